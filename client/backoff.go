@@ -0,0 +1,65 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff configures the delays between the reconnection attempts of a client.
+// The delay starts with InitialDelay and is multiplied by the Multiplier after each attempt, up to the MaxDelay.
+// Before each attempt the client waits a random duration between zero and the current delay (full jitter),
+// so that the clients of a restarted server do not reconnect all at the same time.
+// After a connection was stable for the StableDuration, the delay is reset to the InitialDelay.
+type Backoff struct {
+	InitialDelay   time.Duration
+	MaxDelay       time.Duration
+	Multiplier     float64
+	StableDuration time.Duration
+}
+
+// DefaultBackoff is the reconnection backoff used by New
+var DefaultBackoff = Backoff{
+	InitialDelay:   50 * time.Millisecond,
+	MaxDelay:       30 * time.Second,
+	Multiplier:     2,
+	StableDuration: 10 * time.Second,
+}
+
+// BackoffState is the current position of a client in its reconnection schedule
+type BackoffState struct {
+	// Attempts is the number of reconnection attempts since the last reset
+	Attempts int
+	// Delay is the upper bound for the wait before the next attempt
+	Delay time.Duration
+	// LastWait is the jittered wait before the last attempt
+	LastWait time.Duration
+}
+
+// next returns the state after an attempt, which waited for the given duration
+func (b Backoff) next(state BackoffState, wait time.Duration) BackoffState {
+	delay := time.Duration(float64(state.Delay) * b.Multiplier)
+	if delay > b.MaxDelay || delay < 0 {
+		delay = b.MaxDelay
+	}
+	if delay < b.InitialDelay {
+		delay = b.InitialDelay
+	}
+	return BackoffState{
+		Attempts: state.Attempts + 1,
+		Delay:    delay,
+		LastWait: wait,
+	}
+}
+
+// reset returns the state before the first attempt
+func (b Backoff) reset() BackoffState {
+	return BackoffState{Delay: b.InitialDelay}
+}
+
+// fullJitter returns a random duration in [0, max]
+func fullJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
@@ -6,7 +6,16 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 
+	"github.com/hashicorp/go-multierror"
+
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +24,17 @@ var logger = log.WithFields(log.Fields{
 	"module": "client",
 })
 
+const (
+	// fetchRangeTimeout is the maximum duration of a FetchRange call
+	fetchRangeTimeout = 30 * time.Second
+
+	// subscribeAllTimeout is the maximum time SubscribeAll waits for the acknowledgements of a batch
+	subscribeAllTimeout = 10 * time.Second
+
+	// pongWriteTimeout is the maximum duration for answering a ping of the server
+	pongWriteTimeout = 10 * time.Second
+)
+
 type WSConnection interface {
 	WriteMessage(messageType int, data []byte) error
 	ReadMessage() (messageType int, p []byte, err error)
@@ -22,14 +42,49 @@ type WSConnection interface {
 }
 
 func DefaultConnectionFactory(url string, origin string) (WSConnection, error) {
-	logger.WithField("url", url).Info("Connecting to")
+	return dial(context.Background(), url, connectionHeader(origin, false))
+}
+
+// CompressingConnectionFactory connects like the DefaultConnectionFactory,
+// but requests the server to send large message bodies gzip compressed.
+func CompressingConnectionFactory(url string, origin string) (WSConnection, error) {
+	return dial(context.Background(), url, connectionHeader(origin, true))
+}
+
+// contextConnectionFactory returns a factory connecting like the Default- or the CompressingConnectionFactory,
+// which aborts the dial and the handshake when the context is canceled or its deadline is exceeded.
+func contextConnectionFactory(ctx context.Context, compress bool) WSConnectionFactory {
+	return func(url string, origin string) (WSConnection, error) {
+		return dial(ctx, url, connectionHeader(origin, compress))
+	}
+}
 
+func connectionHeader(origin string, compress bool) http.Header {
 	header := http.Header{"Origin": []string{origin}}
-	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if compress {
+		header.Set(protocol.CompressionHeader, protocol.CompressionGzip)
+	}
+	return header
+}
+
+// dial connects to the url, requesting the supported subprotocol versions, the newest first
+func dial(ctx context.Context, url string, header http.Header) (WSConnection, error) {
+	logger.WithField("url", url).Info("Connecting to")
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = protocol.Subprotocols()
+	conn, resp, err := dialer.DialContext(ctx, url, header)
 	if err != nil {
+		if resp != nil {
+			return nil, newDialError(err, resp)
+		}
 		return nil, err
 	}
-	logger.WithField("url", url).Info("Connected to")
+	if _, ok := protocol.Codec(conn.Subprotocol()); !ok {
+		conn.Close()
+		return nil, newSubprotocolError(conn.Subprotocol())
+	}
+	logger.WithFields(log.Fields{"url": url, "subprotocol": conn.Subprotocol()}).Info("Connected to")
 
 	return conn, nil
 }
@@ -38,21 +93,93 @@ type WSConnectionFactory func(url string, origin string) (WSConnection, error)
 
 type Client interface {
 	Start() error
+
+	// Close closes the connection at once, dropping the sends still being written
+	// and the acknowledgements of the server not yet received.
 	Close()
 
+	// Shutdown closes the client gracefully: the new sends are rejected with ErrClientClosing,
+	// the sends in progress are written, and the acknowledgements of the server for all sent messages are awaited,
+	// before the connection is closed and the receive goroutine has exited.
+	// As the server handles the commands of a connection in order, each message sent without error
+	// was handled by the server (published, or rejected by an error notification), when Shutdown returns nil.
+	// If the context is done before, the connection is closed anyway and the error of the context is returned;
+	// if the connection is lost meanwhile, ErrSendsNotAcknowledged is returned.
+	Shutdown(ctx context.Context) error
+
 	Subscribe(path string) error
+	SubscribeWithAck(path string) error
+	Ack(path string, id uint64) error
+	SubscribeAll(paths []protocol.Path) error
+	SubscribeAllTimeout(paths []protocol.Path, timeout time.Duration) error
+	SubscribeMany(paths ...protocol.Path) error
+	FetchRange(path string, start, end uint64) ([]protocol.Message, error)
 	Unsubscribe(path string) error
+	UnsubscribeAndWait(path protocol.Path, timeout time.Duration) error
+
+	// UnsubscribeAll cancels all subscriptions of the connection with a single command, e.g. when the user logs out.
+	// The server confirms it by a single canceled-all notification, with the number of the canceled subscriptions.
+	UnsubscribeAll() error
 
 	Send(path string, body string, header string) error
 	SendBytes(path string, body []byte, header string) error
 
+	// SendBinary sends the body flagged as binary data, which is stored and delivered as raw bytes
+	// and received with the Binary flag of the message.
+	SendBinary(path protocol.Path, body []byte) error
+
+	// SendWithHeader sends the message with the header fields, serialized as the header json of the message,
+	// e.g. for the header filters of the subscriptions.
+	SendWithHeader(path protocol.Path, body string, header map[string]string) error
+
 	WriteRawMessage(message []byte) error
+
+	// Messages returns the channel of the received data messages, buffered with the channelSize of the client.
+	// While it is full, the client stops reading from the connection, so a slow consumer delays all incoming frames.
 	Messages() chan *protocol.Message
+
+	// WaitForMessage reads the messages of Messages() until one matches the predicate, and returns it.
+	// It returns the error of the context, if it is done before, or ErrClientClosed, if the client is closed.
+	// The messages not matching are not lost: they are passed to Messages() again after the wait, in their order,
+	// but behind the messages received meanwhile. So the channel should not be read by another goroutine during the wait.
+	WaitForMessage(ctx context.Context, match func(*protocol.Message) bool) (*protocol.Message, error)
+
+	// StatusUpdates returns the channel of the status notifications of the server, e.g. the subscription confirmations,
+	// buffered with the channelSize of the client. New notifications are dropped while it is full.
+	StatusUpdates() <-chan *protocol.NotificationMessage
+
+	// StatusMessages returns the same channel as StatusUpdates.
+	// Deprecated: use StatusUpdates.
 	StatusMessages() chan *protocol.NotificationMessage
-	Errors() chan *protocol.NotificationMessage
+
+	// Errors returns the channel of the error notifications of the server and of the client errors,
+	// e.g. connection or decoding errors named `clientError`, buffered with the channelSize of the client.
+	// New errors are dropped while it is full.
+	Errors() <-chan *protocol.NotificationMessage
+
+	// SessionRecoveries returns the channel of the outcomes of restoring the session of a client opened with a session id,
+	// one for each connect, buffered with the channelSize of the client. New outcomes are dropped while it is full.
+	SessionRecoveries() <-chan SessionRecovery
 
 	SetWSConnectionFactory(WSConnectionFactory)
 	IsConnected() bool
+
+	// LastPong returns the time the client last answered a ping of the server, or the zero time if it did not yet.
+	LastPong() time.Time
+
+	// Throttled returns true, while the server does not read from the connection because its ingest queue is full,
+	// between the slow-down and the resume notifications. The sends are written, but not handled by the server meanwhile.
+	Throttled() bool
+
+	SetBackoff(Backoff)
+	BackoffState() BackoffState
+
+	// SetURLs sets the pool of server urls, which the client switches through when the server asks it
+	// to reconnect with the reconnect notification, e.g. before the server is stopped.
+	SetURLs(urls []string)
+
+	// ProtocolVersion returns the websocket subprotocol negotiated by the current connection, e.g. guble.v1
+	ProtocolVersion() string
 }
 
 type client struct {
@@ -69,28 +196,159 @@ type client struct {
 	wSConnectionFactory func(url string, origin string) (WSConnection, error)
 	// flag, to indicate if the client is connected
 	connected bool
+	// pending SubscribeAll and UnsubscribeAndWait calls, waiting for the server's response
+	subscribeWaiters map[protocol.Path]chan error
+	cancelWaiters    map[protocol.Path]chan error
+	// pending FetchRange calls, with the messages received for them until the server's done notification
+	fetchWaiters map[protocol.Path]chan error
+	fetches      map[protocol.Path]*pendingFetch
+	// the reconnection schedule and the time of the last successful connect
+	backoff      Backoff
+	backoffState BackoffState
+	connectedAt  time.Time
+	jitter       func(max time.Duration) time.Duration
+	// the time of the last pong sent to the server
+	lastPong time.Time
+	// if the server paused reading from the connection, by the slow-down notification
+	throttled bool
+	// the context of OpenWithContext; the reconnection stops when it is done
+	ctx context.Context
+	// the pool of urls to reconnect to, and the maximum delay of a reconnect requested by the server
+	urls              []string
+	reconnectMaxDelay *time.Duration
+	// the frame codec of the subprotocol negotiated by the current connection
+	codec protocol.FrameCodec
+	// the optional store of the positions, with the subscriptions resumed from it
+	positions     PositionStore
+	subscriptions map[protocol.Path]subscription
+	// the metadata of the connection (e.g. the app version), passed in the query of the url on each connect
+	metadata map[string]string
+	// the stable session of the client, whose subscriptions are restored by the server on each connect,
+	// the outcomes of restoring it, and if the client subscribes again after a reconnect if it is not restored
+	sessionID          string
+	sessionRecoveries  chan SessionRecovery
+	resubscribePending bool
+	// the graceful shutdown: the sends being written, the sent messages not yet acknowledged by the server,
+	// and the channel closed when the last of them is acknowledged while closing
+	closing      bool
+	sending      sync.WaitGroup
+	pendingSends int
+	sendsLost    bool
+	acked        chan struct{}
+	// closedC is closed by Close, and readDone when the receive goroutine has exited
+	closedC   chan struct{}
+	closeOnce sync.Once
+	readDone  chan struct{}
+}
+
+// sendAckErrors are the error notifications, by which the server answers a rejected send command.
+// Some of them can also answer another command, which ends the wait of Shutdown for an acknowledgement earlier.
+var sendAckErrors = map[string]bool{
+	protocol.ERROR_BAD_REQUEST:               true,
+	protocol.ERROR_ACCESS_DENIED:             true,
+	protocol.ERROR_MAX_MESSAGE_SIZE_EXCEEDED: true,
+	protocol.ERROR_RATE_LIMITED:              true,
+	protocol.ERROR_QUOTA_EXCEEDED:            true,
+}
+
+// reconnectRequest is returned by the readLoop, when the connection was closed for the reconnect notification
+type reconnectRequest struct {
+	maxDelay time.Duration
+}
+
+func (r *reconnectRequest) Error() string {
+	return fmt.Sprintf("The server asked to reconnect within %v.", r.maxDelay)
+}
+
+// subprotocolConnection is implemented by the connections with a negotiated subprotocol, e.g. websocket.Conn
+type subprotocolConnection interface {
+	Subprotocol() string
 }
 
-// Open is a shortcut for New() and Start()
-func Open(url, origin string, channelSize int, autoReconnect bool) (Client, error) {
-	c := New(url, origin, channelSize, autoReconnect)
-	c.SetWSConnectionFactory(DefaultConnectionFactory)
+// pingHandlerSetter is implemented by the connections able to answer the pings of the server, e.g. websocket.Conn
+type pingHandlerSetter interface {
+	SetPingHandler(h func(appData string) error)
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// Open is a shortcut for New() and Start().
+// If compress is set, the server is asked to compress the large message bodies,
+// which are decompressed by the client before delivering them.
+// The backoff configures the delays between the reconnection attempts.
+// With a PositionStore, the subscriptions to a path are resumed after the last processed message of the path,
+// and re-subscribed after a reconnect; a nil positions keeps the subscriptions starting with the future messages.
+// The metadata (e.g. the app version or the device model) is listed by the server with the subscribers of the connection;
+// it is limited as checked by protocol.ValidateMetadata, and may be nil.
+// With a sessionID (as checked by protocol.ValidateSessionID), the server restores the subscriptions of the session
+// with their positions on each connect, also after a restart of the server, reporting it by SessionRecoveries;
+// an empty sessionID opens the client without a session.
+func Open(url, origin string, channelSize int, autoReconnect bool, compress bool, backoff Backoff, positions PositionStore, metadata map[string]string, sessionID string) (Client, error) {
+	return OpenWithContext(context.Background(), url, origin, channelSize, autoReconnect, compress, backoff, positions, metadata, sessionID)
+}
+
+// OpenWithContext is like Open, but the dial and the handshake are aborted when the context is canceled
+// or its deadline is exceeded. The reconnection attempts of an autoReconnect client stop with the context, too.
+func OpenWithContext(ctx context.Context, url, origin string, channelSize int, autoReconnect bool, compress bool, backoff Backoff, positions PositionStore, metadata map[string]string, sessionID string) (Client, error) {
+	if err := protocol.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if sessionID != "" {
+		if err := protocol.ValidateSessionID(sessionID); err != nil {
+			return nil, err
+		}
+	}
+	c := newClient(url, origin, channelSize, autoReconnect)
+	c.ctx = ctx
+	c.positions = positions
+	c.metadata = metadata
+	c.sessionID = sessionID
+	c.SetBackoff(backoff)
+	c.SetWSConnectionFactory(contextConnectionFactory(ctx, compress))
 	return c, c.Start()
 }
 
 // New creates a new client, without starting the connection
 func New(url, origin string, channelSize int, autoReconnect bool) Client {
+	return newClient(url, origin, channelSize, autoReconnect)
+}
+
+func newClient(url, origin string, channelSize int, autoReconnect bool) *client {
 	return &client{
-		messages:       make(chan *protocol.Message, channelSize),
-		statusMessages: make(chan *protocol.NotificationMessage, channelSize),
-		errors:         make(chan *protocol.NotificationMessage, channelSize),
-		url:            url,
-		origin:         origin,
-		shouldStopChan: make(chan bool, 1),
-		autoReconnect:  autoReconnect,
+		messages:          make(chan *protocol.Message, channelSize),
+		statusMessages:    make(chan *protocol.NotificationMessage, channelSize),
+		errors:            make(chan *protocol.NotificationMessage, channelSize),
+		sessionRecoveries: make(chan SessionRecovery, channelSize),
+		url:               url,
+		origin:            origin,
+		shouldStopChan:    make(chan bool, 1),
+		autoReconnect:     autoReconnect,
+		subscribeWaiters:  make(map[protocol.Path]chan error),
+		cancelWaiters:     make(map[protocol.Path]chan error),
+		fetchWaiters:      make(map[protocol.Path]chan error),
+		fetches:           make(map[protocol.Path]*pendingFetch),
+		backoff:           DefaultBackoff,
+		backoffState:      DefaultBackoff.reset(),
+		jitter:            fullJitter,
+		ctx:               context.Background(),
+		codec:             v1Codec(),
+		subscriptions:     make(map[protocol.Path]subscription),
+		closedC:           make(chan struct{}),
+		readDone:          closedChan(),
 	}
 }
 
+// closedChan returns a closed channel, for a receive goroutine not started
+func closedChan() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+func v1Codec() protocol.FrameCodec {
+	codec, _ := protocol.Codec(protocol.SubprotocolV1)
+	return codec
+}
+
 func (c *client) SetWSConnectionFactory(connection WSConnectionFactory) {
 	c.wSConnectionFactory = connection
 }
@@ -101,35 +359,240 @@ func (c *client) IsConnected() bool {
 	return c.connected
 }
 
+// Throttled returns true between the slow-down and the resume notifications of the server on the current connection
+func (c *client) Throttled() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.throttled
+}
+
+func (c *client) setThrottled(throttled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.throttled = throttled
+}
+
+// ProtocolVersion returns the subprotocol negotiated by the current connection, e.g. protocol.SubprotocolV1.
+// A connection to a server, which does not negotiate a subprotocol, uses protocol.SubprotocolV1.
+func (c *client) ProtocolVersion() string {
+	return c.frameCodec().Subprotocol()
+}
+
+func (c *client) frameCodec() protocol.FrameCodec {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.codec
+}
+
+// setConnection uses the connection and the codec of its subprotocol
+func (c *client) setConnection(ws WSConnection) {
+	codec := v1Codec()
+	if sc, ok := ws.(subprotocolConnection); ok {
+		if negotiated, ok := protocol.Codec(sc.Subprotocol()); ok {
+			codec = negotiated
+		}
+	}
+	c.ws = ws
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = codec
+}
+
 func (c *client) setIsConnected(connected bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.connected = connected
+	if connected {
+		c.connectedAt = time.Now()
+	}
+	// a new connection is not throttled, until the server says so
+	c.throttled = false
+}
+
+// SetBackoff configures the reconnection schedule and resets it to the initial delay
+func (c *client) SetBackoff(backoff Backoff) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff = backoff
+	c.backoffState = backoff.reset()
+}
+
+// SetURLs sets the pool of urls, from which the next one is used after the reconnect notification of the server.
+// With autoReconnect, the client closes the connection for the notification and reconnects after a random delay
+// of up to the one given by the server; without it the client is disconnected.
+func (c *client) SetURLs(urls []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.urls = urls
+}
+
+// nextURL switches to the url following the current one in the pool, if there is one
+func (c *client) nextURL() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.urls) == 0 {
+		return
+	}
+	next := 0
+	for i, url := range c.urls {
+		if url == c.url {
+			next = (i + 1) % len(c.urls)
+			break
+		}
+	}
+	c.url = c.urls[next]
+}
+
+func (c *client) currentURL() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.url
+}
+
+// connectionURL returns the current url, with the metadata and the session of the connection added to its query
+func (c *client) connectionURL() string {
+	current := c.currentURL()
+	if len(c.metadata) == 0 && c.sessionID == "" {
+		return current
+	}
+	u, err := url.Parse(current)
+	if err != nil {
+		return current
+	}
+	keys := make([]string, 0, len(c.metadata))
+	for key := range c.metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	query := u.RawQuery
+	for _, key := range keys {
+		if query != "" {
+			query += "&"
+		}
+		query += url.QueryEscape(protocol.MetadataQueryPrefix+key) + "=" + url.QueryEscape(c.metadata[key])
+	}
+	if c.sessionID != "" {
+		if query != "" {
+			query += "&"
+		}
+		query += protocol.SessionIDParam + "=" + url.QueryEscape(c.sessionID)
+	}
+	u.RawQuery = query
+	return u.String()
+}
+
+// requestReconnect remembers the reconnect notification, which is handled by the readLoop
+func (c *client) requestReconnect(message *protocol.NotificationMessage) {
+	millis, err := strconv.ParseInt(message.Arg, 10, 64)
+	if err != nil || millis < 0 {
+		millis = 0
+	}
+	maxDelay := time.Duration(millis) * time.Millisecond
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnectMaxDelay = &maxDelay
+}
+
+// takeReconnect returns the maximum delay of a requested reconnect
+func (c *client) takeReconnect() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reconnectMaxDelay == nil {
+		return 0, false
+	}
+	maxDelay := *c.reconnectMaxDelay
+	c.reconnectMaxDelay = nil
+	return maxDelay, true
+}
+
+// BackoffState returns the current position in the reconnection schedule
+func (c *client) BackoffState() BackoffState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.backoffState
+}
+
+// nextBackoff advances the reconnection schedule and returns the jittered duration to wait before the next attempt.
+// The schedule starts again with the initial delay, if the last connection was stable long enough.
+func (c *client) nextBackoff() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connectedAt.IsZero() && time.Since(c.connectedAt) >= c.backoff.StableDuration {
+		c.backoffState = c.backoff.reset()
+	}
+	c.connectedAt = time.Time{}
+
+	wait := c.jitter(c.backoffState.Delay)
+	c.backoffState = c.backoff.next(c.backoffState, wait)
+	return wait
+}
+
+// LastPong returns the time the client last answered a ping of the server
+func (c *client) LastPong() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastPong
+}
+
+// answerPings replies to the pings of the server on the connection with a pong, recording its time.
+// The pings are handled while reading from the connection.
+func (c *client) answerPings(ws WSConnection) {
+	conn, ok := ws.(pingHandlerSetter)
+	if !ok {
+		return
+	}
+	conn.SetPingHandler(func(appData string) error {
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(pongWriteTimeout))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.lastPong = time.Now()
+		return nil
+	})
 }
 
 // Connect and start the read go routine.
 // If an error occurs on first connect, it will be returned.
 // Further connection errors will only be logged.
+// With autoReconnect, a lost connection is re-established using the backoff schedule.
 func (c *client) Start() error {
-	var err error
-	c.ws, err = c.wSConnectionFactory(c.url, c.origin)
+	ws, err := c.wSConnectionFactory(c.connectionURL(), c.origin)
+	c.setConnection(ws)
 	c.setIsConnected(err == nil)
+	if err == nil {
+		c.answerPings(c.ws)
+	}
 
-	if c.IsConnected() {
-		go c.readLoop()
-	} else if c.autoReconnect {
-		go c.startWithReconnect()
+	if c.autoReconnect {
+		c.readDone = make(chan struct{})
+		go func() {
+			defer close(c.readDone)
+			c.startWithReconnect()
+		}()
+	} else if c.IsConnected() {
+		c.readDone = make(chan struct{})
+		go func() {
+			defer close(c.readDone)
+			c.readLoop()
+		}()
 	}
 	return err
 }
 
 func (c *client) startWithReconnect() {
 	for {
+		var reconnect *reconnectRequest
 		if c.IsConnected() {
 			err := c.readLoop()
 			if err == nil {
 				return
 			}
+			reconnect, _ = err.(*reconnectRequest)
 		}
 
 		if c.shouldStop() {
@@ -137,17 +600,41 @@ func (c *client) startWithReconnect() {
 			return
 		}
 
-		var err error
-		c.ws, err = c.wSConnectionFactory(c.url, c.origin)
+		var wait time.Duration
+		if reconnect != nil {
+			// the delay is random, so that not all clients of the server reconnect at once
+			wait = c.jitter(reconnect.maxDelay)
+			c.nextURL()
+			logger.WithFields(log.Fields{"url": c.currentURL(), "wait": wait}).Info("Reconnecting as asked by the server")
+		} else {
+			wait = c.nextBackoff()
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.shouldStopChan:
+			c.shouldStopFlag = true
+			return
+		case <-c.ctx.Done():
+			logger.WithError(c.ctx.Err()).Info("Context done, stopping the reconnection")
+			return
+		}
+
+		ws, err := c.wSConnectionFactory(c.connectionURL(), c.origin)
+		c.setConnection(ws)
 		if err != nil {
 			c.setIsConnected(false)
 
-			logger.WithError(err).Error("Error on connect, retry in 50 ms")
-
-			time.Sleep(time.Millisecond * 50)
+			logger.WithError(err).WithField("backoffState", c.BackoffState()).Error("Error on connect, retrying")
 		} else {
+			c.answerPings(c.ws)
 			c.setIsConnected(true)
 			logger.Warn("Reconnected again")
+			// with a session, the client subscribes again only if the server does not restore the session
+			if c.sessionID == "" {
+				c.resubscribe()
+			} else {
+				c.setResubscribePending(true)
+			}
 		}
 	}
 }
@@ -157,18 +644,27 @@ func (c *client) readLoop() error {
 		_, msg, err := c.ws.ReadMessage()
 		if err != nil {
 			c.setIsConnected(false)
+			c.loseSends()
 			if c.shouldStop() {
 				return nil
 			}
 
 			logger.WithError(err).Error("Error when reading from websocket")
 
-			c.errors <- clientErrorMessage(err.Error())
-			return err
+			c.notifyError(clientErrorMessage(err.Error()))
+			return newConnectionError(err)
 		}
 
 		logger.WithField("msg", string(msg)).Debug("Raw >")
 		c.handleIncomingMessage(msg)
+
+		// the messages sent before the reconnect notification are received, so the connection can be closed
+		if maxDelay, ok := c.takeReconnect(); ok {
+			c.setIsConnected(false)
+			c.loseSends()
+			c.ws.Close()
+			return &reconnectRequest{maxDelay: maxDelay}
+		}
 	}
 }
 
@@ -186,47 +682,381 @@ func (c *client) shouldStop() bool {
 }
 
 func (c *client) handleIncomingMessage(msg []byte) {
-	parsed, err := protocol.Decode(msg)
+	parsed, err := c.frameCodec().Decode(msg)
 	if err != nil {
 		logger.WithError(err).Error("Error on parsing of incoming message")
-		c.errors <- clientErrorMessage(err.Error())
+		c.notifyError(clientErrorMessage(err.Error()))
 		return
 	}
 
 	switch message := parsed.(type) {
 	case *protocol.Message:
-		c.messages <- message
+		if err := message.DecompressBody(); err != nil {
+			logger.WithError(err).Error("Error on decompressing of incoming message")
+			c.notifyError(clientErrorMessage(err.Error()))
+			return
+		}
+		if c.collectFetched(message) {
+			return
+		}
+		select {
+		case c.messages <- message:
+		case <-c.closedC:
+			return
+		}
+		c.trackPosition(message)
 	case *protocol.NotificationMessage:
+		if message.Name == protocol.SUCCESS_RECONNECT && !message.IsError {
+			c.requestReconnect(message)
+		}
+		if message.Name == protocol.SUCCESS_SLOW_DOWN || message.Name == protocol.SUCCESS_RESUME {
+			c.setThrottled(message.Name == protocol.SUCCESS_SLOW_DOWN && !message.IsError)
+		}
+		if c.sessionID != "" {
+			c.recoverSession(message)
+		}
+		c.notifyWaiter(message)
+		if message.Name == protocol.SUCCESS_SEND || (message.IsError && sendAckErrors[message.Name]) {
+			c.ackSend()
+		}
 		if message.IsError {
-			select {
-			case c.errors <- message:
-			default:
-			}
+			c.notifyError(message)
 		} else {
 			select {
 			case c.statusMessages <- message:
 			default:
+				logger.WithField("notification", message.Name).Debug("Status channel is full, dropping notification")
 			}
 		}
 	}
 }
 
+// notifyError passes the error to the errors channel, or drops it if the channel is full
+func (c *client) notifyError(message *protocol.NotificationMessage) {
+	select {
+	case c.errors <- message:
+	default:
+		logger.WithField("error", message.Name).Debug("Errors channel is full, dropping error")
+	}
+}
+
+// Subscribe sends the receive command for the path, which can be followed by the arguments of the command,
+// e.g. a position: `/foo @latest` for the future messages only, which is the default, `/foo @earliest` for all
+// retained messages before the future ones, or `/foo -10` for the last ten messages before the future ones.
+// With a PositionStore, the subscription to a single path without arguments continues after its stored position.
 func (c *client) Subscribe(path string) error {
+	arg := c.resumableArg(path, false)
 	cmd := &protocol.Cmd{
 		Name: protocol.CmdReceive,
-		Arg:  path,
+		Arg:  arg,
+	}
+	return c.writeCmd(cmd)
+}
+
+// SubscribeWithAck subscribes to the path with at-least-once delivery.
+// The received messages have to be acknowledged with Ack. On a new subscription with ack,
+// the server delivers all messages after the last acknowledged one, e.g. after a reconnect.
+func (c *client) SubscribeWithAck(path string) error {
+	arg := c.resumableArg(path, true)
+	cmd := &protocol.Cmd{
+		Name:       protocol.CmdReceive,
+		Arg:        arg,
+		HeaderJSON: protocol.AckHeader,
+	}
+	return c.writeCmd(cmd)
+}
+
+// Ack acknowledges the message with the id and all messages received before it,
+// for the subscription with at-least-once delivery to the path, which the message was received for.
+func (c *client) Ack(path string, id uint64) error {
+	cmd := &protocol.Cmd{
+		Name: protocol.CmdAck,
+		Arg:  path + " " + strconv.FormatUint(id, 10),
+	}
+	if err := c.writeCmd(cmd); err != nil {
+		return err
+	}
+	c.ackPosition(protocol.Path(path), id)
+	return nil
+}
+
+// SubscribeMany subscribes to all paths with a single command, without waiting for the server's response.
+// The server confirms or rejects each path with its own notification, so a path rejected
+// e.g. by the access control does not prevent the subscriptions to the others.
+func (c *client) SubscribeMany(paths ...protocol.Path) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	args := make([]string, len(paths))
+	for i, path := range paths {
+		if !validPath(path) || strings.Contains(string(path), protocol.PathListSeparator) {
+			return fmt.Errorf("%v: %w", path, ErrInvalidPath)
+		}
+		args[i] = string(path)
+	}
+	if c.positions != nil {
+		// each path continues after its own position
+		for _, path := range paths {
+			if err := c.Subscribe(string(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.Subscribe(strings.Join(args, protocol.PathListSeparator))
+}
+
+// SubscribeAll sends the subscribe commands for all paths at once
+// and blocks until the server acknowledged all of them, for at most 10 seconds.
+// A failure for one path does not abort the batch, the returned multierror lists all failed paths.
+func (c *client) SubscribeAll(paths []protocol.Path) error {
+	return c.SubscribeAllTimeout(paths, subscribeAllTimeout)
+}
+
+// SubscribeAllTimeout is SubscribeAll, waiting at most for the timeout for the acknowledgements.
+// The paths not acknowledged in time fail with ErrSubscribeTimeout.
+func (c *client) SubscribeAllTimeout(paths []protocol.Path, timeout time.Duration) error {
+	var multierr *multierror.Error
+	waiters := make(map[protocol.Path]chan error, len(paths))
+	pending := make([]protocol.Path, 0, len(paths))
+	defer func() {
+		for path, waiter := range waiters {
+			c.removeWaiter(c.subscribeWaiters, path, waiter)
+		}
+	}()
+
+	for _, path := range paths {
+		if _, exists := waiters[path]; exists {
+			continue
+		}
+		if !validPath(path) {
+			multierr = multierror.Append(multierr, fmt.Errorf("%v: %w", path, ErrInvalidPath))
+			continue
+		}
+		waiters[path] = c.addWaiter(c.subscribeWaiters, path)
+		if err := c.Subscribe(string(path)); err != nil {
+			multierr = multierror.Append(multierr, fmt.Errorf("%v: %w", path, err))
+			continue
+		}
+		pending = append(pending, path)
+	}
+
+	timeoutC := time.After(timeout)
+	timedOut := false
+	for _, path := range pending {
+		var err error
+		if timedOut {
+			select {
+			case err = <-waiters[path]:
+			default:
+				err = ErrSubscribeTimeout
+			}
+		} else {
+			select {
+			case err = <-waiters[path]:
+			case <-timeoutC:
+				timedOut = true
+				err = ErrSubscribeTimeout
+			}
+		}
+		if err != nil {
+			multierr = multierror.Append(multierr, fmt.Errorf("%v: %w", path, err))
+		}
+	}
+	return multierr.ErrorOrNil()
+}
+
+// pendingFetch is the range of a pending FetchRange call, with the messages received for it
+type pendingFetch struct {
+	start, end uint64
+	messages   []protocol.Message
+}
+
+// matches returns true, if the message of the path (or one of its subtopics) is in the range of the fetch
+func (f *pendingFetch) matches(path protocol.Path, message *protocol.Message) bool {
+	if message.Path != path && !strings.HasPrefix(string(message.Path), string(path)+"/") {
+		return false
+	}
+	return message.ID >= f.start && message.ID <= f.end
+}
+
+// FetchRange replays the messages of the path with ids from start up to end (both inclusive),
+// without subscribing to further messages. An end after the last stored message is clamped to it.
+// Until the server has sent the range, the messages of the path and its subtopics with ids in the range
+// are returned by FetchRange instead of being delivered to Messages().
+func (c *client) FetchRange(path string, start, end uint64) ([]protocol.Message, error) {
+	p := protocol.Path(path)
+	if !validPath(p) {
+		return nil, ErrInvalidPath
+	}
+	fetch := &pendingFetch{start: start, end: end}
+	c.mu.Lock()
+	c.fetches[p] = fetch
+	c.mu.Unlock()
+	waiter := c.addWaiter(c.fetchWaiters, p)
+	defer func() {
+		c.removeWaiter(c.fetchWaiters, p, waiter)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.fetches[p] == fetch {
+			delete(c.fetches, p)
+		}
+	}()
+
+	cmd := &protocol.Cmd{
+		Name: protocol.CmdReceive,
+		Arg:  fmt.Sprintf("%s %d..%d", path, start, end),
+	}
+	if err := c.writeCmd(cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case err := <-waiter:
+		if err != nil {
+			return nil, err
+		}
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return fetch.messages, nil
+	case <-time.After(fetchRangeTimeout):
+		return nil, ErrFetchRangeTimeout
 	}
-	err := c.ws.WriteMessage(websocket.BinaryMessage, cmd.Bytes())
-	return err
 }
 
+// collectFetched adds the message to a pending FetchRange call matching its path and id,
+// and returns true if there is one
+func (c *client) collectFetched(message *protocol.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, fetch := range c.fetches {
+		if fetch.matches(path, message) {
+			fetch.messages = append(fetch.messages, *message)
+			return true
+		}
+	}
+	return false
+}
+
+// Unsubscribe sends the cancel command without waiting for the server's confirmation
 func (c *client) Unsubscribe(path string) error {
+	return c.UnsubscribeAndWait(protocol.Path(path), 0)
+}
+
+// UnsubscribeAndWait sends the cancel command and blocks until the server confirms it.
+// ErrSubscriptionNotFound is returned if the server has no subscription for the path
+// and ErrUnsubscribeTimeout if no response was received in time.
+// A timeout of zero returns right after the command has been sent.
+func (c *client) UnsubscribeAndWait(path protocol.Path, timeout time.Duration) error {
+	c.forgetSubscription(path)
 	cmd := &protocol.Cmd{
 		Name: protocol.CmdCancel,
-		Arg:  path,
+		Arg:  string(path),
+	}
+	if timeout <= 0 {
+		return c.writeCmd(cmd)
+	}
+
+	waiter := c.addWaiter(c.cancelWaiters, path)
+	defer c.removeWaiter(c.cancelWaiters, path, waiter)
+
+	if err := c.writeCmd(cmd); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-waiter:
+		return err
+	case <-time.After(timeout):
+		return ErrUnsubscribeTimeout
+	}
+}
+
+// UnsubscribeAll sends the cancel command for all subscriptions, without waiting for the server's confirmation
+func (c *client) UnsubscribeAll() error {
+	c.forgetSubscriptions()
+	return c.writeCmd(&protocol.Cmd{
+		Name: protocol.CmdCancel,
+		Arg:  protocol.CancelAllArg,
+	})
+}
+
+func (c *client) addWaiter(waiters map[protocol.Path]chan error, path protocol.Path) chan error {
+	waiter := make(chan error, 1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters[path] = waiter
+	return waiter
+}
+
+func (c *client) removeWaiter(waiters map[protocol.Path]chan error, path protocol.Path, waiter chan error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if waiters[path] == waiter {
+		delete(waiters, path)
+	}
+}
+
+// validPath returns true, if the server accepts the path as receive argument
+func validPath(path protocol.Path) bool {
+	return len(path) > 0 && path[0] == '/' && !strings.Contains(string(path), " ")
+}
+
+// notifyWaiter resolves a pending SubscribeAll or UnsubscribeAndWait call, if the notification answers it.
+// The first word of the notification argument is the path it refers to; the server starts the bad request
+// error of a subscribe command with its path. A bad request without the path of a pending subscribe
+// command resolves no waiter.
+func (c *client) notifyWaiter(message *protocol.NotificationMessage) {
+	args := strings.SplitN(message.Arg, " ", 2)
+	path := protocol.Path(args[0])
+
+	var waiters map[protocol.Path]chan error
+	var err error
+	switch {
+	case !message.IsError && message.Name == protocol.SUCCESS_SUBSCRIBED_TO:
+		waiters = c.subscribeWaiters
+	case message.IsError && message.Name == protocol.ERROR_SUBSCRIBED_TO:
+		waiters = c.subscribeWaiters
+		serverErr := &ServerError{Code: message.Name, Message: message.Arg}
+		if len(args) > 1 {
+			serverErr.Message = args[1]
+		}
+		err = serverErr
+	case message.IsError && message.Name == protocol.ERROR_ACCESS_DENIED:
+		waiters = c.subscribeWaiters
+		err = ErrAccessDenied
+	case !message.IsError && message.Name == protocol.SUCCESS_DONE:
+		waiters = c.fetchWaiters
+	case !message.IsError && message.Name == protocol.SUCCESS_CANCELED:
+		waiters = c.cancelWaiters
+	case message.IsError && message.Name == protocol.ERROR_SUBSCRIPTION_NOT_FOUND:
+		waiters = c.cancelWaiters
+		err = ErrSubscriptionNotFound
+	case message.IsError && message.Name == protocol.ERROR_BAD_REQUEST:
+		waiters = c.subscribeWaiters
+		serverErr := &ServerError{Code: message.Name, Message: message.Arg}
+		if len(args) > 1 {
+			serverErr.Message = args[1]
+		}
+		err = serverErr
+	default:
+		return
+	}
+
+	// a waiter is resolved only once, and a fetch collects no messages after its done notification
+	c.mu.Lock()
+	waiter, ok := waiters[path]
+	delete(waiters, path)
+	if message.Name == protocol.SUCCESS_DONE {
+		delete(c.fetches, path)
+	}
+	c.mu.Unlock()
+	if ok {
+		select {
+		case waiter <- err:
+		default:
+		}
 	}
-	err := c.ws.WriteMessage(websocket.BinaryMessage, cmd.Bytes())
-	return err
 }
 
 func (c *client) Send(path string, body string, header string) error {
@@ -241,28 +1071,180 @@ func (c *client) SendBytes(path string, body []byte, header string) error {
 		HeaderJSON: header,
 	}
 
-	return c.WriteRawMessage(cmd.Bytes())
+	return c.writeSend(cmd)
+}
+
+// writeSend writes the send command, counting it as pending until the server acknowledges it.
+// It is rejected with ErrClientClosing, when the client is shut down.
+func (c *client) writeSend(cmd *protocol.Cmd) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrClientClosing
+	}
+	c.sending.Add(1)
+	c.pendingSends++
+	c.mu.Unlock()
+	defer c.sending.Done()
+
+	err := c.writeCmd(cmd)
+	if err != nil {
+		// a send not written is not acknowledged
+		c.ackSend()
+	}
+	return err
+}
+
+// ackSend counts a send as acknowledged by the server, ending the wait of Shutdown with the last one
+func (c *client) ackSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingSends == 0 {
+		return
+	}
+	c.pendingSends--
+	if c.pendingSends == 0 && c.acked != nil {
+		close(c.acked)
+		c.acked = nil
+	}
+}
+
+// loseSends drops the pending sends with the lost connection, as their acknowledgements will not arrive
+func (c *client) loseSends() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingSends == 0 {
+		return
+	}
+	c.pendingSends = 0
+	c.sendsLost = c.sendsLost || c.closing
+	if c.acked != nil {
+		close(c.acked)
+		c.acked = nil
+	}
+}
+
+func (c *client) SendBinary(path protocol.Path, body []byte) error {
+	return c.SendBytes(string(path)+" "+protocol.BinaryArg, body, "")
+}
+
+func (c *client) SendWithHeader(path protocol.Path, body string, header map[string]string) error {
+	headerJSON, err := encodeHeader(header)
+	if err != nil {
+		return err
+	}
+	return c.Send(string(path), body, headerJSON)
+}
+
+// encodeHeader returns the header json of the header fields, or an empty string if there are none
+func encodeHeader(header map[string]string) (string, error) {
+	if len(header) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
 }
 
 func (c *client) WriteRawMessage(message []byte) error {
-	return c.ws.WriteMessage(websocket.BinaryMessage, message)
+	return c.write(message)
+}
+
+// writeCmd sends the command encoded by the codec of the connection
+func (c *client) writeCmd(cmd *protocol.Cmd) error {
+	return c.write(c.frameCodec().EncodeCmd(cmd))
+}
+
+// write sends the message over the websocket connection, returning an error matching ErrConnectionClosed on failure
+func (c *client) write(message []byte) error {
+	return newConnectionError(c.ws.WriteMessage(websocket.BinaryMessage, message))
 }
 
 func (c *client) Messages() chan *protocol.Message {
 	return c.messages
 }
 
+func (c *client) StatusUpdates() <-chan *protocol.NotificationMessage {
+	return c.statusMessages
+}
+
 func (c *client) StatusMessages() chan *protocol.NotificationMessage {
 	return c.statusMessages
 }
 
-func (c *client) Errors() chan *protocol.NotificationMessage {
+func (c *client) Errors() <-chan *protocol.NotificationMessage {
 	return c.errors
 }
 
+// Close stops the receive goroutine and closes the connection.
+// It can be called more than once, e.g. after Shutdown.
 func (c *client) Close() {
-	c.shouldStopChan <- true
-	c.ws.Close()
+	c.closeOnce.Do(func() {
+		close(c.closedC)
+		c.shouldStopChan <- true
+		if c.ws != nil {
+			c.ws.Close()
+		}
+	})
+}
+
+// Shutdown rejects the new sends, waits for the sends in progress and their acknowledgements by the server,
+// and closes the client, returning after the receive goroutine has exited.
+func (c *client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+
+	err := c.awaitSends(ctx)
+	c.Close()
+	select {
+	case <-c.readDone:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// awaitSends waits for the sends being written, and then for the acknowledgements of all sent messages
+func (c *client) awaitSends(ctx context.Context) error {
+	written := make(chan struct{})
+	go func() {
+		c.sending.Wait()
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.pendingSends == 0 {
+		defer c.mu.Unlock()
+		if c.sendsLost {
+			return ErrSendsNotAcknowledged
+		}
+		return nil
+	}
+	acked := make(chan struct{})
+	c.acked = acked
+	c.mu.Unlock()
+
+	select {
+	case <-acked:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.sendsLost {
+		return ErrSendsNotAcknowledged
+	}
+	return nil
 }
 
 func clientErrorMessage(message string) *protocol.NotificationMessage {
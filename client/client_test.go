@@ -1,13 +1,22 @@
 package client
 
 import (
+	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/testutil"
 
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/golang/mock/gomock"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
@@ -52,7 +61,7 @@ func TestConnectErrorWithoutReconnection(t *testing.T) {
 func TestConnectErrorWithoutReconnectionUsingOpen(t *testing.T) {
 	a := assert.New(t)
 
-	c, err := Open("url", "origin", 1, false)
+	c, err := Open("url", "origin", 1, false, false, DefaultBackoff, nil, nil, "")
 
 	// which raises an error on connect
 	callCounter := 0
@@ -71,8 +80,9 @@ func TestConnectErrorWithReconnection(t *testing.T) {
 	defer finish()
 	a := assert.New(t)
 
-	// given a client
+	// given a client, waiting at most 30ms between the reconnection attempts
 	c := New("url", "origin", 1, true)
+	c.SetBackoff(Backoff{InitialDelay: time.Millisecond * 30, MaxDelay: time.Millisecond * 30, Multiplier: 1})
 
 	// which raises an error twice and then allows to connect
 	callCounter := 0
@@ -95,7 +105,7 @@ func TestConnectErrorWithReconnection(t *testing.T) {
 	a.Error(err)
 	a.False(c.IsConnected())
 
-	// when we wait for two iterations and 10ms buffer time to connect
+	// when we wait for three backoff delays and 20ms buffer time to connect
 	time.Sleep(time.Millisecond * 110)
 
 	// then we got connected
@@ -191,7 +201,7 @@ func TestReceiveAMessage(t *testing.T) {
 
 	// and we receive the notification
 	select {
-	case m := <-c.StatusMessages():
+	case m := <-c.StatusUpdates():
 		a.Equal(aSendNotification, string(m.Bytes()))
 	case <-time.After(time.Millisecond * 10):
 		a.Fail("timeout while waiting for message")
@@ -227,20 +237,45 @@ func TestSendAMessage(t *testing.T) {
 	// when expects a message
 	connMock := NewMockWSConnection(ctrl)
 	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo\n{}\nTest"))
+	closed := make(chan bool)
 	connMock.EXPECT().
 		ReadMessage().
-		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
-		Do(func() {
-			time.Sleep(time.Millisecond * 50)
-		}).
-		AnyTimes()
+		Do(func() { <-closed }).
+		Return(0, nil, fmt.Errorf("closed"))
+	connMock.EXPECT().Close().Do(func() { close(closed) })
 	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
 
 	c.Start()
 	// then the expectation is meet by sending it
 	c.Send("/foo", "Test", "{}")
-	// stop client after 200ms
-	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+
+	// stop client, before the mocks are finished
+	c.Close()
+	time.Sleep(time.Millisecond * 10)
+}
+
+func TestSendAMessageWithHeader(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	c := newClient("url", "origin", 1, false)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// when sending a message with header fields, then they are serialized as the header line of the frame
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo\n{\"device_id\":\"42\",\"region\":\"eu\"}\nTest"))
+	a.NoError(c.SendWithHeader("/foo", "Test", map[string]string{"region": "eu", "device_id": "42"}))
+
+	// and without header fields, the header line is empty
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo\n\nTest"))
+	a.NoError(c.SendWithHeader("/foo", "Test", nil))
+
+	// and the frame is parsed by the server into the same header json
+	cmd, err := protocol.ParseCmd([]byte("> /foo\n{\"device_id\":\"42\",\"region\":\"eu\"}\nTest"))
+	a.NoError(err)
+	a.Equal(`{"device_id":"42","region":"eu"}`, cmd.HeaderJSON)
+	a.Equal("Test", string(cmd.Body))
 }
 
 func TestSendSubscribeMessage(t *testing.T) {
@@ -253,20 +288,20 @@ func TestSendSubscribeMessage(t *testing.T) {
 	// when expects a message
 	connMock := NewMockWSConnection(ctrl)
 	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo"))
+	closed := make(chan bool)
 	connMock.EXPECT().
 		ReadMessage().
-		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
-		Do(func() {
-			time.Sleep(time.Millisecond * 50)
-		}).
-		AnyTimes()
+		Do(func() { <-closed }).
+		Return(0, nil, fmt.Errorf("closed"))
+	connMock.EXPECT().Close().Do(func() { close(closed) })
 	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
 
 	c.Start()
 	c.Subscribe("/foo")
 
-	// stop client after 200ms
-	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+	// stop client, before the mocks are finished
+	c.Close()
+	time.Sleep(time.Millisecond * 10)
 }
 
 func TestSendUnSubscribeMessage(t *testing.T) {
@@ -279,18 +314,913 @@ func TestSendUnSubscribeMessage(t *testing.T) {
 	// when expects a message
 	connMock := NewMockWSConnection(ctrl)
 	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("- /foo"))
+	closed := make(chan bool)
 	connMock.EXPECT().
 		ReadMessage().
-		Return(websocket.BinaryMessage, []byte(aNormalMessage), nil).
-		Do(func() {
-			time.Sleep(time.Millisecond * 50)
-		}).
-		AnyTimes()
+		Do(func() { <-closed }).
+		Return(0, nil, fmt.Errorf("closed"))
+	connMock.EXPECT().Close().Do(func() { close(closed) })
 	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
 
 	c.Start()
 	c.Unsubscribe("/foo")
 
-	// stop client after 200ms
-	time.AfterFunc(time.Millisecond*200, func() { c.Close() })
+	// stop client, before the mocks are finished
+	c.Close()
+	time.Sleep(time.Millisecond * 10)
+}
+
+func TestSendUnsubscribeAllMessage(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	// given a client
+	c := New("url", "origin", 1, true)
+
+	// when expects a message
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("- *"))
+	closed := make(chan bool)
+	connMock.EXPECT().
+		ReadMessage().
+		Do(func() { <-closed }).
+		Return(0, nil, fmt.Errorf("closed"))
+	connMock.EXPECT().Close().Do(func() { close(closed) })
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+
+	c.Start()
+	c.UnsubscribeAll()
+
+	// stop client, before the mocks are finished
+	c.Close()
+	time.Sleep(time.Millisecond * 10)
+}
+
+func TestUnsubscribeAndWait(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	testcases := []struct {
+		desc     string
+		response string
+		expected error
+	}{
+		{"confirmed by the server", "#canceled /foo", nil},
+		{"unknown subscription", "!error-subscription-not-found /foo", ErrSubscriptionNotFound},
+		{"response for another path", "#canceled /bar", ErrUnsubscribeTimeout},
+	}
+
+	for _, tc := range testcases {
+		// given a client, where the server responds to the cancel command
+		c := New("url", "origin", 10, false).(*client)
+		response := tc.response
+
+		connMock := NewMockWSConnection(ctrl)
+		connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("- /foo")).
+			Do(func(int, []byte) {
+				go c.handleIncomingMessage([]byte(response))
+			})
+		c.ws = connMock
+
+		// when we unsubscribe and wait
+		err := c.UnsubscribeAndWait(protocol.Path("/foo"), time.Millisecond*50)
+
+		// then the response is mapped to the expected result
+		a.Equal(tc.expected, err, tc.desc)
+	}
+}
+
+func TestUnsubscribeWithZeroTimeoutDoesNotWait(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, where the server never responds
+	c := New("url", "origin", 1, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("- /foo"))
+	c.ws = connMock
+
+	// when we unsubscribe without a timeout
+	err := c.UnsubscribeAndWait(protocol.Path("/foo"), 0)
+
+	// then the call returns immediately and no waiter is left
+	a.NoError(err)
+	a.Equal(0, len(c.cancelWaiters))
+}
+
+func TestSubscribeAll(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// where the server acknowledges the subscriptions after all commands were sent, in different order
+	written := make(chan bool, 3)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo")).Do(func(int, []byte) { written <- true })
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /bar")).Do(func(int, []byte) { written <- true })
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /baz")).Do(func(int, []byte) { written <- true })
+	go func() {
+		for i := 0; i < 3; i++ {
+			<-written
+		}
+		c.handleIncomingMessage([]byte("#subscribed-to /baz"))
+		c.handleIncomingMessage([]byte("!error-subscribed-to /bar subscription denied"))
+		c.handleIncomingMessage([]byte("#subscribed-to /foo"))
+	}()
+
+	// when we subscribe to all paths
+	err := c.SubscribeAll([]protocol.Path{"/foo", "/bar", "/baz"})
+
+	// then only the failed path is reported
+	a.Error(err)
+	a.Contains(err.Error(), "/bar: subscription denied")
+	a.NotContains(err.Error(), "/foo")
+	a.NotContains(err.Error(), "/baz")
+	a.Equal(0, len(c.subscribeWaiters))
+}
+
+func TestSubscribeMany(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// then all paths are sent in a single command
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo,/bar,/baz"))
+	a.NoError(c.SubscribeMany("/foo", "/bar", "/baz"))
+
+	// and nothing is sent for an invalid path
+	err := c.SubscribeMany("/foo", "/with,comma")
+	a.Error(err)
+	a.Contains(err.Error(), "/with,comma: "+ErrInvalidPath.Error())
+	a.NoError(c.SubscribeMany())
+}
+
+func TestSubscribeAllAccessDenied(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	written := make(chan bool, 2)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any()).Do(func(int, []byte) { written <- true }).Times(2)
+	go func() {
+		<-written
+		<-written
+		c.handleIncomingMessage([]byte("!error-access-denied /private"))
+		c.handleIncomingMessage([]byte("#subscribed-to /foo"))
+	}()
+
+	// when the access to one of the paths is denied, then it is reported without waiting for the timeout
+	err := c.SubscribeAllTimeout([]protocol.Path{"/foo", "/private"}, time.Second)
+	a.Error(err)
+	a.Contains(err.Error(), "/private: "+ErrAccessDenied.Error())
+	a.NotContains(err.Error(), "/foo")
+}
+
+func TestSubscribeAllTimeout(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, where the server only acknowledges one of two subscriptions
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo")).
+		Do(func(int, []byte) {
+			go c.handleIncomingMessage([]byte("#subscribed-to /foo"))
+		})
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /bar"))
+
+	// when we subscribe to both
+	err := c.SubscribeAllTimeout([]protocol.Path{"/foo", "/bar"}, time.Millisecond*20)
+
+	// then the missing acknowledgement is reported as timeout
+	a.Error(err)
+	a.Contains(err.Error(), "/bar: "+ErrSubscribeTimeout.Error())
+	a.NotContains(err.Error(), "/foo")
+}
+
+func TestSubscribeAllBadRequest(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, where the server rejects the second command with a bad request before acknowledging the first one,
+	// and another command without a path
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	written := make(chan bool, 2)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo")).Do(func(int, []byte) { written <- true })
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /bar")).Do(func(int, []byte) { written <- true })
+	go func() {
+		for i := 0; i < 2; i++ {
+			<-written
+		}
+		c.handleIncomingMessage([]byte("!error-bad-request /bar rejected"))
+		c.handleIncomingMessage([]byte("!error-bad-request unrelated"))
+		c.handleIncomingMessage([]byte("#subscribed-to /foo"))
+	}()
+
+	// when we subscribe to the valid and invalid paths
+	start := time.Now()
+	err := c.SubscribeAllTimeout([]protocol.Path{"/foo", "no-slash", "/with space", "/bar"}, time.Second)
+
+	// then the invalid paths are not sent and the bad request is assigned to its path, without waiting for the timeout
+	a.True(time.Since(start) < time.Second)
+	a.Error(err)
+	a.Contains(err.Error(), "no-slash: "+ErrInvalidPath.Error())
+	a.Contains(err.Error(), "/with space: "+ErrInvalidPath.Error())
+	a.Contains(err.Error(), "/bar: rejected")
+	a.NotContains(err.Error(), "/foo")
+}
+
+func TestFetchRange(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// where the server replays the range, while messages of other paths and ids of the topic are received
+	done := make(chan struct{})
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo 100..200")).Do(func(int, []byte) {
+		go func() {
+			defer close(done)
+			c.handleIncomingMessage([]byte("#fetch-start /foo 2"))
+			c.handleIncomingMessage([]byte("/foo,100,user01,phone01,{},1420110000,0\n\nHello"))
+			c.handleIncomingMessage([]byte("/bar,7,user01,phone01,{},1420110000,0\n\nOther"))
+			c.handleIncomingMessage([]byte("/foobar,120,user01,phone01,{},1420110000,0\n\nOther path"))
+			c.handleIncomingMessage([]byte("/foo,300,user01,phone01,{},1420110000,0\n\nOther id"))
+			c.handleIncomingMessage([]byte("/foo/sub,150,user01,phone01,{},1420110000,0\n\nWorld"))
+			c.handleIncomingMessage([]byte("#fetch-end /foo"))
+			c.handleIncomingMessage([]byte("#done /foo"))
+			c.handleIncomingMessage([]byte("/foo,160,user01,phone01,{},1420110000,0\n\nAfter the fetch"))
+		}()
+	})
+
+	// when fetching the range
+	messages, err := c.FetchRange("/foo", 100, 200)
+
+	// then the messages of the topic are returned
+	a.NoError(err)
+	if a.Len(messages, 2) {
+		a.Equal(uint64(100), messages[0].ID)
+		a.Equal("Hello", string(messages[0].Body))
+		a.Equal(uint64(150), messages[1].ID)
+		a.Equal(protocol.Path("/foo/sub"), messages[1].Path)
+	}
+
+	// and the other messages, and the ones received after the done notification, are still delivered
+	<-done
+	for _, body := range []string{"Other", "Other path", "Other id", "After the fetch"} {
+		select {
+		case msg := <-c.Messages():
+			a.Equal(body, string(msg.Body))
+		default:
+			a.Fail("message not delivered", body)
+		}
+	}
+	a.Equal(0, len(c.fetchWaiters))
+	a.Equal(0, len(c.fetches))
+
+	// and an invalid path is not sent
+	_, err = c.FetchRange("no-slash", 1, 2)
+	a.Equal(ErrInvalidPath, err)
+}
+
+func TestReceiveACompressedMessage(t *testing.T) {
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+
+	// when a compressed message is received
+	msg := &protocol.Message{ID: 42, Path: "/foo", Body: []byte("Hello World")}
+	a.NoError(msg.CompressBody())
+	c.handleIncomingMessage(msg.Bytes())
+
+	// then it is delivered decompressed
+	select {
+	case m := <-c.Messages():
+		a.False(m.Compressed)
+		a.Equal("Hello World", string(m.Body))
+	case <-time.After(time.Millisecond * 10):
+		a.Fail("timeout while waiting for message")
+	}
+
+	// and a corrupted body is reported as error
+	c.handleIncomingMessage([]byte("/foo,43,,,,0,0,gzip\n\nnot gzip"))
+	select {
+	case <-c.Errors():
+	case <-time.After(time.Millisecond * 10):
+		a.Fail("timeout while waiting for error")
+	}
+}
+
+func TestClientIsThrottledBetweenSlowDownAndResume(t *testing.T) {
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 10, false).(*client)
+	a.False(c.Throttled())
+
+	// when the server asks it to slow down, then it is throttled
+	c.handleIncomingMessage([]byte("#slow-down 1200"))
+	a.True(c.Throttled())
+	a.Equal("1200", (<-c.StatusUpdates()).Arg)
+
+	// until the server resumes reading
+	c.handleIncomingMessage([]byte("#resume"))
+	a.False(c.Throttled())
+
+	// or the client connects again
+	c.handleIncomingMessage([]byte("#slow-down 1200"))
+	c.setIsConnected(true)
+	a.False(c.Throttled())
+}
+
+func TestFullNotificationChannelsDropInsteadOfBlocking(t *testing.T) {
+	a := assert.New(t)
+
+	// given a client with full errors and status channels
+	c := New("url", "origin", 1, false).(*client)
+	c.handleIncomingMessage([]byte("!error-bad-request first"))
+	c.handleIncomingMessage([]byte("#subscribed-to /first"))
+
+	// when more notifications and client errors are received
+	c.handleIncomingMessage([]byte("!error-bad-request second"))
+	c.handleIncomingMessage([]byte("#subscribed-to /second"))
+	c.handleIncomingMessage([]byte("---"))
+
+	// then they are dropped, and the data messages are still delivered
+	c.handleIncomingMessage([]byte(aNormalMessage))
+	a.Equal(aNormalMessage, string((<-c.Messages()).Bytes()))
+
+	a.Equal("first", (<-c.Errors()).Arg)
+	a.Equal(0, len(c.Errors()))
+	a.Equal("/first", (<-c.StatusUpdates()).Arg)
+	a.Equal(0, len(c.StatusUpdates()))
+}
+
+func TestReconnectBackoffSchedule(t *testing.T) {
+	a := assert.New(t)
+
+	// given a client without jitter
+	c := New("url", "origin", 1, true).(*client)
+	c.SetBackoff(Backoff{
+		InitialDelay:   time.Millisecond * 10,
+		MaxDelay:       time.Millisecond * 50,
+		Multiplier:     2,
+		StableDuration: time.Minute,
+	})
+	c.jitter = func(max time.Duration) time.Duration { return max }
+	a.Equal(BackoffState{Delay: time.Millisecond * 10}, c.BackoffState())
+
+	// when failing to reconnect, then the delay grows exponentially up to the max delay
+	for i, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		a.Equal(expected*time.Millisecond, c.nextBackoff())
+		a.Equal(i+1, c.BackoffState().Attempts)
+	}
+	a.Equal(time.Millisecond*50, c.BackoffState().Delay)
+
+	// when a connection is lost shortly after connecting, then the schedule continues
+	c.setIsConnected(true)
+	c.setIsConnected(false)
+	a.Equal(time.Millisecond*50, c.nextBackoff())
+	a.Equal(6, c.BackoffState().Attempts)
+
+	// when a connection was stable for the stable duration, then the schedule starts again
+	c.setIsConnected(true)
+	c.connectedAt = time.Now().Add(-time.Minute)
+	c.setIsConnected(false)
+	a.Equal(time.Millisecond*10, c.nextBackoff())
+	a.Equal(BackoffState{Attempts: 1, Delay: time.Millisecond * 20, LastWait: time.Millisecond * 10}, c.BackoffState())
+}
+
+func TestReconnectBackoffFullJitter(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(time.Duration(0), fullJitter(0))
+	for i := 0; i < 100; i++ {
+		wait := fullJitter(time.Millisecond)
+		a.True(wait >= 0 && wait <= time.Millisecond)
+	}
+
+	// the client waits the jittered duration, while the delay follows the schedule
+	c := New("url", "origin", 1, true).(*client)
+	wait := c.nextBackoff()
+	a.True(wait <= DefaultBackoff.InitialDelay)
+	a.Equal(BackoffState{Attempts: 1, Delay: DefaultBackoff.InitialDelay * 2, LastWait: wait}, c.BackoffState())
+}
+
+func TestSubscribeWithAckAndAck(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client
+	c := New("url", "origin", 1, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// then the subscribe command enables the at-least-once delivery
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo\n"+protocol.AckHeader))
+	a.NoError(c.SubscribeWithAck("/foo"))
+
+	// and the ack command contains the path and the message id
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("a /foo 42"))
+	a.NoError(c.Ack("/foo", 42))
+}
+
+func TestClientAnswersThePingsOfTheServer(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server sending a ping after connecting
+	pongs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := &websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetPongHandler(func(appData string) error {
+			pongs <- appData
+			return nil
+		})
+		conn.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	c := New("ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost", 1, false)
+	c.SetWSConnectionFactory(DefaultConnectionFactory)
+	a.True(c.LastPong().IsZero())
+
+	// when the client is connected
+	if !a.NoError(c.Start()) {
+		return
+	}
+	defer c.Close()
+
+	// then it answers the ping and records the time of the pong
+	select {
+	case appData := <-pongs:
+		a.Equal("ping", appData)
+	case <-time.After(time.Second):
+		a.Fail("No pong received")
+	}
+	a.WithinDuration(time.Now(), c.LastPong(), time.Second)
+}
+
+func TestOpenWithContextAbortsTheHandshake(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server accepting the connections, but never answering the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !a.NoError(err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	// when opening a client with a deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = OpenWithContext(ctx, "ws://"+listener.Addr().String(), "http://localhost", 1, false, false, DefaultBackoff, nil, nil, "")
+
+	// then the handshake is aborted at the deadline
+	a.Error(err)
+	a.True(time.Since(start) < time.Second)
+}
+
+func TestReconnectionStopsWithTheContext(t *testing.T) {
+	a := assert.New(t)
+
+	// given a reconnecting client, which can not connect
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newClient("url", "origin", 1, true)
+	c.ctx = ctx
+	c.SetBackoff(Backoff{InitialDelay: time.Millisecond * 5, MaxDelay: time.Millisecond * 5, Multiplier: 1})
+	var attempts int32
+	c.SetWSConnectionFactory(func(url string, origin string) (WSConnection, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, fmt.Errorf("emulate connection error")
+	})
+	a.Error(c.Start())
+	time.Sleep(30 * time.Millisecond)
+	a.True(atomic.LoadInt32(&attempts) > 1)
+
+	// when the context is canceled
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	afterCancel := atomic.LoadInt32(&attempts)
+
+	// then there are no further attempts
+	time.Sleep(30 * time.Millisecond)
+	a.Equal(afterCancel, atomic.LoadInt32(&attempts))
+}
+
+func TestErrorsCanBeMatched(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// the timeouts and the denied access match the general errors
+	a.True(errors.Is(ErrSubscribeTimeout, ErrTimeout))
+	a.True(errors.Is(ErrUnsubscribeTimeout, ErrTimeout))
+	a.True(errors.Is(ErrFetchRangeTimeout, ErrTimeout))
+	a.True(errors.Is(ErrAccessDenied, ErrAuthFailed))
+	a.False(errors.Is(ErrSubscriptionNotFound, ErrTimeout))
+
+	// given a client with a broken connection
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+	broken := errors.New("broken pipe")
+	connMock.EXPECT().WriteMessage(gomock.Any(), gomock.Any()).Return(broken).Times(2)
+
+	// when sending and subscribing, then the errors match the closed connection and their cause
+	err := c.Send("/foo", "Hello", "")
+	a.True(errors.Is(err, ErrConnectionClosed))
+	a.True(errors.Is(err, broken))
+	a.Equal("broken pipe", err.Error())
+	a.True(errors.Is(c.Subscribe("/foo"), ErrConnectionClosed))
+
+	// and the read loop returns a closed connection for a read error
+	connMock.EXPECT().ReadMessage().Return(0, nil, broken)
+	a.True(errors.Is(c.readLoop(), ErrConnectionClosed))
+}
+
+func TestSubscribeAllReturnsServerErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, where the server rejects one subscription and denies the other
+	c := New("url", "origin", 10, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	written := make(chan bool, 2)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any()).Do(func(int, []byte) { written <- true }).Times(2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			<-written
+		}
+		c.handleIncomingMessage([]byte("!error-subscribed-to /foo rejected"))
+		c.handleIncomingMessage([]byte("!error-access-denied /bar"))
+	}()
+
+	// when subscribing
+	err := c.SubscribeAllTimeout([]protocol.Path{"/foo", "/bar"}, time.Second)
+
+	// then the error of the server can be extracted
+	var serverErr *ServerError
+	if a.True(errors.As(err, &serverErr)) {
+		a.Equal(protocol.ERROR_SUBSCRIBED_TO, serverErr.Code)
+		a.Equal("rejected", serverErr.Message)
+	}
+	// and the denied access is matched
+	a.True(errors.Is(err, ErrAuthFailed))
+	a.False(errors.Is(err, ErrTimeout))
+}
+
+func TestOpenReturnsAuthFailedForAnUnauthorizedHandshake(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server rejecting the handshake
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	// when opening a client, then the authentication failed
+	_, err := Open("ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost", 1, false, false, DefaultBackoff, nil, nil, "")
+	a.True(errors.Is(err, ErrAuthFailed))
+}
+
+func TestOpenPassesTheMetadataInTheQuery(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server recording the query of the handshake
+	queryC := make(chan url.Values, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queryC <- r.URL.Query()
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	// when opening a client with metadata
+	Open("ws"+strings.TrimPrefix(server.URL, "http")+"/stream/?access_token=secret", "http://localhost", 1, false, false, DefaultBackoff, nil,
+		map[string]string{"app_version": "1.2", "device": "phone 7"}, "")
+
+	// then it is added to the query of the url
+	query := <-queryC
+	a.Equal("secret", query.Get("access_token"))
+	a.Equal("1.2", query.Get(protocol.MetadataQueryPrefix+"app_version"))
+	a.Equal("phone 7", query.Get(protocol.MetadataQueryPrefix+"device"))
+
+	// but invalid metadata is rejected without connecting
+	_, err := Open("ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost", 1, false, false, DefaultBackoff, nil,
+		map[string]string{"App Version": "1.2"}, "")
+	a.Equal(protocol.ErrInvalidMetadata, err)
+	a.Len(queryC, 0)
+}
+
+func TestOpenNegotiatesTheProtocolVersion(t *testing.T) {
+	a := assert.New(t)
+
+	// given servers selecting a subprotocol of the client, or none like an older server
+	for _, serverProtocols := range [][]string{{"guble.v9", protocol.SubprotocolV1}, nil} {
+		var requested []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = websocket.Subprotocols(r)
+			upgrader := &websocket.Upgrader{Subprotocols: serverProtocols, CheckOrigin: func(r *http.Request) bool { return true }}
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.ReadMessage()
+		}))
+
+		// when opening a client
+		c, err := Open("ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost", 1, false, false, DefaultBackoff, nil, nil, "")
+
+		// then it requested its versions, and uses the version 1
+		if a.NoError(err) {
+			a.Equal(protocol.Subprotocols(), requested)
+			a.Equal(protocol.SubprotocolV1, c.ProtocolVersion())
+			c.Close()
+		}
+		server.Close()
+	}
+}
+
+func TestOpenReturnsUnsupportedProtocolWithoutASharedVersion(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server rejecting the handshake, and a server selecting an unknown version
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(protocol.SubprotocolsHeader, "guble.v9")
+		http.Error(w, protocol.ErrUnsupportedSubprotocol.Error(), http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	selecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := &websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": []string{"guble.v9"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer selecting.Close()
+
+	// when opening a client, then the protocol is unsupported
+	for _, server := range []*httptest.Server{rejecting, selecting} {
+		_, err := Open("ws"+strings.TrimPrefix(server.URL, "http"), "http://localhost", 1, false, false, DefaultBackoff, nil, nil, "")
+		a.True(errors.Is(err, ErrUnsupportedProtocol), fmt.Sprint(err))
+		a.False(errors.Is(err, ErrAuthFailed))
+	}
+}
+
+func TestReconnectToTheNextURLAsAskedByTheServer(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client with a pool of urls, connected to the first one
+	c := New("ws://node1", "origin", 10, true).(*client)
+	c.SetURLs([]string{"ws://node1", "ws://node2"})
+	waits := make(chan time.Duration, 1)
+	c.jitter = func(max time.Duration) time.Duration {
+		waits <- max
+		return 0
+	}
+
+	// which receives a message and then the reconnect notification
+	first := NewMockWSConnection(ctrl)
+	gomock.InOrder(
+		first.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte("/foo,42,user01,phone01,,1420110000,1\n\nHello"), nil),
+		first.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte("#reconnect 5000"), nil),
+		first.EXPECT().Close(),
+	)
+	second := NewMockWSConnection(ctrl)
+	reconnected := make(chan bool)
+	second.EXPECT().ReadMessage().Do(func() { <-reconnected }).Return(0, nil, fmt.Errorf("closed"))
+	second.EXPECT().Close().Do(func() { close(reconnected) }).AnyTimes()
+
+	urls := make(chan string, 2)
+	connections := []WSConnection{first, second}
+	c.SetWSConnectionFactory(func(url string, origin string) (WSConnection, error) {
+		urls <- url
+		conn := connections[0]
+		connections = connections[1:]
+		return conn, nil
+	})
+
+	// when starting, then the message is received before the connection is closed
+	a.NoError(c.Start())
+	select {
+	case m := <-c.Messages():
+		a.Equal("Hello", string(m.Body))
+	case <-time.After(time.Second):
+		a.Fail("no message received")
+	}
+
+	// and the client reconnects within the delay of the server, to the next url
+	select {
+	case wait := <-waits:
+		a.Equal(5*time.Second, wait)
+	case <-time.After(time.Second):
+		a.Fail("no reconnect")
+	}
+	a.Equal("ws://node1", <-urls)
+	select {
+	case url := <-urls:
+		a.Equal("ws://node2", url)
+	case <-time.After(time.Second):
+		a.Fail("not reconnected")
+	}
+	time.Sleep(time.Millisecond * 10)
+	a.True(c.IsConnected())
+
+	// and the notification is no error
+	select {
+	case e := <-c.Errors():
+		a.Fail("unexpected error", e.Name)
+	default:
+	}
+	c.Close()
+}
+
+func TestShutdownWaitsForTheAcknowledgementOfTheSends(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a connected client, whose send is acknowledged by the server on demand
+	c := New("url", "origin", 10, false)
+	connMock := NewMockWSConnection(ctrl)
+	ack := make(chan bool)
+	closed := make(chan bool)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("> /foo\n\nTest"))
+	gomock.InOrder(
+		connMock.EXPECT().ReadMessage().Do(func() { <-ack }).Return(websocket.BinaryMessage, []byte("#send"), nil),
+		connMock.EXPECT().ReadMessage().Do(func() { <-closed }).Return(0, nil, fmt.Errorf("closed")),
+	)
+	connMock.EXPECT().Close().Do(func() { close(closed) })
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+	a.NoError(c.Start())
+	a.NoError(c.Send("/foo", "Test", ""))
+
+	// when shutting down, then it waits for the acknowledgement
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Shutdown(context.Background())
+	}()
+	select {
+	case <-done:
+		a.FailNow("returned before the acknowledgement")
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	// and new sends are rejected meanwhile
+	a.Equal(ErrClientClosing, c.Send("/foo", "Test", ""))
+
+	// and it closes the connection after the acknowledgement
+	close(ack)
+	select {
+	case err := <-done:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.Fail("not shut down")
+	}
+	a.False(c.IsConnected())
+
+	// and a later Close does nothing
+	c.Close()
+}
+
+func TestShutdownClosesTheConnectionWhenTheContextIsDone(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a connected client, whose send is never acknowledged
+	c := New("url", "origin", 10, false)
+	connMock := NewMockWSConnection(ctrl)
+	closed := make(chan bool)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any())
+	connMock.EXPECT().ReadMessage().Do(func() { <-closed }).Return(0, nil, fmt.Errorf("closed"))
+	connMock.EXPECT().Close().Do(func() { close(closed) })
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+	a.NoError(c.Start())
+	a.NoError(c.Send("/foo", "Test", ""))
+
+	// when shutting down with a deadline, then the error of the context is returned and the connection is closed
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	a.Equal(context.DeadlineExceeded, c.Shutdown(ctx))
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		a.Fail("connection not closed")
+	}
+}
+
+func TestShutdownReturnsAnErrorWhenTheConnectionIsLost(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a connected client with a send not yet acknowledged
+	c := New("url", "origin", 10, false)
+	connMock := NewMockWSConnection(ctrl)
+	lost := make(chan bool)
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, gomock.Any())
+	connMock.EXPECT().ReadMessage().Do(func() { <-lost }).Return(0, nil, fmt.Errorf("connection reset"))
+	connMock.EXPECT().Close()
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+	a.NoError(c.Start())
+	a.NoError(c.Send("/foo", "Test", ""))
+
+	// when the connection is lost while shutting down, then the send is reported as not acknowledged
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Shutdown(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 10)
+	close(lost)
+	select {
+	case err := <-done:
+		a.Equal(ErrSendsNotAcknowledged, err)
+		a.True(errors.Is(err, ErrConnectionClosed))
+	case <-time.After(time.Second):
+		a.Fail("not shut down")
+	}
+}
+
+func TestCloseStopsTheReceiveGoroutineBlockedOnTheMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client, whose messages channel is full and not read
+	c := New("url", "origin", 1, false).(*client)
+	connMock := NewMockWSConnection(ctrl)
+	closed := make(chan bool)
+	gomock.InOrder(
+		connMock.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(aNormalMessage), nil),
+		connMock.EXPECT().ReadMessage().Return(websocket.BinaryMessage, []byte(aNormalMessage), nil),
+		connMock.EXPECT().ReadMessage().Do(func() { <-closed }).Return(0, nil, fmt.Errorf("closed")).AnyTimes(),
+	)
+	connMock.EXPECT().Close().Do(func() { close(closed) })
+	c.SetWSConnectionFactory(MockConnectionFactory(connMock))
+	a.NoError(c.Start())
+	time.Sleep(time.Millisecond * 10)
+
+	// when closing, then the receive goroutine exits
+	c.Close()
+	select {
+	case <-c.readDone:
+	case <-time.After(time.Second):
+		a.Fail("receive goroutine not stopped")
+	}
 }
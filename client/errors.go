@@ -0,0 +1,137 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/smancke/guble/protocol"
+)
+
+var (
+	// ErrTimeout is matched by errors.Is for all errors of calls, which timed out waiting for the server
+	ErrTimeout = errors.New("Timeout waiting for the server.")
+
+	// ErrConnectionClosed is matched by errors.Is for the errors of writing to or reading from
+	// the websocket connection, which is closed or lost
+	ErrConnectionClosed = errors.New("Connection closed.")
+
+	// ErrAuthFailed is matched by errors.Is, when the server rejected the connection as unauthorized,
+	// or denied the access to a path
+	ErrAuthFailed = errors.New("Authentication failed.")
+
+	// ErrUnsupportedProtocol is matched by errors.Is, when the client and the server share no websocket subprotocol version
+	ErrUnsupportedProtocol = errors.New("Unsupported protocol version.")
+)
+
+var (
+	// ErrSubscriptionNotFound is returned by UnsubscribeAndWait when the server
+	// has no subscription for the given path
+	ErrSubscriptionNotFound = errors.New("Subscription not found.")
+
+	// ErrUnsubscribeTimeout is returned by UnsubscribeAndWait when the server
+	// did not confirm the cancel in the given timeout
+	ErrUnsubscribeTimeout error = &timeoutError{"Timeout waiting for unsubscribe confirmation."}
+
+	// ErrSubscribeTimeout is returned by SubscribeAll for each path the server
+	// did not acknowledge in time
+	ErrSubscribeTimeout error = &timeoutError{"Timeout waiting for subscribe confirmation."}
+
+	// ErrInvalidPath is returned by SubscribeAll for each path, which is not sent
+	// because the server would reject it
+	ErrInvalidPath = errors.New("Invalid path. A path has to start with / and must not contain spaces.")
+
+	// ErrAccessDenied is returned by SubscribeAll for each path the server
+	// denied the subscription to
+	ErrAccessDenied error = &authError{"Access denied."}
+
+	// ErrFetchRangeTimeout is returned by FetchRange when the server
+	// did not finish the replay in the fetchRangeTimeout
+	ErrFetchRangeTimeout error = &timeoutError{"Timeout waiting for the end of the fetched range."}
+
+	// ErrClientClosing is returned by the sends of a client, which is shut down
+	ErrClientClosing = errors.New("Client is closing.")
+
+	// ErrClientClosed is returned by WaitForMessage, when the client is closed during the wait
+	ErrClientClosed error = &connectionError{errors.New("Client closed.")}
+
+	// ErrSendsNotAcknowledged is returned by Shutdown, when the connection was lost
+	// before the server acknowledged all sent messages
+	ErrSendsNotAcknowledged error = &connectionError{errors.New("Connection lost before the sends were acknowledged.")}
+)
+
+// ServerError is an error notification (`!error-...`) sent by the server as response to a command
+type ServerError struct {
+	// Code is the name of the notification, e.g. protocol.ERROR_BAD_REQUEST
+	Code string
+
+	// Message is the argument of the notification
+	Message string
+}
+
+// Error returns the message of the server
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Is matches ErrAuthFailed for a denied access
+func (e *ServerError) Is(target error) bool {
+	return target == ErrAuthFailed && e.Code == protocol.ERROR_ACCESS_DENIED
+}
+
+// timeoutError is a timeout of a call, matching ErrTimeout
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string        { return e.msg }
+func (e *timeoutError) Is(target error) bool { return target == ErrTimeout }
+
+// authError is a rejected authentication or authorization, matching ErrAuthFailed
+type authError struct {
+	msg string
+}
+
+func (e *authError) Error() string        { return e.msg }
+func (e *authError) Is(target error) bool { return target == ErrAuthFailed }
+
+// connectionError is an error of the websocket connection, matching ErrConnectionClosed
+type connectionError struct {
+	err error
+}
+
+func newConnectionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &connectionError{err}
+}
+
+func (e *connectionError) Error() string        { return e.err.Error() }
+func (e *connectionError) Unwrap() error        { return e.err }
+func (e *connectionError) Is(target error) bool { return target == ErrConnectionClosed }
+
+// subprotocolError is a handshake without a shared subprotocol version, matching ErrUnsupportedProtocol
+type subprotocolError struct {
+	msg string
+}
+
+func (e *subprotocolError) Error() string        { return e.msg }
+func (e *subprotocolError) Is(target error) bool { return target == ErrUnsupportedProtocol }
+
+// newSubprotocolError returns the error for a subprotocol selected by the server, which the client does not support
+func newSubprotocolError(subprotocol string) error {
+	return &subprotocolError{fmt.Sprintf("Unsupported protocol version: the server selected %q.", subprotocol)}
+}
+
+// newDialError returns an error matching ErrAuthFailed, if the server rejected the handshake as unauthorized,
+// or matching ErrUnsupportedProtocol, if the server supports none of the requested subprotocols
+func newDialError(err error, resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return &authError{fmt.Sprintf("Authentication failed: the server responded with %d.", resp.StatusCode)}
+	}
+	if supported := resp.Header.Get(protocol.SubprotocolsHeader); resp.StatusCode == http.StatusBadRequest && supported != "" {
+		return &subprotocolError{fmt.Sprintf("Unsupported protocol version: the server supports %s.", supported)}
+	}
+	return err
+}
@@ -0,0 +1,522 @@
+package client
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/hashicorp/go-multierror"
+	"github.com/rs/xid"
+
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrAckNotSupported is returned by the in-process client for the at-least-once delivery,
+	// which is implemented by the websocket connector of the server
+	ErrAckNotSupported = errors.New("The at-least-once delivery is not supported by the in-process client.")
+
+	errNotConnected = newConnectionError(errors.New("The in-process client is not started or closed."))
+)
+
+// inProcessClient is a Client connected directly to a router in the same process.
+// The messages are published and delivered by the routes of the router, as for the websocket connections,
+// but without encoding them and without a network connection.
+type inProcessClient struct {
+	mu             sync.RWMutex
+	router         router.Router
+	userID         string
+	applicationID  string
+	messages       chan *protocol.Message
+	statusMessages chan *protocol.NotificationMessage
+	errors         chan *protocol.NotificationMessage
+	routes         map[protocol.Path]*router.Route
+	connected      bool
+	stopC          chan struct{}
+	backoff        Backoff
+	closing        bool
+	sending        sync.WaitGroup
+}
+
+// NewInProcess returns a Client publishing to and subscribing at the router directly,
+// e.g. for testing the services built on guble without a websocket server.
+// The client has to be started, as the networked one.
+func NewInProcess(r router.Router, userID string) Client {
+	return &inProcessClient{
+		router:         r,
+		userID:         userID,
+		applicationID:  xid.New().String(),
+		messages:       make(chan *protocol.Message, inProcessChannelSize),
+		statusMessages: make(chan *protocol.NotificationMessage, inProcessChannelSize),
+		errors:         make(chan *protocol.NotificationMessage, inProcessChannelSize),
+		routes:         make(map[protocol.Path]*router.Route),
+		stopC:          make(chan struct{}),
+		backoff:        DefaultBackoff,
+	}
+}
+
+const (
+	// inProcessChannelSize is the buffer size of the channels of an in-process client
+	inProcessChannelSize = 100
+
+	// inProcessRouteChannelSize is the channel size of the routes of an in-process client
+	inProcessRouteChannelSize = 10
+)
+
+// Start connects the client, sending the connected notification.
+func (c *inProcessClient) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.stopC:
+		return errNotConnected
+	default:
+	}
+	c.connected = true
+	c.notify(&protocol.NotificationMessage{
+		Name: protocol.SUCCESS_CONNECTED,
+		Arg:  "You are connected to the server.",
+		Json: fmt.Sprintf(`{"ApplicationId": "%s", "UserId": "%s", "Time": "%s"}`, c.applicationID, c.userID, time.Now().Format(time.RFC3339)),
+	})
+	return nil
+}
+
+// Close unsubscribes all routes of the client.
+func (c *inProcessClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		return
+	}
+	c.connected = false
+	close(c.stopC)
+	for path, route := range c.routes {
+		c.router.Unsubscribe(route)
+		delete(c.routes, path)
+	}
+}
+
+// Shutdown rejects the new sends with ErrClientClosing, and closes the client after the sends in progress.
+// As the messages are published synchronously, each returned send is already acknowledged.
+func (c *inProcessClient) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.closing = true
+	c.mu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		c.sending.Wait()
+		close(sent)
+	}()
+	var err error
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Close()
+	return err
+}
+
+// Subscribe subscribes to the path, or to each path of a comma-separated list.
+// As for the networked client, the result is notified on the status and errors channels.
+// The stored messages are not replayed, so the only position accepted after the path is protocol.PositionLatest.
+func (c *inProcessClient) Subscribe(path string) error {
+	path = strings.TrimSuffix(path, " "+protocol.PositionLatest)
+	for _, p := range strings.Split(path, protocol.PathListSeparator) {
+		if p == "" {
+			continue
+		}
+		c.subscribe(protocol.Path(p))
+	}
+	return nil
+}
+
+func (c *inProcessClient) SubscribeWithAck(path string) error {
+	return ErrAckNotSupported
+}
+
+func (c *inProcessClient) Ack(path string, id uint64) error {
+	return ErrAckNotSupported
+}
+
+// SubscribeAllTimeout subscribes to all paths as SubscribeAll.
+// The timeout is not used, as the subscriptions are done synchronously.
+func (c *inProcessClient) SubscribeAllTimeout(paths []protocol.Path, timeout time.Duration) error {
+	return c.SubscribeAll(paths)
+}
+
+// SubscribeAll subscribes to all paths, returning a multierror with all failed paths.
+func (c *inProcessClient) SubscribeAll(paths []protocol.Path) error {
+	var multierr *multierror.Error
+	for _, path := range paths {
+		if err := c.subscribe(path); err != nil {
+			multierr = multierror.Append(multierr, fmt.Errorf("%v: %w", path, err))
+		}
+	}
+	return multierr.ErrorOrNil()
+}
+
+func (c *inProcessClient) SubscribeMany(paths ...protocol.Path) error {
+	for _, path := range paths {
+		if !validPath(path) || strings.Contains(string(path), protocol.PathListSeparator) {
+			return fmt.Errorf("%v: %w", path, ErrInvalidPath)
+		}
+	}
+	for _, path := range paths {
+		c.subscribe(path)
+	}
+	return nil
+}
+
+// subscribe adds a route for the path, delivering its messages to the messages channel
+func (c *inProcessClient) subscribe(path protocol.Path) error {
+	if !validPath(path) {
+		c.notify(errorNotification(protocol.ERROR_BAD_REQUEST, "%v: %v", path, ErrInvalidPath))
+		return ErrInvalidPath
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.connected {
+		c.notify(clientErrorMessage(errNotConnected.Error()))
+		return errNotConnected
+	}
+	if _, exists := c.routes[path]; exists {
+		c.notify(okNotification(protocol.SUCCESS_SUBSCRIBED_TO, string(path)))
+		return nil
+	}
+
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{"application_id": c.applicationID, "user_id": c.userID},
+		Path:        path,
+		ChannelSize: inProcessRouteChannelSize,
+	})
+	if _, err := c.router.Subscribe(route); err != nil {
+		if _, ok := err.(*router.PermissionDeniedError); ok {
+			c.notify(errorNotification(protocol.ERROR_ACCESS_DENIED, "%v", path))
+			return ErrAccessDenied
+		}
+		c.notify(errorNotification(protocol.ERROR_SUBSCRIBED_TO, "%v %v", path, err))
+		return err
+	}
+	c.routes[path] = route
+	go c.deliver(path, route)
+
+	c.notify(okNotification(protocol.SUCCESS_SUBSCRIBED_TO, string(path)))
+	return nil
+}
+
+// deliver passes the messages of the route to the messages channel, until the route is closed
+func (c *inProcessClient) deliver(path protocol.Path, route *router.Route) {
+	for {
+		select {
+		case m, open := <-route.MessagesChannel():
+			if !open {
+				logger.WithField("path", path).Debug("Router closed the route of the in-process client")
+				c.mu.Lock()
+				if c.routes[path] == route {
+					delete(c.routes, path)
+				}
+				c.mu.Unlock()
+				return
+			}
+			select {
+			case c.messages <- m:
+			case <-c.stopC:
+				return
+			}
+		case <-c.stopC:
+			return
+		}
+	}
+}
+
+// FetchRange returns the stored messages of the partition of the path with ids from start up to end (both inclusive).
+func (c *inProcessClient) FetchRange(path string, start, end uint64) ([]protocol.Message, error) {
+	p := protocol.Path(path)
+	if !validPath(p) {
+		return nil, ErrInvalidPath
+	}
+	messageStore, err := c.router.MessageStore()
+	if err != nil {
+		return nil, err
+	}
+	maxID, err := messageStore.MaxMessageID(p.Partition())
+	if err != nil {
+		return nil, err
+	}
+	if maxID == 0 || maxID < start {
+		return nil, nil
+	}
+	if maxID < end {
+		end = maxID
+	}
+
+	req := store.NewFetchRequest(p.Partition(), start, end, store.DirectionForward, -1)
+	req.Init()
+	if err := c.router.Fetch(req); err != nil {
+		return nil, err
+	}
+
+	var messages []protocol.Message
+	timeoutC := time.After(fetchRangeTimeout)
+	for {
+		select {
+		case <-req.StartC:
+		case fetched, open := <-req.MessageC:
+			if !open {
+				return messages, nil
+			}
+			m, err := protocol.ParseMessage(fetched.Message)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, *m)
+		case err := <-req.ErrorC:
+			return nil, err
+		case <-timeoutC:
+			return nil, ErrFetchRangeTimeout
+		}
+	}
+}
+
+// Unsubscribe removes the route of the path.
+func (c *inProcessClient) Unsubscribe(path string) error {
+	c.unsubscribe(protocol.Path(path))
+	return nil
+}
+
+// UnsubscribeAndWait removes the route of the path, returning ErrSubscriptionNotFound if there is none.
+// The timeout is not used, as the route is removed synchronously.
+func (c *inProcessClient) UnsubscribeAndWait(path protocol.Path, timeout time.Duration) error {
+	return c.unsubscribe(path)
+}
+
+// UnsubscribeAll removes all routes of the client, with a single request if the router supports it.
+func (c *inProcessClient) UnsubscribeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := make([]protocol.Path, 0, len(c.routes))
+	for path := range c.routes {
+		paths = append(paths, path)
+	}
+	if batcher, ok := c.router.(router.BatchUnsubscriber); ok {
+		batcher.UnsubscribePaths(router.RouteParams{"application_id": c.applicationID, "user_id": c.userID}, paths)
+	} else {
+		for _, route := range c.routes {
+			c.router.Unsubscribe(route)
+		}
+	}
+	c.routes = make(map[protocol.Path]*router.Route)
+	c.notify(okNotification(protocol.SUCCESS_CANCELED_ALL, strconv.Itoa(len(paths))))
+	return nil
+}
+
+func (c *inProcessClient) unsubscribe(path protocol.Path) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	route, exists := c.routes[path]
+	if !exists {
+		c.notify(errorNotification(protocol.ERROR_SUBSCRIPTION_NOT_FOUND, "%v", path))
+		return ErrSubscriptionNotFound
+	}
+	delete(c.routes, path)
+	c.router.Unsubscribe(route)
+	c.notify(okNotification(protocol.SUCCESS_CANCELED, string(path)))
+	return nil
+}
+
+func (c *inProcessClient) Send(path string, body string, header string) error {
+	return c.SendBytes(path, []byte(body), header)
+}
+
+func (c *inProcessClient) SendWithHeader(path protocol.Path, body string, header map[string]string) error {
+	headerJSON, err := encodeHeader(header)
+	if err != nil {
+		return err
+	}
+	return c.Send(string(path), body, headerJSON)
+}
+
+func (c *inProcessClient) SendBinary(path protocol.Path, body []byte) error {
+	return c.SendBytes(string(path)+" "+protocol.BinaryArg, body, "")
+}
+
+// SendBytes publishes the message to the router, which stores and delivers it as for the websocket connections.
+// As for the networked client, the result is notified on the status and errors channels.
+func (c *inProcessClient) SendBytes(path string, body []byte, header string) error {
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return ErrClientClosing
+	}
+	c.sending.Add(1)
+	c.mu.Unlock()
+	defer c.sending.Done()
+
+	if len(path) == 0 {
+		c.notify(errorNotification(protocol.ERROR_BAD_REQUEST, "send command requires a path argument, but none given"))
+		return nil
+	}
+	msg := &protocol.Message{
+		Path:          protocol.Path(strings.SplitN(path, " ", 2)[0]),
+		ApplicationID: c.applicationID,
+		UserID:        c.userID,
+		HeaderJSON:    header,
+		Body:          body,
+		Binary:        (&protocol.Cmd{Name: protocol.CmdSend, Arg: path}).IsBinary(),
+	}
+	if _, err := msg.Priority(); err != nil {
+		c.notify(errorNotification(protocol.ERROR_BAD_REQUEST, "%v", err))
+		return nil
+	}
+
+	switch err := c.router.HandleMessage(msg).(type) {
+	case nil:
+		c.notify(okNotification(protocol.SUCCESS_SEND, ""))
+	case *router.PermissionDeniedError:
+		c.notify(errorNotification(protocol.ERROR_ACCESS_DENIED, "%v", msg.Path))
+	case *router.MiddlewareError:
+		c.notify(errorNotification(protocol.ERROR_BAD_REQUEST, "%v", err))
+	default:
+		c.notify(errorNotification(protocol.ERROR_INTERNAL_SERVER, "%v", err))
+	}
+	return nil
+}
+
+// WriteRawMessage handles the encoded command, as the server would.
+func (c *inProcessClient) WriteRawMessage(message []byte) error {
+	cmd, err := protocol.ParseCmd(message)
+	if err != nil {
+		return err
+	}
+	switch cmd.Name {
+	case protocol.CmdSend:
+		return c.SendBytes(cmd.Arg, cmd.Body, cmd.HeaderJSON)
+	case protocol.CmdReceive:
+		if cmd.HeaderJSON == protocol.AckHeader {
+			return ErrAckNotSupported
+		}
+		return c.Subscribe(cmd.Arg)
+	case protocol.CmdCancel:
+		return c.Unsubscribe(cmd.Arg)
+	case protocol.CmdAck:
+		args := strings.Fields(cmd.Arg)
+		if len(args) != 2 {
+			return fmt.Errorf("ack command requires a path and a message id, but was %q", cmd.Arg)
+		}
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		return c.Ack(args[0], id)
+	}
+	return fmt.Errorf("unknown command %v", cmd.Name)
+}
+
+func (c *inProcessClient) Messages() chan *protocol.Message {
+	return c.messages
+}
+
+// WaitForMessage reads the messages of the client until one matches, as the networked client.
+func (c *inProcessClient) WaitForMessage(ctx context.Context, match func(*protocol.Message) bool) (*protocol.Message, error) {
+	return waitForMessage(ctx, c.messages, c.stopC, match)
+}
+
+func (c *inProcessClient) StatusUpdates() <-chan *protocol.NotificationMessage {
+	return c.statusMessages
+}
+
+func (c *inProcessClient) StatusMessages() chan *protocol.NotificationMessage {
+	return c.statusMessages
+}
+
+func (c *inProcessClient) Errors() <-chan *protocol.NotificationMessage {
+	return c.errors
+}
+
+// SessionRecoveries returns a nil channel, as the in-process client has no session to restore.
+func (c *inProcessClient) SessionRecoveries() <-chan SessionRecovery {
+	return nil
+}
+
+// SetWSConnectionFactory is a no-op, as the in-process client has no connection.
+func (c *inProcessClient) SetWSConnectionFactory(WSConnectionFactory) {}
+
+func (c *inProcessClient) IsConnected() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.connected
+}
+
+// LastPong returns the zero time, as the router does not ping the in-process client.
+func (c *inProcessClient) LastPong() time.Time {
+	return time.Time{}
+}
+
+// Throttled returns false, as the in-process client publishes to the router directly.
+func (c *inProcessClient) Throttled() bool {
+	return false
+}
+
+// SetURLs does nothing, as the in-process client is not connected to a server url.
+func (c *inProcessClient) SetURLs(urls []string) {}
+
+// ProtocolVersion returns protocol.SubprotocolV1, the format of the raw messages written by the in-process client.
+func (c *inProcessClient) ProtocolVersion() string {
+	return protocol.SubprotocolV1
+}
+
+// SetBackoff only keeps the backoff, as the in-process client does not reconnect.
+func (c *inProcessClient) SetBackoff(backoff Backoff) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff = backoff
+}
+
+func (c *inProcessClient) BackoffState() BackoffState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.backoff.reset()
+}
+
+// notify passes the notification to the status or errors channel, dropping it if the channel is full
+func (c *inProcessClient) notify(message *protocol.NotificationMessage) {
+	messages := c.statusMessages
+	if message.IsError {
+		messages = c.errors
+	}
+	select {
+	case messages <- message:
+	default:
+		logger.WithFields(log.Fields{
+			"notification": message.Name,
+			"isError":      message.IsError,
+		}).Debug("Channel is full, dropping notification of the in-process client")
+	}
+}
+
+func okNotification(name, arg string) *protocol.NotificationMessage {
+	return &protocol.NotificationMessage{Name: name, Arg: arg}
+}
+
+func errorNotification(name string, argPattern string, params ...interface{}) *protocol.NotificationMessage {
+	return &protocol.NotificationMessage{
+		Name:    name,
+		Arg:     fmt.Sprintf(argPattern, params...),
+		IsError: true,
+	}
+}
@@ -0,0 +1,141 @@
+package client
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store/filestore"
+
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+type startStopper interface {
+	Start() error
+	Stop() error
+}
+
+// aStartedRouter returns a router with a file message store in a temp dir and the function to stop it
+func aStartedRouter(a *assert.Assertions, accessManager auth.AccessManager) (router.Router, func()) {
+	dir, err := ioutil.TempDir("", "guble_inprocess_test")
+	a.NoError(err)
+	r := router.New(accessManager, filestore.New(dir), kvstore.NewMemoryKVStore(), nil)
+	a.NoError(r.(startStopper).Start())
+	return r, func() {
+		r.(startStopper).Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func expectNotification(a *assert.Assertions, c <-chan *protocol.NotificationMessage, name, arg string) {
+	select {
+	case n := <-c:
+		a.Equal(name, n.Name)
+		a.Equal(arg, n.Arg)
+	case <-time.After(time.Second):
+		a.Fail("No notification " + name)
+	}
+}
+
+func TestInProcess_SendAndReceive(t *testing.T) {
+	a := assert.New(t)
+	r, stop := aStartedRouter(a, auth.NewAllowAllAccessManager(true))
+	defer stop()
+
+	// given a started subscriber and publisher
+	subscriber := NewInProcess(r, "alice")
+	a.NoError(subscriber.Start())
+	defer subscriber.Close()
+	expectNotification(a, subscriber.StatusUpdates(), protocol.SUCCESS_CONNECTED, "You are connected to the server.")
+	a.True(subscriber.IsConnected())
+
+	a.NoError(subscriber.SubscribeMany("/foo", "/bar"))
+	expectNotification(a, subscriber.StatusUpdates(), protocol.SUCCESS_SUBSCRIBED_TO, "/foo")
+	expectNotification(a, subscriber.StatusUpdates(), protocol.SUCCESS_SUBSCRIBED_TO, "/bar")
+
+	publisher := NewInProcess(r, "bob")
+	a.NoError(publisher.Start())
+	defer publisher.Close()
+
+	// when a message is published
+	a.NoError(publisher.Send("/foo/baz", "Hello", `{"key":"value"}`))
+	expectNotification(a, publisher.StatusUpdates(), protocol.SUCCESS_CONNECTED, "You are connected to the server.")
+	expectNotification(a, publisher.StatusUpdates(), protocol.SUCCESS_SEND, "")
+
+	// then it is stored and delivered to the subscriber
+	select {
+	case m := <-subscriber.Messages():
+		a.Equal(protocol.Path("/foo/baz"), m.Path)
+		a.Equal("Hello", string(m.Body))
+		a.Equal("bob", m.UserID)
+		a.Equal(`{"key":"value"}`, m.HeaderJSON)
+		a.True(m.ID > 0)
+
+		fetched, err := subscriber.FetchRange("/foo", 0, m.ID)
+		a.NoError(err)
+		if a.Len(fetched, 1) {
+			a.Equal(m.ID, fetched[0].ID)
+		}
+	case <-time.After(time.Second):
+		a.Fail("No message received")
+	}
+
+	// and after unsubscribing, the subscription is gone
+	a.NoError(subscriber.UnsubscribeAndWait("/foo", time.Second))
+	a.Equal(ErrSubscriptionNotFound, subscriber.UnsubscribeAndWait("/foo", time.Second))
+	a.Equal(ErrAckNotSupported, subscriber.SubscribeWithAck("/foo"))
+}
+
+func TestInProcess_SubscribeWithoutAccess(t *testing.T) {
+	a := assert.New(t)
+	r, stop := aStartedRouter(a, auth.NewAllowAllAccessManager(false))
+	defer stop()
+
+	c := NewInProcess(r, "eve")
+	a.NoError(c.Start())
+	defer c.Close()
+
+	err := c.SubscribeAll([]protocol.Path{"/private"})
+	a.Error(err)
+	a.Contains(err.Error(), "/private: "+ErrAccessDenied.Error())
+	expectNotification(a, c.Errors(), protocol.ERROR_ACCESS_DENIED, "/private")
+
+	a.NoError(c.Send("/private", "Hello", ""))
+	expectNotification(a, c.Errors(), protocol.ERROR_ACCESS_DENIED, "/private")
+}
+
+func TestInProcess_SubscribeAtLatest(t *testing.T) {
+	a := assert.New(t)
+	r, stop := aStartedRouter(a, auth.NewAllowAllAccessManager(true))
+	defer stop()
+
+	c := NewInProcess(r, "alice")
+	a.NoError(c.Start())
+	defer c.Close()
+	expectNotification(a, c.StatusUpdates(), protocol.SUCCESS_CONNECTED, "You are connected to the server.")
+
+	// when subscribing at the latest position, then the path is subscribed
+	a.NoError(c.Subscribe("/foo @latest"))
+	expectNotification(a, c.StatusUpdates(), protocol.SUCCESS_SUBSCRIBED_TO, "/foo")
+}
+
+func TestInProcess_Shutdown(t *testing.T) {
+	a := assert.New(t)
+	r, stop := aStartedRouter(a, auth.NewAllowAllAccessManager(true))
+	defer stop()
+
+	// given a started client
+	c := NewInProcess(r, "bob")
+	a.NoError(c.Start())
+
+	// when it is shut down, then it is closed and rejects the sends
+	a.NoError(c.Shutdown(context.Background()))
+	a.False(c.IsConnected())
+	a.Equal(ErrClientClosing, c.Send("/foo", "Hello", ""))
+}
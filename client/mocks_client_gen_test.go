@@ -7,6 +7,9 @@ import (
 	"github.com/golang/mock/gomock"
 
 	"github.com/smancke/guble/protocol"
+
+	context "context"
+	time "time"
 )
 
 // Mock of WSConnection interface
@@ -83,6 +86,26 @@ func (_m *MockClient) EXPECT() *_MockClientRecorder {
 	return _m.recorder
 }
 
+func (_m *MockClient) Ack(_param0 string, _param1 uint64) error {
+	ret := _m.ctrl.Call(_m, "Ack", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) Ack(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Ack", arg0, arg1)
+}
+
+func (_m *MockClient) BackoffState() BackoffState {
+	ret := _m.ctrl.Call(_m, "BackoffState")
+	ret0, _ := ret[0].(BackoffState)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) BackoffState() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "BackoffState")
+}
+
 func (_m *MockClient) Close() {
 	_m.ctrl.Call(_m, "Close")
 }
@@ -91,9 +114,19 @@ func (_mr *_MockClientRecorder) Close() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Close")
 }
 
-func (_m *MockClient) Errors() chan *protocol.NotificationMessage {
+func (_m *MockClient) Shutdown(_param0 context.Context) error {
+	ret := _m.ctrl.Call(_m, "Shutdown", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) Shutdown(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Shutdown", arg0)
+}
+
+func (_m *MockClient) Errors() <-chan *protocol.NotificationMessage {
 	ret := _m.ctrl.Call(_m, "Errors")
-	ret0, _ := ret[0].(chan *protocol.NotificationMessage)
+	ret0, _ := ret[0].(<-chan *protocol.NotificationMessage)
 	return ret0
 }
 
@@ -101,6 +134,17 @@ func (_mr *_MockClientRecorder) Errors() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Errors")
 }
 
+func (_m *MockClient) FetchRange(_param0 string, _param1 uint64, _param2 uint64) ([]protocol.Message, error) {
+	ret := _m.ctrl.Call(_m, "FetchRange", _param0, _param1, _param2)
+	ret0, _ := ret[0].([]protocol.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockClientRecorder) FetchRange(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "FetchRange", arg0, arg1, arg2)
+}
+
 func (_m *MockClient) IsConnected() bool {
 	ret := _m.ctrl.Call(_m, "IsConnected")
 	ret0, _ := ret[0].(bool)
@@ -111,6 +155,16 @@ func (_mr *_MockClientRecorder) IsConnected() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "IsConnected")
 }
 
+func (_m *MockClient) LastPong() time.Time {
+	ret := _m.ctrl.Call(_m, "LastPong")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) LastPong() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "LastPong")
+}
+
 func (_m *MockClient) Messages() chan *protocol.Message {
 	ret := _m.ctrl.Call(_m, "Messages")
 	ret0, _ := ret[0].(chan *protocol.Message)
@@ -131,6 +185,16 @@ func (_mr *_MockClientRecorder) Send(arg0, arg1, arg2 interface{}) *gomock.Call
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0, arg1, arg2)
 }
 
+func (_m *MockClient) SendBinary(_param0 protocol.Path, _param1 []byte) error {
+	ret := _m.ctrl.Call(_m, "SendBinary", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SendBinary(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendBinary", arg0, arg1)
+}
+
 func (_m *MockClient) SendBytes(_param0 string, _param1 []byte, _param2 string) error {
 	ret := _m.ctrl.Call(_m, "SendBytes", _param0, _param1, _param2)
 	ret0, _ := ret[0].(error)
@@ -141,6 +205,52 @@ func (_mr *_MockClientRecorder) SendBytes(arg0, arg1, arg2 interface{}) *gomock.
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendBytes", arg0, arg1, arg2)
 }
 
+func (_m *MockClient) SendWithHeader(_param0 protocol.Path, _param1 string, _param2 map[string]string) error {
+	ret := _m.ctrl.Call(_m, "SendWithHeader", _param0, _param1, _param2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SendWithHeader(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SendWithHeader", arg0, arg1, arg2)
+}
+
+func (_m *MockClient) SetURLs(_param0 []string) {
+	_m.ctrl.Call(_m, "SetURLs", _param0)
+}
+
+func (_mr *_MockClientRecorder) SetURLs(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetURLs", arg0)
+}
+
+func (_m *MockClient) ProtocolVersion() string {
+	ret := _m.ctrl.Call(_m, "ProtocolVersion")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) ProtocolVersion() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "ProtocolVersion")
+}
+
+func (_m *MockClient) SessionRecoveries() <-chan SessionRecovery {
+	ret := _m.ctrl.Call(_m, "SessionRecoveries")
+	ret0, _ := ret[0].(<-chan SessionRecovery)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SessionRecoveries() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SessionRecoveries")
+}
+
+func (_m *MockClient) SetBackoff(_param0 Backoff) {
+	_m.ctrl.Call(_m, "SetBackoff", _param0)
+}
+
+func (_mr *_MockClientRecorder) SetBackoff(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SetBackoff", arg0)
+}
+
 func (_m *MockClient) SetWSConnectionFactory(_param0 WSConnectionFactory) {
 	_m.ctrl.Call(_m, "SetWSConnectionFactory", _param0)
 }
@@ -169,6 +279,16 @@ func (_mr *_MockClientRecorder) StatusMessages() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "StatusMessages")
 }
 
+func (_m *MockClient) StatusUpdates() <-chan *protocol.NotificationMessage {
+	ret := _m.ctrl.Call(_m, "StatusUpdates")
+	ret0, _ := ret[0].(<-chan *protocol.NotificationMessage)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) StatusUpdates() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "StatusUpdates")
+}
+
 func (_m *MockClient) Subscribe(_param0 string) error {
 	ret := _m.ctrl.Call(_m, "Subscribe", _param0)
 	ret0, _ := ret[0].(error)
@@ -179,6 +299,60 @@ func (_mr *_MockClientRecorder) Subscribe(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Subscribe", arg0)
 }
 
+func (_m *MockClient) SubscribeAll(_param0 []protocol.Path) error {
+	ret := _m.ctrl.Call(_m, "SubscribeAll", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeAll(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeAll", arg0)
+}
+
+func (_m *MockClient) SubscribeAllTimeout(_param0 []protocol.Path, _param1 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "SubscribeAllTimeout", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeAllTimeout(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeAllTimeout", arg0, arg1)
+}
+
+func (_m *MockClient) SubscribeMany(_param0 ...protocol.Path) error {
+	_s := []interface{}{}
+	for _, _x := range _param0 {
+		_s = append(_s, _x)
+	}
+	ret := _m.ctrl.Call(_m, "SubscribeMany", _s...)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeMany(arg0 ...interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeMany", arg0...)
+}
+
+func (_m *MockClient) SubscribeWithAck(_param0 string) error {
+	ret := _m.ctrl.Call(_m, "SubscribeWithAck", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) SubscribeWithAck(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "SubscribeWithAck", arg0)
+}
+
+func (_m *MockClient) Throttled() bool {
+	ret := _m.ctrl.Call(_m, "Throttled")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) Throttled() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Throttled")
+}
+
 func (_m *MockClient) Unsubscribe(_param0 string) error {
 	ret := _m.ctrl.Call(_m, "Unsubscribe", _param0)
 	ret0, _ := ret[0].(error)
@@ -189,6 +363,37 @@ func (_mr *_MockClientRecorder) Unsubscribe(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Unsubscribe", arg0)
 }
 
+func (_m *MockClient) UnsubscribeAll() error {
+	ret := _m.ctrl.Call(_m, "UnsubscribeAll")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) UnsubscribeAll() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnsubscribeAll")
+}
+
+func (_m *MockClient) UnsubscribeAndWait(_param0 protocol.Path, _param1 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "UnsubscribeAndWait", _param0, _param1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockClientRecorder) UnsubscribeAndWait(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "UnsubscribeAndWait", arg0, arg1)
+}
+
+func (_m *MockClient) WaitForMessage(_param0 context.Context, _param1 func(*protocol.Message) bool) (*protocol.Message, error) {
+	ret := _m.ctrl.Call(_m, "WaitForMessage", _param0, _param1)
+	ret0, _ := ret[0].(*protocol.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockClientRecorder) WaitForMessage(arg0, arg1 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "WaitForMessage", arg0, arg1)
+}
+
 func (_m *MockClient) WriteRawMessage(_param0 []byte) error {
 	ret := _m.ctrl.Call(_m, "WriteRawMessage", _param0)
 	ret0, _ := ret[0].(error)
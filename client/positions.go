@@ -0,0 +1,217 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// PositionStore persists the id of the last processed message per subscribed path on the client side.
+// A client opened with a PositionStore resumes its subscriptions after the stored positions,
+// also when it is restarted, and re-subscribes with them after a reconnect.
+type PositionStore interface {
+	// Position returns the id of the last processed message of the path, and false if there is none.
+	Position(path protocol.Path) (uint64, bool, error)
+
+	// SetPosition stores the id of the last processed message of the path.
+	SetPosition(path protocol.Path, id uint64) error
+}
+
+// FilePositionStore is a PositionStore keeping the positions in a json file,
+// which is rewritten on each change.
+type FilePositionStore struct {
+	filename string
+
+	mutex     sync.Mutex
+	positions map[protocol.Path]uint64
+}
+
+// NewFilePositionStore returns a FilePositionStore with the positions read from the file, if it exists.
+func NewFilePositionStore(filename string) (*FilePositionStore, error) {
+	s := &FilePositionStore{
+		filename:  filename,
+		positions: make(map[protocol.Path]uint64),
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return s, nil
+	}
+	if err := json.Unmarshal(data, &s.positions); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Position is a part of the PositionStore implementation.
+func (s *FilePositionStore) Position(path protocol.Path) (uint64, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id, ok := s.positions[path]
+	return id, ok, nil
+}
+
+// SetPosition is a part of the PositionStore implementation.
+// The file is replaced atomically, so that it is not corrupted by a crash while it is written.
+func (s *FilePositionStore) SetPosition(path protocol.Path, id uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if current, ok := s.positions[path]; ok && current == id {
+		return nil
+	}
+	s.positions[path] = id
+	data, err := json.Marshal(s.positions)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.filename), filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.filename)
+}
+
+// subscription is a subscription of the client to a path, which is resumed from its stored position
+type subscription struct {
+	ack bool
+}
+
+// resumableArg tracks the subscription to a single path without arguments and returns its receive argument,
+// continuing after the stored position. Other arguments are returned unchanged.
+func (c *client) resumableArg(arg string, ack bool) string {
+	if c.positions == nil {
+		return arg
+	}
+	path := protocol.Path(arg)
+	if !validPath(path) || strings.Contains(arg, protocol.PathListSeparator) {
+		return arg
+	}
+
+	c.mu.Lock()
+	c.subscriptions[path] = subscription{ack: ack}
+	c.mu.Unlock()
+
+	id, ok, err := c.positions.Position(path)
+	if err != nil {
+		logger.WithError(err).WithField("path", path).Error("Error reading the stored position, subscribing without it")
+		return arg
+	}
+	if !ok {
+		return arg
+	}
+	return fmt.Sprintf("%s %d", path, id+1)
+}
+
+// forgetSubscription stops tracking the subscription, after it was canceled
+func (c *client) forgetSubscription(path protocol.Path) {
+	if c.positions == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscriptions, path)
+}
+
+// forgetSubscriptions stops tracking all subscriptions, which are not resubscribed after a reconnect anymore
+func (c *client) forgetSubscriptions() {
+	if c.positions == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscriptions = make(map[protocol.Path]subscription)
+}
+
+// resubscribe sends the receive commands of the tracked subscriptions with their stored positions,
+// after the connection was re-established
+func (c *client) resubscribe() {
+	if c.positions == nil {
+		return
+	}
+	c.mu.RLock()
+	subscriptions := make(map[protocol.Path]subscription, len(c.subscriptions))
+	for path, s := range c.subscriptions {
+		subscriptions[path] = s
+	}
+	c.mu.RUnlock()
+
+	for path, s := range subscriptions {
+		var err error
+		if s.ack {
+			err = c.SubscribeWithAck(string(path))
+		} else {
+			err = c.Subscribe(string(path))
+		}
+		if err != nil {
+			logger.WithError(err).WithField("path", path).Error("Error re-subscribing after the reconnect")
+		}
+	}
+}
+
+// trackPosition stores the id of the received message as the position of the subscriptions it is delivered for.
+// The position of a subscription with ack is stored when the message is acknowledged.
+func (c *client) trackPosition(message *protocol.Message) {
+	if c.positions == nil {
+		return
+	}
+	c.mu.Lock()
+	var paths []protocol.Path
+	for path, s := range c.subscriptions {
+		if !s.ack && matchesSubscription(path, message.Path) {
+			paths = append(paths, path)
+		}
+	}
+	c.mu.Unlock()
+
+	c.storePositions(paths, message.ID)
+}
+
+// ackPosition stores the acknowledged id as the position of the subscription with ack to the path
+func (c *client) ackPosition(path protocol.Path, id uint64) {
+	if c.positions == nil {
+		return
+	}
+	c.mu.RLock()
+	s, tracked := c.subscriptions[path]
+	c.mu.RUnlock()
+
+	if tracked && s.ack {
+		c.storePositions([]protocol.Path{path}, id)
+	}
+}
+
+func (c *client) storePositions(paths []protocol.Path, id uint64) {
+	for _, path := range paths {
+		if err := c.positions.SetPosition(path, id); err != nil {
+			logger.WithError(err).WithField("path", path).Error("Error storing the position")
+			c.notifyError(clientErrorMessage(err.Error()))
+		}
+	}
+}
+
+// matchesSubscription returns true, if a message of the topic is delivered for the subscribed path (or a subtopic)
+func matchesSubscription(subscribed, topic protocol.Path) bool {
+	return topic == subscribed || strings.HasPrefix(string(topic), string(subscribed)+"/")
+}
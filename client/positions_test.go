@@ -0,0 +1,186 @@
+package client
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func aFilePositionStore(t *testing.T) (*FilePositionStore, string, func()) {
+	dir, err := ioutil.TempDir("", "guble_positions_test")
+	assert.NoError(t, err)
+	filename := filepath.Join(dir, "positions.json")
+	s, err := NewFilePositionStore(filename)
+	assert.NoError(t, err)
+	return s, filename, func() { os.RemoveAll(dir) }
+}
+
+func TestFilePositionStore(t *testing.T) {
+	a := assert.New(t)
+	s, filename, cleanup := aFilePositionStore(t)
+	defer cleanup()
+
+	// given an empty store
+	_, ok, err := s.Position("/foo")
+	a.NoError(err)
+	a.False(ok)
+
+	// when positions are stored
+	a.NoError(s.SetPosition("/foo", 42))
+	a.NoError(s.SetPosition("/bar", 7))
+	a.NoError(s.SetPosition("/foo", 43))
+
+	// then they are read again from the file
+	reopened, err := NewFilePositionStore(filename)
+	a.NoError(err)
+	id, ok, err := reopened.Position("/foo")
+	a.NoError(err)
+	a.True(ok)
+	a.Equal(uint64(43), id)
+	id, _, _ = reopened.Position("/bar")
+	a.Equal(uint64(7), id)
+}
+
+func TestFilePositionStoreWithAnInvalidFile(t *testing.T) {
+	a := assert.New(t)
+	_, filename, cleanup := aFilePositionStore(t)
+	defer cleanup()
+
+	a.NoError(ioutil.WriteFile(filename, []byte("no json"), 0644))
+	_, err := NewFilePositionStore(filename)
+	a.Error(err)
+}
+
+func TestSubscribeResumesAfterTheStoredPosition(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client with a stored position
+	s, _, cleanup := aFilePositionStore(t)
+	defer cleanup()
+	a.NoError(s.SetPosition("/foo", 41))
+	c := newClient("url", "origin", 10, false)
+	c.positions = s
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+
+	// then the subscription continues after it
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo 42"))
+	a.NoError(c.Subscribe("/foo"))
+
+	// and paths without a position and arguments are passed unchanged
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /bar"))
+	a.NoError(c.Subscribe("/bar"))
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo @earliest"))
+	a.NoError(c.Subscribe("/foo @earliest"))
+
+	// and the received messages of the subscriptions update the positions
+	c.handleIncomingMessage([]byte("/foo/sub,45,user01,phone01,,1420110000,1\n\nHello"))
+	<-c.Messages()
+	id, _, _ := s.Position("/foo")
+	a.Equal(uint64(45), id)
+	_, ok, _ := s.Position("/bar")
+	a.False(ok)
+
+	// but not anymore after unsubscribing
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("- /foo"))
+	a.NoError(c.Unsubscribe("/foo"))
+	c.handleIncomingMessage([]byte("/foo,46,user01,phone01,,1420110000,1\n\nHello"))
+	<-c.Messages()
+	id, _, _ = s.Position("/foo")
+	a.Equal(uint64(45), id)
+}
+
+func TestSubscribeWithAckStoresThePositionOnAck(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a client subscribed with ack
+	s, _, cleanup := aFilePositionStore(t)
+	defer cleanup()
+	c := newClient("url", "origin", 10, false)
+	c.positions = s
+	connMock := NewMockWSConnection(ctrl)
+	c.ws = connMock
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo\n"+protocol.AckHeader))
+	a.NoError(c.SubscribeWithAck("/foo"))
+
+	// when a message is received, the position is not stored
+	c.handleIncomingMessage([]byte("/foo,42,user01,phone01,,1420110000,1\n\nHello"))
+	<-c.Messages()
+	_, ok, _ := s.Position("/foo")
+	a.False(ok)
+
+	// until it is acknowledged
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("a /foo 42"))
+	a.NoError(c.Ack("/foo", 42))
+	id, ok, _ := s.Position("/foo")
+	a.True(ok)
+	a.Equal(uint64(42), id)
+
+	// and the next subscription continues after it
+	connMock.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo 43\n"+protocol.AckHeader))
+	a.NoError(c.SubscribeWithAck("/foo"))
+}
+
+func TestReconnectResubscribesWithTheStoredPositions(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a reconnecting client with a position store
+	s, _, cleanup := aFilePositionStore(t)
+	defer cleanup()
+	c := newClient("url", "origin", 10, true)
+	c.positions = s
+	c.jitter = func(max time.Duration) time.Duration { return 0 }
+
+	// which is subscribed and receives a message, before the connection is lost
+	first := NewMockWSConnection(ctrl)
+	subscribed := make(chan bool)
+	first.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo"))
+	gomock.InOrder(
+		first.EXPECT().ReadMessage().Do(func() { <-subscribed }).Return(websocket.BinaryMessage, []byte("/foo,42,user01,phone01,,1420110000,1\n\nHello"), nil),
+		first.EXPECT().ReadMessage().Return(0, nil, fmt.Errorf("lost")),
+	)
+
+	// then the new connection re-subscribes after the position
+	second := NewMockWSConnection(ctrl)
+	resubscribed := make(chan bool)
+	second.EXPECT().WriteMessage(websocket.BinaryMessage, []byte("+ /foo 43")).Do(func(int, []byte) { close(resubscribed) })
+	closed := make(chan bool)
+	second.EXPECT().ReadMessage().Do(func() { <-closed }).Return(0, nil, fmt.Errorf("closed")).AnyTimes()
+	second.EXPECT().Close().Do(func() { close(closed) })
+
+	connections := []WSConnection{first, second}
+	c.SetWSConnectionFactory(func(url string, origin string) (WSConnection, error) {
+		conn := connections[0]
+		connections = connections[1:]
+		return conn, nil
+	})
+
+	a.NoError(c.Start())
+	a.NoError(c.Subscribe("/foo"))
+	close(subscribed)
+	<-c.Messages()
+
+	select {
+	case <-resubscribed:
+	case <-time.After(time.Second):
+		a.Fail("not re-subscribed after the reconnect")
+	}
+	c.Close()
+	time.Sleep(time.Millisecond * 10)
+}
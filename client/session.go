@@ -0,0 +1,81 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// SessionRecovery is the outcome of restoring the subscriptions of the session of a client by the server,
+// reported for each connect of a client opened with a session id.
+type SessionRecovery struct {
+	SessionID string
+
+	// Restored is true, if the server restored the subscriptions of the session with their positions.
+	// Otherwise the session was unknown or expired, or could not be restored, and the client subscribes again by itself
+	// to the subscriptions tracked by its PositionStore.
+	Restored bool
+
+	// Subscriptions is the number of the restored subscriptions
+	Subscriptions int
+
+	// Err is the ServerError, if the session could not be restored (e.g. the server has disabled the sessions)
+	Err error
+}
+
+// sessionRecovery returns the outcome of the session notification, or false for another notification
+func sessionRecovery(message *protocol.NotificationMessage) (SessionRecovery, bool) {
+	args := strings.SplitN(message.Arg, " ", 2)
+	recovery := SessionRecovery{SessionID: args[0]}
+	switch {
+	case message.Name == protocol.SUCCESS_SESSION_RESTORED && !message.IsError:
+		recovery.Restored = true
+		if len(args) > 1 {
+			recovery.Subscriptions, _ = strconv.Atoi(args[1])
+		}
+	case message.Name == protocol.SUCCESS_SESSION_STARTED && !message.IsError:
+	case message.Name == protocol.ERROR_SESSION_RESTORE && message.IsError:
+		reason := ""
+		if len(args) > 1 {
+			reason = args[1]
+		}
+		recovery.Err = &ServerError{Code: message.Name, Message: reason}
+	default:
+		return recovery, false
+	}
+	return recovery, true
+}
+
+// recoverSession reports the outcome of the session notification, and subscribes again after a reconnect,
+// if the server did not restore the subscriptions
+func (c *client) recoverSession(message *protocol.NotificationMessage) {
+	recovery, ok := sessionRecovery(message)
+	if !ok {
+		return
+	}
+	if c.setResubscribePending(false) && !recovery.Restored {
+		c.resubscribe()
+	}
+	select {
+	case c.sessionRecoveries <- recovery:
+	default:
+		logger.WithField("sessionID", recovery.SessionID).Debug("Session channel is full, dropping the recovery")
+	}
+}
+
+// setResubscribePending sets if the client subscribes again, when the session of the reconnect is not restored.
+// It returns the previous value.
+func (c *client) setResubscribePending(pending bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.resubscribePending
+	c.resubscribePending = pending
+	return previous
+}
+
+// SessionRecoveries returns the channel of the outcomes of restoring the session on each connect,
+// buffered with the channelSize of the client. New outcomes are dropped while it is full.
+func (c *client) SessionRecoveries() <-chan SessionRecovery {
+	return c.sessionRecoveries
+}
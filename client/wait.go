@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// WaitForMessage is an implementation of the Client interface.
+func (c *client) WaitForMessage(ctx context.Context, match func(*protocol.Message) bool) (*protocol.Message, error) {
+	return waitForMessage(ctx, c.messages, c.closedC, match)
+}
+
+// waitForMessage reads the messages until one of them matches, or the context or the client is done.
+// The messages read before, which did not match, are passed to the channel again in their order, by a goroutine,
+// so that the caller can read them after the wait.
+func waitForMessage(ctx context.Context, messages chan *protocol.Message, closedC <-chan struct{}, match func(*protocol.Message) bool) (*protocol.Message, error) {
+	var skipped []*protocol.Message
+	defer func() {
+		if len(skipped) > 0 {
+			go requeueMessages(messages, closedC, skipped)
+		}
+	}()
+
+	for {
+		select {
+		case m := <-messages:
+			if match(m) {
+				return m, nil
+			}
+			skipped = append(skipped, m)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-closedC:
+			return nil, ErrClientClosed
+		}
+	}
+}
+
+// requeueMessages passes the messages to the channel, until the client is closed
+func requeueMessages(messages chan *protocol.Message, closedC <-chan struct{}, skipped []*protocol.Message) {
+	for _, m := range skipped {
+		select {
+		case messages <- m:
+		case <-closedC:
+			return
+		}
+	}
+}
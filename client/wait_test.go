@@ -0,0 +1,94 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForMessage_KeepsTheMessagesNotMatching(t *testing.T) {
+	a := assert.New(t)
+
+	// given a client with received messages
+	c := newClient("ws://localhost/stream", "http://localhost", 10, false)
+	for id := uint64(1); id <= 3; id++ {
+		c.messages <- &protocol.Message{ID: id, Path: "/foo"}
+	}
+
+	// when waiting for the second message
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := c.WaitForMessage(ctx, func(m *protocol.Message) bool { return m.ID == 2 })
+
+	// then it is returned, and the other messages are still received in their order
+	a.NoError(err)
+	a.Equal(uint64(2), m.ID)
+	a.Equal(uint64(3), (<-c.Messages()).ID)
+	a.Equal(uint64(1), (<-c.Messages()).ID)
+
+	// and a message received later matches too
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.messages <- &protocol.Message{ID: 4, Path: "/bar"}
+	}()
+	m, err = c.WaitForMessage(ctx, func(m *protocol.Message) bool { return m.Path == "/bar" })
+	a.NoError(err)
+	a.Equal(uint64(4), m.ID)
+}
+
+func TestWaitForMessage_ReturnsTheErrorOfTheContext(t *testing.T) {
+	a := assert.New(t)
+
+	c := newClient("ws://localhost/stream", "http://localhost", 10, false)
+	c.messages <- &protocol.Message{ID: 1, Path: "/foo"}
+
+	// when no message matches until the deadline, then the error of the context is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	m, err := c.WaitForMessage(ctx, func(m *protocol.Message) bool { return false })
+	a.Nil(m)
+	a.Equal(context.DeadlineExceeded, err)
+
+	// and the message read is passed to the channel again
+	select {
+	case m := <-c.Messages():
+		a.Equal(uint64(1), m.ID)
+	case <-time.After(time.Second):
+		a.Fail("the message was lost")
+	}
+
+	// and a closed client ends the wait
+	c.Close()
+	_, err = c.WaitForMessage(context.Background(), func(m *protocol.Message) bool { return true })
+	a.Equal(ErrClientClosed, err)
+}
+
+func TestInProcess_WaitForMessage(t *testing.T) {
+	a := assert.New(t)
+	r, stop := aStartedRouter(a, auth.NewAllowAllAccessManager(true))
+	defer stop()
+
+	c := NewInProcess(r, "alice")
+	a.NoError(c.Start())
+	defer c.Close()
+	a.NoError(c.Subscribe("/foo"))
+
+	// when messages are sent, then the matching one is awaited
+	a.NoError(c.Send("/foo/a", "first", ""))
+	a.NoError(c.Send("/foo/b", "second", ""))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m, err := c.WaitForMessage(ctx, func(m *protocol.Message) bool { return m.Path == "/foo/b" })
+	a.NoError(err)
+	a.Equal("second", string(m.Body))
+
+	// and the other one is still received
+	m, err = c.WaitForMessage(ctx, func(m *protocol.Message) bool { return true })
+	a.NoError(err)
+	a.Equal("first", string(m.Body))
+}
@@ -20,6 +20,9 @@ var (
 	verbose  = kingpin.Flag("verbose", "Display verbose server communication").Short('v').Bool()
 	url      = kingpin.Flag("url", "The websocket url to connect to").Default("ws://localhost:8080/stream/").String()
 	user     = kingpin.Flag("user", "The user name to connect with (guble-cli)").Short('u').Default("guble-cli").String()
+	compress = kingpin.Flag("compress", "Request gzip compressed message bodies from the server").Bool()
+	metadata = kingpin.Flag("meta", "Metadata of the connection, listed with its subscribers (e.g. --meta app_version=1.2)").StringMap()
+	session  = kingpin.Flag("session", "The session id, whose subscriptions are restored by the server on a reconnect").String()
 	logLevel = kingpin.Flag("log", "Log level").
 			Short('l').
 			Default(log.ErrorLevel.String()).
@@ -49,7 +52,7 @@ func main() {
 
 	origin := "http://localhost/"
 	url := fmt.Sprintf("%v/user/%v", removeTrailingSlash(*url), *user)
-	client, err := client.Open(url, origin, 100, true)
+	client, err := client.Open(url, origin, 100, true, *compress, client.DefaultBackoff, nil, *metadata, *session)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -77,7 +80,7 @@ func readLoop(client client.Client) {
 			}
 		case e := <-client.Errors():
 			fmt.Println("ERROR: " + string(e.Bytes()))
-		case status := <-client.StatusMessages():
+		case status := <-client.StatusUpdates():
 			fmt.Println(string(status.Bytes()))
 			fmt.Println()
 		}
@@ -0,0 +1,38 @@
+package protocol
+
+import "errors"
+
+const (
+	// ApplicationIDParam is the query parameter of the websocket url and of the REST publish requests,
+	// naming the application of the client, e.g. for its message quota.
+	// Without it, each connection or request gets a random application id.
+	ApplicationIDParam = "applicationId"
+
+	// MaxApplicationIDLength is the maximum length of an application id named by a client
+	MaxApplicationIDLength = 64
+)
+
+// ErrInvalidApplicationID is returned for an application id named by a client, which is too long or has invalid characters
+var ErrInvalidApplicationID = errors.New("Invalid application id. It has to be made of letters, digits, `-`, `_` and `.`.")
+
+// ValidateApplicationID returns ErrInvalidApplicationID, if the application id is empty, longer than
+// MaxApplicationIDLength or not made of letters, digits, `-`, `_` and `.`.
+func ValidateApplicationID(id string) error {
+	if !isIdentifier(id, MaxApplicationIDLength) {
+		return ErrInvalidApplicationID
+	}
+	return nil
+}
+
+// isIdentifier returns true, if the id is not empty, at most maxLength long and made of letters, digits, `-`, `_` and `.`
+func isIdentifier(id string, maxLength int) bool {
+	if len(id) == 0 || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
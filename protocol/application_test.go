@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateApplicationID(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(ValidateApplicationID("shop-backend_v2.1"))
+	a.Equal(ErrInvalidApplicationID, ValidateApplicationID(""))
+	a.Equal(ErrInvalidApplicationID, ValidateApplicationID("shop backend"))
+	a.Equal(ErrInvalidApplicationID, ValidateApplicationID(strings.Repeat("a", MaxApplicationIDLength+1)))
+}
@@ -11,8 +11,33 @@ const (
 	CmdSend    = ">"
 	CmdReceive = "+"
 	CmdCancel  = "-"
+	CmdAck     = "a"
 )
 
+// AckHeader is the header of a receive command, which enables the at-least-once delivery for the subscription.
+// The client has to acknowledge the received messages with the ack command,
+// and on a new subscription the server replays all messages after the last acknowledged one.
+const AckHeader = `{"ack":true}`
+
+// BinaryArg is the argument of a send command, which flags the body as binary data, e.g. `> /foo binary`.
+// The message is published with the Binary flag, so that the receivers can tell its body from text.
+const BinaryArg = "binary"
+
+// The position arguments of a receive command, which can be given instead of a start id:
+// PositionLatest subscribes to the future messages only (as without a start id),
+// and PositionEarliest replays all messages from the oldest retained one, before subscribing.
+const (
+	PositionLatest   = "@latest"
+	PositionEarliest = "@earliest"
+)
+
+// CancelAllArg is the argument of a cancel command, which cancels all subscriptions of the connection at once: `- *`.
+// The server confirms it by a single notification with the number of the canceled subscriptions, e.g. `#canceled-all 3`.
+const CancelAllArg = "*"
+
+// PathListSeparator separates the paths of a receive command subscribing to multiple topics at once, e.g. `+ /foo,/bar`.
+const PathListSeparator = ","
+
 // Cmd is a representation of a command, which the client sends to the server
 type Cmd struct {
 
@@ -79,3 +104,14 @@ func (cmd *Cmd) Bytes() []byte {
 
 	return buff.Bytes()
 }
+
+// IsBinary returns true for a send command with the BinaryArg following the path
+func (cmd *Cmd) IsBinary() bool {
+	args := strings.Split(cmd.Arg, " ")
+	for _, arg := range args[1:] {
+		if arg == BinaryArg {
+			return true
+		}
+	}
+	return false
+}
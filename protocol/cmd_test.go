@@ -60,3 +60,12 @@ func TestSerializeASubscribeCommand(t *testing.T) {
 
 	assert.Equal(t, aSubscribeCommand, string(cmd.Bytes()))
 }
+
+func TestCmd_IsBinary(t *testing.T) {
+	a := assert.New(t)
+
+	a.True((&Cmd{Name: CmdSend, Arg: "/foo binary"}).IsBinary())
+	a.True((&Cmd{Name: CmdSend, Arg: "/foo 42 binary"}).IsBinary())
+	a.False((&Cmd{Name: CmdSend, Arg: "/foo 42"}).IsBinary())
+	a.False((&Cmd{Name: CmdSend, Arg: "/binary"}).IsBinary())
+}
@@ -2,10 +2,15 @@ package protocol
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -41,8 +46,77 @@ type Message struct {
 
 	// Used in cluster mode to identify a guble node
 	NodeID uint8
+
+	// Flag which indicates, if the payload is gzip compressed
+	Compressed bool
+
+	// Flag which indicates, if the payload is binary data, which is passed through as raw bytes and not as text
+	Binary bool
 }
 
+const (
+	// CompressionHeader is the header of the websocket handshake, by which a client requests compressed message bodies
+	CompressionHeader = "X-Guble-Compress"
+
+	// CompressionGzip is the value of the CompressionHeader and the metadata field of a compressed message
+	CompressionGzip = "gzip"
+
+	// EncodingBinary is the metadata field of a message with a binary body
+	EncodingBinary = "binary"
+
+	// PriorityHeader is the field of the header json setting the delivery priority of a message,
+	// used by the push notification connectors (the case of the field name is ignored)
+	PriorityHeader = "priority"
+
+	// PriorityHigh is the priority of time-critical messages, delivered before the messages with normal priority
+	PriorityHigh = "high"
+
+	// PriorityNormal is the priority of the messages without a priority header
+	PriorityNormal = "normal"
+
+	// PartitionKeyHeader is the field of the header json, by which the messages of a partitioned topic are ordered:
+	// the messages with the same key are delivered in publish order (the case of the field name is ignored).
+	// It can be set by a REST client with the header `X-Guble-Partition-Key`.
+	PartitionKeyHeader = "Partition-Key"
+
+	// DeliverAtHeader is the field of the header json scheduling a message for a delayed delivery:
+	// an RFC3339 timestamp, until which the router holds the message (the case of the field name is ignored).
+	// It can be set by a REST client with the header `X-Guble-Deliver-At`.
+	DeliverAtHeader = "Deliver-At"
+
+	// ExpiresHeader is the field of the header json limiting the delivery of a message by the connectors:
+	// a duration after the message was stored (e.g. `1h`), or an RFC3339 timestamp (the case of the field name is ignored).
+	// The push notification connectors pass it on as the time to live, and drop the expired messages.
+	// It can be set by a REST client with the header `X-Guble-Expires`.
+	ExpiresHeader = "Expires"
+
+	// ContentTypeHeader is the field of the header json with the MIME type of the body, e.g. `application/json`
+	// (the case of the field name is ignored). It has to be a well-formed MIME type, and is forwarded by the connectors.
+	// It can be set by a REST client with the header `X-Guble-Content-Type`.
+	ContentTypeHeader = "Content-Type"
+
+	// SchemaHeader is the field of the header json naming the schema of the body, e.g. a protobuf message type
+	// (the case of the field name is ignored). It can be set by a REST client with the header `X-Guble-Schema`.
+	SchemaHeader = "Schema"
+
+	// SchemaVersionHeader is the field of the header json with the version of the schema of the body
+	// (the case of the field name is ignored). It can be set by a REST client with the header `X-Guble-Schema-Version`.
+	SchemaVersionHeader = "Schema-Version"
+)
+
+// ErrInvalidPriority is returned for a message with an unknown priority in its header
+var ErrInvalidPriority = errors.New("Invalid priority. The priority header has to be high or normal.")
+
+// ErrInvalidDeliverAt is returned for a message with a deliver-at header, which is not an RFC3339 timestamp
+var ErrInvalidDeliverAt = errors.New("Invalid deliver-at. The deliver-at header has to be an RFC3339 timestamp.")
+
+// ErrInvalidExpires is returned for a message with an expires header, which is neither a positive duration
+// nor an RFC3339 timestamp
+var ErrInvalidExpires = errors.New("Invalid expires. The expires header has to be a positive duration or an RFC3339 timestamp.")
+
+// ErrInvalidContentType is returned for a message with a content-type header, which is not a well-formed MIME type
+var ErrInvalidContentType = errors.New("Invalid content-type. The content-type header has to be a MIME type like application/json.")
+
 type MessageDeliveryCallback func(*Message)
 
 // Metadata returns the first line of a serialized message, without the newline
@@ -96,6 +170,14 @@ func (msg *Message) writeMetadata(buff *bytes.Buffer) {
 	buff.WriteString(strconv.FormatInt(msg.Time, 10))
 	buff.WriteString(",")
 	buff.WriteString(strconv.FormatUint(uint64(msg.NodeID), 10))
+	if msg.Compressed {
+		buff.WriteString(",")
+		buff.WriteString(CompressionGzip)
+	}
+	if msg.Binary {
+		buff.WriteString(",")
+		buff.WriteString(EncodingBinary)
+	}
 }
 
 func (msg *Message) encodeFilters() []byte {
@@ -128,6 +210,215 @@ func (msg *Message) SetFilter(key, value string) {
 	msg.Filters[key] = value
 }
 
+// Priority returns the priority set in the header json of the message: PriorityHigh or PriorityNormal, if not set.
+// An unknown priority returns ErrInvalidPriority.
+func (msg *Message) Priority() (string, error) {
+	raw, ok := msg.headerField(PriorityHeader)
+	if !ok {
+		return PriorityNormal, nil
+	}
+	var priority string
+	if err := json.Unmarshal(raw, &priority); err != nil {
+		return "", ErrInvalidPriority
+	}
+	switch strings.ToLower(priority) {
+	case PriorityHigh:
+		return PriorityHigh, nil
+	case PriorityNormal, "":
+		return PriorityNormal, nil
+	default:
+		return "", ErrInvalidPriority
+	}
+}
+
+// PartitionKey returns the partition key set in the header json of the message, or an empty string if not set.
+// A key which is not a json string (e.g. a number) is returned as its json text.
+func (msg *Message) PartitionKey() string {
+	return msg.headerString(PartitionKeyHeader)
+}
+
+// DeliverAt returns the time set in the deliver-at header of the message, or the zero time if not set.
+// A value which is not an RFC3339 timestamp returns ErrInvalidDeliverAt.
+func (msg *Message) DeliverAt() (time.Time, error) {
+	raw, ok := msg.headerField(DeliverAtHeader)
+	if !ok {
+		return time.Time{}, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return time.Time{}, ErrInvalidDeliverAt
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, ErrInvalidDeliverAt
+	}
+	return t, nil
+}
+
+// Expires returns the time set in the expires header of the message, or the zero time if not set.
+// A duration is added to the time of the message, or the current time if the message has no time (yet).
+// A value which is neither a positive duration nor an RFC3339 timestamp returns ErrInvalidExpires.
+func (msg *Message) Expires() (time.Time, error) {
+	raw, ok := msg.headerField(ExpiresHeader)
+	if !ok {
+		return time.Time{}, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return time.Time{}, ErrInvalidExpires
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, ErrInvalidExpires
+		}
+		start := time.Now()
+		if msg.Time != 0 {
+			start = time.Unix(msg.Time, 0)
+		}
+		return start.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, ErrInvalidExpires
+	}
+	return t, nil
+}
+
+// IsExpired returns true, if the message has an expires header and its time has passed.
+// A message with an invalid expires header is not expired.
+func (msg *Message) IsExpired(now time.Time) bool {
+	expires, err := msg.Expires()
+	return err == nil && !expires.IsZero() && !now.Before(expires)
+}
+
+// ContentType returns the MIME type set in the content-type header of the message, with its parameters
+// (e.g. `text/plain; charset=utf-8`), or an empty string if not set.
+// A value which is not a well-formed MIME type returns ErrInvalidContentType.
+func (msg *Message) ContentType() (string, error) {
+	value := msg.headerString(ContentTypeHeader)
+	if value == "" {
+		return "", nil
+	}
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil || strings.Count(mediaType, "/") != 1 || strings.HasPrefix(mediaType, "/") || strings.HasSuffix(mediaType, "/") {
+		return "", ErrInvalidContentType
+	}
+	return value, nil
+}
+
+// IsJSON returns true, if the content-type of the message is `application/json` or a JSON based type like `application/ld+json`
+func (msg *Message) IsJSON() bool {
+	contentType, err := msg.ContentType()
+	if err != nil || contentType == "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// Schema returns the schema set in the header of the message, or an empty string if not set
+func (msg *Message) Schema() string {
+	return msg.headerString(SchemaHeader)
+}
+
+// SchemaVersion returns the schema version set in the header of the message, or an empty string if not set
+func (msg *Message) SchemaVersion() string {
+	return msg.headerString(SchemaVersionHeader)
+}
+
+// HeaderValues returns the values of the given fields of the header json, by the given names (ignoring their case).
+// The fields not set are missing in the result, and a field which is not a string is returned as json text.
+func (msg *Message) HeaderValues(names ...string) map[string]string {
+	values := make(map[string]string)
+	if msg.HeaderJSON == "" || len(names) == 0 {
+		return values
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(msg.HeaderJSON), &header); err != nil {
+		return values
+	}
+	for key, raw := range header {
+		for _, name := range names {
+			if strings.EqualFold(key, name) {
+				values[name] = rawString(raw)
+			}
+		}
+	}
+	return values
+}
+
+// headerString returns the value of a string field of the header json, or its json text for another type
+func (msg *Message) headerString(name string) string {
+	raw, ok := msg.headerField(name)
+	if !ok {
+		return ""
+	}
+	return rawString(raw)
+}
+
+// rawString returns the string of a json string, or the json text of another value
+func rawString(raw json.RawMessage) string {
+	var value string
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return value
+	}
+	return string(raw)
+}
+
+// headerField returns the raw value of a field of the header json, ignoring the case of its name
+func (msg *Message) headerField(name string) (json.RawMessage, bool) {
+	if msg.HeaderJSON == "" {
+		return nil, false
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(msg.HeaderJSON), &header); err != nil {
+		return nil, false
+	}
+	for key, raw := range header {
+		if strings.EqualFold(key, name) {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// CompressBody compresses the payload with gzip and sets the Compressed flag
+func (msg *Message) CompressBody() error {
+	if msg.Compressed {
+		return nil
+	}
+	buff := &bytes.Buffer{}
+	w := gzip.NewWriter(buff)
+	if _, err := w.Write(msg.Body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	msg.Body = buff.Bytes()
+	msg.Compressed = true
+	return nil
+}
+
+// DecompressBody inflates a compressed payload and resets the Compressed flag
+func (msg *Message) DecompressBody() error {
+	if !msg.Compressed {
+		return nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg.Body = body
+	msg.Compressed = false
+	return nil
+}
+
 // Valid constants for the NotificationMessage.Name
 const (
 	SUCCESS_CONNECTED     = "connected"
@@ -136,9 +427,31 @@ const (
 	SUCCESS_FETCH_END     = "fetch-end"
 	SUCCESS_SUBSCRIBED_TO = "subscribed-to"
 	SUCCESS_CANCELED      = "canceled"
+	SUCCESS_CANCELED_ALL  = "canceled-all"
+	SUCCESS_DONE          = "done"
+	SUCCESS_RECONNECT     = "reconnect"
+	SUCCESS_TOPIC_RESET   = "topic-reset"
+	SUCCESS_SLOW_DOWN     = "slow-down"
+	SUCCESS_RESUME        = "resume"
+
+	SUCCESS_SESSION_STARTED  = "session-started"
+	SUCCESS_SESSION_RESTORED = "session-restored"
+	ERROR_SESSION_RESTORE    = "error-session-restore"
+
 	ERROR_SUBSCRIBED_TO   = "error-subscribed-to"
 	ERROR_BAD_REQUEST     = "error-bad-request"
 	ERROR_INTERNAL_SERVER = "error-server-internal"
+
+	ERROR_SUBSCRIPTION_NOT_FOUND    = "error-subscription-not-found"
+	ERROR_MAX_MESSAGE_SIZE_EXCEEDED = "error-max-message-size-exceeded"
+	ERROR_RATE_LIMITED              = "error-rate-limited"
+	ERROR_QUOTA_EXCEEDED            = "error-quota-exceeded"
+	ERROR_TOPIC_FULL                = "error-topic-full"
+	ERROR_TOO_MANY_TOPICS           = "error-too-many-topics"
+	ERROR_ACCESS_DENIED             = "error-access-denied"
+	ERROR_UNAUTHORIZED              = "error-unauthorized"
+
+	ERROR_SCHEDULED_MESSAGE_NOT_FOUND = "error-scheduled-message-not-found"
 )
 
 // NotificationMessage is a representation of a status messages or error message, sent from the server
@@ -197,10 +510,22 @@ func ParseMessage(message []byte) (*Message, error) {
 
 	meta := strings.Split(parts[0], ",")
 
-	if len(meta) != 7 {
+	if len(meta) < 7 || len(meta) > 9 {
 		return nil, fmt.Errorf("message metadata has to have 7 fields, but was %v", parts[0])
 	}
 
+	var compressed, binary bool
+	for _, flag := range meta[7:] {
+		switch {
+		case flag == CompressionGzip && !compressed && !binary:
+			compressed = true
+		case flag == EncodingBinary && !binary:
+			binary = true
+		default:
+			return nil, fmt.Errorf("message metadata to have the compression and the encoding as optional fields, but was %v", flag)
+		}
+	}
+
 	if len(meta[0]) == 0 || meta[0][0] != '/' {
 		return nil, fmt.Errorf("message has invalid topic, got %v", meta[0])
 	}
@@ -227,6 +552,8 @@ func ParseMessage(message []byte) (*Message, error) {
 		ApplicationID: meta[3],
 		Time:          publishingTime,
 		NodeID:        uint8(nodeID),
+		Compressed:    compressed,
+		Binary:        binary,
 	}
 	msg.decodeFilters([]byte(meta[4]))
 
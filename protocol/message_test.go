@@ -124,6 +124,72 @@ func TestErrorsOnParsingMessages(t *testing.T) {
 	// Error Message without Name
 	_, err = Decode([]byte("!"))
 	assert.Error(err)
+
+	// unknown compression
+	_, err = Decode([]byte("/foo/bar,42,user01,phone01,,1420110000,1,zip\n{}\nBla"))
+	assert.Error(err)
+
+	// unknown encoding, or a flag given twice
+	_, err = Decode([]byte("/foo/bar,42,user01,phone01,,1420110000,1,gzip,text\n{}\nBla"))
+	assert.Error(err)
+	_, err = Decode([]byte("/foo/bar,42,user01,phone01,,1420110000,1,binary,binary\n{}\nBla"))
+	assert.Error(err)
+}
+
+func TestMessage_BinaryBody(t *testing.T) {
+	a := assert.New(t)
+
+	// given a message with a body, which is not valid utf-8 and contains newlines
+	body := []byte{0x0a, 0xff, 0xfe, 0x00, '\n', 0x80, '\n'}
+	msg := &Message{ID: 42, Path: Path("/foo/bar"), Time: unixTime.Unix(), HeaderJSON: `{"a":1}`, Body: body, Binary: true}
+
+	// then the binary flag is part of the serialized message
+	a.Equal("/foo/bar,42,,,,1420110000,0,binary", msg.Metadata())
+
+	// and the parsed message has the unmodified body
+	parsed, err := ParseMessage(msg.Bytes())
+	a.NoError(err)
+	a.True(parsed.Binary)
+	a.False(parsed.Compressed)
+	a.Equal(`{"a":1}`, parsed.HeaderJSON)
+	a.Equal(body, parsed.Body)
+
+	// and a compressed binary message keeps both flags
+	a.NoError(msg.CompressBody())
+	a.Equal("/foo/bar,42,,,,1420110000,0,gzip,binary", msg.Metadata())
+	parsed, err = ParseMessage(msg.Bytes())
+	a.NoError(err)
+	a.True(parsed.Binary)
+	a.NoError(parsed.DecompressBody())
+	a.Equal(body, parsed.Body)
+}
+
+func TestMessage_CompressBody(t *testing.T) {
+	a := assert.New(t)
+
+	// given a message with a large body
+	body := []byte(strings.Repeat("Hello World ", 100))
+	msg := &Message{ID: 42, Path: Path("/foo/bar"), Time: unixTime.Unix(), Body: body}
+
+	// when compressing the body
+	a.NoError(msg.CompressBody())
+
+	// then the compressed flag is part of the serialized message
+	a.True(msg.Compressed)
+	a.True(len(msg.Body) < len(body))
+	a.Equal("/foo/bar,42,,,,1420110000,0,gzip", msg.Metadata())
+
+	// and the parsed message can be decompressed
+	parsed, err := ParseMessage(msg.Bytes())
+	a.NoError(err)
+	a.True(parsed.Compressed)
+	a.NoError(parsed.DecompressBody())
+	a.False(parsed.Compressed)
+	a.Equal(body, parsed.Body)
+
+	// and decompressing an uncompressed message does not change it
+	a.NoError(parsed.DecompressBody())
+	a.Equal(body, parsed.Body)
 }
 
 func TestParsingNotificationMessage(t *testing.T) {
@@ -224,3 +290,144 @@ func TestMessage_decodeFilters(t *testing.T) {
 	a.Equal(msg.Filters["user"], "user01")
 	a.Equal(msg.Filters["device_id"], "ID_DEVICE")
 }
+
+func TestMessage_Priority(t *testing.T) {
+	a := assert.New(t)
+
+	for header, expected := range map[string]string{
+		``:                        PriorityNormal,
+		`{}`:                      PriorityNormal,
+		`{"priority":"high"}`:     PriorityHigh,
+		`{"Priority":"HIGH"}`:     PriorityHigh,
+		`{"priority":"normal"}`:   PriorityNormal,
+		`{"Content-Type":"json"}`: PriorityNormal,
+	} {
+		priority, err := (&Message{HeaderJSON: header}).Priority()
+		a.NoError(err, header)
+		a.Equal(expected, priority, header)
+	}
+
+	for _, header := range []string{`{"priority":"urgent"}`, `{"priority":10}`} {
+		_, err := (&Message{HeaderJSON: header}).Priority()
+		a.Equal(ErrInvalidPriority, err, header)
+	}
+}
+
+func TestMessage_PartitionKey(t *testing.T) {
+	a := assert.New(t)
+
+	for header, expected := range map[string]string{
+		``:                             "",
+		`{}`:                           "",
+		`invalid`:                      "",
+		`{"Partition-Key":"user01"}`:   "user01",
+		`{"partition-key":"user01"}`:   "user01",
+		`{"Partition-Key":42}`:         "42",
+		`{"Content-Type":"text/html"}`: "",
+	} {
+		a.Equal(expected, (&Message{HeaderJSON: header}).PartitionKey(), header)
+	}
+}
+
+func TestMessage_DeliverAt(t *testing.T) {
+	a := assert.New(t)
+
+	for header, expected := range map[string]time.Time{
+		``:                                      {},
+		`{}`:                                    {},
+		`{"Deliver-At":"2017-01-02T15:04:05Z"}`: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+		`{"deliver-at":"2017-01-02T16:04:05+01:00"}`: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+	} {
+		deliverAt, err := (&Message{HeaderJSON: header}).DeliverAt()
+		a.NoError(err, header)
+		a.True(expected.Equal(deliverAt), header)
+	}
+
+	for _, header := range []string{`{"deliver-at":"tomorrow"}`, `{"deliver-at":1483369445}`} {
+		_, err := (&Message{HeaderJSON: header}).DeliverAt()
+		a.Equal(ErrInvalidDeliverAt, err, header)
+	}
+}
+
+func TestMessage_Expires(t *testing.T) {
+	a := assert.New(t)
+
+	for header, expected := range map[string]time.Time{
+		``:                                   {},
+		`{}`:                                 {},
+		`{"Expires":"2017-01-02T15:04:05Z"}`: time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+		`{"expires":"1h30m"}`:                time.Unix(1420110000, 0).Add(90 * time.Minute),
+	} {
+		expires, err := (&Message{Time: 1420110000, HeaderJSON: header}).Expires()
+		a.NoError(err, header)
+		a.True(expected.Equal(expires), header)
+	}
+
+	for _, header := range []string{`{"expires":"tomorrow"}`, `{"expires":"-1h"}`, `{"expires":3600}`} {
+		_, err := (&Message{HeaderJSON: header}).Expires()
+		a.Equal(ErrInvalidExpires, err, header)
+	}
+}
+
+func TestMessage_ContentType(t *testing.T) {
+	a := assert.New(t)
+
+	for header, expected := range map[string]string{
+		``:                                    "",
+		`{}`:                                  "",
+		`{"Content-Type":"application/json"}`: "application/json",
+		`{"content-type":"text/plain; charset=utf-8"}`:    "text/plain; charset=utf-8",
+		`{"Content-Type":"application/x-protobuf"}`:       "application/x-protobuf",
+		`{"Partition-Key":"user01","Schema":"orders.v1"}`: "",
+	} {
+		contentType, err := (&Message{HeaderJSON: header}).ContentType()
+		a.NoError(err, header)
+		a.Equal(expected, contentType, header)
+	}
+
+	for _, header := range []string{`{"Content-Type":"json"}`, `{"Content-Type":"application/"}`, `{"Content-Type":"a/b/c"}`, `{"Content-Type":"text/plain;;"}`, `{"Content-Type":42}`} {
+		_, err := (&Message{HeaderJSON: header}).ContentType()
+		a.Equal(ErrInvalidContentType, err, header)
+	}
+}
+
+func TestMessage_IsJSON(t *testing.T) {
+	a := assert.New(t)
+
+	a.True((&Message{HeaderJSON: `{"Content-Type":"application/json"}`}).IsJSON())
+	a.True((&Message{HeaderJSON: `{"Content-Type":"application/json; charset=utf-8"}`}).IsJSON())
+	a.True((&Message{HeaderJSON: `{"Content-Type":"application/ld+json"}`}).IsJSON())
+	a.False((&Message{HeaderJSON: `{"Content-Type":"text/plain"}`}).IsJSON())
+	a.False((&Message{HeaderJSON: `{"Content-Type":"json"}`}).IsJSON())
+	a.False((&Message{Body: []byte(`{"looks":"like json"}`)}).IsJSON())
+}
+
+func TestMessage_Schema(t *testing.T) {
+	a := assert.New(t)
+
+	msg := &Message{HeaderJSON: `{"Schema":"orders.Order","Schema-Version":"3"}`}
+	a.Equal("orders.Order", msg.Schema())
+	a.Equal("3", msg.SchemaVersion())
+
+	msg = &Message{HeaderJSON: `{"schema-version":3}`}
+	a.Equal("", msg.Schema())
+	a.Equal("3", msg.SchemaVersion())
+}
+
+func TestMessage_HeaderValues(t *testing.T) {
+	a := assert.New(t)
+
+	msg := &Message{HeaderJSON: `{"Customer":"4711","region":"eu","Count":3}`}
+	a.Equal(map[string]string{"customer": "4711", "Count": "3"}, msg.HeaderValues("customer", "Count", "missing"))
+	a.Equal(map[string]string{}, (&Message{}).HeaderValues("customer"))
+	a.Equal(map[string]string{}, (&Message{HeaderJSON: "{"}).HeaderValues("customer"))
+}
+
+func TestMessage_IsExpired(t *testing.T) {
+	a := assert.New(t)
+	msg := &Message{Time: 1420110000, HeaderJSON: `{"Expires":"1m"}`}
+	a.False(msg.IsExpired(time.Unix(1420110000, 0).Add(59 * time.Second)))
+	a.True(msg.IsExpired(time.Unix(1420110000, 0).Add(time.Minute)))
+	a.False((&Message{Time: 1420110000}).IsExpired(time.Now()))
+	a.False((&Message{HeaderJSON: `{"Expires":"never"}`}).IsExpired(time.Now()))
+}
@@ -0,0 +1,52 @@
+package protocol
+
+import "errors"
+
+const (
+	// MetadataHeaderPrefix is the prefix of the headers of the websocket handshake, passing the metadata of the connection,
+	// e.g. `X-Guble-Meta-App-Version: 1.2` for the key `app-version`
+	MetadataHeaderPrefix = "X-Guble-Meta-"
+
+	// MetadataQueryPrefix is the prefix of the query parameters of the websocket url, passing the metadata of the connection,
+	// e.g. `meta_app_version=1.2` for the key `app_version`
+	MetadataQueryPrefix = "meta_"
+
+	// MaxMetadataEntries is the maximum number of metadata entries of a connection
+	MaxMetadataEntries = 16
+
+	// MaxMetadataKeyLength is the maximum length of a metadata key
+	MaxMetadataKeyLength = 32
+
+	// MaxMetadataValueLength is the maximum length of a metadata value
+	MaxMetadataValueLength = 128
+)
+
+// ErrInvalidMetadata is returned for connection metadata exceeding the limits, or with an invalid key
+var ErrInvalidMetadata = errors.New("Invalid metadata. The connection metadata exceeds the limits or has an invalid key.")
+
+// ValidateMetadata returns ErrInvalidMetadata, if the metadata has more than MaxMetadataEntries,
+// or a key which is empty, longer than MaxMetadataKeyLength or not made of lower case letters, digits, `-`, `_` and `.`,
+// or a value longer than MaxMetadataValueLength.
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return ErrInvalidMetadata
+	}
+	for key, value := range metadata {
+		if !validMetadataKey(key) || len(value) > MaxMetadataValueLength {
+			return ErrInvalidMetadata
+		}
+	}
+	return nil
+}
+
+func validMetadataKey(key string) bool {
+	if len(key) == 0 || len(key) > MaxMetadataKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
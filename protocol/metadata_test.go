@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	a := assert.New(t)
+	a.NoError(ValidateMetadata(nil))
+	a.NoError(ValidateMetadata(map[string]string{"app_version": "1.2", "device-model": "Pixel", "os.version": "7"}))
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxMetadataEntries; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	for _, metadata := range []map[string]string{
+		tooMany,
+		{"": "value"},
+		{"App": "value"},
+		{"app version": "value"},
+		{strings.Repeat("k", MaxMetadataKeyLength+1): "value"},
+		{"app": strings.Repeat("v", MaxMetadataValueLength+1)},
+	} {
+		a.Equal(ErrInvalidMetadata, ValidateMetadata(metadata), "%v", metadata)
+	}
+}
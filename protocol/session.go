@@ -0,0 +1,24 @@
+package protocol
+
+import "errors"
+
+const (
+	// SessionIDParam is the query parameter of the websocket url, naming the stable session of a client.
+	// The subscriptions of a session are restored by the server, when the client connects again with the same session id.
+	SessionIDParam = "sessionId"
+
+	// MaxSessionIDLength is the maximum length of a session id
+	MaxSessionIDLength = 64
+)
+
+// ErrInvalidSessionID is returned for a session id, which is too long or has invalid characters
+var ErrInvalidSessionID = errors.New("Invalid session id. It has to be made of letters, digits, `-`, `_` and `.`.")
+
+// ValidateSessionID returns ErrInvalidSessionID, if the session id is empty, longer than
+// MaxSessionIDLength or not made of letters, digits, `-`, `_` and `.`.
+func ValidateSessionID(id string) error {
+	if !isIdentifier(id, MaxSessionIDLength) {
+		return ErrInvalidSessionID
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSessionID(t *testing.T) {
+	a := assert.New(t)
+
+	a.NoError(ValidateSessionID("device-4711_app.v2"))
+	a.Equal(ErrInvalidSessionID, ValidateSessionID(""))
+	a.Equal(ErrInvalidSessionID, ValidateSessionID("device 4711"))
+	a.Equal(ErrInvalidSessionID, ValidateSessionID(strings.Repeat("a", MaxSessionIDLength+1)))
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// SubprotocolV1 is the websocket subprotocol of the current frame format.
+	// It is also the format of the clients, which do not request a subprotocol in the handshake.
+	SubprotocolV1 = "guble.v1"
+
+	// SubprotocolsHeader is the header of a rejected websocket handshake, listing the subprotocols of the server
+	SubprotocolsHeader = "X-Guble-Subprotocols"
+)
+
+// ErrUnsupportedSubprotocol is returned, if the client and the server share no subprotocol version
+var ErrUnsupportedSubprotocol = errors.New("Unsupported websocket subprotocol. The client and the server share no protocol version.")
+
+// FrameCodec encodes and decodes the websocket frames of a subprotocol version.
+// Inside the server, the messages and notifications are in the frame format of SubprotocolV1
+// (which is also the format of the message store), and are encoded for the connection when they are sent.
+type FrameCodec interface {
+	// Subprotocol returns the name of the version in the `Sec-WebSocket-Protocol` header, e.g. SubprotocolV1
+	Subprotocol() string
+
+	// EncodeCmd encodes a command of a client
+	EncodeCmd(cmd *Cmd) []byte
+
+	// DecodeCmd decodes a command received by the server
+	DecodeCmd(frame []byte) (*Cmd, error)
+
+	// EncodeFrame encodes a message or notification of the server, given in the frame format of SubprotocolV1
+	EncodeFrame(frame []byte) []byte
+
+	// Decode decodes a frame received by a client, returning a *Message or a *NotificationMessage
+	Decode(frame []byte) (interface{}, error)
+}
+
+// v1Codec is the FrameCodec of SubprotocolV1
+type v1Codec struct{}
+
+func (v1Codec) Subprotocol() string                      { return SubprotocolV1 }
+func (v1Codec) EncodeCmd(cmd *Cmd) []byte                { return cmd.Bytes() }
+func (v1Codec) DecodeCmd(frame []byte) (*Cmd, error)     { return ParseCmd(frame) }
+func (v1Codec) EncodeFrame(frame []byte) []byte          { return frame }
+func (v1Codec) Decode(frame []byte) (interface{}, error) { return Decode(frame) }
+
+// codecs are the supported versions, the newest first
+var codecs = []FrameCodec{v1Codec{}}
+
+// Subprotocols returns the names of the supported subprotocol versions, the newest first
+func Subprotocols() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Subprotocol()
+	}
+	return names
+}
+
+// Codec returns the FrameCodec of the subprotocol, or false if it is not supported.
+// An empty name returns the codec of SubprotocolV1, for the connections without a negotiated subprotocol.
+func Codec(subprotocol string) (FrameCodec, bool) {
+	if subprotocol == "" {
+		return v1Codec{}, true
+	}
+	for _, c := range codecs {
+		if c.Subprotocol() == subprotocol {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateSubprotocol returns the codec of the newest supported version of the requested subprotocols.
+// Without a requested subprotocol, the codec of SubprotocolV1 is returned.
+// If none of them is supported, ErrUnsupportedSubprotocol is returned.
+func NegotiateSubprotocol(requested []string) (FrameCodec, error) {
+	if len(requested) == 0 {
+		return v1Codec{}, nil
+	}
+	for _, c := range codecs {
+		for _, name := range requested {
+			if strings.TrimSpace(name) == c.Subprotocol() {
+				return c, nil
+			}
+		}
+	}
+	return nil, ErrUnsupportedSubprotocol
+}
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateSubprotocol(t *testing.T) {
+	a := assert.New(t)
+
+	codec, err := NegotiateSubprotocol(nil)
+	a.NoError(err)
+	a.Equal(SubprotocolV1, codec.Subprotocol())
+
+	codec, err = NegotiateSubprotocol([]string{"guble.v9", " guble.v1"})
+	a.NoError(err)
+	a.Equal(SubprotocolV1, codec.Subprotocol())
+
+	_, err = NegotiateSubprotocol([]string{"guble.v9", "chat"})
+	a.Equal(ErrUnsupportedSubprotocol, err)
+
+	_, ok := Codec("guble.v9")
+	a.False(ok)
+	codec, ok = Codec("")
+	a.True(ok)
+	a.Equal(SubprotocolV1, codec.Subprotocol())
+}
+
+func TestV1Codec(t *testing.T) {
+	a := assert.New(t)
+	codec, _ := Codec(SubprotocolV1)
+
+	cmd := &Cmd{Name: CmdSend, Arg: "/foo", HeaderJSON: `{"a":"b"}`, Body: []byte("Hello")}
+	decoded, err := codec.DecodeCmd(codec.EncodeCmd(cmd))
+	a.NoError(err)
+	a.Equal(cmd, decoded)
+
+	frame := []byte("#connected You are connected to the server.")
+	a.Equal(frame, codec.EncodeFrame(frame))
+	n, err := codec.Decode(codec.EncodeFrame(frame))
+	a.NoError(err)
+	a.Equal(SUCCESS_CONNECTED, n.(*NotificationMessage).Name)
+}
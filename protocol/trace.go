@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// TraceIDHeader is the field of the header json with the trace id of a message, which correlates the log lines
+	// of its ingest, routing, storing and delivery (the case of the field name is ignored).
+	// It can be set by a REST client with the header `X-Guble-Trace-Id`, or is generated by the router.
+	TraceIDHeader = "Trace-Id"
+
+	// MaxTraceIDLength is the maximum length of a trace id
+	MaxTraceIDLength = 128
+)
+
+// NewTraceID returns a new random trace id of 32 hex digits, as the trace ids of the W3C trace context
+func NewTraceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidTraceID returns true, if the trace id is not longer than MaxTraceIDLength
+// and made of letters, digits, `-`, `_` and `.`.
+func ValidTraceID(id string) bool {
+	return isIdentifier(id, MaxTraceIDLength)
+}
+
+// TraceIDOfTraceParent returns the trace id of a W3C `traceparent` header (`version-traceid-parentid-flags`),
+// or an empty string if it has another format
+func TraceIDOfTraceParent(traceParent string) string {
+	parts := strings.Split(strings.TrimSpace(traceParent), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return strings.ToLower(parts[1])
+}
+
+// TraceID returns the trace id set in the header json of the message, or an empty string if not set or invalid
+func (msg *Message) TraceID() string {
+	id := msg.headerString(TraceIDHeader)
+	if !ValidTraceID(id) {
+		return ""
+	}
+	return id
+}
+
+// SetTraceID sets the trace id in the header json of the message, replacing an existing one.
+// The header json is rewritten, so the order of its fields may change.
+// A message with a header, which is no json object, returns the error of decoding it.
+func (msg *Message) SetTraceID(id string) error {
+	header := make(map[string]json.RawMessage)
+	if msg.HeaderJSON != "" {
+		if err := json.Unmarshal([]byte(msg.HeaderJSON), &header); err != nil {
+			return err
+		}
+		if header == nil {
+			header = make(map[string]json.RawMessage)
+		}
+	}
+	for key := range header {
+		if strings.EqualFold(key, TraceIDHeader) {
+			delete(header, key)
+		}
+	}
+	value, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	header[TraceIDHeader] = value
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	msg.HeaderJSON = string(data)
+	return nil
+}
@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTraceID(t *testing.T) {
+	a := assert.New(t)
+
+	id := NewTraceID()
+	a.Len(id, 32)
+	a.True(ValidTraceID(id))
+	a.NotEqual(id, NewTraceID())
+}
+
+func TestMessage_TraceID(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("", (&Message{}).TraceID())
+	a.Equal("abc-1", (&Message{HeaderJSON: `{"trace-id":"abc-1"}`}).TraceID())
+	// an invalid trace id is ignored
+	a.Equal("", (&Message{HeaderJSON: `{"Trace-Id":"a b"}`}).TraceID())
+
+	// setting the trace id keeps the other fields, and replaces an existing one
+	msg := &Message{HeaderJSON: `{"Content-Type":"text/plain","trace-id":"old"}`}
+	a.NoError(msg.SetTraceID("new"))
+	a.JSONEq(`{"Content-Type":"text/plain","Trace-Id":"new"}`, msg.HeaderJSON)
+	a.Equal("new", msg.TraceID())
+
+	msg = &Message{}
+	a.NoError(msg.SetTraceID("abc"))
+	a.Equal(`{"Trace-Id":"abc"}`, msg.HeaderJSON)
+
+	msg = &Message{HeaderJSON: "null"}
+	a.NoError(msg.SetTraceID("abc"))
+	a.Equal(`{"Trace-Id":"abc"}`, msg.HeaderJSON)
+
+	// a header which is no json object is not changed
+	msg = &Message{HeaderJSON: `[1]`}
+	a.Error(msg.SetTraceID("abc"))
+	a.Equal(`[1]`, msg.HeaderJSON)
+}
+
+func TestTraceIDOfTraceParent(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal("4bf92f3577b34da6a3ce929d0e0e4736", TraceIDOfTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	a.Equal("", TraceIDOfTraceParent(""))
+	a.Equal("", TraceIDOfTraceParent("00-4bf92f35-00f067aa0ba902b7-01"))
+	a.Equal("", TraceIDOfTraceParent("00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+}
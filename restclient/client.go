@@ -0,0 +1,285 @@
+package restclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxRetries is the number of retries of a request, which failed with a 5xx status or a network error
+	DefaultMaxRetries = 3
+
+	// DefaultRetryBackoff is the delay before the first retry, doubled for each following one
+	DefaultRetryBackoff = 100 * time.Millisecond
+
+	// rangePageSize is the number of messages requested by each page of FetchRange
+	rangePageSize = 100
+
+	xHeaderPrefix = "X-Guble-"
+)
+
+var (
+	// ErrNotFound is matched by errors.Is for the responses with status 404
+	ErrNotFound = errors.New("Not found.")
+
+	// ErrAccessDenied is matched by errors.Is for the responses with status 401 or 403
+	ErrAccessDenied = errors.New("Access denied.")
+)
+
+// ResponseError is an error response of the REST API
+type ResponseError struct {
+	// StatusCode is the http status of the response
+	StatusCode int
+
+	// Code is the name of the error, e.g. protocol.ERROR_BAD_REQUEST, if the server responded with a json error
+	Code string
+
+	// Description is the description of the json error, or the body of any other error response
+	Description string
+}
+
+// Error returns the status and the description of the response
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("Error code returned from guble: %d: %s", e.StatusCode, e.Description)
+}
+
+// Is matches ErrNotFound and ErrAccessDenied by the status of the response
+func (e *ResponseError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrAccessDenied:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Receipt is returned by Publish, after the message was stored
+type Receipt struct {
+	MessageID      uint64 `json:"messageID"`
+	StoreTimestamp int64  `json:"storeTimestamp"`
+	Partition      string `json:"partition"`
+	NodeID         uint8  `json:"nodeID"`
+}
+
+// Offsets are the first and last message id of a topic and the number of messages between them
+type Offsets struct {
+	FirstID uint64 `json:"firstID"`
+	LastID  uint64 `json:"lastID"`
+	Count   uint64 `json:"count"`
+}
+
+// message is a message in the json format of the message range
+type message struct {
+	ID            uint64          `json:"id"`
+	Path          protocol.Path   `json:"path"`
+	UserID        string          `json:"userId"`
+	ApplicationID string          `json:"applicationId"`
+	Time          int64           `json:"time"`
+	Header        json.RawMessage `json:"header"`
+	Body          string          `json:"body"`
+	Binary        bool            `json:"binary"`
+}
+
+func (m *message) toMessage() (*protocol.Message, error) {
+	msg := &protocol.Message{
+		ID:            m.ID,
+		Path:          m.Path,
+		UserID:        m.UserID,
+		ApplicationID: m.ApplicationID,
+		Time:          m.Time,
+		HeaderJSON:    string(m.Header),
+		Body:          []byte(m.Body),
+		Binary:        m.Binary,
+	}
+	if m.Binary {
+		body, err := base64.StdEncoding.DecodeString(m.Body)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = body
+	}
+	return msg, nil
+}
+
+// Client is a typed client of the REST API, e.g. for `http://localhost:8080/api`.
+// The requests answered with a 5xx status, or failed by a network error, are retried with an exponential backoff.
+type Client struct {
+	endpoint   string
+	httpClient *http.Client
+
+	// MaxRetries is the number of retries of a failed request. Zero disables the retries.
+	MaxRetries int
+
+	// RetryBackoff is the delay before the first retry, doubled for each following one
+	RetryBackoff time.Duration
+}
+
+// NewClient returns a new Client for the endpoint of the REST API.
+// The httpClient can be customized for the timeouts or the transport, and http.DefaultClient is used if it is nil.
+func NewClient(endpoint string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		endpoint:     endpoint,
+		httpClient:   httpClient,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+	}
+}
+
+// Publish sends the body to the topic, with the header as the `X-Guble-` headers of the message,
+// and returns the receipt of the stored message.
+func (c *Client) Publish(ctx context.Context, topic string, body []byte, header map[string]string) (*Receipt, error) {
+	httpHeader := http.Header{}
+	for k, v := range header {
+		httpHeader.Set(xHeaderPrefix+k, v)
+	}
+	receipt := &Receipt{}
+	query := url.Values{"receipt": {"true"}}
+	if err := c.do(ctx, http.MethodPost, c.messageURL(topic, "", query), httpHeader, body, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// FetchRange returns the messages of the topic and its subtopics with an id from start to end (inclusive), the oldest first.
+// An end of zero reads to the last message of the topic. The range is read in pages of 100 messages.
+func (c *Client) FetchRange(ctx context.Context, topic string, start, end uint64) ([]*protocol.Message, error) {
+	if start == 0 {
+		start = 1
+	}
+	messages := make([]*protocol.Message, 0)
+	for end == 0 || start <= end {
+		query := url.Values{
+			"from":  {strconv.FormatUint(start, 10)},
+			"limit": {strconv.Itoa(rangePageSize)},
+		}
+		if end > 0 {
+			query.Set("to", strconv.FormatUint(end, 10))
+		}
+		var page []*message
+		if err := c.do(ctx, http.MethodGet, c.messageURL(topic, "", query), nil, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			msg, err := m.toMessage()
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		}
+		if len(page) < rangePageSize {
+			break
+		}
+		start = page[len(page)-1].ID + 1
+	}
+	return messages, nil
+}
+
+// Offsets returns the first and last message id of the topic and the number of messages between them
+func (c *Client) Offsets(ctx context.Context, topic string) (*Offsets, error) {
+	offsets := &Offsets{}
+	if err := c.do(ctx, http.MethodGet, c.messageURL(topic, "/offsets", nil), nil, nil, offsets); err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+func (c *Client) messageURL(topic, suffix string, query url.Values) string {
+	u := fmt.Sprintf("%s/message/%s%s", c.endpoint, trimPrefixSlash(topic), suffix)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends the request, retrying it on 5xx and network errors, and decodes the json response into result
+func (c *Client) do(ctx context.Context, method, requestURL string, header http.Header, body []byte, result interface{}) error {
+	backoff := c.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, requestURL, header, body, result)
+		if err == nil || attempt >= c.MaxRetries || !retryable(ctx, err) {
+			return err
+		}
+		logger.WithError(err).WithFields(log.Fields{
+			"url":     requestURL,
+			"attempt": attempt + 1,
+		}).Warn("Retrying the guble request")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, requestURL string, header http.Header, body []byte, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		request.Header[k] = v
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return newResponseError(response)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// newResponseError reads the error of the response, which is a json error of the REST API or plain text
+func newResponseError(response *http.Response) error {
+	content, _ := ioutil.ReadAll(response.Body)
+	e := &ResponseError{StatusCode: response.StatusCode, Description: string(bytes.TrimSpace(content))}
+	jsonError := struct {
+		Error       string `json:"error"`
+		Description string `json:"description"`
+	}{}
+	if json.Unmarshal(content, &jsonError) == nil && jsonError.Error != "" {
+		e.Code = jsonError.Error
+		e.Description = jsonError.Description
+	}
+	return e
+}
+
+// retryable returns true for the 5xx responses and the network errors, but not if the context is done
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var responseError *ResponseError
+	if errors.As(err, &responseError) {
+		return responseError.StatusCode >= http.StatusInternalServerError
+	}
+	var urlError *url.Error
+	return errors.As(err, &urlError)
+}
@@ -0,0 +1,179 @@
+package restclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_Publish(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		a.Equal(http.MethodPost, r.Method)
+		a.Equal("/api/message/foo/bar", r.URL.Path)
+		a.Equal("true", r.URL.Query().Get("receipt"))
+		a.Equal("eu", r.Header.Get("X-Guble-Region"))
+		a.Equal("Hello", string(body))
+		fmt.Fprint(w, `{"messageID":42,"storeTimestamp":1451236804,"partition":"foo","nodeID":1}`)
+	}))
+	defer server.Close()
+
+	receipt, err := NewClient(server.URL+"/api", nil).Publish(
+		context.Background(), "/foo/bar", []byte("Hello"), map[string]string{"Region": "eu"})
+	a.NoError(err)
+	a.Equal(&Receipt{MessageID: 42, StoreTimestamp: 1451236804, Partition: "foo", NodeID: 1}, receipt)
+}
+
+func TestClient_FetchRangeReadsThePages(t *testing.T) {
+	a := assert.New(t)
+
+	// given a server with the messages 1 to 250 of the topic
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		var from, to, limit int
+		fmt.Sscan(r.URL.Query().Get("from"), &from)
+		fmt.Sscan(r.URL.Query().Get("to"), &to)
+		fmt.Sscan(r.URL.Query().Get("limit"), &limit)
+		fmt.Fprint(w, "[")
+		for id := from; id <= to && id < from+limit; id++ {
+			if id > from {
+				fmt.Fprint(w, ",")
+			}
+			if id == 7 {
+				// a binary body is base64 encoded
+				fmt.Fprintf(w, `{"id":%d,"path":"/foo","time":1,"body":"AAEC","binary":true}`, id)
+				continue
+			}
+			fmt.Fprintf(w, `{"id":%d,"path":"/foo","time":1,"header":{"x":"y"},"body":"%d"}`, id, id)
+		}
+		fmt.Fprint(w, "]")
+	}))
+	defer server.Close()
+
+	// when fetching a range larger than a page
+	messages, err := NewClient(server.URL+"/api", nil).FetchRange(context.Background(), "/foo", 2, 250)
+
+	// then all of its messages are returned
+	a.NoError(err)
+	a.Equal([]string{"from=2&limit=100&to=250", "from=102&limit=100&to=250", "from=202&limit=100&to=250"}, requests)
+	if a.Len(messages, 249) {
+		a.Equal(uint64(2), messages[0].ID)
+		a.Equal(protocol.Path("/foo"), messages[0].Path)
+		a.Equal(`{"x":"y"}`, messages[0].HeaderJSON)
+		a.Equal("2", string(messages[0].Body))
+		a.Equal([]byte{0, 1, 2}, messages[5].Body)
+		a.True(messages[5].Binary)
+		a.Equal(uint64(250), messages[248].ID)
+	}
+}
+
+func TestClient_Offsets(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal("/api/message/foo/offsets", r.URL.Path)
+		fmt.Fprint(w, `{"firstID":4237,"lastID":8644,"count":4408}`)
+	}))
+	defer server.Close()
+
+	offsets, err := NewClient(server.URL+"/api", nil).Offsets(context.Background(), "foo")
+	a.NoError(err)
+	a.Equal(&Offsets{FirstID: 4237, LastID: 8644, Count: 4408}, offsets)
+}
+
+func TestClient_RetriesServerErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "Server error.", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"firstID":1,"lastID":2,"count":2}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL+"/api", nil)
+	c.RetryBackoff = time.Millisecond
+
+	// when the server fails twice, then the third attempt succeeds
+	offsets, err := c.Offsets(context.Background(), "/foo")
+	a.NoError(err)
+	a.Equal(uint64(2), offsets.Count)
+	a.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	// and the error of the last attempt is returned, if all of them fail
+	atomic.StoreInt32(&calls, -10)
+	_, err = c.Offsets(context.Background(), "/foo")
+	a.Equal(int32(-6), atomic.LoadInt32(&calls))
+	var responseError *ResponseError
+	if a.True(errors.As(err, &responseError)) {
+		a.Equal(http.StatusServiceUnavailable, responseError.StatusCode)
+		a.Equal("Server error.", responseError.Description)
+	}
+}
+
+func TestClient_MapsTheErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/api/message/denied/offsets":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":"error-access-denied","description":"read access denied on /denied"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	c := NewClient(server.URL+"/api", nil)
+
+	// a json error is decoded, and the 4xx errors are not retried
+	_, err := c.Offsets(context.Background(), "/denied")
+	a.True(errors.Is(err, ErrAccessDenied))
+	a.False(errors.Is(err, ErrNotFound))
+	var responseError *ResponseError
+	if a.True(errors.As(err, &responseError)) {
+		a.Equal(protocol.ERROR_ACCESS_DENIED, responseError.Code)
+		a.Equal("read access denied on /denied", responseError.Description)
+	}
+	a.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	_, err = c.Offsets(context.Background(), "/other")
+	a.True(errors.Is(err, ErrNotFound))
+}
+
+func TestClient_StopsRetryingWhenTheContextIsDone(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL+"/api", nil)
+	c.RetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.Offsets(ctx, "/foo")
+	a.Equal(context.DeadlineExceeded, err)
+	a.True(time.Since(start) < time.Second)
+}
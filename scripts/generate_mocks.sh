@@ -86,6 +86,12 @@ $MOCKGEN -package apns \
       github.com/smancke/guble/server/apns \
       Pusher &
 
+# server/webhook mocks
+$MOCKGEN -package webhook \
+      -destination server/webhook/mocks_router_gen_test.go \
+      github.com/smancke/guble/server/router \
+      Router &
+
 # server/fcm mocks
 $MOCKGEN -package fcm \
       -destination server/fcm/mocks_router_gen_test.go \
@@ -190,7 +196,7 @@ $MOCKGEN -package rest \
 $MOCKGEN -package sms \
       -destination server/sms/mocks_sender_gen_test.go \
       github.com/smancke/guble/server/sms \
-      Sender &
+      Sender,SMSProvider &
 
 $MOCKGEN -package sms \
       -destination server/sms/mocks_router_gen_test.go \
@@ -26,10 +26,26 @@ type Config struct {
 	CertificateFileName *string
 	CertificateBytes    *[]byte
 	CertificatePassword *string
+	AuthKeyFileName     *string
+	AuthKeyID           *string
+	TeamID              *string
 	AppTopic            *string
 	Workers             *int
+	QueueSize           *int
+	OverflowPolicy      *string
 	Prefix              *string
 	IntervalMetrics     *bool
+	InvalidSubscriber   connector.InvalidSubscriberCallback
+	Events              *connector.Events
+
+	// DryRun logs the notifications instead of pushing them, see newDryRunPusher
+	DryRun *bool
+}
+
+// TokenAuth returns true if the token-based authentication with a .p8 auth key is configured,
+// which is used instead of the certificate
+func (c Config) TokenAuth() bool {
+	return c.AuthKeyFileName != nil && *c.AuthKeyFileName != ""
 }
 
 // apns is the private struct for handling the communication with APNS
@@ -40,17 +56,21 @@ type apns struct {
 
 // New creates a new connector.ResponsiveConnector without starting it
 func New(router router.Router, sender connector.Sender, config Config) (connector.ResponsiveConnector, error) {
-	baseConn, err := connector.NewConnector(
-		router,
-		sender,
-		connector.Config{
-			Name:       "apns",
-			Schema:     schema,
-			Prefix:     *config.Prefix,
-			URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceIDKey, userIDKey, connector.TopicParam),
-			Workers:    *config.Workers,
-		},
-	)
+	connConfig := connector.Config{
+		Name:       "apns",
+		Schema:     schema,
+		Prefix:     *config.Prefix,
+		URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceIDKey, userIDKey, connector.TopicParam),
+		Workers:    *config.Workers,
+		Events:     config.Events,
+	}
+	if config.QueueSize != nil {
+		connConfig.QueueSize = *config.QueueSize
+	}
+	if config.OverflowPolicy != nil {
+		connConfig.OverflowPolicy = connector.OverflowPolicy(*config.OverflowPolicy)
+	}
+	baseConn, err := connector.NewConnector(router, sender, connConfig)
 	if err != nil {
 		logger.WithError(err).Error("Base connector error")
 		return nil, err
@@ -81,6 +101,7 @@ func (a *apns) startMetrics() {
 	mTotalSendNetworkErrors.Set(0)
 	mTotalSendRetryCloseTLS.Set(0)
 	mTotalSendRetryUnrecoverable.Set(0)
+	mTotalDryRunMessages.Set(0)
 
 	if *a.IntervalMetrics {
 		a.startIntervalMetric(mMinute, time.Minute)
@@ -116,8 +137,13 @@ func (a *apns) HandleResponse(request connector.Request, responseIface interface
 		mTotalResponseInternalErrors.Add(1)
 		return err
 	}
+	if r.Sent() && r.ApnsID == dryRunApnsID {
+		mTotalDryRunMessages.Add(1)
+		metrics.PromConnectorDryRunRequests.WithLabelValues("apns").Inc()
+		return nil
+	}
 	if r.Sent() {
-		logger.WithField("id", r.ApnsID).Info("APNS notification was successfully sent")
+		logger.WithField("id", r.ApnsID).WithField("traceID", request.Message().TraceID()).Info("APNS notification was successfully sent")
 		mTotalSentMessages.Add(1)
 		if *a.IntervalMetrics && metadata != nil {
 			addToLatenciesAndCountsMaps(currentTotalMessagesLatenciesKey, currentTotalMessagesKey, metadata.Latency)
@@ -125,7 +151,8 @@ func (a *apns) HandleResponse(request connector.Request, responseIface interface
 		return nil
 	}
 	logger.Error("APNS notification was not sent")
-	logger.WithField("id", r.ApnsID).WithField("reason", r.Reason).Info("APNS notification was not sent - details")
+	logger.WithField("id", r.ApnsID).WithField("reason", r.Reason).
+		WithField("traceID", request.Message().TraceID()).Info("APNS notification was not sent - details")
 	switch r.Reason {
 	case
 		apns2.ReasonMissingDeviceToken,
@@ -139,6 +166,9 @@ func (a *apns) HandleResponse(request connector.Request, responseIface interface
 		if err != nil {
 			logger.WithField("id", r.ApnsID).Error("could not remove subscriber")
 		}
+		if a.InvalidSubscriber != nil {
+			a.InvalidSubscriber(subscriber)
+		}
 	default:
 		logger.Error("handling other APNS errors")
 		mTotalResponseOtherErrors.Add(1)
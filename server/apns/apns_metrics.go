@@ -16,6 +16,7 @@ var (
 	mTotalSendNetworkErrors          = ns.NewInt("total_send_network_errors")
 	mTotalSendRetryCloseTLS          = ns.NewInt("total_send_retry_close_tls")
 	mTotalSendRetryUnrecoverable     = ns.NewInt("total_send_retry_unrecoverable")
+	mTotalDryRunMessages             = ns.NewInt("total_dry_run_messages")
 	mMinute                          = ns.NewMap("minute")
 	mHour                            = ns.NewMap("hour")
 	mDay                             = ns.NewMap("day")
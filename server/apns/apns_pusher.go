@@ -25,14 +25,23 @@ type closable interface {
 	CloseTLS()
 }
 
+// tokenRefresher is implemented by the pushers using token-based authentication
+type tokenRefresher interface {
+	RefreshToken()
+}
+
 func newPusher(c Config) (Pusher, error) {
 	logger.Info("creating new apns pusher")
 
 	var (
 		cert    tls.Certificate
+		token   *authToken
 		errCert error
 	)
-	if c.CertificateFileName != nil && *c.CertificateFileName != "" {
+	if c.TokenAuth() {
+		logger.WithField("keyID", *c.AuthKeyID).Info("Using token-based authentication")
+		token, errCert = newAuthTokenFromFile(*c.AuthKeyFileName, *c.AuthKeyID, *c.TeamID)
+	} else if c.CertificateFileName != nil && *c.CertificateFileName != "" {
 		cert, errCert = certificate.FromP12File(*c.CertificateFileName, *c.CertificatePassword)
 	} else {
 		cert, errCert = certificate.FromP12Bytes(*c.CertificateBytes, *c.CertificatePassword)
@@ -41,7 +50,7 @@ func newPusher(c Config) (Pusher, error) {
 		return nil, errCert
 	}
 
-	var clientFactory func(certificate tls.Certificate) *apns2Client
+	var clientFactory func(certificate tls.Certificate, token *authToken) *apns2Client
 	if *c.Production {
 		clientFactory = newProductionClient
 	} else {
@@ -53,20 +62,20 @@ func newPusher(c Config) (Pusher, error) {
 
 	logger.Info("created new apns pusher")
 
-	return clientFactory(cert), nil
+	return clientFactory(cert, token), nil
 }
 
-func newProductionClient(certificate tls.Certificate) *apns2Client {
+func newProductionClient(certificate tls.Certificate, token *authToken) *apns2Client {
 	logger.Info("APNS Pusher in Production mode")
-	c := newApns2Client(certificate)
+	c := newApns2Client(certificate, token)
 	c.Production()
 	logger.WithField("apns_url", c.Host).Info("APNS Pusher in Production mode url")
 	return c
 }
 
-func newDevelopmentClient(certificate tls.Certificate) *apns2Client {
+func newDevelopmentClient(certificate tls.Certificate, token *authToken) *apns2Client {
 	logger.Info("APNS Pusher in Development mode")
-	c := newApns2Client(certificate)
+	c := newApns2Client(certificate, token)
 	c.Development()
 	logger.WithField("apns_url", c.Host).Info("APNS Pusher in Development mode url")
 	return c
@@ -77,12 +86,16 @@ type apns2Client struct {
 
 	tlsConn net.Conn
 	mu      sync.Mutex
+
+	// token is nil when using certificate-based authentication
+	token *authToken
 }
 
-func newApns2Client(certificate tls.Certificate) *apns2Client {
+// newApns2Client creates a client authenticating with the token, if not nil, or else with the certificate
+func newApns2Client(certificate tls.Certificate, token *authToken) *apns2Client {
 	logger.Info("creating new apns2client")
 
-	c := &apns2Client{}
+	c := &apns2Client{token: token}
 
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{certificate},
@@ -105,9 +118,13 @@ func newApns2Client(certificate tls.Certificate) *apns2Client {
 			return conn, err
 		},
 	}
+	var roundTripper http.RoundTripper = transport
+	if token != nil {
+		roundTripper = &tokenTransport{token: token, base: transport}
+	}
 	client := &apns2.Client{
 		HTTPClient: &http.Client{
-			Transport: transport,
+			Transport: roundTripper,
 			Timeout:   httpClientTimeout,
 		},
 		Certificate: certificate,
@@ -130,3 +147,12 @@ func (c *apns2Client) CloseTLS() {
 		c.tlsConn = nil
 	}
 }
+
+// RefreshToken forces a new JWT for the next push.
+// It implements the interface tokenRefresher, and does nothing when using certificate-based authentication.
+func (c *apns2Client) RefreshToken() {
+	if c.token != nil {
+		logger.Info("Refreshing the APNS auth token")
+		c.token.expire()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/jpillora/backoff"
 	"github.com/sideshow/apns2"
+	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/connector"
 	"net"
 	"time"
@@ -31,6 +32,10 @@ func NewSender(config Config) (connector.Sender, error) {
 		logger.WithField("error", err.Error()).Error("APNS Pusher creation error")
 		return nil, err
 	}
+	if config.DryRun != nil && *config.DryRun {
+		logger.Info("APNS: dry run, the notifications are logged instead of pushed")
+		pusher = newDryRunPusher()
+	}
 	return NewSenderUsingPusher(pusher, *config.AppTopic)
 }
 
@@ -49,10 +54,11 @@ func (s sender) Send(request connector.Request) (interface{}, error) {
 	logger.WithField("deviceToken", deviceToken).Info("Trying to push a message to APNS")
 	push := func() (interface{}, error) {
 		return s.client.Push(&apns2.Notification{
-			Priority:    apns2.PriorityHigh,
+			Priority:    apnsPriority(request.Message()),
 			Topic:       s.appTopic,
 			DeviceToken: deviceToken,
 			Payload:     request.Message().Body,
+			Expiration:  apnsExpiration(request.Message()),
 		})
 	}
 	withRetry := &retryable{
@@ -76,9 +82,32 @@ func (s sender) Send(request connector.Request) (interface{}, error) {
 			logger.Error("Cannot Close TLS. Unrecoverable state")
 		}
 	}
+	if r, ok := result.(*apns2.Response); ok && r != nil && r.Reason == apns2.ReasonExpiredProviderToken {
+		if refresher, ok := s.client.(tokenRefresher); ok {
+			logger.Warn("APNS auth token expired, refresh and retry once")
+			refresher.RefreshToken()
+			return push()
+		}
+	}
 	return result, err
 }
 
+// apnsPriority returns the APNS priority for the priority header of the message:
+// high is sent immediately, and normal (the default) at a time conserving the power of the device.
+func apnsPriority(m *protocol.Message) int {
+	if priority, _ := m.Priority(); priority == protocol.PriorityHigh {
+		return apns2.PriorityHigh
+	}
+	return apns2.PriorityLow
+}
+
+// apnsExpiration returns the time of the expires header of the message, after which APNS stops trying to deliver it.
+// Without a (valid) expires header, it is the zero time, so that APNS applies its default.
+func apnsExpiration(m *protocol.Message) time.Time {
+	expires, _ := m.Expires()
+	return expires
+}
+
 type retryable struct {
 	backoff.Backoff
 	maxTries int
@@ -3,11 +3,15 @@ package apns
 import (
 	"errors"
 	"github.com/golang/mock/gomock"
+	"github.com/sideshow/apns2"
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
 	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/testutil"
 	"github.com/stretchr/testify/assert"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func TestNewSender_ErrorBytes(t *testing.T) {
@@ -88,6 +92,66 @@ func TestSender_Send(t *testing.T) {
 	a.Nil(rsp)
 }
 
+func TestSender_PriorityFromTheHeader(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	route := router.NewRoute(router.RouteConfig{Path: protocol.Path("path")})
+	mSubscriber := NewMockSubscriber(testutil.MockCtrl)
+	mSubscriber.EXPECT().Route().Return(route).AnyTimes()
+
+	mPusher := NewMockPusher(testutil.MockCtrl)
+	s, err := NewSenderUsingPusher(mPusher, "com.myapp")
+	a.NoError(err)
+
+	for header, priority := range map[string]int{
+		``:                      apns2.PriorityLow,
+		`{"priority":"normal"}`: apns2.PriorityLow,
+		`{"priority":"high"}`:   apns2.PriorityHigh,
+	} {
+		mRequest := NewMockRequest(testutil.MockCtrl)
+		mRequest.EXPECT().Subscriber().Return(mSubscriber).AnyTimes()
+		mRequest.EXPECT().Message().Return(&protocol.Message{HeaderJSON: header, Body: []byte("{}")}).AnyTimes()
+		mPusher.EXPECT().Push(gomock.Any()).Do(func(n *apns2.Notification) {
+			a.Equal(priority, n.Priority, header)
+		}).Return(nil, nil)
+
+		_, err := s.Send(mRequest)
+		a.NoError(err)
+	}
+}
+
+func TestSender_ExpirationFromTheExpiresHeader(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	route := router.NewRoute(router.RouteConfig{Path: protocol.Path("path")})
+	mSubscriber := NewMockSubscriber(testutil.MockCtrl)
+	mSubscriber.EXPECT().Route().Return(route).AnyTimes()
+
+	mPusher := NewMockPusher(testutil.MockCtrl)
+	s, err := NewSenderUsingPusher(mPusher, "com.myapp")
+	a.NoError(err)
+
+	for header, expiration := range map[string]time.Time{
+		``:                                   {},
+		`{"expires":"1h"}`:                   time.Unix(1420110000, 0).Add(time.Hour),
+		`{"expires":"2015-01-01T12:00:00Z"}`: time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC),
+	} {
+		mRequest := NewMockRequest(testutil.MockCtrl)
+		mRequest.EXPECT().Subscriber().Return(mSubscriber).AnyTimes()
+		mRequest.EXPECT().Message().Return(&protocol.Message{Time: 1420110000, HeaderJSON: header, Body: []byte("{}")}).AnyTimes()
+		mPusher.EXPECT().Push(gomock.Any()).Do(func(n *apns2.Notification) {
+			a.True(expiration.Equal(n.Expiration), header)
+		}).Return(nil, nil)
+
+		_, err := s.Send(mRequest)
+		a.NoError(err)
+	}
+}
+
 func TestSender_Retry(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -131,6 +195,51 @@ func TestSender_Retry(t *testing.T) {
 
 }
 
+// refreshingPusher is a Pusher using token-based authentication
+type refreshingPusher struct {
+	*MockPusher
+	refreshed int
+}
+
+func (p *refreshingPusher) RefreshToken() {
+	p.refreshed++
+}
+
+func TestSender_RetryOnceWithRefreshedTokenWhenExpired(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given
+	route := router.NewRoute(router.RouteConfig{
+		Path:        protocol.Path("path"),
+		RouteParams: map[string]string{deviceIDKey: "1234"},
+	})
+
+	mSubscriber := NewMockSubscriber(testutil.MockCtrl)
+	mSubscriber.EXPECT().Route().Return(route).AnyTimes()
+
+	mRequest := NewMockRequest(testutil.MockCtrl)
+	mRequest.EXPECT().Subscriber().Return(mSubscriber).AnyTimes()
+	mRequest.EXPECT().Message().Return(&protocol.Message{Body: []byte("{}")}).AnyTimes()
+
+	// and a pusher, whose token is rejected twice as expired
+	expired := &apns2.Response{StatusCode: http.StatusForbidden, Reason: apns2.ReasonExpiredProviderToken}
+	pusher := &refreshingPusher{MockPusher: NewMockPusher(testutil.MockCtrl)}
+	pusher.EXPECT().Push(gomock.Any()).Return(expired, nil).Times(2)
+
+	s, err := NewSenderUsingPusher(pusher, "com.myapp")
+	a.NoError(err)
+
+	// when
+	rsp, err := s.Send(mRequest)
+
+	// then the token is refreshed and the push is retried only once
+	a.NoError(err)
+	a.Equal(expired, rsp)
+	a.Equal(1, pusher.refreshed)
+}
+
 type resultpair struct {
 	result interface{}
 	err    error
@@ -189,3 +298,23 @@ func (e *mockTimeout) Temporary() bool { return true }
 
 var errMockTimeout error = &mockTimeout{}
 var errMockOther error = errors.New("mock not retriable")
+
+func TestSender_DryRun(t *testing.T) {
+	a := assert.New(t)
+
+	// given a dry-run sender
+	routeParams := map[string]string{deviceIDKey: "1234"}
+	subscriber := connector.NewSubscriber("/topic", routeParams, 0)
+	s, err := NewSenderUsingPusher(newDryRunPusher(), "com.myapp")
+	a.NoError(err)
+
+	// when a message is sent
+	rsp, err := s.Send(connector.NewRequest(subscriber, &protocol.Message{Body: []byte(`{"aps":{}}`)}))
+
+	// then it is answered as sent, with the dry-run id
+	a.NoError(err)
+	if a.IsType(&apns2.Response{}, rsp) {
+		a.True(rsp.(*apns2.Response).Sent())
+		a.Equal(dryRunApnsID, rsp.(*apns2.Response).ApnsID)
+	}
+}
@@ -96,6 +96,10 @@ func TestNew_HandleResponseHandleSubscriber(t *testing.T) {
 
 	//given
 	c, mKVS := newAPNSConnector(t)
+	var invalid connector.Subscriber
+	c.(*apns).InvalidSubscriber = func(s connector.Subscriber) {
+		invalid = s
+	}
 
 	removeForReasons := []string{
 		apns2.ReasonMissingDeviceToken,
@@ -132,6 +136,7 @@ func TestNew_HandleResponseHandleSubscriber(t *testing.T) {
 
 		//then
 		a.NoError(err)
+		a.Equal(mSubscriber, invalid)
 	}
 }
 
@@ -0,0 +1,144 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenRefreshInterval is the age after which a new JWT is generated.
+// APNS rejects tokens older than one hour, and also tokens refreshed more often than every 20 minutes.
+const tokenRefreshInterval = 50 * time.Minute
+
+var errInvalidAuthKey = errors.New("The APNS auth key must be an ECDSA private key in PEM format")
+
+// authToken generates and caches the JWT used for the token-based authentication with APNS,
+// signed with ES256 by the .p8 auth key
+type authToken struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+
+	mu       sync.Mutex
+	bearer   string
+	issuedAt time.Time
+	now      func() time.Time
+}
+
+func newAuthTokenFromFile(filename, keyID, teamID string) (*authToken, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseAuthKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &authToken{
+		key:    key,
+		keyID:  keyID,
+		teamID: teamID,
+		now:    time.Now,
+	}, nil
+}
+
+// parseAuthKey parses the PKCS8 encoded private key of a .p8 file
+func parseAuthKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidAuthKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errInvalidAuthKey
+	}
+	return ecdsaKey, nil
+}
+
+// get returns the cached JWT, generating a new one if it is older than the tokenRefreshInterval
+func (t *authToken) get() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	if t.bearer != "" && now.Sub(t.issuedAt) < tokenRefreshInterval {
+		return t.bearer, nil
+	}
+	bearer, err := t.generate(now)
+	if err != nil {
+		return "", err
+	}
+	t.bearer = bearer
+	t.issuedAt = now
+	return bearer, nil
+}
+
+// expire forces the generation of a new JWT on the next request
+func (t *authToken) expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.bearer = ""
+}
+
+func (t *authToken) generate(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": t.keyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{"iss": t.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	// the ES256 signature is the concatenation of r and s, each padded to the size of the curve
+	size := (t.key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[size-len(rBytes):size], rBytes)
+	copy(signature[2*size-len(sBytes):], sBytes)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// tokenTransport adds the JWT of the authToken to all requests sent to APNS
+type tokenTransport struct {
+	token *authToken
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bearer, err := t.token.get()
+	if err != nil {
+		return nil, err
+	}
+	// the request may not be modified by a RoundTripper
+	authorized := new(http.Request)
+	*authorized = *req
+	authorized.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authorized.Header[k] = v
+	}
+	authorized.Header.Set("authorization", "bearer "+bearer)
+	return t.base.RoundTrip(authorized)
+}
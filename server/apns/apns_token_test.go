@@ -0,0 +1,152 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthToken_IsSignedWithES256(t *testing.T) {
+	a := assert.New(t)
+
+	// given a token from a .p8 key file
+	key, filename := writeAuthKeyFile(a)
+	defer os.Remove(filename)
+
+	token, err := newAuthTokenFromFile(filename, "KEYID12345", "TEAMID1234")
+	a.NoError(err)
+
+	// when getting the JWT
+	bearer, err := token.get()
+	a.NoError(err)
+
+	// then it has the header, claims and a valid signature
+	parts := strings.Split(bearer, ".")
+	if !a.Len(parts, 3) {
+		return
+	}
+	header := make(map[string]string)
+	a.NoError(decodeJWTPart(parts[0], &header))
+	a.Equal(map[string]string{"alg": "ES256", "kid": "KEYID12345"}, header)
+
+	claims := make(map[string]interface{})
+	a.NoError(decodeJWTPart(parts[1], &claims))
+	a.Equal("TEAMID1234", claims["iss"])
+	a.InDelta(time.Now().Unix(), claims["iat"], 5)
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	a.NoError(err)
+	a.Len(signature, 64)
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	a.True(ecdsa.Verify(&key.PublicKey, hash[:], r, s))
+}
+
+func TestAuthToken_IsCachedAndRefreshed(t *testing.T) {
+	a := assert.New(t)
+
+	_, filename := writeAuthKeyFile(a)
+	defer os.Remove(filename)
+
+	token, err := newAuthTokenFromFile(filename, "KEYID12345", "TEAMID1234")
+	a.NoError(err)
+	now := time.Now()
+	token.now = func() time.Time { return now }
+
+	// the token is cached
+	first, err := token.get()
+	a.NoError(err)
+	now = now.Add(tokenRefreshInterval - time.Second)
+	cached, err := token.get()
+	a.NoError(err)
+	a.Equal(first, cached)
+
+	// and refreshed before it expires
+	now = now.Add(time.Second)
+	refreshed, err := token.get()
+	a.NoError(err)
+	a.NotEqual(first, refreshed)
+
+	// and a refresh can be forced
+	token.expire()
+	forced, err := token.get()
+	a.NoError(err)
+	a.NotEqual(refreshed, forced)
+}
+
+func TestNewAuthTokenFromFile_InvalidKey(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := newAuthTokenFromFile("/non-existing-file.p8", "KEYID12345", "TEAMID1234")
+	a.Error(err)
+
+	file, err := ioutil.TempFile("", "guble_apns_key")
+	a.NoError(err)
+	defer os.Remove(file.Name())
+	file.WriteString("not a key")
+	file.Close()
+
+	_, err = newAuthTokenFromFile(file.Name(), "KEYID12345", "TEAMID1234")
+	a.Equal(errInvalidAuthKey, err)
+}
+
+func TestTokenTransport_SetsTheAuthorizationHeader(t *testing.T) {
+	a := assert.New(t)
+
+	_, filename := writeAuthKeyFile(a)
+	defer os.Remove(filename)
+	token, err := newAuthTokenFromFile(filename, "KEYID12345", "TEAMID1234")
+	a.NoError(err)
+
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("authorization")
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &tokenTransport{token: token, base: http.DefaultTransport}}
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	resp, err := client.Do(req)
+	a.NoError(err)
+	resp.Body.Close()
+
+	bearer, _ := token.get()
+	a.Equal("bearer "+bearer, authorization)
+	a.Empty(req.Header.Get("authorization"))
+}
+
+func writeAuthKeyFile(a *assert.Assertions) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	a.NoError(err)
+
+	file, err := ioutil.TempFile("", "guble_apns_key")
+	a.NoError(err)
+	defer file.Close()
+	a.NoError(pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return key, file.Name()
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,42 @@
+package apns
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/sideshow/apns2"
+)
+
+// dryRunApnsID is the apns-id of the synthetic responses of a dry run
+const dryRunApnsID = "dry-run"
+
+// dryRunPusher is a Pusher, which logs the notifications with their device token and payload instead of pushing them,
+// and returns a successful response with the dryRunApnsID.
+type dryRunPusher struct{}
+
+func newDryRunPusher() Pusher {
+	return dryRunPusher{}
+}
+
+func (dryRunPusher) Push(n *apns2.Notification) (*apns2.Response, error) {
+	logger.WithFields(log.Fields{
+		"deviceToken": n.DeviceToken,
+		"topic":       n.Topic,
+		"priority":    n.Priority,
+		"payload":     dryRunPayload(n.Payload),
+	}).Info("Dry run: would push notification to APNS")
+	return &apns2.Response{StatusCode: apns2.StatusSent, ApnsID: dryRunApnsID}, nil
+}
+
+// dryRunPayload returns the payload of a notification as a string, for logging it
+func dryRunPayload(payload interface{}) string {
+	if b, ok := payload.([]byte); ok {
+		return string(b)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
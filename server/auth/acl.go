@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+)
+
+const (
+	// ACLSchema is the reserved schema of the KV store, containing the access control lists by topic path
+	ACLSchema = "acl"
+
+	// aclPrefixSuffix marks a rule for all topics below the path, e.g. `/private/*`
+	aclPrefixSuffix = "/*"
+
+	// aclReloadInterval is the maximum age of the rules, before they are loaded again from the KV store
+	aclReloadInterval = 10 * time.Second
+)
+
+// ApplicationAccessManager is implemented by the access managers, which can also grant the access
+// by the application id of a client.
+type ApplicationAccessManager interface {
+	IsAllowedForApplication(accessType AccessType, userID, applicationID string, path protocol.Path) bool
+}
+
+// IsAllowed asks the access manager for the access of the user, and of the application if supported.
+func IsAllowed(am AccessManager, accessType AccessType, userID, applicationID string, path protocol.Path) bool {
+	if aam, ok := am.(ApplicationAccessManager); ok {
+		return aam.IsAllowedForApplication(accessType, userID, applicationID, path)
+	}
+	return am.IsAllowed(accessType, userID, path)
+}
+
+// ACLPermission lists the users and the applications having a permission
+type ACLPermission struct {
+	Users        []string `json:"users,omitempty"`
+	Applications []string `json:"applications,omitempty"`
+}
+
+// ACL is the access control list of a topic path, stored as json in the ACLSchema of the KV store.
+// Its key is either a topic path, or a path ending with `/*` for all topics below it.
+type ACL struct {
+	Read  ACLPermission `json:"read"`
+	Write ACLPermission `json:"write"`
+}
+
+// ACLAccessManager restricts the topics having an ACL to the listed users and applications.
+// The access to the other topics is decided by the wrapped AccessManager.
+type ACLAccessManager struct {
+	kvStore  kvstore.KVStore
+	fallback AccessManager
+
+	// Owner is a user id granted all access, regardless of the ACLs
+	Owner string
+
+	mutex    sync.RWMutex
+	rules    map[string]*ACL
+	loadedAt time.Time
+}
+
+// NewACLAccessManager returns a new ACLAccessManager.
+// The rules are loaded from the KV store on the first check, and again after the reload interval.
+func NewACLAccessManager(kvStore kvstore.KVStore, fallback AccessManager) *ACLAccessManager {
+	return &ACLAccessManager{
+		kvStore:  kvStore,
+		fallback: fallback,
+		rules:    make(map[string]*ACL),
+	}
+}
+
+// IsAllowed is an implementation of the AccessManager interface.
+func (am *ACLAccessManager) IsAllowed(accessType AccessType, userID string, path protocol.Path) bool {
+	return am.IsAllowedForApplication(accessType, userID, "", path)
+}
+
+// IsAllowedForApplication is an implementation of the ApplicationAccessManager interface.
+// A wildcard subscription (e.g. `/foo/*`) is only allowed, if all ACLs of the topics below it allow the access.
+func (am *ACLAccessManager) IsAllowedForApplication(accessType AccessType, userID, applicationID string, path protocol.Path) bool {
+	if am.Owner != "" && userID == am.Owner {
+		return true
+	}
+
+	rules := am.currentRules()
+	p := string(path)
+	wildcard := strings.HasSuffix(p, aclPrefixSuffix)
+	if wildcard {
+		p = strings.TrimSuffix(p, aclPrefixSuffix)
+	}
+
+	restricted := false
+	if acl := matchingACL(rules, p); acl != nil {
+		restricted = true
+		if !acl.permission(accessType).allows(userID, applicationID) {
+			return false
+		}
+	}
+	if wildcard {
+		for key, acl := range rules {
+			if below(strings.TrimSuffix(key, aclPrefixSuffix), p) {
+				restricted = true
+				if !acl.permission(accessType).allows(userID, applicationID) {
+					return false
+				}
+			}
+		}
+	}
+	if restricted {
+		return true
+	}
+	return am.fallback.IsAllowed(accessType, userID, path)
+}
+
+// Load reads the ACLs from the KV store.
+func (am *ACLAccessManager) Load() error {
+	entries, err := am.kvStore.Iterate(ACLSchema, "")
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]*ACL)
+	for entry := range entries {
+		acl := &ACL{}
+		if err := json.Unmarshal([]byte(entry[1]), acl); err != nil {
+			logger.WithError(err).WithField("path", entry[0]).Error("Ignoring the invalid ACL")
+			continue
+		}
+		rules[entry[0]] = acl
+	}
+
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	am.rules = rules
+	am.loadedAt = time.Now()
+	return nil
+}
+
+// currentRules returns the rules, loading them again if they are older than the reload interval
+func (am *ACLAccessManager) currentRules() map[string]*ACL {
+	am.mutex.RLock()
+	rules, loadedAt := am.rules, am.loadedAt
+	am.mutex.RUnlock()
+
+	if time.Since(loadedAt) < aclReloadInterval {
+		return rules
+	}
+	if err := am.Load(); err != nil {
+		logger.WithError(err).Error("Loading the ACLs failed, using the previous ones")
+		am.mutex.Lock()
+		am.loadedAt = time.Now()
+		am.mutex.Unlock()
+		return rules
+	}
+	am.mutex.RLock()
+	defer am.mutex.RUnlock()
+	return am.rules
+}
+
+// matchingACL returns the ACL of the path, or of its longest matching prefix rule
+func matchingACL(rules map[string]*ACL, path string) *ACL {
+	if acl, ok := rules[path]; ok {
+		return acl
+	}
+	prefix := strings.TrimSuffix(path, "/")
+	for {
+		if acl, ok := rules[prefix+aclPrefixSuffix]; ok {
+			return acl
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			return nil
+		}
+		prefix = prefix[:i]
+	}
+}
+
+// below returns true if the path is a subtopic of the parent
+func below(path, parent string) bool {
+	return strings.HasPrefix(path, parent+"/")
+}
+
+func (acl *ACL) permission(accessType AccessType) ACLPermission {
+	if accessType == WRITE {
+		return acl.Write
+	}
+	return acl.Read
+}
+
+func (p ACLPermission) allows(userID, applicationID string) bool {
+	for _, u := range p.Users {
+		if u == userID {
+			return true
+		}
+	}
+	if applicationID == "" {
+		return false
+	}
+	for _, a := range p.Applications {
+		if a == applicationID {
+			return true
+		}
+	}
+	return false
+}
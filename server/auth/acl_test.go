@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/smancke/guble/server/kvstore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func aclAccessManager(a *assert.Assertions, rules map[string]string) *ACLAccessManager {
+	kvs := kvstore.NewMemoryKVStore()
+	for path, rule := range rules {
+		a.NoError(kvs.Put(ACLSchema, path, []byte(rule)))
+	}
+	return NewACLAccessManager(kvs, NewAllowAllAccessManager(true))
+}
+
+func Test_ACLAccessManagerRestrictsTheTopics(t *testing.T) {
+	a := assert.New(t)
+	am := aclAccessManager(a, map[string]string{
+		"/private/*":   `{"read":{"users":["alice","bob"]},"write":{"users":["alice"]}}`,
+		"/private/bob": `{"read":{"users":["bob"]},"write":{"users":["bob"],"applications":["app1"]}}`,
+	})
+
+	// the topics without an ACL are decided by the fallback
+	a.True(am.IsAllowed(WRITE, "eve", "/public"))
+	a.True(am.IsAllowed(READ, "eve", "/privateer"))
+
+	// a prefix rule applies to all topics below it, and to the prefix itself
+	a.True(am.IsAllowed(READ, "bob", "/private/foo/bar"))
+	a.True(am.IsAllowed(WRITE, "alice", "/private"))
+	a.False(am.IsAllowed(WRITE, "bob", "/private/foo"))
+	a.False(am.IsAllowed(READ, "eve", "/private/foo"))
+	a.False(am.IsAllowed(READ, "", "/private/foo"))
+
+	// the rule of a topic has precedence over the prefix rule
+	a.False(am.IsAllowed(READ, "alice", "/private/bob"))
+	a.True(am.IsAllowed(WRITE, "bob", "/private/bob"))
+
+	// the applications can be granted the access, too
+	a.True(IsAllowed(am, WRITE, "eve", "app1", "/private/bob"))
+	a.False(IsAllowed(am, WRITE, "eve", "app2", "/private/bob"))
+	a.False(am.IsAllowed(WRITE, "app1", "/private/bob"))
+}
+
+func Test_ACLAccessManagerWildcardSubscriptions(t *testing.T) {
+	a := assert.New(t)
+	am := aclAccessManager(a, map[string]string{
+		"/private/*":   `{"read":{"users":["alice","bob"]}}`,
+		"/private/bob": `{"read":{"users":["bob"]}}`,
+	})
+
+	// a wildcard subscription requires the access to all restricted topics below it
+	a.True(am.IsAllowed(READ, "bob", "/private/*"))
+	a.True(am.IsAllowed(READ, "bob", "/*"))
+	a.False(am.IsAllowed(READ, "alice", "/private/*"))
+	a.False(am.IsAllowed(READ, "alice", "/*"))
+	a.True(am.IsAllowed(READ, "eve", "/public/*"))
+}
+
+func Test_ACLAccessManagerOwner(t *testing.T) {
+	a := assert.New(t)
+	am := aclAccessManager(a, map[string]string{
+		"/private/*": `{"read":{"users":["alice"]}}`,
+	})
+	am.Owner = "admin"
+
+	a.True(am.IsAllowed(READ, "admin", "/private/foo"))
+	a.True(am.IsAllowed(WRITE, "admin", "/*"))
+	a.False(am.IsAllowed(WRITE, "alice", "/private/foo"))
+}
+
+func Test_ACLAccessManagerIgnoresInvalidRules(t *testing.T) {
+	a := assert.New(t)
+	am := aclAccessManager(a, map[string]string{
+		"/broken": `{"read":`,
+	})
+
+	a.True(am.IsAllowed(READ, "eve", "/broken"))
+}
+
+func Test_IsAllowedWithoutApplicationSupport(t *testing.T) {
+	a := assert.New(t)
+	a.True(IsAllowed(NewAllowAllAccessManager(true), READ, "user", "app", "/foo"))
+	a.False(IsAllowed(NewAllowAllAccessManager(false), WRITE, "user", "app", "/foo"))
+}
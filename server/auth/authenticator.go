@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrMissingToken is returned by an Authenticator, if the request has no bearer token
+	ErrMissingToken = errors.New("Missing bearer token.")
+
+	// ErrInvalidToken is returned by an Authenticator, if the token is malformed, or its signature can not be verified
+	ErrInvalidToken = errors.New("Invalid token.")
+
+	// ErrTokenExpired is returned by an Authenticator, if the token is expired or not valid yet
+	ErrTokenExpired = errors.New("Token expired.")
+
+	// ErrUserMismatch is returned by Authenticate, if the request names another user than the authenticated one
+	ErrUserMismatch = errors.New("The user id does not match the authenticated user.")
+
+	// ErrApplicationMismatch is returned by AuthenticateApplication, if the request names another application
+	// than the authenticated one
+	ErrApplicationMismatch = errors.New("The application id does not match the authenticated application.")
+)
+
+// Authenticator authenticates the connections of the clients (the websocket handshakes and the REST requests),
+// before any route is created for them.
+type Authenticator interface {
+	// AuthenticateConnection returns the id of the authenticated user and the claims of its credentials,
+	// or an error if the request is not authenticated.
+	// An empty user id keeps the user id given by the request.
+	AuthenticateConnection(r *http.Request) (userID string, claims map[string]interface{}, err error)
+}
+
+// AllowAllAuthenticator is the permissive default implementation, authenticating every connection
+// as the user given by the request.
+type AllowAllAuthenticator struct{}
+
+// NewAllowAllAuthenticator returns a new AllowAllAuthenticator.
+func NewAllowAllAuthenticator() AllowAllAuthenticator {
+	return AllowAllAuthenticator{}
+}
+
+// AuthenticateConnection returns always an empty user id, and no error.
+func (AllowAllAuthenticator) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	return "", nil, nil
+}
+
+// Authenticate authenticates the request by the authenticator (if not nil), and returns the user id of the connection:
+// the authenticated user, or the user id given by the request, if the authenticator did not return one.
+func Authenticate(a Authenticator, r *http.Request, userID string) (string, error) {
+	userID, _, err := AuthenticateApplication(a, r, userID, "")
+	return userID, err
+}
+
+// AuthenticateApplication is Authenticate, returning also the application id of the connection:
+// the application of the ApplicationIDClaim of the credentials, or the application id given by the request.
+func AuthenticateApplication(a Authenticator, r *http.Request, userID, applicationID string) (string, string, error) {
+	if a == nil {
+		return userID, applicationID, nil
+	}
+	authenticated, claims, err := a.AuthenticateConnection(r)
+	if err != nil {
+		return "", "", err
+	}
+	if authenticated != "" {
+		if userID != "" && userID != authenticated {
+			return "", "", ErrUserMismatch
+		}
+		userID = authenticated
+	}
+	if authenticatedApplication, ok := claims[ApplicationIDClaim].(string); ok && authenticatedApplication != "" {
+		if applicationID != "" && applicationID != authenticatedApplication {
+			return "", "", ErrApplicationMismatch
+		}
+		applicationID = authenticatedApplication
+	}
+	return userID, applicationID, nil
+}
+
+// AuthenticationStatus returns the http status for an error of Authenticate:
+// forbidden for another user or application than the authenticated one, otherwise unauthorized.
+func AuthenticationStatus(err error) int {
+	if err == ErrUserMismatch || err == ErrApplicationMismatch {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// BearerToken returns the token of the `Authorization: Bearer <token>` header,
+// or of the query parameter `access_token` for the clients, which can not set the header (e.g. a browser websocket).
+func BearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return r.URL.Query().Get("access_token")
+}
@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"github.com/smancke/guble/protocol"
+)
+
+const (
+	// ApplicationIDClaim is the claim of the credentials containing the authenticated application id
+	ApplicationIDClaim = "application_id"
+)
+
+// ErrMissingClientCertificate is returned by the ClientCertAuthenticator, if the request has no verified client certificate
+var ErrMissingClientCertificate = errors.New("Missing client certificate.")
+
+// ClientCertAuthenticator authenticates the connections by their TLS client certificates, which are verified
+// by the webserver on the handshake. The user id is the common name of the subject of the certificate (or its
+// first DNS name, if it has no common name), and the application id is the first DNS name of its alternative names,
+// which is a valid application id.
+type ClientCertAuthenticator struct{}
+
+// NewClientCertAuthenticator returns a new ClientCertAuthenticator.
+func NewClientCertAuthenticator() ClientCertAuthenticator {
+	return ClientCertAuthenticator{}
+}
+
+// AuthenticateConnection is an implementation of the Authenticator interface.
+// The claims contain the common name (`cn`), the DNS names (`dns`) and the email addresses (`email`) of the certificate,
+// and the application id, if it has one.
+func (ClientCertAuthenticator) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", nil, ErrMissingClientCertificate
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	userID := cert.Subject.CommonName
+	if userID == "" && len(cert.DNSNames) > 0 {
+		userID = cert.DNSNames[0]
+	}
+	if userID == "" {
+		logger.WithField("serial", cert.SerialNumber).Info("The client certificate has no common name or DNS name")
+		return "", nil, ErrMissingClientCertificate
+	}
+	claims := map[string]interface{}{
+		"cn":    cert.Subject.CommonName,
+		"dns":   cert.DNSNames,
+		"email": cert.EmailAddresses,
+	}
+	if applicationID := certificateApplicationID(cert); applicationID != "" {
+		claims[ApplicationIDClaim] = applicationID
+	}
+	return userID, claims, nil
+}
+
+// certificateApplicationID returns the first DNS name of the certificate, which is a valid application id
+func certificateApplicationID(cert *x509.Certificate) string {
+	for _, name := range cert.DNSNames {
+		if protocol.ValidateApplicationID(name) == nil {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requestWithClientCertificate(cert *x509.Certificate, url string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestClientCertAuthenticator_AuthenticateConnection(t *testing.T) {
+	a := assert.New(t)
+	authenticator := NewClientCertAuthenticator()
+
+	// the subject and the first valid DNS name are the user and the application
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "orders"},
+		DNSNames:       []string{"*.example.com", "orders.example.com"},
+		EmailAddresses: []string{"orders@example.com"},
+	}
+	userID, claims, err := authenticator.AuthenticateConnection(requestWithClientCertificate(cert, "/"))
+	a.NoError(err)
+	a.Equal("orders", userID)
+	a.Equal("orders.example.com", claims[ApplicationIDClaim])
+	a.Equal([]string{"orders@example.com"}, claims["email"])
+
+	// a certificate without a common name is the user of its DNS name
+	userID, _, err = authenticator.AuthenticateConnection(requestWithClientCertificate(&x509.Certificate{
+		DNSNames: []string{"billing.example.com"},
+	}, "/"))
+	a.NoError(err)
+	a.Equal("billing.example.com", userID)
+
+	// and a request without a verified certificate is not authenticated
+	_, _, err = authenticator.AuthenticateConnection(httptest.NewRequest(http.MethodGet, "/", nil))
+	a.Equal(ErrMissingClientCertificate, err)
+	_, _, err = authenticator.AuthenticateConnection(requestWithClientCertificate(&x509.Certificate{}, "/"))
+	a.Equal(ErrMissingClientCertificate, err)
+}
+
+func TestAuthenticateApplication(t *testing.T) {
+	a := assert.New(t)
+	authenticator := NewClientCertAuthenticator()
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "orders"},
+		DNSNames: []string{"orders.example.com"},
+	}
+	r := requestWithClientCertificate(cert, "/")
+
+	userID, applicationID, err := AuthenticateApplication(authenticator, r, "", "")
+	a.NoError(err)
+	a.Equal("orders", userID)
+	a.Equal("orders.example.com", applicationID)
+
+	_, _, err = AuthenticateApplication(authenticator, r, "orders", "billing")
+	a.Equal(ErrApplicationMismatch, err)
+	a.Equal(http.StatusForbidden, AuthenticationStatus(err))
+
+	// without an authenticated application, the one of the request is kept
+	userID, applicationID, err = AuthenticateApplication(NewAllowAllAuthenticator(), r, "user", "billing")
+	a.NoError(err)
+	a.Equal("user", userID)
+	a.Equal("billing", applicationID)
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // the hashes of the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultUserClaim is the claim of a JWT containing the user id
+	DefaultUserClaim = "sub"
+
+	// jwksMaxAge is the maximum age of the keys, before they are fetched again from the JWKS url
+	jwksMaxAge = time.Hour
+
+	// jwksMinRefresh is the minimum time between two fetches for a key id, which is not known (yet)
+	jwksMinRefresh = 10 * time.Second
+
+	// jwtLeeway is the tolerated clock skew, when checking the expiry of a token
+	jwtLeeway = 30 * time.Second
+)
+
+// jwtAlgorithm is a signature algorithm of a JWT
+type jwtAlgorithm struct {
+	hash crypto.Hash
+	ec   bool
+}
+
+// jwtAlgorithms are the supported asymmetric algorithms. `none` and the HMAC algorithms are rejected,
+// as the keys of the JWKS are public.
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"RS256": {crypto.SHA256, false},
+	"RS384": {crypto.SHA384, false},
+	"RS512": {crypto.SHA512, false},
+	"ES256": {crypto.SHA256, true},
+	"ES384": {crypto.SHA384, true},
+	"ES512": {crypto.SHA512, true},
+}
+
+// JWTAuthenticator authenticates the connections by a bearer JWT, verifying its signature by the keys of a JWKS url
+// (e.g. of an identity provider) and its expiry. The user id is read from the UserClaim of the token.
+type JWTAuthenticator struct {
+	jwksURL    string
+	httpClient *http.Client
+
+	// UserClaim is the claim containing the user id, `sub` by default
+	UserClaim string
+
+	mutex     sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWTAuthenticator returns a new JWTAuthenticator.
+// The keys are fetched from the JWKS url on the first connection, and again after an hour or for an unknown key id.
+func NewJWTAuthenticator(jwksURL string) *JWTAuthenticator {
+	return &JWTAuthenticator{
+		jwksURL:    jwksURL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		UserClaim:  DefaultUserClaim,
+	}
+}
+
+// AuthenticateConnection is an implementation of the Authenticator interface.
+func (a *JWTAuthenticator) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return "", nil, ErrMissingToken
+	}
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	userID, ok := claims[a.UserClaim].(string)
+	if !ok || userID == "" {
+		logger.WithField("claim", a.UserClaim).Info("The token has no user id")
+		return "", nil, ErrInvalidToken
+	}
+	return userID, claims, nil
+}
+
+// verify returns the claims of the token, if its signature and expiry are valid at the given time
+func (a *JWTAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		logger.WithField("alg", header.Alg).Info("Unsupported algorithm of a token")
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	h := alg.hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(alg, key, h.Sum(nil), signature) {
+		return nil, ErrInvalidToken
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func verifySignature(alg jwtAlgorithm, key crypto.PublicKey, digest, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return !alg.ec && rsa.VerifyPKCS1v15(k, alg.hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// the signature is the concatenation of r and s, each of the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !alg.ec || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+// key returns the key of the id, fetching the keys again if it is unknown, or if they are too old.
+// Without a key id, the only key of the JWKS is used.
+func (a *JWTAuthenticator) key(kid string) (crypto.PublicKey, error) {
+	a.mutex.RLock()
+	key, found := a.lookup(kid)
+	age := time.Since(a.fetchedAt)
+	a.mutex.RUnlock()
+	if found && age < jwksMaxAge {
+		return key, nil
+	}
+	if !found && age < jwksMinRefresh {
+		return nil, ErrInvalidToken
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// the keys may have been fetched by a concurrent connection in the meantime
+	if time.Since(a.fetchedAt) >= jwksMinRefresh {
+		if err := a.fetch(); err != nil {
+			logger.WithError(err).WithField("url", a.jwksURL).Error("Error fetching the JWKS")
+			if found {
+				return key, nil
+			}
+			return nil, ErrInvalidToken
+		}
+	}
+	if key, found = a.lookup(kid); !found {
+		logger.WithField("kid", kid).Info("Unknown key id of a token")
+		return nil, ErrInvalidToken
+	}
+	return key, nil
+}
+
+func (a *JWTAuthenticator) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, found := a.keys[kid]
+	return key, found
+}
+
+// jwk is a public key of a JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetch loads the signing keys of the JWKS url, skipping the keys of an unsupported type
+func (a *JWTAuthenticator) fetch() error {
+	a.fetchedAt = time.Now()
+	resp, err := a.httpClient.Get(a.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error code returned from the JWKS url: %d", resp.StatusCode)
+	}
+	jwks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			logger.WithError(err).WithFields(log.Fields{"kid": k.Kid, "kty": k.Kty}).Warn("Skipping a key of the JWKS")
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	a.keys = keys
+	return nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
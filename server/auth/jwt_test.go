@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testIdentityProvider serves the JWKS of its keys, and signs the tokens
+type testIdentityProvider struct {
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	keys    []map[string]string
+	fetches int32
+	server  *httptest.Server
+}
+
+func newTestIdentityProvider(t *testing.T) *testIdentityProvider {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	idp := &testIdentityProvider{rsaKey: rsaKey, ecKey: ecKey}
+	idp.keys = []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}
+	idp.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&idp.fetches, 1)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": idp.keys})
+	}))
+	return idp
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (idp *testIdentityProvider) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(input))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest.Sum(nil))
+	case "ES256":
+		digest := crypto.SHA256.New()
+		digest.Write([]byte(input))
+		r, s, signErr := ecdsa.Sign(rand.Reader, idp.ecKey, digest.Sum(nil))
+		err = signErr
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		signature = []byte("signature")
+	}
+	assert.NoError(t, err)
+	return input + "." + b64(signature)
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/stream/user/user01", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func validClaims(sub string) map[string]interface{} {
+	return map[string]interface{}{"sub": sub, "exp": time.Now().Add(time.Hour).Unix(), "email": sub + "@example.com"}
+}
+
+func TestJWTAuthenticator_AuthenticatesValidTokens(t *testing.T) {
+	a := assert.New(t)
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	am := NewJWTAuthenticator(idp.server.URL)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := "rsa1"
+		if alg == "ES256" {
+			kid = "ec1"
+		}
+		userID, claims, err := am.AuthenticateConnection(bearerRequest(idp.sign(t, alg, kid, validClaims("user01"))))
+		a.NoError(err, alg)
+		a.Equal("user01", userID, alg)
+		a.Equal("user01@example.com", claims["email"], alg)
+	}
+
+	// and the keys are fetched once
+	a.Equal(int32(1), atomic.LoadInt32(&idp.fetches))
+
+	// and the token can be passed as query parameter
+	token := idp.sign(t, "RS256", "rsa1", validClaims("user02"))
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/stream/user/user02?access_token="+token, nil)
+	userID, _, err := am.AuthenticateConnection(r)
+	a.NoError(err)
+	a.Equal("user02", userID)
+
+	// and the user id can be read from another claim
+	am.UserClaim = "email"
+	userID, _, err = am.AuthenticateConnection(bearerRequest(token))
+	a.NoError(err)
+	a.Equal("user02@example.com", userID)
+}
+
+func TestJWTAuthenticator_RejectsInvalidTokens(t *testing.T) {
+	a := assert.New(t)
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	am := NewJWTAuthenticator(idp.server.URL)
+
+	valid := idp.sign(t, "RS256", "rsa1", validClaims("user01"))
+	expired := validClaims("user01")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	notYetValid := validClaims("user01")
+	notYetValid["nbf"] = time.Now().Add(time.Hour).Unix()
+	noExpiry := validClaims("user01")
+	delete(noExpiry, "exp")
+	noUser := validClaims("")
+
+	parts := strings.Split(valid, ".")
+	forged := strings.Join([]string{parts[0], b64([]byte(`{"sub":"admin","exp":9999999999}`)), parts[2]}, ".")
+
+	cases := map[string]struct {
+		token    string
+		expected error
+	}{
+		"missing":          {"", ErrMissingToken},
+		"malformed":        {"abc.def", ErrInvalidToken},
+		"forged claims":    {forged, ErrInvalidToken},
+		"expired":          {idp.sign(t, "RS256", "rsa1", expired), ErrTokenExpired},
+		"not yet valid":    {idp.sign(t, "RS256", "rsa1", notYetValid), ErrTokenExpired},
+		"without expiry":   {idp.sign(t, "RS256", "rsa1", noExpiry), ErrInvalidToken},
+		"without user":     {idp.sign(t, "RS256", "rsa1", noUser), ErrInvalidToken},
+		"algorithm none":   {idp.sign(t, "none", "rsa1", validClaims("user01")), ErrInvalidToken},
+		"hmac algorithm":   {idp.sign(t, "HS256", "rsa1", validClaims("user01")), ErrInvalidToken},
+		"unknown key":      {idp.sign(t, "RS256", "other", validClaims("user01")), ErrInvalidToken},
+		"encryption key":   {idp.sign(t, "RS256", "enc1", validClaims("user01")), ErrInvalidToken},
+		"key of other alg": {idp.sign(t, "RS256", "ec1", validClaims("user01")), ErrInvalidToken},
+	}
+	for name, c := range cases {
+		_, _, err := am.AuthenticateConnection(bearerRequest(c.token))
+		a.Equal(c.expected, err, name)
+	}
+
+	// and an unknown key id does not fetch the keys again immediately
+	a.Equal(int32(1), atomic.LoadInt32(&idp.fetches))
+}
+
+func TestJWTAuthenticator_FetchesRotatedKeys(t *testing.T) {
+	a := assert.New(t)
+	idp := newTestIdentityProvider(t)
+	defer idp.server.Close()
+	am := NewJWTAuthenticator(idp.server.URL)
+
+	// given the keys fetched before the identity provider rotated its rsa key
+	idp.keys = idp.keys[1:2]
+	_, _, err := am.AuthenticateConnection(bearerRequest(idp.sign(t, "ES256", "", validClaims("user01"))))
+	a.NoError(err, "the only key is used for a token without key id")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	a.NoError(err)
+	idp.rsaKey = rsaKey
+	idp.keys = append(idp.keys, map[string]string{
+		"kty": "RSA", "kid": "rsa2", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())})
+
+	// when a token of the new key is sent after the minimum refresh interval
+	am.fetchedAt = time.Now().Add(-jwksMinRefresh)
+	userID, _, err := am.AuthenticateConnection(bearerRequest(idp.sign(t, "RS256", "rsa2", validClaims("user01"))))
+
+	// then the keys are fetched again
+	a.NoError(err)
+	a.Equal("user01", userID)
+	a.Equal(int32(2), atomic.LoadInt32(&idp.fetches))
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := assert.New(t)
+	r := bearerRequest("")
+
+	userID, err := Authenticate(nil, r, "user01")
+	a.NoError(err)
+	a.Equal("user01", userID)
+
+	userID, err = Authenticate(NewAllowAllAuthenticator(), r, "user01")
+	a.NoError(err)
+	a.Equal("user01", userID)
+
+	authenticated := authenticatorFunc(func(*http.Request) (string, map[string]interface{}, error) {
+		return "user02", nil, nil
+	})
+	userID, err = Authenticate(authenticated, r, "")
+	a.NoError(err)
+	a.Equal("user02", userID)
+
+	_, err = Authenticate(authenticated, r, "user01")
+	a.Equal(ErrUserMismatch, err)
+	a.Equal(http.StatusForbidden, AuthenticationStatus(err))
+
+	_, err = Authenticate(authenticatorFunc(func(*http.Request) (string, map[string]interface{}, error) {
+		return "", nil, ErrInvalidToken
+	}), r, "user01")
+	a.Equal(ErrInvalidToken, err)
+	a.Equal(http.StatusUnauthorized, AuthenticationStatus(err))
+}
+
+func TestBearerToken(t *testing.T) {
+	a := assert.New(t)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/api?access_token=query", nil)
+	a.Equal("query", BearerToken(r))
+	r.Header.Set("Authorization", "bearer header")
+	a.Equal("header", BearerToken(r))
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	a.Equal("query", BearerToken(r))
+	a.Equal("", BearerToken(httptest.NewRequest(http.MethodGet, "http://localhost/api", nil)))
+}
+
+type authenticatorFunc func(*http.Request) (string, map[string]interface{}, error)
+
+func (f authenticatorFunc) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	return f(r)
+}
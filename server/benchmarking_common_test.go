@@ -44,7 +44,7 @@ func (params *benchParams) createClients() (clients []client.Client) {
 	wsURL := "ws://" + params.service.WebServer().GetAddr() + "/stream/user/"
 	for clientID := 0; clientID < params.clients; clientID++ {
 		location := wsURL + strconv.Itoa(clientID)
-		c, err := client.Open(location, "http://localhost/", 1000, true)
+		c, err := client.Open(location, "http://localhost/", 1000, true, false, client.DefaultBackoff, nil, nil, "")
 		if err != nil {
 			assert.FailNow(params, "guble client could not connect to server")
 		}
@@ -32,13 +32,13 @@ func Benchmark_E2E_Fetch_HelloWorld_Messages(b *testing.B) {
 
 	// fill the topic
 	location := "ws://" + service.WebServer().GetAddr() + "/stream/user/xy"
-	c, err := client.Open(location, "http://localhost/", 1000, true)
+	c, err := client.Open(location, "http://localhost/", 1000, true, false, client.DefaultBackoff, nil, nil, "")
 	a.NoError(err)
 
 	for i := 1; i <= b.N; i++ {
 		a.NoError(c.Send("/hello", fmt.Sprintf("Hello %v", i), ""))
 		select {
-		case <-c.StatusMessages():
+		case <-c.StatusUpdates():
 			// wait for, but ignore
 		case <-time.After(time.Millisecond * 100):
 			a.Fail("timeout on send notification")
@@ -114,11 +114,11 @@ func (tg *testgroup) Init() {
 	location := "ws://" + tg.addr + "/stream/user/xy"
 	//location := "ws://gathermon.mancke.net:8080/stream/"
 	//location := "ws://127.0.0.1:8080/stream/"
-	tg.consumer, err = client.Open(location, "http://localhost/", 10, false)
+	tg.consumer, err = client.Open(location, "http://localhost/", 10, false, false, client.DefaultBackoff, nil, nil, "")
 	if err != nil {
 		panic(err)
 	}
-	tg.publisher, err = client.Open(location, "http://localhost/", 10, false)
+	tg.publisher, err = client.Open(location, "http://localhost/", 10, false, false, client.DefaultBackoff, nil, nil, "")
 	if err != nil {
 		panic(err)
 	}
@@ -132,7 +132,7 @@ func (tg *testgroup) Init() {
 
 func (tg *testgroup) expectStatusMessage(name string, arg string) {
 	select {
-	case notify := <-tg.consumer.StatusMessages():
+	case notify := <-tg.consumer.StatusUpdates():
 		assert.Equal(tg.t, name, notify.Name)
 		assert.Equal(tg.t, arg, notify.Arg)
 	case <-time.After(time.Second * 1):
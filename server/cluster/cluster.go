@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 var (
@@ -26,6 +28,14 @@ type Config struct {
 	Port                 int
 	Remotes              []*net.TCPAddr
 	HealthScoreThreshold int
+
+	// Advertise is the address announced to the other nodes, if it differs from the bound one (e.g. behind a NAT).
+	// The other nodes store and dial this address. A zero port is the bound Port.
+	// Without it, the bound Host is announced, or a private IP of the node, if it is bound to all interfaces.
+	Advertise *net.TCPAddr
+
+	// MaxMessageSize is the maximum body size in bytes of a message received from another node. Zero disables the limit.
+	MaxMessageSize int
 }
 
 // router interface specify only the methods we require in cluster from the Router
@@ -34,6 +44,7 @@ type Config struct {
 type router interface {
 	HandleMessage(message *protocol.Message) error
 	MessageStore() (store.MessageStore, error)
+	GetSubscribers(topic string) ([]byte, error)
 }
 
 // Cluster is a struct for managing the `local view` of the guble cluster, as seen by a node.
@@ -54,19 +65,44 @@ type Cluster struct {
 	numUpdates int
 
 	synchronizer *synchronizer
+
+	// the cluster-messages being sent to the other nodes
+	pendingSends sync.WaitGroup
+
+	// pending subscribers queries, by query id
+	queries      map[uint64]chan []byte
+	queriesMutex sync.RWMutex
+	lastQueryID  uint64
+
+	// last contacts with the remote nodes, by node name
+	contacts      map[string]*nodeContact
+	contactsMutex sync.Mutex
+	probeInterval time.Duration
+	probeTimeout  time.Duration
 }
 
 //New returns a new instance of the cluster, created using the given Config.
 func New(config *Config) (*Cluster, error) {
 	c := &Cluster{
-		Config: config,
-		name:   fmt.Sprintf("%d", config.ID),
+		Config:   config,
+		name:     fmt.Sprintf("%d", config.ID),
+		queries:  make(map[uint64]chan []byte),
+		contacts: make(map[string]*nodeContact),
 	}
 
 	memberlistConfig := memberlist.DefaultLANConfig()
 	memberlistConfig.Name = c.name
 	memberlistConfig.BindAddr = config.Host
 	memberlistConfig.BindPort = config.Port
+	if config.Advertise != nil {
+		memberlistConfig.AdvertiseAddr = config.Advertise.IP.String()
+		memberlistConfig.AdvertisePort = config.Advertise.Port
+		if memberlistConfig.AdvertisePort == 0 {
+			memberlistConfig.AdvertisePort = config.Port
+		}
+	}
+	c.probeInterval = memberlistConfig.ProbeInterval
+	c.probeTimeout = memberlistConfig.ProbeTimeout
 
 	//TODO Cosmin temporarily disabling any logging from memberlist, we might want to enable it again using logrus?
 	memberlistConfig.LogOutput = ioutil.Discard
@@ -80,13 +116,17 @@ func New(config *Config) (*Cluster, error) {
 	memberlistConfig.Delegate = c
 	memberlistConfig.Conflict = c
 	memberlistConfig.Events = c
+	memberlistConfig.Ping = c
 
 	return c, nil
 }
 
 // Start the cluster module.
 func (cluster *Cluster) Start() error {
-	logger.WithField("remotes", cluster.Config.Remotes).Debug("Starting Cluster")
+	logger.WithFields(log.Fields{
+		"remotes":   cluster.Config.Remotes,
+		"advertise": cluster.memberlist.LocalNode().Address(),
+	}).Debug("Starting Cluster")
 
 	if cluster.Router == nil {
 		errorMessage := "There should be a valid Router already set-up"
@@ -125,6 +165,32 @@ func (cluster *Cluster) Stop() error {
 	return cluster.memberlist.Shutdown()
 }
 
+// Leave leaves the cluster gracefully, waiting at most for the timeout:
+// the cluster-messages still being sent (e.g. the replicated messages) are sent first,
+// then the other nodes are notified, so that they remove this node immediately instead of detecting its failure.
+func (cluster *Cluster) Leave(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	sentC := make(chan struct{})
+	go func() {
+		cluster.pendingSends.Wait()
+		close(sentC)
+	}()
+	select {
+	case <-sentC:
+		logger.Info("Sent the pending cluster-messages")
+	case <-time.After(timeout):
+		logger.WithField("timeout", timeout).Error("Timeout while sending the pending cluster-messages")
+	}
+
+	remaining := deadline.Sub(time.Now())
+	if remaining <= 0 {
+		remaining = time.Millisecond
+	}
+	logger.WithField("timeout", remaining).Info("Leaving the cluster")
+	return cluster.memberlist.Leave(remaining)
+}
+
 // Check returns a non-nil error if the health status of the cluster (as seen by this node) is not perfect.
 func (cluster *Cluster) Check() error {
 	if healthScore := cluster.memberlist.GetHealthScore(); healthScore > cluster.Config.HealthScoreThreshold {
@@ -165,7 +231,10 @@ func (cluster *Cluster) BroadcastString(sMessage *string) error {
 
 // BroadcastMessage broadcasts a guble-protocol-message to all the other nodes in the guble cluster.
 func (cluster *Cluster) BroadcastMessage(pMessage *protocol.Message) error {
-	logger.WithField("message", pMessage).Debug("BroadcastMessage")
+	logger.WithFields(log.Fields{
+		"message": pMessage,
+		"traceID": pMessage.TraceID(),
+	}).Debug("BroadcastMessage")
 	cMessage := &message{
 		NodeID: cluster.Config.ID,
 		Type:   mtGubleMessage,
@@ -191,7 +260,11 @@ func (cluster *Cluster) broadcastClusterMessage(cMessage *message) error {
 		if cluster.name == node.Name {
 			continue
 		}
-		go cluster.sendToNode(node, cMessageBytes)
+		cluster.pendingSends.Add(1)
+		go func(node *memberlist.Node) {
+			defer cluster.pendingSends.Done()
+			cluster.sendToNode(node, cMessageBytes)
+		}(node)
 	}
 	return nil
 }
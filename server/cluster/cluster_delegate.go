@@ -37,6 +37,14 @@ func (cluster *Cluster) NotifyMsg(data []byte) {
 	case mtSyncMessageRequest:
 		// cluster node is requesting to receive messages for sync
 		cluster.handleSyncMessageRequest(cmsg)
+	case mtSubscribersRequest:
+		cluster.handleSubscribersRequest(cmsg)
+	case mtSubscribersResponse:
+		cluster.handleSubscribersResponse(cmsg)
+	case mtTruncate:
+		cluster.handleTruncate(cmsg)
+	case mtPause, mtResume:
+		cluster.handlePause(cmsg)
 	}
 }
 
@@ -62,6 +70,15 @@ func (cluster *Cluster) handleGubleMessage(cmsg *message) {
 		logger.WithField("err", err).Error("Parsing of guble-message contained in cluster-message failed")
 		return
 	}
+	if cluster.Config.MaxMessageSize > 0 && len(message.Body) > cluster.Config.MaxMessageSize {
+		logger.WithFields(log.Fields{
+			"node_id": cmsg.NodeID,
+			"path":    message.Path,
+			"size":    len(message.Body),
+			"traceID": message.TraceID(),
+		}).Warn("Dropping guble-message exceeding the max message size")
+		return
+	}
 	cluster.Router.HandleMessage(message)
 }
 
@@ -80,7 +97,7 @@ func (cluster *Cluster) handleSyncPartitions(cmsg *message) {
 
 	logger.WithFields(log.Fields{
 		"partitions": partitionsSlice,
-		"nodeID":     cmsg.NodeID,
+		"node_id":    cmsg.NodeID,
 	}).Debug("Partitions received")
 
 	// add to synchronizer
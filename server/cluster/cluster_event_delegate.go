@@ -4,6 +4,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/hashicorp/memberlist"
+
+	"time"
 )
 
 // ==========================================================
@@ -13,6 +15,7 @@ import (
 func (cluster *Cluster) NotifyJoin(node *memberlist.Node) {
 	cluster.numJoins++
 	cluster.eventLog(node, "Cluster Node Join")
+	cluster.touch(node)
 
 	cluster.sendPartitions(node)
 }
@@ -20,11 +23,23 @@ func (cluster *Cluster) NotifyJoin(node *memberlist.Node) {
 func (cluster *Cluster) NotifyLeave(node *memberlist.Node) {
 	cluster.numLeaves++
 	cluster.eventLog(node, "Cluster Node Leave")
+	cluster.markDead(node)
 }
 
 func (cluster *Cluster) NotifyUpdate(node *memberlist.Node) {
 	cluster.numUpdates++
 	cluster.eventLog(node, "Cluster Node Update")
+	cluster.touch(node)
+}
+
+// =========================================================
+// memberlist.PingDelegate implementation for cluster struct
+// =========================================================
+
+func (cluster *Cluster) AckPayload() []byte { return nil }
+
+func (cluster *Cluster) NotifyPingComplete(node *memberlist.Node, rtt time.Duration, payload []byte) {
+	cluster.touch(node)
 }
 
 func (cluster *Cluster) eventLog(node *memberlist.Node, message string) {
@@ -13,6 +13,7 @@ import (
 
 	"errors"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -110,6 +111,44 @@ func TestCluster_BroadcastStringAndMessageAndCheck(t *testing.T) {
 	a.NoError(err, "Health-check score of a Cluster with 2 nodes should be OK for node 2")
 }
 
+func TestCluster_LeaveSendsThePendingMessagesAndNotifiesTheNodes(t *testing.T) {
+	a := assert.New(t)
+
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	router1 := newDummyRouter(t)
+	node1.Router = router1
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	node2.Router = newDummyRouter(t)
+	defer node2.Stop()
+	a.NoError(node2.Start())
+	waitForNodes(node2, func(nodes []NodeInfo) bool { return len(nodes) == 2 })
+
+	// when node 2 leaves right after broadcasting a message
+	a.NoError(node2.BroadcastMessage(&protocol.Message{ID: 1, Path: "/foo", Body: []byte("test"), NodeID: config2.ID}))
+	a.NoError(node2.Leave(time.Second))
+
+	// then the message was sent before leaving
+	for i := 0; i < 50 && len(router1.handled) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if a.Len(router1.handled, 1) {
+		a.Equal(protocol.Path("/foo"), router1.handled[0].Path)
+	}
+
+	// and node 1 sees node 2 as dead without waiting for the failure detection
+	nodes := waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 && nodes[1].State == NodeDead })
+	if a.Len(nodes, 2) {
+		a.Equal(NodeDead, nodes[1].State)
+	}
+}
+
 func TestCluster_NewShouldReturnErrorWhenPortIsInvalid(t *testing.T) {
 	a := assert.New(t)
 
@@ -221,20 +260,57 @@ func TestCluster_broadcastClusterMessage(t *testing.T) {
 	}
 }
 
+func TestCluster_handleGubleMessageDropsMessagesExceedingTheMaxMessageSize(t *testing.T) {
+	a := assert.New(t)
+
+	config := testConfig()
+	config.MaxMessageSize = 5
+	node, err := New(&config)
+	a.NoError(err)
+	defer node.Stop()
+	router := newDummyRouter(t)
+	node.Router = router
+
+	// when receiving a message larger than the limit and a small one from another node
+	for _, body := range []string{"Hello World", "Hello"} {
+		msg := &protocol.Message{ID: 1, Path: "/foo", Body: []byte(body)}
+		node.handleGubleMessage(&message{NodeID: 2, Type: mtGubleMessage, Body: msg.Bytes()})
+	}
+
+	// then only the small message is passed to the router
+	if a.Equal(1, len(router.handled)) {
+		a.Equal("Hello", string(router.handled[0].Body))
+	}
+}
+
 type dummyRouter struct {
-	store store.MessageStore
+	store     store.MessageStore
+	nodeID    uint8
+	handled   []*protocol.Message
+	truncated chan string
+	paused    chan string
 }
 
 func newDummyRouter(t *testing.T) *dummyRouter {
 	dir, err := ioutil.TempDir("", "guble_cluster_test")
 	assert.NoError(t, err)
-	return &dummyRouter{store: filestore.New(dir)}
+	return &dummyRouter{store: filestore.New(dir), truncated: make(chan string, 10), paused: make(chan string, 10)}
 }
 
-func (_ *dummyRouter) HandleMessage(pmsg *protocol.Message) error {
+func (d *dummyRouter) HandleMessage(pmsg *protocol.Message) error {
+	d.handled = append(d.handled, pmsg)
 	return nil
 }
 
 func (d *dummyRouter) MessageStore() (store.MessageStore, error) {
 	return d.store, nil
 }
+
+func (d *dummyRouter) GetSubscribers(topic string) ([]byte, error) {
+	return []byte(`[{"node_id":` + strconv.Itoa(int(d.nodeID)) + `,"route":{"topic":"` + topic + `"}}]`), nil
+}
+
+func (d *dummyRouter) HandleTruncate(partition string) error {
+	d.truncated <- partition
+	return nil
+}
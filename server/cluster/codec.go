@@ -26,6 +26,21 @@ const (
 	mtSyncMessage
 
 	mtStringMessage
+
+	// Sent to query the local subscribers of a topic on a node
+	mtSubscribersRequest
+
+	// Sent as answer to a `mtSubscribersRequest`, contains the subscribers of the node
+	mtSubscribersResponse
+
+	// Sent to truncate a partition on the other nodes, contains the name of the partition
+	mtTruncate
+
+	// Sent to pause the delivery of a topic on the other nodes, contains the topic
+	mtPause
+
+	// Sent to resume the delivery of a paused topic on the other nodes, contains the topic
+	mtResume
 )
 
 type encoder interface {
@@ -44,9 +59,9 @@ type message struct {
 
 func (cmsg *message) encode() ([]byte, error) {
 	logger.WithFields(log.Fields{
-		"nodeID": cmsg.NodeID,
-		"type":   cmsg.Type,
-		"body":   string(cmsg.Body),
+		"node_id": cmsg.NodeID,
+		"type":    cmsg.Type,
+		"body":    string(cmsg.Body),
 	}).Debug("Encoding cluster message")
 	return encode(cmsg)
 }
@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// NodeState is the state of a cluster node, as seen by the local node.
+type NodeState string
+
+const (
+	NodeAlive   NodeState = "alive"
+	NodeSuspect NodeState = "suspect"
+	NodeDead    NodeState = "dead"
+)
+
+// NodeInfo describes a node of the cluster, as seen by the local node.
+type NodeInfo struct {
+	ID      uint8     `json:"id"`
+	Address string    `json:"address"`
+	State   NodeState `json:"state"`
+
+	// LastContact is the unix timestamp of the last successful contact with the node.
+	LastContact int64 `json:"lastContact"`
+}
+
+// nodeContact is the last contact of the local node with a remote node, and its state reported by the gossip layer
+type nodeContact struct {
+	address string
+	last    time.Time
+	state   NodeState
+}
+
+// Nodes returns the local node and all nodes known by the gossip layer, sorted by the node id.
+// The state of a member is the state of its memberlist.Node. The memberlist keeps the state of its nodes internally,
+// and the exported state of its members can still be alive while it suspects them: so a member is also suspect,
+// if it missed the probes of two probe rounds, after which the gossip layer suspects it until its suspicion timeout.
+// The nodes which left or were declared dead by the gossip layer are listed as dead.
+func (cluster *Cluster) Nodes() []NodeInfo {
+	now := time.Now()
+	members := cluster.memberlist.Members()
+
+	cluster.contactsMutex.Lock()
+	defer cluster.contactsMutex.Unlock()
+
+	// each member is probed once in a round, in which the other members are probed in a random order
+	suspectAfter := time.Duration(2*(len(members)-1))*cluster.probeInterval + cluster.probeTimeout
+	nodes := make([]NodeInfo, 0, len(members)+len(cluster.contacts))
+	listed := make(map[string]bool, len(members))
+	for _, node := range members {
+		listed[node.Name] = true
+		if node.Name == cluster.name {
+			nodes = append(nodes, nodeInfo(node.Name, node.Address(), NodeAlive, now))
+			continue
+		}
+		contact := cluster.contact(node, now)
+		state := nodeState(node.State)
+		if state == NodeAlive && now.Sub(contact.last) > suspectAfter {
+			state = NodeSuspect
+		}
+		nodes = append(nodes, nodeInfo(node.Name, contact.address, state, contact.last))
+	}
+	for name, contact := range cluster.contacts {
+		if !listed[name] && contact.state == NodeDead {
+			nodes = append(nodes, nodeInfo(name, contact.address, NodeDead, contact.last))
+		}
+	}
+
+	sort.Sort(byID(nodes))
+	return nodes
+}
+
+// touch records a successful contact with the node, and its state
+func (cluster *Cluster) touch(node *memberlist.Node) {
+	cluster.contactsMutex.Lock()
+	defer cluster.contactsMutex.Unlock()
+
+	now := time.Now()
+	contact := cluster.contact(node, now)
+	contact.address = node.Address()
+	contact.last = now
+	contact.state = nodeState(node.State)
+}
+
+// markDead records that the node left or was declared dead by the gossip layer
+func (cluster *Cluster) markDead(node *memberlist.Node) {
+	cluster.contactsMutex.Lock()
+	defer cluster.contactsMutex.Unlock()
+
+	cluster.contact(node, time.Now()).state = NodeDead
+}
+
+// nodeState returns the NodeState of a state of the gossip layer, in which a node which left is dead
+func nodeState(state memberlist.NodeStateType) NodeState {
+	switch state {
+	case memberlist.StateAlive:
+		return NodeAlive
+	case memberlist.StateSuspect:
+		return NodeSuspect
+	default:
+		return NodeDead
+	}
+}
+
+// contact returns the contact of the node, created with the given time if not existing;
+// the caller has to hold the contactsMutex
+func (cluster *Cluster) contact(node *memberlist.Node, now time.Time) *nodeContact {
+	contact, ok := cluster.contacts[node.Name]
+	if !ok {
+		contact = &nodeContact{address: node.Address(), last: now, state: nodeState(node.State)}
+		cluster.contacts[node.Name] = contact
+	}
+	return contact
+}
+
+type byID []NodeInfo
+
+func (nodes byID) Len() int           { return len(nodes) }
+func (nodes byID) Less(i, j int) bool { return nodes[i].ID < nodes[j].ID }
+func (nodes byID) Swap(i, j int)      { nodes[i], nodes[j] = nodes[j], nodes[i] }
+
+func nodeInfo(name, address string, state NodeState, last time.Time) NodeInfo {
+	id, _ := strconv.ParseUint(name, 10, 8)
+	return NodeInfo{
+		ID:          uint8(id),
+		Address:     address,
+		State:       state,
+		LastContact: last.Unix(),
+	}
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster_NodesReflectTheGossipState(t *testing.T) {
+	a := assert.New(t)
+
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	node1.Router = newDummyRouter(t)
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	node2.Router = newDummyRouter(t)
+	defer node2.Stop()
+	a.NoError(node2.Start())
+
+	// then both nodes are seen alive by node 1
+	nodes := waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 })
+	if a.Len(nodes, 2) {
+		a.Equal(NodeInfo{ID: config1.ID, Address: "127.0.0.1:" + strconv.Itoa(config1.Port), State: NodeAlive, LastContact: nodes[0].LastContact}, nodes[0])
+		a.Equal(NodeInfo{ID: config2.ID, Address: "127.0.0.1:" + strconv.Itoa(config2.Port), State: NodeAlive, LastContact: nodes[1].LastContact}, nodes[1])
+		a.InDelta(time.Now().Unix(), nodes[1].LastContact, 2)
+	}
+
+	// when node 2 missed the probes, then it is suspect
+	node1.contactsMutex.Lock()
+	node1.contacts[node2.name].last = time.Now().Add(-time.Hour)
+	node1.contactsMutex.Unlock()
+	nodes = node1.Nodes()
+	if a.Len(nodes, 2) {
+		a.Equal(NodeSuspect, nodes[1].State)
+		a.Equal(time.Now().Add(-time.Hour).Unix(), nodes[1].LastContact)
+	}
+
+	// when node 2 leaves the cluster, then it is dead
+	a.NoError(node2.memberlist.Leave(time.Second))
+	nodes = waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 && nodes[1].State == NodeDead })
+	if a.Len(nodes, 2) {
+		a.Equal(NodeAlive, nodes[0].State)
+		a.Equal(NodeDead, nodes[1].State)
+	}
+}
+
+func TestCluster_NodesReflectTheFailureDetection(t *testing.T) {
+	a := assert.New(t)
+
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	node1.Router = newDummyRouter(t)
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	node2.Router = newDummyRouter(t)
+	a.NoError(node2.Start())
+	nodes := waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 })
+	a.Len(nodes, 2)
+
+	// when node 2 stops answering the probes, without leaving the cluster
+	a.NoError(node2.memberlist.Shutdown())
+
+	// then it is suspected by the gossip layer, and declared dead after the suspicion timeout
+	nodes = waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 && nodes[1].State == NodeSuspect })
+	if a.Len(nodes, 2) {
+		a.Equal(NodeSuspect, nodes[1].State)
+	}
+	nodes = waitForNodes(node1, func(nodes []NodeInfo) bool { return len(nodes) == 2 && nodes[1].State == NodeDead })
+	if a.Len(nodes, 2) {
+		a.Equal(NodeAlive, nodes[0].State)
+		a.Equal(NodeDead, nodes[1].State)
+	}
+}
+
+func Test_nodeState(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(NodeAlive, nodeState(memberlist.StateAlive))
+	a.Equal(NodeSuspect, nodeState(memberlist.StateSuspect))
+	a.Equal(NodeDead, nodeState(memberlist.StateDead))
+	a.Equal(NodeDead, nodeState(memberlist.StateLeft))
+}
+
+func waitForNodes(cluster *Cluster, condition func([]NodeInfo) bool) []NodeInfo {
+	nodes := cluster.Nodes()
+	for i := 0; i < 100 && !condition(nodes); i++ {
+		time.Sleep(100 * time.Millisecond)
+		nodes = cluster.Nodes()
+	}
+	return nodes
+}
+
+func TestCluster_NodesStoreAndDialTheAdvertisedAddress(t *testing.T) {
+	a := assert.New(t)
+
+	// given a node bound to all interfaces, advertising another address
+	config1 := testConfig()
+	config1.Host = "0.0.0.0"
+	config1.Advertise = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	node1, err := New(&config1)
+	a.NoError(err)
+	router1 := newDummyRouter(t)
+	node1.Router = router1
+	defer node1.Stop()
+	a.NoError(node1.Start())
+	advertised := "127.0.0.1:" + strconv.Itoa(config1.Port)
+	a.Equal(advertised, node1.memberlist.LocalNode().Address())
+
+	// when another node joins it
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	node2.Router = newDummyRouter(t)
+	defer node2.Stop()
+	a.NoError(node2.Start())
+
+	// then the other node stores the advertised address
+	nodes := waitForNodes(node2, func(nodes []NodeInfo) bool { return len(nodes) == 2 })
+	if a.Len(nodes, 2) {
+		a.Equal(config1.ID, nodes[0].ID)
+		a.Equal(advertised, nodes[0].Address)
+	}
+
+	// and dials it for sending a cluster message
+	a.NoError(node2.BroadcastTruncate("foo"))
+	select {
+	case partition := <-router1.truncated:
+		a.Equal("foo", partition)
+	case <-time.After(time.Second):
+		a.Fail("The message was not received at the advertised address")
+	}
+}
@@ -0,0 +1,48 @@
+package cluster
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// pauser is implemented by a router, which can hold back the delivery of the messages of a topic
+type pauser interface {
+	HandlePause(topic protocol.Path) error
+	HandleResume(topic protocol.Path) error
+}
+
+// BroadcastPause asks all the other nodes of the guble cluster to pause the delivery of the topic.
+func (cluster *Cluster) BroadcastPause(topic string) error {
+	logger.WithField("topic", topic).Debug("BroadcastPause")
+	return cluster.broadcastClusterMessage(cluster.newMessage(mtPause, []byte(topic)))
+}
+
+// BroadcastResume asks all the other nodes of the guble cluster to resume the delivery of the paused topic.
+func (cluster *Cluster) BroadcastResume(topic string) error {
+	logger.WithField("topic", topic).Debug("BroadcastResume")
+	return cluster.broadcastClusterMessage(cluster.newMessage(mtResume, []byte(topic)))
+}
+
+// handles message received with type `mtPause` or `mtResume`
+func (cluster *Cluster) handlePause(cmsg *message) {
+	p, ok := cluster.Router.(pauser)
+	if !ok {
+		logger.WithField("node_id", cmsg.NodeID).Warn("Ignoring the pause, which is not supported by the router")
+		return
+	}
+	topic := protocol.Path(cmsg.Body)
+	var err error
+	if cmsg.Type == mtPause {
+		err = p.HandlePause(topic)
+	} else {
+		err = p.HandleResume(topic)
+	}
+	if err != nil {
+		logger.WithError(err).WithFields(log.Fields{
+			"node_id": cmsg.NodeID,
+			"topic":   topic,
+			"type":    cmsg.Type,
+		}).Error("Error pausing or resuming the topic")
+	}
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func (d *dummyRouter) HandlePause(topic protocol.Path) error {
+	d.paused <- "pause " + string(topic)
+	return nil
+}
+
+func (d *dummyRouter) HandleResume(topic protocol.Path) error {
+	d.paused <- "resume " + string(topic)
+	return nil
+}
+
+func TestCluster_BroadcastPauseAndResume(t *testing.T) {
+	a := assert.New(t)
+
+	// given a cluster of two nodes
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	router1 := newDummyRouter(t)
+	node1.Router = router1
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	router2 := newDummyRouter(t)
+	node2.Router = router2
+	defer node2.Stop()
+	a.NoError(node2.Start())
+
+	// when node 1 broadcasts the pause and the resume of a topic
+	a.NoError(node1.BroadcastPause("/foo"))
+	a.NoError(node1.BroadcastResume("/foo"))
+
+	// then the router of node 2 pauses and resumes it, and node 1 does not
+	for _, expected := range []string{"pause /foo", "resume /foo"} {
+		select {
+		case received := <-router2.paused:
+			a.Equal(expected, received)
+		case <-time.After(time.Second):
+			a.FailNow("The pause was not received by the other node", expected)
+		}
+	}
+	a.Equal(0, len(router1.paused))
+}
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// subscribersRequest is the body of a `mtSubscribersRequest` message, querying the local subscribers of a topic
+type subscribersRequest struct {
+	ID    uint64
+	Topic string
+}
+
+func (r *subscribersRequest) encode() ([]byte, error) {
+	return encode(r)
+}
+
+func (r *subscribersRequest) decode(data []byte) error {
+	return decode(r, data)
+}
+
+// subscribersResponse is the body of a `mtSubscribersResponse` message,
+// containing the JSON encoded subscribers as returned by the router of the responding node
+type subscribersResponse struct {
+	ID          uint64
+	Subscribers []byte
+}
+
+func (r *subscribersResponse) encode() ([]byte, error) {
+	return encode(r)
+}
+
+func (r *subscribersResponse) decode(data []byte) error {
+	return decode(r, data)
+}
+
+// QuerySubscribers asks all other nodes of the cluster for their local subscribers of the topic.
+// It returns the JSON encoded subscribers of each node, which responded in the given timeout.
+func (cluster *Cluster) QuerySubscribers(topic string, timeout time.Duration) ([][]byte, error) {
+	id := atomic.AddUint64(&cluster.lastQueryID, 1)
+	request, err := cluster.newEncoderMessage(mtSubscribersRequest, &subscribersRequest{ID: id, Topic: topic})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := cluster.memberlist.Members()
+	responseC := make(chan []byte, len(nodes))
+	cluster.queriesMutex.Lock()
+	cluster.queries[id] = responseC
+	cluster.queriesMutex.Unlock()
+	defer func() {
+		cluster.queriesMutex.Lock()
+		delete(cluster.queries, id)
+		cluster.queriesMutex.Unlock()
+	}()
+
+	expected := 0
+	for _, node := range nodes {
+		if cluster.name == node.Name {
+			continue
+		}
+		if err := cluster.sendMessageToNode(node, request); err != nil {
+			continue
+		}
+		expected++
+	}
+
+	results := make([][]byte, 0, expected)
+	timeoutC := time.After(timeout)
+	for len(results) < expected {
+		select {
+		case subscribers := <-responseC:
+			results = append(results, subscribers)
+		case <-timeoutC:
+			logger.WithFields(log.Fields{
+				"topic":     topic,
+				"expected":  expected,
+				"responses": len(results),
+			}).Warn("Timeout waiting for subscribers of the cluster nodes")
+			return results, nil
+		}
+	}
+	return results, nil
+}
+
+// handles message received with type `mtSubscribersRequest`
+func (cluster *Cluster) handleSubscribersRequest(cmsg *message) {
+	request := new(subscribersRequest)
+	if err := request.decode(cmsg.Body); err != nil {
+		logger.WithError(err).Error("Error decoding subscribers request")
+		return
+	}
+
+	subscribers, err := cluster.Router.GetSubscribers(request.Topic)
+	if err != nil {
+		logger.WithError(err).WithField("topic", request.Topic).Error("Error getting the subscribers")
+		return
+	}
+
+	response, err := cluster.newEncoderMessage(mtSubscribersResponse, &subscribersResponse{
+		ID:          request.ID,
+		Subscribers: subscribers,
+	})
+	if err != nil {
+		return
+	}
+	cluster.sendMessageToNodeID(cmsg.NodeID, response)
+}
+
+// handles message received with type `mtSubscribersResponse`
+func (cluster *Cluster) handleSubscribersResponse(cmsg *message) {
+	response := new(subscribersResponse)
+	if err := response.decode(cmsg.Body); err != nil {
+		logger.WithError(err).Error("Error decoding subscribers response")
+		return
+	}
+
+	cluster.queriesMutex.RLock()
+	responseC, ok := cluster.queries[response.ID]
+	cluster.queriesMutex.RUnlock()
+	if !ok {
+		logger.WithField("node_id", cmsg.NodeID).Debug("Subscribers response for a finished query")
+		return
+	}
+	select {
+	case responseC <- response.Subscribers:
+	default:
+	}
+}
@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster_QuerySubscribers(t *testing.T) {
+	a := assert.New(t)
+
+	// given a cluster of two nodes
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	node1.Router = newDummyRouter(t)
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	router2 := newDummyRouter(t)
+	router2.nodeID = config2.ID
+	node2.Router = router2
+	defer node2.Stop()
+	a.NoError(node2.Start())
+
+	// when node 1 queries the subscribers of a topic
+	results, err := node1.QuerySubscribers("/foo", time.Second)
+
+	// then it receives the subscribers of node 2
+	a.NoError(err)
+	if a.Equal(1, len(results)) {
+		a.JSONEq(`[{"node_id":`+strconv.Itoa(int(config2.ID))+`,"route":{"topic":"/foo"}}]`, string(results[0]))
+	}
+	a.Equal(0, len(node1.queries))
+}
+
+func TestCluster_QuerySubscribersWithoutOtherNodes(t *testing.T) {
+	a := assert.New(t)
+
+	conf := testConfig()
+	node, err := New(&conf)
+	a.NoError(err)
+	node.Router = newDummyRouter(t)
+	defer node.Stop()
+	a.NoError(node.Start())
+
+	results, err := node.QuerySubscribers("/foo", time.Second)
+	a.NoError(err)
+	a.Equal(0, len(results))
+}
@@ -208,8 +208,8 @@ func (s *synchronizer) syncMessage(nodeID uint8, data []byte) error {
 	err := sm.decode(data)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"nodeID": nodeID,
-			"data":   string(data),
+			"node_id": nodeID,
+			"data":    string(data),
 		}).Error("Error decoding sync message received")
 		return err
 	}
@@ -280,7 +280,7 @@ func (sp *syncPartition) loop() {
 	err = sp.synchronizer.cluster.sendMessageToNodeID(nodeID, cmsg)
 	if err != nil {
 		sp.synchronizer.logger.WithError(err).WithFields(log.Fields{
-			"nodeID":  nodeID,
+			"node_id": nodeID,
 			"StartID": sp.lastID,
 			"EndID":   maxID,
 		}).Error("Error sending sync message request to node")
@@ -295,7 +295,7 @@ func (sp *syncPartition) loop() {
 			err := sp.synchronizer.store.Store(partitionName, sm.ID, sm.Message)
 			if err != nil {
 				sp.synchronizer.logger.WithError(err).
-					WithField("messageID", sm.ID).
+					WithField("message_id", sm.ID).
 					Error("Error storing synchronize message")
 			}
 
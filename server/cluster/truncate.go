@@ -0,0 +1,32 @@
+package cluster
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// truncater is implemented by a router, which can truncate the partitions of its message store
+type truncater interface {
+	HandleTruncate(partition string) error
+}
+
+// BroadcastTruncate asks all the other nodes of the guble cluster to truncate the partition in their message store.
+func (cluster *Cluster) BroadcastTruncate(partition string) error {
+	logger.WithField("partition", partition).Debug("BroadcastTruncate")
+	return cluster.broadcastClusterMessage(cluster.newMessage(mtTruncate, []byte(partition)))
+}
+
+// handles message received with type `mtTruncate`
+func (cluster *Cluster) handleTruncate(cmsg *message) {
+	t, ok := cluster.Router.(truncater)
+	if !ok {
+		logger.WithField("node_id", cmsg.NodeID).Warn("Ignoring the truncation, which is not supported by the router")
+		return
+	}
+	partition := string(cmsg.Body)
+	if err := t.HandleTruncate(partition); err != nil {
+		logger.WithError(err).WithFields(log.Fields{
+			"node_id":   cmsg.NodeID,
+			"partition": partition,
+		}).Error("Error truncating the partition")
+	}
+}
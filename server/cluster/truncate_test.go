@@ -0,0 +1,41 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCluster_BroadcastTruncate(t *testing.T) {
+	a := assert.New(t)
+
+	// given a cluster of two nodes
+	config1 := testConfig()
+	node1, err := New(&config1)
+	a.NoError(err)
+	router1 := newDummyRouter(t)
+	node1.Router = router1
+	defer node1.Stop()
+	a.NoError(node1.Start())
+
+	config2 := testConfigAnother()
+	node2, err := New(&config2)
+	a.NoError(err)
+	router2 := newDummyRouter(t)
+	node2.Router = router2
+	defer node2.Stop()
+	a.NoError(node2.Start())
+
+	// when node 1 broadcasts the truncation of a partition
+	a.NoError(node1.BroadcastTruncate("foo"))
+
+	// then the router of node 2 truncates it, and node 1 does not
+	select {
+	case partition := <-router2.truncated:
+		a.Equal("foo", partition)
+	case <-time.After(time.Second):
+		a.FailNow("The partition was not truncated by the other node")
+	}
+	a.Equal(0, len(router1.truncated))
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// clusterFile is the content of the cluster configuration file (--cluster-config), e.g.:
+//
+//	node-id: 1
+//	bind-address: 0.0.0.0:10000
+//	advertise-address: 10.0.0.1:10000
+//	seeds:
+//	  - 10.0.0.2:10000
+//
+// Instead of the values of a single node, the file can list all nodes of the cluster,
+// so the same file is deployed to all of them, and each node takes its entry by its --node-id:
+//
+//	nodes:
+//	  - id: 1
+//	    advertise-address: 10.0.0.1:10000
+//	  - id: 2
+//	    advertise-address: 10.0.0.2:10000
+//
+// The other nodes are then the seeds, unless the seeds are given.
+type clusterFile struct {
+	NodeID           uint8             `yaml:"node-id"`
+	BindAddress      string            `yaml:"bind-address"`
+	AdvertiseAddress string            `yaml:"advertise-address"`
+	Seeds            []string          `yaml:"seeds"`
+	Nodes            []clusterFileNode `yaml:"nodes"`
+}
+
+// clusterFileNode is a node listed in the cluster configuration file
+type clusterFileNode struct {
+	ID               uint8  `yaml:"id"`
+	BindAddress      string `yaml:"bind-address"`
+	AdvertiseAddress string `yaml:"advertise-address"`
+}
+
+// readClusterFile reads and decodes the cluster configuration file, rejecting unknown fields
+func readClusterFile(path string) (*clusterFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &clusterFile{}
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// node returns the entry of the node with the id in the list of nodes, or nil
+func (f *clusterFile) node(id uint8) *clusterFileNode {
+	for i := range f.Nodes {
+		if f.Nodes[i].ID == id {
+			return &f.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// validate checks the file for the node with the id, which is the node id of the file, if not given by a flag
+func (f *clusterFile) validate(nodeID uint8) error {
+	ids := make(map[uint8]bool)
+	addresses := make(map[string]uint8)
+	for _, n := range f.Nodes {
+		if n.ID == 0 {
+			return fmt.Errorf("a node without id, which has to be a strictly positive integer number")
+		}
+		if ids[n.ID] {
+			return fmt.Errorf("the node id %d is not unique", n.ID)
+		}
+		ids[n.ID] = true
+		if n.AdvertiseAddress == "" {
+			continue
+		}
+		if other, exist := addresses[n.AdvertiseAddress]; exist {
+			return fmt.Errorf("the nodes %d and %d have the same advertise-address %s", other, n.ID, n.AdvertiseAddress)
+		}
+		addresses[n.AdvertiseAddress] = n.ID
+	}
+
+	if nodeID == 0 {
+		return fmt.Errorf("no node id, neither given by the node-id of the file nor by --node-id")
+	}
+	if len(f.Nodes) == 0 {
+		return nil
+	}
+	n := f.node(nodeID)
+	if n == nil {
+		return fmt.Errorf("the node id %d is not one of the nodes", nodeID)
+	}
+	if f.BindAddress != "" && n.BindAddress != "" && f.BindAddress != n.BindAddress {
+		return fmt.Errorf("conflicting bind-address of the node %d: %s and %s", nodeID, f.BindAddress, n.BindAddress)
+	}
+	if f.AdvertiseAddress != "" && n.AdvertiseAddress != "" && f.AdvertiseAddress != n.AdvertiseAddress {
+		return fmt.Errorf("conflicting advertise-address of the node %d: %s and %s", nodeID, f.AdvertiseAddress, n.AdvertiseAddress)
+	}
+	return nil
+}
+
+// seeds returns the addresses of the seeds, or the advertised addresses of the other nodes, if there are no seeds
+func (f *clusterFile) seeds(nodeID uint8) []string {
+	if len(f.Seeds) > 0 || len(f.Nodes) == 0 {
+		return f.Seeds
+	}
+	var seeds []string
+	for _, n := range f.Nodes {
+		if n.ID != nodeID && n.AdvertiseAddress != "" {
+			seeds = append(seeds, n.AdvertiseAddress)
+		}
+	}
+	return seeds
+}
+
+// applyClusterFile reads the cluster configuration file, if given, and sets the values of the cluster config,
+// which are not given by their flags. It returns an error for an invalid or inconsistent file,
+// or for an address, which can not be resolved.
+func applyClusterFile(c *ClusterConfig) error {
+	if *c.ConfigFile != "" {
+		f, err := readClusterFile(*c.ConfigFile)
+		if err != nil {
+			return err
+		}
+		if *c.NodeID == 0 {
+			*c.NodeID = f.NodeID
+		}
+		if err := f.validate(*c.NodeID); err != nil {
+			return err
+		}
+
+		bind, advertise := f.BindAddress, f.AdvertiseAddress
+		if n := f.node(*c.NodeID); n != nil {
+			if bind == "" {
+				bind = n.BindAddress
+			}
+			if advertise == "" {
+				advertise = n.AdvertiseAddress
+			}
+		}
+		if bind != "" {
+			host, port, err := splitHostPort(bind)
+			if err != nil {
+				return fmt.Errorf("invalid bind-address %s: %v", bind, err)
+			}
+			if *c.Host == "" {
+				*c.Host = host
+			}
+			if *c.NodePort == 0 {
+				*c.NodePort = port
+			}
+		}
+		if *c.Advertise == "" {
+			*c.Advertise = advertise
+		}
+		if len(*c.Remotes) == 0 {
+			for _, seed := range f.seeds(*c.NodeID) {
+				addr, err := net.ResolveTCPAddr("tcp", seed)
+				if err != nil {
+					return fmt.Errorf("invalid seed %s: %v", seed, err)
+				}
+				*c.Remotes = append(*c.Remotes, addr)
+			}
+		}
+		logger.WithFields(log.Fields{
+			"file":      *c.ConfigFile,
+			"nodeID":    *c.NodeID,
+			"remotes":   len(*c.Remotes),
+			"advertise": *c.Advertise,
+		}).Info("Read the cluster configuration file")
+	}
+
+	if *c.NodePort == 0 {
+		*c.NodePort = defaultNodePort
+	}
+	return nil
+}
+
+// advertiseAddr resolves the advertised address of the cluster config, returning nil if there is none.
+// An address without port advertises the node port.
+func advertiseAddr(c *ClusterConfig) (*net.TCPAddr, error) {
+	address := *c.Advertise
+	if address == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(*c.NodePort))
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return nil, fmt.Errorf("expected IP[:port] of a single interface got '%s'", *c.Advertise)
+	}
+	return addr, nil
+}
+
+func splitHostPort(address string) (string, int, error) {
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 {
+		return "", 0, fmt.Errorf("expected a strictly positive port got '%s'", p)
+	}
+	return host, port, nil
+}
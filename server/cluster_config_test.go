@@ -0,0 +1,177 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func aClusterFile(a *assert.Assertions, content string) string {
+	f, err := ioutil.TempFile("", "guble_cluster_config_test")
+	a.NoError(err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	a.NoError(err)
+	return f.Name()
+}
+
+func aClusterConfig(file string) *ClusterConfig {
+	var (
+		nodeID                      uint8
+		nodePort                    int
+		configFile, host, advertise = file, "", ""
+		remotes                     = make(tcpAddrList, 0)
+	)
+	return &ClusterConfig{
+		ConfigFile: &configFile,
+		NodeID:     &nodeID,
+		NodePort:   &nodePort,
+		Host:       &host,
+		Advertise:  &advertise,
+		Remotes:    &remotes,
+	}
+}
+
+func TestApplyClusterFile_SingleNode(t *testing.T) {
+	a := assert.New(t)
+	file := aClusterFile(a, `
+node-id: 3
+bind-address: 127.0.0.1:10001
+advertise-address: 10.0.0.3:10001
+seeds:
+  - 127.0.0.1:10002
+  - 127.0.0.1:10003
+`)
+	defer os.Remove(file)
+
+	c := aClusterConfig(file)
+	a.NoError(applyClusterFile(c))
+
+	a.Equal(uint8(3), *c.NodeID)
+	a.Equal("127.0.0.1", *c.Host)
+	a.Equal(10001, *c.NodePort)
+	a.Equal("10.0.0.3:10001", *c.Advertise)
+	a.Equal(2, len(*c.Remotes))
+	a.Equal("127.0.0.1:10003", (*c.Remotes)[1].String())
+
+	advertise, err := advertiseAddr(c)
+	a.NoError(err)
+	a.Equal(&net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 10001}, advertise)
+}
+
+func TestApplyClusterFile_FlagsOverrideTheFile(t *testing.T) {
+	a := assert.New(t)
+	file := aClusterFile(a, `
+node-id: 3
+bind-address: 127.0.0.1:10001
+seeds: [127.0.0.1:10002]
+`)
+	defer os.Remove(file)
+
+	c := aClusterConfig(file)
+	*c.NodeID, *c.NodePort, *c.Host = 4, 11000, "0.0.0.0"
+	remote, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:11001")
+	*c.Remotes = append(*c.Remotes, remote)
+
+	a.NoError(applyClusterFile(c))
+	a.Equal(uint8(4), *c.NodeID)
+	a.Equal(11000, *c.NodePort)
+	a.Equal("0.0.0.0", *c.Host)
+	a.Equal(tcpAddrList{remote}, *c.Remotes)
+}
+
+func TestApplyClusterFile_AllNodes(t *testing.T) {
+	a := assert.New(t)
+	file := aClusterFile(a, `
+nodes:
+  - id: 1
+    bind-address: 127.0.0.1:10001
+    advertise-address: 127.0.0.1:10001
+  - id: 2
+    bind-address: 127.0.0.1:10002
+    advertise-address: 127.0.0.1:10002
+  - id: 3
+    advertise-address: 127.0.0.1:10003
+`)
+	defer os.Remove(file)
+
+	// when the node id is given by the flag
+	c := aClusterConfig(file)
+	*c.NodeID = 2
+	a.NoError(applyClusterFile(c))
+
+	// then the node takes its entry, and the other nodes are the seeds
+	a.Equal(10002, *c.NodePort)
+	a.Equal("127.0.0.1:10002", *c.Advertise)
+	if a.Equal(2, len(*c.Remotes)) {
+		a.Equal("127.0.0.1:10001", (*c.Remotes)[0].String())
+		a.Equal("127.0.0.1:10003", (*c.Remotes)[1].String())
+	}
+
+	// and a node without bind-address uses the default port
+	c = aClusterConfig(file)
+	*c.NodeID = 3
+	a.NoError(applyClusterFile(c))
+	a.Equal(defaultNodePort, *c.NodePort)
+	a.Equal("", *c.Host)
+}
+
+func TestApplyClusterFile_Invalid(t *testing.T) {
+	a := assert.New(t)
+
+	for _, test := range []struct {
+		content string
+		nodeID  uint8
+		err     string
+	}{
+		{"node-id: 1\nremotes: [127.0.0.1:10001]", 0, "field remotes not found"},
+		{"node-id: 300", 0, "cannot unmarshal"},
+		{"seeds: [127.0.0.1:10001]", 0, "no node id"},
+		{"nodes: [{id: 1}, {id: 2}, {id: 1}]", 1, "the node id 1 is not unique"},
+		{"nodes: [{id: 1}, {}]", 1, "a node without id"},
+		{"nodes: [{id: 1, advertise-address: '10.0.0.1:10000'}, {id: 2, advertise-address: '10.0.0.1:10000'}]", 1, "the same advertise-address"},
+		{"nodes: [{id: 1}, {id: 2}]", 3, "the node id 3 is not one of the nodes"},
+		{"node-id: 1\nbind-address: 0.0.0.0:10000\nnodes: [{id: 1, bind-address: '0.0.0.0:10001'}]", 0, "conflicting bind-address"},
+		{"node-id: 1\nbind-address: 0.0.0.0", 0, "invalid bind-address"},
+		{"node-id: 1\nseeds: [unknown.invalid:10000]", 0, "invalid seed"},
+	} {
+		file := aClusterFile(a, test.content)
+		c := aClusterConfig(file)
+		*c.NodeID = test.nodeID
+
+		err := applyClusterFile(c)
+		if a.Error(err, test.content) {
+			a.Contains(err.Error(), test.err)
+		}
+		os.Remove(file)
+	}
+
+	// and a missing file
+	a.Error(applyClusterFile(aClusterConfig("/nonexistent/cluster.yml")))
+}
+
+func TestApplyClusterFile_WithoutFile(t *testing.T) {
+	a := assert.New(t)
+
+	c := aClusterConfig("")
+	a.NoError(applyClusterFile(c))
+	a.Equal(defaultNodePort, *c.NodePort)
+	a.Equal(uint8(0), *c.NodeID)
+
+	// and an advertised address without port advertises the node port
+	*c.Advertise = "10.0.0.1"
+	advertise, err := advertiseAddr(c)
+	a.NoError(err)
+	a.Equal(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: defaultNodePort}, advertise)
+
+	// and an address of all interfaces can not be advertised
+	*c.Advertise = "0.0.0.0:10000"
+	_, err = advertiseAddr(c)
+	a.Error(err)
+	*c.Advertise = ":10000"
+	_, err = advertiseAddr(c)
+	a.Error(err)
+}
@@ -105,7 +105,7 @@ WAIT:
 		case incomingMessage := <-client2.Messages():
 			numReceived++
 			logger.WithFields(log.Fields{
-				"nodeID":            incomingMessage.NodeID,
+				"node_id":           incomingMessage.NodeID,
 				"path":              incomingMessage.Path,
 				"incomingMsgUserId": incomingMessage.UserID,
 				"headerJson":        incomingMessage.HeaderJSON,
@@ -183,7 +183,7 @@ func TestSynchronizerIntegration(t *testing.T) {
 				log.WithField("m", m).Error("Message received from first cluster")
 			case e := <-client2.Errors():
 				log.WithField("clientError", e).Error("Client error")
-			case status := <-client2.StatusMessages():
+			case status := <-client2.StatusUpdates():
 				log.WithField("status", status).Error("Client status messasge")
 			case <-doneC:
 				return
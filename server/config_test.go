@@ -1,10 +1,12 @@
 package server
 
 import (
+	"github.com/alecthomas/units"
 	"github.com/stretchr/testify/assert"
 	"net"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestParsingOfEnvironmentVariables(t *testing.T) {
@@ -21,6 +23,84 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_LOG", "debug")
 	defer os.Unsetenv("GUBLE_LOG")
 
+	os.Setenv("GUBLE_LOG_FORMAT", "json")
+	defer os.Unsetenv("GUBLE_LOG_FORMAT")
+
+	os.Setenv("GUBLE_LOG_OUTPUT", "stdout")
+	defer os.Unsetenv("GUBLE_LOG_OUTPUT")
+
+	os.Setenv("GUBLE_HTTP_READ_TIMEOUT", "5s")
+	defer os.Unsetenv("GUBLE_HTTP_READ_TIMEOUT")
+
+	os.Setenv("GUBLE_HTTP_WRITE_TIMEOUT", "10s")
+	defer os.Unsetenv("GUBLE_HTTP_WRITE_TIMEOUT")
+
+	os.Setenv("GUBLE_HTTP_IDLE_TIMEOUT", "1m")
+	defer os.Unsetenv("GUBLE_HTTP_IDLE_TIMEOUT")
+
+	os.Setenv("GUBLE_HTTP2", "false")
+	defer os.Unsetenv("GUBLE_HTTP2")
+
+	os.Setenv("GUBLE_RESTART_TIMEOUT", "1m")
+	defer os.Unsetenv("GUBLE_RESTART_TIMEOUT")
+
+	os.Setenv("GUBLE_TLS_CERT", "cert.pem")
+	defer os.Unsetenv("GUBLE_TLS_CERT")
+
+	os.Setenv("GUBLE_TLS_KEY", "key.pem")
+	defer os.Unsetenv("GUBLE_TLS_KEY")
+
+	os.Setenv("GUBLE_TLS_MIN_VERSION", "1.3")
+	defer os.Unsetenv("GUBLE_TLS_MIN_VERSION")
+
+	os.Setenv("GUBLE_TLS_CIPHERS", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	defer os.Unsetenv("GUBLE_TLS_CIPHERS")
+
+	os.Setenv("GUBLE_TLS_CLIENT_CA", "ca.pem")
+	defer os.Unsetenv("GUBLE_TLS_CLIENT_CA")
+
+	os.Setenv("GUBLE_CORS_ALLOW_ORIGINS", "https://app.example.com,https://admin.example.com")
+	defer os.Unsetenv("GUBLE_CORS_ALLOW_ORIGINS")
+
+	os.Setenv("GUBLE_CORS_ALLOW_METHODS", "GET,POST")
+	defer os.Unsetenv("GUBLE_CORS_ALLOW_METHODS")
+
+	os.Setenv("GUBLE_CORS_ALLOW_CREDENTIALS", "true")
+	defer os.Unsetenv("GUBLE_CORS_ALLOW_CREDENTIALS")
+
+	os.Setenv("GUBLE_ACCESS_LOG", "true")
+	defer os.Unsetenv("GUBLE_ACCESS_LOG")
+
+	os.Setenv("GUBLE_ACCESS_LOG_EXCLUDE", "/health,/api/tap")
+	defer os.Unsetenv("GUBLE_ACCESS_LOG_EXCLUDE")
+
+	os.Setenv("GUBLE_WS_COMPRESS_THRESHOLD", "1024")
+	defer os.Unsetenv("GUBLE_WS_COMPRESS_THRESHOLD")
+
+	os.Setenv("GUBLE_WS_PING_INTERVAL", "1m")
+	defer os.Unsetenv("GUBLE_WS_PING_INTERVAL")
+
+	os.Setenv("GUBLE_WS_PONG_TIMEOUT", "5s")
+	defer os.Unsetenv("GUBLE_WS_PONG_TIMEOUT")
+
+	os.Setenv("GUBLE_WS_SESSION_EXPIRY", "1h")
+	defer os.Unsetenv("GUBLE_WS_SESSION_EXPIRY")
+
+	os.Setenv("GUBLE_WS_HIGH_WATER_MARK", "1000")
+	defer os.Unsetenv("GUBLE_WS_HIGH_WATER_MARK")
+
+	os.Setenv("GUBLE_WS_LOW_WATER_MARK", "100")
+	defer os.Unsetenv("GUBLE_WS_LOW_WATER_MARK")
+
+	os.Setenv("GUBLE_SMS_BATCH_WINDOW", "2s")
+	defer os.Unsetenv("GUBLE_SMS_BATCH_WINDOW")
+
+	os.Setenv("GUBLE_SMS_BATCH_KEY", "recipient")
+	defer os.Unsetenv("GUBLE_SMS_BATCH_KEY")
+
+	os.Setenv("GUBLE_MAX_MESSAGE_SIZE", "1MB")
+	defer os.Unsetenv("GUBLE_MAX_MESSAGE_SIZE")
+
 	os.Setenv("GUBLE_ENV", "dev")
 	defer os.Unsetenv("GUBLE_ENV")
 
@@ -39,18 +119,180 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_METRICS_ENDPOINT", "metrics_endpoint")
 	defer os.Unsetenv("GUBLE_METRICS_ENDPOINT")
 
+	os.Setenv("GUBLE_PROMETHEUS_ENDPOINT", "prometheus_endpoint")
+	defer os.Unsetenv("GUBLE_PROMETHEUS_ENDPOINT")
+
 	os.Setenv("GUBLE_MS", "ms-backend")
 	defer os.Unsetenv("GUBLE_MS")
 
+	os.Setenv("GUBLE_STORE_MEMORY_SIZE", "500")
+	defer os.Unsetenv("GUBLE_STORE_MEMORY_SIZE")
+
+	os.Setenv("GUBLE_MS_TTL", "/foo=1h /bar=30m")
+	defer os.Unsetenv("GUBLE_MS_TTL")
+
+	os.Setenv("GUBLE_MS_INDEXED_HEADERS", "/foo=Customer,Region")
+	defer os.Unsetenv("GUBLE_MS_INDEXED_HEADERS")
+
+	os.Setenv("GUBLE_MS_COMPACTION_KEYS", "/devices=Device-Id")
+	defer os.Unsetenv("GUBLE_MS_COMPACTION_KEYS")
+
+	os.Setenv("GUBLE_PER_USER_RATE", "2.5")
+	defer os.Unsetenv("GUBLE_PER_USER_RATE")
+
+	os.Setenv("GUBLE_PER_USER_BURST", "10")
+	defer os.Unsetenv("GUBLE_PER_USER_BURST")
+
+	os.Setenv("GUBLE_MAX_MESSAGES_PER_TOPIC", "1000")
+	defer os.Unsetenv("GUBLE_MAX_MESSAGES_PER_TOPIC")
+
+	os.Setenv("GUBLE_STORE_BATCH_SIZE", "64")
+	defer os.Unsetenv("GUBLE_STORE_BATCH_SIZE")
+
+	os.Setenv("GUBLE_STORE_BATCH_LINGER", "2ms")
+	defer os.Unsetenv("GUBLE_STORE_BATCH_LINGER")
+
+	os.Setenv("GUBLE_STORE_COMPRESS", "true")
+	defer os.Unsetenv("GUBLE_STORE_COMPRESS")
+
+	os.Setenv("GUBLE_STORE_MIGRATE", "true")
+	defer os.Unsetenv("GUBLE_STORE_MIGRATE")
+
+	os.Setenv("GUBLE_STORE_ON_CORRUPTION", "fail")
+	defer os.Unsetenv("GUBLE_STORE_ON_CORRUPTION")
+
+	os.Setenv("GUBLE_ID_GENERATOR", "snowflake")
+	defer os.Unsetenv("GUBLE_ID_GENERATOR")
+
+	os.Setenv("GUBLE_STORE_MIN_FREE_BYTES", "1073741824")
+	defer os.Unsetenv("GUBLE_STORE_MIN_FREE_BYTES")
+
+	os.Setenv("GUBLE_STORE_MIN_FREE_PERCENT", "10")
+	defer os.Unsetenv("GUBLE_STORE_MIN_FREE_PERCENT")
+
+	os.Setenv("GUBLE_DEDUP_WINDOW", "5m")
+	defer os.Unsetenv("GUBLE_DEDUP_WINDOW")
+
+	os.Setenv("GUBLE_DEDUP_MAX_KEYS", "500")
+	defer os.Unsetenv("GUBLE_DEDUP_MAX_KEYS")
+
+	os.Setenv("GUBLE_SLOW_CONSUMER_LAG", "1000")
+	defer os.Unsetenv("GUBLE_SLOW_CONSUMER_LAG")
+
+	os.Setenv("GUBLE_DISCONNECT_SLOW_CONSUMERS", "true")
+	defer os.Unsetenv("GUBLE_DISCONNECT_SLOW_CONSUMERS")
+
+	os.Setenv("GUBLE_MAX_SUBSCRIBERS_PER_TOPIC", "50000")
+	defer os.Unsetenv("GUBLE_MAX_SUBSCRIBERS_PER_TOPIC")
+
+	os.Setenv("GUBLE_DELIVERY_WORKERS", "8")
+	defer os.Unsetenv("GUBLE_DELIVERY_WORKERS")
+
+	os.Setenv("GUBLE_MAX_TOPICS", "10000")
+	defer os.Unsetenv("GUBLE_MAX_TOPICS")
+
+	os.Setenv("GUBLE_MAX_PAUSED_MESSAGES", "500")
+	defer os.Unsetenv("GUBLE_MAX_PAUSED_MESSAGES")
+
+	os.Setenv("GUBLE_TOPIC_IDLE_TIMEOUT", "10m")
+	defer os.Unsetenv("GUBLE_TOPIC_IDLE_TIMEOUT")
+
+	os.Setenv("GUBLE_TRACE_IDS", "true")
+	defer os.Unsetenv("GUBLE_TRACE_IDS")
+
+	os.Setenv("GUBLE_REPLAY_MAX_RATE", "5000")
+	defer os.Unsetenv("GUBLE_REPLAY_MAX_RATE")
+
+	os.Setenv("GUBLE_REPLAY_MAX_RATE_PER_TOPIC", "500")
+	defer os.Unsetenv("GUBLE_REPLAY_MAX_RATE_PER_TOPIC")
+
+	os.Setenv("GUBLE_ACL", "true")
+	defer os.Unsetenv("GUBLE_ACL")
+
+	os.Setenv("GUBLE_ACL_OWNER", "admin")
+	defer os.Unsetenv("GUBLE_ACL_OWNER")
+
+	os.Setenv("GUBLE_AUTH_JWKS_URL", "https://idp.example.com/jwks.json")
+	defer os.Unsetenv("GUBLE_AUTH_JWKS_URL")
+
+	os.Setenv("GUBLE_AUTH_USER_CLAIM", "email")
+	defer os.Unsetenv("GUBLE_AUTH_USER_CLAIM")
+
+	os.Setenv("GUBLE_ADMIN_USER", "root")
+	defer os.Unsetenv("GUBLE_ADMIN_USER")
+
+	os.Setenv("GUBLE_CONNECTOR_EVENTS", "true")
+	defer os.Unsetenv("GUBLE_CONNECTOR_EVENTS")
+
+	os.Setenv("GUBLE_CONNECTOR_EVENTS_TOPIC", "/ops/events")
+	defer os.Unsetenv("GUBLE_CONNECTOR_EVENTS_TOPIC")
+
 	os.Setenv("GUBLE_FCM", "true")
 	defer os.Unsetenv("GUBLE_FCM")
 
 	os.Setenv("GUBLE_FCM_API_KEY", "fcm-api-key")
 	defer os.Unsetenv("GUBLE_FCM_API_KEY")
 
+	os.Setenv("GUBLE_FCM_KEY_STRATEGY", "token")
+	defer os.Unsetenv("GUBLE_FCM_KEY_STRATEGY")
+
 	os.Setenv("GUBLE_FCM_WORKERS", "3")
 	defer os.Unsetenv("GUBLE_FCM_WORKERS")
 
+	os.Setenv("GUBLE_FCM_QUEUE_SIZE", "100")
+	defer os.Unsetenv("GUBLE_FCM_QUEUE_SIZE")
+
+	os.Setenv("GUBLE_FCM_OVERFLOW_POLICY", "drop-oldest")
+	defer os.Unsetenv("GUBLE_FCM_OVERFLOW_POLICY")
+
+	os.Setenv("GUBLE_FCM_MAX_RATE", "500")
+	defer os.Unsetenv("GUBLE_FCM_MAX_RATE")
+
+	os.Setenv("GUBLE_FCM_WARMUP_DURATION", "2m")
+	defer os.Unsetenv("GUBLE_FCM_WARMUP_DURATION")
+
+	os.Setenv("GUBLE_FCM_WARMUP_CURVE", "exponential")
+	defer os.Unsetenv("GUBLE_FCM_WARMUP_CURVE")
+
+	os.Setenv("GUBLE_FCM_DEADLETTER_TOPIC", "/fcm/deadletter")
+	defer os.Unsetenv("GUBLE_FCM_DEADLETTER_TOPIC")
+
+	os.Setenv("GUBLE_FCM_RECEIPTS_TOPIC", "/fcm/receipts")
+	defer os.Unsetenv("GUBLE_FCM_RECEIPTS_TOPIC")
+
+	os.Setenv("GUBLE_FCM_DRY_RUN", "true")
+	defer os.Unsetenv("GUBLE_FCM_DRY_RUN")
+
+	os.Setenv("GUBLE_FCM_BREAKER_ERRORS", "20")
+	defer os.Unsetenv("GUBLE_FCM_BREAKER_ERRORS")
+
+	os.Setenv("GUBLE_FCM_BREAKER_ERROR_RATE", "0.5")
+	defer os.Unsetenv("GUBLE_FCM_BREAKER_ERROR_RATE")
+
+	os.Setenv("GUBLE_FCM_BREAKER_WINDOW", "1m")
+	defer os.Unsetenv("GUBLE_FCM_BREAKER_WINDOW")
+
+	os.Setenv("GUBLE_FCM_BREAKER_COOLDOWN", "2m")
+	defer os.Unsetenv("GUBLE_FCM_BREAKER_COOLDOWN")
+
+	os.Setenv("GUBLE_FCM_BREAKER_POLICY", "drop")
+	defer os.Unsetenv("GUBLE_FCM_BREAKER_POLICY")
+
+	os.Setenv("GUBLE_FCM_RETRY_BUDGET", "10")
+	defer os.Unsetenv("GUBLE_FCM_RETRY_BUDGET")
+
+	os.Setenv("GUBLE_WEBHOOK_ENABLED", "true")
+	defer os.Unsetenv("GUBLE_WEBHOOK_ENABLED")
+
+	os.Setenv("GUBLE_WEBHOOK_SECRET", "webhook-secret")
+	defer os.Unsetenv("GUBLE_WEBHOOK_SECRET")
+
+	os.Setenv("GUBLE_WEBHOOK_RETRIES", "5")
+	defer os.Unsetenv("GUBLE_WEBHOOK_RETRIES")
+
+	os.Setenv("GUBLE_WEBHOOK_TIMEOUT", "2s")
+	defer os.Unsetenv("GUBLE_WEBHOOK_TIMEOUT")
+
 	os.Setenv("GUBLE_APNS", "true")
 	defer os.Unsetenv("GUBLE_APNS")
 
@@ -63,15 +305,42 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_APNS_CERT_PASSWORD", "rotten")
 	defer os.Unsetenv("GUBLE_APNS_CERT_PASSWORD")
 
+	os.Setenv("GUBLE_APNS_KEY_FILE", "key.p8")
+	defer os.Unsetenv("GUBLE_APNS_KEY_FILE")
+
+	os.Setenv("GUBLE_APNS_KEY_ID", "KEYID12345")
+	defer os.Unsetenv("GUBLE_APNS_KEY_ID")
+
+	os.Setenv("GUBLE_APNS_TEAM_ID", "TEAMID1234")
+	defer os.Unsetenv("GUBLE_APNS_TEAM_ID")
+
 	os.Setenv("GUBLE_APNS_APP_TOPIC", "com.myapp")
 	defer os.Unsetenv("GUBLE_APNS_APP_TOPIC")
 
+	os.Setenv("GUBLE_APNS_QUEUE_SIZE", "50")
+	defer os.Unsetenv("GUBLE_APNS_QUEUE_SIZE")
+
+	os.Setenv("GUBLE_APNS_OVERFLOW_POLICY", "drop-newest")
+	defer os.Unsetenv("GUBLE_APNS_OVERFLOW_POLICY")
+
+	os.Setenv("GUBLE_APNS_DRY_RUN", "true")
+	defer os.Unsetenv("GUBLE_APNS_DRY_RUN")
+
 	os.Setenv("GUBLE_NODE_ID", "1")
 	defer os.Unsetenv("GUBLE_NODE_ID")
 
 	os.Setenv("GUBLE_NODE_PORT", "10000")
 	defer os.Unsetenv("GUBLE_NODE_PORT")
 
+	os.Setenv("GUBLE_NODE_HOST", "127.0.0.1")
+	defer os.Unsetenv("GUBLE_NODE_HOST")
+
+	os.Setenv("GUBLE_NODE_ADVERTISE", "10.0.0.1:10000")
+	defer os.Unsetenv("GUBLE_NODE_ADVERTISE")
+
+	os.Setenv("GUBLE_CLUSTER_CONFIG", "cluster.yml")
+	defer os.Unsetenv("GUBLE_CLUSTER_CONFIG")
+
 	os.Setenv("GUBLE_PG_HOST", "pg-host")
 	defer os.Unsetenv("GUBLE_PG_HOST")
 
@@ -87,6 +356,15 @@ func TestParsingOfEnvironmentVariables(t *testing.T) {
 	os.Setenv("GUBLE_PG_DBNAME", "pg-dbname")
 	defer os.Unsetenv("GUBLE_PG_DBNAME")
 
+	os.Setenv("GUBLE_KV_DSN", "postgres://pg-host/pg-dbname")
+	defer os.Unsetenv("GUBLE_KV_DSN")
+
+	os.Setenv("GUBLE_PG_MAX_OPEN_CONNS", "20")
+	defer os.Unsetenv("GUBLE_PG_MAX_OPEN_CONNS")
+
+	os.Setenv("GUBLE_PG_MAX_IDLE_CONNS", "5")
+	defer os.Unsetenv("GUBLE_PG_MAX_IDLE_CONNS")
+
 	os.Setenv("GUBLE_NODE_REMOTES", "127.0.0.1:8080 127.0.0.1:20002")
 	defer os.Unsetenv("GUBLE_NODE_REMOTES")
 
@@ -107,33 +385,129 @@ func TestParsingArgs(t *testing.T) {
 	// given: a command line
 	os.Args = []string{os.Args[0],
 		"--http", "http_listen",
+		"--http-read-timeout", "5s",
+		"--http-write-timeout", "10s",
+		"--http-idle-timeout", "1m",
+		"--no-http2",
+		"--restart-timeout", "1m",
+		"--tls-cert", "cert.pem",
+		"--tls-key", "key.pem",
+		"--tls-min-version", "1.3",
+		"--tls-ciphers", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"--tls-client-ca", "ca.pem",
+		"--cors-allow-origins", "https://app.example.com,https://admin.example.com",
+		"--cors-allow-methods", "GET,POST",
+		"--cors-allow-credentials",
+		"--access-log",
+		"--access-log-exclude", "/health,/api/tap",
+		"--ws-compress-threshold", "1024",
+		"--ws-ping-interval", "1m",
+		"--ws-pong-timeout", "5s",
+		"--ws-session-expiry", "1h",
+		"--ws-high-water-mark", "1000",
+		"--ws-low-water-mark", "100",
+		"--sms-batch-window", "2s",
+		"--sms-batch-key", "recipient",
+		"--max-message-size", "1MB",
 		"--env", "dev",
 		"--log", "debug",
+		"--log-format", "json",
+		"--log-output", "stdout",
 		"--profile", "mem",
 		"--storage-path", os.TempDir(),
 		"--kvs", "kvs-backend",
 		"--ms", "ms-backend",
+		"--store-memory-size", "500",
+		"--ms-ttl", "/foo=1h /bar=30m",
+		"--ms-indexed-headers", "/foo=Customer,Region",
+		"--ms-compaction-keys", "/devices=Device-Id",
+		"--max-messages-per-topic", "1000",
+		"--store-batch-size", "64",
+		"--store-batch-linger", "2ms",
+		"--store-compress",
+		"--store-migrate",
+		"--store-on-corruption", "fail",
+		"--id-generator", "snowflake",
+		"--store-min-free-bytes", "1073741824",
+		"--store-min-free-percent", "10",
+		"--dedup-window", "5m",
+		"--dedup-max-keys", "500",
+		"--slow-consumer-lag", "1000",
+		"--disconnect-slow-consumers",
+		"--max-subscribers-per-topic", "50000",
+		"--delivery-workers", "8",
+		"--max-topics", "10000",
+		"--max-paused-messages", "500",
+		"--topic-idle-timeout", "10m",
+		"--trace-ids",
+		"--replay-max-rate", "5000",
+		"--replay-max-rate-per-topic", "500",
+		"--acl",
+		"--acl-owner", "admin",
+		"--auth-jwks-url", "https://idp.example.com/jwks.json",
+		"--auth-user-claim", "email",
+		"--admin-user", "root",
+		"--connector-events",
+		"--connector-events-topic", "/ops/events",
+		"--per-user-rate", "2.5",
+		"--per-user-burst", "10",
 		"--health-endpoint", "health_endpoint",
 		"--metrics-endpoint", "metrics_endpoint",
+		"--prometheus-endpoint", "prometheus_endpoint",
 		"--fcm",
 		"--fcm-api-key", "fcm-api-key",
+		"--fcm-key-strategy", "token",
 		"--fcm-workers", "3",
+		"--fcm-queue-size", "100",
+		"--fcm-overflow-policy", "drop-oldest",
+		"--fcm-max-rate", "500",
+		"--fcm-warmup-duration", "2m",
+		"--fcm-warmup-curve", "exponential",
+		"--fcm-deadletter-topic", "/fcm/deadletter",
+		"--fcm-receipts-topic", "/fcm/receipts",
+		"--fcm-dry-run",
+		"--fcm-breaker-errors", "20",
+		"--fcm-breaker-error-rate", "0.5",
+		"--fcm-breaker-window", "1m",
+		"--fcm-breaker-cooldown", "2m",
+		"--fcm-breaker-policy", "drop",
+		"--fcm-retry-budget", "10",
+		"--webhook-enabled",
+		"--webhook-secret", "webhook-secret",
+		"--webhook-retries", "5",
+		"--webhook-timeout", "2s",
 		"--apns",
 		"--apns-production",
 		"--apns-cert-bytes", "00ff",
 		"--apns-cert-password", "rotten",
+		"--apns-key-file", "key.p8",
+		"--apns-key-id", "KEYID12345",
+		"--apns-team-id", "TEAMID1234",
 		"--apns-app-topic", "com.myapp",
+		"--apns-queue-size", "50",
+		"--apns-overflow-policy", "drop-newest",
+		"--apns-dry-run",
 		"--node-id", "1",
 		"--node-port", "10000",
+		"--node-host", "127.0.0.1",
+		"--node-advertise", "10.0.0.1:10000",
+		"--cluster-config", "cluster.yml",
 		"--pg-host", "pg-host",
 		"--pg-port", "5432",
 		"--pg-user", "pg-user",
 		"--pg-password", "pg-password",
 		"--pg-dbname", "pg-dbname",
+		"--kv-dsn", "postgres://pg-host/pg-dbname",
+		"--pg-max-open-conns", "20",
+		"--pg-max-idle-conns", "5",
 		"--remotes", "127.0.0.1:8080 127.0.0.1:20002",
 	}
 
 	// when we parse the arguments from command-line flags
+	defer disableTLS()
+	defer disableCORS()
+	defer disableTracing()
+	defer disableClusterConfig()
 	parseConfig()
 
 	// then the parsed parameters are correctly set
@@ -142,33 +516,127 @@ func TestParsingArgs(t *testing.T) {
 
 func assertArguments(a *assert.Assertions) {
 	a.Equal("http_listen", *Config.HttpListen)
+	a.Equal(5*time.Second, *Config.HttpReadTimeout)
+	a.Equal(10*time.Second, *Config.HttpWriteTimeout)
+	a.Equal(time.Minute, *Config.HttpIdleTimeout)
+	a.False(*Config.HTTP2)
+	a.Equal(time.Minute, *Config.RestartTimeout)
+	a.Equal("cert.pem", *Config.TLS.CertFile)
+	a.Equal("key.pem", *Config.TLS.KeyFile)
+	a.Equal("1.3", *Config.TLS.MinVersion)
+	a.Equal("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", *Config.TLS.CipherSuites)
+	a.Equal("ca.pem", *Config.TLS.ClientCAFile)
+	a.Equal("https://app.example.com,https://admin.example.com", *Config.CORS.AllowOrigins)
+	a.Equal("GET,POST", *Config.CORS.AllowMethods)
+	a.True(*Config.CORS.AllowCredentials)
+	a.True(*Config.AccessLog)
+	a.Equal("/health,/api/tap", *Config.AccessLogExclude)
+	a.Equal(1024, *Config.WSCompressThreshold)
+	a.Equal(time.Minute, *Config.WSPingInterval)
+	a.Equal(5*time.Second, *Config.WSPongTimeout)
+	a.Equal(time.Hour, *Config.WSSessionExpiry)
+	a.Equal(1000, *Config.WSHighWaterMark)
+	a.Equal(100, *Config.WSLowWaterMark)
+	a.Equal(2*time.Second, *Config.SMS.BatchWindow)
+	a.Equal("recipient", *Config.SMS.BatchKey)
+	a.Equal(units.MiB, *Config.MaxMessageSize)
 	a.Equal("kvs-backend", *Config.KVS)
 	a.Equal(os.TempDir(), *Config.StoragePath)
 	a.Equal("ms-backend", *Config.MS)
+	a.Equal(500, *Config.StoreMemorySize)
+	a.Equal(topicTTLs{"/foo": time.Hour, "/bar": 30 * time.Minute}, *Config.MSTTL)
+	a.Equal(topicHeaderKeys{"/foo": {"Customer", "Region"}}, *Config.MSIndexedHeaders)
+	a.Equal(topicCompactionKeys{"/devices": "Device-Id"}, *Config.MSCompactionKeys)
+	a.Equal(1000, *Config.MaxMessagesPerTopic)
+	a.Equal(64, *Config.StoreBatchSize)
+	a.Equal(2*time.Millisecond, *Config.StoreBatchLinger)
+	a.True(*Config.StoreCompress)
+	a.True(*Config.StoreMigrate)
+	a.Equal("fail", *Config.StoreOnCorruption)
+	a.Equal("snowflake", *Config.IDGenerator)
+	a.Equal(uint64(1073741824), *Config.StoreMinFreeBytes)
+	a.Equal(10.0, *Config.StoreMinFreePercent)
+	a.Equal(5*time.Minute, *Config.DedupWindow)
+	a.Equal(500, *Config.DedupMaxKeys)
+	a.Equal(1000, *Config.SlowConsumerLag)
+	a.True(*Config.DisconnectSlow)
+	a.Equal(50000, *Config.MaxSubscribers)
+	a.Equal(8, *Config.DeliveryWorkers)
+	a.Equal(10000, *Config.MaxTopics)
+	a.Equal(500, *Config.MaxPausedMessages)
+	a.Equal(10*time.Minute, *Config.TopicIdleTimeout)
+	a.True(*Config.TraceIDs)
+	a.Equal(5000.0, *Config.ReplayMaxRate)
+	a.Equal(500.0, *Config.ReplayMaxTopicRate)
+	a.True(*Config.ACL)
+	a.Equal("admin", *Config.ACLOwner)
+	a.Equal("https://idp.example.com/jwks.json", *Config.AuthJWKSURL)
+	a.Equal("email", *Config.AuthUserClaim)
+	a.Equal("root", *Config.AdminUser)
+	a.True(*Config.ConnectorEvents)
+	a.Equal("/ops/events", *Config.ConnectorEventsTopic)
+	a.Equal(2.5, *Config.PerUserRate)
+	a.Equal(10, *Config.PerUserBurst)
 	a.Equal("health_endpoint", *Config.HealthEndpoint)
 
 	a.Equal("metrics_endpoint", *Config.MetricsEndpoint)
+	a.Equal("prometheus_endpoint", *Config.PrometheusEndpoint)
 
 	a.Equal(true, *Config.FCM.Enabled)
 	a.Equal("fcm-api-key", *Config.FCM.APIKey)
+	a.Equal("token", *Config.FCM.KeyStrategy)
 	a.Equal(3, *Config.FCM.Workers)
+	a.Equal(100, *Config.FCM.QueueSize)
+	a.Equal("drop-oldest", *Config.FCM.OverflowPolicy)
+	a.Equal(500.0, *Config.FCM.MaxRate)
+	a.Equal(2*time.Minute, *Config.FCM.WarmupDuration)
+	a.Equal("exponential", *Config.FCM.WarmupCurve)
+	a.Equal("/fcm/deadletter", *Config.FCM.DeadLetterTopic)
+	a.Equal("/fcm/receipts", *Config.FCM.ReceiptsTopic)
+	a.True(*Config.FCM.DryRun)
+	a.Equal(20, *Config.FCM.BreakerErrors)
+	a.Equal(0.5, *Config.FCM.BreakerErrorRate)
+	a.Equal(time.Minute, *Config.FCM.BreakerWindow)
+	a.Equal(2*time.Minute, *Config.FCM.BreakerCooldown)
+	a.Equal("drop", *Config.FCM.BreakerPolicy)
+	a.Equal(10.0, *Config.FCM.RetryBudget)
+
+	a.True(*Config.Webhook.Enabled)
+	a.Equal("/webhook/", *Config.Webhook.Prefix)
+	a.Equal("webhook-secret", *Config.Webhook.Secret)
+	a.Equal(5, *Config.Webhook.Retries)
+	a.Equal(2*time.Second, *Config.Webhook.Timeout)
 
 	a.Equal(true, *Config.APNS.Enabled)
 	a.Equal(true, *Config.APNS.Production)
 	a.Equal([]byte{0, 255}, *Config.APNS.CertificateBytes)
 	a.Equal("rotten", *Config.APNS.CertificatePassword)
+	a.Equal("key.p8", *Config.APNS.AuthKeyFileName)
+	a.Equal("KEYID12345", *Config.APNS.AuthKeyID)
+	a.Equal("TEAMID1234", *Config.APNS.TeamID)
 	a.Equal("com.myapp", *Config.APNS.AppTopic)
+	a.Equal(50, *Config.APNS.QueueSize)
+	a.Equal("drop-newest", *Config.APNS.OverflowPolicy)
+	a.True(*Config.APNS.DryRun)
 
 	a.Equal(uint8(1), *Config.Cluster.NodeID)
 	a.Equal(10000, *Config.Cluster.NodePort)
+	a.Equal("127.0.0.1", *Config.Cluster.Host)
+	a.Equal("10.0.0.1:10000", *Config.Cluster.Advertise)
+	a.Equal("cluster.yml", *Config.Cluster.ConfigFile)
 
 	a.Equal("pg-host", *Config.Postgres.Host)
 	a.Equal(5432, *Config.Postgres.Port)
 	a.Equal("pg-user", *Config.Postgres.User)
 	a.Equal("pg-password", *Config.Postgres.Password)
 	a.Equal("pg-dbname", *Config.Postgres.DbName)
+	a.Equal("postgres://pg-host/pg-dbname", *Config.Postgres.DSN)
+	a.Equal(20, *Config.Postgres.MaxOpenConns)
+	a.Equal(5, *Config.Postgres.MaxIdleConns)
 
 	a.Equal("debug", *Config.Log)
+	a.Equal("json", *Config.LogFormat)
+	a.Equal("stdout", *Config.LogOutput)
 	a.Equal("dev", *Config.EnvName)
 	a.Equal("mem", *Config.Profile)
 
@@ -183,3 +651,24 @@ func assertClusterRemotes(a *assert.Assertions) {
 	ipList = append(ipList, ip2)
 	a.Equal(ipList, *Config.Cluster.Remotes)
 }
+
+// disableTLS resets the TLS certificate and the client CA of the config parsed only once by both tests,
+// since the other tests start the service without TLS
+func disableTLS() {
+	*Config.TLS.CertFile, *Config.TLS.KeyFile, *Config.TLS.ClientCAFile = "", "", ""
+}
+
+// disableCORS resets the allowed origins of the config, since the clients of the other tests are not in them
+func disableCORS() {
+	*Config.CORS.AllowOrigins = ""
+}
+
+// disableTracing resets the generation of the trace ids, since the other tests expect the headers of their messages
+func disableTracing() {
+	*Config.TraceIDs = false
+}
+
+// disableClusterConfig resets the cluster configuration file and addresses, which the other tests do not use
+func disableClusterConfig() {
+	*Config.Cluster.ConfigFile, *Config.Cluster.Host, *Config.Cluster.Advertise = "", "", ""
+}
@@ -0,0 +1,100 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+)
+
+const (
+	nameParam = "name"
+	idParam   = "id"
+)
+
+// removedSubscription is the response of a subscription removed through the SubscriptionsAPI
+type removedSubscription struct {
+	Connector string             `json:"connector"`
+	ID        string             `json:"id"`
+	Topic     protocol.Path      `json:"topic"`
+	Params    router.RouteParams `json:"params"`
+}
+
+// SubscriptionsAPI is an administrative endpoint for the subscriptions of the connectors,
+// addressed by the connector name and the subscription key.
+type SubscriptionsAPI struct {
+	prefix     string
+	connectors map[string]Connector
+	mux        *mux.Router
+}
+
+// NewSubscriptionsAPI returns a new SubscriptionsAPI for the given connectors.
+func NewSubscriptionsAPI(prefix string, connectors ...Connector) *SubscriptionsAPI {
+	api := &SubscriptionsAPI{
+		prefix:     prefix,
+		connectors: make(map[string]Connector, len(connectors)),
+	}
+	for _, c := range connectors {
+		api.connectors[c.Name()] = c
+	}
+
+	muxRouter := mux.NewRouter()
+	baseRouter := muxRouter.PathPrefix(prefix).Subrouter()
+	baseRouter.Methods(http.MethodDelete).Path("/{name}/subscriptions/{id}").HandlerFunc(api.Delete)
+	api.mux = muxRouter
+	return api
+}
+
+// GetPrefix returns the prefix.
+// It is a part of the service.endpoint implementation.
+func (api *SubscriptionsAPI) GetPrefix() string {
+	return api.prefix
+}
+
+// ServeHTTP is an http.Handler.
+// It is a part of the service.endpoint implementation.
+func (api *SubscriptionsAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	api.mux.ServeHTTP(w, req)
+}
+
+// Delete force-removes a subscription of a connector, from the KVStore and from the router
+func (api *SubscriptionsAPI) Delete(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	name, id := params[nameParam], params[idParam]
+	logger.WithFields(log.Fields{"connector": name, "id": id}).Info("Force-removing subscription")
+
+	c, ok := api.connectors[name]
+	if !ok {
+		http.Error(w, `{"error":"connector not found"}`, http.StatusNotFound)
+		return
+	}
+	subscriber := c.Manager().Find(id)
+	if subscriber == nil {
+		http.Error(w, `{"error":"subscription not found"}`, http.StatusNotFound)
+		return
+	}
+
+	// removing cancels the subscription loop, which unsubscribes the route from the router
+	if err := c.Manager().Remove(subscriber); err != nil {
+		if err == ErrSubscriberDoesNotExist {
+			http.Error(w, `{"error":"subscription not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	route := subscriber.Route()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&removedSubscription{
+		Connector: name,
+		ID:        subscriber.Key(),
+		Topic:     route.Path,
+		Params:    route.RouteParams,
+	})
+}
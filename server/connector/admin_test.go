@@ -0,0 +1,108 @@
+package connector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionsAPI_DeleteRemovesTheSubscription(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	// given a started connector with a subscription
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "name",
+		Schema:     "schema",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, false, false)
+
+	entriesC := make(chan [2]string)
+	mocks.kvstore.EXPECT().Iterate(gomock.Eq("schema"), gomock.Eq("")).Return(entriesC, nil)
+	close(entriesC)
+
+	key := GenerateKey("/topic1", map[string]string{
+		"device_token": "device1",
+		"user_id":      "user1",
+		"connector":    "name",
+	})
+	mocks.kvstore.EXPECT().Put(gomock.Eq("schema"), gomock.Eq(key), gomock.Any())
+	mocks.router.EXPECT().Subscribe(gomock.Any())
+
+	a.NoError(conn.Start())
+	defer conn.Stop()
+
+	req, err := http.NewRequest(http.MethodPost, "/connector/device1/user1/topic1", strings.NewReader(""))
+	a.NoError(err)
+	conn.ServeHTTP(httptest.NewRecorder(), req)
+	time.Sleep(50 * time.Millisecond)
+
+	// when the subscription is deleted through the api
+	api := NewSubscriptionsAPI("/api/connector/", conn)
+	unsubscribed := make(chan *router.Route, 1)
+	mocks.kvstore.EXPECT().Delete(gomock.Eq("schema"), gomock.Eq(key))
+	mocks.router.EXPECT().Unsubscribe(gomock.Any()).Do(func(r *router.Route) {
+		unsubscribed <- r
+	})
+
+	recorder := httptest.NewRecorder()
+	req, err = http.NewRequest(http.MethodDelete, "/api/connector/name/subscriptions/"+key, nil)
+	a.NoError(err)
+	api.ServeHTTP(recorder, req)
+
+	// then the details of the removed subscription are returned
+	a.Equal(http.StatusOK, recorder.Code)
+	var removed removedSubscription
+	a.NoError(json.NewDecoder(recorder.Body).Decode(&removed))
+	a.Equal("name", removed.Connector)
+	a.Equal(key, removed.ID)
+	a.Equal(protocol.Path("/topic1"), removed.Topic)
+	a.Equal("device1", removed.Params["device_token"])
+
+	// and the route is unsubscribed from the router
+	select {
+	case r := <-unsubscribed:
+		a.Equal(protocol.Path("/topic1"), r.Path)
+	case <-time.After(time.Second):
+		a.Fail("The route was not unsubscribed")
+	}
+	a.Nil(conn.Manager().Find(key))
+}
+
+func TestSubscriptionsAPI_DeleteNotFound(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	manager := NewMockManager(ctrl)
+	conn := NewMockConnector(ctrl)
+	conn.EXPECT().Name().Return("fcm")
+	conn.EXPECT().Manager().Return(manager).AnyTimes()
+	manager.EXPECT().Find("unknown").Return(nil)
+
+	api := NewSubscriptionsAPI("/api/connector/", conn)
+
+	for _, path := range []string{
+		"/api/connector/fcm/subscriptions/unknown",
+		"/api/connector/apns/subscriptions/unknown",
+	} {
+		recorder := httptest.NewRecorder()
+		req, err := http.NewRequest(http.MethodDelete, path, nil)
+		a.NoError(err)
+		api.ServeHTTP(recorder, req)
+		a.Equal(http.StatusNotFound, recorder.Code, path)
+	}
+}
@@ -31,6 +31,13 @@ type Sender interface {
 	Send(Request) (interface{}, error)
 }
 
+// CancelableSender is implemented by a Sender, whose sends can be canceled.
+// The queue cancels the sends in progress, when it is stopped.
+type CancelableSender interface {
+	Sender
+	SendContext(context.Context, Request) (interface{}, error)
+}
+
 type SenderSetter interface {
 	Sender() Sender
 	SetSender(Sender)
@@ -50,6 +57,10 @@ type ResponseHandlerSetter interface {
 	SetResponseHandler(ResponseHandler)
 }
 
+// InvalidSubscriberCallback is called by a push connector, after it removed a subscriber
+// because the push service reported its device token as invalid.
+type InvalidSubscriberCallback func(Subscriber)
+
 type Runner interface {
 	Run(Subscriber)
 }
@@ -57,10 +68,12 @@ type Runner interface {
 type Connector interface {
 	service.Startable
 	service.Stopable
+	service.Drainer
 	service.Endpoint
 	SenderSetter
 	ResponseHandlerSetter
 	Runner
+	Name() string
 	Manager() Manager
 	Context() context.Context
 }
@@ -93,6 +106,27 @@ type Config struct {
 	Prefix     string
 	URLPattern string
 	Workers    int
+
+	// QueueSize is the number of requests buffered for the workers
+	QueueSize int
+
+	// OverflowPolicy applies when the queue is full. Without a policy, a push blocks,
+	// but the routes of the subscriptions are closed (and restarted) when they are not read in time.
+	// With OverflowBlock, the routes are blocking instead, so that the router is slowed down.
+	OverflowPolicy OverflowPolicy
+
+	// Rate is the maximum number of requests per second sent by the workers. Zero disables the limit.
+	Rate float64
+
+	// Warmup is the duration after the start, during which the rate is ramped up to Rate along the WarmupCurve,
+	// e.g. so that the replay of a backlog after a restart does not exceed the rate limits of the push service.
+	Warmup time.Duration
+
+	// WarmupCurve is the ramp of the rate during the warm-up (default: WarmupLinear)
+	WarmupCurve WarmupCurve
+
+	// Events receives the delivery events of the connector (optional)
+	Events *Events
 }
 
 func NewConnector(router router.Router, sender Sender, config Config) (Connector, error) {
@@ -104,12 +138,31 @@ func NewConnector(router router.Router, sender Sender, config Config) (Connector
 	if config.Workers <= 0 {
 		config.Workers = DefaultWorkers
 	}
+	if config.OverflowPolicy != "" && !config.OverflowPolicy.IsValid() {
+		return nil, fmt.Errorf("Unknown overflow policy: %q", config.OverflowPolicy)
+	}
+	if config.WarmupCurve != "" && !config.WarmupCurve.IsValid() {
+		return nil, fmt.Errorf("Unknown warm-up curve: %q", config.WarmupCurve)
+	}
+	if config.Warmup > 0 && config.Rate <= 0 {
+		return nil, fmt.Errorf("The warm-up of %v requires a max rate", config.Warmup)
+	}
 
+	queue := NewBufferedQueue(sender, config.Workers, QueueConfig{
+		Name:           config.Name,
+		Size:           config.QueueSize,
+		OverflowPolicy: config.OverflowPolicy,
+		PartitionKey:   partitionKeyFunc(router),
+		Rate:           config.Rate,
+		Warmup:         config.Warmup,
+		WarmupCurve:    config.WarmupCurve,
+		Events:         config.Events,
+	})
 	c := &connector{
 		config:  config,
 		sender:  sender,
-		manager: NewManager(config.Schema, kvs),
-		queue:   NewQueue(sender, config.Workers),
+		manager: newManager(config.Schema, kvs, queue),
+		queue:   queue,
 		router:  router,
 		logger:  logger.WithField("name", config.Name),
 	}
@@ -117,6 +170,14 @@ func NewConnector(router router.Router, sender Sender, config Config) (Connector
 	return c, nil
 }
 
+// partitionKeyFunc returns the partition keys of the router, if it supports the ordered delivery by partition key
+func partitionKeyFunc(r router.Router) func(*protocol.Message) string {
+	if p, ok := r.(router.Partitioner); ok {
+		return p.PartitionKey
+	}
+	return nil
+}
+
 func (c *connector) initMuxRouter() {
 	muxRouter := mux.NewRouter()
 
@@ -186,6 +247,7 @@ func (c *connector) Post(w http.ResponseWriter, req *http.Request) {
 	}
 	delete(params, TopicParam)
 	params[ConnectorParam] = c.config.Name
+	setGroup(params, req)
 	c.logger.WithField("params", params).WithField("topic", topic).Info("Creating subscription")
 	subscriber, err := c.manager.Create(protocol.Path("/"+topic), params)
 	if err != nil {
@@ -212,6 +274,7 @@ func (c *connector) Delete(w http.ResponseWriter, req *http.Request) {
 	}
 	delete(params, TopicParam)
 	params[ConnectorParam] = c.config.Name
+	setGroup(params, req)
 	c.logger.WithField("params", params).WithField("topic", topic).Info("Finding subscription to delete it")
 	subscriber := c.manager.Find(GenerateKey("/"+topic, params))
 	if subscriber == nil {
@@ -227,6 +290,13 @@ func (c *connector) Delete(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, `{"unsubscribed":"/%v"}`, topic)
 }
 
+// setGroup sets the consumer group of the `group` query parameter, if given, as a route param of the subscription
+func setGroup(params map[string]string, req *http.Request) {
+	if group := req.URL.Query().Get(router.GroupParam); group != "" {
+		params[router.GroupParam] = group
+	}
+}
+
 func (c *connector) Substitute(w http.ResponseWriter, req *http.Request) {
 	s := new(substitution)
 	err := json.NewDecoder(req.Body).Decode(&s)
@@ -283,9 +353,12 @@ func (c *connector) Run(s Subscriber) {
 	c.wg.Add(1)
 	defer c.wg.Done()
 
+	route := s.Route()
+	route.Blocking = c.config.OverflowPolicy == OverflowBlock
+
 	var provideErr error
 	go func() {
-		err := s.Route().Provide(c.router, true)
+		err := route.Provide(c.router, true)
 		if err != nil {
 			// cancel subscription loop if there is an error on the provider
 			provideErr = err
@@ -294,6 +367,10 @@ func (c *connector) Run(s Subscriber) {
 	}()
 
 	err := s.Loop(c.ctx, c.queue)
+	if route.Blocking {
+		// the router can be blocked delivering to the route, which is not read anymore
+		route.Close()
+	}
 	if err != nil && provideErr == nil {
 		c.logger.WithField("error", err.Error()).Error("Error returned by subscriber loop")
 		// if context cancelled loop then unsubscribe the route from router
@@ -337,7 +414,21 @@ func (c *connector) restart(s Subscriber) error {
 	return nil
 }
 
-// Stop the connector (the context, the queue, the subscription loops)
+// Drain stops the subscription loops, so that no new messages are queued,
+// and waits for the queue to finish the messages in progress, at most for the given timeout.
+func (c *connector) Drain(timeout time.Duration) error {
+	c.logger.Info("Draining connector")
+	c.cancel()
+	if pending, err := c.manager.Drain(timeout); err != nil {
+		c.logger.WithError(err).WithField("pending", pending).Error("Error draining connector")
+		return err
+	}
+	c.logger.Info("Drained connector")
+	return nil
+}
+
+// Stop the connector (the context, the queue, the subscription loops).
+// The sends still in progress, e.g. after the timeout of a Drain, are canceled.
 func (c *connector) Stop() error {
 	c.logger.Info("Stopping connector")
 	c.cancel()
@@ -347,6 +438,11 @@ func (c *connector) Stop() error {
 	return nil
 }
 
+// Name returns the name of the connector, as given in its config
+func (c *connector) Name() string {
+	return c.config.Name
+}
+
 func (c *connector) Manager() Manager {
 	return c.manager
 }
@@ -69,6 +69,44 @@ func TestConnector_PostSubscription(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+func TestConnector_PostSubscriptionWithGroup(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	recorder := httptest.NewRecorder()
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "test",
+		Schema:     "test",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, true, false)
+
+	mocks.manager.EXPECT().Load().Return(nil)
+	mocks.manager.EXPECT().List().Return(make([]Subscriber, 0))
+	a.NoError(conn.Start())
+	defer conn.Stop()
+
+	// when posting a subscription with a group, then the group is a route param of the subscription
+	subscriber := NewMockSubscriber(testutil.MockCtrl)
+	mocks.manager.EXPECT().Create(gomock.Eq(protocol.Path("/topic1")), gomock.Eq(router.RouteParams{
+		"device_token": "device1",
+		"user_id":      "user1",
+		"connector":    "test",
+		"group":        "workers",
+	})).Return(subscriber, nil)
+	subscriber.EXPECT().Loop(gomock.Any(), gomock.Any())
+	r := router.NewRoute(router.RouteConfig{Path: protocol.Path("topic1")})
+	subscriber.EXPECT().Route().Return(r)
+	mocks.router.EXPECT().Subscribe(gomock.Eq(r)).Return(r, nil)
+
+	req, err := http.NewRequest(http.MethodPost, "/connector/device1/user1/topic1?group=workers", strings.NewReader(""))
+	a.NoError(err)
+	conn.ServeHTTP(recorder, req)
+	a.Equal(`{"subscribed":"/topic1"}`, recorder.Body.String())
+	time.Sleep(100 * time.Millisecond)
+}
+
 func TestConnector_PostSubscriptionNoMocks(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -84,7 +122,7 @@ func TestConnector_PostSubscriptionNoMocks(t *testing.T) {
 	}, false, false)
 
 	entriesC := make(chan [2]string)
-	mocks.kvstore.EXPECT().Iterate(gomock.Eq("schema"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Iterate(gomock.Eq("schema"), gomock.Eq("")).Return(entriesC, nil)
 	close(entriesC)
 
 	mocks.kvstore.EXPECT().Put(gomock.Eq("schema"), gomock.Eq(GenerateKey("/topic1", map[string]string{
@@ -203,7 +241,7 @@ func TestConnector_StartWithSubscriptions(t *testing.T) {
 	}, false, false)
 
 	entriesC := make(chan [2]string)
-	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC, nil)
 	close(entriesC)
 	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
 
@@ -250,7 +288,7 @@ func TestConnector_Substitute(t *testing.T) {
 	}, false, false)
 
 	entriesC := make(chan [2]string)
-	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC, nil)
 	close(entriesC)
 	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
 
@@ -295,7 +333,7 @@ func TestConnector_SubstituteWrongPostBody(t *testing.T) {
 	}, false, false)
 
 	entriesC := make(chan [2]string)
-	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC)
+	mocks.kvstore.EXPECT().Iterate(gomock.Eq("test"), gomock.Eq("")).Return(entriesC, nil)
 	close(entriesC)
 	mocks.kvstore.EXPECT().Put(gomock.Any(), gomock.Any(), gomock.Any()).Times(4)
 
@@ -363,6 +401,52 @@ func TestConnector_StartAndStopWithoutSubscribers(t *testing.T) {
 	a.NoError(err)
 }
 
+func TestConnector_DrainStopsTheSubscriptionsAndDrainsTheQueue(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	conn, mocks := getTestConnector(t, Config{
+		Name:       "test",
+		Schema:     "test",
+		Prefix:     "/connector/",
+		URLPattern: "/{device_token}/{user_id}/{topic:.*}",
+	}, true, true)
+	mocks.manager.EXPECT().Load().Return(nil)
+	mocks.manager.EXPECT().List().Return(nil)
+	mocks.queue.EXPECT().Start().Return(nil)
+	a.NoError(conn.Start())
+
+	// when draining, the error of the manager with the number of pending requests is returned
+	drainErr := &DrainTimeoutError{Pending: 3}
+	mocks.manager.EXPECT().Drain(time.Second).Return(3, drainErr)
+	a.Equal(drainErr, conn.Drain(time.Second))
+
+	// and the subscription loops are cancelled
+	a.Error(conn.Context().Err())
+
+	mocks.queue.EXPECT().Stop().Return(nil)
+	a.NoError(conn.Stop())
+}
+
+func TestConnector_NewRejectsInvalidWarmups(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().KVStore().Return(NewMockKVStore(testutil.MockCtrl), nil).AnyTimes()
+
+	_, err := NewConnector(mRouter, nil, Config{Name: "test", Rate: 10, Warmup: time.Minute, WarmupCurve: "cubic"})
+	a.Error(err)
+
+	_, err = NewConnector(mRouter, nil, Config{Name: "test", Warmup: time.Minute})
+	a.Error(err, "a warm-up requires a rate")
+
+	_, err = NewConnector(mRouter, nil, Config{Name: "test", Rate: 10, Warmup: time.Minute, WarmupCurve: WarmupExponential})
+	a.NoError(err)
+}
+
 func getTestConnector(t *testing.T, config Config, mockManager bool, mockQueue bool) (Connector, *connectorMocks) {
 	a := assert.New(t)
 
@@ -0,0 +1,231 @@
+package connector
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+)
+
+// EventType is a stage of the delivery of a message by a connector
+type EventType string
+
+const (
+	// EventQueued is published when a request is pushed to the queue of a connector
+	EventQueued EventType = "queued"
+
+	// EventSent is published when a worker starts sending a request
+	EventSent EventType = "sent"
+
+	// EventSucceeded is published when a request was sent and its response handled without error
+	EventSucceeded EventType = "succeeded"
+
+	// EventFailed is published when sending a request or handling its response failed, or the request was dropped
+	EventFailed EventType = "failed"
+
+	// EventRetried is published by a RetryingSender, each time it retries a request
+	EventRetried EventType = "retried"
+
+	// DefaultEventsTopic is the topic, to which the delivery events are published by default
+	DefaultEventsTopic = "/connectors/events"
+
+	// eventsBufferSize is the number of events buffered for the publishing; further events are dropped
+	eventsBufferSize = 1000
+)
+
+// RetryingSender is implemented by a Sender, which retries the failed requests by itself.
+// The queue of a connector with delivery events sets the handler, to which each retry is reported.
+type RetryingSender interface {
+	Sender
+	SetRetryHandler(func(Request, error))
+}
+
+// Event is a delivery event of a request by a connector
+type Event struct {
+	Type      EventType
+	Connector string
+	Request   Request
+	Error     error
+	Time      time.Time
+}
+
+// Message returns the event as a message of the topic.
+// The metadata of the event is in the header: the type of the event, the name of the connector,
+// the id and path of the delivered message, the route params of the subscriber (e.g. the device token),
+// the time of the event and the error, if any. The trace id of the delivered message is kept. The body is empty.
+func (e *Event) Message(topic protocol.Path) (*protocol.Message, error) {
+	header := make(map[string]string)
+	for key, value := range e.Request.Subscriber().Route().RouteParams {
+		header[key] = value
+	}
+	message := e.Request.Message()
+	header["event"] = string(e.Type)
+	header["connector"] = e.Connector
+	header["message_id"] = strconv.FormatUint(message.ID, 10)
+	header["path"] = string(message.Path)
+	header["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	if traceID := message.TraceID(); traceID != "" {
+		header[protocol.TraceIDHeader] = traceID
+	}
+	if e.Error != nil {
+		header["error"] = e.Error.Error()
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Message{
+		Path:       topic,
+		HeaderJSON: string(headerJSON),
+		Body:       []byte{},
+	}, nil
+}
+
+// Events is the bus of the delivery events of the connectors, which publishes them to a topic of the router.
+// Further handlers of the events can be subscribed inside the server.
+// The events are opt-in: the connectors without Events (i.e. a nil *Events) do not create them.
+// It is a module, publishing the events in the background after its start.
+type Events struct {
+	router router.Router
+	topic  protocol.Path
+
+	mutex    sync.RWMutex
+	handlers []func(*Event)
+
+	// the events published before the start are buffered
+	eventC chan *Event
+	stopC  chan struct{}
+	doneC  chan struct{}
+}
+
+// NewEvents returns the Events publishing to the topic of the router (not started)
+func NewEvents(r router.Router, topic protocol.Path) *Events {
+	return &Events{
+		router: r,
+		topic:  topic,
+		eventC: make(chan *Event, eventsBufferSize),
+	}
+}
+
+// Topic returns the topic of the events
+func (e *Events) Topic() protocol.Path {
+	return e.topic
+}
+
+// Subscribe adds a handler, which is called with each event from the publishing goroutine.
+// The handler must not block.
+func (e *Events) Subscribe(handler func(*Event)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.handlers = append(e.handlers, handler)
+}
+
+// Publish buffers the event for publishing, without blocking the connector.
+// If the buffer is full, the event is dropped.
+// It does nothing on nil Events.
+func (e *Events) Publish(event *Event) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.eventC <- event:
+	default:
+		logger.WithFields(log.Fields{
+			"event":     event.Type,
+			"connector": event.Connector,
+		}).Warn("Dropped delivery event, because the buffer is full")
+	}
+}
+
+// publish creates an event of the current time and publishes it
+func (e *Events) publish(connector string, t EventType, request Request, err error) {
+	if e == nil {
+		return
+	}
+	e.Publish(&Event{
+		Type:      t,
+		Connector: connector,
+		Request:   request,
+		Error:     err,
+		Time:      time.Now(),
+	})
+}
+
+// IsEvent returns true for a message of the topic of the events (or one of its subtopics),
+// which is not delivered by the connectors, so that the events are not fed back into them.
+// It returns false on nil Events.
+func (e *Events) IsEvent(m *protocol.Message) bool {
+	if e == nil {
+		return false
+	}
+	return m.Path == e.topic || strings.HasPrefix(string(m.Path), string(e.topic)+"/")
+}
+
+// Start publishing the events
+func (e *Events) Start() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.stopC = make(chan struct{})
+	e.doneC = make(chan struct{})
+	go e.loop(e.stopC, e.doneC)
+	return nil
+}
+
+// Stop publishing the events, after the buffered ones
+func (e *Events) Stop() error {
+	e.mutex.Lock()
+	stopC, doneC := e.stopC, e.doneC
+	e.stopC = nil
+	e.mutex.Unlock()
+
+	if stopC == nil {
+		return nil
+	}
+	close(stopC)
+	<-doneC
+	return nil
+}
+
+func (e *Events) loop(stopC, doneC chan struct{}) {
+	defer close(doneC)
+	for {
+		select {
+		case event := <-e.eventC:
+			e.handle(event)
+		case <-stopC:
+			for {
+				select {
+				case event := <-e.eventC:
+					e.handle(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *Events) handle(event *Event) {
+	message, err := event.Message(e.topic)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding the delivery event")
+		return
+	}
+	if err := e.router.HandleMessage(message); err != nil {
+		logger.WithError(err).WithField("topic", e.topic).Error("Error publishing the delivery event")
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, handler := range e.handlers {
+		handler(event)
+	}
+}
@@ -0,0 +1,164 @@
+package connector
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// retryingSender retries each request once, before it succeeds
+type retryingSender struct {
+	onRetry func(Request, error)
+}
+
+func (s *retryingSender) SetRetryHandler(handler func(Request, error)) {
+	s.onRetry = handler
+}
+
+func (s *retryingSender) Send(request Request) (interface{}, error) {
+	s.onRetry(request, errors.New("unavailable"))
+	return nil, nil
+}
+
+func startedEvents(a *assert.Assertions) (*Events, <-chan *Event) {
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().HandleMessage(gomock.Any()).Return(nil).AnyTimes()
+	events := NewEvents(mRouter, DefaultEventsTopic)
+	eventC := make(chan *Event, 20)
+	events.Subscribe(func(e *Event) { eventC <- e })
+	a.NoError(events.Start())
+	return events, eventC
+}
+
+// receiveEvents returns the types of the next n events, by message id
+func receiveEvents(a *assert.Assertions, eventC <-chan *Event, n int) map[uint64][]EventType {
+	types := make(map[uint64][]EventType)
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-eventC:
+			id := e.Request.Message().ID
+			types[id] = append(types[id], e.Type)
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return types
+		}
+	}
+	return types
+}
+
+func aRequest(id uint64, path string) Request {
+	s := NewSubscriber("/foo", router.RouteParams{"device_token": "abc", "user_id": "user1"}, 0)
+	return NewRequest(s, &protocol.Message{ID: id, Path: protocol.Path(path)})
+}
+
+func TestQueue_PublishesTheDeliveryEvents(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	events, eventC := startedEvents(a)
+	defer events.Stop()
+
+	// given a queue with events, sending a message successfully and failing the next one
+	mSender := NewMockSender(testutil.MockCtrl)
+	first := mSender.EXPECT().Send(gomock.Any()).Return(nil, nil)
+	mSender.EXPECT().Send(gomock.Any()).Return(nil, errors.New("send failed")).After(first)
+	q := NewBufferedQueue(mSender, 1, QueueConfig{Name: "test", Size: 10, Events: events})
+	a.NoError(q.Start())
+
+	// when the messages are pushed
+	a.NoError(q.Push(aRequest(1, "/foo")))
+	a.NoError(q.Push(aRequest(2, "/foo")))
+	a.NoError(q.Stop())
+
+	// then each stage of their delivery is published
+	types := receiveEvents(a, eventC, 6)
+	a.Equal([]EventType{EventQueued, EventSent, EventSucceeded}, types[1])
+	a.Equal([]EventType{EventQueued, EventSent, EventFailed}, types[2])
+}
+
+func TestQueue_PublishesTheRetriesOfTheSender(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	events, eventC := startedEvents(a)
+	defer events.Stop()
+
+	// given a queue with events, and a sender retrying once
+	q := NewBufferedQueue(&retryingSender{}, 1, QueueConfig{Name: "test", Events: events})
+	a.NoError(q.Start())
+
+	// when a message is sent, then the retry is published
+	a.NoError(q.Push(aRequest(1, "/foo")))
+	a.NoError(q.Stop())
+	types := receiveEvents(a, eventC, 4)
+	a.Equal([]EventType{EventQueued, EventSent, EventRetried, EventSucceeded}, types[1])
+}
+
+func TestQueue_SkipsTheMessagesOfTheEventsTopic(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+	events, eventC := startedEvents(a)
+	defer events.Stop()
+
+	// given a queue with events
+	mSender := NewMockSender(testutil.MockCtrl)
+	q := NewBufferedQueue(mSender, 1, QueueConfig{Name: "test", Events: events})
+	a.NoError(q.Start())
+
+	// when the events are pushed to it, then they are neither sent, nor create new events
+	a.NoError(q.Push(aRequest(1, DefaultEventsTopic)))
+	a.NoError(q.Push(aRequest(2, DefaultEventsTopic+"/fcm")))
+	a.NoError(q.Stop())
+	select {
+	case e := <-eventC:
+		a.Fail("unexpected event", e.Type)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// and the other topics starting with its name are not skipped
+	a.False(events.IsEvent(&protocol.Message{Path: DefaultEventsTopic + "-other"}))
+}
+
+func TestEvent_Message(t *testing.T) {
+	a := assert.New(t)
+
+	e := &Event{
+		Type:      EventFailed,
+		Connector: "fcm",
+		Request:   aRequest(42, "/foo/bar"),
+		Error:     errors.New("NotRegistered"),
+		Time:      time.Date(2017, 1, 2, 15, 4, 5, 0, time.UTC),
+	}
+	m, err := e.Message(DefaultEventsTopic)
+	a.NoError(err)
+	a.Equal(protocol.Path(DefaultEventsTopic), m.Path)
+
+	var header map[string]string
+	a.NoError(json.Unmarshal([]byte(m.HeaderJSON), &header))
+	a.Equal(map[string]string{
+		"event":        "failed",
+		"connector":    "fcm",
+		"message_id":   "42",
+		"path":         "/foo/bar",
+		"device_token": "abc",
+		"user_id":      "user1",
+		"time":         "2017-01-02T15:04:05Z",
+		"error":        "NotRegistered",
+	}, header)
+}
+
+func TestEvents_NilIsDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	var events *Events
+	events.Publish(&Event{Type: EventQueued})
+	a.False(events.IsEvent(&protocol.Message{Path: DefaultEventsTopic}))
+}
@@ -2,6 +2,7 @@ package connector
 
 import (
 	"sync"
+	"time"
 
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/kvstore"
@@ -18,6 +19,10 @@ type Manager interface {
 	Add(Subscriber) error
 	Update(Subscriber) error
 	Remove(Subscriber) error
+
+	// Drain cancels the subscribers, so that no new requests are queued, and waits for the queue
+	// to finish the pending requests, at most for the timeout. It returns the number of requests still pending.
+	Drain(timeout time.Duration) (int, error)
 }
 
 type manager struct {
@@ -25,19 +30,30 @@ type manager struct {
 	schema      string
 	kvstore     kvstore.KVStore
 	subscribers map[string]Subscriber
+
+	// queue receives the requests of the subscribers, nil if the manager has no queue to drain
+	queue Queue
 }
 
 func NewManager(schema string, kvstore kvstore.KVStore) Manager {
+	return newManager(schema, kvstore, nil)
+}
+
+func newManager(schema string, kvstore kvstore.KVStore, queue Queue) Manager {
 	return &manager{
 		schema:      schema,
 		kvstore:     kvstore,
 		subscribers: make(map[string]Subscriber, 0),
+		queue:       queue,
 	}
 }
 
 func (m *manager) Load() error {
 	// try to load s from kvstore
-	entries := m.kvstore.Iterate(m.schema, "")
+	entries, err := m.kvstore.Iterate(m.schema, "")
+	if err != nil {
+		return err
+	}
 	for e := range entries {
 		subscriber, err := NewSubscriberFromJSON([]byte(e[1]))
 		if err != nil {
@@ -194,3 +210,19 @@ func (m *manager) removeStore(s Subscriber) error {
 	logger.WithField("subscriber", s).Info("RemoveStore")
 	return m.kvstore.Delete(m.schema, s.Key())
 }
+
+func (m *manager) Drain(timeout time.Duration) (int, error) {
+	for _, s := range m.List() {
+		s.Cancel()
+	}
+	if m.queue == nil {
+		return 0, nil
+	}
+	if err := m.queue.Drain(timeout); err != nil {
+		if timeoutErr, ok := err.(*DrainTimeoutError); ok {
+			return timeoutErr.Pending, err
+		}
+		return 0, err
+	}
+	return 0, nil
+}
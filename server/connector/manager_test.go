@@ -1 +1,46 @@
 package connector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManager_DrainReturnsThePendingRequests(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a manager with a subscriber, and a queue busy with a request
+	sendingC := make(chan bool)
+	releaseC := make(chan bool)
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		sendingC <- true
+		<-releaseC
+	}).Return(nil, nil)
+	q := NewQueue(mSender, 1)
+	a.NoError(q.Start())
+	m := newManager("test", kvstore.NewMemoryKVStore(), q)
+	_, err := m.Create("/topic", router.RouteParams{"device_token": "token"})
+	a.NoError(err)
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+	<-sendingC
+
+	// when draining, then the request still in progress after the timeout is reported
+	pending, err := m.Drain(10 * time.Millisecond)
+	a.IsType(&DrainTimeoutError{}, err)
+	a.Equal(1, pending)
+
+	// and after the request is finished, nothing is pending
+	close(releaseC)
+	pending, err = m.Drain(time.Second)
+	a.NoError(err)
+	a.Equal(0, pending)
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/smancke/guble/server/router"
 	"net/http"
+	"time"
 )
 
 // Mock of Connector interface
@@ -43,6 +44,16 @@ func (_mr *_MockConnectorRecorder) Context() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Context")
 }
 
+func (_m *MockConnector) Drain(_param0 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "Drain", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockConnectorRecorder) Drain(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Drain", arg0)
+}
+
 func (_m *MockConnector) GetPrefix() string {
 	ret := _m.ctrl.Call(_m, "GetPrefix")
 	ret0, _ := ret[0].(string)
@@ -63,6 +74,16 @@ func (_mr *_MockConnectorRecorder) Manager() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Manager")
 }
 
+func (_m *MockConnector) Name() string {
+	ret := _m.ctrl.Call(_m, "Name")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+func (_mr *_MockConnectorRecorder) Name() *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Name")
+}
+
 func (_m *MockConnector) ResponseHandler() ResponseHandler {
 	ret := _m.ctrl.Call(_m, "ResponseHandler")
 	ret0, _ := ret[0].(ResponseHandler)
@@ -290,6 +311,17 @@ func (_mr *_MockManagerRecorder) Load() *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Load")
 }
 
+func (_m *MockManager) Drain(_param0 time.Duration) (int, error) {
+	ret := _m.ctrl.Call(_m, "Drain", _param0)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockManagerRecorder) Drain(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Drain", arg0)
+}
+
 func (_m *MockManager) Remove(_param0 Subscriber) error {
 	ret := _m.ctrl.Call(_m, "Remove", _param0)
 	ret0, _ := ret[0].(error)
@@ -331,6 +363,16 @@ func (_m *MockQueue) EXPECT() *_MockQueueRecorder {
 	return _m.recorder
 }
 
+func (_m *MockQueue) Drain(_param0 time.Duration) error {
+	ret := _m.ctrl.Call(_m, "Drain", _param0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+func (_mr *_MockQueueRecorder) Drain(arg0 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Drain", arg0)
+}
+
 func (_m *MockQueue) Push(_param0 Request) error {
 	ret := _m.ctrl.Call(_m, "Push", _param0)
 	ret0, _ := ret[0].(error)
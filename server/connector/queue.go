@@ -1,13 +1,91 @@
 package connector
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
 
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/metrics"
+)
+
+var (
+	// ErrQueueStopped is returned by Push, when the queue is drained or stopped.
+	ErrQueueStopped = errors.New("Queue is stopped. No more requests are accepted.")
+
+	// ErrQueueFull is returned by Push, when the request was dropped because the queue is full.
+	ErrQueueFull = errors.New("Queue is full. The request was dropped.")
+
+	// ErrMessageExpired is the error of the delivery event of a request, which was dropped because its message expired.
+	ErrMessageExpired = errors.New("Message expired. The request was dropped.")
 )
 
+// OverflowPolicy decides what happens to a request pushed to a full queue
+type OverflowPolicy string
+
+const (
+	// OverflowBlock blocks the push until a worker takes a request,
+	// which slows down the subscriptions and, through them, the router
+	OverflowBlock OverflowPolicy = "block"
+
+	// OverflowDropOldest drops the oldest buffered request, to make room for the pushed one
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+
+	// OverflowDropNewest drops the pushed request
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+)
+
+// IsValid returns true for a known policy
+func (p OverflowPolicy) IsValid() bool {
+	return p == OverflowBlock || p == OverflowDropOldest || p == OverflowDropNewest
+}
+
+// QueueConfig configures the buffering of the requests of a Queue
+type QueueConfig struct {
+	// Name labels the metric of the dropped requests, usually with the name of the connector
+	Name string
+
+	// Size is the number of requests buffered for the workers
+	Size int
+
+	// OverflowPolicy applies to the requests pushed while the buffer is full (default: OverflowBlock)
+	OverflowPolicy OverflowPolicy
+
+	// PartitionKey returns the partition key of a message, or an empty string if it has none (optional).
+	// The requests of the same key are handled by the same worker, in the order they were pushed.
+	PartitionKey func(m *protocol.Message) string
+
+	// Rate is the maximum number of requests per second handled by all workers together. Zero disables the limit.
+	Rate float64
+
+	// Warmup is the duration after the start, during which the rate is ramped up from a low rate to Rate.
+	// While warming up, a push to a full queue blocks regardless of the OverflowPolicy, so no request is dropped.
+	Warmup time.Duration
+
+	// WarmupCurve is the ramp of the rate during the warm-up (default: WarmupLinear)
+	WarmupCurve WarmupCurve
+
+	// Events receives the delivery events of the requests, labeled with the Name (optional).
+	// The messages of its topic are not delivered.
+	Events *Events
+}
+
+// DrainTimeoutError is returned by Drain, when the queue still had pending requests after the timeout.
+type DrainTimeoutError struct {
+	Pending int
+}
+
+func (e *DrainTimeoutError) Error() string {
+	return fmt.Sprintf("Queue drain timed out with %d pending requests", e.Pending)
+}
+
 // Queue is an interface modeling a task-queue (it is started and more Requests can be pushed to it, and finally it is stopped after all requests are handled).
 type Queue interface {
 	ResponseHandlerSetter
@@ -15,6 +93,7 @@ type Queue interface {
 
 	Start() error
 	Push(request Request) error
+	Drain(timeout time.Duration) error
 	Stop() error
 }
 
@@ -24,19 +103,76 @@ type queue struct {
 	requestsC       chan Request
 	nWorkers        int
 	metrics         bool
-	wg              sync.WaitGroup
+	config          QueueConfig
+
+	// highC passes the requests of messages with high priority, which are handled before the others
+	highC chan Request
+
+	// partitionC buffers the requests with a partition key, one channel for each worker
+	partitionC []chan Request
+
+	// limiter paces the workers, nil if the rate is not limited
+	limiter *rateLimiter
+
+	// stopC is closed when the queue stops accepting requests
+	stopC    chan struct{}
+	stopOnce sync.Once
+	workers  sync.WaitGroup
+
+	// ctx is canceled when the queue is stopped, canceling the sends in progress of a CancelableSender
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// pending is the number of pushed requests, which are not handled yet
+	pending int64
 }
 
-// NewQueue returns a new Queue (not started).
+// NewQueue returns a new Queue (not started), handing the requests over to the workers without buffering.
 func NewQueue(sender Sender, nWorkers int) Queue {
+	return NewBufferedQueue(sender, nWorkers, QueueConfig{})
+}
+
+// NewBufferedQueue returns a new Queue (not started), buffering the requests as configured.
+// The requests of messages with high priority are not buffered, and never dropped.
+func NewBufferedQueue(sender Sender, nWorkers int, config QueueConfig) Queue {
 	q := &queue{
-		sender:   sender,
-		nWorkers: nWorkers,
-		metrics:  true,
+		sender:    sender,
+		nWorkers:  nWorkers,
+		metrics:   true,
+		config:    config,
+		requestsC: make(chan Request, config.Size),
+		highC:     make(chan Request),
+		stopC:     make(chan struct{}),
 	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.partitionC = q.newPartitionChannels()
+	q.limiter = newRateLimiter(config.Rate, config.Warmup, config.WarmupCurve)
+	q.setRetryHandler()
 	return q
 }
 
+// setRetryHandler reports the retries of a RetryingSender as delivery events, if the queue has events
+func (q *queue) setRetryHandler() {
+	if s, ok := q.sender.(RetryingSender); ok && q.config.Events != nil {
+		s.SetRetryHandler(func(request Request, err error) {
+			q.config.Events.publish(q.config.Name, EventRetried, request, err)
+		})
+	}
+}
+
+// newPartitionChannels returns the channels of the workers for the requests with a partition key,
+// or nil if the queue is not partitioned
+func (q *queue) newPartitionChannels() []chan Request {
+	if q.config.PartitionKey == nil {
+		return nil
+	}
+	channels := make([]chan Request, q.nWorkers)
+	for i := range channels {
+		channels[i] = make(chan Request, q.config.Size)
+	}
+	return channels
+}
+
 func (q *queue) SetResponseHandler(rh ResponseHandler) {
 	q.responseHandler = rh
 }
@@ -51,33 +187,87 @@ func (q *queue) Sender() Sender {
 
 func (q *queue) SetSender(s Sender) {
 	q.sender = s
+	q.setRetryHandler()
 }
 
 // Start a fixed number of goroutines to handle requests and responses w.r.t. external push-notification services.
 func (q *queue) Start() error {
-	q.requestsC = make(chan Request)
+	q.requestsC = make(chan Request, q.config.Size)
+	q.highC = make(chan Request)
+	q.partitionC = q.newPartitionChannels()
+	q.limiter = newRateLimiter(q.config.Rate, q.config.Warmup, q.config.WarmupCurve)
+	q.stopC = make(chan struct{})
+	q.stopOnce = sync.Once{}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
 	for i := 1; i <= q.nWorkers; i++ {
+		q.workers.Add(1)
 		go q.worker(i)
 	}
 	return nil
 }
 
 func (q *queue) worker(i int) {
+	defer q.workers.Done()
+
 	logger.WithField("worker", i).Info("starting queue worker")
-	for request := range q.requestsC {
+	var partitionC chan Request
+	if q.partitionC != nil {
+		partitionC = q.partitionC[i-1]
+	}
+	for {
+		request, ok := q.next(partitionC)
+		if !ok {
+			logger.WithField("worker", i).Info("stopping queue worker")
+			return
+		}
+		if q.limiter != nil {
+			q.limiter.wait()
+		}
 		q.handle(request)
+		atomic.AddInt64(&q.pending, -1)
 	}
 }
 
-func (q *queue) handle(request Request) {
-	q.wg.Add(1)
-	defer q.wg.Done()
+// next returns the next request to handle, preferring the requests with high priority,
+// or false if the queue was stopped.
+// The partitionC of the worker is nil, if the queue is not partitioned.
+func (q *queue) next(partitionC chan Request) (Request, bool) {
+	select {
+	case request := <-q.highC:
+		return request, true
+	default:
+	}
+	select {
+	case request := <-q.highC:
+		return request, true
+	case request := <-q.requestsC:
+		return request, true
+	case request := <-partitionC:
+		return request, true
+	case <-q.stopC:
+		// the buffered requests are still handled
+		select {
+		case request := <-q.requestsC:
+			return request, true
+		case request := <-partitionC:
+			return request, true
+		default:
+			return nil, false
+		}
+	}
+}
 
+func (q *queue) handle(request Request) {
+	if request.Message().IsExpired(time.Now()) {
+		q.expire(request)
+		return
+	}
+	q.config.Events.publish(q.config.Name, EventSent, request, nil)
 	var beforeSend time.Time
 	if q.metrics {
 		beforeSend = time.Now()
 	}
-	response, err := q.sender.Send(request)
+	response, err := q.send(request)
 	if q.responseHandler != nil {
 		var metadata *Metadata
 		if q.metrics {
@@ -89,6 +279,7 @@ func (q *queue) handle(request Request) {
 				"error":      err.Error(),
 				"subscriber": request.Subscriber(),
 				"message":    request.Message(),
+				"traceID":    request.Message().TraceID(),
 			}).Error("error handling connector response")
 		}
 	} else if err == nil {
@@ -96,27 +287,159 @@ func (q *queue) handle(request Request) {
 	} else {
 		logger.WithField("error", err.Error()).Error("error while sending, and no response handler was set")
 	}
+
+	if err != nil {
+		q.config.Events.publish(q.config.Name, EventFailed, request, err)
+	} else {
+		q.config.Events.publish(q.config.Name, EventSucceeded, request, nil)
+	}
 }
 
+// send sends the request, canceling it when the queue is stopped, if the sender is a CancelableSender
+func (q *queue) send(request Request) (interface{}, error) {
+	if s, ok := q.sender.(CancelableSender); ok {
+		return s.SendContext(q.ctx, request)
+	}
+	return q.sender.Send(request)
+}
+
+// Push hands the request over to a worker, or returns ErrQueueStopped if the queue does not accept requests anymore.
+// The requests of messages with high priority are handed over before the waiting requests with normal priority.
+// The requests with a partition key are handed over to the worker of the key, regardless of their priority,
+// so that they are handled in order.
+// If the queue is full, the overflow policy applies: Push blocks, or a request is dropped.
+// During the warm-up of a rate limited queue, Push blocks.
+// The messages of the topic of the delivery events are skipped.
 func (q *queue) Push(request Request) error {
-	// recover if the channel been closed
-	defer func() {
-		if r := recover(); r != nil {
-			switch x := r.(type) {
-			case error:
-				logger.WithError(x).Error("recovered from error")
-			default:
-				panic(r)
+	select {
+	case <-q.stopC:
+		return ErrQueueStopped
+	default:
+	}
+	if q.config.Events.IsEvent(request.Message()) {
+		logger.WithField("path", request.Message().Path).Debug("Skipped the delivery event")
+		return nil
+	}
+
+	requestsC := q.requestsC
+	if partitionC := q.partitionChannel(request.Message()); partitionC != nil {
+		requestsC = partitionC
+	} else if priority, _ := request.Message().Priority(); priority == protocol.PriorityHigh {
+		requestsC = q.highC
+	}
+
+	atomic.AddInt64(&q.pending, 1)
+	q.config.Events.publish(q.config.Name, EventQueued, request, nil)
+	if requestsC != q.highC && (q.config.OverflowPolicy == OverflowDropOldest || q.config.OverflowPolicy == OverflowDropNewest) &&
+		(q.limiter == nil || !q.limiter.warmingUp()) {
+		return q.pushOrDrop(requestsC, request)
+	}
+	select {
+	case requestsC <- request:
+		return nil
+	case <-q.stopC:
+		atomic.AddInt64(&q.pending, -1)
+		q.config.Events.publish(q.config.Name, EventFailed, request, ErrQueueStopped)
+		return ErrQueueStopped
+	}
+}
+
+// partitionChannel returns the channel of the worker for the partition key of the message,
+// or nil if the message has no partition key
+func (q *queue) partitionChannel(m *protocol.Message) chan Request {
+	if q.partitionC == nil {
+		return nil
+	}
+	key := q.config.PartitionKey(m)
+	if key == "" {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return q.partitionC[h.Sum32()%uint32(len(q.partitionC))]
+}
+
+// pushOrDrop buffers the request without blocking, dropping the oldest or the pushed request if the queue is full
+func (q *queue) pushOrDrop(requestsC chan Request, request Request) error {
+	for {
+		select {
+		case requestsC <- request:
+			return nil
+		default:
+		}
+		if q.config.OverflowPolicy == OverflowDropNewest {
+			q.drop(request)
+			return ErrQueueFull
+		}
+		select {
+		case oldest := <-requestsC:
+			q.drop(oldest)
+		default:
+			// without a buffer, there is no older request to drop
+			if q.config.Size == 0 {
+				q.drop(request)
+				return ErrQueueFull
 			}
 		}
+	}
+}
+
+func (q *queue) drop(request Request) {
+	atomic.AddInt64(&q.pending, -1)
+	q.config.Events.publish(q.config.Name, EventFailed, request, ErrQueueFull)
+	metrics.PromConnectorDroppedRequests.WithLabelValues(q.config.Name).Inc()
+	logger.WithFields(log.Fields{
+		"queue":   q.config.Name,
+		"policy":  q.config.OverflowPolicy,
+		"message": request.Message().ID,
+		"traceID": request.Message().TraceID(),
+	}).Warn("Dropped request, because the queue is full")
+}
+
+// expire drops the request of an expired message, instead of sending it
+func (q *queue) expire(request Request) {
+	q.config.Events.publish(q.config.Name, EventFailed, request, ErrMessageExpired)
+	metrics.PromConnectorExpiredRequests.WithLabelValues(q.config.Name).Inc()
+	logger.WithFields(log.Fields{
+		"queue":   q.config.Name,
+		"message": request.Message().ID,
+		"traceID": request.Message().TraceID(),
+	}).Info("Dropped request, because the message expired")
+}
+
+// Drain stops accepting new requests and waits until the workers have finished the requests in progress.
+// If this does not happen in the given timeout, a *DrainTimeoutError with the number of pending requests is returned.
+func (q *queue) Drain(timeout time.Duration) error {
+	q.stopAccepting()
+
+	doneC := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(doneC)
 	}()
 
-	q.requestsC <- request
-	return nil
+	select {
+	case <-doneC:
+		return nil
+	case <-time.After(timeout):
+		pending := int(atomic.LoadInt64(&q.pending))
+		logger.WithField("pending", pending).Warn("queue drain timed out")
+		return &DrainTimeoutError{Pending: pending}
+	}
 }
 
+// Stop stops accepting new requests and cancels the sends of a CancelableSender, so that the requests in progress
+// and the buffered ones fail with the canceled context, and waits until the workers have finished them.
+// It is usually called after Drain, to cancel the requests still pending after its timeout.
 func (q *queue) Stop() error {
-	close(q.requestsC)
-	q.wg.Wait()
+	q.stopAccepting()
+	q.cancel()
+	q.workers.Wait()
 	return nil
 }
+
+func (q *queue) stopAccepting() {
+	q.stopOnce.Do(func() {
+		close(q.stopC)
+	})
+}
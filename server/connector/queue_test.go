@@ -0,0 +1,383 @@
+package connector
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_DrainWaitsForRequestsInProgress(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a started queue, with a request in progress
+	sendingC := make(chan bool)
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		sendingC <- true
+		time.Sleep(20 * time.Millisecond)
+	}).Return(nil, nil)
+
+	q := NewQueue(mSender, 1)
+	a.NoError(q.Start())
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+	<-sendingC
+
+	// when draining, then the request in progress is finished
+	a.NoError(q.Drain(time.Second))
+
+	// and no more requests are accepted
+	a.Equal(ErrQueueStopped, q.Push(NewRequest(nil, &protocol.Message{ID: 2})))
+
+	// and the queue can still be stopped
+	a.NoError(q.Stop())
+}
+
+func TestQueue_DrainTimeoutReturnsThePendingRequests(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a started queue, with a request in progress which takes longer than the drain timeout
+	sendingC := make(chan bool)
+	releaseC := make(chan bool)
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		sendingC <- true
+		<-releaseC
+	}).Return(nil, nil)
+
+	q := NewQueue(mSender, 1)
+	a.NoError(q.Start())
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+	<-sendingC
+
+	// when draining
+	err := q.Drain(10 * time.Millisecond)
+
+	// then the pending request is reported
+	if a.IsType(&DrainTimeoutError{}, err) {
+		a.Equal(1, err.(*DrainTimeoutError).Pending)
+	}
+
+	// and the worker exits, after finishing the request
+	close(releaseC)
+	a.NoError(q.Drain(time.Second))
+}
+
+// cancelableSender blocks the sends until they are canceled
+type cancelableSender struct {
+	sendingC chan bool
+}
+
+func (s *cancelableSender) Send(r Request) (interface{}, error) {
+	return s.SendContext(context.Background(), r)
+}
+
+func (s *cancelableSender) SendContext(ctx context.Context, r Request) (interface{}, error) {
+	s.sendingC <- true
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueue_StopCancelsTheSendsInProgress(t *testing.T) {
+	a := assert.New(t)
+
+	// given a started queue, with a send in progress and a buffered request, which are still pending after a drain
+	s := &cancelableSender{sendingC: make(chan bool, 2)}
+	q := NewBufferedQueue(s, 1, QueueConfig{Size: 1})
+	a.NoError(q.Start())
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+	<-s.sendingC
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 2})))
+	a.IsType(&DrainTimeoutError{}, q.Drain(10*time.Millisecond))
+
+	// when stopping, then the send in progress and the buffered one are canceled
+	stoppedC := make(chan error)
+	go func() {
+		stoppedC <- q.Stop()
+	}()
+	select {
+	case err := <-stoppedC:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.Fail("the stop waits for the send in progress")
+	}
+	a.Len(s.sendingC, 1)
+}
+
+func TestQueue_BlockedPushIsReleasedWhenStopping(t *testing.T) {
+	a := assert.New(t)
+
+	// given a queue without running workers
+	q := NewQueue(nil, 1)
+
+	pushErrC := make(chan error)
+	go func() {
+		pushErrC <- q.Push(NewRequest(nil, &protocol.Message{ID: 1}))
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	// when stopping the queue, the blocked push returns an error instead of panicking
+	a.NoError(q.Stop())
+	select {
+	case err := <-pushErrC:
+		a.Equal(ErrQueueStopped, err)
+	case <-time.After(time.Second):
+		a.Fail("push still blocked")
+	}
+
+	// and stopping again is possible
+	a.NoError(q.Stop())
+}
+
+func TestQueue_HighPriorityRequestsAreHandledFirst(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a started queue with a single worker, busy with a request
+	sendingC := make(chan bool)
+	releaseC := make(chan bool)
+	sentC := make(chan uint64, 3)
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		if r.Message().ID == 1 {
+			sendingC <- true
+			<-releaseC
+		}
+		sentC <- r.Message().ID
+	}).Return(nil, nil).Times(3)
+
+	q := NewQueue(mSender, 1)
+	a.NoError(q.Start())
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+	<-sendingC
+
+	// when a normal and then a high priority request are waiting
+	go q.Push(NewRequest(nil, &protocol.Message{ID: 2}))
+	time.Sleep(5 * time.Millisecond)
+	go q.Push(NewRequest(nil, &protocol.Message{ID: 3, HeaderJSON: `{"priority":"high"}`}))
+	time.Sleep(5 * time.Millisecond)
+	close(releaseC)
+
+	// then the high priority request is handled before the normal one
+	var sent []uint64
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-sentC:
+			sent = append(sent, id)
+		case <-time.After(time.Second):
+			a.Fail("request not handled")
+		}
+	}
+	a.Equal([]uint64{1, 3, 2}, sent)
+	a.NoError(q.Stop())
+}
+
+func TestQueue_OverflowPolicies(t *testing.T) {
+	testCases := []struct {
+		policy  OverflowPolicy
+		pushErr error
+		sent    []uint64
+	}{
+		{OverflowBlock, nil, []uint64{1, 2, 3, 4}},
+		{OverflowDropOldest, nil, []uint64{1, 3, 4}},
+		{OverflowDropNewest, ErrQueueFull, []uint64{1, 2, 3}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			_, finish := testutil.NewMockCtrl(t)
+			defer finish()
+			a := assert.New(t)
+
+			// given a started queue with a single worker, busy with a request
+			sendingC := make(chan bool)
+			releaseC := make(chan bool)
+			sentC := make(chan uint64, 4)
+			mSender := NewMockSender(testutil.MockCtrl)
+			mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+				if r.Message().ID == 1 {
+					sendingC <- true
+					<-releaseC
+				}
+				sentC <- r.Message().ID
+			}).Return(nil, nil).Times(len(tc.sent))
+
+			q := NewBufferedQueue(mSender, 1, QueueConfig{Name: "test", Size: 2, OverflowPolicy: tc.policy})
+			a.NoError(q.Start())
+			a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1})))
+			<-sendingC
+
+			// and a full buffer
+			a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 2})))
+			a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 3})))
+
+			// when pushing another request
+			pushErrC := make(chan error, 1)
+			go func() {
+				pushErrC <- q.Push(NewRequest(nil, &protocol.Message{ID: 4}))
+			}()
+
+			// then the push only blocks with the block policy
+			select {
+			case err := <-pushErrC:
+				a.NotEqual(OverflowBlock, tc.policy, "push did not block")
+				a.Equal(tc.pushErr, err)
+			case <-time.After(20 * time.Millisecond):
+				a.Equal(OverflowBlock, tc.policy, "push blocked")
+			}
+			close(releaseC)
+			if tc.policy == OverflowBlock {
+				a.NoError(<-pushErrC)
+			}
+
+			// and the requests not dropped are handled in order
+			var sent []uint64
+			for range tc.sent {
+				select {
+				case id := <-sentC:
+					sent = append(sent, id)
+				case <-time.After(time.Second):
+					a.Fail("request not handled")
+				}
+			}
+			a.Equal(tc.sent, sent)
+			a.NoError(q.Stop())
+		})
+	}
+}
+
+func TestQueue_PartitionKeysAreHandledInOrder(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a started queue with many workers, partitioned by the header
+	var mutex sync.Mutex
+	inProgress := make(map[string]bool)
+	sent := make(map[string][]uint64)
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		key := r.Message().PartitionKey()
+		mutex.Lock()
+		a.False(key != "" && inProgress[key], "requests of the same key sent in parallel")
+		inProgress[key] = true
+		sent[key] = append(sent[key], r.Message().ID)
+		mutex.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mutex.Lock()
+		inProgress[key] = false
+		mutex.Unlock()
+	}).Return(nil, nil).Times(60)
+
+	q := NewBufferedQueue(mSender, 4, QueueConfig{
+		Size: 10,
+		PartitionKey: func(m *protocol.Message) string {
+			return m.PartitionKey()
+		},
+	})
+	a.NoError(q.Start())
+
+	// when pushing the requests of three keys, some of them with high priority
+	for id := uint64(1); id <= 60; id++ {
+		header := fmt.Sprintf(`{"Partition-Key":"user%d"}`, id%3)
+		if id%5 == 0 {
+			header = fmt.Sprintf(`{"Partition-Key":"user%d","priority":"high"}`, id%3)
+		}
+		a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: id, HeaderJSON: header})))
+	}
+	a.NoError(q.Drain(time.Second))
+
+	// then the requests of each key are sent in the order they were pushed
+	for key, ids := range sent {
+		a.Len(ids, 20, key)
+		for i := 1; i < len(ids); i++ {
+			a.True(ids[i-1] < ids[i], key)
+		}
+	}
+}
+
+func TestQueue_WarmupRampsTheRateWithoutDropping(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a started queue of 100 requests per second, warming up for 400ms, which drops the newest requests when full
+	const count = 15
+	var mutex sync.Mutex
+	var sent []time.Time
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		mutex.Lock()
+		sent = append(sent, time.Now())
+		mutex.Unlock()
+	}).Return(nil, nil).Times(count)
+
+	q := NewBufferedQueue(mSender, 4, QueueConfig{
+		Name:           "test",
+		Size:           1,
+		OverflowPolicy: OverflowDropNewest,
+		Rate:           100,
+		Warmup:         400 * time.Millisecond,
+	})
+	a.NoError(q.Start())
+	start := time.Now()
+	limiter := q.(*queue).limiter
+
+	// when pushing a backlog of requests, which is sent during the warm-up
+	for id := uint64(1); id <= count; id++ {
+		a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: id})))
+	}
+	a.NoError(q.Drain(2 * time.Second))
+
+	// then no request is dropped, and the requests sent stay under the ramp schedule
+	a.Equal(count, len(sent))
+	for _, at := range sent {
+		elapsed := at.Sub(start)
+		n := 0
+		for _, other := range sent {
+			if !other.After(at) {
+				n++
+			}
+		}
+		a.True(float64(n) <= allowed(limiter, elapsed)+2, "%d sent after %v, %.1f allowed", n, elapsed, allowed(limiter, elapsed))
+	}
+}
+
+func TestQueue_ExpiredMessagesAreNotSent(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a queue, with a sender expecting only the messages which did not expire
+	var sent []uint64
+	mSender := NewMockSender(testutil.MockCtrl)
+	mSender.EXPECT().Send(gomock.Any()).Do(func(r Request) {
+		sent = append(sent, r.Message().ID)
+	}).Return(nil, nil).Times(2)
+
+	q := NewQueue(mSender, 1)
+	a.NoError(q.Start())
+
+	// when pushing a message without expiry, an expired one and one expiring later
+	now := time.Now().Unix()
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 1, Time: now})))
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 2, Time: now - 120, HeaderJSON: `{"Expires":"1m"}`})))
+	a.NoError(q.Push(NewRequest(nil, &protocol.Message{ID: 3, Time: now, HeaderJSON: `{"Expires":"1h"}`})))
+	a.NoError(q.Stop())
+
+	// then the expired message is dropped
+	a.Equal([]uint64{1, 3}, sent)
+}
@@ -0,0 +1,110 @@
+package connector
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// WarmupCurve is the shape of the ramp of the send rate, during the warm-up of a queue after its start
+type WarmupCurve string
+
+const (
+	// WarmupLinear increases the send rate by the same amount each second
+	WarmupLinear WarmupCurve = "linear"
+
+	// WarmupExponential multiplies the send rate by the same factor each second,
+	// so it stays low for a longer time and reaches the max rate at the end of the warm-up
+	WarmupExponential WarmupCurve = "exponential"
+
+	// warmupStartRatio is the ratio of the max rate, at which a warm-up starts
+	warmupStartRatio = 0.05
+
+	// warmupMinRate is the minimum send rate per second during a warm-up, so that the first requests are not delayed too long
+	warmupMinRate = 1.0
+)
+
+// IsValid returns true for a known curve
+func (c WarmupCurve) IsValid() bool {
+	return c == WarmupLinear || c == WarmupExponential
+}
+
+// rateLimiter paces the requests of the workers of a queue to a maximum rate per second,
+// which is ramped up from a low rate during the warm-up after the start
+type rateLimiter struct {
+	maxRate float64
+	warmup  time.Duration
+	curve   WarmupCurve
+
+	mutex   sync.Mutex
+	startAt time.Time
+	next    time.Time
+
+	// now returns the current time; it is replaced in the tests
+	now func() time.Time
+}
+
+// newRateLimiter returns a rateLimiter of maxRate requests per second, or nil if the rate is not limited
+func newRateLimiter(maxRate float64, warmup time.Duration, curve WarmupCurve) *rateLimiter {
+	if maxRate <= 0 {
+		return nil
+	}
+	if curve == "" {
+		curve = WarmupLinear
+	}
+	l := &rateLimiter{maxRate: maxRate, warmup: warmup, curve: curve, now: time.Now}
+	l.start()
+	return l
+}
+
+// start begins the warm-up
+func (l *rateLimiter) start() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.startAt = l.now()
+	l.next = l.startAt
+}
+
+// rate returns the allowed requests per second at the time t
+func (l *rateLimiter) rate(t time.Time) float64 {
+	elapsed := t.Sub(l.startAt)
+	if l.warmup <= 0 || elapsed >= l.warmup {
+		return l.maxRate
+	}
+	startRate := math.Min(l.maxRate, math.Max(l.maxRate*warmupStartRatio, warmupMinRate))
+	progress := math.Max(0, float64(elapsed)/float64(l.warmup))
+	if l.curve == WarmupExponential {
+		return startRate * math.Pow(l.maxRate/startRate, progress)
+	}
+	return startRate + (l.maxRate-startRate)*progress
+}
+
+// warmingUp returns true during the warm-up
+func (l *rateLimiter) warmingUp() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.now().Sub(l.startAt) < l.warmup
+}
+
+// reserve returns the time, at which the next request may be sent
+func (l *rateLimiter) reserve() time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = at.Add(time.Duration(float64(time.Second) / l.rate(at)))
+	return at
+}
+
+// wait blocks until the next request may be sent
+func (l *rateLimiter) wait() {
+	if d := l.reserve().Sub(l.now()); d > 0 {
+		time.Sleep(d)
+	}
+}
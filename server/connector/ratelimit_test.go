@@ -0,0 +1,80 @@
+package connector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// scheduled returns the send times of n requests, each sent as soon as the limiter allows it
+func scheduled(l *rateLimiter, now *time.Time, n int) []time.Duration {
+	times := make([]time.Duration, n)
+	for i := range times {
+		*now = l.reserve()
+		times[i] = now.Sub(l.startAt)
+	}
+	return times
+}
+
+// allowed returns the number of requests allowed by the ramp of the limiter until the elapsed time
+func allowed(l *rateLimiter, elapsed time.Duration) float64 {
+	const step = time.Millisecond
+	sum := 0.0
+	for t := time.Duration(0); t < elapsed; t += step {
+		sum += l.rate(l.startAt.Add(t)) * step.Seconds()
+	}
+	return sum
+}
+
+func TestRateLimiter_RampStaysUnderTheSchedule(t *testing.T) {
+	for _, curve := range []WarmupCurve{WarmupLinear, WarmupExponential} {
+		t.Run(string(curve), func(t *testing.T) {
+			a := assert.New(t)
+
+			// given a limiter of 100 requests per second, warming up for 10 seconds
+			now := time.Unix(1500000000, 0)
+			l := newRateLimiter(100, 10*time.Second, curve)
+			l.now = func() time.Time { return now }
+			l.start()
+
+			// then the rate is ramped up from the start rate to the max rate
+			a.Equal(5.0, l.rate(l.startAt))
+			a.True(l.rate(l.startAt.Add(5*time.Second)) < 100)
+			a.Equal(100.0, l.rate(l.startAt.Add(10*time.Second)))
+
+			// when requests are sent as fast as possible
+			times := scheduled(l, &now, 1000)
+
+			// then the requests sent until any time of the warm-up stay under the ramp schedule
+			for elapsed := 100 * time.Millisecond; elapsed <= 10*time.Second; elapsed += 100 * time.Millisecond {
+				sent := 0
+				for _, at := range times {
+					if at <= elapsed {
+						sent++
+					}
+				}
+				a.True(float64(sent) <= allowed(l, elapsed)+1, "%d sent after %v, %.1f allowed", sent, elapsed, allowed(l, elapsed))
+			}
+
+			// and after the warm-up the requests are sent at the max rate
+			last := len(times) - 1
+			a.True(times[last-100] > 10*time.Second)
+			a.InDelta(time.Second, times[last]-times[last-100], float64(time.Millisecond))
+			a.False(l.warmingUp())
+		})
+	}
+}
+
+func TestRateLimiter_ExponentialRampStaysLowerLonger(t *testing.T) {
+	linear := newRateLimiter(100, 10*time.Second, WarmupLinear)
+	exponential := newRateLimiter(100, 10*time.Second, WarmupExponential)
+	exponential.startAt = linear.startAt
+
+	mid := linear.startAt.Add(5 * time.Second)
+	assert.True(t, exponential.rate(mid) < linear.rate(mid))
+}
+
+func TestRateLimiter_WithoutRate(t *testing.T) {
+	assert.Nil(t, newRateLimiter(0, time.Minute, WarmupLinear))
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"sync"
 
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/router"
@@ -56,8 +57,13 @@ func (sd *SubscriberData) newRoute() *router.Route {
 type subscriber struct {
 	data SubscriberData
 
-	key    string
-	route  *router.Route
+	key   string
+	route *router.Route
+
+	// ctx and cancel are the context of the running loop, guarded by the mutex,
+	// as the subscriber is canceled by the manager or the route provider while looping
+	mutex  sync.Mutex
+	ctx    context.Context
 	cancel context.CancelFunc
 }
 
@@ -91,7 +97,7 @@ func (s *subscriber) String() string {
 
 func (s *subscriber) Reset() error {
 	s.route = s.data.newRoute()
-	s.cancel = nil
+	s.setLoop(nil, nil)
 	return nil
 }
 
@@ -113,8 +119,8 @@ func (s *subscriber) Route() *router.Route {
 func (s *subscriber) Loop(ctx context.Context, q Queue) error {
 	var m *protocol.Message
 	sCtx, cancel := context.WithCancel(ctx)
-	s.cancel = cancel
-	defer func() { s.cancel = nil }()
+	s.setLoop(sCtx, cancel)
+	defer s.endLoop(sCtx)
 
 	opened := true
 	for opened {
@@ -144,11 +150,32 @@ func (s *subscriber) SetLastID(ID uint64) {
 }
 
 func (s *subscriber) Cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
 	if s.cancel != nil {
 		s.cancel()
 	}
 }
 
+func (s *subscriber) setLoop(ctx context.Context, cancel context.CancelFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ctx, s.cancel = ctx, cancel
+}
+
+// endLoop releases the context of the loop, unless the subscriber was reset and loops with another one already
+func (s *subscriber) endLoop(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ctx == ctx {
+		s.cancel()
+		s.ctx, s.cancel = nil, nil
+	}
+}
+
 func (s *subscriber) Encode() ([]byte, error) {
 	return json.Marshal(s.data)
 }
@@ -0,0 +1,42 @@
+package connector
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriber_CancelWhileLooping(t *testing.T) {
+	a := assert.New(t)
+
+	// given a subscriber, canceled concurrently, e.g. by the deletion of its subscription and by its route provider
+	s := NewSubscriber("/topic", router.RouteParams{"device_token": "token"}, 0)
+	stopC := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopC:
+					return
+				case <-time.After(time.Millisecond):
+					s.Cancel()
+				}
+			}
+		}()
+	}
+
+	// when it is reset and loops again after each cancel, then each loop is canceled
+	for i := 0; i < 10; i++ {
+		a.NoError(s.Reset())
+		a.Equal(context.Canceled, s.Loop(context.Background(), nil))
+	}
+	close(stopC)
+	wg.Wait()
+}
@@ -0,0 +1,7 @@
+package device
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "device")
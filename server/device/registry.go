@@ -0,0 +1,442 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+)
+
+const (
+	// schema is the default database schema for the device registrations
+	schema = "device_registration"
+
+	userIDKey   = "user_id"
+	deviceIDKey = "device_id"
+	platformKey = "platform"
+	tokenKey    = "token"
+
+	// IOS is the platform of the devices receiving their notifications through APNS
+	IOS = "ios"
+
+	// Android is the platform of the devices receiving their notifications through FCM
+	Android = "android"
+)
+
+// tokenParams maps each platform to the route param, in which its connector expects the device token
+var tokenParams = map[string]string{
+	IOS:     "device_id",
+	Android: "device_token",
+}
+
+var (
+	// ErrUnknownPlatform is returned for a platform, which is not known or has no connector enabled
+	ErrUnknownPlatform = errors.New("Unknown or disabled device platform")
+
+	// ErrRegistrationNotFound is returned for a device, which is not registered
+	ErrRegistrationNotFound = errors.New("Device registration not found")
+)
+
+// Registration is a device of a user, holding the token of each platform registered for it
+// and the topics subscribed by the device.
+type Registration struct {
+	UserID   string            `json:"user_id"`
+	DeviceID string            `json:"device_id"`
+	Tokens   map[string]string `json:"tokens"`
+	Topics   []string          `json:"topics"`
+}
+
+func registrationKey(userID, deviceID string) string {
+	return userID + ":" + deviceID
+}
+
+func (reg *Registration) hasTopic(topic string) bool {
+	for _, t := range reg.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry keeps the device registrations. A subscription of a device is fanned out
+// to the connector of each platform registered for the device.
+type Registry struct {
+	sync.Mutex
+	prefix        string
+	router        router.Router
+	kvstore       kvstore.KVStore
+	connectors    map[string]connector.Connector
+	registrations map[string]*Registration
+	mux           *mux.Router
+}
+
+// NewRegistry returns a new Registry, storing the registrations in the KVStore of the router.
+func NewRegistry(prefix string, router router.Router) *Registry {
+	r := &Registry{
+		prefix:        prefix,
+		router:        router,
+		connectors:    make(map[string]connector.Connector),
+		registrations: make(map[string]*Registration),
+	}
+
+	muxRouter := mux.NewRouter()
+	baseRouter := muxRouter.PathPrefix(prefix).Subrouter()
+	devicePath := fmt.Sprintf("/{%s}/{%s}", userIDKey, deviceIDKey)
+	subscriptionPath := fmt.Sprintf("%s/subscriptions/{%s:.*}", devicePath, connector.TopicParam)
+	baseRouter.Methods(http.MethodPost).Path(subscriptionPath).HandlerFunc(r.Subscribe)
+	baseRouter.Methods(http.MethodDelete).Path(subscriptionPath).HandlerFunc(r.Unsubscribe)
+	baseRouter.Methods(http.MethodPost).Path(fmt.Sprintf("%s/{%s}/{%s}", devicePath, platformKey, tokenKey)).HandlerFunc(r.Register)
+	baseRouter.Methods(http.MethodDelete).Path(fmt.Sprintf("%s/{%s}", devicePath, platformKey)).HandlerFunc(r.Unregister)
+	baseRouter.Methods(http.MethodGet).Path(devicePath).HandlerFunc(r.Get)
+	baseRouter.Methods(http.MethodDelete).Path(devicePath).HandlerFunc(r.Delete)
+	r.mux = muxRouter
+	return r
+}
+
+// SetConnector sets the connector delivering the notifications to the devices of the platform.
+func (r *Registry) SetConnector(platform string, c connector.Connector) error {
+	if _, ok := tokenParams[platform]; !ok {
+		return ErrUnknownPlatform
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.connectors[platform] = c
+	return nil
+}
+
+// Start loads the registrations from the KVStore.
+// The subscriptions of the devices are loaded by the connectors themselves.
+func (r *Registry) Start() error {
+	kvs, err := r.router.KVStore()
+	if err != nil {
+		return err
+	}
+	entries, err := kvs.Iterate(schema, "")
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.kvstore = kvs
+	for e := range entries {
+		reg := &Registration{}
+		if err := json.Unmarshal([]byte(e[1]), reg); err != nil {
+			return err
+		}
+		if reg.Tokens == nil {
+			reg.Tokens = make(map[string]string)
+		}
+		r.registrations[e[0]] = reg
+	}
+	logger.WithField("count", len(r.registrations)).Info("Loaded device registrations")
+	return nil
+}
+
+// GetPrefix returns the prefix.
+// It is a part of the service.endpoint implementation.
+func (r *Registry) GetPrefix() string {
+	return r.prefix
+}
+
+// ServeHTTP is an http.Handler.
+// It is a part of the service.endpoint implementation.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.ServeHTTP(w, req)
+}
+
+// Get returns the registration of a device
+func (r *Registry) Get(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	r.Lock()
+	defer r.Unlock()
+	reg, ok := r.registrations[registrationKey(params[userIDKey], params[deviceIDKey])]
+	if !ok {
+		writeError(w, ErrRegistrationNotFound)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// Register registers the token of a platform for a device, and subscribes it to the topics of the device.
+// A token registered before for the platform is replaced, together with its subscriptions.
+func (r *Registry) Register(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	logger.WithField("params", params).Info("Registering device token")
+	reg, err := r.register(params[userIDKey], params[deviceIDKey], params[platformKey], params[tokenKey])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// Unregister removes the token of a platform from a device, together with its subscriptions
+func (r *Registry) Unregister(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	logger.WithField("params", params).Info("Unregistering device token")
+	reg, err := r.unregister(params[userIDKey], params[deviceIDKey], params[platformKey])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// Delete removes the registration of a device with the subscriptions of all of its platforms
+func (r *Registry) Delete(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	logger.WithField("params", params).Info("Deleting device registration")
+	reg, err := r.remove(params[userIDKey], params[deviceIDKey])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// Subscribe subscribes a device to a topic, on each of its registered platforms
+func (r *Registry) Subscribe(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	logger.WithField("params", params).Info("Subscribing device")
+	reg, err := r.subscribe(params[userIDKey], params[deviceIDKey], "/"+params[connector.TopicParam])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// Unsubscribe unsubscribes a device from a topic, on each of its registered platforms
+func (r *Registry) Unsubscribe(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	logger.WithField("params", params).Info("Unsubscribing device")
+	reg, err := r.unsubscribe(params[userIDKey], params[deviceIDKey], "/"+params[connector.TopicParam])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeRegistration(w, reg)
+}
+
+// RemoveInvalid is a connector.InvalidSubscriberCallback. It removes the token of the platform
+// of the subscriber from the registrations holding it, with its remaining subscriptions.
+// The registration itself and its other platforms are kept.
+func (r *Registry) RemoveInvalid(s connector.Subscriber) {
+	params := s.Route().RouteParams
+	r.Lock()
+	defer r.Unlock()
+
+	for platform, c := range r.connectors {
+		if c.Name() != params[connector.ConnectorParam] {
+			continue
+		}
+		token := params[tokenParams[platform]]
+		for _, reg := range r.registrations {
+			if reg.UserID != params[userIDKey] || reg.Tokens[platform] != token {
+				continue
+			}
+			logger.WithFields(log.Fields{
+				"user_id":   reg.UserID,
+				"device_id": reg.DeviceID,
+				"platform":  platform,
+			}).Info("Removing invalid device token")
+			r.removeSubscriptions(c, subscriptionParams(c, platform, reg.UserID, token))
+			delete(reg.Tokens, platform)
+			if err := r.store(reg); err != nil {
+				logger.WithError(err).Error("Could not store device registration")
+			}
+		}
+	}
+}
+
+func (r *Registry) register(userID, deviceID, platform, token string) (*Registration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	c, ok := r.connectors[platform]
+	if !ok {
+		return nil, ErrUnknownPlatform
+	}
+	key := registrationKey(userID, deviceID)
+	reg, ok := r.registrations[key]
+	if !ok {
+		reg = &Registration{
+			UserID:   userID,
+			DeviceID: deviceID,
+			Tokens:   make(map[string]string),
+			Topics:   []string{},
+		}
+		r.registrations[key] = reg
+	}
+
+	if old, ok := reg.Tokens[platform]; ok && old != token {
+		r.removeSubscriptions(c, subscriptionParams(c, platform, userID, old))
+	}
+	reg.Tokens[platform] = token
+	params := subscriptionParams(c, platform, userID, token)
+	for _, topic := range reg.Topics {
+		if err := createSubscription(c, params, topic); err != nil {
+			return nil, err
+		}
+	}
+	return reg, r.store(reg)
+}
+
+func (r *Registry) unregister(userID, deviceID, platform string) (*Registration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	reg, ok := r.registrations[registrationKey(userID, deviceID)]
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	c, ok := r.connectors[platform]
+	if !ok {
+		return nil, ErrUnknownPlatform
+	}
+	if token, ok := reg.Tokens[platform]; ok {
+		r.removeSubscriptions(c, subscriptionParams(c, platform, userID, token))
+		delete(reg.Tokens, platform)
+	}
+	return reg, r.store(reg)
+}
+
+func (r *Registry) remove(userID, deviceID string) (*Registration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	key := registrationKey(userID, deviceID)
+	reg, ok := r.registrations[key]
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	for platform, token := range reg.Tokens {
+		if c, ok := r.connectors[platform]; ok {
+			r.removeSubscriptions(c, subscriptionParams(c, platform, userID, token))
+		}
+	}
+	if err := r.kvstore.Delete(schema, key); err != nil {
+		return nil, err
+	}
+	delete(r.registrations, key)
+	return reg, nil
+}
+
+func (r *Registry) subscribe(userID, deviceID, topic string) (*Registration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	reg, ok := r.registrations[registrationKey(userID, deviceID)]
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	for platform, token := range reg.Tokens {
+		c, ok := r.connectors[platform]
+		if !ok {
+			continue
+		}
+		if err := createSubscription(c, subscriptionParams(c, platform, userID, token), topic); err != nil {
+			return nil, err
+		}
+	}
+	if !reg.hasTopic(topic) {
+		reg.Topics = append(reg.Topics, topic)
+	}
+	return reg, r.store(reg)
+}
+
+func (r *Registry) unsubscribe(userID, deviceID, topic string) (*Registration, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	reg, ok := r.registrations[registrationKey(userID, deviceID)]
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	for platform, token := range reg.Tokens {
+		c, ok := r.connectors[platform]
+		if !ok {
+			continue
+		}
+		key := connector.GenerateKey(topic, subscriptionParams(c, platform, userID, token))
+		if s := c.Manager().Find(key); s != nil {
+			if err := c.Manager().Remove(s); err != nil && err != connector.ErrSubscriberDoesNotExist {
+				return nil, err
+			}
+		}
+	}
+	topics := reg.Topics[:0]
+	for _, t := range reg.Topics {
+		if t != topic {
+			topics = append(topics, t)
+		}
+	}
+	reg.Topics = topics
+	return reg, r.store(reg)
+}
+
+// removeSubscriptions removes all subscriptions of the connector matching the params
+func (r *Registry) removeSubscriptions(c connector.Connector, params router.RouteParams) {
+	for _, s := range c.Manager().Filter(params) {
+		if err := c.Manager().Remove(s); err != nil {
+			logger.WithError(err).WithField("subscriber", s).Error("Could not remove device subscription")
+		}
+	}
+}
+
+func (r *Registry) store(reg *Registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	return r.kvstore.Put(schema, registrationKey(reg.UserID, reg.DeviceID), data)
+}
+
+// subscriptionParams returns the route params of a subscription of the connector,
+// as they are created by a POST to the connector itself
+func subscriptionParams(c connector.Connector, platform, userID, token string) router.RouteParams {
+	return router.RouteParams{
+		connector.ConnectorParam: c.Name(),
+		tokenParams[platform]:    token,
+		userIDKey:                userID,
+	}
+}
+
+// createSubscription creates and runs a subscription of the connector, if it does not exist yet
+func createSubscription(c connector.Connector, params router.RouteParams, topic string) error {
+	s, err := c.Manager().Create(protocol.Path(topic), params.Copy())
+	if err == connector.ErrSubscriberExists {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	go c.Run(s)
+	return nil
+}
+
+func writeRegistration(w http.ResponseWriter, reg *Registration) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reg)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrRegistrationNotFound:
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusNotFound)
+	case ErrUnknownPlatform:
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+	default:
+		http.Error(w, fmt.Sprintf(`{"error":"unknown error: %s"}`, err.Error()), http.StatusInternalServerError)
+	}
+}
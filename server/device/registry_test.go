@@ -0,0 +1,158 @@
+package device
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConnector is a connector with a real manager, which does not run its subscriptions
+type testConnector struct {
+	connector.Connector
+	name    string
+	manager connector.Manager
+}
+
+func (c *testConnector) Name() string                 { return c.name }
+func (c *testConnector) Manager() connector.Manager   { return c.manager }
+func (c *testConnector) Run(connector.Subscriber)     {}
+func (c *testConnector) topics(token string) []string { return c.filter(tokenParamOf(c.name), token) }
+
+func (c *testConnector) filter(key, value string) []string {
+	var topics []string
+	for _, s := range c.manager.Filter(map[string]string{key: value}) {
+		topics = append(topics, string(s.Route().Path))
+	}
+	return topics
+}
+
+func tokenParamOf(name string) string {
+	if name == "apns" {
+		return tokenParams[IOS]
+	}
+	return tokenParams[Android]
+}
+
+func newTestRegistry(t *testing.T) (*Registry, *testConnector, *testConnector, kvstore.KVStore) {
+	kvs := kvstore.NewMemoryKVStore()
+	r := NewRegistry("/devices/", router.New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil))
+	fcmConn := &testConnector{name: "fcm", manager: connector.NewManager("fcm_registration", kvs)}
+	apnsConn := &testConnector{name: "apns", manager: connector.NewManager("apns_registration", kvs)}
+	assert.NoError(t, r.SetConnector(Android, fcmConn))
+	assert.NoError(t, r.SetConnector(IOS, apnsConn))
+	assert.NoError(t, r.Start())
+	return r, fcmConn, apnsConn, kvs
+}
+
+func serve(r *Registry, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, "http://localhost"+path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestRegistry_SubscribeFansOutToThePlatforms(t *testing.T) {
+	a := assert.New(t)
+	r, fcmConn, apnsConn, _ := newTestRegistry(t)
+
+	// given a device registered for both platforms
+	a.Equal(http.StatusOK, serve(r, http.MethodPost, "/devices/user1/device1/android/fcmToken").Code)
+	a.Equal(http.StatusOK, serve(r, http.MethodPost, "/devices/user1/device1/ios/apnsToken").Code)
+
+	// when it subscribes to a topic
+	w := serve(r, http.MethodPost, "/devices/user1/device1/subscriptions/foo/bar")
+
+	// then a subscription is created by each connector
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"user_id":"user1","device_id":"device1","tokens":{"android":"fcmToken","ios":"apnsToken"},"topics":["/foo/bar"]}`, w.Body.String())
+	a.Equal([]string{"/foo/bar"}, fcmConn.topics("fcmToken"))
+	a.Equal([]string{"/foo/bar"}, apnsConn.topics("apnsToken"))
+	s := fcmConn.manager.Filter(map[string]string{"device_token": "fcmToken"})[0]
+	a.Equal(router.RouteParams{"connector": "fcm", "device_token": "fcmToken", "user_id": "user1"}, s.Route().RouteParams)
+
+	// and a platform registered later is subscribed to the topics of the device
+	a.Equal(http.StatusOK, serve(r, http.MethodPost, "/devices/user1/device1/ios/newApnsToken").Code)
+	a.Nil(apnsConn.topics("apnsToken"))
+	a.Equal([]string{"/foo/bar"}, apnsConn.topics("newApnsToken"))
+
+	// and unsubscribing removes the subscriptions of all platforms
+	a.Equal(http.StatusOK, serve(r, http.MethodDelete, "/devices/user1/device1/subscriptions/foo/bar").Code)
+	a.Nil(fcmConn.topics("fcmToken"))
+	a.Nil(apnsConn.topics("newApnsToken"))
+}
+
+func TestRegistry_RemoveInvalidKeepsTheOtherPlatform(t *testing.T) {
+	a := assert.New(t)
+	r, fcmConn, apnsConn, kvs := newTestRegistry(t)
+
+	// given a device with both platforms, subscribed to two topics
+	serve(r, http.MethodPost, "/devices/user1/device1/android/fcmToken")
+	serve(r, http.MethodPost, "/devices/user1/device1/ios/apnsToken")
+	serve(r, http.MethodPost, "/devices/user1/device1/subscriptions/foo")
+	serve(r, http.MethodPost, "/devices/user1/device1/subscriptions/bar")
+
+	// when APNS reports the token as invalid for one subscription, which the connector removes
+	s := apnsConn.manager.Filter(map[string]string{"device_id": "apnsToken"})[0]
+	a.NoError(apnsConn.manager.Remove(s))
+	r.RemoveInvalid(s)
+
+	// then only the ios entry and its subscriptions are removed
+	a.Nil(apnsConn.topics("apnsToken"))
+	a.Len(fcmConn.topics("fcmToken"), 2)
+
+	data, exists, err := kvs.Get(schema, registrationKey("user1", "device1"))
+	a.NoError(err)
+	a.True(exists)
+	reg := &Registration{}
+	a.NoError(json.Unmarshal(data, reg))
+	a.Equal(map[string]string{Android: "fcmToken"}, reg.Tokens)
+	a.Equal([]string{"/foo", "/bar"}, reg.Topics)
+}
+
+func TestRegistry_UnregisterAndDelete(t *testing.T) {
+	a := assert.New(t)
+	r, fcmConn, apnsConn, kvs := newTestRegistry(t)
+
+	serve(r, http.MethodPost, "/devices/user1/device1/android/fcmToken")
+	serve(r, http.MethodPost, "/devices/user1/device1/ios/apnsToken")
+	serve(r, http.MethodPost, "/devices/user1/device1/subscriptions/foo")
+
+	// when unregistering one platform, then only its subscriptions are removed
+	w := serve(r, http.MethodDelete, "/devices/user1/device1/android")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"user_id":"user1","device_id":"device1","tokens":{"ios":"apnsToken"},"topics":["/foo"]}`, w.Body.String())
+	a.Nil(fcmConn.topics("fcmToken"))
+	a.Equal([]string{"/foo"}, apnsConn.topics("apnsToken"))
+
+	// and the registration is loaded again by a new registry
+	r2 := NewRegistry("/devices/", router.New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil))
+	a.NoError(r2.Start())
+	a.JSONEq(w.Body.String(), serve(r2, http.MethodGet, "/devices/user1/device1").Body.String())
+
+	// when deleting the device, then all of its subscriptions and the registration are removed
+	a.Equal(http.StatusOK, serve(r, http.MethodDelete, "/devices/user1/device1").Code)
+	a.Nil(apnsConn.topics("apnsToken"))
+	a.Equal(http.StatusNotFound, serve(r, http.MethodGet, "/devices/user1/device1").Code)
+	_, exists, err := kvs.Get(schema, registrationKey("user1", "device1"))
+	a.NoError(err)
+	a.False(exists)
+}
+
+func TestRegistry_Errors(t *testing.T) {
+	a := assert.New(t)
+	r, _, _, _ := newTestRegistry(t)
+
+	a.Equal(http.StatusBadRequest, serve(r, http.MethodPost, "/devices/user1/device1/windows/token").Code)
+	a.Equal(http.StatusNotFound, serve(r, http.MethodPost, "/devices/user1/device1/subscriptions/foo").Code)
+	a.Equal(http.StatusNotFound, serve(r, http.MethodDelete, "/devices/user1/device1/ios").Code)
+	a.Equal(ErrUnknownPlatform, r.SetConnector("windows", nil))
+}
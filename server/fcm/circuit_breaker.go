@@ -0,0 +1,218 @@
+package fcm
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/server/metrics"
+)
+
+// ErrCircuitOpen is returned for a request, which was not sent because the circuit breaker is open
+var ErrCircuitOpen = errors.New("FCM circuit breaker is open. The request was not sent.")
+
+// BreakerPolicy decides what happens to the requests while the circuit breaker is open
+type BreakerPolicy string
+
+const (
+	// BreakerQueue keeps the requests: the workers wait until the circuit is half-open,
+	// so the requests are buffered by the queue, and its overflow policy applies
+	BreakerQueue BreakerPolicy = "queue"
+
+	// BreakerDrop fails the requests with ErrCircuitOpen, without sending them
+	BreakerDrop BreakerPolicy = "drop"
+
+	// halfOpenWait is the interval, in which a worker waiting for the circuit checks again,
+	// while the trial request of the half-open circuit is sent
+	halfOpenWait = 100 * time.Millisecond
+)
+
+// IsValid returns true for a known policy
+func (p BreakerPolicy) IsValid() bool {
+	return p == BreakerQueue || p == BreakerDrop
+}
+
+// breakerState is the state of a circuitBreaker, exposed by the metrics as its number
+type breakerState int
+
+const (
+	// breakerClosed sends all requests
+	breakerClosed breakerState = iota
+
+	// breakerOpen sends no request until the cooldown is over
+	breakerOpen
+
+	// breakerHalfOpen sends a single trial request, which closes the circuit again or opens it for another cooldown
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// BreakerConfig configures the circuit breaker of the FCM sender
+type BreakerConfig struct {
+	// Errors is the number of failed sends within the Window, which opens the circuit. Zero disables the breaker.
+	Errors int
+
+	// ErrorRate is the minimum ratio of the failed sends within the Window, for opening the circuit (zero: any ratio)
+	ErrorRate float64
+
+	// Window is the duration, over which the sends are counted
+	Window time.Duration
+
+	// Cooldown is the duration, for which the circuit stays open before the trial request
+	Cooldown time.Duration
+
+	// Policy applies to the requests while the circuit is open (default: BreakerQueue)
+	Policy BreakerPolicy
+}
+
+// circuitBreaker stops sending to FCM during an outage: when too many sends failed within a window,
+// the circuit opens for a cooldown, then half-opens for a trial request deciding whether FCM recovered.
+// Only the transient errors count as failures, not the errors of a single device like NotRegistered.
+type circuitBreaker struct {
+	config BreakerConfig
+
+	mutex       sync.Mutex
+	state       breakerState
+	windowStart time.Time
+	sends       int
+	failures    int
+	openedAt    time.Time
+	trial       bool
+
+	// now returns the current time; it is replaced in the tests
+	now func() time.Time
+}
+
+// newCircuitBreaker returns a circuitBreaker, or nil if the breaker is disabled
+func newCircuitBreaker(config BreakerConfig) *circuitBreaker {
+	if config.Errors <= 0 {
+		return nil
+	}
+	if config.Policy == "" {
+		config.Policy = BreakerQueue
+	}
+	b := &circuitBreaker{config: config, now: time.Now}
+	b.windowStart = b.now()
+	b.setState(breakerClosed)
+	return b
+}
+
+// allow returns true if a request can be sent, or the duration after which the circuit can be tried again.
+// In the half-open state, only the first caller is allowed, for the trial request.
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if remaining := b.config.Cooldown - b.now().Sub(b.openedAt); remaining > 0 {
+			return false, remaining
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return true, 0
+	case breakerHalfOpen:
+		if b.trial {
+			return false, halfOpenWait
+		}
+		b.trial = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// wait returns nil when a request can be sent.
+// With BreakerQueue it waits for it, with BreakerDrop it returns ErrCircuitOpen while the circuit is open.
+func (b *circuitBreaker) wait() error {
+	for {
+		ok, retryIn := b.allow()
+		if ok {
+			return nil
+		}
+		if b.config.Policy == BreakerDrop {
+			mTotalShortCircuited.Add(1)
+			return ErrCircuitOpen
+		}
+		time.Sleep(retryIn)
+	}
+}
+
+// record counts the outcome of a send to FCM
+func (b *circuitBreaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case breakerHalfOpen:
+		b.trial = false
+		if failed {
+			b.open(now)
+			return
+		}
+		b.setState(breakerClosed)
+		b.windowStart, b.sends, b.failures = now, 0, 0
+	case breakerClosed:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart, b.sends, b.failures = now, 0, 0
+		}
+		b.sends++
+		if !failed {
+			return
+		}
+		b.failures++
+		if b.failures >= b.config.Errors && float64(b.failures)/float64(b.sends) >= b.config.ErrorRate {
+			b.open(now)
+		}
+	}
+	// the sends started before the circuit opened are not counted
+}
+
+// isOpen returns true, while the circuit is open
+func (b *circuitBreaker) isOpen() bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state == breakerOpen
+}
+
+// open opens the circuit for the cooldown; the caller has to hold the lock
+func (b *circuitBreaker) open(now time.Time) {
+	b.openedAt = now
+	b.setState(breakerOpen)
+	mTotalCircuitOpened.Add(1)
+	logger.WithFields(log.Fields{
+		"failures": b.failures,
+		"sends":    b.sends,
+		"cooldown": b.config.Cooldown,
+	}).Warn("Opened the circuit breaker of FCM")
+}
+
+// setState changes the state and its metrics; the caller has to hold the lock
+func (b *circuitBreaker) setState(state breakerState) {
+	if state != b.state {
+		logger.WithFields(log.Fields{"from": b.state, "to": state}).Info("Circuit breaker of FCM changed its state")
+	}
+	b.state = state
+	mCircuitState.Set(int64(state))
+	metrics.PromFCMCircuitState.Set(float64(state))
+}
@@ -0,0 +1,118 @@
+package fcm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Bogh/gcm"
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker_OpensHalfOpensAndCloses(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1420110000, 0)
+	b := newCircuitBreaker(BreakerConfig{Errors: 3, ErrorRate: 0.5, Window: 10 * time.Second, Cooldown: 30 * time.Second})
+	b.now = func() time.Time { return now }
+
+	// given errors below the rate, then the circuit stays closed
+	for _, failed := range []bool{false, false, false, true, true} {
+		b.record(failed)
+	}
+	a.Equal(breakerClosed, b.state)
+
+	// when the errors reach the count and the rate in the next window, then the circuit opens
+	now = now.Add(10 * time.Second)
+	for _, failed := range []bool{true, false, true, true} {
+		b.record(failed)
+	}
+	a.Equal(breakerOpen, b.state)
+	a.Equal(ErrCircuitOpen, (&sender{breaker: b}).Check())
+	ok, retryIn := b.allow()
+	a.False(ok)
+	a.Equal(30*time.Second, retryIn)
+
+	// and after the cooldown, a single trial request is allowed
+	now = now.Add(30 * time.Second)
+	ok, _ = b.allow()
+	a.True(ok)
+	a.Equal(breakerHalfOpen, b.state)
+	ok, retryIn = b.allow()
+	a.False(ok)
+	a.Equal(halfOpenWait, retryIn)
+
+	// and a failed trial opens it again
+	b.record(true)
+	a.Equal(breakerOpen, b.state)
+
+	// and a successful trial closes it
+	now = now.Add(30 * time.Second)
+	ok, _ = b.allow()
+	a.True(ok)
+	b.record(false)
+	a.Equal(breakerClosed, b.state)
+	a.NoError((&sender{breaker: b}).Check())
+	ok, _ = b.allow()
+	a.True(ok)
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	a := assert.New(t)
+
+	b := newCircuitBreaker(BreakerConfig{})
+	a.Nil(b)
+	b.record(true)
+	ok, _ := b.allow()
+	a.True(ok)
+	a.False(b.isOpen())
+}
+
+func TestSender_DropsTheRequestsWhileTheCircuitIsOpen(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 1)
+	s.SetCircuitBreaker(BreakerConfig{Errors: 2, Window: time.Minute, Cooldown: time.Hour, Policy: BreakerDrop})
+
+	// given FCM is unavailable, then the circuit opens after two errors
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(nil, errors.New("503 Service Unavailable")).Times(2)
+	for i := 0; i < 2; i++ {
+		_, err := s.Send(testRequest("device01"))
+		a.IsType(&SendError{}, err)
+	}
+
+	// and the next requests are not sent
+	_, err := s.Send(testRequest("device01"))
+	a.Equal(ErrCircuitOpen, err)
+	a.Equal(ErrCircuitOpen, s.Check())
+}
+
+func TestSender_WaitsForTheHalfOpenCircuit(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 1)
+	s.SetCircuitBreaker(BreakerConfig{Errors: 1, Window: time.Minute, Cooldown: 50 * time.Millisecond})
+
+	// given an open circuit
+	gomock.InOrder(
+		gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Failure: 1, Error: errors.New("Unavailable")}, nil),
+		gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil),
+	)
+	_, err := s.Send(testRequest("device01"))
+	a.NoError(err)
+	a.True(s.breaker.isOpen())
+
+	// when sending with the queue policy, then the request waits for the cooldown, and is sent as trial
+	start := time.Now()
+	response, err := s.Send(testRequest("device01"))
+	a.NoError(err)
+	a.True(response.(*Response).Ok())
+	a.True(time.Since(start) >= 40*time.Millisecond)
+	a.Equal(breakerClosed, s.breaker.state)
+}
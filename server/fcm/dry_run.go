@@ -0,0 +1,42 @@
+package fcm
+
+import (
+	"encoding/json"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/Bogh/gcm"
+)
+
+// dryRunMessageID is the message id of the synthetic responses of a dry run
+const dryRunMessageID = "dry-run"
+
+// NewDryRunSender returns a sender, which selects the API keys and builds the FCM messages like the one of NewSender,
+// but logs each message with its device token and payload instead of sending it, and returns a successful response.
+// The responses are marked as DryRun, so that they are counted separately from the sent messages.
+func NewDryRunSender(apiKeys []string, strategy string) *sender {
+	s := NewSender(apiKeys, strategy)
+	for _, key := range s.keys {
+		key.gcmSender = &dryRunGCMSender{key: key.name}
+	}
+	s.dryRun = true
+	return s
+}
+
+// dryRunGCMSender is a gcm.Sender, which logs the messages without sending them
+type dryRunGCMSender struct {
+	key string
+}
+
+func (s *dryRunGCMSender) Send(message *gcm.Message) (*gcm.Response, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"deviceToken": message.To,
+		"key":         s.key,
+		"payload":     string(payload),
+	}).Info("Dry run: would send message to FCM")
+	return &gcm.Response{Success: 1, Results: []gcm.Result{{MessageID: dryRunMessageID}}}, nil
+}
@@ -0,0 +1,75 @@
+package fcm
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunSender_Send(t *testing.T) {
+	a := assert.New(t)
+
+	// given a dry-run sender with two keys
+	s := NewDryRunSender([]string{"key0", "key1"}, KeyStrategyRoundRobin)
+
+	// then the messages are not sent, but answered successfully, with the keys selected in turn
+	var keys []string
+	for i := 0; i < 2; i++ {
+		rsp, err := s.Send(testRequest("device01"))
+		a.NoError(err)
+		response := rsp.(*Response)
+		a.True(response.DryRun)
+		a.True(response.Ok())
+		a.Equal(dryRunMessageID, response.Results[0].MessageID)
+		keys = append(keys, response.Key)
+	}
+	a.Equal([]string{"0-key0", "1-key1"}, keys)
+}
+
+func TestConnector_DryRunResponse(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	conn, mocks := testFCM(t, false)
+	receiptsTopic := "/fcm/receipts"
+	conn.(*fcm).ReceiptsTopic = &receiptsTopic
+
+	subscriber := connector.NewSubscriber("/topic", router.RouteParams{deviceTokenKey: "device01", userIDKEy: "user01"}, 0)
+	a.NoError(conn.Manager().Add(subscriber))
+
+	// expect a receipt
+	receiptC := make(chan *protocol.Message, 1)
+	mocks.router.EXPECT().HandleMessage(gomock.Any()).Do(func(m *protocol.Message) {
+		receiptC <- m
+	}).Return(nil)
+
+	// when the dry-run response of a message is handled
+	request := connector.NewRequest(subscriber, &protocol.Message{ID: 4, Path: "/topic", Body: []byte("{}")})
+	response, err := NewDryRunSender([]string{"key0"}, KeyStrategyRoundRobin).Send(request)
+	a.NoError(err)
+	a.NoError(conn.HandleResponse(request, response, nil, nil))
+
+	// then the subscription moved on to the message
+	var data connector.SubscriberData
+	encoded, err := subscriber.Encode()
+	a.NoError(err)
+	a.NoError(json.Unmarshal(encoded, &data))
+	a.Equal(uint64(4), data.LastID)
+
+	// and a receipt was published
+	select {
+	case m := <-receiptC:
+		a.JSONEq(`{"message_id":4,"path":"/topic","device_token":"device01","user_id":"user01","key":"0-key0",
+			"multicast_id":0,"success":true,"dry_run":true}`, string(m.Body))
+	case <-time.After(time.Second):
+		a.Fail("No receipt published")
+	}
+}
@@ -1,9 +1,13 @@
 package fcm
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 
-	"github.com/Bogh/gcm"
+	log "github.com/Sirupsen/logrus"
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/connector"
 	"github.com/smancke/guble/server/metrics"
@@ -23,39 +27,144 @@ const (
 type Config struct {
 	Enabled              *bool
 	APIKey               *string
+	KeyStrategy          *string
 	Workers              *int
+	QueueSize            *int
+	OverflowPolicy       *string
+	MaxRate              *float64
+	WarmupDuration       *time.Duration
+	WarmupCurve          *string
 	Endpoint             *string
 	Prefix               *string
 	IntervalMetrics      *bool
+	DeadLetterTopic      *string
+	ReceiptsTopic        *string
 	AfterMessageDelivery protocol.MessageDeliveryCallback
+	InvalidSubscriber    connector.InvalidSubscriberCallback
+	Events               *connector.Events
+
+	// DryRun logs the messages instead of sending them, see NewDryRunSender
+	DryRun *bool
+
+	// BreakerErrors, BreakerErrorRate, BreakerWindow, BreakerCooldown and BreakerPolicy configure the circuit breaker
+	// of the sender (see BreakerConfig), which is disabled without BreakerErrors
+	BreakerErrors    *int
+	BreakerErrorRate *float64
+	BreakerWindow    *time.Duration
+	BreakerCooldown  *time.Duration
+	BreakerPolicy    *string
+
+	// RetryBudget is the maximum number of retries per second of all messages (zero disables the limit)
+	RetryBudget *float64
+}
+
+// resilientSender is implemented by the sender of NewSender, which can stop sending during an outage of FCM
+type resilientSender interface {
+	SetCircuitBreaker(config BreakerConfig)
+	SetRetryBudget(retriesPerSecond float64)
+}
+
+// checker is implemented by a sender, which reports its health
+type checker interface {
+	Check() error
+}
+
+// templatedSender is implemented by the sender of NewSender, which renders the FCM messages by the payload templates
+type templatedSender interface {
+	setTemplates(templates *payloadTemplates)
 }
 
 // Connector is the structure for handling the communication with Firebase Cloud Messaging
 type fcm struct {
 	Config
 	connector.Connector
+	router router.Router
+
+	// templates are the payload templates, loaded on start
+	templates *payloadTemplates
 }
 
 // New creates a new *fcm and returns it as an connector.ResponsiveConnector
 func New(router router.Router, sender connector.Sender, config Config) (connector.ResponsiveConnector, error) {
-	baseConn, err := connector.NewConnector(router, sender, connector.Config{
+	connConfig := connector.Config{
 		Name:       "fcm",
 		Schema:     schema,
 		Prefix:     *config.Prefix,
 		URLPattern: fmt.Sprintf("/{%s}/{%s}/{%s:.*}", deviceTokenKey, userIDKEy, connector.TopicParam),
 		Workers:    *config.Workers,
-	})
+		Events:     config.Events,
+	}
+	if config.QueueSize != nil {
+		connConfig.QueueSize = *config.QueueSize
+	}
+	if config.OverflowPolicy != nil {
+		connConfig.OverflowPolicy = connector.OverflowPolicy(*config.OverflowPolicy)
+	}
+	if config.MaxRate != nil {
+		connConfig.Rate = *config.MaxRate
+	}
+	if config.WarmupDuration != nil {
+		connConfig.Warmup = *config.WarmupDuration
+	}
+	if config.WarmupCurve != nil {
+		connConfig.WarmupCurve = connector.WarmupCurve(*config.WarmupCurve)
+	}
+	if s, ok := sender.(resilientSender); ok {
+		configureResilience(s, config)
+	}
+	baseConn, err := connector.NewConnector(router, sender, connConfig)
 	if err != nil {
 		logger.WithError(err).Error("Base connector error")
 		return nil, err
 	}
 
-	f := &fcm{config, baseConn}
+	f := &fcm{Config: config, Connector: baseConn, router: router}
 	f.SetResponseHandler(f)
 	return f, nil
 }
 
+// configureResilience sets the circuit breaker and the retry budget of the sender, as configured
+func configureResilience(s resilientSender, config Config) {
+	if config.BreakerErrors != nil && *config.BreakerErrors > 0 {
+		b := BreakerConfig{Errors: *config.BreakerErrors}
+		if config.BreakerErrorRate != nil {
+			b.ErrorRate = *config.BreakerErrorRate
+		}
+		if config.BreakerWindow != nil {
+			b.Window = *config.BreakerWindow
+		}
+		if config.BreakerCooldown != nil {
+			b.Cooldown = *config.BreakerCooldown
+		}
+		if config.BreakerPolicy != nil {
+			b.Policy = BreakerPolicy(*config.BreakerPolicy)
+		}
+		logger.WithFields(log.Fields{
+			"errors":    b.Errors,
+			"errorRate": b.ErrorRate,
+			"window":    b.Window,
+			"cooldown":  b.Cooldown,
+			"policy":    b.Policy,
+		}).Info("Enabled the circuit breaker of FCM")
+		s.SetCircuitBreaker(b)
+	}
+	if config.RetryBudget != nil && *config.RetryBudget > 0 {
+		s.SetRetryBudget(*config.RetryBudget)
+	}
+}
+
+// Check is an implementation of health.Checker: the connector is unhealthy while its circuit breaker is open
+func (f *fcm) Check() error {
+	if c, ok := f.Sender().(checker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
 func (f *fcm) Start() error {
+	if err := f.startTemplates(); err != nil {
+		return err
+	}
 	err := f.Connector.Start()
 	if err == nil {
 		f.startMetrics()
@@ -63,6 +172,32 @@ func (f *fcm) Start() error {
 	return err
 }
 
+// startTemplates loads the payload templates from the KV store, and passes them to the sender
+func (f *fcm) startTemplates() error {
+	kvStore, err := f.router.KVStore()
+	if err != nil {
+		return err
+	}
+	f.templates = newPayloadTemplates(kvStore)
+	if err := f.templates.load(); err != nil {
+		logger.WithError(err).Error("Loading the FCM templates failed, passing the bodies through")
+	}
+	if s, ok := f.Sender().(templatedSender); ok {
+		s.setTemplates(f.templates)
+	}
+	return nil
+}
+
+// ServeHTTP serves the payload templates below the templates path, and the subscriptions on all other paths
+func (f *fcm) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if f.templates != nil && path == strings.TrimSuffix(f.GetPrefix(), "/")+templatesPath {
+		f.templates.ServeHTTP(w, req)
+		return
+	}
+	f.Connector.ServeHTTP(w, req)
+}
+
 func (f *fcm) startMetrics() {
 	mTotalSentMessages.Set(0)
 	mTotalSendErrors.Set(0)
@@ -71,6 +206,13 @@ func (f *fcm) startMetrics() {
 	mTotalResponseNotRegisteredErrors.Set(0)
 	mTotalReplacedCanonicalErrors.Set(0)
 	mTotalResponseOtherErrors.Set(0)
+	mTotalDeadLetterMessages.Set(0)
+	mTotalReceiptMessages.Set(0)
+	mTotalDryRunMessages.Set(0)
+	mTotalRetries.Set(0)
+	mTotalRetriesDenied.Set(0)
+	mTotalCircuitOpened.Set(0)
+	mTotalShortCircuited.Set(0)
 
 	if *f.IntervalMetrics {
 		f.startIntervalMetric(mMinute, time.Minute)
@@ -85,8 +227,9 @@ func (f *fcm) startIntervalMetric(m metrics.Map, td time.Duration) {
 
 func (f *fcm) HandleResponse(request connector.Request, responseIface interface{}, metadata *connector.Metadata, err error) error {
 	if err != nil && !isValidResponseError(err) {
-		logger.WithField("error", err.Error()).Error("Error sending message to FCM")
+		logger.WithFields(log.Fields{"error": err.Error(), "key": errorKey(err)}).Error("Error sending message to FCM")
 		mTotalSendErrors.Add(1)
+		metrics.PromFCMMessages.WithLabelValues("failure", errorKey(err)).Inc()
 		if *f.IntervalMetrics && metadata != nil {
 			addToLatenciesAndCountsMaps(currentTotalErrorsLatenciesKey, currentTotalErrorsKey, metadata.Latency)
 		}
@@ -95,34 +238,62 @@ func (f *fcm) HandleResponse(request connector.Request, responseIface interface{
 	message := request.Message()
 	subscriber := request.Subscriber()
 
-	response, ok := responseIface.(*gcm.Response)
-	if !ok {
+	response, ok := responseIface.(*Response)
+	if !ok || response.Response == nil {
 		mTotalResponseErrors.Add(1)
+		metrics.PromFCMMessages.WithLabelValues("failure", errorKey(err)).Inc()
 		return fmt.Errorf("Invalid FCM Response")
 	}
 
-	logger.WithField("messageID", message.ID).Debug("Delivered message to FCM")
+	logger.WithFields(log.Fields{
+		"message_id": message.ID,
+		"traceID":    message.TraceID(),
+	}).Debug("Delivered message to FCM")
+	migrated := false
+	defer func() { f.publishReceipt(request, response, migrated) }()
+
 	subscriber.SetLastID(message.ID)
 	if err := f.Manager().Update(request.Subscriber()); err != nil {
 		logger.WithField("error", err.Error()).Error("Manager could not update subscription")
 		mTotalResponseInternalErrors.Add(1)
 		return err
 	}
+	if response.DryRun {
+		mTotalDryRunMessages.Add(1)
+		metrics.PromConnectorDryRunRequests.WithLabelValues("fcm").Inc()
+		return nil
+	}
 	if response.Ok() {
 		mTotalSentMessages.Add(1)
+		metrics.PromFCMMessages.WithLabelValues("success", response.Key).Inc()
 		if *f.IntervalMetrics && metadata != nil {
 			addToLatenciesAndCountsMaps(currentTotalMessagesLatenciesKey, currentTotalMessagesKey, metadata.Latency)
 		}
+		if newToken := canonicalID(response); newToken != "" {
+			mTotalReplacedCanonicalErrors.Add(1)
+			err := f.replaceCanonical(subscriber, newToken, message.ID)
+			migrated = err == nil
+			return err
+		}
 		return nil
 	}
 
-	logger.WithField("success", response.Success).Debug("Handling FCM Error")
+	logger.WithFields(log.Fields{"success": response.Success, "key": response.Key}).Debug("Handling FCM Error")
+	metrics.PromFCMMessages.WithLabelValues("failure", response.Key).Inc()
 
-	switch errText := response.Error.Error(); errText {
+	errText := response.Error.Error()
+	if isPermanentError(errText) {
+		f.deadLetter(request, errText)
+	}
+
+	switch errText {
 	case "NotRegistered":
 		logger.Debug("Removing not registered FCM subscription")
 		f.Manager().Remove(subscriber)
 		mTotalResponseNotRegisteredErrors.Add(1)
+		if f.InvalidSubscriber != nil {
+			f.InvalidSubscriber(subscriber)
+		}
 		return response.Error
 	case "InvalidRegistration":
 		logger.WithField("jsonError", errText).Error("InvalidRegistration of FCM subscription")
@@ -130,28 +301,185 @@ func (f *fcm) HandleResponse(request connector.Request, responseIface interface{
 		logger.WithField("jsonError", errText).Error("Unexpected error while sending to FCM")
 	}
 
-	if response.CanonicalIDs != 0 {
+	if newToken := canonicalID(response); newToken != "" {
 		mTotalReplacedCanonicalErrors.Add(1)
-		// we only send to one receiver, so we know that we can replace the old id with the first registration id (=canonical id)
-		return f.replaceCanonical(request.Subscriber(), response.Results[0].RegistrationID)
+		err := f.replaceCanonical(subscriber, newToken, message.ID)
+		migrated = err == nil
+		return err
 	}
 	mTotalResponseOtherErrors.Add(1)
 	return nil
 }
 
-func (f *fcm) replaceCanonical(subscriber connector.Subscriber, newToken string) error {
-	manager := f.Manager()
-	err := manager.Remove(subscriber)
-	if err != nil {
-		return err
+// errorKey returns the name of the API key, with which the message was sent, if known
+func errorKey(err error) string {
+	if sendErr, ok := err.(*SendError); ok {
+		return sendErr.Key
 	}
+	return ""
+}
 
+// canonicalID returns the canonical registration id of the response, which replaces the device token, if FCM returned one.
+// We only send to one receiver, so the first registration id is the canonical id.
+func canonicalID(response *Response) string {
+	if response.CanonicalIDs == 0 || len(response.Results) == 0 {
+		return ""
+	}
+	return response.Results[0].RegistrationID
+}
+
+// replaceCanonical migrates the subscription to the canonical id, which FCM returned for its device token.
+// The new subscription is stored before the old one is removed, so that the device is not unsubscribed if storing fails,
+// and it keeps the last id of the old one. If the canonical id is subscribed to the topic already
+// (e.g. when two tokens of a device collapse to the same canonical id), the old subscription is removed as a duplicate.
+func (f *fcm) replaceCanonical(subscriber connector.Subscriber, newToken string, lastID uint64) error {
+	manager := f.Manager()
 	topic := subscriber.Route().Path
 	params := subscriber.Route().RouteParams.Copy()
-
 	params[deviceTokenKey] = newToken
 
-	newSubscriber, err := manager.Create(topic, params)
+	if manager.Exists(connector.GenerateKey(string(topic), params)) {
+		logger.WithField("topic", topic).Info("Removing the FCM subscription duplicating the one of its canonical id")
+		return manager.Remove(subscriber)
+	}
+
+	newSubscriber := connector.NewSubscriber(topic, params, 0)
+	newSubscriber.SetLastID(lastID)
+	if err := manager.Add(newSubscriber); err != nil {
+		return err
+	}
+	if err := manager.Remove(subscriber); err != nil {
+		logger.WithError(err).Error("Error removing the FCM subscription replaced by its canonical id")
+	}
 	go f.Run(newSubscriber)
-	return err
+	return nil
+}
+
+// permanentErrors are the FCM errors, for which a message will never be delivered to the device.
+// All other errors, like `Unavailable`, are transient and the message is retried.
+var permanentErrors = map[string]bool{
+	"MissingRegistration": true,
+	"InvalidRegistration": true,
+	"NotRegistered":       true,
+	"InvalidPackageName":  true,
+	"MismatchSenderId":    true,
+	"MessageTooBig":       true,
+	"InvalidDataKey":      true,
+	"InvalidTtl":          true,
+}
+
+func isPermanentError(errText string) bool {
+	return permanentErrors[errText]
+}
+
+// deadLetter republishes a message, which was rejected permanently, to the dead-letter topic (if configured).
+// The failure reason and the target device token are passed in the header of the republished message.
+func (f *fcm) deadLetter(request connector.Request, reason string) {
+	if f.DeadLetterTopic == nil || *f.DeadLetterTopic == "" {
+		return
+	}
+	message := request.Message()
+	route := request.Subscriber().Route()
+
+	header, err := json.Marshal(map[string]string{
+		"reason":       reason,
+		"device_token": route.Get(deviceTokenKey),
+		"user_id":      route.Get(userIDKEy),
+		"path":         string(message.Path),
+		"message_id":   strconv.FormatUint(message.ID, 10),
+	})
+	if err != nil {
+		logger.WithError(err).Error("Error encoding the dead-letter header")
+		return
+	}
+
+	deadLetter := &protocol.Message{
+		Path:          protocol.Path(*f.DeadLetterTopic),
+		UserID:        message.UserID,
+		ApplicationID: message.ApplicationID,
+		HeaderJSON:    string(header),
+		Body:          message.Body,
+	}
+	if err := f.router.HandleMessage(deadLetter); err != nil {
+		logger.WithError(err).WithField("topic", *f.DeadLetterTopic).Error("Error publishing to the dead-letter topic")
+		return
+	}
+	mTotalDeadLetterMessages.Add(1)
+}
+
+// receipt is the body of a delivery receipt, published to the receipts topic for each response of FCM
+type receipt struct {
+	MessageID     uint64 `json:"message_id"`
+	Path          string `json:"path"`
+	DeviceToken   string `json:"device_token"`
+	UserID        string `json:"user_id"`
+	Key           string `json:"key,omitempty"`
+	MulticastID   int64  `json:"multicast_id"`
+	Success       bool   `json:"success"`
+	Error         string `json:"error,omitempty"`
+	CanonicalID   string `json:"canonical_id,omitempty"`
+	TokenMigrated bool   `json:"token_migrated,omitempty"`
+	DryRun        bool   `json:"dry_run,omitempty"`
+	TraceID       string `json:"trace_id,omitempty"`
+}
+
+// publishReceipt publishes the outcome of sending a message to FCM to the receipts topic (if configured).
+// If FCM returned a canonical id, the receipt notes whether the subscription was migrated to it.
+// The status, the device token and the user id are passed in the header as well, for filtering the receipts,
+// with the trace id of the delivered message.
+func (f *fcm) publishReceipt(request connector.Request, response *Response, migrated bool) {
+	if f.ReceiptsTopic == nil || *f.ReceiptsTopic == "" {
+		return
+	}
+	message := request.Message()
+	route := request.Subscriber().Route()
+
+	r := &receipt{
+		MessageID:     message.ID,
+		Path:          string(message.Path),
+		DeviceToken:   route.Get(deviceTokenKey),
+		UserID:        route.Get(userIDKEy),
+		Key:           response.Key,
+		MulticastID:   response.MulticastID,
+		Success:       response.Ok(),
+		CanonicalID:   canonicalID(response),
+		TokenMigrated: migrated,
+		DryRun:        response.DryRun,
+		TraceID:       message.TraceID(),
+	}
+	if response.Error != nil {
+		r.Error = response.Error.Error()
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding the receipt")
+		return
+	}
+	fields := map[string]string{
+		"success":      strconv.FormatBool(r.Success),
+		"device_token": r.DeviceToken,
+		"user_id":      r.UserID,
+	}
+	// the receipt continues the trace of the delivered message
+	if r.TraceID != "" {
+		fields[protocol.TraceIDHeader] = r.TraceID
+	}
+	header, err := json.Marshal(fields)
+	if err != nil {
+		logger.WithError(err).Error("Error encoding the receipt header")
+		return
+	}
+
+	receiptMessage := &protocol.Message{
+		Path:          protocol.Path(*f.ReceiptsTopic),
+		UserID:        message.UserID,
+		ApplicationID: message.ApplicationID,
+		HeaderJSON:    string(header),
+		Body:          body,
+	}
+	if err := f.router.HandleMessage(receiptMessage); err != nil {
+		logger.WithError(err).WithField("topic", *f.ReceiptsTopic).Error("Error publishing to the receipts topic")
+		return
+	}
+	mTotalReceiptMessages.Add(1)
 }
@@ -14,6 +14,14 @@ var (
 	mTotalResponseNotRegisteredErrors = ns.NewInt("total_response_not_registered_errors")
 	mTotalReplacedCanonicalErrors     = ns.NewInt("total_replaced_canonical_errors")
 	mTotalResponseOtherErrors         = ns.NewInt("total_response_other_errors")
+	mTotalDeadLetterMessages          = ns.NewInt("total_dead_letter_messages")
+	mTotalReceiptMessages             = ns.NewInt("total_receipt_messages")
+	mTotalDryRunMessages              = ns.NewInt("total_dry_run_messages")
+	mTotalRetries                     = ns.NewInt("total_retries")
+	mTotalRetriesDenied               = ns.NewInt("total_retries_denied")
+	mTotalCircuitOpened               = ns.NewInt("total_circuit_opened")
+	mTotalShortCircuited              = ns.NewInt("total_short_circuited")
+	mCircuitState                     = ns.NewInt("circuit_state")
 	mMinute                           = ns.NewMap("minute")
 	mHour                             = ns.NewMap("hour")
 	mDay                              = ns.NewMap("day")
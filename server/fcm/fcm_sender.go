@@ -2,6 +2,11 @@ package fcm
 
 import (
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -9,32 +14,262 @@ import (
 	"github.com/Bogh/gcm"
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/metrics"
 )
 
 const (
-	// sendRetries is the number of retries when something fails
+	// sendRetries is the number of retries when the sending fails with a transient error
 	sendRetries = 5
 
+	// retryBackoff is the pause before the first retry, doubled for each further retry
+	retryBackoff = 100 * time.Millisecond
+
 	// sendTimeout timeout to wait for response from FCM
 	sendTimeout = time.Second
+
+	// unauthorizedPause is the duration for which an API key is not used anymore, after FCM rejected it as unauthorized
+	unauthorizedPause = time.Minute
+
+	// KeyStrategyRoundRobin selects the API keys in turn, for the outgoing messages
+	KeyStrategyRoundRobin = "round-robin"
+
+	// KeyStrategyToken selects always the same API key for a device token
+	KeyStrategyToken = "token"
+
+	// maxTimeToLive is the maximum time to live of a FCM message
+	maxTimeToLive = 4 * 7 * 24 * time.Hour
 )
 
-type sender struct {
+// Response is the response of FCM, together with the name of the API key used for sending the message
+type Response struct {
+	*gcm.Response
+	Key string
+
+	// DryRun is true for the synthetic response of a message, which was not sent (see NewDryRunSender)
+	DryRun bool
+}
+
+// SendError is an error returned when sending a message to FCM, together with the name of the API key used
+type SendError struct {
+	Err error
+	Key string
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+// apiKey is a FCM API key of the sender, identified in the logs and metrics by its name
+type apiKey struct {
+	name      string
 	gcmSender gcm.Sender
+
+	mutex       sync.RWMutex
+	pausedUntil time.Time
+}
+
+func (k *apiKey) pause(d time.Duration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.pausedUntil = time.Now().Add(d)
+}
+
+func (k *apiKey) isPaused(now time.Time) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return now.Before(k.pausedUntil)
+}
+
+type sender struct {
+	keys     []*apiKey
+	strategy string
+	next     uint64
+
+	// onRetry is called when a message is sent again with the next API key or after a transient error, see SetRetryHandler
+	onRetry func(connector.Request, error)
+
+	// retries is the maximum number of retries of a message after transient errors, paused by the backoff
+	retries int
+	backoff time.Duration
+
+	// breaker stops the sending during an outage of FCM, and budget caps the retries of all messages (nil: disabled)
+	breaker *circuitBreaker
+	budget  *retryBudget
+
+	// templates render the FCM messages of the topics or applications having a template (nil: passthrough)
+	templates *payloadTemplates
+
+	// dryRun marks the responses as synthetic, see NewDryRunSender
+	dryRun bool
+}
+
+// NewSender returns a sender using the given API keys (of possibly different Firebase projects),
+// selected for each message by the given strategy.
+func NewSender(apiKeys []string, strategy string) *sender {
+	s := &sender{strategy: strategy, retries: sendRetries, backoff: retryBackoff}
+	for i, key := range apiKeys {
+		// the retries are made by the sender, limited by the retry budget
+		s.keys = append(s.keys, &apiKey{
+			name:      keyName(i, key),
+			gcmSender: gcm.NewSender(key, 0, sendTimeout),
+		})
+	}
+	return s
 }
 
-func NewSender(apiKey string) *sender {
-	return &sender{
-		gcmSender: gcm.NewSender(apiKey, sendRetries, sendTimeout),
+// SetCircuitBreaker enables the circuit breaker of the sender, if the config has a number of errors
+func (s *sender) SetCircuitBreaker(config BreakerConfig) {
+	s.breaker = newCircuitBreaker(config)
+}
+
+// SetRetryBudget limits the retries of all messages to the given number per second (zero disables the limit)
+func (s *sender) SetRetryBudget(retriesPerSecond float64) {
+	s.budget = newRetryBudget(retriesPerSecond)
+}
+
+// Check is an implementation of health.Checker, returning ErrCircuitOpen while the circuit breaker is open
+func (s *sender) Check() error {
+	if s.breaker.isOpen() {
+		return ErrCircuitOpen
 	}
+	return nil
+}
+
+// SplitAPIKeys returns the API keys of a comma separated list
+func SplitAPIKeys(apiKeys string) []string {
+	var keys []string
+	for _, key := range strings.Split(apiKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keyName identifies an API key by its position and its last characters, without revealing it
+func keyName(i int, key string) string {
+	if len(key) > 4 {
+		key = key[len(key)-4:]
+	}
+	return fmt.Sprintf("%d-%s", i, key)
+}
+
+// SetRetryHandler is an implementation of connector.RetryingSender
+func (s *sender) SetRetryHandler(handler func(connector.Request, error)) {
+	s.onRetry = handler
 }
 
 func (s *sender) Send(request connector.Request) (interface{}, error) {
 	deviceToken := request.Subscriber().Route().Get(deviceTokenKey)
-	fcmMessage := fcmMessage(request.Message())
+	fcmMessage := s.payload(request.Message())
 	fcmMessage.To = deviceToken
-	logger.WithFields(log.Fields{"deviceToken": fcmMessage.To}).Debug("sending message")
-	return s.gcmSender.Send(fcmMessage)
+	setPriority(fcmMessage, request.Message())
+	setTimeToLive(fcmMessage, request.Message(), time.Now())
+
+	if s.breaker != nil {
+		if err := s.breaker.wait(); err != nil {
+			return nil, err
+		}
+	}
+	for retry := 0; ; retry++ {
+		response, err := s.sendWithKeys(request, fcmMessage)
+		transientErr := transientError(response, err)
+		if transientErr == nil || retry >= s.retries || !s.mayRetry() {
+			if err != nil {
+				return nil, err
+			}
+			return response, nil
+		}
+		logger.WithFields(log.Fields{
+			"deviceToken": fcmMessage.To,
+			"retry":       retry + 1,
+			"error":       transientErr.Error(),
+		}).Debug("retrying message after a transient error")
+		if s.onRetry != nil {
+			s.onRetry(request, transientErr)
+		}
+		time.Sleep(s.backoff << uint(retry))
+	}
+}
+
+// mayRetry returns true, if the circuit breaker allows sending and a retry is left in the retry budget
+func (s *sender) mayRetry() bool {
+	if ok, _ := s.breaker.allow(); !ok {
+		return false
+	}
+	if !s.budget.take() {
+		mTotalRetriesDenied.Add(1)
+		metrics.PromFCMRetries.WithLabelValues("denied").Inc()
+		return false
+	}
+	mTotalRetries.Add(1)
+	metrics.PromFCMRetries.WithLabelValues("retried").Inc()
+	return true
+}
+
+// sendWithKeys sends the message with the selected API key, or with the next one when an API key is unauthorized.
+// Each send is recorded by the circuit breaker.
+func (s *sender) sendWithKeys(request connector.Request, fcmMessage *gcm.Message) (*Response, error) {
+	var err error
+	for attempt := 0; attempt < len(s.keys); attempt++ {
+		key := s.selectKey(fcmMessage.To)
+		logger.WithFields(log.Fields{"deviceToken": fcmMessage.To, "key": key.name}).Debug("sending message")
+
+		var response *gcm.Response
+		response, err = key.gcmSender.Send(fcmMessage)
+		if err == nil {
+			r := &Response{Response: response, Key: key.name, DryRun: s.dryRun}
+			s.breaker.record(transientError(r, nil) != nil)
+			return r, nil
+		}
+		err = &SendError{Err: err, Key: key.name}
+		if !isUnauthorizedError(err) {
+			s.breaker.record(true)
+			return nil, err
+		}
+		logger.WithFields(log.Fields{"key": key.name, "error": err.Error()}).Error("FCM API key is unauthorized")
+		// FCM is available, but rejected the key
+		s.breaker.record(false)
+		key.pause(unauthorizedPause)
+		if s.onRetry != nil && attempt < len(s.keys)-1 {
+			s.onRetry(request, err)
+		}
+	}
+	return nil, err
+}
+
+// selectKey returns the API key selected by the strategy, or the next one which is not paused
+func (s *sender) selectKey(deviceToken string) *apiKey {
+	n := len(s.keys)
+	var start int
+	if s.strategy == KeyStrategyToken {
+		h := fnv.New32a()
+		h.Write([]byte(deviceToken))
+		start = int(h.Sum32() % uint32(n))
+	} else {
+		start = int((atomic.AddUint64(&s.next, 1) - 1) % uint64(n))
+	}
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		if key := s.keys[(start+i)%n]; !key.isPaused(now) {
+			return key
+		}
+	}
+	return s.keys[start]
+}
+
+// setTemplates sets the payload templates, by which the FCM messages are rendered
+func (s *sender) setTemplates(templates *payloadTemplates) {
+	s.templates = templates
+}
+
+// payload returns the FCM message rendered by the template of the message, or else the one of its body
+func (s *sender) payload(message *protocol.Message) *gcm.Message {
+	if m := s.templates.render(message); m != nil {
+		return m
+	}
+	return fcmMessage(message)
 }
 
 func fcmMessage(message *protocol.Message) *gcm.Message {
@@ -43,9 +278,9 @@ func fcmMessage(message *protocol.Message) *gcm.Message {
 	err := json.Unmarshal(message.Body, m)
 	if err != nil {
 		logger.WithFields(log.Fields{
-			"error":     err.Error(),
-			"body":      string(message.Body),
-			"messageID": message.ID,
+			"error":      err.Error(),
+			"body":       string(message.Body),
+			"message_id": message.ID,
 		}).Debug("Could not decode gcm.Message from guble message body")
 	} else if m.Notification != nil && m.Data != nil {
 		return m
@@ -61,6 +296,65 @@ func fcmMessage(message *protocol.Message) *gcm.Message {
 	return m
 }
 
+// setPriority sets the FCM priority of the message from its priority header,
+// unless it is already given by the body
+func setPriority(m *gcm.Message, message *protocol.Message) {
+	if m.Priority != "" {
+		return
+	}
+	priority, err := message.Priority()
+	if err != nil {
+		priority = protocol.PriorityNormal
+	}
+	m.Priority = priority
+}
+
+// setTimeToLive sets the FCM time to live of the message to the seconds remaining until its expires header,
+// unless it is already given by the body
+func setTimeToLive(m *gcm.Message, message *protocol.Message, now time.Time) {
+	if m.TimeToLive != nil {
+		return
+	}
+	expires, err := message.Expires()
+	if err != nil || expires.IsZero() {
+		return
+	}
+	remaining := expires.Sub(now)
+	if remaining < 0 {
+		remaining = 0
+	} else if remaining > maxTimeToLive {
+		remaining = maxTimeToLive
+	}
+	ttl := uint(remaining / time.Second)
+	m.TimeToLive = &ttl
+}
+
+// transientErrors are the errors of a FCM response, after which the message can be retried
+var transientErrors = map[string]bool{
+	"Unavailable":         true,
+	"InternalServerError": true,
+}
+
+// transientError returns the error of a failed send, which can be retried, or nil.
+// The errors sending the request are transient, unless all API keys are unauthorized.
+func transientError(response *Response, err error) error {
+	if err != nil {
+		if isUnauthorizedError(err) {
+			return nil
+		}
+		return err
+	}
+	if response != nil && response.Response != nil && response.Error != nil && transientErrors[response.Error.Error()] {
+		return response.Error
+	}
+	return nil
+}
+
+// isUnauthorizedError returns true if FCM rejected the API key
+func isUnauthorizedError(err error) bool {
+	return strings.HasPrefix(err.Error(), "401") || strings.Contains(err.Error(), "Unauthorized")
+}
+
 // isValidResponseError returns True if the error is accepted as a valid response
 // cases are InvalidRegistration and NotRegistered
 func isValidResponseError(err error) bool {
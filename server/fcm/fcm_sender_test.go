@@ -0,0 +1,169 @@
+package fcm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Bogh/gcm"
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSender_RoundRobin(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 2)
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil).Times(2)
+	gcmSenders[1].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil).Times(2)
+
+	var keys []string
+	for i := 0; i < 4; i++ {
+		response, err := s.Send(testRequest("device01"))
+		a.NoError(err)
+		keys = append(keys, response.(*Response).Key)
+	}
+	a.Equal([]string{"0-key0", "1-key1", "0-key0", "1-key1"}, keys)
+}
+
+func TestSender_ConsistentByToken(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyToken, 3)
+	for _, gcmSender := range gcmSenders {
+		gcmSender.EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil).AnyTimes()
+	}
+
+	// the same device token is sent always with the same key
+	for _, token := range []string{"device01", "device02", "device03"} {
+		first, err := s.Send(testRequest(token))
+		a.NoError(err)
+		for i := 0; i < 3; i++ {
+			response, err := s.Send(testRequest(token))
+			a.NoError(err)
+			a.Equal(first.(*Response).Key, response.(*Response).Key)
+		}
+	}
+}
+
+func TestSender_UnauthorizedKeyIsSkipped(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 2)
+
+	// given the first key is rejected by FCM
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(nil, errors.New("401 error: 401 Unauthorized"))
+	gcmSenders[1].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil).Times(3)
+
+	// then the message is sent with the other key, and the rejected key is not used anymore
+	for i := 0; i < 3; i++ {
+		response, err := s.Send(testRequest("device01"))
+		a.NoError(err)
+		a.Equal("1-key1", response.(*Response).Key)
+	}
+}
+
+func TestSender_ErrorContainsTheKey(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 2)
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(nil, errors.New("timeout"))
+
+	// a transient error is returned without trying the other key
+	_, err := s.Send(testRequest("device01"))
+	if a.IsType(&SendError{}, err) {
+		a.Equal("0-key0", err.(*SendError).Key)
+		a.Equal("timeout", err.Error())
+	}
+}
+
+func TestSplitAPIKeys(t *testing.T) {
+	a := assert.New(t)
+	a.Equal([]string{"key"}, SplitAPIKeys("key"))
+	a.Equal([]string{"key1", "key2"}, SplitAPIKeys(" key1, key2,"))
+	a.Nil(SplitAPIKeys(""))
+}
+
+func testSenderWithKeys(strategy string, n int) (*sender, []*MockSender) {
+	s := &sender{strategy: strategy}
+	var gcmSenders []*MockSender
+	for i := 0; i < n; i++ {
+		gcmSender := NewMockSender(testutil.MockCtrl)
+		gcmSenders = append(gcmSenders, gcmSender)
+		s.keys = append(s.keys, &apiKey{
+			name:      keyName(i, fmt.Sprintf("key%d", i)),
+			gcmSender: gcmSender,
+		})
+	}
+	return s, gcmSenders
+}
+
+func TestSender_PriorityFromTheHeader(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 1)
+	var priorities []string
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Do(func(m *gcm.Message) {
+		priorities = append(priorities, m.Priority)
+	}).Return(&gcm.Response{Success: 1}, nil).Times(3)
+
+	subscriber := connector.NewSubscriber("/topic", router.RouteParams{deviceTokenKey: "device01"}, 0)
+	for _, m := range []*protocol.Message{
+		{ID: 1, Path: "/topic", Body: []byte("{}")},
+		{ID: 2, Path: "/topic", HeaderJSON: `{"priority":"high"}`, Body: []byte("{}")},
+		{ID: 3, Path: "/topic", HeaderJSON: `{"priority":"high"}`, Body: []byte(`{"notification":{},"data":{},"priority":"normal"}`)},
+	} {
+		_, err := s.Send(connector.NewRequest(subscriber, m))
+		a.NoError(err)
+	}
+
+	// the priority given in the body of a FCM message is kept
+	a.Equal([]string{"normal", "high", "normal"}, priorities)
+}
+
+func TestSender_TimeToLiveFromTheExpiresHeader(t *testing.T) {
+	a := assert.New(t)
+	now := time.Unix(1420110000, 0)
+
+	for _, tc := range []struct {
+		header string
+		body   string
+		ttl    *uint
+	}{
+		{``, `{}`, nil},
+		{`{"expires":"1h"}`, `{}`, uintPointer(3600)},
+		{`{"expires":"2015-01-01T13:00:00Z"}`, `{}`, uintPointer(7200)},
+		{`{"expires":"2015-01-01T09:00:00Z"}`, `{}`, uintPointer(0)},
+		{`{"expires":"2016-01-01T10:00:00Z"}`, `{}`, uintPointer(uint(maxTimeToLive / time.Second))},
+		{`{"expires":"1h"}`, `{"notification":{},"data":{},"time_to_live":60}`, uintPointer(60)},
+	} {
+		m := &protocol.Message{ID: 1, Path: "/topic", Time: now.Unix(), HeaderJSON: tc.header, Body: []byte(tc.body)}
+		fcmMessage := fcmMessage(m)
+		setTimeToLive(fcmMessage, m, now)
+		a.Equal(tc.ttl, fcmMessage.TimeToLive, tc.header)
+	}
+}
+
+func uintPointer(u uint) *uint {
+	return &u
+}
+
+func testRequest(deviceToken string) connector.Request {
+	subscriber := connector.NewSubscriber("/topic", router.RouteParams{deviceTokenKey: deviceToken}, 0)
+	return connector.NewRequest(subscriber, &protocol.Message{ID: 1, Path: "/topic", Body: []byte("{}")})
+}
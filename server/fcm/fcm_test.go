@@ -75,6 +75,13 @@ func TestConnector_GetErrorMessageFromFCM(t *testing.T) {
 	})
 	// mocks.store.EXPECT().MaxMessageID(gomock.Any()).Return(uint64(4), nil)
 
+	// expect the rejected message republished to the dead-letter topic
+	mocks.router.EXPECT().HandleMessage(gomock.Any()).Do(func(m *protocol.Message) {
+		a.Equal("/fcm/deadletter", string(m.Path))
+		a.Equal("{id:id}", string(m.Body))
+		a.JSONEq(`{"reason":"InvalidRegistration","device_token":"device01","user_id":"user01","path":"/topic","message_id":"4"}`, m.HeaderJSON)
+	}).Return(nil)
+
 	response := new(gcm.Response)
 	err = json.Unmarshal([]byte(ErrorFCMResponse), response)
 	a.NoError(err)
@@ -94,6 +101,184 @@ func TestConnector_GetErrorMessageFromFCM(t *testing.T) {
 	a.NoError(err)
 }
 
+func TestConnector_TransientErrorIsNotDeadLettered(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	fcm, mocks := testFCM(t, true)
+
+	err := fcm.Start()
+	a.NoError(err)
+
+	var route *router.Route
+	mocks.router.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) (*router.Route, error) {
+		route = r
+		return r, nil
+	})
+	postSubscription(t, fcm, "user01", "device01", "topic")
+	time.Sleep(100 * time.Millisecond)
+	a.NotNil(route)
+
+	// expect no unsubscribe and no message published to the dead-letter topic
+	doneC := make(chan bool, 1)
+	response := new(gcm.Response)
+	err = json.Unmarshal([]byte(`{"success":0,"failure":1,"error":"Unavailable","results":[{"error":"Unavailable"}]}`), response)
+	a.NoError(err)
+	mocks.gcmSender.EXPECT().Send(gomock.Any()).Do(func(m *gcm.Message) {
+		doneC <- true
+	}).Return(response, nil)
+
+	route.Deliver(&protocol.Message{
+		ID:   uint64(4),
+		Path: "/topic",
+		Body: []byte("{id:id}"),
+	}, true)
+
+	select {
+	case <-doneC:
+	case <-time.After(100 * time.Millisecond):
+		a.Fail("Message not received by FCM")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	err = fcm.Stop()
+	a.NoError(err)
+}
+
+func TestConnector_PublishesReceipts(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	conn, mocks := testFCM(t, true)
+	receiptsTopic := "/fcm/receipts"
+	conn.(*fcm).ReceiptsTopic = &receiptsTopic
+
+	err := conn.Start()
+	a.NoError(err)
+
+	routes := make(chan *router.Route, 1)
+	mocks.router.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) (*router.Route, error) {
+		routes <- r
+		return r, nil
+	})
+	postSubscription(t, conn, "user01", "device01", "topic")
+	route := <-routes
+
+	// given a message accepted by FCM, which returned a canonical id for the device
+	response := new(gcm.Response)
+	err = json.Unmarshal([]byte(`{"multicast_id":7,"success":1,"failure":0,"canonical_ids":1,
+		"results":[{"message_id":"m1","registration_id":"newDevice01"}]}`), response)
+	a.NoError(err)
+	mocks.gcmSender.EXPECT().Send(gomock.Any()).Return(response, nil)
+
+	// expect the subscription migrated to the canonical id
+	mocks.router.EXPECT().Unsubscribe(gomock.Any())
+	mocks.router.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		a.Equal("newDevice01", r.Get(deviceTokenKey))
+	})
+
+	// and a receipt published, noting the migration
+	receiptC := make(chan *protocol.Message, 1)
+	mocks.router.EXPECT().HandleMessage(gomock.Any()).Do(func(m *protocol.Message) {
+		receiptC <- m
+	}).Return(nil)
+
+	route.Deliver(&protocol.Message{
+		ID:            uint64(4),
+		Path:          "/topic",
+		ApplicationID: "app1",
+		Body:          []byte("{id:id}"),
+	}, true)
+
+	select {
+	case m := <-receiptC:
+		a.Equal("/fcm/receipts", string(m.Path))
+		a.Equal("app1", m.ApplicationID)
+		a.JSONEq(`{"success":"true","device_token":"device01","user_id":"user01"}`, m.HeaderJSON)
+		a.JSONEq(`{"message_id":4,"path":"/topic","device_token":"device01","user_id":"user01","key":"0-mock",
+			"multicast_id":7,"success":true,"canonical_id":"newDevice01","token_migrated":true}`, string(m.Body))
+	case <-time.After(time.Second):
+		a.Fail("No receipt published")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	err = conn.Stop()
+	a.NoError(err)
+}
+
+func TestConnector_MigratesToTheCanonicalID(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+	conn, mocks := testFCM(t, true)
+
+	err := conn.Start()
+	a.NoError(err)
+
+	routes := make(chan *router.Route, 3)
+	mocks.router.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) (*router.Route, error) {
+		routes <- r
+		return r, nil
+	}).AnyTimes()
+	mocks.router.EXPECT().Unsubscribe(gomock.Any()).AnyTimes()
+
+	// given two tokens of a device subscribed to the topic, for which FCM returns the same canonical id
+	postSubscription(t, conn, "user01", "device01", "topic")
+	route1 := <-routes
+	postSubscription(t, conn, "user01", "device02", "topic")
+	route2 := <-routes
+
+	response := new(gcm.Response)
+	err = json.Unmarshal([]byte(`{"multicast_id":7,"success":1,"failure":0,"canonical_ids":1,
+		"results":[{"message_id":"m1","registration_id":"canonical01"}]}`), response)
+	a.NoError(err)
+	sentC := make(chan string, 2)
+	mocks.gcmSender.EXPECT().Send(gomock.Any()).Do(func(m *gcm.Message) {
+		sentC <- m.To
+	}).Return(response, nil).Times(2)
+
+	tokens := func() []string {
+		var tokens []string
+		for _, s := range conn.Manager().List() {
+			tokens = append(tokens, s.Route().Get(deviceTokenKey))
+		}
+		return tokens
+	}
+
+	// when a message is sent to the first token
+	route1.Deliver(&protocol.Message{ID: uint64(4), Path: "/topic", Body: []byte("{id:id}")}, true)
+	a.Equal("device01", <-sentC)
+	time.Sleep(50 * time.Millisecond)
+
+	// then its subscription is migrated to the canonical id, keeping its last id
+	a.ElementsMatch([]string{"canonical01", "device02"}, tokens())
+	migrated := conn.Manager().Filter(map[string]string{deviceTokenKey: "canonical01"})
+	if a.Len(migrated, 1) {
+		data, err := migrated[0].Encode()
+		a.NoError(err)
+		a.Contains(string(data), `"LastID":4`)
+		a.Equal("user01", migrated[0].Route().Get(userIDKEy))
+	}
+	select {
+	case r := <-routes:
+		a.Equal("canonical01", r.Get(deviceTokenKey))
+	case <-time.After(time.Second):
+		a.Fail("The migrated subscription is not subscribed to the router")
+	}
+
+	// when a message is sent to the second token, then its subscription is removed as a duplicate
+	route2.Deliver(&protocol.Message{ID: uint64(5), Path: "/topic", Body: []byte("{id:id}")}, true)
+	a.Equal("device02", <-sentC)
+	time.Sleep(50 * time.Millisecond)
+	a.Equal([]string{"canonical01"}, tokens())
+
+	err = conn.Stop()
+	a.NoError(err)
+}
+
 func TestFCMFormatMessage(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -192,10 +377,10 @@ func testFCM(t *testing.T, mockStore bool) (connector.ResponsiveConnector, *mock
 	endpoint := ""
 	prefix := "/fcm/"
 	intervalMetrics := false
+	deadLetterTopic := "/fcm/deadletter"
 
 	mcks.gcmSender = NewMockSender(testutil.MockCtrl)
-	sender := NewSender(key)
-	sender.gcmSender = mcks.gcmSender
+	sender := NewSenderWithMock(mcks.gcmSender)
 
 	conn, err := New(mcks.router, sender, Config{
 		APIKey:          &key,
@@ -203,6 +388,7 @@ func testFCM(t *testing.T, mockStore bool) (connector.ResponsiveConnector, *mock
 		Endpoint:        &endpoint,
 		Prefix:          &prefix,
 		IntervalMetrics: &intervalMetrics,
+		DeadLetterTopic: &deadLetterTopic,
 	})
 	assert.NoError(t, err)
 	if mockStore {
@@ -50,10 +50,11 @@ func (_mr *_MockKVStoreRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Get", arg0, arg1)
 }
 
-func (_m *MockKVStore) Iterate(_param0 string, _param1 string) chan [2]string {
+func (_m *MockKVStore) Iterate(_param0 string, _param1 string) (chan [2]string, error) {
 	ret := _m.ctrl.Call(_m, "Iterate", _param0, _param1)
 	ret0, _ := ret[0].(chan [2]string)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 func (_mr *_MockKVStoreRecorder) Iterate(arg0, arg1 interface{}) *gomock.Call {
@@ -0,0 +1,54 @@
+package fcm
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// retryBudget caps the retries of all requests of the connector to a rate per second,
+// so that the retries do not multiply the load on FCM during an outage.
+// Up to one second of unused retries is kept, for the bursts of transient errors.
+type retryBudget struct {
+	rate float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// now returns the current time; it is replaced in the tests
+	now func() time.Time
+}
+
+// newRetryBudget returns a retryBudget of rate retries per second, or nil if the retries are not limited
+func newRetryBudget(rate float64) *retryBudget {
+	if rate <= 0 {
+		return nil
+	}
+	b := &retryBudget{rate: rate, now: time.Now}
+	b.tokens = b.capacity()
+	b.last = b.now()
+	return b
+}
+
+func (b *retryBudget) capacity() float64 {
+	return math.Max(b.rate, 1)
+}
+
+// take returns true, if a retry is left in the budget, and consumes it
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.now()
+	b.tokens = math.Min(b.capacity(), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,77 @@
+package fcm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Bogh/gcm"
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget_RefillsWithTheRate(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1420110000, 0)
+	b := newRetryBudget(2)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// the budget of a second is consumed
+	a.True(b.take())
+	a.True(b.take())
+	a.False(b.take())
+
+	// and refilled with the rate
+	now = now.Add(500 * time.Millisecond)
+	a.True(b.take())
+	a.False(b.take())
+
+	// but not above one second of retries
+	now = now.Add(time.Hour)
+	a.True(b.take())
+	a.True(b.take())
+	a.False(b.take())
+
+	// and without a rate, the retries are not limited
+	a.Nil(newRetryBudget(0))
+	a.True((*retryBudget)(nil).take())
+}
+
+func TestSender_RetriesTransientErrorsWithinTheBudget(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	s, gcmSenders := testSenderWithKeys(KeyStrategyRoundRobin, 1)
+	s.retries, s.backoff = 3, time.Millisecond
+	var retried []error
+	s.SetRetryHandler(func(_ connector.Request, err error) { retried = append(retried, err) })
+
+	// given a transient error, then the message is retried until it succeeds
+	gomock.InOrder(
+		gcmSenders[0].EXPECT().Send(gomock.Any()).Return(nil, errors.New("timeout")),
+		gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Failure: 1, Error: errors.New("Unavailable")}, nil),
+		gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Success: 1}, nil),
+	)
+	response, err := s.Send(testRequest("device01"))
+	a.NoError(err)
+	a.True(response.(*Response).Ok())
+	a.Len(retried, 2)
+
+	// and the error of a device is not retried
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(&gcm.Response{Failure: 1, Error: errors.New("NotRegistered")}, nil)
+	response, err = s.Send(testRequest("device01"))
+	a.NoError(err)
+	a.Equal("NotRegistered", response.(*Response).Error.Error())
+
+	// when the retry budget is exhausted, then the error is returned without further retry
+	s.SetRetryBudget(1)
+	gcmSenders[0].EXPECT().Send(gomock.Any()).Return(nil, errors.New("timeout")).Times(2)
+	_, err = s.Send(testRequest("device01"))
+	a.Equal("timeout", err.Error())
+	a.Len(retried, 3)
+}
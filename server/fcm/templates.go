@@ -0,0 +1,318 @@
+package fcm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Bogh/gcm"
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+)
+
+const (
+	// TemplatesSchema is the schema of the KV store, containing the payload templates by topic path or application
+	TemplatesSchema = "fcm_templates"
+
+	// templatesPath is the path of the payload templates, below the prefix of the connector
+	templatesPath = "/templates"
+
+	// applicationKeyPrefix is the prefix of the key of a template for all messages of an application
+	applicationKeyPrefix = "app:"
+
+	// templatesReloadInterval is the maximum age of the templates, before they are loaded again from the KV store
+	templatesReloadInterval = 10 * time.Second
+)
+
+// ErrInvalidTemplate is returned for a template, which does not render a json object of an FCM message
+var ErrInvalidTemplate = errors.New("The template does not render a json object")
+
+// templateMessage is the data of a payload template: the fields of the guble message,
+// its header, its body as string and, if the body is json, the decoded body.
+type templateMessage struct {
+	ID            uint64
+	Path          string
+	UserID        string
+	ApplicationID string
+	Time          int64
+	TraceID       string
+	Header        map[string]interface{}
+	Body          string
+	JSON          interface{}
+}
+
+func newTemplateMessage(message *protocol.Message) *templateMessage {
+	m := &templateMessage{
+		ID:            message.ID,
+		Path:          string(message.Path),
+		UserID:        message.UserID,
+		ApplicationID: message.ApplicationID,
+		Time:          message.Time,
+		TraceID:       message.TraceID(),
+		Header:        make(map[string]interface{}),
+		Body:          string(message.Body),
+	}
+	if message.HeaderJSON != "" {
+		json.Unmarshal([]byte(message.HeaderJSON), &m.Header)
+	}
+	if json.Unmarshal(message.Body, &m.JSON) != nil {
+		m.JSON = nil
+	}
+	return m
+}
+
+// sampleMessage is the message, on which a template is tried when it is registered
+var sampleMessage = &templateMessage{
+	ID:     1,
+	Path:   "/",
+	Header: make(map[string]interface{}),
+	Body:   "{}",
+	JSON:   make(map[string]interface{}),
+}
+
+var templateFuncs = template.FuncMap{
+	// json encodes a value, e.g. `{{json .Header.title}}` for a quoted and escaped string
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// parseTemplate parses a payload template and tries it on a sample message
+func parseTemplate(key, text string) (*template.Template, error) {
+	t, err := template.New(key).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := execute(t, sampleMessage); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// execute renders the template on the message, returning the FCM message
+func execute(t *template.Template, data *templateMessage) (*gcm.Message, error) {
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	m := &gcm.Message{}
+	if err := json.Unmarshal(buf.Bytes(), m); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrInvalidTemplate, err)
+	}
+	return m, nil
+}
+
+// templateKey returns the key of the template of a topic or of an application, or an empty string if neither is given
+func templateKey(topic, applicationID string) string {
+	if topic != "" {
+		return "/" + strings.Trim(topic, "/")
+	}
+	if applicationID != "" {
+		return applicationKeyPrefix + applicationID
+	}
+	return ""
+}
+
+// payloadTemplates renders the FCM messages by the templates stored in the TemplatesSchema of the KV store.
+// The template of a topic applies also to its subtopics, unless they have their own one, and takes precedence
+// over the template of the application, which published the message. Without a template, the body is passed through.
+type payloadTemplates struct {
+	kvStore kvstore.KVStore
+
+	mutex     sync.RWMutex
+	templates map[string]*template.Template
+	loadedAt  time.Time
+}
+
+func newPayloadTemplates(kvStore kvstore.KVStore) *payloadTemplates {
+	return &payloadTemplates{
+		kvStore:   kvStore,
+		templates: make(map[string]*template.Template),
+	}
+}
+
+// load reads the templates from the KV store, ignoring the invalid ones
+func (pt *payloadTemplates) load() error {
+	entries, err := pt.kvStore.Iterate(TemplatesSchema, "")
+	if err != nil {
+		return err
+	}
+	templates := make(map[string]*template.Template)
+	for entry := range entries {
+		t, err := parseTemplate(entry[0], entry[1])
+		if err != nil {
+			logger.WithError(err).WithField("key", entry[0]).Error("Ignoring the invalid FCM template")
+			continue
+		}
+		templates[entry[0]] = t
+	}
+
+	pt.mutex.Lock()
+	defer pt.mutex.Unlock()
+	pt.templates = templates
+	pt.loadedAt = time.Now()
+	return nil
+}
+
+// current returns the templates, loading them again if they are older than the reload interval
+func (pt *payloadTemplates) current() map[string]*template.Template {
+	pt.mutex.RLock()
+	templates, loadedAt := pt.templates, pt.loadedAt
+	pt.mutex.RUnlock()
+
+	if time.Since(loadedAt) < templatesReloadInterval {
+		return templates
+	}
+	if err := pt.load(); err != nil {
+		logger.WithError(err).Error("Loading the FCM templates failed, using the previous ones")
+		pt.mutex.Lock()
+		pt.loadedAt = time.Now()
+		pt.mutex.Unlock()
+		return templates
+	}
+	pt.mutex.RLock()
+	defer pt.mutex.RUnlock()
+	return pt.templates
+}
+
+// set validates and stores the template of the key
+func (pt *payloadTemplates) set(key, text string) error {
+	if _, err := parseTemplate(key, text); err != nil {
+		return err
+	}
+	if err := pt.kvStore.Put(TemplatesSchema, key, []byte(text)); err != nil {
+		return err
+	}
+	return pt.load()
+}
+
+// remove deletes the template of the key
+func (pt *payloadTemplates) remove(key string) error {
+	if err := pt.kvStore.Delete(TemplatesSchema, key); err != nil {
+		return err
+	}
+	return pt.load()
+}
+
+// matching returns the template of the topic of the message, or of its closest parent topic having one,
+// else the template of its application, or nil
+func matching(templates map[string]*template.Template, message *protocol.Message) *template.Template {
+	path := strings.TrimSuffix(string(message.Path), "/")
+	for path != "" {
+		if t, ok := templates[path]; ok {
+			return t
+		}
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	if t, ok := templates["/"]; ok {
+		return t
+	}
+	if message.ApplicationID != "" {
+		return templates[applicationKeyPrefix+message.ApplicationID]
+	}
+	return nil
+}
+
+// render returns the FCM message rendered by the matching template, or nil if there is none,
+// or if the rendering failed for this message
+func (pt *payloadTemplates) render(message *protocol.Message) *gcm.Message {
+	if pt == nil {
+		return nil
+	}
+	t := matching(pt.current(), message)
+	if t == nil {
+		return nil
+	}
+	m, err := execute(t, newTemplateMessage(message))
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"error":      err.Error(),
+			"template":   t.Name(),
+			"message_id": message.ID,
+		}).Error("Could not render the FCM template, passing the body through")
+		return nil
+	}
+	return m
+}
+
+// registration is a template of a topic or of an application, as posted to the templates path
+type registration struct {
+	Topic         string `json:"topic,omitempty"`
+	ApplicationID string `json:"application_id,omitempty"`
+	Template      string `json:"template"`
+}
+
+// ServeHTTP manages the templates: `GET` returns the templates by their keys,
+// `POST` registers a template by a json object like `{"topic":"/news","template":"..."}`
+// or `{"application_id":"app","template":"..."}`, and `DELETE` with the query parameter
+// `topic` or `application_id` removes it.
+func (pt *payloadTemplates) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		entries, err := pt.kvStore.Iterate(TemplatesSchema, "")
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		texts := make(map[string]string)
+		for entry := range entries {
+			texts[entry[0]] = entry[1]
+		}
+		writeJSON(w, texts)
+	case http.MethodPost:
+		r := &registration{}
+		if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"json body could not be decoded: %s"}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		key := templateKey(r.Topic, r.ApplicationID)
+		if key == "" || r.Template == "" {
+			http.Error(w, `{"error":"not all required values were supplied"}`, http.StatusBadRequest)
+			return
+		}
+		if err := pt.set(key, r.Template); err != nil {
+			writeJSONError(w, fmt.Sprintf("invalid template: %v", err), http.StatusBadRequest)
+			return
+		}
+		logger.WithField("key", key).Info("Registered FCM template")
+		writeJSON(w, map[string]string{"registered": key})
+	case http.MethodDelete:
+		key := templateKey(req.URL.Query().Get("topic"), req.URL.Query().Get("application_id"))
+		if key == "" {
+			http.Error(w, `{"error":"missing topic or application_id"}`, http.StatusBadRequest)
+			return
+		}
+		if err := pt.remove(key); err != nil {
+			writeJSONError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.WithField("key", key).Info("Removed FCM template")
+		writeJSON(w, map[string]string{"removed": key})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WithError(err).Error("Writing the FCM templates response failed")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, description string, code int) {
+	data, _ := json.Marshal(map[string]string{"error": description})
+	http.Error(w, string(data), code)
+}
@@ -0,0 +1,141 @@
+package fcm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const newsTemplate = `{"notification":{"title":{{json .Header.title}},"body":{{json .JSON.text}}},"data":{"path":{{json .Path}}}}`
+
+func TestParseTemplate_Validation(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := parseTemplate("/news", newsTemplate)
+	a.NoError(err)
+
+	for _, text := range []string{
+		`{"data":{{.Body`,
+		`not json`,
+		`["a list"]`,
+		`{"data":{{.Unknown}}}`,
+	} {
+		_, err := parseTemplate("/news", text)
+		a.Error(err, text)
+	}
+}
+
+func TestPayloadTemplates_Matching(t *testing.T) {
+	a := assert.New(t)
+
+	pt := newPayloadTemplates(kvstore.NewMemoryKVStore())
+	a.NoError(pt.set(templateKey("/news/", ""), `{"data":{"template":"news"}}`))
+	a.NoError(pt.set(templateKey("/news/sport", ""), `{"data":{"template":"sport"}}`))
+	a.NoError(pt.set(templateKey("", "app1"), `{"data":{"template":"app1"}}`))
+
+	for _, test := range []struct {
+		path, applicationID, template string
+	}{
+		{"/news", "", "news"},
+		{"/news/politics", "app1", "news"},
+		{"/news/sport/football", "", "sport"},
+		{"/weather", "app1", "app1"},
+		{"/weather", "app2", ""},
+		{"/newsletter", "", ""},
+	} {
+		m := pt.render(&protocol.Message{Path: protocol.Path(test.path), ApplicationID: test.applicationID})
+		if test.template == "" {
+			a.Nil(m, test.path)
+			continue
+		}
+		if a.NotNil(m, test.path) {
+			a.Equal(test.template, m.Data["template"], test.path)
+		}
+	}
+}
+
+func TestSender_RendersThePayloadByTheTemplate(t *testing.T) {
+	a := assert.New(t)
+
+	pt := newPayloadTemplates(kvstore.NewMemoryKVStore())
+	a.NoError(pt.set("/news", newsTemplate))
+	s := NewSenderWithMock(nil)
+	s.setTemplates(pt)
+
+	// the template maps the header and the fields of the json body
+	m := s.payload(&protocol.Message{
+		Path:       "/news/local",
+		HeaderJSON: `{"title":"Breaking \"news\""}`,
+		Body:       []byte(`{"text":"a text"}`),
+	})
+	if a.NotNil(m.Notification) {
+		a.Equal(`Breaking "news"`, m.Notification.Title)
+		a.Equal("a text", m.Notification.Body)
+	}
+	a.Equal("/news/local", m.Data["path"])
+
+	// a body, on which the template fails, is passed through
+	pt = newPayloadTemplates(kvstore.NewMemoryKVStore())
+	a.NoError(pt.set("/news", `{"data":{"text":{{json (index .JSON "text")}}}}`))
+	s.setTemplates(pt)
+	m = s.payload(&protocol.Message{Path: "/news", Body: []byte(`["a list"]`)})
+	a.Contains(m.Data, "message")
+
+	// and the messages of a topic without template
+	m = s.payload(&protocol.Message{Path: "/weather", Body: []byte(`plain body`)})
+	a.Contains(m.Data, "message")
+}
+
+func TestConnector_ManagesTheTemplates(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	conn, _ := testFCM(t, false)
+	a.NoError(conn.Start())
+	defer conn.Stop()
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		a.NoError(err)
+		w := httptest.NewRecorder()
+		conn.ServeHTTP(w, req)
+		return w
+	}
+
+	// when registering an invalid template, then it is rejected
+	w := serve(http.MethodPost, "http://localhost/fcm/templates", `{"topic":"/news","template":"not json"}`)
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.Contains(w.Body.String(), "invalid template")
+	w = serve(http.MethodPost, "http://localhost/fcm/templates", `{"template":"{}"}`)
+	a.Equal(http.StatusBadRequest, w.Code)
+
+	// when registering a valid template, then it is listed
+	w = serve(http.MethodPost, "http://localhost/fcm/templates", `{"topic":"/news","template":"{\"data\":{}}"}`)
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"registered":"/news"}`, w.Body.String())
+	w = serve(http.MethodPost, "http://localhost/fcm/templates/", `{"application_id":"app1","template":"{}"}`)
+	a.JSONEq(`{"registered":"app:app1"}`, w.Body.String())
+
+	w = serve(http.MethodGet, "http://localhost/fcm/templates", "")
+	templates := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &templates))
+	a.Equal(map[string]string{"/news": `{"data":{}}`, "app:app1": "{}"}, templates)
+
+	// when removing a template, then it is not rendered any more
+	w = serve(http.MethodDelete, "http://localhost/fcm/templates?topic=/news", "")
+	a.Equal(http.StatusOK, w.Code, w.Body.String())
+	a.Nil(conn.(*fcm).templates.render(&protocol.Message{Path: "/news"}))
+
+	// and the subscriptions are still served
+	w = serve(http.MethodGet, "http://localhost/fcm/?user_id=user01", "")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq("[]", w.Body.String())
+}
@@ -41,7 +41,7 @@ const (
 )
 
 func NewSenderWithMock(gcmSender gcm.Sender) *sender {
-	return &sender{gcmSender: gcmSender}
+	return &sender{keys: []*apiKey{{name: "0-mock", gcmSender: gcmSender}}}
 }
 
 type FCMSender func(message *gcm.Message) (*gcm.Response, error)
@@ -139,7 +139,10 @@ func serviceSetUp(t *testing.T) (*service.Service, func()) {
 	*Config.FCM.APIKey = "WILL BE OVERWRITTEN"
 	*Config.FCM.Prefix = "/fcm/"
 	*Config.FCM.Workers = 1 // use only one worker so we can control the number of messages that go to FCM
+	*Config.FCM.WarmupDuration = 0
 	*Config.APNS.Enabled = false
+	*Config.Webhook.Enabled = false
+	*Config.AuthJWKSURL = ""
 
 	var s *service.Service
 	for s == nil {
@@ -158,7 +161,7 @@ func serviceSetUp(t *testing.T) (*service.Service, func()) {
 
 func clientSetUp(t *testing.T, service *service.Service) client.Client {
 	wsURL := "ws://" + service.WebServer().GetAddr() + "/stream/user/user01"
-	c, err := client.Open(wsURL, "http://localhost/", 1000, false)
+	c, err := client.Open(wsURL, "http://localhost/", 1000, false, false, client.DefaultBackoff, nil, nil, "")
 	assert.NoError(t, err)
 	return c
 }
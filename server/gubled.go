@@ -8,6 +8,8 @@ import (
 	"github.com/smancke/guble/server/apns"
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/cluster"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/device"
 	"github.com/smancke/guble/server/fcm"
 	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/metrics"
@@ -18,17 +20,23 @@ import (
 	"github.com/smancke/guble/server/store"
 	"github.com/smancke/guble/server/store/dummystore"
 	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/server/webhook"
 	"github.com/smancke/guble/server/webserver"
 	"github.com/smancke/guble/server/websocket"
 
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Bogh/gcm"
 	"github.com/pkg/profile"
@@ -37,6 +45,16 @@ import (
 
 const (
 	fileOption = "file"
+
+	// maxMessagesSchema is the key-value store schema holding the max messages limits by topic,
+	// overriding the --max-messages-per-topic flag for the file message store
+	maxMessagesSchema = "ms_max_messages"
+
+	// postgresMaxRetries is the number of retries after a transient error of the PostgreSQL connection
+	postgresMaxRetries = 5
+
+	// leaveTimeout is the maximum duration of each step of leaving the cluster gracefully on SIGTERM
+	leaveTimeout = 10 * time.Second
 )
 
 var AfterMessageDelivery = func(m *protocol.Message) {
@@ -65,6 +83,28 @@ var CreateAccessManager = func() auth.AccessManager {
 	return auth.NewAllowAllAccessManager(true)
 }
 
+// CreateAuthenticator is a func which returns a auth.Authenticator implementation
+// (currently: ClientCertAuthenticator if a TLS client CA is configured, JWTAuthenticator if a JWKS url is configured,
+// otherwise AllowAllAuthenticator).
+var CreateAuthenticator = func() auth.Authenticator {
+	if *Config.TLS.ClientCAFile != "" {
+		if *Config.AuthJWKSURL != "" {
+			logger.Warn("Authenticating the connections by the client certificates, ignoring the JWKS url")
+		}
+		logger.WithField("ca", *Config.TLS.ClientCAFile).Info("Authenticating the connections by the client certificates")
+		return auth.NewClientCertAuthenticator()
+	}
+	if *Config.AuthJWKSURL == "" {
+		return auth.NewAllowAllAuthenticator()
+	}
+	logger.WithField("url", *Config.AuthJWKSURL).Info("Authenticating the connections by JWT")
+	authenticator := auth.NewJWTAuthenticator(*Config.AuthJWKSURL)
+	if *Config.AuthUserClaim != "" {
+		authenticator.UserClaim = *Config.AuthUserClaim
+	}
+	return authenticator
+}
+
 // CreateKVStore is a func which returns a kvstore.KVStore implementation
 // (currently, based on guble configuration).
 var CreateKVStore = func() kvstore.KVStore {
@@ -78,6 +118,10 @@ var CreateKVStore = func() kvstore.KVStore {
 		}
 		return db
 	case "postgres":
+		maxOpenConns := *Config.Postgres.MaxOpenConns
+		if maxOpenConns <= 0 {
+			maxOpenConns = runtime.GOMAXPROCS(0)
+		}
 		db := kvstore.NewPostgresKVStore(kvstore.PostgresConfig{
 			ConnParams: map[string]string{
 				"host":     *Config.Postgres.Host,
@@ -87,8 +131,10 @@ var CreateKVStore = func() kvstore.KVStore {
 				"dbname":   *Config.Postgres.DbName,
 				"sslmode":  "disable",
 			},
-			MaxIdleConns: 1,
-			MaxOpenConns: runtime.GOMAXPROCS(0),
+			DSN:          *Config.Postgres.DSN,
+			MaxIdleConns: *Config.Postgres.MaxIdleConns,
+			MaxOpenConns: maxOpenConns,
+			MaxRetries:   postgresMaxRetries,
 		})
 		if err := db.Open(); err != nil {
 			logger.WithError(err).Panic("Could not open postgres database connection")
@@ -103,33 +149,133 @@ var CreateKVStore = func() kvstore.KVStore {
 // (currently, based on guble configuration).
 var CreateMessageStore = func() store.MessageStore {
 	switch *Config.MS {
-	case "none", "memory", "":
+	case "none", "":
 		return dummystore.New(kvstore.NewMemoryKVStore())
+	case "memory":
+		logger.WithField("size", *Config.StoreMemorySize).Info("Using MemoryMessageStore")
+		mms := memorystore.New(*Config.StoreMemorySize)
+		mms.SetIDGenerator(newIDGenerator())
+		return mms
 	case "file":
 		logger.WithField("storagePath", *Config.StoragePath).Info("Using FileMessageStore in directory")
-		return filestore.New(*Config.StoragePath)
+		fms := filestore.New(*Config.StoragePath)
+		fms.SetIDGenerator(newIDGenerator())
+		if Config.MSTTL != nil {
+			for topic, ttl := range *Config.MSTTL {
+				logger.WithFields(log.Fields{"topic": topic, "ttl": ttl}).Info("Setting message TTL")
+				fms.SetTTL(topic, ttl)
+			}
+		}
+		if Config.MSCompactionKeys != nil {
+			for topic, key := range *Config.MSCompactionKeys {
+				logger.WithFields(log.Fields{"topic": topic, "key": key}).Info("Compacting the messages by key")
+				fms.SetCompactionKey(topic, key)
+			}
+		}
+		if Config.MSIndexedHeaders != nil {
+			for topic, keys := range *Config.MSIndexedHeaders {
+				logger.WithFields(log.Fields{"topic": topic, "keys": keys}).Info("Indexing the message headers")
+				fms.SetIndexedHeaders(topic, keys)
+			}
+		}
+		fms.SetDefaultMaxMessages(*Config.MaxMessagesPerTopic)
+		if *Config.StoreBatchSize > 0 {
+			logger.WithFields(log.Fields{
+				"size":   *Config.StoreBatchSize,
+				"linger": *Config.StoreBatchLinger,
+			}).Info("Batching the writes of the FileMessageStore")
+			fms.SetBatching(*Config.StoreBatchSize, *Config.StoreBatchLinger)
+		}
+		if *Config.StoreCompress {
+			logger.Info("Compressing the sealed files of the FileMessageStore")
+			fms.SetCompression(true)
+		}
+		fms.SetCorruptionPolicy(filestore.CorruptionPolicy(*Config.StoreOnCorruption))
+		fms.SetMinFreeSpace(*Config.StoreMinFreeBytes, *Config.StoreMinFreePercent)
+		fms.SetLockTimeout(restartLockTimeout(*Config.RestartTimeout))
+		return fms
 	default:
 		panic(fmt.Errorf("Unknown message-store backend: %q", *Config.MS))
 	}
 }
 
+// newIDGenerator returns the generator of the message ids selected by the configuration
+func newIDGenerator() store.IDGenerator {
+	if *Config.IDGenerator == idGeneratorSnowflake {
+		logger.Info("Generating snowflake message ids")
+		return store.NewSnowflakeIDGenerator()
+	}
+	if *Config.Cluster.NodeID > 0 {
+		logger.Warn("The sequential message ids of the nodes of a cluster can collide, use --id-generator snowflake")
+	}
+	return store.SequenceIDGenerator{}
+}
+
 // CreateModules is a func which returns a slice of modules which should be used by the service
 // (currently, based on guble configuration);
 // see package `service` for terminological details.
 var CreateModules = func(router router.Router) []interface{} {
 	var modules []interface{}
 
-	if wsHandler, err := websocket.NewWSHandler(router, "/stream/"); err != nil {
+	authenticator := CreateAuthenticator()
+
+	wsHandler, err := websocket.NewWSHandler(router, "/stream/")
+	if err != nil {
 		logger.WithError(err).Error("Error loading WSHandler module")
 	} else {
+		wsHandler.CompressThreshold = *Config.WSCompressThreshold
+		wsHandler.PingInterval = *Config.WSPingInterval
+		wsHandler.PongTimeout = *Config.WSPongTimeout
+		wsHandler.MaxMessageSize = int(*Config.MaxMessageSize)
+		wsHandler.SetRateLimit(*Config.PerUserRate, *Config.PerUserBurst)
+		if err := wsHandler.SetSessionExpiry(*Config.WSSessionExpiry); err != nil {
+			logger.WithError(err).Error("Error enabling the websocket sessions")
+		}
+		if err := wsHandler.SetBackpressure(*Config.WSHighWaterMark, *Config.WSLowWaterMark); err != nil {
+			logger.WithError(err).Error("Error enabling the backpressure of the websocket connections")
+		}
+		wsHandler.Authenticator = authenticator
+		if cors := newCORS(); cors != nil {
+			wsHandler.CheckOrigin = cors.AllowsOrigin
+		}
 		modules = append(modules, wsHandler)
 	}
 
-	modules = append(modules, rest.NewRestMessageAPI(router, "/api/"))
+	restAPI := rest.NewRestMessageAPI(router, "/api/")
+	restAPI.MaxMessageSize = int(*Config.MaxMessageSize)
+	restAPI.Authenticator = authenticator
+	restAPI.AdminUser = *Config.AdminUser
+	restAPI.WriteTimeout = *Config.HttpWriteTimeout
+	if wsHandler != nil {
+		restAPI.Reconnector = wsHandler
+	}
+	modules = append(modules, restAPI)
+
+	var connectors []connector.Connector
+
+	// the delivery events of the connectors are opt-in
+	if *Config.ConnectorEvents && (*Config.FCM.Enabled || *Config.APNS.Enabled || *Config.Webhook.Enabled) {
+		logger.WithField("topic", *Config.ConnectorEventsTopic).Info("Publishing the delivery events of the connectors")
+		events := connector.NewEvents(router, protocol.Path(*Config.ConnectorEventsTopic))
+		Config.FCM.Events = events
+		Config.APNS.Events = events
+		Config.Webhook.Events = events
+		modules = append(modules, events)
+	}
+
+	// the devices registered with a platform token are subscribed through the FCM and APNS connectors
+	var registry *device.Registry
+	if *Config.FCM.Enabled || *Config.APNS.Enabled {
+		registry = device.NewRegistry("/devices/", router)
+		Config.FCM.InvalidSubscriber = registry.RemoveInvalid
+		Config.APNS.InvalidSubscriber = registry.RemoveInvalid
+		modules = append(modules, registry)
+	}
 
 	if *Config.FCM.Enabled {
 		logger.Info("Firebase Cloud Messaging: enabled")
-		if *Config.FCM.APIKey == "" {
+		apiKeys := fcm.SplitAPIKeys(*Config.FCM.APIKey)
+		if len(apiKeys) == 0 {
 			logger.Panic("The API Key has to be provided when Firebase Cloud Messaging is enabled")
 		}
 		Config.FCM.AfterMessageDelivery = AfterMessageDelivery
@@ -137,11 +283,17 @@ var CreateModules = func(router router.Router) []interface{} {
 		if Config.FCM.Endpoint != nil {
 			gcm.GcmSendEndpoint = *Config.FCM.Endpoint
 		}
-		sender := fcm.NewSender(*Config.FCM.APIKey)
+		sender := fcm.NewSender(apiKeys, *Config.FCM.KeyStrategy)
+		if *Config.FCM.DryRun {
+			logger.Info("Firebase Cloud Messaging: dry run, the messages are logged instead of sent")
+			sender = fcm.NewDryRunSender(apiKeys, *Config.FCM.KeyStrategy)
+		}
 		if fcmConn, err := fcm.New(router, sender, Config.FCM); err != nil {
 			logger.WithError(err).Error("Error creating FCM connector")
 		} else {
 			modules = append(modules, fcmConn)
+			connectors = append(connectors, fcmConn)
+			registry.SetConnector(device.Android, fcmConn)
 		}
 	} else {
 		logger.Info("Firebase Cloud Messaging: disabled")
@@ -154,11 +306,17 @@ var CreateModules = func(router router.Router) []interface{} {
 			logger.Info("APNS: enabled in development mode")
 		}
 		logger.Info("APNS: enabled")
-		if *Config.APNS.CertificateFileName == "" && Config.APNS.CertificateBytes == nil {
-			logger.Panic("The certificate (as filename or bytes) has to be provided when APNS is enabled")
-		}
-		if *Config.APNS.CertificatePassword == "" {
-			logger.Panic("A non-empty password has to be provided when APNS is enabled")
+		if Config.APNS.TokenAuth() {
+			if *Config.APNS.AuthKeyID == "" || *Config.APNS.TeamID == "" {
+				logger.Panic("The key id and the team id have to be provided with the APNS auth key file")
+			}
+		} else {
+			if *Config.APNS.CertificateFileName == "" && Config.APNS.CertificateBytes == nil {
+				logger.Panic("The certificate (as filename or bytes) has to be provided when APNS is enabled")
+			}
+			if *Config.APNS.CertificatePassword == "" {
+				logger.Panic("A non-empty password has to be provided when APNS is enabled")
+			}
 		}
 		if *Config.APNS.AppTopic == "" {
 			logger.Panic("The Mobile App Topic (usually the bundle-id) has to be provided when APNS is enabled")
@@ -172,23 +330,22 @@ var CreateModules = func(router router.Router) []interface{} {
 			logger.WithError(err).Error("Error creating APNS connector")
 		} else {
 			modules = append(modules, apnsConn)
+			connectors = append(connectors, apnsConn)
+			registry.SetConnector(device.IOS, apnsConn)
 		}
 	} else {
 		logger.Info("APNS: disabled")
 	}
 
 	if *Config.SMS.Enabled {
-		logger.Info("Nexmo SMS: enabled")
-		if *Config.SMS.APIKey == "" || *Config.SMS.APISecret == "" {
-			logger.Panic("The API Key has to be provided when NEXMO SMS connector is enabled")
-		}
-		nexmoSender, err := sms.NewNexmoSender(*Config.SMS.APIKey, *Config.SMS.APISecret)
+		logger.WithField("provider", *Config.SMS.Provider).Info("SMS: enabled")
+		provider, err := sms.NewProvider(*Config.SMS.Provider, Config.SMS)
 		if err != nil {
-			logger.WithError(err).Error("Error creating Nexmo Sender")
+			logger.WithError(err).Panic("Error creating SMS provider")
 		}
-		smsConn, err := sms.New(router, nexmoSender, Config.SMS)
+		smsConn, err := sms.New(router, sms.NewSender(provider), Config.SMS)
 		if err != nil {
-			logger.WithError(err).Error("Error creating Nexmo Sender")
+			logger.WithError(err).Error("Error creating SMS connector")
 		} else {
 			modules = append(modules, smsConn)
 		}
@@ -196,9 +353,57 @@ var CreateModules = func(router router.Router) []interface{} {
 		logger.Info("SMS: disabled")
 	}
 
+	if *Config.Webhook.Enabled {
+		logger.Info("Webhook: enabled")
+		if webhookConn, err := webhook.New(router, webhook.NewSender(Config.Webhook), Config.Webhook); err != nil {
+			logger.WithError(err).Error("Error creating webhook connector")
+		} else {
+			modules = append(modules, webhookConn)
+			connectors = append(connectors, webhookConn)
+		}
+	} else {
+		logger.Info("Webhook: disabled")
+	}
+
+	if len(connectors) > 0 {
+		modules = append(modules, connector.NewSubscriptionsAPI("/api/connector/", connectors...))
+	}
+
 	return modules
 }
 
+// configureLogging sets the output and the formatter of the logs, as configured
+func configureLogging() error {
+	var output io.Writer
+	switch *Config.LogOutput {
+	case logOutputStderr:
+		output = os.Stderr
+	case logOutputStdout:
+		output = os.Stdout
+	default:
+		file, err := os.OpenFile(*Config.LogOutput, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	log.SetOutput(output)
+
+	switch *Config.LogFormat {
+	case logFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	case logFormatLogstash:
+		log.SetFormatter(&logformatter.LogstashFormatter{Env: *Config.EnvName})
+	default:
+		if file, ok := output.(*os.File); !ok || !terminal.IsTerminal(int(file.Fd())) {
+			log.SetFormatter(&logformatter.LogstashFormatter{Env: *Config.EnvName})
+		}
+	}
+	return nil
+}
+
 // Main is the entry-point of the guble server.
 func Main() {
 	defer func() {
@@ -209,8 +414,8 @@ func Main() {
 
 	parseConfig()
 
-	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
-		log.SetFormatter(&logformatter.LogstashFormatter{Env: *Config.EnvName})
+	if err := configureLogging(); err != nil {
+		logger.WithError(err).Fatal("Could not configure the logging")
 	}
 
 	level, err := log.ParseLevel(*Config.Log)
@@ -233,17 +438,42 @@ func Main() {
 		logger.Debug("no profiling was started")
 	}
 
+	if err := inheritListener(); err != nil {
+		logger.WithError(err).Fatal("Could not inherit the listener of the old process")
+	}
+
 	if err := ValidateStoragePath(); err != nil {
 		logger.Fatal("Fatal error in gubled in validation of storage path")
 	}
 
+	if *Config.StoreMigrate {
+		if err := filestore.New(*Config.StoragePath).Migrate(); err != nil {
+			logger.WithError(err).WithField("storagePath", *Config.StoragePath).Fatal("Could not migrate the file message store")
+		}
+		logger.WithField("version", filestore.StoreVersion).Info("Migrated the file message store")
+		return
+	}
+
 	srv := StartService()
 	if srv == nil {
 		logger.Fatal("exiting because of unrecoverable error(s) when starting the service")
 	}
+	if err := signalReady(); err != nil {
+		logger.WithError(err).Error("Could not report the start to the old process")
+	}
+	if srv.WebServer().TLSEnabled() {
+		go reloadCertificateOnHangup(srv.WebServer())
+	}
+	go restartOnSignal(srv, *Config.RestartTimeout)
 
-	waitForTermination(func() {
-		err := srv.Stop()
+	waitForTermination(func(sig os.Signal) {
+		var err error
+		if sig == syscall.SIGTERM {
+			// e.g. a terminated pod: leave the cluster cleanly, instead of being detected as failed by the other nodes
+			err = srv.Leave(leaveTimeout)
+		} else {
+			err = srv.Stop()
+		}
 		if err != nil {
 			logger.WithField("error", err.Error()).Error("errors occurred while stopping service")
 		}
@@ -254,20 +484,42 @@ func Main() {
 func StartService() *service.Service {
 	//TODO StartService could return an error in case it fails to start
 
+	if err := applyClusterFile(&Config.Cluster); err != nil {
+		logger.WithError(err).WithField("file", *Config.Cluster.ConfigFile).Fatal("Invalid cluster configuration")
+	}
+
 	accessManager := CreateAccessManager()
 	messageStore := CreateMessageStore()
 	kvStore := CreateKVStore()
 
+	if fms, ok := messageStore.(*filestore.FileMessageStore); ok {
+		setMaxMessagesFromKVStore(fms, kvStore)
+	}
+
+	if *Config.ACL {
+		logger.Info("Restricting the topics by the access control lists")
+		acl := auth.NewACLAccessManager(kvStore, accessManager)
+		acl.Owner = *Config.ACLOwner
+		accessManager = acl
+	}
+
 	var cl *cluster.Cluster
 	var err error
 
 	if *Config.Cluster.NodeID > 0 {
 		exitIfInvalidClusterParams(*Config.Cluster.NodeID, *Config.Cluster.NodePort, *Config.Cluster.Remotes)
+		var advertise *net.TCPAddr
+		if advertise, err = advertiseAddr(&Config.Cluster); err != nil {
+			logger.WithError(err).Fatal("Invalid advertised address of the cluster node")
+		}
 		logger.Info("Starting in cluster-mode")
 		cl, err = cluster.New(&cluster.Config{
-			ID:      *Config.Cluster.NodeID,
-			Port:    *Config.Cluster.NodePort,
-			Remotes: *Config.Cluster.Remotes,
+			ID:             *Config.Cluster.NodeID,
+			Host:           *Config.Cluster.Host,
+			Port:           *Config.Cluster.NodePort,
+			Remotes:        *Config.Cluster.Remotes,
+			Advertise:      advertise,
+			MaxMessageSize: int(*Config.MaxMessageSize),
 		})
 		if err != nil {
 			logger.WithField("err", err).Fatal("Module could not be started (cluster)")
@@ -277,11 +529,63 @@ func StartService() *service.Service {
 	}
 
 	r := router.New(accessManager, messageStore, kvStore, cl)
+	if dedup, ok := r.(router.Deduplicator); ok && *Config.DedupWindow > 0 {
+		logger.WithField("window", *Config.DedupWindow).Info("Deduplicating messages by their idempotency key")
+		dedup.SetDeduplication(*Config.DedupWindow, *Config.DedupMaxKeys)
+	}
+	if monitor, ok := r.(router.LagMonitor); ok && *Config.SlowConsumerLag > 0 {
+		logger.WithFields(log.Fields{
+			"lag":        *Config.SlowConsumerLag,
+			"disconnect": *Config.DisconnectSlow,
+		}).Info("Monitoring the lag of the subscribers")
+		monitor.SetLagThreshold(uint64(*Config.SlowConsumerLag), *Config.DisconnectSlow)
+	}
+	if limiter, ok := r.(router.FanOutLimiter); ok && (*Config.MaxSubscribers > 0 || *Config.DeliveryWorkers > 0) {
+		logger.WithFields(log.Fields{
+			"maxSubscribers": *Config.MaxSubscribers,
+			"workers":        *Config.DeliveryWorkers,
+		}).Info("Limiting the fan-out of the topics")
+		limiter.SetFanOut(*Config.MaxSubscribers, *Config.DeliveryWorkers)
+	}
+	if limiter, ok := r.(router.TopicLimiter); ok && (*Config.MaxTopics > 0 || *Config.TopicIdleTimeout > 0) {
+		logger.WithFields(log.Fields{
+			"maxTopics":   *Config.MaxTopics,
+			"idleTimeout": *Config.TopicIdleTimeout,
+		}).Info("Limiting the topics of the node")
+		limiter.SetMaxTopics(*Config.MaxTopics, *Config.TopicIdleTimeout)
+	}
+	if pauser, ok := r.(router.Pauser); ok {
+		pauser.SetMaxPausedMessages(*Config.MaxPausedMessages)
+	}
+	if tracer, ok := r.(router.MessageTracer); ok && *Config.TraceIDs {
+		logger.Info("Generating the trace ids of the published messages")
+		tracer.SetTracing(true)
+	}
+	if throttler, ok := r.(router.ReplayThrottler); ok && (*Config.ReplayMaxRate > 0 || *Config.ReplayMaxTopicRate > 0) {
+		logger.WithFields(log.Fields{
+			"rate":      *Config.ReplayMaxRate,
+			"topicRate": *Config.ReplayMaxTopicRate,
+		}).Info("Throttling the replay from the message store")
+		throttler.SetReplayRate(*Config.ReplayMaxRate, *Config.ReplayMaxTopicRate)
+	}
 	websrv := webserver.New(*Config.HttpListen)
+	websrv.ReadTimeout = *Config.HttpReadTimeout
+	websrv.WriteTimeout = *Config.HttpWriteTimeout
+	websrv.IdleTimeout = *Config.HttpIdleTimeout
+	websrv.HTTP2 = *Config.HTTP2
+	websrv.CORS = newCORS()
+	if *Config.AccessLog {
+		websrv.AccessLog = webserver.NewAccessLog(*Config.AccessLogExclude)
+	}
+	websrv.Listener = inheritedListener
+	if err := configureTLS(websrv); err != nil {
+		logger.WithError(err).Fatal("Invalid TLS configuration")
+	}
 
 	srv := service.New(r, websrv).
 		HealthEndpoint(*Config.HealthEndpoint).
-		MetricsEndpoint(*Config.MetricsEndpoint)
+		MetricsEndpoint(*Config.MetricsEndpoint).
+		PrometheusEndpoint(*Config.PrometheusEndpoint)
 
 	srv.RegisterModules(0, 6, kvStore, messageStore)
 	srv.RegisterModules(4, 3, CreateModules(r)...)
@@ -297,6 +601,84 @@ func StartService() *service.Service {
 	return srv
 }
 
+// newCORS returns the CORS of the allowed origins, or nil if CORS is not enabled
+func newCORS() *webserver.CORS {
+	if *Config.CORS.AllowOrigins == "" {
+		return nil
+	}
+	return webserver.NewCORS(*Config.CORS.AllowOrigins, *Config.CORS.AllowMethods, *Config.CORS.AllowCredentials)
+}
+
+// configureTLS enables serving HTTPS and WSS in the webserver, if a certificate is configured
+func configureTLS(websrv *webserver.WebServer) error {
+	certFile, keyFile := *Config.TLS.CertFile, *Config.TLS.KeyFile
+	if certFile == "" && keyFile == "" {
+		if *Config.TLS.ClientCAFile != "" {
+			return errors.New("The --tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return errors.New("Both --tls-cert and --tls-key are required for TLS")
+	}
+
+	minVersion, err := webserver.ParseTLSVersion(*Config.TLS.MinVersion)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, name := range strings.Split(*Config.TLS.CipherSuites, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	cipherSuites, err := webserver.ParseCipherSuites(names)
+	if err != nil {
+		return err
+	}
+
+	websrv.TLSCertFile = certFile
+	websrv.TLSKeyFile = keyFile
+	websrv.TLSMinVersion = minVersion
+	websrv.TLSCipherSuites = cipherSuites
+	websrv.TLSClientCAFile = *Config.TLS.ClientCAFile
+	return nil
+}
+
+// reloadCertificateOnHangup reloads the TLS certificate of the webserver on each SIGHUP,
+// e.g. after the certificate was renewed, without closing the open connections.
+func reloadCertificateOnHangup(websrv *webserver.WebServer) {
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, syscall.SIGHUP)
+	for range signalC {
+		if err := websrv.ReloadCertificate(); err != nil {
+			logger.WithError(err).Error("Could not reload the TLS certificate, keeping the current one")
+			continue
+		}
+		logger.Info("Reloaded the TLS certificate")
+	}
+}
+
+// setMaxMessagesFromKVStore sets the max messages limits of the topics found in the key-value store,
+// stored as a decimal number with the topic as key
+func setMaxMessagesFromKVStore(fms *filestore.FileMessageStore, kvStore kvstore.KVStore) {
+	entries, err := kvStore.Iterate(maxMessagesSchema, "")
+	if err != nil {
+		logger.WithError(err).Error("Could not read the max messages limits from the key-value store")
+		return
+	}
+	for entry := range entries {
+		topic, value := entry[0], entry[1]
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			logger.WithError(err).WithField("topic", topic).Error("Invalid max messages limit in the key-value store")
+			continue
+		}
+		logger.WithFields(log.Fields{"topic": topic, "maxMessages": n}).Info("Setting max messages")
+		fms.SetMaxMessages(topic, n)
+	}
+}
+
 func exitIfInvalidClusterParams(nodeID uint8, nodePort int, remotes []*net.TCPAddr) {
 	if (nodeID <= 0 && len(remotes) > 0) || (nodePort <= 0) {
 		errorMessage := "Could not start in cluster-mode: invalid/incomplete parameters"
@@ -308,12 +690,12 @@ func exitIfInvalidClusterParams(nodeID uint8, nodePort int, remotes []*net.TCPAd
 	}
 }
 
-func waitForTermination(callback func()) {
+func waitForTermination(callback func(os.Signal)) {
 	signalC := make(chan os.Signal)
 	signal.Notify(signalC, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-signalC
 	logger.Infof("Got signal '%v' .. exiting gracefully now", sig)
-	callback()
+	callback(sig)
 	metrics.LogOnDebugLevel()
 	logger.Info("Exit gracefully now")
 	os.Exit(0)
@@ -1,11 +1,17 @@
 package server
 
 import (
+	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/webserver"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/smancke/guble/testutil"
 	"github.com/stretchr/testify/assert"
 
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -32,6 +38,110 @@ func TestValidateStoragePath(t *testing.T) {
 	a.Error(ValidateStoragePath())
 }
 
+func TestSetMaxMessagesFromKVStore(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_max_messages_test")
+	defer os.RemoveAll(dir)
+
+	// given a store keeping one message per topic, overridden for /foo in the kv store
+	fms := filestore.New(dir)
+	fms.SetDefaultMaxMessages(1)
+	kvs := kvstore.NewMemoryKVStore()
+	a.NoError(kvs.Put(maxMessagesSchema, "/foo", []byte("2")))
+	a.NoError(kvs.Put(maxMessagesSchema, "/bar", []byte("invalid")))
+
+	// when setting the limits from the kv store
+	setMaxMessagesFromKVStore(fms, kvs)
+
+	// then /foo keeps two messages and /bar the default one
+	for i := 0; i < 3; i++ {
+		_, err := fms.StoreMessage(&protocol.Message{Path: "/foo", Body: []byte("foo")}, 0)
+		a.NoError(err)
+		_, err = fms.StoreMessage(&protocol.Message{Path: "/bar", Body: []byte("bar")}, 0)
+		a.NoError(err)
+	}
+	foo, err := fms.Partition("foo")
+	a.NoError(err)
+	a.Equal(uint64(2), foo.Count())
+	bar, err := fms.Partition("bar")
+	a.NoError(err)
+	a.Equal(uint64(1), bar.Count())
+}
+
+func TestConfigureLoggingToAFileInJSON(t *testing.T) {
+	a := assert.New(t)
+	defer func(format, output string) {
+		*Config.LogFormat, *Config.LogOutput = format, output
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(&log.TextFormatter{})
+	}(*Config.LogFormat, *Config.LogOutput)
+
+	dir, _ := ioutil.TempDir("", "guble_logging_test")
+	defer os.RemoveAll(dir)
+
+	// given a json log format and a file as output
+	*Config.LogFormat = "json"
+	*Config.LogOutput = dir + "/guble.log"
+	a.NoError(configureLogging())
+
+	// when logging
+	log.WithFields(log.Fields{"topic": "/foo", "message_id": 42}).Error("Hello")
+
+	// then the entry is written as json to the file
+	data, err := ioutil.ReadFile(dir + "/guble.log")
+	a.NoError(err)
+	entry := make(map[string]interface{})
+	a.NoError(json.Unmarshal(data, &entry))
+	a.Equal("Hello", entry["msg"])
+	a.Equal("/foo", entry["topic"])
+	a.Equal(float64(42), entry["message_id"])
+
+	// and a log output in a non-existing directory is an error
+	*Config.LogOutput = dir + "/non-existing/guble.log"
+	a.Error(configureLogging())
+}
+
+func TestConfigureTLS(t *testing.T) {
+	a := assert.New(t)
+	defer func(cert, key, version, ciphers, clientCA string) {
+		*Config.TLS.CertFile, *Config.TLS.KeyFile, *Config.TLS.MinVersion, *Config.TLS.CipherSuites = cert, key, version, ciphers
+		*Config.TLS.ClientCAFile = clientCA
+	}(*Config.TLS.CertFile, *Config.TLS.KeyFile, *Config.TLS.MinVersion, *Config.TLS.CipherSuites, *Config.TLS.ClientCAFile)
+
+	// without a certificate TLS is disabled
+	*Config.TLS.CertFile, *Config.TLS.KeyFile = "", ""
+	websrv := webserver.New(":0")
+	a.NoError(configureTLS(websrv))
+	a.False(websrv.TLSEnabled())
+
+	// and the client certificates require TLS
+	*Config.TLS.ClientCAFile = "ca.pem"
+	a.Error(configureTLS(websrv))
+	*Config.TLS.ClientCAFile = ""
+
+	// a certificate requires a key
+	*Config.TLS.CertFile = "cert.pem"
+	a.Error(configureTLS(websrv))
+
+	// and the cipher suites have to be known
+	*Config.TLS.KeyFile = "key.pem"
+	*Config.TLS.MinVersion = "1.2"
+	*Config.TLS.CipherSuites = "TLS_UNKNOWN"
+	a.Error(configureTLS(websrv))
+
+	*Config.TLS.CipherSuites = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	a.NoError(configureTLS(websrv))
+	a.True(websrv.TLSEnabled())
+	a.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, websrv.TLSCipherSuites)
+	a.Equal(uint16(tls.VersionTLS12), websrv.TLSMinVersion)
+	a.Equal("", websrv.TLSClientCAFile)
+
+	*Config.TLS.ClientCAFile = "ca.pem"
+	a.NoError(configureTLS(websrv))
+	a.Equal("ca.pem", websrv.TLSClientCAFile)
+}
+
 func TestCreateKVStoreBackend(t *testing.T) {
 	a := assert.New(t)
 	*Config.KVS = "memory"
@@ -47,18 +157,31 @@ func TestCreateKVStoreBackend(t *testing.T) {
 	a.Equal("*kvstore.SqliteKVStore", reflect.TypeOf(sqlite).String())
 }
 
+func TestCreateMessageStoreBackend(t *testing.T) {
+	a := assert.New(t)
+	defer func() { *Config.MS = "file" }()
+
+	*Config.MS = "memory"
+	a.Equal("*memorystore.MemoryMessageStore", reflect.TypeOf(CreateMessageStore()).String())
+
+	*Config.MS = "none"
+	a.Equal("*dummystore.DummyMessageStore", reflect.TypeOf(CreateMessageStore()).String())
+}
+
 func TestFCMOnlyStartedIfEnabled(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
 
 	a := assert.New(t)
 
+	defer withoutSessions()()
 	routerMock := initRouterMock()
 	routerMock.EXPECT().KVStore().Return(kvstore.NewMemoryKVStore(), nil)
 
 	*Config.FCM.Enabled = true
 	*Config.FCM.APIKey = "xyz"
 	*Config.APNS.Enabled = false
+	*Config.Webhook.Enabled = false
 	a.True(containsFCMModule(CreateModules(routerMock)))
 
 	*Config.FCM.Enabled = false
@@ -74,6 +197,34 @@ func containsFCMModule(modules []interface{}) bool {
 	return false
 }
 
+func TestWebhookOnlyStartedIfEnabled(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	defer withoutSessions()()
+	routerMock := initRouterMock()
+	routerMock.EXPECT().KVStore().Return(kvstore.NewMemoryKVStore(), nil)
+
+	*Config.FCM.Enabled = false
+	*Config.APNS.Enabled = false
+	*Config.Webhook.Enabled = true
+	a.True(containsModule(CreateModules(routerMock), "*webhook.webhook"))
+
+	*Config.Webhook.Enabled = false
+	a.False(containsModule(CreateModules(routerMock), "*webhook.webhook"))
+}
+
+func containsModule(modules []interface{}, typeName string) bool {
+	for _, module := range modules {
+		if reflect.TypeOf(module).String() == typeName {
+			return true
+		}
+	}
+	return false
+}
+
 func TestPanicOnMissingFCMApiKey(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -85,6 +236,7 @@ func TestPanicOnMissingFCMApiKey(t *testing.T) {
 		}
 	}()
 
+	defer withoutSessions()()
 	routerMock := initRouterMock()
 	*Config.FCM.APIKey = ""
 	*Config.FCM.Enabled = true
@@ -114,6 +266,8 @@ func TestStartServiceModules(t *testing.T) {
 	*Config.MS = "file"
 	*Config.FCM.Enabled = false
 	*Config.APNS.Enabled = false
+	*Config.Webhook.Enabled = false
+	*Config.AuthJWKSURL = ""
 
 	// using an available port for http
 	testHttpPort++
@@ -133,6 +287,14 @@ func TestStartServiceModules(t *testing.T) {
 		strings.Join(moduleNames, " "))
 }
 
+// withoutSessions disables the websocket sessions, so that the kvstore is only requested by the connectors.
+// It returns the function restoring the session expiry.
+func withoutSessions() func() {
+	expiry := *Config.WSSessionExpiry
+	*Config.WSSessionExpiry = 0
+	return func() { *Config.WSSessionExpiry = expiry }
+}
+
 func initRouterMock() *MockRouter {
 	routerMock := NewMockRouter(testutil.MockCtrl)
 	routerMock.EXPECT().Cluster().Return(nil).AnyTimes()
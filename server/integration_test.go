@@ -3,11 +3,13 @@ package server
 import (
 	"github.com/smancke/guble/client"
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/server/service"
 
 	"github.com/stretchr/testify/assert"
 
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,19 +25,20 @@ import (
 func initServerAndClients(t *testing.T) (*service.Service, client.Client, client.Client, func()) {
 	*Config.HttpListen = "localhost:0"
 	*Config.KVS = "memory"
+	*Config.AuthJWKSURL = ""
 	s := StartService()
 
 	time.Sleep(time.Millisecond * 100)
 
 	var err error
-	client1, err := client.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user1", "http://localhost", 1, false)
+	client1, err := client.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user1", "http://localhost", 1, false, false, client.DefaultBackoff, nil, nil, "")
 	assert.NoError(t, err)
 
 	checkConnectedNotificationJSON(t, "user1",
 		expectStatusMessage(t, client1, protocol.SUCCESS_CONNECTED, "You are connected to the server."),
 	)
 
-	client2, err := client.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user2", "http://localhost", 1, false)
+	client2, err := client.Open("ws://"+s.WebServer().GetAddr()+"/stream/user/user2", "http://localhost", 1, false, false, client.DefaultBackoff, nil, nil, "")
 	assert.NoError(t, err)
 	checkConnectedNotificationJSON(t, "user2",
 		expectStatusMessage(t, client2, protocol.SUCCESS_CONNECTED, "You are connected to the server."),
@@ -54,7 +57,7 @@ func initServerAndClients(t *testing.T) (*service.Service, client.Client, client
 
 func expectStatusMessage(t *testing.T, client client.Client, name string, arg string) string {
 	select {
-	case notify := <-client.StatusMessages():
+	case notify := <-client.StatusUpdates():
 		assert.Equal(t, name, notify.Name)
 		assert.Equal(t, arg, notify.Arg)
 		return notify.Json
@@ -75,12 +78,6 @@ func checkConnectedNotificationJSON(t *testing.T, user string, connectedJSON str
 	assert.NoError(t, e)
 }
 
-//Used only for test and unmarshalling of the json response
-type Subscriber struct {
-	DeviceToken string `json:"device_token"`
-	UserID      string `json:"user_id"`
-}
-
 func TestSubscribersIntegration(t *testing.T) {
 	defer testutil.SkipIfShort(t)
 	defer testutil.SkipIfDisabled(t)
@@ -99,13 +96,13 @@ func TestSubscribersIntegration(t *testing.T) {
 	restClient := restclient.New(fmt.Sprintf("http://%s/api", s.WebServer().GetAddr()))
 	content, err := restClient.GetSubscribers(testTopic)
 	a.NoError(err)
-	routeParams := make([]*Subscriber, 0)
+	subscribers := make([]*router.Subscriber, 0)
 
-	err = json.Unmarshal(content, &routeParams)
-	a.Equal(4, len(routeParams), "Should have 4 subscribers")
-	for i, rp := range routeParams {
-		a.Equal(fmt.Sprintf("gcmId%d", i), rp.DeviceToken)
-		a.Equal(fmt.Sprintf("user%d", i), rp.UserID)
+	err = json.Unmarshal(content, &subscribers)
+	a.Equal(4, len(subscribers), "Should have 4 subscribers")
+	for i, s := range subscribers {
+		a.Equal(fmt.Sprintf("gcmId%d", i), s.Route["device_token"])
+		a.Equal(fmt.Sprintf("user%d", i), s.UserID)
 	}
 	a.NoError(err)
 }
@@ -131,3 +128,244 @@ func subscribeMultipleClients(t *testing.T, service *service.Service, noOfClient
 		a.Equal(fmt.Sprintf(`{"subscribed":"%s"}`, testTopic), string(body))
 	}
 }
+
+func TestAckIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	s, cleanup := serviceSetUp(t)
+	defer cleanup()
+	defer s.Stop()
+
+	wsURL := "ws://" + s.WebServer().GetAddr() + "/stream/user/user1"
+	publisher, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer publisher.Close()
+
+	// given a client subscribed with at-least-once delivery
+	receiver, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	a.NoError(receiver.SubscribeWithAck("/ack"))
+	time.Sleep(time.Millisecond * 50)
+
+	// which acknowledges the first message, but not the second
+	a.NoError(publisher.Send("/ack", "first", ""))
+	first := expectMessage(t, receiver, "first")
+	a.NoError(receiver.Ack("/ack", first.ID))
+	a.NoError(publisher.Send("/ack", "second", ""))
+	expectMessage(t, receiver, "second")
+	time.Sleep(time.Millisecond * 50)
+	receiver.Close()
+
+	// when subscribing again, then the not acknowledged message is replayed
+	receiver, err = client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer receiver.Close()
+	a.NoError(receiver.SubscribeWithAck("/ack"))
+	expectMessage(t, receiver, "second")
+}
+
+func TestSendWithHeaderIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	s, cleanup := serviceSetUp(t)
+	defer cleanup()
+	defer s.Stop()
+
+	wsURL := "ws://" + s.WebServer().GetAddr() + "/stream/user/user1"
+	publisher, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer publisher.Close()
+
+	// given a client subscribed with a filter on a header field
+	receiver, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer receiver.Close()
+	a.NoError(receiver.Subscribe("/headers filter:region=eu"))
+	time.Sleep(time.Millisecond * 50)
+
+	// when messages are sent with header fields
+	a.NoError(publisher.SendWithHeader("/headers", "us", map[string]string{"region": "us"}))
+	a.NoError(publisher.SendWithHeader("/headers", "eu", map[string]string{"region": "eu", "device_id": "42"}))
+
+	// then only the matching one is received, with its header intact
+	msg := expectMessage(t, receiver, "eu")
+	a.JSONEq(`{"region":"eu","device_id":"42"}`, msg.HeaderJSON)
+	select {
+	case msg := <-receiver.Messages():
+		a.Fail("unexpected message", string(msg.Body))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestUnsubscribeAllIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	_, client1, client2, cleanup := initServerAndClients(t)
+	defer cleanup()
+
+	// given a client subscribed to two topics
+	a.NoError(client1.Subscribe("/foo"))
+	expectStatusMessage(t, client1, protocol.SUCCESS_SUBSCRIBED_TO, "/foo")
+	a.NoError(client1.Subscribe("/bar"))
+	expectStatusMessage(t, client1, protocol.SUCCESS_SUBSCRIBED_TO, "/bar")
+
+	// when it cancels all subscriptions at once
+	a.NoError(client1.UnsubscribeAll())
+
+	// then it is confirmed by a single notification
+	expectStatusMessage(t, client1, protocol.SUCCESS_CANCELED_ALL, "2")
+
+	// and the messages of both topics are not delivered anymore
+	a.NoError(client2.Send("/foo", "foo", ""))
+	a.NoError(client2.Send("/bar", "bar", ""))
+	select {
+	case msg := <-client1.Messages():
+		a.Fail("unexpected message", string(msg.Body))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSendBinaryIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	s, cleanup := serviceSetUp(t)
+	defer cleanup()
+	defer s.Stop()
+
+	wsURL := "ws://" + s.WebServer().GetAddr() + "/stream/user/user1"
+	publisher, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer publisher.Close()
+	receiver, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer receiver.Close()
+	a.NoError(receiver.Subscribe("/binary"))
+	time.Sleep(time.Millisecond * 50)
+
+	// when a body, which is not valid utf-8, is sent as binary
+	body := string([]byte{0xff, 0x00, '\n', 0xfe, 0x80})
+	a.NoError(publisher.SendBinary("/binary", []byte(body)))
+
+	// then it is received unmodified and flagged binary
+	msg := expectMessage(t, receiver, body)
+	a.True(msg.Binary)
+
+	// and the stored message is replayed unmodified
+	fetched, err := receiver.FetchRange("/binary", msg.ID, msg.ID)
+	a.NoError(err)
+	if a.Len(fetched, 1) {
+		a.Equal([]byte(body), fetched[0].Body)
+		a.True(fetched[0].Binary)
+	}
+}
+
+func TestRestClientIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	s, cleanup := serviceSetUp(t)
+	defer cleanup()
+	defer s.Stop()
+
+	c := restclient.NewClient(fmt.Sprintf("http://%s/api", s.WebServer().GetAddr()), &http.Client{Timeout: time.Second})
+	ctx := context.Background()
+
+	// when messages are published with the rest client
+	var receipts []*restclient.Receipt
+	for i := 1; i <= 3; i++ {
+		receipt, err := c.Publish(ctx, "/rest/client", []byte(fmt.Sprintf("msg %d", i)), map[string]string{"Region": "eu"})
+		a.NoError(err)
+		receipts = append(receipts, receipt)
+	}
+
+	// then they are counted by the offsets of the topic
+	offsets, err := c.Offsets(ctx, "/rest")
+	a.NoError(err)
+	a.Equal(uint64(3), offsets.Count)
+	a.Equal(receipts[2].MessageID, offsets.LastID)
+
+	// and a range of them is fetched with their header
+	messages, err := c.FetchRange(ctx, "/rest/client", receipts[1].MessageID, 0)
+	a.NoError(err)
+	if a.Len(messages, 2) {
+		a.Equal("msg 2", string(messages[0].Body))
+		a.Equal("msg 3", string(messages[1].Body))
+		a.JSONEq(`{"Region":"eu"}`, messages[0].HeaderJSON)
+	}
+}
+
+func TestSubscribePositionsIntegration(t *testing.T) {
+	defer testutil.SkipIfShort(t)
+	defer testutil.SkipIfDisabled(t)
+
+	defer testutil.ResetDefaultRegistryHealthCheck()
+
+	a := assert.New(t)
+
+	s, cleanup := serviceSetUp(t)
+	defer cleanup()
+	defer s.Stop()
+
+	wsURL := "ws://" + s.WebServer().GetAddr() + "/stream/user/user1"
+	publisher, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer publisher.Close()
+
+	// given two stored messages
+	a.NoError(publisher.Send("/positions", "first", ""))
+	a.NoError(publisher.Send("/positions", "second", ""))
+	time.Sleep(time.Millisecond * 50)
+
+	// when subscribing at the latest and the earliest position
+	latest, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer latest.Close()
+	a.NoError(latest.Subscribe("/positions @latest"))
+	earliest, err := client.Open(wsURL, "http://localhost", 10, false, false, client.DefaultBackoff, nil, nil, "")
+	a.NoError(err)
+	defer earliest.Close()
+	a.NoError(earliest.Subscribe("/positions @earliest"))
+	time.Sleep(time.Millisecond * 50)
+	a.NoError(publisher.Send("/positions", "third", ""))
+
+	// then the earliest one replays the stored messages before the new one, and the latest one gets only the new one
+	expectMessage(t, earliest, "first")
+	expectMessage(t, earliest, "second")
+	expectMessage(t, earliest, "third")
+	expectMessage(t, latest, "third")
+}
+
+func expectMessage(t *testing.T, client client.Client, body string) *protocol.Message {
+	select {
+	case msg := <-client.Messages():
+		assert.Equal(t, body, string(msg.Body))
+		return msg
+	case <-time.After(time.Second):
+		t.Errorf("no message %q received", body)
+		return &protocol.Message{}
+	}
+}
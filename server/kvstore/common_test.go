@@ -47,24 +47,68 @@ func CommonTestIterate(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
 	a.NoError(kvs1.Put("s1", "buu", test3))
 	a.NoError(kvs1.Put("s2", "bli", test2))
 
-	assertChannelContainsEntries(a, kvs2.Iterate("s1", "bl"),
+	assertChannelContainsEntries(a, iterate(a, kvs2, "s1", "bl"),
 		[2]string{"bli", string(test1)},
 		[2]string{"bla", string(test2)})
 
-	assertChannelContainsEntries(a, kvs2.Iterate("s1", ""),
+	assertChannelContainsEntries(a, iterate(a, kvs2, "s1", ""),
 		[2]string{"bli", string(test1)},
 		[2]string{"bla", string(test2)},
 		[2]string{"buu", string(test3)})
 
-	assertChannelContainsEntries(a, kvs2.Iterate("s1", "bla"),
+	assertChannelContainsEntries(a, iterate(a, kvs2, "s1", "bla"),
 		[2]string{"bla", string(test2)})
 
-	assertChannelContainsEntries(a, kvs2.Iterate("s1", "nothing"))
+	assertChannelContainsEntries(a, iterate(a, kvs2, "s1", "nothing"))
 
-	assertChannelContainsEntries(a, kvs2.Iterate("s2", ""),
+	assertChannelContainsEntries(a, iterate(a, kvs2, "s2", ""),
 		[2]string{"bli", string(test2)})
 }
 
+func CommonTestIterateOrderAndEscaping(t *testing.T, kvs1 KVStore, kvs2 KVStore) {
+	a := assert.New(t)
+
+	a.NoError(kvs1.Put("s1", "c", test1))
+	a.NoError(kvs1.Put("s1", "a_1", test2))
+	a.NoError(kvs1.Put("s1", "ab1", test3))
+	a.NoError(kvs1.Put("s1", "a%1", test1))
+	a.NoError(kvs1.Put("s1", "a\\1", test2))
+	a.NoError(kvs1.Put("s1", "b", test3))
+
+	// the entries are sent ordered by key, the same on each call
+	for i := 0; i < 3; i++ {
+		a.Equal([]string{"a%1", "a\\1", "a_1", "ab1", "b", "c"}, receiveKeys(a, iterate(a, kvs2, "s1", "")))
+	}
+
+	// and the wildcards in the prefix match only themselves
+	a.Equal([]string{"a_1"}, receiveKeys(a, iterate(a, kvs2, "s1", "a_")))
+	a.Equal([]string{"a%1"}, receiveKeys(a, iterate(a, kvs2, "s1", "a%")))
+	a.Equal([]string{"a\\1"}, receiveKeys(a, iterate(a, kvs2, "s1", "a\\")))
+	a.Equal([]string{"a%1", "a\\1", "a_1", "ab1"}, receiveKeys(a, iterate(a, kvs2, "s1", "a")))
+}
+
+func iterate(a *assert.Assertions, kvs KVStore, schema, keyPrefix string) chan [2]string {
+	entryC, err := kvs.Iterate(schema, keyPrefix)
+	a.NoError(err)
+	return entryC
+}
+
+func receiveKeys(a *assert.Assertions, entryC chan [2]string) []string {
+	keys := []string{}
+	for {
+		select {
+		case entry, ok := <-entryC:
+			if !ok {
+				return keys
+			}
+			keys = append(keys, entry[0])
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return keys
+		}
+	}
+}
+
 func assertChannelContainsEntries(a *assert.Assertions, entryC chan [2]string, expectedEntries ...[2]string) {
 	var allEntries [][2]string
 
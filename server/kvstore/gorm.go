@@ -4,7 +4,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/jinzhu/gorm"
 
+	"database/sql"
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -12,6 +14,13 @@ const (
 	responseChannelSize = 100
 )
 
+var (
+	// retryBackoff is the delay before the first retry of an operation, doubled for each following one
+	retryBackoff = 100 * time.Millisecond
+	// maxRetryBackoff is the maximum delay between two retries
+	maxRetryBackoff = 5 * time.Second
+)
+
 type kvEntry struct {
 	Schema    string    `gorm:"primary_key"sql:"type:varchar(200)"`
 	Key       string    `gorm:"primary_key"sql:"type:varchar(200)"`
@@ -22,6 +31,10 @@ type kvEntry struct {
 type kvStore struct {
 	db     *gorm.DB
 	logger *log.Entry
+
+	// the operations failing with a transient error are retried up to maxRetries times
+	maxRetries  int
+	isTransient func(error) bool
 }
 
 func (store *kvStore) Stop() error {
@@ -47,16 +60,21 @@ func (store *kvStore) Check() error {
 }
 
 func (store *kvStore) Put(schema, key string, value []byte) error {
-	if err := store.Delete(schema, key); err != nil {
-		return err
-	}
-	entry := &kvEntry{Schema: schema, Key: key, Value: value, UpdatedAt: time.Now()}
-	return store.db.Create(entry).Error
+	return store.retry(func() error {
+		if err := store.db.Delete(&kvEntry{Schema: schema, Key: key}).Error; err != nil {
+			return err
+		}
+		entry := &kvEntry{Schema: schema, Key: key, Value: value, UpdatedAt: time.Now()}
+		return store.db.Create(entry).Error
+	})
 }
 
 func (store *kvStore) Get(schema, key string) ([]byte, bool, error) {
 	entry := &kvEntry{}
-	if err := store.db.First(&entry, "schema = ? and key = ?", schema, key).Error; err != nil {
+	err := store.retry(func() error {
+		return store.db.First(&entry, "schema = ? and key = ?", schema, key).Error
+	})
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return nil, false, nil
 		}
@@ -66,31 +84,42 @@ func (store *kvStore) Get(schema, key string) ([]byte, bool, error) {
 	return entry.Value, true, nil
 }
 
-func (store *kvStore) Iterate(schema string, keyPrefix string) chan [2]string {
+func (store *kvStore) Iterate(schema string, keyPrefix string) (chan [2]string, error) {
+	var rows *sql.Rows
+	err := store.retry(func() (err error) {
+		rows, err = store.db.Raw("select key, value from kv_entry where schema = ? and key LIKE ? ESCAPE '\\' order by key",
+			schema, likePrefix(keyPrefix)).
+			Rows()
+		return err
+	})
+	if err != nil {
+		store.logger.WithField("error", err.Error()).Error("Error fetching entries from database")
+		return nil, err
+	}
+
 	responseC := make(chan [2]string, responseChannelSize)
 	go func() {
-		rows, err := store.db.Raw("select key, value from kv_entry where schema = ? and key LIKE ?", schema, keyPrefix+"%").
-			Rows()
-		if err != nil {
-			store.logger.WithField("error", err.Error()).Error("Error fetching keys from database")
-		} else {
-			defer rows.Close()
-			for rows.Next() {
-				var key, value string
-				rows.Scan(&key, &value)
-				responseC <- [2]string{key, value}
-			}
+		defer rows.Close()
+		for rows.Next() {
+			var key, value string
+			rows.Scan(&key, &value)
+			responseC <- [2]string{key, value}
 		}
 		close(responseC)
 	}()
-	return responseC
+	return responseC, nil
 }
 
 func (store *kvStore) IterateKeys(schema string, keyPrefix string) chan string {
 	responseC := make(chan string, responseChannelSize)
 	go func() {
-		rows, err := store.db.Raw("select key from kv_entry where schema = ? and key LIKE ?", schema, keyPrefix+"%").
-			Rows()
+		var rows *sql.Rows
+		err := store.retry(func() (err error) {
+			rows, err = store.db.Raw("select key from kv_entry where schema = ? and key LIKE ? ESCAPE '\\' order by key",
+				schema, likePrefix(keyPrefix)).
+				Rows()
+			return err
+		})
 		if err != nil {
 			store.logger.WithField("error", err.Error()).Error("Error fetching keys from database")
 		} else {
@@ -107,5 +136,30 @@ func (store *kvStore) IterateKeys(schema string, keyPrefix string) chan string {
 }
 
 func (store *kvStore) Delete(schema, key string) error {
-	return store.db.Delete(&kvEntry{Schema: schema, Key: key}).Error
+	return store.retry(func() error {
+		return store.db.Delete(&kvEntry{Schema: schema, Key: key}).Error
+	})
 }
+
+// retry executes the operation, and retries it with an exponential backoff while it fails with a transient error
+func (store *kvStore) retry(operation func() error) error {
+	err := operation()
+	backoff := retryBackoff
+	for i := 0; i < store.maxRetries && err != nil && store.isTransient != nil && store.isTransient(err); i++ {
+		store.logger.WithError(err).WithField("retry", i+1).Warn("Retrying after a transient database error")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		err = operation()
+	}
+	return err
+}
+
+// likePrefix returns the LIKE pattern matching all strings starting with the prefix,
+// escaping the wildcards contained in the prefix.
+func likePrefix(prefix string) string {
+	return likeEscaper.Replace(prefix) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
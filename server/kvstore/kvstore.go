@@ -16,7 +16,8 @@ type KVStore interface {
 	// The result will be sent to the channel, which is closed after the last entry.
 	// For simplicity, the return type is an string array with key, value.
 	// If you have binary values, you can safely cast back to []byte.
-	Iterate(schema, keyPrefix string) (entries chan [2]string)
+	// The entries are sent ordered by key. An error is returned, if the iteration could not be started.
+	Iterate(schema, keyPrefix string) (entries chan [2]string, err error)
 
 	// IterateKeys iterates over all keys in the key value store.
 	// The keys will be sent to the channel, which is closed after the last entry.
@@ -1,6 +1,7 @@
 package kvstore
 
 import (
+	"sort"
 	"strings"
 	"sync"
 )
@@ -48,46 +49,55 @@ func (kvStore *MemoryKVStore) Delete(schema, key string) error {
 }
 
 // Iterate iterates over the key-value pairs in the schema, with keys matching the keyPrefix.
-// TODO: this can lead to a deadlock, if the consumer modifies the store while receiving and the channel blocks
-func (kvStore *MemoryKVStore) Iterate(schema string, keyPrefix string) chan [2]string {
-	responseChan := make(chan [2]string, 100)
+// The matching entries are copied before sending, so the consumer can modify the store while receiving.
+func (kvStore *MemoryKVStore) Iterate(schema string, keyPrefix string) (chan [2]string, error) {
 	kvStore.mutex.Lock()
 	s := kvStore.getSchema(schema)
+	keys := sortedKeys(s, keyPrefix)
+	entries := make([][2]string, len(keys))
+	for i, key := range keys {
+		entries[i] = [2]string{key, string(s[key])}
+	}
 	kvStore.mutex.Unlock()
+
+	responseChan := make(chan [2]string, 100)
 	go func() {
-		kvStore.mutex.Lock()
-		for key, value := range s {
-			if strings.HasPrefix(key, keyPrefix) {
-				responseChan <- [2]string{key, string(value)}
-			}
+		for _, entry := range entries {
+			responseChan <- entry
 		}
-		kvStore.mutex.Unlock()
 		close(responseChan)
 	}()
-	return responseChan
+	return responseChan, nil
 }
 
 // IterateKeys iterates over the keys in the schema, matching the keyPrefix.
-// TODO: this can lead to a deadlock, if the consumer modifies the store while receiving and the channel blocks
 func (kvStore *MemoryKVStore) IterateKeys(schema string, keyPrefix string) chan string {
-	responseChan := make(chan string, 100)
 	kvStore.mutex.Lock()
-	s := kvStore.getSchema(schema)
+	keys := sortedKeys(kvStore.getSchema(schema), keyPrefix)
 	kvStore.mutex.Unlock()
+
+	responseChan := make(chan string, 100)
 	go func() {
-		kvStore.mutex.Lock()
-		for key := range s {
-			if strings.HasPrefix(key, keyPrefix) {
-				responseChan <- key
-			}
+		for _, key := range keys {
+			responseChan <- key
 		}
-		kvStore.mutex.Unlock()
-
 		close(responseChan)
 	}()
 	return responseChan
 }
 
+// sortedKeys returns the keys of the schema matching the keyPrefix, in a stable order
+func sortedKeys(s map[string][]byte, keyPrefix string) []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		if strings.HasPrefix(key, keyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (kvStore *MemoryKVStore) getSchema(schema string) map[string][]byte {
 	if s, ok := kvStore.data[schema]; ok {
 		return s
@@ -19,6 +19,11 @@ func TestMemoryIterate(t *testing.T) {
 	CommonTestIterate(t, mkvs, mkvs)
 }
 
+func TestMemoryIterateOrderAndEscaping(t *testing.T) {
+	mkvs := NewMemoryKVStore()
+	CommonTestIterateOrderAndEscaping(t, mkvs, mkvs)
+}
+
 func BenchmarkMemoryPutGet(b *testing.B) {
 	CommonBenchmarkPutGet(b, NewMemoryKVStore())
 }
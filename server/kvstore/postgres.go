@@ -4,6 +4,11 @@ import (
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+
+	"database/sql/driver"
+	"io"
+	"net"
 
 	// use gorm's postgres dialect
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -20,17 +25,26 @@ type PostgresKVStore struct {
 // NewPostgresKVStore returns a new configured PostgresKVStore (not opened yet).
 func NewPostgresKVStore(postgresConfig PostgresConfig) *PostgresKVStore {
 	return &PostgresKVStore{
-		kvStore: &kvStore{logger: log.WithFields(log.Fields{"module": "kv-postgres"})},
-		config:  postgresConfig,
+		kvStore: &kvStore{
+			logger:      log.WithFields(log.Fields{"module": "kv-postgres"}),
+			maxRetries:  postgresConfig.MaxRetries,
+			isTransient: isTransientPostgresError,
+		},
+		config: postgresConfig,
 	}
 }
 
 // Open a connection to Postgresql database, or return an error.
+// The schema is created, if not existing yet.
 func (kvStore *PostgresKVStore) Open() error {
-	logger := kvStore.logger.WithField("config", kvStore.config)
+	logger := kvStore.logger.WithField("config", kvStore.config.loggable())
 	logger.Info("Opening database")
 
-	gormdb, err := gorm.Open("postgres", kvStore.config.connectionString())
+	var gormdb *gorm.DB
+	err := kvStore.retry(func() (err error) {
+		gormdb, err = gorm.Open("postgres", kvStore.config.connectionString())
+		return err
+	})
 	if err != nil {
 		logger.WithField("err", err).Error("Error opening database")
 		return err
@@ -44,8 +58,7 @@ func (kvStore *PostgresKVStore) Open() error {
 
 	gormdb.LogMode(postgresGormLogMode)
 	gormdb.SingularTable(true)
-	//TODO MARIAN REMOVE THIS AFTER BUG
-	gormdb.DB().SetMaxIdleConns(-1)
+	gormdb.DB().SetMaxIdleConns(kvStore.config.MaxIdleConns)
 	gormdb.DB().SetMaxOpenConns(kvStore.config.MaxOpenConns)
 
 	//TODO MARIAN maybe config
@@ -59,3 +72,18 @@ func (kvStore *PostgresKVStore) Open() error {
 	kvStore.db = gormdb
 	return nil
 }
+
+// isTransientPostgresError returns true for the errors of a lost or refused connection, which may succeed when retried
+func isTransientPostgresError(err error) bool {
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case *pq.Error:
+		// connection exceptions, and the server shutting down or not accepting connections yet
+		return e.Code.Class() == "08" || e.Code == "57P01" || e.Code == "57P02" || e.Code == "57P03"
+	}
+	return false
+}
@@ -1,8 +1,16 @@
 package kvstore
 
 import (
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 func BenchmarkPostgresKVStore_PutGet(b *testing.B) {
@@ -78,3 +86,54 @@ func invalidPostgresConfig() PostgresConfig {
 		MaxOpenConns: 1,
 	}
 }
+
+func TestIsTransientPostgresError(t *testing.T) {
+	a := assert.New(t)
+
+	a.True(isTransientPostgresError(driver.ErrBadConn))
+	a.True(isTransientPostgresError(io.ErrUnexpectedEOF))
+	a.True(isTransientPostgresError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	a.True(isTransientPostgresError(&pq.Error{Code: "08006"}))
+	a.True(isTransientPostgresError(&pq.Error{Code: "57P03"}))
+
+	a.False(isTransientPostgresError(&pq.Error{Code: "23505"}))
+	a.False(isTransientPostgresError(&pq.Error{Code: "57014"}))
+	a.False(isTransientPostgresError(gorm.ErrRecordNotFound))
+}
+
+func TestKVStore_RetriesTransientErrors(t *testing.T) {
+	a := assert.New(t)
+	defer func(b time.Duration) { retryBackoff = b }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	transient := errors.New("transient")
+	store := NewPostgresKVStore(PostgresConfig{MaxRetries: 2})
+	store.isTransient = func(err error) bool { return err == transient }
+
+	// a transient error is retried until the operation succeeds
+	calls := 0
+	a.NoError(store.retry(func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	}))
+	a.Equal(3, calls)
+
+	// but not more than the max retries
+	calls = 0
+	a.Equal(transient, store.retry(func() error {
+		calls++
+		return transient
+	}))
+	a.Equal(3, calls)
+
+	// and other errors are not retried
+	calls = 0
+	a.Equal(gorm.ErrRecordNotFound, store.retry(func() error {
+		calls++
+		return gorm.ErrRecordNotFound
+	}))
+	a.Equal(1, calls)
+}
@@ -44,6 +44,16 @@ func TestSqliteIterateKeys(t *testing.T) {
 	CommonTestIterateKeys(t, db, db)
 }
 
+func TestSqliteIterateOrderAndEscaping(t *testing.T) {
+	f := tempFilename()
+	defer os.Remove(f)
+
+	db := NewSqliteKVStore(f, false)
+	db.Open()
+
+	CommonTestIterateOrderAndEscaping(t, db, db)
+}
+
 func TestCheck_SqlKVStore(t *testing.T) {
 	a := assert.New(t)
 	f := tempFilename()
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	promNamespace = "guble"
+
+	// maxTopicLabels limits the number of distinct topic label values.
+	// Messages on further topics are counted with the label `otherTopicLabel`.
+	maxTopicLabels  = 100
+	otherTopicLabel = "other"
+)
+
+var (
+	// PromMessagesReceived counts the messages received by the router, by topic
+	PromMessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "messages_received_total",
+		Help:      "The number of messages received by the router.",
+	}, []string{"topic"})
+
+	// PromMessagesDelivered counts the messages delivered to the subscribers, by topic
+	PromMessagesDelivered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "messages_delivered_total",
+		Help:      "The number of messages delivered to the subscribers.",
+	}, []string{"topic"})
+
+	// PromWebsocketConnections is the number of open websocket connections
+	PromWebsocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "websocket_connections",
+		Help:      "The number of open websocket connections.",
+	})
+
+	// PromWebsocketPongTimeouts counts the websocket connections closed, because the client missed a pong
+	PromWebsocketPongTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "websocket_pong_timeouts_total",
+		Help:      "The number of websocket connections closed, because the client did not answer a ping in time.",
+	})
+
+	// PromWebsocketThrottled is the number of websocket connections, which are not read while the ingest queue is full
+	PromWebsocketThrottled = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "websocket_throttled_connections",
+		Help:      "The number of websocket connections paused by the backpressure of the ingest queue.",
+	})
+
+	// PromSubscriberLag is the largest lag of the routes of a user, by user id:
+	// the difference between the id of the last message routed to a route and the id of the last one read from it
+	PromSubscriberLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "subscriber_lag",
+		Help:      "The number of message ids the slowest subscriber of a user is behind its topic.",
+	}, []string{"user_id"})
+
+	// PromFCMMessages counts the messages sent to FCM, by result (success or failure) and name of the API key
+	PromFCMMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "fcm_messages_total",
+		Help:      "The number of messages sent to Firebase Cloud Messaging.",
+	}, []string{"result", "key"})
+
+	// PromFCMRetries counts the retries of the messages sent to FCM after transient errors,
+	// by result (retried, or denied by the retry budget)
+	PromFCMRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "fcm_retries_total",
+		Help:      "The number of retries after transient FCM errors, and of the retries denied by the retry budget.",
+	}, []string{"result"})
+
+	// PromFCMCircuitState is the state of the circuit breaker of FCM: 0 closed, 1 open, 2 half-open
+	PromFCMCircuitState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "fcm_circuit_state",
+		Help:      "The state of the FCM circuit breaker: 0 closed, 1 open, 2 half-open.",
+	})
+
+	// PromConnectorDroppedRequests counts the requests dropped by the full queue of a connector, by connector name
+	PromConnectorDroppedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "connector_dropped_requests_total",
+		Help:      "The number of requests dropped by the full queue of a connector.",
+	}, []string{"connector"})
+
+	// PromConnectorExpiredRequests counts the requests dropped by a connector, because their message expired
+	// before it was sent, by connector name
+	PromConnectorExpiredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "connector_expired_requests_total",
+		Help:      "The number of requests dropped by a connector, because their message expired before it was sent.",
+	}, []string{"connector"})
+
+	// PromConnectorDryRunRequests counts the requests handled by a connector in dry-run mode, without sending them,
+	// by connector name
+	PromConnectorDryRunRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "connector_dry_run_requests_total",
+		Help:      "The number of requests handled by a connector in dry-run mode, which were logged instead of sent.",
+	}, []string{"connector"})
+
+	// PromMessageStoreLatency observes the duration of the message store operations in seconds, by operation (read or write)
+	PromMessageStoreLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Name:      "message_store_latency_seconds",
+		Help:      "The latency of reading and writing a message in the message store.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 9),
+	}, []string{"operation"})
+
+	// PromTopics is the number of topics used on the node, when the topics are limited
+	PromTopics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Name:      "topics",
+		Help:      "The number of topics used on the node, tracked by the topic limit.",
+	})
+
+	// PromEvictedTopics counts the idle topics evicted by the topic limit
+	PromEvictedTopics = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Name:      "topics_evicted_total",
+		Help:      "The number of idle topics evicted, whose partitions were closed.",
+	})
+)
+
+// RegisterPrometheus registers the guble collectors in the default prometheus registry.
+// It can be called more than once, for example by multiple services in one process.
+func RegisterPrometheus() error {
+	for _, c := range []prometheus.Collector{
+		PromMessagesReceived,
+		PromMessagesDelivered,
+		PromWebsocketConnections,
+		PromWebsocketPongTimeouts,
+		PromWebsocketThrottled,
+		PromSubscriberLag,
+		PromFCMMessages,
+		PromFCMRetries,
+		PromFCMCircuitState,
+		PromConnectorDroppedRequests,
+		PromConnectorExpiredRequests,
+		PromConnectorDryRunRequests,
+		PromMessageStoreLatency,
+		PromTopics,
+		PromEvictedTopics,
+	} {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PrometheusHandler exposes the collectors of the default prometheus registry
+func PrometheusHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+var (
+	topicLabelsMutex sync.RWMutex
+	topicLabels      = make(map[string]bool)
+)
+
+// TopicLabel returns the topic label for a message path.
+// To bound the cardinality of the label, only the first segment of the path is used,
+// and after maxTopicLabels distinct values the remaining topics share the same label.
+func TopicLabel(path string) string {
+	label := path
+	trimmed := strings.TrimPrefix(path, "/")
+	if i := strings.Index(trimmed, "/"); i >= 0 {
+		label = path[:len(path)-len(trimmed)+i]
+	}
+
+	topicLabelsMutex.RLock()
+	known := topicLabels[label]
+	count := len(topicLabels)
+	topicLabelsMutex.RUnlock()
+	if known {
+		return label
+	}
+	if count >= maxTopicLabels {
+		return otherTopicLabel
+	}
+
+	topicLabelsMutex.Lock()
+	defer topicLabelsMutex.Unlock()
+	if len(topicLabels) >= maxTopicLabels && !topicLabels[label] {
+		return otherTopicLabel
+	}
+	topicLabels[label] = true
+	return label
+}
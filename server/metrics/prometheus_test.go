@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"fmt"
+	"testing"
+)
+
+func TestRegisterPrometheus_CanBeCalledTwice(t *testing.T) {
+	a := assert.New(t)
+	a.NoError(RegisterPrometheus())
+	a.NoError(RegisterPrometheus())
+}
+
+func TestTopicLabel(t *testing.T) {
+	a := assert.New(t)
+	defer func() { topicLabels = make(map[string]bool) }()
+	topicLabels = make(map[string]bool)
+
+	// only the first path segment is used
+	a.Equal("/foo", TopicLabel("/foo"))
+	a.Equal("/foo", TopicLabel("/foo/bar"))
+	a.Equal("/foo", TopicLabel("/foo/user/42"))
+	a.Equal("foo", TopicLabel("foo/bar"))
+
+	// and the number of distinct labels is bounded
+	for i := len(topicLabels); i < maxTopicLabels; i++ {
+		a.Equal(fmt.Sprintf("/topic%d", i), TopicLabel(fmt.Sprintf("/topic%d/sub", i)))
+	}
+	a.Equal(otherTopicLabel, TopicLabel("/one-too-many"))
+	a.Equal("/foo", TopicLabel("/foo/baz"))
+	a.Equal(maxTopicLabels, len(topicLabels))
+}
@@ -0,0 +1,86 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// aliasesPath is the path of the topic aliases
+const aliasesPath = "/aliases"
+
+// alias is an alias path with its canonical path, as posted to `/aliases`
+type alias struct {
+	Alias     protocol.Path `json:"alias"`
+	Canonical protocol.Path `json:"canonical"`
+}
+
+// isAliasesRequest returns true for the path of the aliases, or of a single alias, e.g. `/api/aliases/oldname`
+func (api *RestMessageAPI) isAliasesRequest(r *http.Request) bool {
+	path := removeTrailingSlash(r.URL.Path)
+	prefix := removeTrailingSlash(api.prefix) + aliasesPath
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// aliases manages the topic aliases of the router:
+// `GET /api/aliases` returns the canonical paths by alias, `POST /api/aliases` sets an alias
+// by a json object like `{"alias":"/oldname","canonical":"/newname"}`, and `DELETE /api/aliases/oldname` removes it.
+// Changing the aliases requires the admin user.
+func (api *RestMessageAPI) aliases(w http.ResponseWriter, r *http.Request) {
+	aliaser, ok := api.router.(router.Aliaser)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(aliaser.Aliases()); err != nil {
+			log.WithError(err).Error("Writing the aliases failed")
+		}
+		return
+	}
+
+	if !api.isAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, "changing the aliases requires the admin user")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		a := &alias{}
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, fmt.Sprintf("invalid alias: %v", err))
+			return
+		}
+		if err := aliaser.SetAlias(a.Alias, a.Canonical); err != nil {
+			if err == router.ErrInvalidAlias || err == router.ErrAliasCycle {
+				writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+				return
+			}
+			writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+			return
+		}
+		log.WithFields(log.Fields{"alias": a.Alias, "canonical": a.Canonical}).Info("Set alias")
+	case http.MethodDelete:
+		path := protocol.Path(removeTrailingSlash(strings.TrimPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+aliasesPath)))
+		if path == "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := aliaser.RemoveAlias(path); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+			return
+		}
+		log.WithField("alias", path).Info("Removed alias")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
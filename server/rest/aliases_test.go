@@ -0,0 +1,88 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// aliasingRouter is a router, which keeps the aliases in a map
+type aliasingRouter struct {
+	*MockRouter
+	aliases map[protocol.Path]protocol.Path
+	err     error
+}
+
+func (r *aliasingRouter) SetAlias(alias, canonical protocol.Path) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.aliases[alias] = canonical
+	return nil
+}
+
+func (r *aliasingRouter) RemoveAlias(alias protocol.Path) error {
+	delete(r.aliases, alias)
+	return nil
+}
+
+func (r *aliasingRouter) Aliases() map[protocol.Path]protocol.Path {
+	return r.aliases
+}
+
+func (r *aliasingRouter) ResolveAlias(path protocol.Path) protocol.Path {
+	return path
+}
+
+func TestServeHTTP_Aliases(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := &aliasingRouter{MockRouter: NewMockRouter(ctrl), aliases: make(map[protocol.Path]protocol.Path)}
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+
+	request := func(method, url string, body io.Reader) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, body)
+		api.ServeHTTP(w, req)
+		return w
+	}
+	anAlias := `{"alias":"/oldname","canonical":"/newname"}`
+
+	// only the admin user can set an alias
+	a.Equal(http.StatusForbidden, request(http.MethodPost, "http://localhost/api/aliases?access_token=secret", strings.NewReader(anAlias)).Code)
+	a.Empty(routerMock.aliases)
+
+	api.AdminUser = "marvin"
+	w := request(http.MethodPost, "http://localhost/api/aliases?access_token=secret", strings.NewReader(anAlias))
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("OK", w.Body.String())
+	a.Equal(map[protocol.Path]protocol.Path{"/oldname": "/newname"}, routerMock.aliases)
+
+	// and the aliases are listed
+	w = request(http.MethodGet, "http://localhost/api/aliases/?access_token=secret", nil)
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"/oldname":"/newname"}`, w.Body.String())
+
+	// and invalid aliases are rejected
+	a.Equal(http.StatusBadRequest, request(http.MethodPost, "http://localhost/api/aliases?access_token=secret", strings.NewReader("no json")).Code)
+	routerMock.err = router.ErrAliasCycle
+	w = request(http.MethodPost, "http://localhost/api/aliases?access_token=secret", strings.NewReader(anAlias))
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.Contains(w.Body.String(), router.ErrAliasCycle.Error())
+
+	// and an alias is removed by its path
+	w = request(http.MethodDelete, "http://localhost/api/aliases/oldname?access_token=secret", nil)
+	a.Equal(http.StatusOK, w.Code)
+	a.Empty(routerMock.aliases)
+}
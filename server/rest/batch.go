@@ -0,0 +1,201 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	batchSuffix = "/batch"
+
+	// batchLineOverhead is the space allowed for the json encoding of a batch line, in addition to the max message size
+	batchLineOverhead = 64 * 1024
+
+	// defaultMaxBatchLineSize is the maximum size of a batch line, if the message size is not limited
+	defaultMaxBatchLineSize = 16 * 1024 * 1024
+)
+
+// batchLine is a single message of a batch, given as a json object on its own line
+type batchLine struct {
+	Body    string            `json:"body"`
+	UserID  string            `json:"userId"`
+	Header  map[string]string `json:"header"`
+	Filters map[string]string `json:"filters"`
+}
+
+// batchLineResult is the outcome of publishing a single line of a batch
+type batchLineResult struct {
+	Line      int    `json:"line"`
+	MessageID uint64 `json:"messageID,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchSummary is the response of a batch request
+type batchSummary struct {
+	Published int               `json:"published"`
+	Failed    int               `json:"failed"`
+	Results   []batchLineResult `json:"results"`
+
+	// retryAfter is the number of seconds until the next window of the quota, if it was exceeded by a line
+	retryAfter int64
+}
+
+func (s *batchSummary) succeeded(line int, msg *protocol.Message) {
+	s.Published++
+	s.Results = append(s.Results, batchLineResult{Line: line, MessageID: msg.ID})
+}
+
+func (s *batchSummary) failed(line int, err error) {
+	s.Failed++
+	s.Results = append(s.Results, batchLineResult{Line: line, Error: err.Error()})
+}
+
+// publishBatch publishes the messages of a newline-delimited json body in order, reading it line by line.
+// Malformed lines are reported in the summary, without stopping the batch.
+// With `atomic=true` all lines are parsed before publishing, and nothing is published if one of them is malformed.
+func (api *RestMessageAPI) publishBatch(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(strings.TrimSuffix(removeTrailingSlash(r.URL.Path), batchSuffix), "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	atomic := q(r, "atomic") == "true"
+
+	summary := &batchSummary{Results: make([]batchLineResult, 0)}
+	var parsed []*protocol.Message
+	var parsedLines []int
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), api.maxBatchLineSize())
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		msg, err := api.parseBatchLine(r, topic, scanner.Bytes())
+		if err != nil {
+			summary.failed(line, err)
+			if atomic {
+				break
+			}
+			continue
+		}
+		if atomic {
+			parsed = append(parsed, msg)
+			parsedLines = append(parsedLines, line)
+			continue
+		}
+		api.publishBatchMessage(summary, line, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		// the body can not be read any further, e.g. if a line exceeds the max line size
+		summary.failed(line+1, err)
+	}
+
+	if atomic {
+		if summary.Failed > 0 {
+			log.WithField("topic", topic).Warn("Rejecting the atomic batch with a malformed line")
+			writeBatchSummary(w, http.StatusBadRequest, summary)
+			return
+		}
+		for i, msg := range parsed {
+			if !api.publishBatchMessage(summary, parsedLines[i], msg) {
+				break
+			}
+		}
+	}
+	writeBatchSummary(w, http.StatusOK, summary)
+}
+
+// parseBatchLine returns the message of a batch line, with the user id, headers and filters of the request
+// used for all messages not specifying their own
+func (api *RestMessageAPI) parseBatchLine(r *http.Request, topic string, data []byte) (*protocol.Message, error) {
+	var l batchLine
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("Malformed line: %v", err)
+	}
+	if api.MaxMessageSize > 0 && len(l.Body) > api.MaxMessageSize {
+		return nil, errMessageTooLarge
+	}
+
+	applicationID, err := publisherApplicationID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &protocol.Message{
+		Path:          protocol.Path(topic),
+		Body:          []byte(l.Body),
+		UserID:        l.UserID,
+		ApplicationID: applicationID,
+		HeaderJSON:    headersToJSON(r.Header),
+	}
+	if msg.UserID == "" {
+		msg.UserID = q(r, "userId")
+	}
+	if l.Header != nil {
+		header, err := json.Marshal(l.Header)
+		if err != nil {
+			return nil, err
+		}
+		msg.HeaderJSON = string(header)
+	}
+	setTraceParent(r, msg)
+	api.setFilters(r, msg)
+	for key, value := range l.Filters {
+		msg.SetFilter(key, value)
+	}
+	if _, err := msg.Priority(); err != nil {
+		return nil, err
+	}
+	if _, err := msg.DeliverAt(); err != nil {
+		return nil, err
+	}
+	if _, err := msg.Expires(); err != nil {
+		return nil, err
+	}
+	if _, err := msg.ContentType(); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// publishBatchMessage passes a message of a batch to the router, recording the result in the summary
+func (api *RestMessageAPI) publishBatchMessage(summary *batchSummary, line int, msg *protocol.Message) bool {
+	if err := api.router.HandleMessage(msg); err != nil {
+		log.WithError(err).WithField("path", msg.Path).Error("Handling a message of a batch failed")
+		if quotaErr, ok := err.(*router.QuotaExceededError); ok {
+			summary.retryAfter = quotaErr.RetryAfterSeconds()
+		}
+		summary.failed(line, err)
+		return false
+	}
+	summary.succeeded(line, msg)
+	return true
+}
+
+func (api *RestMessageAPI) maxBatchLineSize() int {
+	if api.MaxMessageSize <= 0 {
+		return defaultMaxBatchLineSize
+	}
+	return api.MaxMessageSize + batchLineOverhead
+}
+
+func writeBatchSummary(w http.ResponseWriter, code int, summary *batchSummary) {
+	if summary.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(summary.retryAfter, 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTP_Batch(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// given a batch with a malformed line, an empty line and a message which can not be stored
+	batch := `{"body":"first","header":{"key":"value"}}
+not json
+
+{"body":"second","userId":"marvin","filters":{"device_id":"42"}}
+{"body":"third"}
+`
+	var published []*protocol.Message
+	id := uint64(0)
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		id++
+		msg.ID = id
+		published = append(published, msg)
+	}).Return(nil).Times(2)
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(errors.New("store error"))
+
+	// when posting it
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic/batch?userId=default", strings.NewReader(batch))
+	req.Header.Set("X-Guble-Source", "import")
+	api.ServeHTTP(w, req)
+
+	// then the valid lines are published in order
+	if a.Len(published, 2) {
+		a.Equal("first", string(published[0].Body))
+		a.Equal("/my/topic", string(published[0].Path))
+		a.Equal("default", published[0].UserID)
+		a.Equal(`{"key":"value"}`, published[0].HeaderJSON)
+		a.Equal("second", string(published[1].Body))
+		a.Equal("marvin", published[1].UserID)
+		a.Equal(`{"Source":"import"}`, published[1].HeaderJSON)
+		a.Equal(map[string]string{"device_id": "42"}, published[1].Filters)
+	}
+
+	// and the result of each line is returned
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	var summary batchSummary
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &summary))
+	a.Equal(2, summary.Published)
+	a.Equal(2, summary.Failed)
+	if a.Len(summary.Results, 4) {
+		a.Equal(batchLineResult{Line: 1, MessageID: 1}, summary.Results[0])
+		a.Equal(2, summary.Results[1].Line)
+		a.Contains(summary.Results[1].Error, "Malformed line")
+		a.Equal(batchLineResult{Line: 4, MessageID: 2}, summary.Results[2])
+		a.Equal(batchLineResult{Line: 5, Error: "store error"}, summary.Results[3])
+	}
+}
+
+func TestServeHTTP_BatchAtomic(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.MaxMessageSize = 5
+
+	// when posting an atomic batch with a message exceeding the max message size
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic/batch?atomic=true",
+		strings.NewReader("{\"body\":\"first\"}\n{\"body\":\"too large\"}\n{\"body\":\"third\"}\n"))
+	api.ServeHTTP(w, req)
+
+	// then nothing is published
+	a.Equal(http.StatusBadRequest, w.Code)
+	var summary batchSummary
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &summary))
+	a.Equal(0, summary.Published)
+	a.Equal([]batchLineResult{{Line: 2, Error: errMessageTooLarge.Error()}}, summary.Results)
+
+	// and a valid atomic batch is published completely
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Times(2)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic/batch?atomic=true",
+		strings.NewReader("{\"body\":\"first\"}\n{\"body\":\"third\"}"))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &summary))
+	a.Equal(2, summary.Published)
+}
+
+func TestServeHTTP_BatchLineTooLong(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.MaxMessageSize = 1
+
+	// when a line exceeds the max line size, then the rest of the batch is not read
+	routerMock.EXPECT().HandleMessage(gomock.Any())
+	w := httptest.NewRecorder()
+	batch := "{\"body\":\"a\"}\n{\"body\":\"" + strings.Repeat("a", batchLineOverhead) + "\"}\n{\"body\":\"b\"}\n"
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic/batch", strings.NewReader(batch))
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusOK, w.Code)
+	var summary batchSummary
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &summary))
+	a.Equal(1, summary.Published)
+	a.Equal(1, summary.Failed)
+	a.Equal(2, summary.Results[1].Line)
+}
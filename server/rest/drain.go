@@ -0,0 +1,58 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	drainPath = "/drain"
+
+	// defaultDrainDelay is the maximum delay of the reconnects of the clients, if no delay is requested
+	defaultDrainDelay = 10 * time.Second
+)
+
+// Reconnector asks the connected clients to reconnect after a random delay of up to maxDelay,
+// returning the number of notified clients, e.g. the websocket handler
+type Reconnector interface {
+	ReconnectClients(maxDelay time.Duration) int
+}
+
+// drained is the response of the drain request
+type drained struct {
+	Clients int `json:"clients"`
+}
+
+// isDrainRequest returns true for a POST of `/drain`
+func (api *RestMessageAPI) isDrainRequest(r *http.Request) bool {
+	return removeTrailingSlash(r.URL.Path) == removeTrailingSlash(api.prefix)+drainPath
+}
+
+// drain asks the connected clients of the Reconnector to reconnect, e.g. to another node before this one is stopped.
+// The maximum delay of the reconnects is requested with `delay`, as a duration like `30s`.
+func (api *RestMessageAPI) drain(w http.ResponseWriter, r *http.Request) {
+	delay := defaultDrainDelay
+	if d := q(r, "delay"); d != "" {
+		var err error
+		if delay, err = time.ParseDuration(d); err != nil || delay < 0 {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "delay has to be a positive duration, e.g. 30s")
+			return
+		}
+	}
+
+	result := drained{}
+	if api.Reconnector != nil {
+		result.Clients = api.Reconnector.ReconnectClients(delay)
+	}
+	log.WithFields(log.Fields{"clients": result.Clients, "delay": delay}).Info("Drained the connections")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.WithError(err).Error("Writing the drain response failed")
+	}
+}
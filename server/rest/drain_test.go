@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type reconnectorFunc func(maxDelay time.Duration) int
+
+func (f reconnectorFunc) ReconnectClients(maxDelay time.Duration) int { return f(maxDelay) }
+
+func TestServeHTTP_Drain(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	var delays []time.Duration
+	api := NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	api.Reconnector = reconnectorFunc(func(maxDelay time.Duration) int {
+		delays = append(delays, maxDelay)
+		return 3
+	})
+
+	post := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// when draining, then the clients are asked to reconnect with the requested or the default delay
+	w := post("http://localhost/api/drain?delay=30s")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"clients":3}`, w.Body.String())
+	post("http://localhost/api/drain/")
+	a.Equal([]time.Duration{30 * time.Second, defaultDrainDelay}, delays)
+
+	// and an invalid delay is rejected
+	a.Equal(http.StatusBadRequest, post("http://localhost/api/drain?delay=soon").Code)
+	a.Len(delays, 2)
+
+	// and without a reconnector there are no clients to drain
+	api.Reconnector = nil
+	a.JSONEq(`{"clients":0}`, post("http://localhost/api/drain").Body.String())
+}
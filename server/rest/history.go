@@ -0,0 +1,293 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/store"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+
+	// historyChunkSize is the maximum number of messages read from the store by a single fetch,
+	// so that a large count does not read the whole partition at once
+	historyChunkSize = 100
+)
+
+// historyMessage is a message of the history response
+type historyMessage struct {
+	ID            uint64          `json:"id"`
+	Path          protocol.Path   `json:"path"`
+	UserID        string          `json:"userId,omitempty"`
+	ApplicationID string          `json:"applicationId,omitempty"`
+	Time          int64           `json:"time"`
+	Header        json.RawMessage `json:"header,omitempty"`
+	Body          string          `json:"body"`
+	Binary        bool            `json:"binary,omitempty"`
+}
+
+func newHistoryMessage(m *protocol.Message) *historyMessage {
+	hm := &historyMessage{
+		ID:            m.ID,
+		Path:          m.Path,
+		UserID:        m.UserID,
+		ApplicationID: m.ApplicationID,
+		Time:          m.Time,
+		Body:          string(m.Body),
+	}
+	if m.Binary {
+		// a binary body is not valid text in general, so it is encoded to pass the json unmodified
+		hm.Body = base64.StdEncoding.EncodeToString(m.Body)
+		hm.Binary = true
+	}
+	if m.HeaderJSON != "" && json.Valid([]byte(m.HeaderJSON)) {
+		hm.Header = json.RawMessage(m.HeaderJSON)
+	}
+	return hm
+}
+
+// writeHistory replies with the last messages of the topic, as requested by `last` and `order`
+// (`asc` for the oldest of them first, which is the default, or `desc` for the newest first).
+func (api *RestMessageAPI) writeHistory(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(removeTrailingSlash(r.URL.Path), "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	last, err := strconv.Atoi(q(r, "last"))
+	if err != nil || last <= 0 {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "last has to be a positive number of messages")
+		return
+	}
+	order := q(r, "order")
+	if order == "" {
+		order = orderAsc
+	}
+	if order != orderAsc && order != orderDesc {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, fmt.Sprintf("unknown order %q", order))
+		return
+	}
+
+	path := protocol.Path(topic)
+	if am, err := api.router.AccessManager(); err == nil && !auth.IsAllowed(am, auth.READ, q(r, "userId"), "", path) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, fmt.Sprintf("read access denied on %v", path))
+		return
+	}
+
+	messages, err := api.fetchLast(path, last)
+	if err != nil {
+		log.WithError(err).WithField("topic", topic).Error("Fetching the last messages failed")
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+
+	history := make([]*historyMessage, len(messages))
+	for i, m := range messages {
+		if order == orderDesc {
+			history[i] = newHistoryMessage(m)
+		} else {
+			history[len(messages)-1-i] = newHistoryMessage(m)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// writeRange replies with the messages of the topic with an id between `from` and `to` (inclusive, open ended without `to`),
+// the oldest first, and at most `limit` of them. A client reads a larger range in pages,
+// by requesting the next one from the id following the last returned message.
+func (api *RestMessageAPI) writeRange(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(removeTrailingSlash(r.URL.Path), "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	from, err := idParam(r, "from")
+	if err != nil || from == 0 {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "from has to be a message id")
+		return
+	}
+	to, err := idParam(r, "to")
+	if err != nil || (to > 0 && to < from) {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "to has to be a message id, not lower than from")
+		return
+	}
+	limit := defaultSearchLimit
+	if l := q(r, "limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "limit has to be a positive number of messages")
+			return
+		}
+	}
+
+	path := protocol.Path(topic)
+	if am, err := api.router.AccessManager(); err == nil && !auth.IsAllowed(am, auth.READ, q(r, "userId"), "", path) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, fmt.Sprintf("read access denied on %v", path))
+		return
+	}
+
+	messages, err := api.fetchRange(path, from, to, limit)
+	if err != nil {
+		log.WithError(err).WithField("topic", topic).Error("Fetching the range of messages failed")
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+
+	history := make([]*historyMessage, len(messages))
+	for i, m := range messages {
+		history[i] = newHistoryMessage(m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// fetchRange returns up to count messages of the topic and its subtopics with an id from `from` to `to`, the oldest first.
+// The partition is read forwards in chunks, like the last messages.
+func (api *RestMessageAPI) fetchRange(topic protocol.Path, from, to uint64, count int) ([]*protocol.Message, error) {
+	messageStore, err := api.router.MessageStore()
+	if err != nil {
+		return nil, err
+	}
+	maxID, err := messageStore.MaxMessageID(topic.Partition())
+	if err != nil {
+		return nil, err
+	}
+	if to == 0 || to > maxID {
+		to = maxID
+	}
+
+	messages := make([]*protocol.Message, 0)
+	startID := from
+	for startID <= to && len(messages) < count {
+		req := store.NewFetchRequest(topic.Partition(), startID, to, store.DirectionForward, historyChunkSize)
+		req.Init()
+		if err := api.router.Fetch(req); err != nil {
+			return nil, err
+		}
+
+		fetched, _, highestID, err := collectFetched(req, topic)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, fetched...)
+		if highestID < startID {
+			break
+		}
+		startID = highestID + 1
+	}
+	sort.Sort(sort.Reverse(newestFirst(messages)))
+	if len(messages) > count {
+		messages = messages[:count]
+	}
+	return messages, nil
+}
+
+// fetchLast returns up to count messages of the topic and its subtopics, the newest first.
+// The partition is read backwards from its last message, in chunks seeked by the index of the store.
+func (api *RestMessageAPI) fetchLast(topic protocol.Path, count int) ([]*protocol.Message, error) {
+	messageStore, err := api.router.MessageStore()
+	if err != nil {
+		return nil, err
+	}
+	startID, err := messageStore.MaxMessageID(topic.Partition())
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*protocol.Message, 0)
+	for startID > 0 && len(messages) < count {
+		chunkSize := count - len(messages)
+		if chunkSize > historyChunkSize {
+			chunkSize = historyChunkSize
+		}
+		req := store.NewFetchRequest(topic.Partition(), startID, 0, store.DirectionBackwards, chunkSize)
+		req.Init()
+		if err := api.router.Fetch(req); err != nil {
+			return nil, err
+		}
+
+		fetched, lowestID, _, err := collectFetched(req, topic)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, fetched...)
+		if lowestID == 0 || lowestID >= startID {
+			break
+		}
+		startID = lowestID - 1
+	}
+	sort.Sort(newestFirst(messages))
+	if len(messages) > count {
+		messages = messages[:count]
+	}
+	return messages, nil
+}
+
+// collectFetched returns the fetched messages of the topic and the lowest and highest fetched id,
+// which are zero if nothing was fetched
+func collectFetched(req *store.FetchRequest, topic protocol.Path) ([]*protocol.Message, uint64, uint64, error) {
+	select {
+	case n := <-req.StartC:
+		if n == 0 {
+			return nil, 0, 0, nil
+		}
+	case err := <-req.ErrorC:
+		return nil, 0, 0, err
+	}
+
+	var messages []*protocol.Message
+	var lowestID, highestID uint64
+	for {
+		select {
+		case fm, open := <-req.MessageC:
+			if !open {
+				return messages, lowestID, highestID, nil
+			}
+			if lowestID == 0 || fm.ID < lowestID {
+				lowestID = fm.ID
+			}
+			if fm.ID > highestID {
+				highestID = fm.ID
+			}
+			// the messages are skipped on errors, for reading the fetch request until it is done
+			m, err := protocol.ParseMessage(fm.Message)
+			if err != nil {
+				log.WithError(err).WithField("id", fm.ID).Error("Error parsing a fetched message")
+				continue
+			}
+			if !inTopic(m.Path, topic) {
+				continue
+			}
+			if err := m.DecompressBody(); err != nil {
+				log.WithError(err).WithField("id", fm.ID).Error("Error decompressing a fetched message")
+				continue
+			}
+			messages = append(messages, m)
+		case err := <-req.ErrorC:
+			return nil, 0, 0, err
+		}
+	}
+}
+
+// inTopic returns true if the path is the topic or one of its subtopics
+func inTopic(path, topic protocol.Path) bool {
+	return path == topic || strings.HasPrefix(string(path), string(topic)+"/")
+}
+
+// newestFirst sorts the messages by descending id
+type newestFirst []*protocol.Message
+
+func (m newestFirst) Len() int           { return len(m) }
+func (m newestFirst) Less(i, j int) bool { return m[i].ID > m[j].ID }
+func (m newestFirst) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
@@ -0,0 +1,238 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeHTTP_GetLastMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with 250 messages in the topic /foo/bar and some in /foo/other
+	dir, err := ioutil.TempDir("", "guble_history_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	for i := 1; i <= 300; i++ {
+		path := protocol.Path("/foo/bar")
+		if i%6 == 0 {
+			path = "/foo/other"
+		}
+		_, err := fms.StoreMessage(&protocol.Message{Path: path, Body: []byte(fmt.Sprintf("%d", i))}, 0)
+		a.NoError(err)
+	}
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	get := func(query string) []historyMessage {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/bar?"+query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(http.StatusOK, w.Code)
+		var messages []historyMessage
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+		return messages
+	}
+
+	// when requesting the last messages newest first, then they are read backwards, skipping the other topic
+	messages := get("last=3&order=desc")
+	if a.Len(messages, 3) {
+		a.Equal("299", messages[0].Body)
+		a.Equal("298", messages[1].Body)
+		a.Equal("297", messages[2].Body)
+		a.Equal(protocol.Path("/foo/bar"), messages[0].Path)
+	}
+
+	// and in ascending order by default
+	messages = get("last=2")
+	if a.Len(messages, 2) {
+		a.Equal("298", messages[0].Body)
+		a.Equal("299", messages[1].Body)
+	}
+
+	// and a count over multiple chunks returns all messages of the topic, if it has fewer
+	messages = get("last=1000&order=desc")
+	if a.Len(messages, 250) {
+		a.Equal("299", messages[0].Body)
+		a.Equal("1", messages[249].Body)
+	}
+}
+
+func TestServeHTTP_GetLastMessagesWithBinaryBody(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with a binary and a text message
+	dir, err := ioutil.TempDir("", "guble_history_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	binary := []byte{0xff, 0x00, '\n', 0xfe}
+	_, err = fms.StoreMessage(&protocol.Message{Path: "/foo", Body: binary, Binary: true}, 0)
+	a.NoError(err)
+	_, err = fms.StoreMessage(&protocol.Message{Path: "/foo", Body: []byte("text")}, 0)
+	a.NoError(err)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// when requesting the messages
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo?last=2", nil)
+	api.ServeHTTP(w, req)
+
+	// then the binary body is base64 encoded and flagged
+	var messages []historyMessage
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+	if a.Len(messages, 2) {
+		a.True(messages[0].Binary)
+		a.Equal(base64.StdEncoding.EncodeToString(binary), messages[0].Body)
+		a.False(messages[1].Binary)
+		a.Equal("text", messages[1].Body)
+	}
+}
+
+func TestServeHTTP_GetLastMessagesErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(false), nil)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	cases := []struct {
+		query string
+		code  int
+	}{
+		{"", http.StatusNotFound},
+		{"last=-1", http.StatusBadRequest},
+		{"last=5&order=random", http.StatusBadRequest},
+		{"last=5", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo?"+c.query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(c.code, w.Code, c.query)
+	}
+}
+
+func TestServeHTTP_GetRangeOfMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with 300 messages in /foo/bar and /foo/other
+	dir, err := ioutil.TempDir("", "guble_range_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	ids := make(map[int]uint64)
+	for i := 1; i <= 300; i++ {
+		m := &protocol.Message{Path: "/foo/bar", Body: []byte(fmt.Sprintf("%d", i))}
+		if i%6 == 0 {
+			m.Path = "/foo/other"
+		}
+		_, err := fms.StoreMessage(m, 0)
+		a.NoError(err)
+		ids[i] = m.ID
+	}
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	get := func(query string) []string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/bar?"+query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(http.StatusOK, w.Code)
+		var messages []historyMessage
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+		bodies := make([]string, 0, len(messages))
+		for _, m := range messages {
+			bodies = append(bodies, m.Body)
+		}
+		return bodies
+	}
+
+	// when requesting a range, then its messages of the topic are returned, the oldest first
+	a.Equal([]string{"4", "5", "7", "8"}, get(fmt.Sprintf("from=%d&to=%d", ids[4], ids[8])))
+
+	// and the number of messages is limited
+	a.Equal([]string{"4", "5"}, get(fmt.Sprintf("from=%d&to=%d&limit=2", ids[4], ids[8])))
+
+	// and an open range over multiple chunks is read to the last message
+	bodies := get(fmt.Sprintf("from=%d&limit=1000", ids[1]))
+	if a.Len(bodies, 250) {
+		a.Equal("1", bodies[0])
+		a.Equal("299", bodies[249])
+	}
+
+	// and a range behind the last message is empty
+	a.Equal([]string{}, get(fmt.Sprintf("from=%d", ids[300]+1)))
+}
+
+func TestServeHTTP_GetRangeOfMessagesErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(false), nil)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	cases := []struct {
+		query string
+		code  int
+	}{
+		{"from=0", http.StatusBadRequest},
+		{"from=abc", http.StatusBadRequest},
+		{"from=5&to=4", http.StatusBadRequest},
+		{"from=5&limit=0", http.StatusBadRequest},
+		{"from=5", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo?"+c.query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(c.code, w.Code, c.query)
+	}
+}
@@ -0,0 +1,59 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const lagSuffix = "/lag"
+
+// subscriberLag is an entry of the lag response
+type subscriberLag struct {
+	NodeID        uint8  `json:"node_id"`
+	UserID        string `json:"user_id"`
+	ApplicationID string `json:"application_id"`
+	Lag           uint64 `json:"lag"`
+}
+
+// isLagRequest returns true for a GET of `/subscribers/{topic}/lag`
+func (api *RestMessageAPI) isLagRequest(r *http.Request) bool {
+	path := removeTrailingSlash(r.URL.Path)
+	return strings.HasPrefix(path, removeTrailingSlash(api.prefix)+subscribersPrefix+"/") &&
+		strings.HasSuffix(path, lagSuffix)
+}
+
+// writeLag replies with the lag of the subscribers of the topic: the number of message ids
+// between the last message routed to a subscriber and the last one read by it.
+func (api *RestMessageAPI) writeLag(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(strings.TrimSuffix(removeTrailingSlash(r.URL.Path), lagSuffix), subscribersPrefix)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	subscribers, err := api.subscribers(topic, q(r, "local") == "true")
+	if err != nil {
+		log.WithError(err).Error("Getting the subscribers failed")
+		http.Error(w, "Server error.", http.StatusInternalServerError)
+		return
+	}
+	if len(subscribers) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	lags := make([]subscriberLag, 0, len(subscribers))
+	for _, s := range subscribers {
+		lags = append(lags, subscriberLag{
+			NodeID:        s.NodeID,
+			UserID:        s.UserID,
+			ApplicationID: s.ApplicationID,
+			Lag:           s.Lag,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lags)
+}
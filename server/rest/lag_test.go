@@ -0,0 +1,58 @@
+package rest
+
+import (
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTP_GetSubscribersLag(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	routerMock.EXPECT().GetSubscribers("/foo/bar").
+		Return([]byte(`[{"node_id":1,"user_id":"marvin","application_id":"app1","route":{"user_id":"marvin"},"lag":42}]`), nil)
+	routerMock.EXPECT().Cluster().Return(nil)
+
+	// when requesting the lag of the subscribers of the topic
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/api/subscribers/foo/bar/lag", nil)
+	a.NoError(err)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	// then the lag of each subscriber is returned
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	a.JSONEq(`[{"node_id":1,"user_id":"marvin","application_id":"app1","lag":42}]`, w.Body.String())
+}
+
+func TestServeHTTP_GetSubscribersLagNotFound(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	routerMock.EXPECT().GetSubscribers("/foo").Return([]byte("[]"), nil)
+
+	// when requesting the lag of a topic without subscribers, then not found is returned
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/api/subscribers/foo/lag?local=true", nil)
+	a.NoError(err)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusNotFound, w.Code)
+
+	// and without a topic as well
+	req, err = http.NewRequest(http.MethodGet, "http://localhost/api/subscribers/lag", nil)
+	a.NoError(err)
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusNotFound, w.Code)
+}
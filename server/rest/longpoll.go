@@ -0,0 +1,200 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	subscribePath = "/subscribe"
+
+	// defaultLongPollTimeout is the duration a long poll waits for a message, if the request has no `timeout`
+	defaultLongPollTimeout = 30 * time.Second
+
+	// maxLongPollTimeout limits the `timeout` of a long poll, if the webserver has no write timeout
+	maxLongPollTimeout = 5 * time.Minute
+
+	// longPollReplyMargin is the time left for replying to a long poll before the write timeout of the webserver
+	longPollReplyMargin = time.Second
+
+	// defaultLongPollMax is the maximum number of messages returned by a long poll, if the request has no `max`
+	defaultLongPollMax = 10
+)
+
+// longPolls counts the long polls, for the unique application id of their temporary routes
+var longPolls uint64
+
+// longPollResponse is the response of a long poll, with the messages and the cursor for the next poll
+type longPollResponse struct {
+	Messages []*historyMessage `json:"messages"`
+	Since    uint64            `json:"since"`
+}
+
+// isSubscribeRequest returns true for a GET of `/subscribe/{topic}`
+func (api *RestMessageAPI) isSubscribeRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+subscribePath+"/")
+}
+
+// longPoll replies with the messages of the topic following the id `since`, as soon as there is at least one of them,
+// or with none after the `timeout` (e.g. `30s`). At most `max` messages are returned, the oldest first,
+// together with the `since` cursor of the next poll. Without `since`, only the messages published while waiting are returned.
+// The messages are received by a temporary route, which is unsubscribed when the request completes.
+func (api *RestMessageAPI) longPoll(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(removeTrailingSlash(r.URL.Path), subscribePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	since, err := idParam(r, "since")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "since has to be a message id")
+		return
+	}
+	timeout := defaultLongPollTimeout
+	if t := q(r, "timeout"); t != "" {
+		if timeout, err = time.ParseDuration(t); err != nil || timeout <= 0 {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "timeout has to be a positive duration")
+			return
+		}
+	}
+	if max := api.maxLongPollTimeout(); timeout > max {
+		timeout = max
+	}
+	max := defaultLongPollMax
+	if m := q(r, "max"); m != "" {
+		if max, err = strconv.Atoi(m); err != nil || max <= 0 || max > historyChunkSize {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST,
+				fmt.Sprintf("max has to be a number of messages from 1 to %d", historyChunkSize))
+			return
+		}
+	}
+
+	path := protocol.Path(topic)
+	userID := q(r, "userId")
+	if am, err := api.router.AccessManager(); err == nil && !auth.IsAllowed(am, auth.READ, userID, "", path) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, fmt.Sprintf("read access denied on %v", path))
+		return
+	}
+
+	// the route is subscribed before reading the stored messages, so that no message is missed in between
+	route := router.NewRoute(router.RouteConfig{
+		RouteParams: router.RouteParams{
+			"application_id": fmt.Sprintf("longpoll-%d", atomic.AddUint64(&longPolls, 1)),
+			"user_id":        userID,
+		},
+		Path:        path,
+		ChannelSize: max,
+	})
+	if _, err := api.router.Subscribe(route); err != nil {
+		if _, ok := err.(*router.PermissionDeniedError); ok {
+			writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, err.Error())
+			return
+		}
+		if err == router.ErrTopicFull {
+			writeJSONError(w, http.StatusServiceUnavailable, protocol.ERROR_TOPIC_FULL, err.Error())
+			return
+		}
+		if err == router.ErrTooManyTopics {
+			writeJSONError(w, http.StatusServiceUnavailable, protocol.ERROR_TOO_MANY_TOPICS, err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	defer api.router.Unsubscribe(route)
+
+	var messages []*protocol.Message
+	if q(r, "since") != "" {
+		// the route path is the canonical one, if the topic is an alias
+		if messages, err = api.fetchRange(route.Path, since+1, 0, max); err != nil {
+			log.WithError(err).WithField("topic", topic).Error("Fetching the messages of the long poll failed")
+			writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+			return
+		}
+	}
+	if len(messages) > 0 {
+		since = messages[len(messages)-1].ID
+	} else {
+		var disconnected bool
+		if messages, disconnected = receiveLongPoll(r, route, since, max, timeout); disconnected {
+			log.WithField("topic", topic).Debug("Long poll canceled by the client")
+			return
+		}
+	}
+
+	response := longPollResponse{Messages: make([]*historyMessage, len(messages)), Since: since}
+	for i, m := range messages {
+		response.Messages[i] = newHistoryMessage(m)
+		if m.ID > response.Since {
+			response.Since = m.ID
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// receiveLongPoll waits for the messages of the route following the id `since`, and returns the first one
+// together with those already buffered, up to max. It returns no messages after the timeout,
+// and true if the client disconnected while waiting.
+func receiveLongPoll(r *http.Request, route *router.Route, since uint64, max int, timeout time.Duration) ([]*protocol.Message, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var messages []*protocol.Message
+	for len(messages) < max {
+		var m *protocol.Message
+		var open bool
+		if len(messages) == 0 {
+			select {
+			case m, open = <-route.MessagesChannel():
+			case <-timer.C:
+				return nil, false
+			case <-r.Context().Done():
+				return nil, true
+			}
+		} else {
+			select {
+			case m, open = <-route.MessagesChannel():
+			default:
+				return messages, false
+			}
+		}
+		if !open {
+			// the router closed the route, e.g. when stopping
+			return messages, false
+		}
+		if m.ID <= since {
+			continue
+		}
+		// the routed message is shared with the other routes, so its body is decompressed on a copy
+		copied := *m
+		if err := copied.DecompressBody(); err != nil {
+			log.WithError(err).WithField("id", m.ID).Error("Error decompressing a message of the long poll")
+			continue
+		}
+		messages = append(messages, &copied)
+	}
+	return messages, false
+}
+
+// maxLongPollTimeout returns the maximum timeout of a long poll, which replies before the write timeout of the webserver
+func (api *RestMessageAPI) maxLongPollTimeout() time.Duration {
+	if api.WriteTimeout > 0 {
+		if max := api.WriteTimeout - longPollReplyMargin; max > 0 {
+			return max
+		}
+		return api.WriteTimeout
+	}
+	return maxLongPollTimeout
+}
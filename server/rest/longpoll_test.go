@@ -0,0 +1,198 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// longPollRouter returns a router mock with the store of the directory, passing the subscribed routes to routeC
+func longPollRouter(ctrl *gomock.Controller, dir string) (*MockRouter, *filestore.FileMessageStore, chan *router.Route) {
+	fms := filestore.New(dir)
+	routeC := make(chan *router.Route, 1)
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		routeC <- r
+	}).Return(nil, nil)
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+	return routerMock, fms, routeC
+}
+
+func longPoll(a *assert.Assertions, api *RestMessageAPI, query string) *longPollResponse {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/subscribe/foo?"+query, nil)
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	response := &longPollResponse{}
+	a.NoError(json.Unmarshal(w.Body.Bytes(), response))
+	return response
+}
+
+func TestServeHTTP_LongPollReturnsTheStoredMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with messages of the topic
+	dir, err := ioutil.TempDir("", "guble_longpoll_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	routerMock, fms, routeC := longPollRouter(ctrl, dir)
+	var ids []uint64
+	for i := 1; i <= 4; i++ {
+		m := &protocol.Message{Path: "/foo", Body: []byte(fmt.Sprintf("%d", i))}
+		_, err := fms.StoreMessage(m, 0)
+		a.NoError(err)
+		ids = append(ids, m.ID)
+	}
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// when polling since the first one, then the following ones are returned at once, up to max
+	response := longPoll(a, api, fmt.Sprintf("since=%d&max=2", ids[0]))
+	a.Len(response.Messages, 2)
+	a.Equal("2", response.Messages[0].Body)
+	a.Equal("3", response.Messages[1].Body)
+	a.Equal(ids[2], response.Since)
+
+	// and the temporary route was subscribed for the topic
+	route := <-routeC
+	a.Equal(protocol.Path("/foo"), route.Path)
+}
+
+func TestServeHTTP_LongPollWaitsForTheNextMessage(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "guble_longpoll_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	routerMock, _, routeC := longPollRouter(ctrl, dir)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// given a message routed while the poll is waiting
+	go func() {
+		route := <-routeC
+		time.Sleep(10 * time.Millisecond)
+		route.Deliver(&protocol.Message{ID: 5, Path: "/foo/bar", Body: []byte("hello")}, false)
+	}()
+
+	// then it is returned with the next cursor
+	response := longPoll(a, api, "since=4&timeout=5s")
+	a.Len(response.Messages, 1)
+	a.Equal("hello", response.Messages[0].Body)
+	a.Equal(protocol.Path("/foo/bar"), response.Messages[0].Path)
+	a.Equal(uint64(5), response.Since)
+}
+
+func TestServeHTTP_LongPollTimeout(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "guble_longpoll_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	routerMock, _, _ := longPollRouter(ctrl, dir)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// when no message arrives before the timeout, then none is returned and the cursor is kept
+	response := longPoll(a, api, "since=4&timeout=10ms")
+	a.Len(response.Messages, 0)
+	a.Equal(uint64(4), response.Since)
+}
+
+func TestServeHTTP_LongPollClientDisconnect(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "guble_longpoll_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	routerMock, _, routeC := longPollRouter(ctrl, dir)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// given a client disconnecting while the poll is waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-routeC
+		cancel()
+	}()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/subscribe/foo?timeout=5s", nil)
+	w := httptest.NewRecorder()
+
+	// then the poll returns without a response, after unsubscribing the route
+	done := make(chan bool)
+	go func() {
+		api.ServeHTTP(w, req.WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-done:
+		a.Equal(0, w.Body.Len())
+	case <-time.After(time.Second):
+		a.Fail("poll not canceled")
+	}
+}
+
+func TestServeHTTP_LongPollErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(false), nil)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	cases := []struct {
+		query string
+		code  int
+	}{
+		{"since=abc", http.StatusBadRequest},
+		{"timeout=soon", http.StatusBadRequest},
+		{"timeout=-1s", http.StatusBadRequest},
+		{"max=0", http.StatusBadRequest},
+		{"max=1000", http.StatusBadRequest},
+		{"since=5", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/subscribe/foo?"+c.query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(c.code, w.Code, c.query)
+	}
+}
+
+func TestRestMessageAPI_MaxLongPollTimeout(t *testing.T) {
+	a := assert.New(t)
+	api := NewRestMessageAPI(nil, "/api")
+	a.Equal(maxLongPollTimeout, api.maxLongPollTimeout())
+
+	// a long poll replies before the write timeout of the webserver
+	api.WriteTimeout = 30 * time.Second
+	a.Equal(29*time.Second, api.maxLongPollTimeout())
+}
@@ -0,0 +1,70 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/store"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const offsetsSuffix = "/offsets"
+
+// offsets is the response of the offsets request
+type offsets struct {
+	FirstID uint64 `json:"firstID"`
+	LastID  uint64 `json:"lastID"`
+	Count   uint64 `json:"count"`
+}
+
+// isOffsetsRequest returns true for a GET of `/message/{topic}/offsets`
+func (api *RestMessageAPI) isOffsetsRequest(r *http.Request) bool {
+	path := removeTrailingSlash(r.URL.Path)
+	return strings.HasPrefix(path, removeTrailingSlash(api.prefix)+"/message/") &&
+		strings.HasSuffix(path, offsetsSuffix)
+}
+
+// writeOffsets replies with the first and last message id and the number of messages of the partition of the topic,
+// as read from the index of the store. An empty topic has zero offsets.
+func (api *RestMessageAPI) writeOffsets(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(strings.TrimSuffix(removeTrailingSlash(r.URL.Path), offsetsSuffix), "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := protocol.Path(topic)
+	if am, err := api.router.AccessManager(); err == nil && !auth.IsAllowed(am, auth.READ, q(r, "userId"), "", path) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, fmt.Sprintf("read access denied on %v", path))
+		return
+	}
+
+	messageStore, err := api.router.MessageStore()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	reader, ok := messageStore.(store.OffsetsReader)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, protocol.ERROR_INTERNAL_SERVER, "the message store does not support offsets")
+		return
+	}
+	o, err := reader.Offsets(path.Partition())
+	if err != nil {
+		log.WithError(err).WithField("topic", topic).Error("Reading the offsets failed")
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&offsets{
+		FirstID: o.FirstID,
+		LastID:  o.LastID,
+		Count:   o.Count,
+	})
+}
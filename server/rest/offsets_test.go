@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeHTTP_GetOffsets(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with three messages in the partition foo
+	dir, err := ioutil.TempDir("", "guble_offsets_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	for _, path := range []protocol.Path{"/foo/bar", "/foo/other", "/foo/bar"} {
+		_, err := fms.StoreMessage(&protocol.Message{Path: path, Body: []byte("Hello")}, 0)
+		a.NoError(err)
+	}
+	lastID, err := fms.MaxMessageID("foo")
+	a.NoError(err)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// when requesting the offsets of a topic, then the offsets of its partition are returned
+	w := get("http://localhost/api/message/foo/bar/offsets")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	var o offsets
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &o))
+	a.True(o.FirstID > 0)
+	a.Equal(lastID, o.LastID)
+	a.Equal(uint64(3), o.Count)
+
+	// and an empty topic has zero offsets
+	w = get("http://localhost/api/message/empty/offsets")
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"firstID":0,"lastID":0,"count":0}`, w.Body.String())
+
+	// and a missing topic is not found
+	a.Equal(http.StatusNotFound, get("http://localhost/api/message/offsets").Code)
+}
+
+func TestServeHTTP_GetOffsetsNotAllowed(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(false), nil)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/offsets?userId=user01", nil)
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestServeHTTP_GetOffsetsNotSupportedByTheStore(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	routerMock.EXPECT().MessageStore().Return(dummystore.New(kvstore.NewMemoryKVStore()), nil)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/offsets", nil)
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusNotImplemented, w.Code)
+}
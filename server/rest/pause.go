@@ -0,0 +1,79 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	topicsPrefix = "/topics"
+	pauseSuffix  = "/pause"
+	resumeSuffix = "/resume"
+)
+
+// isPauseRequest returns true for a POST of `/topics/{topic}/pause` or `/topics/{topic}/resume`
+func (api *RestMessageAPI) isPauseRequest(r *http.Request) bool {
+	path := removeTrailingSlash(r.URL.Path)
+	return strings.HasPrefix(path, removeTrailingSlash(api.prefix)+topicsPrefix+"/") &&
+		(strings.HasSuffix(path, pauseSuffix) || strings.HasSuffix(path, resumeSuffix))
+}
+
+// pause pauses or resumes the delivery of a topic and its subtopics on all nodes of the cluster,
+// e.g. by `POST /api/topics/foo/pause`. The messages published while the topic is paused are stored,
+// and delivered in order on resume.
+func (api *RestMessageAPI) pause(w http.ResponseWriter, r *http.Request) {
+	path := removeTrailingSlash(r.URL.Path)
+	resume := strings.HasSuffix(path, resumeSuffix)
+	action := "pausing"
+	if resume {
+		action = "resuming"
+	}
+	if !api.isAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, action+" a topic requires the admin user")
+		return
+	}
+
+	topic, err := api.extractTopic(strings.TrimSuffix(strings.TrimSuffix(path, pauseSuffix), resumeSuffix), topicsPrefix)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	p, ok := api.router.(router.Pauser)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, protocol.ERROR_BAD_REQUEST, "The router does not support pausing topics.")
+		return
+	}
+	if resume {
+		err = p.Resume(protocol.Path(topic))
+	} else {
+		err = p.Pause(protocol.Path(topic))
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if _, stopping := err.(*router.ModuleStoppingError); stopping {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSONError(w, code, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	l := log.WithFields(log.Fields{"topic": topic, "userId": api.AdminUser})
+	if resume {
+		l.Info("Resumed topic")
+	} else {
+		l.Info("Paused topic")
+	}
+	w.Write([]byte("OK"))
+}
+
+// pausedTopics returns the topics paused on this node, or nil if the router can not pause topics
+func (api *RestMessageAPI) pausedTopics() []router.PausedTopic {
+	if p, ok := api.router.(router.Pauser); ok {
+		return p.PausedTopics()
+	}
+	return nil
+}
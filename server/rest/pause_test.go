@@ -0,0 +1,80 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pausingRouter is a router, which records the paused and resumed topics
+type pausingRouter struct {
+	*MockRouter
+	paused  []protocol.Path
+	resumed []protocol.Path
+}
+
+func (r *pausingRouter) Pause(topic protocol.Path) error {
+	r.paused = append(r.paused, topic)
+	return nil
+}
+
+func (r *pausingRouter) Resume(topic protocol.Path) error {
+	r.resumed = append(r.resumed, topic)
+	return nil
+}
+
+func (r *pausingRouter) PausedTopics() []router.PausedTopic {
+	topics := make([]router.PausedTopic, 0, len(r.paused))
+	for _, topic := range r.paused {
+		topics = append(topics, router.PausedTopic{Topic: topic})
+	}
+	return topics
+}
+
+func (r *pausingRouter) SetMaxPausedMessages(int) {}
+
+func TestServeHTTP_PauseAndResume(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := &pausingRouter{MockRouter: NewMockRouter(ctrl)}
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+
+	post := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// without an admin user, nobody can pause a topic
+	a.Equal(http.StatusForbidden, post("http://localhost/api/topics/foo/bar/pause?access_token=secret").Code)
+	a.Empty(routerMock.paused)
+
+	// and the admin user pauses and resumes the topic
+	api.AdminUser = "marvin"
+	w := post("http://localhost/api/topics/foo/bar/pause?access_token=secret")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("OK", w.Body.String())
+	a.Equal([]protocol.Path{"/foo/bar"}, routerMock.paused)
+
+	a.Equal(http.StatusOK, post("http://localhost/api/topics/foo/bar/resume/?access_token=secret").Code)
+	a.Equal([]protocol.Path{"/foo/bar"}, routerMock.resumed)
+
+	// and a request without a topic is not found
+	a.Equal(http.StatusNotFound, post("http://localhost/api/topics/pause?access_token=secret").Code)
+
+	// and a router without pausing is not supported
+	api = NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	api.Authenticator = tokenAuthenticator{}
+	api.AdminUser = "marvin"
+	a.Equal(http.StatusNotImplemented, post("http://localhost/api/topics/foo/pause?access_token=secret").Code)
+}
@@ -0,0 +1,39 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+)
+
+const quotasPath = "/quotas"
+
+// isQuotaRequest returns true for a GET of `/quotas/{applicationId}`
+func (api *RestMessageAPI) isQuotaRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+quotasPath+"/")
+}
+
+// writeQuotaUsage replies with the number of messages published by the application on this node, in the current window
+// of its quota, together with the limit and the time the window is reset.
+func (api *RestMessageAPI) writeQuotaUsage(w http.ResponseWriter, r *http.Request) {
+	applicationID := strings.TrimPrefix(removeTrailingSlash(r.URL.Path), removeTrailingSlash(api.prefix)+quotasPath+"/")
+	if protocol.ValidateApplicationID(applicationID) != nil {
+		http.NotFound(w, r)
+		return
+	}
+	meter, ok := api.router.(router.QuotaMeter)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, protocol.ERROR_BAD_REQUEST, "the router does not support quotas")
+		return
+	}
+	usage, ok := meter.QuotaUsage(applicationID)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, protocol.ERROR_BAD_REQUEST, "the application has no quota")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,90 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// meteringRouter is a router, which has a quota for the application `shop`
+type meteringRouter struct {
+	*MockRouter
+	usage router.QuotaUsage
+}
+
+func (r *meteringRouter) QuotaUsage(applicationID string) (router.QuotaUsage, bool) {
+	return r.usage, applicationID == r.usage.ApplicationID
+}
+
+func TestServeHTTP_PostExceedingTheQuota(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// given a message of an application, which used up its quota
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("shop", msg.ApplicationID)
+	}).Return(&router.QuotaExceededError{ApplicationID: "shop", Limit: 10, RetryAfter: time.Hour})
+
+	// then it is rejected with the time until the next window of the quota
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?applicationId=shop", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusTooManyRequests, w.Code)
+	a.Equal("3600", w.Header().Get("Retry-After"))
+	a.True(strings.Contains(w.Body.String(), protocol.ERROR_QUOTA_EXCEEDED))
+
+	// and an invalid application id is rejected
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?applicationId=a%20b", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestServeHTTP_QuotaUsage(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	reset := time.Date(2017, 1, 3, 0, 0, 0, 0, time.UTC)
+	routerMock := &meteringRouter{
+		MockRouter: NewMockRouter(ctrl),
+		usage:      router.QuotaUsage{ApplicationID: "shop", Limit: 10, Used: 4, Window: "24h0m0s", Reset: reset},
+	}
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	get := func(api *RestMessageAPI, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// the usage of an application is returned
+	w := get(api, "http://localhost/api/quotas/shop")
+	a.Equal(http.StatusOK, w.Code)
+	usage := router.QuotaUsage{}
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &usage))
+	a.Equal(routerMock.usage, usage)
+
+	// and an application without quota is not found
+	a.Equal(http.StatusNotFound, get(api, "http://localhost/api/quotas/other").Code)
+	a.Equal(http.StatusNotFound, get(api, "http://localhost/api/quotas/").Code)
+
+	// and a router without quotas is not supported
+	a.Equal(http.StatusNotImplemented, get(NewRestMessageAPI(NewMockRouter(ctrl), "/api"), "http://localhost/api/quotas/shop").Code)
+}
@@ -1,20 +1,27 @@
 package rest
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 
 	"github.com/azer/snakecase"
 
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/cluster"
 	"github.com/smancke/guble/server/router"
 
 	"github.com/rs/xid"
 
 	"bytes"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -23,19 +30,48 @@ const (
 	xHeaderPrefix     = "x-guble-"
 	filterPrefix      = "filter"
 	subscribersPrefix = "/subscribers"
+	clusterNodesPath  = "/cluster/nodes"
+
+	// binaryContentType is the content type of a posted body, which is published as binary data
+	binaryContentType = "application/octet-stream"
+
+	// traceParentHeader is the header of the W3C trace context, whose trace id is taken for a message without trace id
+	traceParentHeader = "traceparent"
+
+	// subscribersQueryTimeout is the maximum time to wait for the subscribers of the other cluster nodes
+	subscribersQueryTimeout = 2 * time.Second
 )
 
-var errNotFound = errors.New("Not Found.")
+var (
+	errNotFound        = errors.New("Not Found.")
+	errMessageTooLarge = errors.New("Message body too large.")
+)
 
 // RestMessageAPI is a struct representing a router's connector for a REST API.
 type RestMessageAPI struct {
 	router router.Router
 	prefix string
+
+	// MaxMessageSize is the maximum body size in bytes of a posted message. Zero disables the limit.
+	MaxMessageSize int
+
+	// Reconnector is asked to reconnect the clients by the drain request, nil if there are no clients to drain
+	Reconnector Reconnector
+
+	// Authenticator authenticates the requests, as the user of their `userId`. Nil accepts all requests.
+	Authenticator auth.Authenticator
+
+	// AdminUser is the user id, which is allowed to truncate, pause and resume the topics, if authenticated by the Authenticator.
+	// Empty disables these requests.
+	AdminUser string
+
+	// WriteTimeout is the write timeout of the webserver, which limits the timeout of the long polls. Zero means none.
+	WriteTimeout time.Duration
 }
 
 // NewRestMessageAPI returns a new RestMessageAPI.
 func NewRestMessageAPI(router router.Router, prefix string) *RestMessageAPI {
-	return &RestMessageAPI{router, prefix}
+	return &RestMessageAPI{router: router, prefix: prefix}
 }
 
 // GetPrefix returns the prefix.
@@ -51,9 +87,79 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if api.Authenticator != nil {
+		userID, applicationID, err := auth.AuthenticateApplication(api.Authenticator, r, q(r, "userId"), q(r, protocol.ApplicationIDParam))
+		if err != nil {
+			log.WithError(err).WithField("url", r.URL.Path).Info("Rejected the request")
+			writeJSONError(w, auth.AuthenticationStatus(err), protocol.ERROR_UNAUTHORIZED, err.Error())
+			return
+		}
+		// the authenticated user (and application) replace the ones of the query, for the checks of the access manager
+		if userID != "" || applicationID != "" {
+			query := r.URL.Query()
+			if userID != "" {
+				query.Set("userId", userID)
+			}
+			if applicationID != "" {
+				query.Set(protocol.ApplicationIDParam, applicationID)
+			}
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+
+	if api.isAliasesRequest(r) {
+		api.aliases(w, r)
+		return
+	}
+
 	if r.Method == http.MethodGet {
 		log.WithField("url", r.URL.Path).Debug("GET")
 
+		if removeTrailingSlash(r.URL.Path) == removeTrailingSlash(api.prefix)+clusterNodesPath {
+			api.writeClusterNodes(w, r)
+			return
+		}
+
+		if api.isOffsetsRequest(r) {
+			api.writeOffsets(w, r)
+			return
+		}
+
+		if api.isSearchRequest(r) {
+			api.writeSearch(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+"/message/") && q(r, "last") != "" {
+			api.writeHistory(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+"/message/") && q(r, "from") != "" {
+			api.writeRange(w, r)
+			return
+		}
+
+		if api.isLagRequest(r) {
+			api.writeLag(w, r)
+			return
+		}
+
+		if api.isSubscribeRequest(r) {
+			api.longPoll(w, r)
+			return
+		}
+
+		if api.isTapRequest(r) {
+			api.tap(w, r)
+			return
+		}
+
+		if api.isQuotaRequest(r) {
+			api.writeQuotaUsage(w, r)
+			return
+		}
+
 		topic, err := api.extractTopic(r.URL.Path, subscribersPrefix)
 		if err != nil {
 			log.WithError(err).Error("Extracting topic failed")
@@ -65,7 +171,23 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		resp, err := api.router.GetSubscribers(topic)
+		subscribers, err := api.subscribers(topic, q(r, "local") == "true")
+		if err != nil {
+			log.WithError(err).Error("Getting the subscribers failed")
+			http.Error(w, "Server error.", http.StatusInternalServerError)
+			return
+		}
+		if len(subscribers) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		resp, err := json.Marshal(subscribers)
+		if err != nil {
+			log.WithError(err).Error("Encoding the subscribers failed")
+			http.Error(w, "Server error.", http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 
 		_, err = w.Write(resp)
@@ -77,12 +199,41 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodDelete {
+		if api.isCancelScheduledRequest(r) {
+			api.cancelScheduled(w, r)
+			return
+		}
+		api.truncate(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	if api.isDrainRequest(r) {
+		api.drain(w, r)
+		return
+	}
+
+	if api.isPauseRequest(r) {
+		api.pause(w, r)
+		return
+	}
+
+	if strings.HasSuffix(removeTrailingSlash(r.URL.Path), batchSuffix) {
+		api.publishBatch(w, r)
+		return
+	}
+
+	body, err := api.readBody(r)
+	if err == errMessageTooLarge {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, protocol.ERROR_MAX_MESSAGE_SIZE_EXCEEDED,
+			fmt.Sprintf("message body exceeds the maximum of %d bytes", api.MaxMessageSize))
+		return
+	}
 	if err != nil {
 		http.Error(w, "Can not read body", http.StatusBadRequest)
 		return
@@ -98,19 +249,184 @@ func (api *RestMessageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	applicationID, err := publisherApplicationID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	}
+
 	msg := &protocol.Message{
 		Path:          protocol.Path(topic),
 		Body:          body,
 		UserID:        q(r, "userId"),
-		ApplicationID: xid.New().String(),
+		ApplicationID: applicationID,
 		HeaderJSON:    headersToJSON(r.Header),
+		Binary:        isBinary(r),
 	}
+	setTraceParent(r, msg)
 
 	// add filters
 	api.setFilters(r, msg)
 
-	api.router.HandleMessage(msg)
-	fmt.Fprintf(w, "OK")
+	if _, err := msg.Priority(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	}
+	if _, err := msg.DeliverAt(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	}
+	if _, err := msg.Expires(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	}
+	if _, err := msg.ContentType(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	}
+
+	err = api.router.HandleMessage(msg)
+	if err == router.ErrTooManyTopics {
+		writeJSONError(w, http.StatusServiceUnavailable, protocol.ERROR_TOO_MANY_TOPICS, err.Error())
+		return
+	}
+	switch err := err.(type) {
+	case *router.PermissionDeniedError:
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, err.Error())
+		return
+	case *router.MiddlewareError:
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+		return
+	case *router.QuotaExceededError:
+		w.Header().Set("Retry-After", strconv.FormatInt(err.RetryAfterSeconds(), 10))
+		writeJSONError(w, http.StatusTooManyRequests, protocol.ERROR_QUOTA_EXCEEDED, err.Error())
+		return
+	}
+	if q(r, "receipt") != "true" {
+		fmt.Fprintf(w, "OK")
+		return
+	}
+	api.writeReceipt(w, msg, err)
+}
+
+// receipt is the response of a message posted with `receipt=true`, after it was stored
+type receipt struct {
+	MessageID      uint64 `json:"messageID"`
+	StoreTimestamp int64  `json:"storeTimestamp"`
+	Partition      string `json:"partition"`
+	NodeID         uint8  `json:"nodeID"`
+	TraceID        string `json:"traceID,omitempty"`
+}
+
+// writeReceipt replies with the id, time and partition assigned to the stored message,
+// or with the error returned when handling it.
+func (api *RestMessageAPI) writeReceipt(w http.ResponseWriter, msg *protocol.Message, err error) {
+	if err != nil {
+		log.WithError(err).WithField("path", msg.Path).Error("Handling the message with receipt failed")
+		code := http.StatusInternalServerError
+		switch err.(type) {
+		case *router.PermissionDeniedError:
+			code = http.StatusForbidden
+		case *router.ModuleStoppingError:
+			code = http.StatusServiceUnavailable
+		}
+		writeJSONError(w, code, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&receipt{
+		MessageID:      msg.ID,
+		StoreTimestamp: msg.Time,
+		Partition:      msg.Path.Partition(),
+		NodeID:         msg.NodeID,
+		TraceID:        msg.TraceID(),
+	})
+}
+
+// clusterNodes is the response of the cluster nodes request
+type clusterNodes struct {
+	NodeID uint8              `json:"nodeID"`
+	Nodes  []cluster.NodeInfo `json:"nodes"`
+
+	// Paused are the topics paused on this node; a pause is sent to all nodes of the cluster
+	Paused []router.PausedTopic `json:"paused,omitempty"`
+}
+
+// writeClusterNodes replies with the nodes of the cluster, as currently seen by the gossip layer of this node.
+// Not found is returned, if guble is not running in cluster mode.
+func (api *RestMessageAPI) writeClusterNodes(w http.ResponseWriter, r *http.Request) {
+	c := api.router.Cluster()
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&clusterNodes{
+		NodeID: c.Config.ID,
+		Nodes:  c.Nodes(),
+		Paused: api.pausedTopics(),
+	})
+}
+
+// readBody reads the body of the request, without reading more than MaxMessageSize+1 bytes from the client
+func (api *RestMessageAPI) readBody(r *http.Request) ([]byte, error) {
+	if api.MaxMessageSize <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(api.MaxMessageSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > api.MaxMessageSize {
+		return nil, errMessageTooLarge
+	}
+	return body, nil
+}
+
+// isBinary returns true for a request with a binary body, posted with the content type `application/octet-stream`
+func isBinary(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == binaryContentType
+}
+
+// writeJSONError replies with the given status code and a json body describing the error
+func writeJSONError(w http.ResponseWriter, code int, name string, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":       name,
+		"description": description,
+	})
+}
+
+// subscribers returns the subscribers of the topic connected to this node
+// and, if not restricted to the local node, to all other nodes of the cluster.
+func (api *RestMessageAPI) subscribers(topic string, local bool) ([]router.Subscriber, error) {
+	localSubscribers, err := api.router.GetSubscribers(topic)
+	if err != nil {
+		return nil, err
+	}
+	nodesSubscribers := [][]byte{localSubscribers}
+
+	if !local && api.router.Cluster() != nil {
+		remoteSubscribers, err := api.router.Cluster().QuerySubscribers(topic, subscribersQueryTimeout)
+		if err != nil {
+			return nil, err
+		}
+		nodesSubscribers = append(nodesSubscribers, remoteSubscribers...)
+	}
+
+	subscribers := make([]router.Subscriber, 0)
+	for _, data := range nodesSubscribers {
+		var nodeSubscribers []router.Subscriber
+		if err := json.Unmarshal(data, &nodeSubscribers); err != nil {
+			return nil, err
+		}
+		subscribers = append(subscribers, nodeSubscribers...)
+	}
+	return subscribers, nil
 }
 
 func (api *RestMessageAPI) extractTopic(path string, requestTypeTopicPrefix string) (string, error) {
@@ -126,6 +442,16 @@ func (api *RestMessageAPI) extractTopic(path string, requestTypeTopicPrefix stri
 	return topic, nil
 }
 
+// publisherApplicationID returns the application id named by the `applicationId` query parameter,
+// or a random one if the request has none
+func publisherApplicationID(r *http.Request) (string, error) {
+	id := q(r, protocol.ApplicationIDParam)
+	if id == "" {
+		return xid.New().String(), nil
+	}
+	return id, protocol.ValidateApplicationID(id)
+}
+
 // setFilters sets a field found in the format `filterCamelCaseField` in the
 // query of the request to underscore format on the message filters
 func (api *RestMessageAPI) setFilters(r *http.Request, msg *protocol.Message) {
@@ -172,6 +498,19 @@ func headersToJSON(header http.Header) string {
 	return string(buff.Bytes())
 }
 
+// setTraceParent sets the trace id of the W3C `traceparent` header of the request,
+// if the message has no trace id of its own (e.g. by the header `X-Guble-Trace-Id`)
+func setTraceParent(r *http.Request, msg *protocol.Message) {
+	if msg.TraceID() != "" {
+		return
+	}
+	if traceID := protocol.TraceIDOfTraceParent(r.Header.Get(traceParentHeader)); traceID != "" {
+		if err := msg.SetTraceID(traceID); err != nil {
+			log.WithError(err).WithField("path", msg.Path).Warn("Could not set the trace id of the traceparent header")
+		}
+	}
+}
+
 func removeTrailingSlash(path string) string {
 	if len(path) > 1 && path[len(path)-1] == '/' {
 		return path[:len(path)-1]
@@ -2,13 +2,20 @@ package rest
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/cluster"
+	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/testutil"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -54,6 +61,265 @@ func TestServerHTTP(t *testing.T) {
 	api.ServeHTTP(w, req)
 }
 
+// Server should return an 413 Request Entity Too Large and not handle a message exceeding the max message size
+func TestServeHTTP_MaxMessageSizeExceeded(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a rest api with a max message size, smaller than the body
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.MaxMessageSize = len(testBytes) - 1
+
+	// when posting the message
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+
+	// then the message is rejected with a json error, without passing it to the router
+	a.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	body := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(protocol.ERROR_MAX_MESSAGE_SIZE_EXCEEDED, body["error"])
+
+	// and a message with exactly the max message size is accepted
+	api.MaxMessageSize = len(testBytes)
+	routerMock.EXPECT().HandleMessage(gomock.Any())
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+}
+
+func TestServeHTTP_Receipt(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	// given a router which stores the message
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		msg.ID = 42
+		msg.Time = 1420110000
+		msg.NodeID = 3
+	}).Return(nil)
+
+	// when posting a message with receipt
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?receipt=true", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+
+	// then the id, time and partition of the stored message are returned
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	a.JSONEq(`{"messageID":42,"storeTimestamp":1420110000,"partition":"my","nodeID":3}`, w.Body.String())
+}
+
+func TestServeHTTP_ReceiptWithTraceID(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	var traceIDs []string
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		traceIDs = append(traceIDs, msg.TraceID())
+		msg.ID = 42
+	}).Return(nil).Times(2)
+
+	// when posting a message with a W3C trace context, then its trace id is returned with the receipt
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?receipt=true", bytes.NewReader(testBytes))
+	req.Header.Set("traceparent", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01")
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`{"messageID":42,"storeTimestamp":0,"partition":"my","nodeID":0,"traceID":"4bf92f3577b34da6a3ce929d0e0e4736"}`, w.Body.String())
+
+	// and the own trace id of a message is kept
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?receipt=true", bytes.NewReader(testBytes))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("X-Guble-Trace-Id", "checkout-1234")
+	api.ServeHTTP(w, req)
+	a.Equal([]string{"4bf92f3577b34da6a3ce929d0e0e4736", "checkout-1234"}, traceIDs)
+}
+
+// tokenAuthenticator authenticates the token `secret` as the user `marvin`
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	if auth.BearerToken(r) != "secret" {
+		return "", nil, auth.ErrInvalidToken
+	}
+	return "marvin", nil, nil
+}
+
+func TestServeHTTP_Authenticator(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+
+	// when posting without a valid token, then the request is unauthorized
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusUnauthorized, w.Code)
+	body := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(protocol.ERROR_UNAUTHORIZED, body["error"])
+
+	// and posting as another user than the authenticated one is forbidden
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?userId=arthur", bytes.NewReader(testBytes))
+	req.Header.Set("Authorization", "Bearer secret")
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusForbidden, w.Code)
+
+	// and a message posted with a valid token is sent by the authenticated user
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("marvin", msg.UserID)
+	})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?access_token=secret", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+}
+
+func TestServeHTTP_ClientCertAuthenticator(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = auth.NewClientCertAuthenticator()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "orders"}, DNSNames: []string{"orders.example.com"}}
+
+	// when posting with a client certificate, the message is sent by its user and application
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+		a.Equal("orders", msg.UserID)
+		a.Equal("orders.example.com", msg.ApplicationID)
+	})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+
+	// and posting as another application is forbidden
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?applicationId=billing", bytes.NewReader(testBytes))
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestServeHTTP_ReceiptWithError(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{&router.PermissionDeniedError{UserID: "marvin", Path: "/my/topic"}, http.StatusForbidden},
+		{&router.ModuleStoppingError{Name: "router"}, http.StatusServiceUnavailable},
+		{errors.New("store error"), http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		routerMock.EXPECT().HandleMessage(gomock.Any()).Return(c.err)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic?receipt=true", bytes.NewReader(testBytes))
+		api.ServeHTTP(w, req)
+
+		a.Equal(c.code, w.Code)
+		body := make(map[string]string)
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+		a.Equal(c.err.Error(), body["description"])
+	}
+
+	// without receipt the error is not returned
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(errors.New("store error"))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("OK", w.Body.String())
+
+	// but a denied access is returned anyway
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.PermissionDeniedError{UserID: "marvin", Path: "/my/topic"})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusForbidden, w.Code)
+	body := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(protocol.ERROR_ACCESS_DENIED, body["error"])
+
+	// as is a message rejected by a middleware
+	routerMock.EXPECT().HandleMessage(gomock.Any()).Return(&router.MiddlewareError{Name: "pii", Err: errors.New("contains pii")})
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	api.ServeHTTP(w, req)
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal("Message rejected by middleware pii: contains pii", body["description"])
+}
+
+func TestServeHTTP_InvalidPriority(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	api := NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+
+	// when posting a message with an unknown priority, then it is rejected without passing it to the router
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Priority", "urgent")
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusBadRequest, w.Code)
+	body := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(protocol.ERROR_BAD_REQUEST, body["error"])
+}
+
+func TestServeHTTP_InvalidContentType(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	api := NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+
+	// when posting a message with a content-type which is no MIME type, then it is rejected without passing it to the router
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/my/topic", bytes.NewReader(testBytes))
+	req.Header.Set("X-Guble-Content-Type", "json")
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusBadRequest, w.Code)
+	body := make(map[string]string)
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(protocol.ERROR_BAD_REQUEST, body["error"])
+	a.Equal(protocol.ErrInvalidContentType.Error(), body["description"])
+}
+
 // Server should return an 405 Method Not Allowed in case method request is not POST
 func TestServeHTTP_GetError(t *testing.T) {
 	a := assert.New(t)
@@ -87,20 +353,94 @@ func TestServeHTTP_GetSubscribers(t *testing.T) {
 
 	routerMock := NewMockRouter(testutil.MockCtrl)
 	api := NewRestMessageAPI(routerMock, "/api")
-	routerMock.EXPECT().GetSubscribers(gomock.Any()).Return([]byte("{}"), nil)
+	routerMock.EXPECT().GetSubscribers("/mytopic").
+		Return([]byte(`[{"node_id":1,"user_id":"marvin","application_id":"app1","route":{"user_id":"marvin"}}]`), nil)
+	routerMock.EXPECT().Cluster().Return(nil)
 	u, _ := url.Parse("http://localhost/api/subscribers/mytopic")
 	// and a http context
 	req := &http.Request{
 		Method: http.MethodGet,
 		URL:    u,
 	}
-	w := &httptest.ResponseRecorder{}
+	w := httptest.NewRecorder()
 
 	// when: I POST a message
 	api.ServeHTTP(w, req)
 
 	//then
 	a.Equal(http.StatusOK, w.Code)
+	a.JSONEq(`[{"node_id":1,"user_id":"marvin","application_id":"app1","route":{"user_id":"marvin"}}]`, w.Body.String())
+}
+
+func TestServeHTTP_GetSubscribersNotFound(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a topic without subscribers
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	routerMock.EXPECT().GetSubscribers("/mytopic").Return([]byte("[]"), nil)
+
+	// when requesting the subscribers of the local node
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/api/subscribers/mytopic?local=true", nil)
+	a.NoError(err)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	// then the cluster is not queried and not found is returned
+	a.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestServeHTTP_GetClusterNodes(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a node of a cluster
+	node, err := cluster.New(&cluster.Config{ID: 3, Host: "127.0.0.1", Port: 10500})
+	a.NoError(err)
+	defer node.Stop()
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/api/")
+	routerMock.EXPECT().Cluster().Return(node)
+
+	// when requesting the cluster nodes
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/api/cluster/nodes", nil)
+	a.NoError(err)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	// then the local node is returned
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("application/json", w.Header().Get("Content-Type"))
+	var body clusterNodes
+	a.NoError(json.Unmarshal(w.Body.Bytes(), &body))
+	a.Equal(uint8(3), body.NodeID)
+	if a.Len(body.Nodes, 1) {
+		a.Equal(uint8(3), body.Nodes[0].ID)
+		a.Equal("127.0.0.1:10500", body.Nodes[0].Address)
+		a.Equal(cluster.NodeAlive, body.Nodes[0].State)
+		a.InDelta(time.Now().Unix(), body.Nodes[0].LastContact, 2)
+	}
+}
+
+func TestServeHTTP_GetClusterNodesWithoutCluster(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	routerMock.EXPECT().Cluster().Return(nil)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/api/cluster/nodes", nil)
+	a.NoError(err)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusNotFound, w.Code)
 }
 
 func TestHeadersToJSON(t *testing.T) {
@@ -223,3 +563,32 @@ func TestRestMessageAPI_SetFiltersWhenServing(t *testing.T) {
 
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestServeHTTP_BinaryBody(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	api := NewRestMessageAPI(routerMock, "/api")
+	body := []byte{0xff, 0x00, '\n', 0xfe}
+
+	post := func(contentType string) *protocol.Message {
+		var handled *protocol.Message
+		routerMock.EXPECT().HandleMessage(gomock.Any()).Do(func(msg *protocol.Message) {
+			handled = msg
+		})
+		req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/foo", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		api.ServeHTTP(httptest.NewRecorder(), req)
+		return handled
+	}
+
+	// when posting an octet-stream, then the message is flagged binary with the unmodified body
+	msg := post("application/octet-stream")
+	a.True(msg.Binary)
+	a.Equal(body, msg.Body)
+
+	// and any other content type is text
+	a.False(post("text/plain; charset=utf-8").Binary)
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// scheduledPrefix is the path of the scheduled messages, by their topic and id
+const scheduledPrefix = "/scheduled/"
+
+// isCancelScheduledRequest returns true for the path of a scheduled message, e.g. `/api/scheduled/foo/42`
+func (api *RestMessageAPI) isCancelScheduledRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+scheduledPrefix)
+}
+
+// cancelScheduled cancels a message published with a deliver-at header, before it is delivered,
+// e.g. by `DELETE /api/scheduled/foo/42` with the topic of the message and the message id of its receipt,
+// as the ids are generated per partition.
+// The user has to be allowed to publish to the topic of the message.
+// As a message is scheduled on the node it was published to, it has to be cancelled on the same node.
+func (api *RestMessageAPI) cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	param := removeTrailingSlash(strings.TrimPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+scheduledPrefix))
+	i := strings.LastIndex(param, "/")
+	if i <= 0 {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST,
+			fmt.Sprintf("missing topic of the message id %q", param))
+		return
+	}
+	topic, idParam := protocol.Path("/"+param[:i]), param[i+1:]
+	id, err := strconv.ParseUint(idParam, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST,
+			fmt.Sprintf("invalid message id %q", idParam))
+		return
+	}
+
+	s, ok := api.router.(router.Scheduler)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	userID := q(r, "userId")
+	err = s.CancelScheduled(topic, id, userID)
+	switch err.(type) {
+	case nil:
+	case *router.PermissionDeniedError:
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, err.Error())
+		return
+	case *router.ModuleStoppingError:
+		writeJSONError(w, http.StatusServiceUnavailable, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	default:
+		if err == router.ErrScheduledMessageNotFound {
+			writeJSONError(w, http.StatusNotFound, protocol.ERROR_SCHEDULED_MESSAGE_NOT_FOUND, err.Error())
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	log.WithFields(log.Fields{"topic": topic, "messageId": id, "userId": userID}).Info("Cancelled scheduled message")
+	fmt.Fprintf(w, "OK")
+}
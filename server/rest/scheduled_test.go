@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// schedulingRouter is a router, which records the cancelled messages
+type schedulingRouter struct {
+	*MockRouter
+	topics    []protocol.Path
+	cancelled []uint64
+	userIDs   []string
+	err       error
+}
+
+func (r *schedulingRouter) CancelScheduled(topic protocol.Path, id uint64, userID string) error {
+	r.topics = append(r.topics, topic)
+	r.cancelled = append(r.cancelled, id)
+	r.userIDs = append(r.userIDs, userID)
+	return r.err
+}
+
+func TestServeHTTP_CancelScheduled(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := &schedulingRouter{MockRouter: NewMockRouter(ctrl)}
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	del := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// a scheduled message is cancelled by its topic and id, as the user of the request
+	w := del("http://localhost/api/scheduled/foo/bar/42?userId=marvin")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("OK", w.Body.String())
+	a.Equal([]protocol.Path{"/foo/bar"}, routerMock.topics)
+	a.Equal([]uint64{42}, routerMock.cancelled)
+	a.Equal([]string{"marvin"}, routerMock.userIDs)
+
+	// an invalid id, or an id without a topic is rejected
+	a.Equal(http.StatusBadRequest, del("http://localhost/api/scheduled/foo/abc").Code)
+	a.Equal(http.StatusBadRequest, del("http://localhost/api/scheduled/42").Code)
+	a.Len(routerMock.cancelled, 1)
+
+	// and the errors of the router are mapped to their status codes
+	routerMock.err = router.ErrScheduledMessageNotFound
+	w = del("http://localhost/api/scheduled/foo/43")
+	a.Equal(http.StatusNotFound, w.Code)
+	a.Contains(w.Body.String(), protocol.ERROR_SCHEDULED_MESSAGE_NOT_FOUND)
+
+	routerMock.err = &router.PermissionDeniedError{UserID: "marvin", Path: "/foo"}
+	a.Equal(http.StatusForbidden, del("http://localhost/api/scheduled/foo/43?userId=marvin").Code)
+}
+
+func TestServeHTTP_RejectsAnInvalidDeliverAt(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	api := NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost/api/message/foo", strings.NewReader("hello"))
+	req.Header.Set("X-Guble-Deliver-At", "tomorrow")
+	api.ServeHTTP(w, req)
+
+	a.Equal(http.StatusBadRequest, w.Code)
+	a.Contains(w.Body.String(), protocol.ErrInvalidDeliverAt.Error())
+}
@@ -0,0 +1,265 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/store"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	searchSuffix = "/search"
+
+	searchFieldBody   = "body"
+	searchFieldHeader = "header"
+
+	// defaultSearchLimit is the number of matches returned, if no limit is requested
+	defaultSearchLimit = 100
+)
+
+// isSearchRequest returns true for a GET of `/message/{topic}/search`
+func (api *RestMessageAPI) isSearchRequest(r *http.Request) bool {
+	path := removeTrailingSlash(r.URL.Path)
+	return strings.HasPrefix(path, removeTrailingSlash(api.prefix)+"/message/") &&
+		strings.HasSuffix(path, searchSuffix)
+}
+
+// writeSearch replies with the messages of the topic containing the query `q` in their body or header (`field`),
+// the newest first, and at most `limit` of them. The scan can be bounded by the ids `since` and `until` (inclusive).
+// With a header `key`, the query is searched in the value of that header field only.
+// The partition is read in chunks, each one by a separate fetch, so that the store is not locked for the whole scan,
+// and the matches are streamed as a json array while they are found.
+// If the header field is indexed by the message store, the scan reads the header index, and only the matching messages.
+func (api *RestMessageAPI) writeSearch(w http.ResponseWriter, r *http.Request) {
+	topic, err := api.extractTopic(strings.TrimSuffix(removeTrailingSlash(r.URL.Path), searchSuffix), "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	query := q(r, "q")
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "q has to be given")
+		return
+	}
+	field := q(r, "field")
+	if field == "" {
+		field = searchFieldBody
+	}
+	if field != searchFieldBody && field != searchFieldHeader {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, fmt.Sprintf("unknown field %q", field))
+		return
+	}
+	key := q(r, "key")
+	if key != "" && field != searchFieldHeader {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "key requires the header field")
+		return
+	}
+	limit := defaultSearchLimit
+	if l := q(r, "limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "limit has to be a positive number of messages")
+			return
+		}
+	}
+	since, err := idParam(r, "since")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "since has to be a message id")
+		return
+	}
+	until, err := idParam(r, "until")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, "until has to be a message id")
+		return
+	}
+
+	path := protocol.Path(topic)
+	if am, err := api.router.AccessManager(); err == nil && !auth.IsAllowed(am, auth.READ, q(r, "userId"), "", path) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, fmt.Sprintf("read access denied on %v", path))
+		return
+	}
+	messageStore, err := api.router.MessageStore()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	maxID, err := messageStore.MaxMessageID(path.Partition())
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	if until == 0 || until > maxID {
+		until = maxID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	sw := &searchWriter{w: w}
+	sw.begin()
+	defer sw.end()
+
+	if hi, indexedKey, ok := indexedHeader(messageStore, path, key); ok {
+		api.searchHeaderIndex(sw, hi, path, indexedKey, query, since, until, limit)
+		return
+	}
+
+	matches := func(m *protocol.Message) bool {
+		if key != "" {
+			return strings.Contains(m.HeaderValues(key)[key], query)
+		}
+		if field == searchFieldHeader {
+			return strings.Contains(m.HeaderJSON, query)
+		}
+		return strings.Contains(string(m.Body), query)
+	}
+
+	startID := until
+	for startID > 0 && startID >= since && sw.count < limit {
+		req := store.NewFetchRequest(path.Partition(), startID, 0, store.DirectionBackwards, historyChunkSize)
+		req.Init()
+		if err := api.router.Fetch(req); err != nil {
+			log.WithError(err).WithField("topic", topic).Error("Fetching the messages of the search failed")
+			return
+		}
+		fetched, lowestID, _, err := collectFetched(req, path)
+		if err != nil {
+			log.WithError(err).WithField("topic", topic).Error("Fetching the messages of the search failed")
+			return
+		}
+		sort.Sort(newestFirst(fetched))
+		for _, m := range fetched {
+			if m.ID < since || sw.count >= limit {
+				break
+			}
+			if matches(m) {
+				sw.write(newHistoryMessage(m))
+			}
+		}
+		if lowestID == 0 || lowestID >= startID {
+			break
+		}
+		startID = lowestID - 1
+	}
+}
+
+// indexedHeader returns the header index of the message store and the indexed key matching the key, if it is indexed
+func indexedHeader(messageStore store.MessageStore, path protocol.Path, key string) (store.HeaderIndex, string, bool) {
+	hi, ok := messageStore.(store.HeaderIndex)
+	if !ok || key == "" {
+		return nil, "", false
+	}
+	for _, indexedKey := range hi.IndexedHeaders(path.Partition()) {
+		if strings.EqualFold(indexedKey, key) {
+			return hi, indexedKey, true
+		}
+	}
+	return nil, "", false
+}
+
+// searchHeaderIndex scans the header index of the partition in chunks, newest first,
+// and fetches the messages with a matching header value
+func (api *RestMessageAPI) searchHeaderIndex(sw *searchWriter, hi store.HeaderIndex, path protocol.Path, key, query string, since, until uint64, limit int) {
+	startID := until
+	for startID > 0 && startID >= since && sw.count < limit {
+		var matching []uint64
+		lowestID := uint64(0)
+		req := store.NewFetchRequest(path.Partition(), startID, 0, store.DirectionBackwards, historyChunkSize)
+		err := hi.ScanHeaders(req, func(id uint64, header map[string]string) error {
+			if lowestID == 0 || id < lowestID {
+				lowestID = id
+			}
+			if id >= since && strings.Contains(header[key], query) {
+				matching = append(matching, id)
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).WithField("topic", path).Error("Scanning the header index of the search failed")
+			return
+		}
+		sort.Sort(sort.Reverse(uint64s(matching)))
+		for _, id := range matching {
+			if sw.count >= limit {
+				break
+			}
+			m, err := api.fetchMessage(path, id)
+			if err != nil {
+				log.WithError(err).WithField("topic", path).Error("Fetching the messages of the search failed")
+				return
+			}
+			// the header index has the messages of the whole partition, including the other topics
+			if m != nil {
+				sw.write(newHistoryMessage(m))
+			}
+		}
+		if lowestID == 0 || lowestID >= startID {
+			break
+		}
+		startID = lowestID - 1
+	}
+}
+
+// fetchMessage returns the message of the topic with the id, or nil if there is none
+func (api *RestMessageAPI) fetchMessage(topic protocol.Path, id uint64) (*protocol.Message, error) {
+	req := store.NewFetchRequest(topic.Partition(), id, id, store.DirectionForward, 1)
+	req.Init()
+	if err := api.router.Fetch(req); err != nil {
+		return nil, err
+	}
+	fetched, _, _, err := collectFetched(req, topic)
+	if err != nil || len(fetched) == 0 {
+		return nil, err
+	}
+	return fetched[0], nil
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// idParam returns the message id of the query parameter, or zero if it is not given
+func idParam(r *http.Request, name string) (uint64, error) {
+	value := q(r, name)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
+
+// searchWriter streams the matches of a search as a json array, flushing each of them
+type searchWriter struct {
+	w     http.ResponseWriter
+	count int
+}
+
+func (sw *searchWriter) begin() {
+	fmt.Fprint(sw.w, "[")
+}
+
+func (sw *searchWriter) write(m *historyMessage) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.WithError(err).WithField("id", m.ID).Error("Error encoding a found message")
+		return
+	}
+	if sw.count > 0 {
+		fmt.Fprint(sw.w, ",")
+	}
+	sw.w.Write(data)
+	sw.count++
+	if f, ok := sw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *searchWriter) end() {
+	fmt.Fprint(sw.w, "]")
+}
@@ -0,0 +1,176 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeHTTP_SearchMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store with 300 messages in /foo/bar and /foo/other, some of them with an order id
+	dir, err := ioutil.TempDir("", "guble_search_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	ids := make(map[int]uint64)
+	for i := 1; i <= 300; i++ {
+		m := &protocol.Message{Path: "/foo/bar", Body: []byte(fmt.Sprintf("msg %d", i))}
+		if i%6 == 0 {
+			m.Path = "/foo/other"
+		}
+		if i%50 == 0 {
+			m.Body = []byte(fmt.Sprintf("order 4711 #%d", i))
+		}
+		if i%2 == 0 {
+			m.HeaderJSON = `{"region":"eu"}`
+		}
+		_, err := fms.StoreMessage(m, 0)
+		a.NoError(err)
+		ids[i] = m.ID
+	}
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	search := func(query string) []string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/bar/search?"+query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(http.StatusOK, w.Code)
+		a.Equal("application/json", w.Header().Get("Content-Type"))
+		var messages []historyMessage
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+		bodies := make([]string, 0, len(messages))
+		for _, m := range messages {
+			bodies = append(bodies, m.Body)
+		}
+		return bodies
+	}
+
+	// when searching the body, then the matches of the topic are returned newest first, over multiple chunks
+	a.Equal([]string{"order 4711 #250", "order 4711 #200", "order 4711 #100", "order 4711 #50"}, search("q=4711"))
+
+	// and the number of matches is limited
+	a.Equal([]string{"order 4711 #250", "order 4711 #200"}, search("q=4711&limit=2"))
+
+	// and the scan is bounded by the id range
+	a.Equal([]string{"order 4711 #200", "order 4711 #100"}, search(fmt.Sprintf("q=4711&since=%d&until=%d", ids[100], ids[200])))
+
+	// and the header can be searched
+	a.Equal([]string{"msg 298", "msg 296", "msg 292"}, search(`field=header&limit=3&q="region":"eu"`))
+
+	// and no match is an empty array
+	a.Equal([]string{}, search("q=nothing"))
+}
+
+func TestServeHTTP_SearchMessagesErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(false), nil).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	get := func(url string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	a.Equal(http.StatusBadRequest, get("http://localhost/api/message/foo/search"))
+	a.Equal(http.StatusBadRequest, get("http://localhost/api/message/foo/search?q=x&field=path"))
+	a.Equal(http.StatusBadRequest, get("http://localhost/api/message/foo/search?q=x&limit=0"))
+	a.Equal(http.StatusBadRequest, get("http://localhost/api/message/foo/search?q=x&since=abc"))
+	a.Equal(http.StatusBadRequest, get("http://localhost/api/message/foo/search?q=x&key=customer"))
+	a.Equal(http.StatusForbidden, get("http://localhost/api/message/foo/search?q=x&userId=user01"))
+	a.Equal(http.StatusNotFound, get("http://localhost/api/message/search?q=x"))
+}
+
+func TestServeHTTP_SearchAnIndexedHeader(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a store indexing the customer header, with 300 messages in /foo/bar and /foo/other
+	dir, err := ioutil.TempDir("", "guble_search_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	fms := filestore.New(dir)
+	fms.SetIndexedHeaders("/foo", []string{"Customer"})
+	for i := 1; i <= 300; i++ {
+		m := &protocol.Message{
+			Path:       "/foo/bar",
+			HeaderJSON: fmt.Sprintf(`{"Customer":"c%d","Region":"eu"}`, i),
+			Body:       []byte(fmt.Sprintf("msg %d", i)),
+		}
+		if i%6 == 0 {
+			m.Path = "/foo/other"
+		}
+		if i%50 == 0 {
+			m.HeaderJSON = `{"Customer":"4711","Region":"us"}`
+		}
+		_, err := fms.StoreMessage(m, 0)
+		a.NoError(err)
+	}
+
+	fetches := 0
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil).AnyTimes()
+	routerMock.EXPECT().MessageStore().Return(fms, nil).AnyTimes()
+	routerMock.EXPECT().Fetch(gomock.Any()).Do(func(req *store.FetchRequest) error {
+		fetches++
+		fms.Fetch(req)
+		return nil
+	}).AnyTimes()
+	api := NewRestMessageAPI(routerMock, "/api")
+
+	search := func(query string) []string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/message/foo/bar/search?"+query, nil)
+		api.ServeHTTP(w, req)
+		a.Equal(http.StatusOK, w.Code)
+		var messages []historyMessage
+		a.NoError(json.Unmarshal(w.Body.Bytes(), &messages))
+		bodies := make([]string, 0, len(messages))
+		for _, m := range messages {
+			bodies = append(bodies, m.Body)
+		}
+		return bodies
+	}
+
+	// when searching the indexed key, then the matches of the topic are returned newest first
+	a.Equal([]string{"msg 250", "msg 200", "msg 100", "msg 50"}, search("field=header&key=customer&q=4711"))
+
+	// and only the matching messages are fetched, including the ones of the other topic
+	a.Equal(6, fetches)
+
+	// and a key not indexed is searched by fetching the messages
+	fetches = 0
+	a.Equal([]string{"msg 250", "msg 200"}, search("field=header&key=Region&q=us&limit=2"))
+	a.True(fetches > 0)
+}
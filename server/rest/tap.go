@@ -0,0 +1,126 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	tapPath = "/tap"
+
+	// tapChannelSize is the number of tapped messages buffered for a slow client, before dropping the next ones
+	tapChannelSize = 100
+
+	// tapKeepAliveInterval is the interval of the comments sent to an idle tap, e.g. through proxies closing idle requests
+	tapKeepAliveInterval = 15 * time.Second
+)
+
+// tappedMessage is an event of the tap stream, with the routing metadata of the message
+type tappedMessage struct {
+	*historyMessage
+	NodeID    uint8  `json:"nodeId"`
+	Partition string `json:"partition"`
+	Routes    int    `json:"routes"`
+	TraceID   string `json:"traceId,omitempty"`
+}
+
+// isTapRequest returns true for a GET of `/tap/{topic}`
+func (api *RestMessageAPI) isTapRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, removeTrailingSlash(api.prefix)+tapPath+"/")
+}
+
+// tap streams the messages routed for the topic and its subtopics as server-sent events, for debugging the delivery.
+// The messages can be restricted by header `filter` expressions (e.g. `filter=type=refund`), which all have to match.
+// Only the admin user is allowed to tap a topic. The tap does not subscribe a route, and drops the messages
+// while the client is slow. The stream ends before the write timeout of the webserver, and is reconnected by an
+// EventSource client.
+func (api *RestMessageAPI) tap(w http.ResponseWriter, r *http.Request) {
+	if !api.isAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, "tapping a topic requires the admin user")
+		return
+	}
+	topic, err := api.extractTopic(removeTrailingSlash(r.URL.Path), tapPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var filters router.HeaderFilters
+	for _, expression := range r.URL.Query()["filter"] {
+		f, err := router.ParseHeaderFilter(expression)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST, err.Error())
+			return
+		}
+		filters = append(filters, f)
+	}
+	t, ok := api.router.(router.Tapper)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, protocol.ERROR_BAD_REQUEST, "the router does not support tapping")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, protocol.ERROR_INTERNAL_SERVER, "streaming is not supported")
+		return
+	}
+
+	tapC, remove := t.Tap(protocol.Path(topic), filters, tapChannelSize)
+	defer remove()
+	log.WithFields(log.Fields{"topic": topic, "filters": filters}).Info("Tapping topic")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	end := time.NewTimer(api.maxLongPollTimeout())
+	defer end.Stop()
+	keepAlive := time.NewTicker(tapKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case tapped := <-tapC:
+			if err := writeTappedMessage(w, tapped); err != nil {
+				log.WithError(err).WithField("topic", topic).Error("Error writing a tapped message")
+				continue
+			}
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-end.C:
+			return
+		case <-r.Context().Done():
+			log.WithField("topic", topic).Debug("Tap closed by the client")
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeTappedMessage writes the message as an event with its id
+func writeTappedMessage(w http.ResponseWriter, tapped *router.TappedMessage) error {
+	// the routed message is shared with the routes, so its body is decompressed on a copy
+	m := *tapped.Message
+	if err := m.DecompressBody(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(tappedMessage{
+		historyMessage: newHistoryMessage(&m),
+		NodeID:         m.NodeID,
+		Partition:      m.Path.Partition(),
+		Routes:         tapped.Routes,
+		TraceID:        m.TraceID(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", m.ID, data)
+	return err
+}
@@ -0,0 +1,116 @@
+package rest
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tappingRouter is a router, which passes the messages of tapC to its tap
+type tappingRouter struct {
+	*MockRouter
+	tapC    chan *router.TappedMessage
+	path    protocol.Path
+	filters router.HeaderFilters
+	removed chan bool
+}
+
+func (r *tappingRouter) Tap(path protocol.Path, filters router.HeaderFilters, channelSize int) (<-chan *router.TappedMessage, func()) {
+	r.path, r.filters = path, filters
+	return r.tapC, func() { close(r.removed) }
+}
+
+func TestServeHTTP_Tap(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := &tappingRouter{
+		MockRouter: NewMockRouter(ctrl),
+		tapC:       make(chan *router.TappedMessage),
+		removed:    make(chan bool),
+	}
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+	api.AdminUser = "marvin"
+
+	// given a tap of the admin user, with a header filter
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/api/tap/orders?access_token=secret&filter=type=refund", nil)
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		api.ServeHTTP(w, req.WithContext(ctx))
+		close(done)
+	}()
+
+	// when a message is routed, and the client disconnects
+	routerMock.tapC <- &router.TappedMessage{
+		Message: &protocol.Message{
+			ID:         42,
+			Path:       "/orders/eu",
+			NodeID:     2,
+			HeaderJSON: `{"type":"refund"}`,
+			Body:       []byte("hello"),
+		},
+		Routes: 3,
+	}
+	cancel()
+
+	// then the message is streamed as an event with the routing metadata, and the tap is removed
+	select {
+	case <-done:
+		a.Equal("text/event-stream", w.Header().Get("Content-Type"))
+		a.Equal(`id: 42
+data: {"id":42,"path":"/orders/eu","time":0,"header":{"type":"refund"},"body":"hello","nodeId":2,"partition":"orders","routes":3}
+
+`, w.Body.String())
+		a.Equal(protocol.Path("/orders"), routerMock.path)
+		a.Equal(router.HeaderFilters{{Key: "type", Value: "refund"}}, routerMock.filters)
+	case <-time.After(time.Second):
+		a.Fail("tap not closed")
+	}
+	select {
+	case <-routerMock.removed:
+	case <-time.After(time.Second):
+		a.Fail("tap not removed")
+	}
+}
+
+func TestServeHTTP_TapErrors(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	get := func(api *RestMessageAPI, url string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	routerMock := &tappingRouter{MockRouter: NewMockRouter(ctrl)}
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+
+	// without an admin user, nobody can tap a topic
+	a.Equal(http.StatusForbidden, get(api, "http://localhost/api/tap/orders?access_token=secret"))
+
+	// and an invalid filter is rejected
+	api.AdminUser = "marvin"
+	a.Equal(http.StatusBadRequest, get(api, "http://localhost/api/tap/orders?access_token=secret&filter==refund"))
+
+	// and a router without taps is not supported
+	api = NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	api.Authenticator = tokenAuthenticator{}
+	api.AdminUser = "marvin"
+	a.Equal(http.StatusNotImplemented, get(api, "http://localhost/api/tap/orders?access_token=secret"))
+}
@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// isAdmin returns true, if the Authenticator authenticated the request as the AdminUser.
+// The user id of the query is not trusted, so without an AdminUser or an Authenticator nobody is an admin.
+func (api *RestMessageAPI) isAdmin(r *http.Request) bool {
+	if api.AdminUser == "" || api.Authenticator == nil {
+		return false
+	}
+	userID, _, err := api.Authenticator.AuthenticateConnection(r)
+	return err == nil && userID == api.AdminUser
+}
+
+// truncate deletes the stored messages of a topic on all nodes of the cluster, e.g. by `DELETE /api/message/foo`,
+// and resets its message ids. As the messages are stored by partition, only the topic of a whole partition
+// can be truncated. The subscribers of the partition are notified by the `topic-reset` notification.
+func (api *RestMessageAPI) truncate(w http.ResponseWriter, r *http.Request) {
+	if !api.isAdmin(r) {
+		writeJSONError(w, http.StatusForbidden, protocol.ERROR_ACCESS_DENIED, "truncating a topic requires the admin user")
+		return
+	}
+
+	topic, err := api.extractTopic(r.URL.Path, "/message")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	path := protocol.Path(removeTrailingSlash(topic))
+	partition := path.Partition()
+	if path.RemovePrefixSlash() != partition {
+		writeJSONError(w, http.StatusBadRequest, protocol.ERROR_BAD_REQUEST,
+			fmt.Sprintf("only the topic of a whole partition can be truncated, e.g. /%s", partition))
+		return
+	}
+
+	t, ok := api.router.(router.Truncater)
+	if !ok {
+		writeJSONError(w, http.StatusNotImplemented, protocol.ERROR_BAD_REQUEST, router.ErrTruncateNotSupported.Error())
+		return
+	}
+	if err := t.Truncate(partition); err != nil {
+		code := http.StatusInternalServerError
+		if err == router.ErrTruncateNotSupported {
+			code = http.StatusNotImplemented
+		} else if _, stopping := err.(*router.ModuleStoppingError); stopping {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSONError(w, code, protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	log.WithFields(log.Fields{"partition": partition, "userId": api.AdminUser}).Info("Truncated topic")
+	fmt.Fprintf(w, "OK")
+}
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// truncatingRouter is a router, which records the truncated partitions
+type truncatingRouter struct {
+	*MockRouter
+	truncated []string
+	err       error
+}
+
+func (r *truncatingRouter) Truncate(partition string) error {
+	r.truncated = append(r.truncated, partition)
+	return r.err
+}
+
+func TestServeHTTP_Truncate(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := &truncatingRouter{MockRouter: NewMockRouter(ctrl)}
+	api := NewRestMessageAPI(routerMock, "/api")
+	api.Authenticator = tokenAuthenticator{}
+
+	del := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		api.ServeHTTP(w, req)
+		return w
+	}
+
+	// without an admin user, nobody can truncate a topic
+	a.Equal(http.StatusForbidden, del("http://localhost/api/message/foo?access_token=secret").Code)
+
+	// and only the authenticated admin user can truncate it
+	api.AdminUser = "marvin"
+	a.Equal(http.StatusUnauthorized, del("http://localhost/api/message/foo?userId=marvin").Code)
+	api.AdminUser = "root"
+	a.Equal(http.StatusForbidden, del("http://localhost/api/message/foo?access_token=secret").Code)
+	a.Empty(routerMock.truncated)
+
+	api.AdminUser = "marvin"
+	w := del("http://localhost/api/message/foo/?access_token=secret")
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("OK", w.Body.String())
+	a.Equal([]string{"foo"}, routerMock.truncated)
+
+	// and only a whole partition can be truncated
+	a.Equal(http.StatusBadRequest, del("http://localhost/api/message/foo/bar?access_token=secret").Code)
+	a.Equal(http.StatusNotFound, del("http://localhost/api/message/?access_token=secret").Code)
+
+	// and a store without truncation is not supported
+	routerMock.err = router.ErrTruncateNotSupported
+	a.Equal(http.StatusNotImplemented, del("http://localhost/api/message/foo?access_token=secret").Code)
+
+	// and a router without truncation neither
+	api = NewRestMessageAPI(NewMockRouter(ctrl), "/api")
+	api.Authenticator = tokenAuthenticator{}
+	api.AdminUser = "marvin"
+	a.Equal(http.StatusNotImplemented, del("http://localhost/api/message/foo?access_token=secret").Code)
+}
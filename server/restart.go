@@ -0,0 +1,223 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/smancke/guble/server/service"
+)
+
+const (
+	// restartEnv is set for the new process of a graceful restart, which inherits the listening socket as the
+	// file descriptor restartListenerFD, and reports being started on the pipe restartReadyFD
+	restartEnv        = "GUBLE_GRACEFUL_RESTART"
+	restartListenerFD = 3
+	restartReadyFD    = 4
+
+	// restartReadyTimeout is the maximum duration the old process waits for the new one to be started,
+	// after handing over to it
+	restartReadyTimeout = 10 * time.Second
+
+	restartPollInterval = 100 * time.Millisecond
+)
+
+// inheritedListener is the listening socket inherited from the old process on a graceful restart, nil otherwise
+var inheritedListener net.Listener
+
+// reconnectingHandler is the websocket handler, asking its clients to reconnect on a graceful restart
+type reconnectingHandler interface {
+	ReconnectClients(maxDelay time.Duration) int
+	Clients() int
+}
+
+// inheritListener takes over the listening socket of the old process, if started by a graceful restart.
+func inheritListener() error {
+	if os.Getenv(restartEnv) == "" {
+		return nil
+	}
+	os.Unsetenv(restartEnv)
+
+	file := os.NewFile(restartListenerFD, "listener")
+	ln, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	inheritedListener = ln
+	logger.WithField("address", ln.Addr().String()).Info("Inherited the listener of the old process")
+	return nil
+}
+
+// signalReady reports to the old process of a graceful restart, that the service was started.
+// If the new process exits before, the old process resumes serving.
+func signalReady() error {
+	if inheritedListener == nil {
+		return nil
+	}
+	ready := os.NewFile(restartReadyFD, "ready")
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	return err
+}
+
+// restartOnSignal restarts the service gracefully on SIGUSR2. If the new process could not be started,
+// the service keeps running, or is started again.
+//
+// The shutdown sequence of the old process is:
+//  1. start the new process, passing the listening socket
+//  2. drain the webserver: the new connections are accepted by the new process from then on
+//  3. ask the websocket clients to reconnect, and wait at most for timeout until they are disconnected
+//  4. stop the service, releasing the lock of the message store, which the new process waits for before starting
+//  5. wait until the new process has started its service, and exit
+//
+// If the new process exits or does not start in time, it is killed and the old process starts its service again
+// on the listening socket.
+func restartOnSignal(srv *service.Service, timeout time.Duration) {
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, syscall.SIGUSR2)
+	for sig := range signalC {
+		logger.Infof("Got signal '%v' .. restarting gracefully now", sig)
+		s, err := startSuccessor(srv)
+		if err != nil {
+			logger.WithError(err).Error("Could not start the new process, keeping the current one")
+			continue
+		}
+		handOver(srv, timeout)
+		if err := s.wait(restartReadyTimeout); err != nil {
+			logger.WithError(err).Error("The new process did not start, resuming the current one")
+			if err := resume(srv, s.listener); err != nil {
+				logger.WithError(err).Fatal("Could not resume the current process")
+			}
+			continue
+		}
+		logger.Info("Exit gracefully now")
+		os.Exit(0)
+	}
+}
+
+// successor is the new process of a graceful restart
+type successor struct {
+	cmd *exec.Cmd
+
+	// listener is the listening socket passed to the new process, kept for resuming if it does not start
+	listener *os.File
+
+	// readyC receives nil when the new process has started, or the error if it exited before
+	readyC chan error
+}
+
+// startSuccessor starts the new process with the same arguments, passing the listening socket of the webserver.
+// The new process waits for the old one to stop, before starting its service.
+func startSuccessor(srv *service.Service) (*successor, error) {
+	listener, err := srv.WebServer().ListenerFile()
+	if err != nil {
+		return nil, err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		listener.Close()
+		readyR.Close()
+		readyW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), restartEnv+"=true")
+	cmd.ExtraFiles = []*os.File{listener, readyW}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		listener.Close()
+		readyR.Close()
+		return nil, err
+	}
+	go cmd.Wait()
+	logger.WithField("pid", cmd.Process.Pid).Info("Started the new process")
+	return &successor{cmd: cmd, listener: listener, readyC: readyOf(readyR)}, nil
+}
+
+// readyOf returns the channel receiving the result of reading the ready pipe, which is closed afterwards.
+// The read fails, if the new process exits without reporting being started.
+func readyOf(readyR *os.File) chan error {
+	readyC := make(chan error, 1)
+	go func() {
+		defer readyR.Close()
+		_, err := readyR.Read(make([]byte, 1))
+		readyC <- err
+	}()
+	return readyC
+}
+
+// wait returns nil after the new process has started, or an error if it exited or did not start in the timeout.
+// A new process not started in time is killed.
+func (s *successor) wait(timeout time.Duration) error {
+	var err error
+	select {
+	case err = <-s.readyC:
+	case <-time.After(timeout):
+		err = errors.New("The new process did not start in time")
+	}
+	if err != nil && s.cmd != nil {
+		s.cmd.Process.Kill()
+	}
+	if err == nil {
+		s.listener.Close()
+	}
+	return err
+}
+
+// resume starts the service of the old process again, on the listening socket passed to the new process
+func resume(srv *service.Service, listener *os.File) error {
+	defer listener.Close()
+
+	ln, err := net.FileListener(listener)
+	if err != nil {
+		return err
+	}
+	srv.WebServer().Listener = ln
+	return srv.Start()
+}
+
+// handOver stops the service after the websocket clients reconnected to the new process, or after the timeout
+func handOver(srv *service.Service, timeout time.Duration) {
+	logger.Info("Draining the webserver")
+	if err := srv.WebServer().Drain(leaveTimeout); err != nil {
+		logger.WithError(err).Error("Error while draining the webserver")
+	}
+
+	for _, iface := range srv.ModulesSortedByStartOrder() {
+		if h, ok := iface.(reconnectingHandler); ok {
+			h.ReconnectClients(timeout / 2)
+			deadline := time.Now().Add(timeout)
+			for h.Clients() > 0 && time.Now().Before(deadline) {
+				time.Sleep(restartPollInterval)
+			}
+			logger.WithField("clients", h.Clients()).Info("Handing over to the new process")
+		}
+	}
+
+	if err := srv.Stop(); err != nil {
+		logger.WithField("error", err.Error()).Error("errors occurred while stopping service")
+	}
+}
+
+// restartLockTimeout returns the maximum duration the message store waits for the lock held by the old process
+func restartLockTimeout(timeout time.Duration) time.Duration {
+	if inheritedListener == nil {
+		return 0
+	}
+	// draining the webserver, waiting for the clients, and stopping the other modules
+	return leaveTimeout + timeout + leaveTimeout
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"github.com/smancke/guble/server/service"
+	"github.com/smancke/guble/server/store/filestore"
+	"github.com/smancke/guble/server/webserver"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reconnectingHandlerStub disconnects its clients shortly after being asked to reconnect them
+type reconnectingHandlerStub struct {
+	clients  int32
+	maxDelay time.Duration
+}
+
+func (h *reconnectingHandlerStub) ReconnectClients(maxDelay time.Duration) int {
+	h.maxDelay = maxDelay
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&h.clients, 0)
+	}()
+	return h.Clients()
+}
+
+func (h *reconnectingHandlerStub) Clients() int {
+	return int(atomic.LoadInt32(&h.clients))
+}
+
+func TestHandOver(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_restart_test")
+	defer os.RemoveAll(dir)
+
+	// given a started service with a file message store and a connected websocket client
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().Cluster().Return(nil)
+	srv := service.New(routerMock, webserver.New("localhost:0"))
+	handler := &reconnectingHandlerStub{clients: 1}
+	srv.RegisterModules(0, 6, filestore.New(dir))
+	srv.RegisterModules(4, 3, handler)
+	a.NoError(srv.Start())
+	addr := srv.WebServer().GetAddr()
+
+	// when handing over to a new process
+	start := time.Now()
+	handOver(srv, 5*time.Second)
+
+	// then the clients were asked to reconnect within the timeout, and were waited for
+	a.Equal(2500*time.Millisecond, handler.maxDelay)
+	a.Equal(0, handler.Clients())
+	a.True(time.Since(start) < time.Second)
+
+	// and the webserver does not accept connections anymore
+	_, err := net.Dial("tcp", addr)
+	a.Error(err)
+
+	// and the lock of the message store is released for the new process
+	next := filestore.New(dir)
+	a.NoError(next.Start())
+	a.NoError(next.Stop())
+}
+
+func TestSuccessor_Wait(t *testing.T) {
+	a := assert.New(t)
+
+	aSuccessor := func() (*successor, *os.File) {
+		readyR, readyW, err := os.Pipe()
+		a.NoError(err)
+		listener, err := ioutil.TempFile("", "guble_restart_test")
+		a.NoError(err)
+		os.Remove(listener.Name())
+		return &successor{listener: listener, readyC: readyOf(readyR)}, readyW
+	}
+
+	// a new process reporting its start is waited for
+	s, readyW := aSuccessor()
+	_, err := readyW.Write([]byte{1})
+	a.NoError(err)
+	a.NoError(s.wait(time.Second))
+	readyW.Close()
+
+	// but a new process exiting without reporting its start fails
+	s, readyW = aSuccessor()
+	readyW.Close()
+	a.Error(s.wait(time.Second))
+
+	// and also a new process not started in time
+	s, readyW = aSuccessor()
+	defer readyW.Close()
+	a.Error(s.wait(10 * time.Millisecond))
+}
+
+func TestResume(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_restart_test")
+	defer os.RemoveAll(dir)
+
+	// given a service handed over to a new process, which did not start
+	routerMock := NewMockRouter(ctrl)
+	routerMock.EXPECT().Cluster().Return(nil)
+	srv := service.New(routerMock, webserver.New("localhost:0"))
+	srv.RegisterModules(0, 6, filestore.New(dir))
+	a.NoError(srv.Start())
+	addr := srv.WebServer().GetAddr()
+	listener, err := srv.WebServer().ListenerFile()
+	a.NoError(err)
+	handOver(srv, time.Second)
+
+	// when resuming, then the service is started again on the listening socket
+	a.NoError(resume(srv, listener))
+	defer srv.Stop()
+	conn, err := net.Dial("tcp", addr)
+	if a.NoError(err) {
+		conn.Close()
+	}
+}
+
+func TestRestartLockTimeout(t *testing.T) {
+	a := assert.New(t)
+	defer func() { inheritedListener = nil }()
+
+	// a process not started by a graceful restart does not wait for the lock
+	a.Equal(time.Duration(0), restartLockTimeout(30*time.Second))
+
+	// but the new process waits until the old one has stopped
+	inheritedListener = &net.TCPListener{}
+	a.Equal(30*time.Second+2*leaveTimeout, restartLockTimeout(30*time.Second))
+}
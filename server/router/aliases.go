@@ -0,0 +1,208 @@
+package router
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+)
+
+const (
+	// AliasesSchema is the reserved schema of the KV store, containing the canonical paths by their alias path.
+	AliasesSchema = "aliases"
+
+	// aliasesReloadInterval is the maximum age of the aliases, before they are loaded again from the KV store,
+	// e.g. to get the aliases set on another node of the cluster
+	aliasesReloadInterval = 10 * time.Second
+)
+
+// Aliaser is implemented by a router, which rewrites the alias paths of the published messages and the routes
+// to their canonical paths, e.g. for a renamed topic. An alias applies also to the subtopics of its path,
+// and the canonical path can be an alias itself. The messages are stored and delivered with the canonical path only.
+type Aliaser interface {
+	// SetAlias maps the alias path to the canonical path.
+	// It returns ErrInvalidAlias for an invalid path, and ErrAliasCycle if the alias would resolve to itself.
+	SetAlias(alias, canonical protocol.Path) error
+
+	// RemoveAlias removes the alias path.
+	RemoveAlias(alias protocol.Path) error
+
+	// Aliases returns the canonical paths by their alias path.
+	Aliases() map[protocol.Path]protocol.Path
+
+	// ResolveAlias returns the canonical path of the path, which is the path itself if it is no alias.
+	ResolveAlias(path protocol.Path) protocol.Path
+}
+
+// aliasing caches the aliases of the KV store
+type aliasing struct {
+	kvStore kvstore.KVStore
+
+	mutex    sync.RWMutex
+	aliases  map[protocol.Path]protocol.Path
+	loadedAt time.Time
+}
+
+func newAliasing(kvStore kvstore.KVStore) *aliasing {
+	return &aliasing{
+		kvStore: kvStore,
+		aliases: make(map[protocol.Path]protocol.Path),
+	}
+}
+
+// SetAlias is an implementation of the Aliaser interface.
+func (router *router) SetAlias(alias, canonical protocol.Path) error {
+	if !validAliasPath(alias) || !validAliasPath(canonical) || alias == canonical {
+		return ErrInvalidAlias
+	}
+	if err := router.aliasing.load(); err != nil {
+		return err
+	}
+
+	aliases := router.aliasing.current()
+	changed := make(map[protocol.Path]protocol.Path, len(aliases)+1)
+	for a, c := range aliases {
+		changed[a] = c
+	}
+	changed[alias] = canonical
+	// a new alias can close a cycle through the subtopics of another alias, so all of them are resolved
+	for a := range changed {
+		if _, err := resolveAlias(changed, a); err != nil {
+			return err
+		}
+	}
+
+	if err := router.aliasing.kvStore.Put(AliasesSchema, string(alias), []byte(canonical)); err != nil {
+		logger.WithError(err).WithField("alias", alias).Error("Error storing the alias")
+		return err
+	}
+	router.aliasing.set(changed)
+	logger.WithFields(log.Fields{
+		"alias":     alias,
+		"canonical": canonical,
+	}).Info("Set alias")
+	return nil
+}
+
+// RemoveAlias is an implementation of the Aliaser interface.
+func (router *router) RemoveAlias(alias protocol.Path) error {
+	if err := router.aliasing.kvStore.Delete(AliasesSchema, string(alias)); err != nil {
+		logger.WithError(err).WithField("alias", alias).Error("Error deleting the alias")
+		return err
+	}
+	if err := router.aliasing.load(); err != nil {
+		return err
+	}
+	logger.WithField("alias", alias).Info("Removed alias")
+	return nil
+}
+
+// Aliases is an implementation of the Aliaser interface.
+func (router *router) Aliases() map[protocol.Path]protocol.Path {
+	aliases := router.aliasing.current()
+	result := make(map[protocol.Path]protocol.Path, len(aliases))
+	for a, c := range aliases {
+		result[a] = c
+	}
+	return result
+}
+
+// ResolveAlias is an implementation of the Aliaser interface.
+// An alias resolving to a cycle (e.g. by aliases written to the KV store directly) is not rewritten.
+func (router *router) ResolveAlias(path protocol.Path) protocol.Path {
+	aliases := router.aliasing.current()
+	if len(aliases) == 0 {
+		return path
+	}
+	canonical, err := resolveAlias(aliases, path)
+	if err != nil {
+		logger.WithError(err).WithField("path", path).Error("Not resolving the alias")
+		return path
+	}
+	return canonical
+}
+
+// resolveAlias rewrites the path by the alias of the path or of its nearest parent, until no alias applies.
+// It returns ErrAliasCycle if an alias is applied twice.
+func resolveAlias(aliases map[protocol.Path]protocol.Path, path protocol.Path) (protocol.Path, error) {
+	applied := make(map[protocol.Path]bool)
+	for {
+		alias, canonical, ok := matchAlias(aliases, path)
+		if !ok {
+			return path, nil
+		}
+		if applied[alias] {
+			return path, ErrAliasCycle
+		}
+		applied[alias] = true
+		path = canonical + path[len(alias):]
+	}
+}
+
+// matchAlias returns the alias of the path or of its nearest parent, and its canonical path
+func matchAlias(aliases map[protocol.Path]protocol.Path, path protocol.Path) (protocol.Path, protocol.Path, bool) {
+	prefix := string(path)
+	for prefix != "" {
+		if canonical, ok := aliases[protocol.Path(prefix)]; ok {
+			return protocol.Path(prefix), canonical, true
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+	}
+	return "", "", false
+}
+
+// validAliasPath returns true for a topic path without wildcard, which can be aliased or be the canonical path
+func validAliasPath(path protocol.Path) bool {
+	return len(path) > 1 && path[0] == '/' && !strings.HasSuffix(string(path), "/") &&
+		!strings.ContainsAny(string(path), " *,")
+}
+
+// load reads the aliases from the KV store
+func (a *aliasing) load() error {
+	entries, err := a.kvStore.Iterate(AliasesSchema, "")
+	if err != nil {
+		return err
+	}
+	aliases := make(map[protocol.Path]protocol.Path)
+	for entry := range entries {
+		aliases[protocol.Path(entry[0])] = protocol.Path(entry[1])
+	}
+	a.set(aliases)
+	return nil
+}
+
+func (a *aliasing) set(aliases map[protocol.Path]protocol.Path) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.aliases = aliases
+	a.loadedAt = time.Now()
+}
+
+// current returns the aliases, loading them again if they are older than the reload interval
+func (a *aliasing) current() map[protocol.Path]protocol.Path {
+	a.mutex.RLock()
+	aliases, loadedAt := a.aliases, a.loadedAt
+	a.mutex.RUnlock()
+
+	if time.Since(loadedAt) < aliasesReloadInterval {
+		return aliases
+	}
+	if err := a.load(); err != nil {
+		logger.WithError(err).Error("Loading the aliases failed, using the previous ones")
+		a.mutex.Lock()
+		a.loadedAt = time.Now()
+		a.mutex.Unlock()
+		return aliases
+	}
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.aliases
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_ResolveAlias(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	a.NoError(router.SetAlias("/oldname", "/newname"))
+	a.NoError(router.SetAlias("/older", "/oldname/sub"))
+
+	a.Equal(protocol.Path("/newname"), router.ResolveAlias("/oldname"))
+	a.Equal(protocol.Path("/newname/foo"), router.ResolveAlias("/oldname/foo"))
+	a.Equal(protocol.Path("/newname/sub/foo"), router.ResolveAlias("/older/foo"))
+	a.Equal(protocol.Path("/oldnamefoo"), router.ResolveAlias("/oldnamefoo"))
+	a.Equal(protocol.Path("/other"), router.ResolveAlias("/other"))
+
+	a.Equal(map[protocol.Path]protocol.Path{"/oldname": "/newname", "/older": "/oldname/sub"}, router.Aliases())
+
+	// and a removed alias is not resolved anymore
+	a.NoError(router.RemoveAlias("/older"))
+	a.Equal(protocol.Path("/older/foo"), router.ResolveAlias("/older/foo"))
+}
+
+func TestRouter_SetAliasRejectsCyclesAndInvalidPaths(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	a.NoError(router.SetAlias("/a", "/b"))
+	a.NoError(router.SetAlias("/b", "/c"))
+
+	a.Equal(ErrAliasCycle, router.SetAlias("/c", "/a"))
+	a.Equal(ErrAliasCycle, router.SetAlias("/c", "/c/sub"))
+	a.NoError(router.SetAlias("/d/x", "/a/x"))
+	a.Equal(ErrAliasCycle, router.SetAlias("/c", "/d"))
+
+	a.Equal(ErrInvalidAlias, router.SetAlias("/a", "/a"))
+	a.Equal(ErrInvalidAlias, router.SetAlias("a", "/b"))
+	a.Equal(ErrInvalidAlias, router.SetAlias("/a/*", "/b"))
+	a.Equal(ErrInvalidAlias, router.SetAlias("/a", ""))
+
+	// the rejected aliases are not stored
+	_, exists, err := router.kvStore.Get(AliasesSchema, "/c")
+	a.NoError(err)
+	a.False(exists)
+	a.Equal(protocol.Path("/c"), router.ResolveAlias("/c"))
+}
+
+func TestRouter_DeliversTheMessagesOfAnAliasWithTheCanonicalPath(t *testing.T) {
+	a := assert.New(t)
+
+	// given a route of the canonical path, and a route of the alias path
+	router, _, ms, _ := aStartedRouter()
+	defer router.Stop()
+	a.NoError(router.SetAlias("/oldname", "/newname"))
+	canonical, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+		Path:        "/newname",
+		ChannelSize: chanSize,
+	}))
+	a.NoError(err)
+	aliased, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid02", "user_id": "user01"},
+		Path:        "/oldname",
+		ChannelSize: chanSize,
+	}))
+	a.NoError(err)
+	a.Equal(protocol.Path("/newname"), aliased.Path)
+
+	// when a message is published to the alias
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/oldname", Body: aTestByteMessage}))
+
+	// then both routes receive it once, with the canonical path
+	for _, r := range []*Route{canonical, aliased} {
+		select {
+		case m := <-r.MessagesChannel():
+			a.Equal(protocol.Path("/newname"), m.Path)
+		case <-time.After(time.Second):
+			a.Fail("No message received")
+		}
+	}
+
+	// and it is stored in the partition of the canonical path only
+	maxID, err := ms.MaxMessageID("newname")
+	a.NoError(err)
+	a.Equal(uint64(1), maxID)
+	maxID, err = ms.MaxMessageID("oldname")
+	a.NoError(err)
+	a.Equal(uint64(0), maxID)
+}
@@ -0,0 +1,184 @@
+package router
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// IdempotencyKeyHeader is the field of the header json of a message, by which the router recognizes a message
+// resent by a client. It can be set by a REST client with the header `X-Guble-Idempotency-Key`.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Deduplicator is implemented by a router, which can deduplicate the published messages by their idempotency key.
+type Deduplicator interface {
+	// SetDeduplication remembers the idempotency keys of the messages for the window,
+	// but not more than maxKeys over all topics (a non-positive window disables the deduplication).
+	SetDeduplication(window time.Duration, maxKeys int)
+}
+
+// seenMessage is a message stored with an idempotency key.
+// While the message is being stored, its key is reserved: stored is open until it is stored or released.
+type seenMessage struct {
+	path   protocol.Path
+	key    string
+	id     uint64
+	time   int64
+	nodeID uint8
+	seen   time.Time
+	stored chan struct{}
+}
+
+// deduplication remembers the recently published idempotency keys by topic.
+// The keys are evicted in the order they were seen, after the window or when there are more than maxKeys.
+type deduplication struct {
+	window  time.Duration
+	maxKeys int
+
+	mutex  sync.Mutex
+	keys   map[protocol.Path]map[string]*list.Element
+	byTime *list.List
+}
+
+func newDeduplication(window time.Duration, maxKeys int) *deduplication {
+	return &deduplication{
+		window:  window,
+		maxKeys: maxKeys,
+		keys:    make(map[protocol.Path]map[string]*list.Element),
+		byTime:  list.New(),
+	}
+}
+
+// SetDeduplication enables the deduplication of messages with an idempotency key.
+func (router *router) SetDeduplication(window time.Duration, maxKeys int) {
+	router.Lock()
+	defer router.Unlock()
+
+	if window <= 0 {
+		router.deduplication = nil
+		return
+	}
+	router.deduplication = newDeduplication(window, maxKeys)
+}
+
+func (router *router) getDeduplication() *deduplication {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.deduplication
+}
+
+// reserve sets the id, time and node of the originally stored message and returns true, if the message was already seen.
+// Otherwise it reserves the key for the message, until the message is stored or the reservation is released.
+// A message with the key of a message being stored waits for its result.
+func (d *deduplication) reserve(m *protocol.Message, key string) (*seenMessage, bool) {
+	for {
+		d.mutex.Lock()
+		d.evict(time.Now())
+		e, ok := d.keys[m.Path][key]
+		if !ok {
+			reservation := d.add(&seenMessage{
+				path:   m.Path,
+				key:    key,
+				seen:   time.Now(),
+				stored: make(chan struct{}),
+			})
+			d.mutex.Unlock()
+			return reservation, false
+		}
+		original := e.Value.(*seenMessage)
+		if original.stored == nil {
+			m.ID = original.id
+			m.Time = original.time
+			m.NodeID = original.nodeID
+			d.mutex.Unlock()
+			return nil, true
+		}
+		stored := original.stored
+		d.mutex.Unlock()
+		<-stored
+	}
+}
+
+// store records the id, time and node of the message stored with the reserved key
+func (d *deduplication) store(reservation *seenMessage, m *protocol.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	reservation.id = m.ID
+	reservation.time = m.Time
+	reservation.nodeID = m.NodeID
+	close(reservation.stored)
+	reservation.stored = nil
+}
+
+// release removes the reserved key of a message, which was not stored
+func (d *deduplication) release(reservation *seenMessage) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if e, ok := d.keys[reservation.path][reservation.key]; ok && e.Value == reservation {
+		d.remove(e)
+	}
+	close(reservation.stored)
+	reservation.stored = nil
+}
+
+// add records the seen message and evicts the keys exceeding the window or maxKeys;
+// the caller has to hold the mutex
+func (d *deduplication) add(seen *seenMessage) *seenMessage {
+	topicKeys, ok := d.keys[seen.path]
+	if !ok {
+		topicKeys = make(map[string]*list.Element)
+		d.keys[seen.path] = topicKeys
+	}
+	topicKeys[seen.key] = d.byTime.PushBack(seen)
+	d.evict(time.Now())
+	return seen
+}
+
+// evict removes the keys seen before the window and the oldest keys exceeding maxKeys;
+// the caller has to hold the mutex
+func (d *deduplication) evict(now time.Time) {
+	for e := d.byTime.Front(); e != nil; e = d.byTime.Front() {
+		if now.Sub(e.Value.(*seenMessage).seen) <= d.window && (d.maxKeys <= 0 || d.byTime.Len() <= d.maxKeys) {
+			return
+		}
+		d.remove(e)
+	}
+}
+
+func (d *deduplication) remove(e *list.Element) {
+	seen := d.byTime.Remove(e).(*seenMessage)
+	topicKeys := d.keys[seen.path]
+	delete(topicKeys, seen.key)
+	if len(topicKeys) == 0 {
+		delete(d.keys, seen.path)
+	}
+}
+
+func (d *deduplication) len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.byTime.Len()
+}
+
+// idempotencyKey returns the idempotency key from the header json of the message, or an empty string
+func idempotencyKey(m *protocol.Message) string {
+	if m.HeaderJSON == "" {
+		return ""
+	}
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(m.HeaderJSON), &header); err != nil {
+		return ""
+	}
+	raw, ok := header[IdempotencyKeyHeader]
+	if !ok {
+		return ""
+	}
+	return headerValue(raw)
+}
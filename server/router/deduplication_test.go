@@ -0,0 +1,157 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_HandleMessageDeduplicatesByIdempotencyKey(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router deduplicating messages, with a route
+	router, r := aRouterRoute(chanSize)
+	router.SetDeduplication(time.Minute, 10)
+	msMock := NewMockMessageStore(ctrl)
+	router.messageStore = msMock
+
+	id := uint64(0)
+	msMock.EXPECT().
+		StoreMessage(gomock.Any(), gomock.Any()).
+		Do(func(m *protocol.Message, nodeID uint8) (int, error) {
+			id++
+			m.ID = id
+			m.Time = 1420110000
+			return len(m.Bytes()), nil
+		}).Times(3)
+
+	// when a message is published twice with the same idempotency key
+	first := &protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"abc"}`, Body: aTestByteMessage}
+	a.NoError(router.HandleMessage(first))
+	duplicate := &protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"abc"}`, Body: aTestByteMessage}
+	a.NoError(router.HandleMessage(duplicate))
+
+	// then it is stored and delivered once, and the duplicate gets the id of the original
+	a.Equal(uint64(1), first.ID)
+	a.Equal(uint64(1), duplicate.ID)
+	a.Equal(int64(1420110000), duplicate.Time)
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+	select {
+	case <-r.MessagesChannel():
+		a.Fail("The duplicate was delivered")
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	// and messages with another key, in another topic or without a key are stored
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"def"}`}))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/other", HeaderJSON: `{"Idempotency-Key":"abc"}`}))
+	a.Equal(uint64(3), id)
+}
+
+func TestRouter_HandleMessageDeduplicatesConcurrentMessages(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router deduplicating messages, with a slow message store
+	router, r := aRouterRoute(chanSize)
+	router.SetDeduplication(time.Minute, 10)
+	msMock := NewMockMessageStore(ctrl)
+	router.messageStore = msMock
+	msMock.EXPECT().
+		StoreMessage(gomock.Any(), gomock.Any()).
+		Do(func(m *protocol.Message, nodeID uint8) (int, error) {
+			time.Sleep(10 * time.Millisecond)
+			m.ID = 42
+			return len(m.Bytes()), nil
+		})
+
+	// when the same message is published concurrently
+	messages := make([]*protocol.Message, 10)
+	var wg sync.WaitGroup
+	for i := range messages {
+		messages[i] = &protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"abc"}`, Body: aTestByteMessage}
+		wg.Add(1)
+		go func(m *protocol.Message) {
+			defer wg.Done()
+			a.NoError(router.HandleMessage(m))
+		}(messages[i])
+	}
+	wg.Wait()
+
+	// then it is stored once, and all messages get its id
+	for _, m := range messages {
+		a.Equal(uint64(42), m.ID)
+	}
+}
+
+func TestRouter_HandleMessageReleasesTheKeyOfAMessageNotStored(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router deduplicating messages, with a failing message store
+	router, r := aRouterRoute(chanSize)
+	router.SetDeduplication(time.Minute, 10)
+	msMock := NewMockMessageStore(ctrl)
+	router.messageStore = msMock
+	gomock.InOrder(
+		msMock.EXPECT().StoreMessage(gomock.Any(), gomock.Any()).Return(0, errors.New("store failed")),
+		msMock.EXPECT().StoreMessage(gomock.Any(), gomock.Any()).Return(1, nil),
+	)
+
+	// when a message is not stored, then its resending with the same key is stored
+	a.Error(router.HandleMessage(&protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"abc"}`}))
+	a.Equal(0, router.getDeduplication().len())
+	a.NoError(router.HandleMessage(&protocol.Message{Path: r.Path, HeaderJSON: `{"Idempotency-Key":"abc"}`}))
+	a.Equal(1, router.getDeduplication().len())
+}
+
+func TestDeduplication_EvictsByTimeAndMaxKeys(t *testing.T) {
+	a := assert.New(t)
+	d := newDeduplication(time.Minute, 2)
+
+	// when more than max keys are remembered, then the oldest one is evicted
+	remember := func(key string) {
+		m := &protocol.Message{Path: "/foo"}
+		if reservation, duplicate := d.reserve(m, key); !duplicate {
+			m.ID = 1
+			d.store(reservation, m)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		remember(key)
+	}
+	a.Equal(2, d.len())
+	_, duplicate := d.reserve(&protocol.Message{Path: "/foo"}, "c")
+	a.True(duplicate)
+	a.NotContains(d.keys["/foo"], "a")
+
+	// and the keys seen before the window are evicted
+	d.mutex.Lock()
+	d.byTime.Front().Value.(*seenMessage).seen = time.Now().Add(-2 * time.Minute)
+	d.mutex.Unlock()
+	reservation, duplicate := d.reserve(&protocol.Message{Path: "/foo"}, "b")
+	a.False(duplicate)
+	d.release(reservation)
+	a.Equal(1, d.len())
+	a.Len(d.keys["/foo"], 1)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("abc", idempotencyKey(&protocol.Message{HeaderJSON: `{"Idempotency-Key":"abc"}`}))
+	a.Equal("42", idempotencyKey(&protocol.Message{HeaderJSON: `{"Idempotency-Key":42}`}))
+	a.Equal("", idempotencyKey(&protocol.Message{HeaderJSON: `{"Key":"abc"}`}))
+	a.Equal("", idempotencyKey(&protocol.Message{HeaderJSON: `invalid`}))
+	a.Equal("", idempotencyKey(&protocol.Message{}))
+}
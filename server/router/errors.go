@@ -6,6 +6,7 @@ import (
 
 	"errors"
 	"fmt"
+	"time"
 )
 
 var (
@@ -22,6 +23,34 @@ var (
 
 	// ErrQueueFull is returned when trying to `Deliver` a message in a full queued route
 	ErrQueueFull = errors.New("Route queue is full. Route is closed.")
+
+	// ErrInvalidWildcard is returned by `Subscribe` when the route path contains a wildcard,
+	// which is not the trailing `/*` segment
+	ErrInvalidWildcard = errors.New("Invalid wildcard in route path. Only a trailing /* is supported.")
+
+	// ErrTruncateNotSupported is returned by `Truncate`, if the message store can not truncate a partition
+	ErrTruncateNotSupported = errors.New("The message store does not support the truncation of topics.")
+
+	// ErrScheduledMessageNotFound is returned by `CancelScheduled`, if the message is not scheduled on this node,
+	// e.g. because it was already delivered or cancelled
+	ErrScheduledMessageNotFound = errors.New("Scheduled message not found.")
+
+	// ErrInvalidAlias is returned by `SetAlias`, if the alias or the canonical path is no topic path,
+	// or both are the same
+	ErrInvalidAlias = errors.New("Invalid alias. The alias and the canonical path have to be different topic paths without wildcard.")
+
+	// ErrAliasCycle is returned by `SetAlias`, if the alias would resolve to itself
+	ErrAliasCycle = errors.New("The alias would create a cycle of aliases.")
+
+	// ErrTopicFull is returned by `Subscribe`, when the topic path has the maximum number of subscribers
+	ErrTopicFull = errors.New("Topic is full. The maximum number of subscribers is reached.")
+
+	// ErrTooManyTopics is returned by `HandleMessage` and `Subscribe`, when a new topic would exceed
+	// the maximum number of topics of the node, see TopicLimiter
+	ErrTooManyTopics = errors.New("Too many topics. The maximum number of topics of the node is reached.")
+
+	// errNilMessage is the cause of a MiddlewareError, if the middleware returned no message
+	errNilMessage = errors.New("Middleware returned no message.")
 )
 
 // PermissionDeniedError is returned when AccessManager denies a user request for a topic
@@ -49,3 +78,38 @@ type ModuleStoppingError struct {
 func (m *ModuleStoppingError) Error() string {
 	return fmt.Sprintf("Service %s is stopping", m.Name)
 }
+
+// MiddlewareError is returned when a middleware rejects a published message
+type MiddlewareError struct {
+	// name of the middleware
+	Name string
+
+	// the error returned by the middleware
+	Err error
+}
+
+func (e *MiddlewareError) Error() string {
+	return fmt.Sprintf("Message rejected by middleware %s: %v", e.Name, e.Err)
+}
+
+// QuotaExceededError is returned when an application published all messages of its quota in the current window
+type QuotaExceededError struct {
+	ApplicationID string
+	Limit         int
+
+	// RetryAfter is the duration until the next window of the quota
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("Quota of %d messages exceeded for application=[%s], retry after %v", e.Limit, e.ApplicationID, e.RetryAfter)
+}
+
+// RetryAfterSeconds returns the RetryAfter in whole seconds, rounded up, e.g. for a `Retry-After` header
+func (e *QuotaExceededError) RetryAfterSeconds() int64 {
+	seconds := int64(e.RetryAfter / time.Second)
+	if e.RetryAfter%time.Second > 0 || seconds == 0 {
+		seconds++
+	}
+	return seconds
+}
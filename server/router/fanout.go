@@ -0,0 +1,158 @@
+package router
+
+import (
+	"sync"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/metrics"
+)
+
+// workerQueueSize is the number of messages queued for each delivery worker, before the routing waits for it
+const workerQueueSize = 100
+
+// FanOutLimiter is implemented by a router, which can limit the subscribers of a topic
+// and deliver the messages through a pool of workers, instead of the routing goroutine.
+type FanOutLimiter interface {
+	// SetFanOut rejects the subscriptions of a topic path with ErrTopicFull above maxSubscribers (zero disables it),
+	// and delivers the messages to the routes by the given number of workers (zero delivers them inline).
+	// The workers are started with the router.
+	SetFanOut(maxSubscribers, workers int)
+}
+
+// SetFanOut sets the maximum number of subscribers of a topic path and the number of delivery workers.
+func (router *router) SetFanOut(maxSubscribers, workers int) {
+	router.Lock()
+	defer router.Unlock()
+
+	router.maxSubscribers = maxSubscribers
+	router.deliveryWorkers = workers
+}
+
+func (router *router) getFanOut() (int, int) {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.maxSubscribers, router.deliveryWorkers
+}
+
+// topicFull returns true, if the route would exceed the maximum number of subscribers of its path.
+// A route replacing an existing one of the same application and user is no new subscriber.
+func (router *router) topicFull(r *Route) bool {
+	maxSubscribers, _ := router.getFanOut()
+	if maxSubscribers <= 0 || len(router.routes[r.Path]) < maxSubscribers {
+		return false
+	}
+	for _, route := range router.routes[r.Path] {
+		if route.Equal(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// delivery is a message for the routes of a worker
+type delivery struct {
+	message *protocol.Message
+	routes  []*Route
+}
+
+// deliveryPool delivers the messages to the routes by a fixed number of workers.
+// A route is always delivered by the same worker, so that it receives the messages in order,
+// and a slow route delays only the routes of its worker, instead of the routing of all topics.
+type deliveryPool struct {
+	queues []chan delivery
+
+	// invalidC passes the invalid routes to the routing goroutine, for unsubscribing them
+	invalidC chan *Route
+
+	// next is the worker assigned to the next subscribed route
+	next int
+
+	wg sync.WaitGroup
+}
+
+func newDeliveryPool(workers int) *deliveryPool {
+	p := &deliveryPool{
+		queues:   make([]chan delivery, workers),
+		invalidC: make(chan *Route, unsubscribeChannelCapacity),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan delivery, workerQueueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *deliveryPool) work(queue chan delivery) {
+	defer p.wg.Done()
+	for d := range queue {
+		for _, route := range d.routes {
+			err := route.Deliver(d.message, false)
+			if err == ErrInvalidRoute {
+				// an invalid route not passed now is passed again with the next message
+				select {
+				case p.invalidC <- route:
+				default:
+				}
+			} else if err == nil {
+				metrics.PromMessagesDelivered.WithLabelValues(metrics.TopicLabel(string(d.message.Path))).Inc()
+			}
+		}
+	}
+}
+
+// assign selects the worker of a subscribed route, round-robin
+func (p *deliveryPool) assign(r *Route) {
+	if p == nil {
+		return
+	}
+	r.worker = p.next
+	p.next = (p.next + 1) % len(p.queues)
+}
+
+// stop waits for the queued messages to be delivered, and stops the workers
+func (p *deliveryPool) stop() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// deliveryBatch collects the routes of a message by worker
+type deliveryBatch struct {
+	pool   *deliveryPool
+	routes [][]*Route
+}
+
+// batch returns a new batch for a message, or nil if there are no workers
+func (p *deliveryPool) batch() *deliveryBatch {
+	if p == nil {
+		return nil
+	}
+	return &deliveryBatch{pool: p, routes: make([][]*Route, len(p.queues))}
+}
+
+func (b *deliveryBatch) add(r *Route) {
+	b.routes[r.worker] = append(b.routes[r.worker], r)
+}
+
+// dispatch queues the message for the workers of its routes
+func (b *deliveryBatch) dispatch(message *protocol.Message) {
+	if b == nil {
+		return
+	}
+	for i, routes := range b.routes {
+		if len(routes) > 0 {
+			b.pool.queues[i] <- delivery{message: message, routes: routes}
+		}
+	}
+}
+
+// invalidRoutes returns the channel of the invalid routes found by the workers, or nil if there are no workers
+func (p *deliveryPool) invalidRoutes() <-chan *Route {
+	if p == nil {
+		return nil
+	}
+	return p.invalidC
+}
@@ -0,0 +1,124 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// aFanOutRouter returns a started router with the fan-out settings
+func aFanOutRouter(maxSubscribers, workers int) *router {
+	kvs := kvstore.NewMemoryKVStore()
+	router := New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil).(*router)
+	router.SetFanOut(maxSubscribers, workers)
+	router.Start()
+	return router
+}
+
+func aFanOutRoute(path protocol.Path, userID string) *Route {
+	return NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "app01", "user_id": userID},
+		Path:        path,
+		ChannelSize: 10,
+	})
+}
+
+func TestRouter_MaxSubscribersPerTopic(t *testing.T) {
+	a := assert.New(t)
+
+	// given a topic with the maximum number of subscribers
+	router := aFanOutRouter(2, 0)
+	defer router.Stop()
+	_, err := router.Subscribe(aFanOutRoute("/foo", "user01"))
+	a.NoError(err)
+	_, err = router.Subscribe(aFanOutRoute("/foo", "user02"))
+	a.NoError(err)
+
+	// when another one subscribes, then it is rejected
+	_, err = router.Subscribe(aFanOutRoute("/foo", "user03"))
+	a.Equal(ErrTopicFull, err)
+	a.Len(router.routes["/foo"], 2)
+
+	// but a route replacing an existing one is accepted
+	replacing := aFanOutRoute("/foo", "user02")
+	_, err = router.Subscribe(replacing)
+	a.NoError(err)
+	a.Equal(replacing, router.routes["/foo"][1])
+
+	// and the limit is counted by topic path
+	_, err = router.Subscribe(aFanOutRoute("/bar", "user03"))
+	a.NoError(err)
+}
+
+func TestRouter_DeliveryWorkers(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router with two workers, and a blocking route which is not read
+	router := aFanOutRouter(0, 2)
+	slow := NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "app01", "user_id": "slow"},
+		Path:        "/foo",
+		ChannelSize: 1,
+		Blocking:    true,
+	})
+	_, err := router.Subscribe(slow)
+	a.NoError(err)
+	fast := aFanOutRoute("/foo", "fast")
+	_, err = router.Subscribe(fast)
+	a.NoError(err)
+	a.NotEqual(slow.worker, fast.worker)
+
+	// when messages are published
+	for i := 1; i <= 5; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte(fmt.Sprintf("%d", i))}))
+	}
+
+	// then the other route receives all of them in order, while the worker of the slow route is blocked
+	for i := 1; i <= 5; i++ {
+		select {
+		case m := <-fast.MessagesChannel():
+			a.Equal(fmt.Sprintf("%d", i), string(m.Body))
+		case <-time.After(time.Second):
+			a.FailNow("message not delivered")
+		}
+	}
+
+	// and the router stops, closing the blocked route
+	stopped := make(chan bool)
+	go func() {
+		router.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		a.Fail("router not stopped")
+	}
+	a.True(slow.isInvalid())
+}
+
+func TestRouter_DeliveryWorkersUnsubscribeInvalidRoutes(t *testing.T) {
+	a := assert.New(t)
+
+	// given a closed route delivered by a worker
+	router := aFanOutRouter(0, 1)
+	defer router.Stop()
+	closed := aFanOutRoute("/foo", "user01")
+	_, err := router.Subscribe(closed)
+	a.NoError(err)
+	closed.Close()
+
+	// when a message is published, then the route is unsubscribed
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo"}))
+	time.Sleep(20 * time.Millisecond)
+	_, err = router.Subscribe(aFanOutRoute("/bar", "user01"))
+	a.NoError(err)
+	a.Len(router.routes["/foo"], 0)
+}
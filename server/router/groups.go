@@ -0,0 +1,74 @@
+package router
+
+import (
+	"hash/fnv"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// GroupParam is the route param naming the consumer group of a connector subscription.
+// The routes of a path with the same group share its messages: each message is delivered to one member of the group,
+// selected by the partition key of the message if its topic is partitioned, and round-robin otherwise.
+// The routes without a group receive every message.
+const GroupParam = "group"
+
+// consumerGroups keeps the round-robin position of each consumer group, by groupKey.
+// It is used by the goroutine of the router only.
+type consumerGroups struct {
+	next map[string]uint64
+}
+
+func newConsumerGroups() *consumerGroups {
+	return &consumerGroups{next: make(map[string]uint64)}
+}
+
+// groupKey identifies a consumer group of a route path
+func groupKey(path protocol.Path, group string) string {
+	return string(path) + " " + group
+}
+
+// deliverToGroup delivers the message to one member of the consumer group.
+// If the selected member is invalid (e.g. its connection closed), it is unsubscribed and the message is delivered
+// to one of the remaining members, which also take over its share of the next messages.
+// It returns true, if the message was delivered to a member.
+func (router *router) deliverToGroup(message *protocol.Message, path protocol.Path, group string, members []*Route) bool {
+	partitionKey := router.PartitionKey(message)
+	for len(members) > 0 {
+		var i int
+		if partitionKey != "" {
+			h := fnv.New32a()
+			h.Write([]byte(partitionKey))
+			i = int(h.Sum32() % uint32(len(members)))
+		} else {
+			key := groupKey(path, group)
+			i = int(router.groups.next[key] % uint64(len(members)))
+			router.groups.next[key]++
+		}
+
+		if err := router.deliverToRoute(message, members[i]); err != ErrInvalidRoute {
+			return err == nil
+		}
+		logger.WithFields(log.Fields{
+			"group": group,
+			"route": members[i].String(),
+		}).Info("Rebalancing the message of an invalid consumer group member")
+		members = append(members[:i:i], members[i+1:]...)
+	}
+	return false
+}
+
+// removeGroup forgets the round-robin position of the group of the unsubscribed route, if it has no members left
+func (router *router) removeGroup(r *Route) {
+	group := r.Get(GroupParam)
+	if group == "" {
+		return
+	}
+	for _, route := range router.routes[r.Path] {
+		if route.Get(GroupParam) == group {
+			return
+		}
+	}
+	delete(router.groups.next, groupKey(r.Path, group))
+}
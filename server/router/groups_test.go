@@ -0,0 +1,111 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+// aGroupRoute subscribes a route for the topic, as a member of the group if it is not empty
+func aGroupRoute(a *assert.Assertions, router *router, appID, group string) *Route {
+	params := RouteParams{"application_id": appID, "user_id": "user01"}
+	if group != "" {
+		params[GroupParam] = group
+	}
+	r, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: params,
+		Path:        "/orders",
+		ChannelSize: 10,
+	}))
+	a.NoError(err)
+	return r
+}
+
+// receivedBodies returns the bodies of the messages in the channel of the route, waiting for the routing before
+func receivedBodies(r *Route) []string {
+	time.Sleep(20 * time.Millisecond)
+	var bodies []string
+	for {
+		select {
+		case m := <-r.MessagesChannel():
+			bodies = append(bodies, string(m.Body))
+		default:
+			return bodies
+		}
+	}
+}
+
+func TestRouter_ConsumerGroupSharesTheMessages(t *testing.T) {
+	a := assert.New(t)
+
+	// given two members of a group and a route without group
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	first := aGroupRoute(a, router, "app1", "workers")
+	second := aGroupRoute(a, router, "app2", "workers")
+	fanOut := aGroupRoute(a, router, "app3", "")
+
+	// when messages are published
+	for i := 1; i <= 4; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders", Body: []byte(fmt.Sprintf("%d", i))}))
+	}
+
+	// then each of them is delivered to one member of the group, round-robin
+	a.Equal([]string{"1", "3"}, receivedBodies(first))
+	a.Equal([]string{"2", "4"}, receivedBodies(second))
+
+	// and the route without group receives all of them
+	a.Equal([]string{"1", "2", "3", "4"}, receivedBodies(fanOut))
+}
+
+func TestRouter_ConsumerGroupRebalancesAnInvalidMember(t *testing.T) {
+	a := assert.New(t)
+
+	// given a group with a member, whose route was closed
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	first := aGroupRoute(a, router, "app1", "workers")
+	second := aGroupRoute(a, router, "app2", "workers")
+	first.Close()
+
+	// when messages are published, then the remaining member receives all of them
+	for i := 1; i <= 3; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders", Body: []byte(fmt.Sprintf("%d", i))}))
+	}
+	a.Equal([]string{"1", "2", "3"}, receivedBodies(second))
+
+	// and the invalid member was unsubscribed
+	a.Len(router.routes["/orders"], 1)
+
+	// and the position of the group is removed with its last member
+	router.Unsubscribe(second)
+	a.Len(router.groups.next, 0)
+}
+
+func TestRouter_ConsumerGroupByPartitionKey(t *testing.T) {
+	a := assert.New(t)
+
+	// given a group of a partitioned topic
+	router, _, _, kvs := aStartedRouter()
+	defer router.Stop()
+	a.NoError(kvs.Put(PartitioningSchema, "/orders", []byte(`{"enabled":true}`)))
+	first := aGroupRoute(a, router, "app1", "workers")
+	second := aGroupRoute(a, router, "app2", "workers")
+
+	// when the messages of a key are published
+	for i := 1; i <= 4; i++ {
+		a.NoError(router.HandleMessage(&protocol.Message{
+			Path:       "/orders",
+			HeaderJSON: `{"Partition-Key":"user01"}`,
+			Body:       []byte(fmt.Sprintf("%d", i)),
+		}))
+	}
+
+	// then they are all delivered to the same member
+	firstBodies, secondBodies := receivedBodies(first), receivedBodies(second)
+	a.True(len(firstBodies) == 0 || len(secondBodies) == 0)
+	a.Equal([]string{"1", "2", "3", "4"}, append(firstBodies, secondBodies...))
+}
@@ -0,0 +1,83 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+)
+
+var errEmptyHeaderFilterKey = errors.New("The key of a header filter must not be empty")
+
+// HeaderFilter is a filter of a route on a field of the header json of the messages,
+// parsed once when subscribing.
+type HeaderFilter struct {
+	Key string
+
+	// Value is the value the header field has to be equal to, unless only the presence of the field is checked.
+	Value string
+
+	// Present is true, if the filter only checks that the header field exists
+	Present bool
+}
+
+// ParseHeaderFilter parses a filter expression: `key=value` matches the messages with the header field `key` equal to
+// `value`, and `key` matches the messages having the header field `key`.
+func ParseHeaderFilter(expression string) (HeaderFilter, error) {
+	i := strings.Index(expression, "=")
+	if i < 0 {
+		if expression == "" {
+			return HeaderFilter{}, errEmptyHeaderFilterKey
+		}
+		return HeaderFilter{Key: expression, Present: true}, nil
+	}
+	if i == 0 {
+		return HeaderFilter{}, errEmptyHeaderFilterKey
+	}
+	return HeaderFilter{Key: expression[:i], Value: expression[i+1:]}, nil
+}
+
+func (f HeaderFilter) String() string {
+	if f.Present {
+		return f.Key
+	}
+	return f.Key + "=" + f.Value
+}
+
+// HeaderFilters are the header filters of a route, which all have to match for delivering a message.
+type HeaderFilters []HeaderFilter
+
+// Match returns true if there are no filters, or if the header json of the message matches all of them.
+// String fields are compared with their value, and all other fields with their json representation.
+func (filters HeaderFilters) Match(m *protocol.Message) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	if m.HeaderJSON == "" {
+		return false
+	}
+
+	var header map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(m.HeaderJSON), &header); err != nil {
+		return false
+	}
+	for _, f := range filters {
+		raw, ok := header[f.Key]
+		if !ok {
+			return false
+		}
+		if !f.Present && headerValue(raw) != f.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func headerValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
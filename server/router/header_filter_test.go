@@ -0,0 +1,77 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHeaderFilter(t *testing.T) {
+	a := assert.New(t)
+
+	f, err := ParseHeaderFilter("region=eu")
+	a.NoError(err)
+	a.Equal(HeaderFilter{Key: "region", Value: "eu"}, f)
+	a.Equal("region=eu", f.String())
+
+	f, err = ParseHeaderFilter("query=a=b")
+	a.NoError(err)
+	a.Equal(HeaderFilter{Key: "query", Value: "a=b"}, f)
+
+	f, err = ParseHeaderFilter("region=")
+	a.NoError(err)
+	a.Equal(HeaderFilter{Key: "region", Value: ""}, f)
+
+	f, err = ParseHeaderFilter("region")
+	a.NoError(err)
+	a.Equal(HeaderFilter{Key: "region", Present: true}, f)
+	a.Equal("region", f.String())
+
+	_, err = ParseHeaderFilter("")
+	a.Equal(errEmptyHeaderFilterKey, err)
+	_, err = ParseHeaderFilter("=eu")
+	a.Equal(errEmptyHeaderFilterKey, err)
+}
+
+func TestHeaderFilters_Match(t *testing.T) {
+	a := assert.New(t)
+
+	filters := HeaderFilters{{Key: "region", Value: "eu"}, {Key: "count", Value: "3"}, {Key: "premium", Present: true}}
+
+	testcases := []struct {
+		header  string
+		matches bool
+	}{
+		{header: `{"region":"eu","count":3,"premium":false}`, matches: true},
+		{header: `{"region":"eu","count":"3","premium":null}`, matches: true},
+		{header: `{"region":"us","count":3,"premium":false}`, matches: false},
+		{header: `{"region":"eu","count":4,"premium":false}`, matches: false},
+		{header: `{"region":"eu","count":3}`, matches: false},
+		{header: ``, matches: false},
+		{header: `not json`, matches: false},
+	}
+	for _, test := range testcases {
+		a.Equal(test.matches, filters.Match(&protocol.Message{HeaderJSON: test.header}), test.header)
+	}
+
+	// without filters all messages match
+	a.True(HeaderFilters(nil).Match(&protocol.Message{}))
+}
+
+func TestRoute_DeliverOnlyMatchingHeaders(t *testing.T) {
+	a := assert.New(t)
+
+	r := NewRoute(RouteConfig{
+		Path:          "/foo",
+		ChannelSize:   2,
+		HeaderFilters: HeaderFilters{{Key: "region", Value: "eu"}},
+	})
+
+	a.NoError(r.Deliver(&protocol.Message{ID: 1, Path: "/foo", HeaderJSON: `{"region":"us"}`}, false))
+	a.NoError(r.Deliver(&protocol.Message{ID: 2, Path: "/foo", HeaderJSON: `{"region":"eu"}`}, false))
+
+	m := <-r.MessagesChannel()
+	a.Equal(uint64(2), m.ID)
+	a.Equal(0, len(r.MessagesChannel()))
+}
@@ -0,0 +1,13 @@
+package router
+
+// IngestQueue is implemented by a router, which reports the published messages, which were stored
+// but not yet passed to the routes, e.g. for slowing down the publishers while the delivery lags behind.
+type IngestQueue interface {
+	// QueuedMessages returns the number of the published messages waiting for the delivery
+	QueuedMessages() int
+}
+
+// QueuedMessages is an implementation of the IngestQueue interface.
+func (router *router) QueuedMessages() int {
+	return len(router.handleC)
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"github.com/smancke/guble/protocol"
+)
+
+// MessageMiddleware transforms an incoming message before it is stored and delivered,
+// e.g. for adding a server timestamp to the header. Returning an error rejects the message.
+type MessageMiddleware func(*protocol.Message) (*protocol.Message, error)
+
+// MiddlewareRegistry is implemented by a router, which runs middlewares on the published messages.
+type MiddlewareRegistry interface {
+	// AddMiddleware appends a middleware to the chain, which runs in the order of registration.
+	// A middleware with the name of an already added one replaces it, at the same position.
+	AddMiddleware(name string, fn MessageMiddleware)
+}
+
+type namedMiddleware struct {
+	name string
+	fn   MessageMiddleware
+}
+
+// AddMiddleware adds a middleware run on each message published to this node.
+func (router *router) AddMiddleware(name string, fn MessageMiddleware) {
+	router.Lock()
+	defer router.Unlock()
+
+	for i, m := range router.middlewares {
+		if m.name == name {
+			router.middlewares[i].fn = fn
+			return
+		}
+	}
+	router.middlewares = append(router.middlewares, namedMiddleware{name: name, fn: fn})
+}
+
+func (router *router) getMiddlewares() []namedMiddleware {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.middlewares
+}
+
+// transform runs the middlewares on the message, replacing it with the result of the chain.
+func (router *router) transform(message *protocol.Message) error {
+	middlewares := router.getMiddlewares()
+	if len(middlewares) == 0 {
+		return nil
+	}
+	transformed := message
+	for _, m := range middlewares {
+		var err error
+		if transformed, err = m.fn(transformed); err != nil {
+			return &MiddlewareError{Name: m.name, Err: err}
+		}
+		if transformed == nil {
+			return &MiddlewareError{Name: m.name, Err: errNilMessage}
+		}
+	}
+	if transformed != message {
+		*message = *transformed
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_HandleMessageRunsTheMiddlewaresInOrder(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router with a route and two middlewares
+	router, r := aRouterRoute(chanSize)
+	msMock := NewMockMessageStore(ctrl)
+	router.messageStore = msMock
+
+	router.AddMiddleware("header", func(m *protocol.Message) (*protocol.Message, error) {
+		m.HeaderJSON = `{"server":"guble"}`
+		return m, nil
+	})
+	router.AddMiddleware("body", func(m *protocol.Message) (*protocol.Message, error) {
+		transformed := *m
+		transformed.Body = append([]byte("transformed "), m.Body...)
+		return &transformed, nil
+	})
+
+	// then the transformed message is stored
+	msMock.EXPECT().StoreMessage(gomock.Any(), gomock.Any()).
+		Do(func(m *protocol.Message, nodeID uint8) (int, error) {
+			a.Equal(`{"server":"guble"}`, m.HeaderJSON)
+			a.Equal("transformed test", string(m.Body))
+			m.ID = 42
+			return len(m.Bytes()), nil
+		})
+
+	// when a message is published
+	msg := &protocol.Message{Path: r.Path, Body: []byte("test")}
+	a.NoError(router.HandleMessage(msg))
+
+	// and the published message is replaced by the transformed one
+	a.Equal(uint64(42), msg.ID)
+	a.Equal("transformed test", string(msg.Body))
+	assertChannelContainsMessage(a, r.MessagesChannel(), []byte("transformed test"))
+}
+
+func TestRouter_HandleMessageRejectedByAMiddleware(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router with a middleware rejecting the messages
+	router, r := aRouterRoute(chanSize)
+	router.messageStore = NewMockMessageStore(ctrl)
+
+	calls := 0
+	router.AddMiddleware("pii", func(m *protocol.Message) (*protocol.Message, error) {
+		calls++
+		return nil, errors.New("contains pii")
+	})
+	router.AddMiddleware("never", func(m *protocol.Message) (*protocol.Message, error) {
+		a.Fail("The chain was not stopped")
+		return m, nil
+	})
+
+	// when a message is published, then it is rejected without storing it
+	err := router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage})
+	a.Equal(&MiddlewareError{Name: "pii", Err: errors.New("contains pii")}, err)
+	a.Equal("Message rejected by middleware pii: contains pii", err.Error())
+
+	// and a middleware added again with the same name replaces the old one
+	router.AddMiddleware("pii", func(m *protocol.Message) (*protocol.Message, error) {
+		return nil, nil
+	})
+	err = router.HandleMessage(&protocol.Message{Path: r.Path, Body: aTestByteMessage})
+	a.Equal(&MiddlewareError{Name: "pii", Err: errNilMessage}, err)
+	a.Equal(1, calls)
+	a.Len(router.getMiddlewares(), 2)
+}
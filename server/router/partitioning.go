@@ -0,0 +1,122 @@
+package router
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+)
+
+const (
+	// PartitioningSchema is the reserved schema of the KV store, containing the partitioned topics.
+	// Its keys are topic paths, or paths ending with `/*` for all topics below them.
+	PartitioningSchema = "partitioning"
+
+	// partitioningReloadInterval is the maximum age of the partitioned topics, before they are loaded again from the KV store
+	partitioningReloadInterval = 10 * time.Second
+)
+
+// Partitioner is implemented by a router, which knows the topics with ordered delivery by partition key.
+// The router itself delivers the messages in publish order to each route (also to a wildcard route of many topics);
+// the connectors use the partition key to never send the messages of the same key in parallel.
+type Partitioner interface {
+	// PartitionKey returns the partition key of the message,
+	// or an empty string if the message has none, or its topic is not partitioned.
+	PartitionKey(m *protocol.Message) string
+}
+
+// PartitioningConfig is the configuration of a partitioned topic, stored as json in the PartitioningSchema of the KV store
+type PartitioningConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// partitioning caches the configurations of the partitioned topics
+type partitioning struct {
+	kvStore kvstore.KVStore
+
+	mutex    sync.RWMutex
+	topics   map[string]*PartitioningConfig
+	loadedAt time.Time
+}
+
+func newPartitioning(kvStore kvstore.KVStore) *partitioning {
+	return &partitioning{
+		kvStore: kvStore,
+		topics:  make(map[string]*PartitioningConfig),
+	}
+}
+
+// PartitionKey is an implementation of the Partitioner interface.
+func (router *router) PartitionKey(m *protocol.Message) string {
+	key := m.PartitionKey()
+	if key == "" || router.partitioning == nil || !router.partitioning.enabled(m.Path) {
+		return ""
+	}
+	return key
+}
+
+// enabled returns true if the topic is partitioned, by its own config or by the nearest wildcard config above it
+func (p *partitioning) enabled(path protocol.Path) bool {
+	topics := p.current()
+	prefix := string(path)
+	if config, ok := topics[prefix]; ok {
+		return config.Enabled
+	}
+	for {
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			return false
+		}
+		prefix = prefix[:i]
+		if config, ok := topics[prefix+wildcardSuffix]; ok {
+			return config.Enabled
+		}
+	}
+}
+
+// load reads the partitioned topics from the KV store
+func (p *partitioning) load() error {
+	entries, err := p.kvStore.Iterate(PartitioningSchema, "")
+	if err != nil {
+		return err
+	}
+	topics := make(map[string]*PartitioningConfig)
+	for entry := range entries {
+		config := &PartitioningConfig{}
+		if err := json.Unmarshal([]byte(entry[1]), config); err != nil {
+			logger.WithError(err).WithField("path", entry[0]).Error("Ignoring the invalid partitioning config")
+			continue
+		}
+		topics[entry[0]] = config
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.topics = topics
+	p.loadedAt = time.Now()
+	return nil
+}
+
+// current returns the partitioned topics, loading them again if they are older than the reload interval
+func (p *partitioning) current() map[string]*PartitioningConfig {
+	p.mutex.RLock()
+	topics, loadedAt := p.topics, p.loadedAt
+	p.mutex.RUnlock()
+
+	if time.Since(loadedAt) < partitioningReloadInterval {
+		return topics
+	}
+	if err := p.load(); err != nil {
+		logger.WithError(err).Error("Loading the partitioned topics failed, using the previous ones")
+		p.mutex.Lock()
+		p.loadedAt = time.Now()
+		p.mutex.Unlock()
+		return topics
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.topics
+}
@@ -0,0 +1,82 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_PartitionKey(t *testing.T) {
+	a := assert.New(t)
+
+	// given the partitioned topics in the KV store
+	router, _, _, kvs := aStartedRouter()
+	defer router.Stop()
+	a.NoError(kvs.Put(PartitioningSchema, "/orders/*", []byte(`{"enabled":true}`)))
+	a.NoError(kvs.Put(PartitioningSchema, "/orders/public", []byte(`{"enabled":false}`)))
+	a.NoError(kvs.Put(PartitioningSchema, "/invoices", []byte(`invalid`)))
+
+	keyed := func(path protocol.Path) *protocol.Message {
+		return &protocol.Message{Path: path, HeaderJSON: `{"Partition-Key":"user01"}`}
+	}
+
+	// then only the keys of the messages to partitioned topics are returned
+	a.Equal("user01", router.PartitionKey(keyed("/orders/eu")))
+	a.Equal("user01", router.PartitionKey(keyed("/orders/eu/berlin")))
+	a.Equal("", router.PartitionKey(&protocol.Message{Path: "/orders/eu"}))
+	a.Equal("", router.PartitionKey(keyed("/orders/public")))
+	a.Equal("", router.PartitionKey(keyed("/orders")))
+	a.Equal("", router.PartitionKey(keyed("/invoices")))
+	a.Equal("", router.PartitionKey(keyed("/ordersandmore")))
+
+	// and the changes are loaded after the reload interval
+	a.NoError(kvs.Put(PartitioningSchema, "/invoices", []byte(`{"enabled":true}`)))
+	a.Equal("", router.PartitionKey(keyed("/invoices")))
+	router.partitioning.loadedAt = time.Now().Add(-partitioningReloadInterval)
+	a.Equal("user01", router.PartitionKey(keyed("/invoices")))
+}
+
+func TestRouter_DeliversPartitionedMessagesInOrder(t *testing.T) {
+	a := assert.New(t)
+
+	// given a wildcard route over several partitioned topics, with a queue
+	router, _, _, kvs := aStartedRouter()
+	defer router.Stop()
+	a.NoError(kvs.Put(PartitioningSchema, "/orders/*", []byte(`{"enabled":true}`)))
+	r, err := router.Subscribe(NewRoute(
+		RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        protocol.Path("/orders/*"),
+			ChannelSize: 1,
+			queueSize:   -1,
+			timeout:     -1,
+		},
+	))
+	a.NoError(err)
+
+	// when the messages of a key are published to the topics, while the route is read slowly
+	const count = 50
+	go func() {
+		for i := 0; i < count; i++ {
+			router.HandleMessage(&protocol.Message{
+				Path:       protocol.Path(fmt.Sprintf("/orders/%d", i%3)),
+				HeaderJSON: `{"Partition-Key":"user01"}`,
+				Body:       []byte(fmt.Sprintf("%d", i)),
+			})
+		}
+	}()
+
+	// then they are received in publish order
+	for i := 0; i < count; i++ {
+		select {
+		case m := <-r.MessagesChannel():
+			a.Equal(fmt.Sprintf("%d", i), string(m.Body))
+		case <-time.After(time.Second):
+			a.FailNow("No message received")
+		}
+		time.Sleep(100 * time.Microsecond)
+	}
+}
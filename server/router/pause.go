@@ -0,0 +1,214 @@
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+)
+
+const (
+	// DefaultMaxPausedMessages is the default maximum number of messages held back for a paused topic
+	DefaultMaxPausedMessages = 10000
+
+	resumeChannelCapacity = 10
+)
+
+// Pauser is implemented by a router, which can hold back the delivery of the messages of a topic,
+// e.g. of a noisy topic during an incident, without disconnecting its subscribers.
+type Pauser interface {
+	// Pause holds back the delivery of the messages of the topic and its subtopics to the routes,
+	// on all nodes of the cluster. The messages are still accepted and stored.
+	Pause(topic protocol.Path) error
+
+	// Resume delivers the held messages of the topic in order, and the following ones as before,
+	// on all nodes of the cluster.
+	Resume(topic protocol.Path) error
+
+	// PausedTopics returns the topics paused on this node, sorted by topic.
+	PausedTopics() []PausedTopic
+
+	// SetMaxPausedMessages sets the maximum number of messages held back for a paused topic.
+	// If more messages are published while it is paused, the held messages are dropped, and on resume
+	// the routes of the topic are closed instead: the subscribers catch up by fetching the messages from the store.
+	SetMaxPausedMessages(maxMessages int)
+}
+
+// PausedTopic is a topic, whose messages are held back by the router
+type PausedTopic struct {
+	Topic      protocol.Path `json:"topic"`
+	Since      time.Time     `json:"since"`
+	Held       int           `json:"held"`
+	Overflowed bool          `json:"overflowed,omitempty"`
+}
+
+// pausedTopic holds back the messages of a paused topic, in the order of their routing
+type pausedTopic struct {
+	since      time.Time
+	held       []*protocol.Message
+	overflowed bool
+}
+
+// pausing are the paused topics, changed by the requests and read by the goroutine of the router
+type pausing struct {
+	topics      map[protocol.Path]*pausedTopic
+	maxMessages int
+	sync.RWMutex
+}
+
+func newPausing() *pausing {
+	return &pausing{
+		topics:      make(map[protocol.Path]*pausedTopic),
+		maxMessages: DefaultMaxPausedMessages,
+	}
+}
+
+// SetMaxPausedMessages is an implementation of the Pauser interface.
+func (router *router) SetMaxPausedMessages(maxMessages int) {
+	router.pausing.Lock()
+	defer router.pausing.Unlock()
+
+	router.pausing.maxMessages = maxMessages
+}
+
+// Pause is an implementation of the Pauser interface.
+func (router *router) Pause(topic protocol.Path) error {
+	if err := router.HandlePause(topic); err != nil {
+		return err
+	}
+	if router.cluster != nil {
+		return router.cluster.BroadcastPause(string(topic))
+	}
+	return nil
+}
+
+// Resume is an implementation of the Pauser interface.
+func (router *router) Resume(topic protocol.Path) error {
+	if err := router.HandleResume(topic); err != nil {
+		return err
+	}
+	if router.cluster != nil {
+		return router.cluster.BroadcastResume(string(topic))
+	}
+	return nil
+}
+
+// HandlePause pauses the topic on this node only, e.g. when the pause was received from the cluster.
+// Pausing a paused topic keeps its held messages.
+func (router *router) HandlePause(topic protocol.Path) error {
+	if err := router.isStopping(); err != nil {
+		return err
+	}
+	topic = router.ResolveAlias(topic)
+
+	router.pausing.Lock()
+	defer router.pausing.Unlock()
+
+	if _, paused := router.pausing.topics[topic]; !paused {
+		router.pausing.topics[topic] = &pausedTopic{since: time.Now()}
+		logger.WithField("topic", topic).Info("Paused the delivery of the topic")
+	}
+	return nil
+}
+
+// HandleResume resumes the topic on this node only, e.g. when the resume was received from the cluster.
+// The held messages are delivered by the goroutine of the router, before the messages routed after them.
+func (router *router) HandleResume(topic protocol.Path) error {
+	if err := router.isStopping(); err != nil {
+		return err
+	}
+	router.resumeC <- router.ResolveAlias(topic)
+	return nil
+}
+
+// PausedTopics is an implementation of the Pauser interface.
+func (router *router) PausedTopics() []PausedTopic {
+	router.pausing.RLock()
+	defer router.pausing.RUnlock()
+
+	topics := make([]PausedTopic, 0, len(router.pausing.topics))
+	for topic, p := range router.pausing.topics {
+		topics = append(topics, PausedTopic{Topic: topic, Since: p.since, Held: len(p.held), Overflowed: p.overflowed})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
+
+// isPaused returns true, if the messages of the path are held back
+func (router *router) isPaused(path protocol.Path) bool {
+	router.pausing.RLock()
+	defer router.pausing.RUnlock()
+
+	for topic := range router.pausing.topics {
+		if matchesTopic(path, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// hold holds back the message, if its topic is paused. When the held messages of the topic exceed the maximum,
+// they are dropped: the topic is overflowed, and its routes catch up from the store on resume.
+func (router *router) hold(message *protocol.Message) bool {
+	router.pausing.Lock()
+	defer router.pausing.Unlock()
+
+	for topic, p := range router.pausing.topics {
+		if !matchesTopic(message.Path, topic) {
+			continue
+		}
+		if p.overflowed {
+			return true
+		}
+		if len(p.held) >= router.pausing.maxMessages {
+			logger.WithFields(log.Fields{
+				"topic":       topic,
+				"maxMessages": router.pausing.maxMessages,
+			}).Warn("Too many messages held back for the paused topic, its subscribers catch up from the store on resume")
+			p.held = nil
+			p.overflowed = true
+			return true
+		}
+		p.held = append(p.held, message)
+		return true
+	}
+	return false
+}
+
+// resume delivers the held messages of the topic to its routes. The routes of an overflowed topic are closed instead,
+// so that their subscribers fetch the messages missed since the pause.
+func (router *router) resume(topic protocol.Path) {
+	router.pausing.Lock()
+	p, paused := router.pausing.topics[topic]
+	delete(router.pausing.topics, topic)
+	router.pausing.Unlock()
+
+	if !paused {
+		return
+	}
+	l := logger.WithFields(log.Fields{
+		"topic":    topic,
+		"duration": time.Since(p.since),
+	})
+	if !p.overflowed {
+		for _, message := range p.held {
+			router.handleMessage(message)
+		}
+		l.WithField("messages", len(p.held)).Info("Resumed the delivery of the topic")
+		return
+	}
+
+	var overlapping []*Route
+	for path, pathRoutes := range router.routes {
+		if matchesTopic(path, topic) || matchesTopic(topic, path) {
+			overlapping = append(overlapping, pathRoutes...)
+		}
+	}
+	for _, route := range overlapping {
+		route.Close()
+		router.unsubscribe(route)
+	}
+	l.WithField("routes", len(overlapping)).Warn("Resumed the overflowed topic by closing its routes")
+}
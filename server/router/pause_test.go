@@ -0,0 +1,111 @@
+package router
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_PauseAndResume(t *testing.T) {
+	a := assert.New(t)
+
+	// given a route of a topic, and one of another topic
+	router, _, ms, _ := aStartedRouter()
+	defer router.Stop()
+	subscribe := func(path protocol.Path) *Route {
+		r, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        path,
+			ChannelSize: chanSize,
+		}))
+		a.NoError(err)
+		return r
+	}
+	foo, other := subscribe("/foo"), subscribe("/other")
+
+	// when the topic is paused
+	a.NoError(router.Pause("/foo"))
+
+	// then its messages are stored, but not delivered
+	for _, body := range []string{"first", "second"} {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo/bar", Body: []byte(body)}))
+	}
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/other", Body: []byte("other")}))
+	select {
+	case m := <-other.MessagesChannel():
+		a.Equal("other", string(m.Body))
+	case <-time.After(time.Second):
+		a.Fail("The message of another topic was not delivered")
+	}
+	select {
+	case <-foo.MessagesChannel():
+		a.Fail("A message of the paused topic was delivered")
+	case <-time.After(10 * time.Millisecond):
+	}
+	maxID, _ := ms.MaxMessageID("foo")
+	a.Equal(uint64(2), maxID)
+
+	// and the topic is listed as paused, with its subscribers
+	if paused := router.PausedTopics(); a.Len(paused, 1) {
+		a.Equal(protocol.Path("/foo"), paused[0].Topic)
+		a.Equal(2, paused[0].Held)
+		a.False(paused[0].Overflowed)
+	}
+	data, err := router.GetSubscribers("/foo")
+	a.NoError(err)
+	var subscribers []Subscriber
+	a.NoError(json.Unmarshal(data, &subscribers))
+	if a.Len(subscribers, 1) {
+		a.True(subscribers[0].Paused)
+	}
+
+	// and after the resume, the held messages are delivered in order, before the following ones
+	a.NoError(router.Resume("/foo"))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("third")}))
+	for _, body := range []string{"first", "second", "third"} {
+		select {
+		case m := <-foo.MessagesChannel():
+			a.Equal(body, string(m.Body))
+		case <-time.After(time.Second):
+			a.FailNow("The message was not delivered after the resume", body)
+		}
+	}
+	a.Empty(router.PausedTopics())
+}
+
+func TestRouter_ResumeOfAnOverflowedTopicClosesItsRoutes(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	router.SetMaxPausedMessages(1)
+	route, err := router.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+		Path:        "/*",
+		ChannelSize: chanSize,
+	}))
+	a.NoError(err)
+
+	// given a paused topic, with more messages than can be held
+	a.NoError(router.Pause("/foo"))
+	for _, body := range []string{"first", "second", "third"} {
+		a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte(body)}))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if paused := router.PausedTopics(); a.Len(paused, 1) {
+		a.Equal(0, paused[0].Held)
+		a.True(paused[0].Overflowed)
+	}
+
+	// when it is resumed, then the overlapping routes are closed, for catching up from the store
+	a.NoError(router.Resume("/foo"))
+	select {
+	case _, open := <-route.MessagesChannel():
+		a.False(open)
+	case <-time.After(time.Second):
+		a.Fail("The route was not closed")
+	}
+}
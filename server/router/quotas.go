@@ -0,0 +1,251 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/server/kvstore"
+)
+
+const (
+	// QuotasSchema is the reserved schema of the KV store, containing the message quotas by application id.
+	QuotasSchema = "quotas"
+
+	// QuotaUsageSchema is the reserved schema of the KV store, persisting the number of messages published
+	// in the current window of each quota, keyed by `{nodeID}/{applicationID}`.
+	QuotaUsageSchema = "quota_usage"
+
+	// defaultQuotaWindow is the window of a quota without one
+	defaultQuotaWindow = 24 * time.Hour
+
+	// quotasReloadInterval is the maximum age of the quotas, before they are loaded again from the KV store
+	quotasReloadInterval = 10 * time.Second
+
+	// quotaUsageFlushInterval is the maximum age of the counted messages, before they are persisted in the KV store
+	quotaUsageFlushInterval = 5 * time.Second
+)
+
+// QuotaMeter is implemented by a router, which limits the number of messages published by an application
+// in a window of time, e.g. a day. The windows are aligned to the unix epoch, so a daily quota is reset at midnight UTC.
+type QuotaMeter interface {
+	// QuotaUsage returns the usage of the quota of the application in the current window,
+	// and false if the application has no quota.
+	QuotaUsage(applicationID string) (QuotaUsage, bool)
+}
+
+// QuotaConfig is the quota of an application, stored as json in the QuotasSchema of the KV store,
+// e.g. `{"limit":10000,"window":"24h"}`
+type QuotaConfig struct {
+	Limit  int    `json:"limit"`
+	Window string `json:"window,omitempty"`
+}
+
+// QuotaUsage is the number of messages published by an application in the current window of its quota
+type QuotaUsage struct {
+	ApplicationID string    `json:"applicationId"`
+	Limit         int       `json:"limit"`
+	Used          int       `json:"used"`
+	Window        string    `json:"window"`
+	Reset         time.Time `json:"reset"`
+}
+
+// quota is a parsed QuotaConfig
+type quota struct {
+	limit  int
+	window time.Duration
+}
+
+// quotaCounter counts the messages of an application in the window starting at start
+type quotaCounter struct {
+	// Start is the unix time of the window
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+
+	dirty bool
+}
+
+// quotas caches the quotas of the applications, and counts their messages published to this node
+type quotas struct {
+	kvStore kvstore.KVStore
+
+	mutex    sync.RWMutex
+	quotas   map[string]quota
+	loadedAt time.Time
+
+	countersMutex sync.Mutex
+	counters      map[string]*quotaCounter
+	flushedAt     time.Time
+}
+
+func newQuotas(kvStore kvstore.KVStore) *quotas {
+	return &quotas{
+		kvStore:   kvStore,
+		quotas:    make(map[string]quota),
+		counters:  make(map[string]*quotaCounter),
+		flushedAt: time.Now(),
+	}
+}
+
+// QuotaUsage is an implementation of the QuotaMeter interface.
+func (router *router) QuotaUsage(applicationID string) (QuotaUsage, bool) {
+	if router.quotas == nil {
+		return QuotaUsage{}, false
+	}
+	return router.quotas.usage(router.nodeID(), applicationID, time.Now())
+}
+
+func (router *router) nodeID() uint8 {
+	if router.cluster != nil {
+		return router.cluster.Config.ID
+	}
+	return 0
+}
+
+// use counts a message of the application, or returns a QuotaExceededError if its quota is used up in the current window
+func (q *quotas) use(nodeID uint8, applicationID string, now time.Time) error {
+	quota, ok := q.current()[applicationID]
+	if !ok {
+		return nil
+	}
+	start := now.Truncate(quota.window)
+
+	q.countersMutex.Lock()
+	c := q.counter(nodeID, applicationID, start)
+	if c.Count >= quota.limit {
+		q.countersMutex.Unlock()
+		return &QuotaExceededError{
+			ApplicationID: applicationID,
+			Limit:         quota.limit,
+			RetryAfter:    start.Add(quota.window).Sub(now),
+		}
+	}
+	c.Count++
+	c.dirty = true
+	flush := now.Sub(q.flushedAt) >= quotaUsageFlushInterval
+	q.countersMutex.Unlock()
+
+	if flush {
+		q.flush(now)
+	}
+	return nil
+}
+
+// usage returns the usage of the quota of the application in the current window
+func (q *quotas) usage(nodeID uint8, applicationID string, now time.Time) (QuotaUsage, bool) {
+	quota, ok := q.current()[applicationID]
+	if !ok {
+		return QuotaUsage{}, false
+	}
+	start := now.Truncate(quota.window)
+
+	q.countersMutex.Lock()
+	defer q.countersMutex.Unlock()
+	return QuotaUsage{
+		ApplicationID: applicationID,
+		Limit:         quota.limit,
+		Used:          q.counter(nodeID, applicationID, start).Count,
+		Window:        quota.window.String(),
+		Reset:         start.Add(quota.window),
+	}, true
+}
+
+// counter returns the counter of the application for the window, loading it from the KV store after a restart.
+// It has to be called with the countersMutex held.
+func (q *quotas) counter(nodeID uint8, applicationID string, start time.Time) *quotaCounter {
+	key := quotaUsageKey(nodeID, applicationID)
+	c, ok := q.counters[key]
+	if !ok {
+		c = &quotaCounter{}
+		if data, exist, err := q.kvStore.Get(QuotaUsageSchema, key); err != nil {
+			logger.WithError(err).WithField("applicationID", applicationID).Error("Loading the quota usage failed")
+		} else if exist {
+			if err := json.Unmarshal(data, c); err != nil {
+				logger.WithError(err).WithField("applicationID", applicationID).Error("Ignoring the invalid quota usage")
+			}
+		}
+		q.counters[key] = c
+	}
+	if c.Start != start.Unix() {
+		// a new window starts with no messages
+		c.Start, c.Count, c.dirty = start.Unix(), 0, true
+	}
+	return c
+}
+
+// flush persists the changed counters in the KV store
+func (q *quotas) flush(now time.Time) {
+	q.countersMutex.Lock()
+	q.flushedAt = now
+	changed := make(map[string][]byte)
+	for key, c := range q.counters {
+		if c.dirty {
+			data, _ := json.Marshal(c)
+			changed[key] = data
+			c.dirty = false
+		}
+	}
+	q.countersMutex.Unlock()
+
+	for key, data := range changed {
+		if err := q.kvStore.Put(QuotaUsageSchema, key, data); err != nil {
+			logger.WithError(err).WithField("key", key).Error("Persisting the quota usage failed")
+		}
+	}
+}
+
+func quotaUsageKey(nodeID uint8, applicationID string) string {
+	return fmt.Sprintf("%d/%s", nodeID, applicationID)
+}
+
+// load reads the quotas from the KV store
+func (q *quotas) load() error {
+	entries, err := q.kvStore.Iterate(QuotasSchema, "")
+	if err != nil {
+		return err
+	}
+	quotas := make(map[string]quota)
+	for entry := range entries {
+		config := &QuotaConfig{}
+		if err := json.Unmarshal([]byte(entry[1]), config); err != nil {
+			logger.WithError(err).WithField("applicationID", entry[0]).Error("Ignoring the invalid quota")
+			continue
+		}
+		window := defaultQuotaWindow
+		if config.Window != "" {
+			if window, err = time.ParseDuration(config.Window); err != nil || window <= 0 {
+				logger.WithField("applicationID", entry[0]).Error("Ignoring the quota with an invalid window")
+				continue
+			}
+		}
+		quotas[entry[0]] = quota{limit: config.Limit, window: window}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.quotas = quotas
+	q.loadedAt = time.Now()
+	return nil
+}
+
+// current returns the quotas, loading them again if they are older than the reload interval
+func (q *quotas) current() map[string]quota {
+	q.mutex.RLock()
+	quotas, loadedAt := q.quotas, q.loadedAt
+	q.mutex.RUnlock()
+
+	if time.Since(loadedAt) < quotasReloadInterval {
+		return quotas
+	}
+	if err := q.load(); err != nil {
+		logger.WithError(err).Error("Loading the quotas failed, using the previous ones")
+		q.mutex.Lock()
+		q.loadedAt = time.Now()
+		q.mutex.Unlock()
+		return quotas
+	}
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	return q.quotas
+}
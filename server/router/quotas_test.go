@@ -0,0 +1,86 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_QuotaRejectsTheMessagesExceedingIt(t *testing.T) {
+	a := assert.New(t)
+
+	// given an application with a quota of two messages
+	router, _, _, kvs := aStartedRouter()
+	defer router.Stop()
+	a.NoError(kvs.Put(QuotasSchema, "shop", []byte(`{"limit":2,"window":"1h"}`)))
+
+	publish := func(applicationID string) error {
+		return router.HandleMessage(&protocol.Message{Path: "/orders", ApplicationID: applicationID, Body: []byte("order")})
+	}
+
+	// then its third message is rejected until the next window
+	a.NoError(publish("shop"))
+	a.NoError(publish("shop"))
+	err := publish("shop")
+	if a.IsType(&QuotaExceededError{}, err) {
+		quotaErr := err.(*QuotaExceededError)
+		a.Equal("shop", quotaErr.ApplicationID)
+		a.Equal(2, quotaErr.Limit)
+		a.True(quotaErr.RetryAfter > 0 && quotaErr.RetryAfter <= time.Hour)
+	}
+
+	// and the other applications are not limited
+	a.NoError(publish("other"))
+
+	// and the usage is reported
+	usage, ok := router.QuotaUsage("shop")
+	a.True(ok)
+	a.Equal(2, usage.Used)
+	a.Equal(2, usage.Limit)
+	a.Equal("1h0m0s", usage.Window)
+	a.Equal(time.Now().Truncate(time.Hour).Add(time.Hour), usage.Reset)
+	_, ok = router.QuotaUsage("other")
+	a.False(ok)
+}
+
+func TestQuotas_WindowAndPersistence(t *testing.T) {
+	a := assert.New(t)
+
+	kvs := kvstore.NewMemoryKVStore()
+	a.NoError(kvs.Put(QuotasSchema, "shop", []byte(`{"limit":1}`)))
+	a.NoError(kvs.Put(QuotasSchema, "invalid", []byte(`{"limit":1,"window":"often"}`)))
+	q := newQuotas(kvs)
+	day := time.Date(2017, 1, 2, 15, 0, 0, 0, time.UTC)
+
+	// a daily quota is used up until midnight
+	a.NoError(q.use(1, "shop", day))
+	err := q.use(1, "shop", day.Add(time.Hour))
+	if a.IsType(&QuotaExceededError{}, err) {
+		a.Equal(8*time.Hour, err.(*QuotaExceededError).RetryAfter)
+	}
+
+	// and the usage is kept after a restart
+	q.flush(day)
+	restarted := newQuotas(kvs)
+	a.IsType(&QuotaExceededError{}, restarted.use(1, "shop", day.Add(2*time.Hour)))
+
+	// but is reset with the next window
+	a.NoError(restarted.use(1, "shop", day.Add(9*time.Hour)))
+
+	// and the usage of another node is separate
+	a.NoError(restarted.use(2, "shop", day))
+
+	// and a quota with an invalid window is ignored
+	a.NoError(q.use(1, "invalid", day))
+	a.NoError(q.use(1, "invalid", day))
+}
+
+func TestQuotaExceededError_RetryAfterSeconds(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(int64(91), (&QuotaExceededError{RetryAfter: 90500 * time.Millisecond}).RetryAfterSeconds())
+	a.Equal(int64(90), (&QuotaExceededError{RetryAfter: 90 * time.Second}).RetryAfterSeconds())
+	a.Equal(int64(1), (&QuotaExceededError{RetryAfter: 0}).RetryAfterSeconds())
+}
@@ -0,0 +1,201 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// replayLiveWindow is the number of the last messages of a partition, which are replayed without throttling:
+// a fetch reaching them has caught up with the live tail.
+const replayLiveWindow = 100
+
+// ReplayThrottler is implemented by a router, which can limit the rate of the messages replayed from the message store,
+// so that many clients catching up at once do not overload the store, and the live delivery keeps going.
+type ReplayThrottler interface {
+	// SetReplayRate limits the replayed messages to rate per second over all topics,
+	// and to topicRate per second for each partition (zero disables a limit).
+	SetReplayRate(rate, topicRate float64)
+
+	// ThrottleFetch returns the request to pass to the message store instead of req,
+	// whose messages are forwarded to req at the limited rate.
+	// It returns req itself, if the replay is not limited.
+	ThrottleFetch(req *store.FetchRequest) *store.FetchRequest
+}
+
+// SetReplayRate sets the limits of the replay from the message store.
+func (router *router) SetReplayRate(rate, topicRate float64) {
+	router.Lock()
+	defer router.Unlock()
+
+	if rate <= 0 && topicRate <= 0 {
+		router.replayThrottle = nil
+		return
+	}
+	router.replayThrottle = newReplayThrottle(rate, topicRate)
+}
+
+func (router *router) getReplayThrottle() *replayThrottle {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.replayThrottle
+}
+
+// ThrottleFetch throttles the messages of the fetch request, if the replay is limited.
+func (router *router) ThrottleFetch(req *store.FetchRequest) *store.FetchRequest {
+	t := router.getReplayThrottle()
+	if t == nil || router.messageStore == nil {
+		return req
+	}
+	maxID, err := router.messageStore.MaxMessageID(req.Partition)
+	if err != nil {
+		logger.WithError(err).WithField("partition", req.Partition).Error("Reading the last message id for the replay failed")
+		return req
+	}
+
+	throttled := &store.FetchRequest{
+		Partition: req.Partition,
+		StartID:   req.StartID,
+		EndID:     req.EndID,
+		Direction: req.Direction,
+		Count:     req.Count,
+		MessageC:  make(chan *store.FetchedMessage, cap(req.MessageC)),
+		ErrorC:    make(chan error),
+		StartC:    req.StartC,
+	}
+	go t.forward(throttled, req, maxID)
+	return throttled
+}
+
+// replayThrottle holds the token buckets of the replay, over all topics and by partition.
+type replayThrottle struct {
+	all       *replayBucket
+	topicRate float64
+
+	mutex  sync.Mutex
+	topics map[string]*replayBucket
+	now    func() time.Time
+}
+
+// replayBucket is a token bucket, which can go into debt: a replayed message takes its token at once,
+// and waits for the time needed to refill it. So each waiting replay proceeds in time, in the order of its arrival.
+type replayBucket struct {
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	fetches int
+}
+
+func newReplayBucket(rate float64, now time.Time) *replayBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &replayBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// take takes a token, returning the time to wait for it
+func (b *replayBucket) take(now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func newReplayThrottle(rate, topicRate float64) *replayThrottle {
+	t := &replayThrottle{
+		topicRate: topicRate,
+		topics:    make(map[string]*replayBucket),
+		now:       time.Now,
+	}
+	if rate > 0 {
+		t.all = newReplayBucket(rate, t.now())
+	}
+	return t
+}
+
+// wait returns the time to wait for replaying a message of the partition
+func (t *replayThrottle) wait(partition string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	var d time.Duration
+	if t.all != nil {
+		d = t.all.take(now)
+	}
+	if b, ok := t.topics[partition]; ok {
+		if topicWait := b.take(now); topicWait > d {
+			d = topicWait
+		}
+	}
+	return d
+}
+
+// register adds a replay of the partition, creating its bucket with the first one
+func (t *replayThrottle) register(partition string) {
+	if t.topicRate <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b, ok := t.topics[partition]
+	if !ok {
+		b = newReplayBucket(t.topicRate, t.now())
+		t.topics[partition] = b
+	}
+	b.fetches++
+}
+
+// unregister removes a replay of the partition, and its bucket with the last one
+func (t *replayThrottle) unregister(partition string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	b, ok := t.topics[partition]
+	if !ok {
+		return
+	}
+	b.fetches--
+	if b.fetches <= 0 {
+		delete(t.topics, partition)
+	}
+}
+
+// forward passes the messages fetched by the throttled request to the original one, waiting for the rate limits.
+// The messages among the last ones of the partition at the start of the fetch are forwarded at once.
+// The forwarding ends with the fetch, or with its error.
+func (t *replayThrottle) forward(throttled, req *store.FetchRequest, maxID uint64) {
+	t.register(req.Partition)
+	defer t.unregister(req.Partition)
+
+	for {
+		select {
+		case fm, ok := <-throttled.MessageC:
+			if !ok {
+				req.Done()
+				return
+			}
+			if fm.ID+replayLiveWindow <= maxID {
+				if d := t.wait(req.Partition); d > 0 {
+					mTotalThrottledReplayMessages.Add(1)
+					time.Sleep(d)
+				}
+			}
+			req.MessageC <- fm
+		case err := <-throttled.ErrorC:
+			req.ErrorC <- err
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/memorystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayThrottle_Wait(t *testing.T) {
+	a := assert.New(t)
+
+	// given a throttle of 10 messages per second, and 2 per second by topic
+	now := time.Unix(1000, 0)
+	throttle := newReplayThrottle(10, 2)
+	throttle.now = func() time.Time { return now }
+	throttle.all = newReplayBucket(10, now)
+	throttle.register("foo")
+	throttle.register("bar")
+
+	// then the burst of a topic is replayed at once, and the next message waits for its topic bucket
+	a.Equal(time.Duration(0), throttle.wait("foo"))
+	a.Equal(time.Duration(0), throttle.wait("foo"))
+	a.Equal(500*time.Millisecond, throttle.wait("foo"))
+
+	// and the other topic has its own bucket
+	a.Equal(time.Duration(0), throttle.wait("bar"))
+
+	// and the waiting time grows with the messages taken meanwhile
+	a.Equal(time.Second, throttle.wait("foo"))
+
+	// and the bucket is refilled with the time
+	now = now.Add(2 * time.Second)
+	a.Equal(time.Duration(0), throttle.wait("foo"))
+
+	// and the bucket of a topic is removed with its last replay, leaving the global limit only
+	throttle.unregister("foo")
+	a.Len(throttle.topics, 1)
+}
+
+// replayIDs fetches the messages of the partition from the id, returning their ids
+func replayIDs(router *router, startID uint64) []uint64 {
+	req := store.NewFetchRequest("foo", startID, 0, store.DirectionForward, -1)
+	req.Init()
+	router.Fetch(req)
+	req.Ready()
+	var ids []uint64
+	for m := range req.Messages() {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestRouter_ThrottledConcurrentReplays(t *testing.T) {
+	a := assert.New(t)
+
+	// given a topic with 140 messages and a replay limit of 200 messages per second
+	kvs := kvstore.NewMemoryKVStore()
+	ms := memorystore.New(1000)
+	for id := uint64(1); id <= 140; id++ {
+		a.NoError(ms.Store("foo", id, []byte("message")))
+	}
+	router := New(auth.NewAllowAllAccessManager(true), ms, kvs, nil).(*router)
+	router.SetReplayRate(200, 0)
+	a.NoError(router.Start())
+	defer router.Stop()
+
+	// when 10 clients replay all of them at once, the last 100 messages of each one not being throttled
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// then each client receives all messages in order
+			ids := replayIDs(router, 1)
+			if a.Len(ids, 140) {
+				a.Equal(uint64(1), ids[0])
+				a.Equal(uint64(140), ids[139])
+			}
+		}()
+	}
+
+	// and a client replaying the live tail meanwhile is not throttled
+	time.Sleep(50 * time.Millisecond)
+	tailStart := time.Now()
+	a.Len(replayIDs(router, 100), 41)
+	a.True(time.Since(tailStart) < 200*time.Millisecond)
+
+	// and the 400 throttled messages take the burst of 200 and one more second
+	wg.Wait()
+	elapsed := time.Since(start)
+	a.True(elapsed > 800*time.Millisecond, elapsed.String())
+	a.True(elapsed < 3*time.Second, elapsed.String())
+}
@@ -31,8 +31,22 @@ type Route struct {
 	// if it reaches the capacity the route is closed.
 	queue *queue
 
+	// lag tracks how far the consumer of the route is behind
+	lag routeLag
+
+	// worker is the delivery worker of the route, if the router has a pool of workers
+	worker int
+
 	closeC chan struct{}
 
+	// resetC is signaled, when the stored messages of the topic were deleted by a truncation
+	resetC chan struct{}
+
+	// closingC is closed before the route takes its lock for closing,
+	// which releases a blocking send holding the lock
+	closingC    chan struct{}
+	closingOnce sync.Once
+
 	// Indicates if the consumer go routine is running
 	consuming bool
 	invalid   bool
@@ -47,8 +61,11 @@ func NewRoute(config RouteConfig) *Route {
 		RouteConfig: config,
 
 		queue:     newQueue(config.queueSize),
+		lag:       newRouteLag(config.ChannelSize),
 		messagesC: make(chan *protocol.Message, config.ChannelSize),
 		closeC:    make(chan struct{}),
+		closingC:  make(chan struct{}),
+		resetC:    make(chan struct{}, 1),
 
 		logger: logger.WithFields(log.Fields{"path": config.Path, "params": config.RouteParams}),
 	}
@@ -88,6 +105,18 @@ func (r *Route) Deliver(msg *protocol.Message, isFromStore bool) error {
 		mTotalNotMatchedByFilters.Add(1)
 		return nil
 	}
+
+	if !r.HeaderFilters.Match(msg) {
+		loggerMessage.Debug("Message header didn't match route filters")
+		mTotalNotMatchedByFilters.Add(1)
+		return nil
+	}
+	r.routed(msg.ID)
+
+	if r.Blocking {
+		return r.sendBlocking(msg)
+	}
+
 	// not an infinite queue
 	if r.queueSize >= 0 {
 		// if size is zero the sending is direct
@@ -113,6 +142,20 @@ func (r *Route) MessagesChannel() <-chan *protocol.Message {
 	return r.messagesC
 }
 
+// ResetChannel returns the channel signaled when the topic of the route was truncated:
+// its stored messages were deleted, and the ids of its next messages start a new sequence.
+func (r *Route) ResetChannel() <-chan struct{} {
+	return r.resetC
+}
+
+// reset signals the truncation of the topic, without blocking if a signal is still pending
+func (r *Route) reset() {
+	select {
+	case r.resetC <- struct{}{}:
+	default:
+	}
+}
+
 // Provide accepts a router to use for fetching/subscribing and a boolean
 // indicating if it should close the route after fetching without subscribing
 // The method is blocking until fetch is finished or route is subscribed
@@ -178,13 +221,13 @@ REFETCH:
 				goto REFETCH
 			}
 
-			r.logger.WithField("fetchedMessageID", fetchedMessage.ID).Debug("Fetched message")
+			r.logger.WithField("message_id", fetchedMessage.ID).Debug("Fetched message")
 			message, err := protocol.ParseMessage(fetchedMessage.Message)
 			if err != nil {
 				return err
 			}
 
-			r.logger.WithField("messageID", message.ID).Debug("Sending fetched message in channel")
+			r.logger.WithField("message_id", message.ID).Debug("Sending fetched message in channel")
 			if err := r.Deliver(message, true); err != nil {
 				return err
 			}
@@ -206,6 +249,7 @@ func (r *Route) handleSubscribe(router Router) error {
 
 // Close closes the route channel.
 func (r *Route) Close() error {
+	r.closingOnce.Do(func() { close(r.closingC) })
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.logger.Debug("Closing route")
@@ -311,12 +355,14 @@ func (r *Route) send(msg *protocol.Message) error {
 	// no timeout, means we don't close the channel
 	if r.timeout == -1 {
 		r.messagesC <- msg
+		r.sentToChannel(msg.ID)
 		r.logger.WithField("size", len(r.messagesC)).Debug("Channel size")
 		return nil
 	}
 
 	select {
 	case r.messagesC <- msg:
+		r.sentToChannel(msg.ID)
 		return nil
 	case <-r.closeC:
 		return ErrInvalidRoute
@@ -336,15 +382,35 @@ func (r *Route) invalidRecover() error {
 	return nil
 }
 
+// sendBlocking sends the message in the channel, waiting until it is read or the route is closed.
+// It holds the read lock while sending, so that the channel is not closed meanwhile.
+func (r *Route) sendBlocking(msg *protocol.Message) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.invalid {
+		return ErrInvalidRoute
+	}
+
+	select {
+	case r.messagesC <- msg:
+		r.sentToChannel(msg.ID)
+		return nil
+	case <-r.closingC:
+		return ErrInvalidRoute
+	}
+}
+
 // sendDirect sends the message directly in the channel
 func (r *Route) sendDirect(msg *protocol.Message, store bool) error {
 	if store {
 		r.messagesC <- msg
+		r.sentToChannel(msg.ID)
 		return nil
 	}
 
 	select {
 	case r.messagesC <- msg:
+		r.sentToChannel(msg.ID)
 		return nil
 	default:
 		r.logger.Debug("Closing route because of full channel")
@@ -28,9 +28,19 @@ type RouteConfig struct {
 	// If timeout is reached the route is closed.
 	timeout time.Duration
 
+	// Blocking routes wait for each message to be read from their channel, instead of closing
+	// when it is full, which blocks the router until then
+	Blocking bool `json:"-"`
+
 	// Matcher if set will be used to check equality of the routes
 	Matcher Matcher `json:"-"`
 
+	// HeaderFilters only deliver the messages with matching header fields to the route
+	HeaderFilters HeaderFilters `json:"-"`
+
+	// Metadata of the connection of the route, passed by the client (e.g. its app version), listed with the subscribers
+	Metadata map[string]string `json:"-"`
+
 	// FetchRequest to fetch messages before subscribing
 	// The Partition field of the FetchRequest is overrided with the Partition of the Route topic
 	FetchRequest *store.FetchRequest `json:"-"`
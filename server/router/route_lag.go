@@ -0,0 +1,144 @@
+package router
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/server/metrics"
+)
+
+// LagMonitor is implemented by a router, which can warn about and disconnect the subscribers not keeping up with their topics.
+type LagMonitor interface {
+	// SetLagThreshold warns about the routes with a lag above the threshold (zero disables it),
+	// and closes them if disconnect is set.
+	SetLagThreshold(threshold uint64, disconnect bool)
+}
+
+// routeLag tracks the ids of the messages of a route, for computing how far its consumer is behind the topic.
+type routeLag struct {
+	mutex sync.Mutex
+
+	// firstID and routedID are the ids of the first and the last message accepted for the route
+	firstID  uint64
+	routedID uint64
+
+	// sentIDs is a ring of the ids of the last messages sent to the channel, one more than the channel can hold,
+	// so that the id of the last message read from the channel is known
+	sentIDs []uint64
+	sent    int
+
+	// slow marks a route with a lag above the threshold, for warning only once
+	slow bool
+}
+
+func newRouteLag(channelSize int) routeLag {
+	return routeLag{sentIDs: make([]uint64, channelSize+1)}
+}
+
+// routed remembers the id of a message accepted for the route
+func (r *Route) routed(id uint64) {
+	r.lag.mutex.Lock()
+	defer r.lag.mutex.Unlock()
+
+	if r.lag.firstID == 0 {
+		r.lag.firstID = id
+	}
+	if id > r.lag.routedID {
+		r.lag.routedID = id
+	}
+}
+
+// sentToChannel remembers the id of a message sent to the channel of the route
+func (r *Route) sentToChannel(id uint64) {
+	r.lag.mutex.Lock()
+	defer r.lag.mutex.Unlock()
+
+	r.lag.sentIDs[r.lag.sent%len(r.lag.sentIDs)] = id
+	r.lag.sent++
+}
+
+// Lag returns the difference between the id of the last message accepted for the route
+// and the id of the last message read from its channel by the consumer.
+func (r *Route) Lag() uint64 {
+	r.lag.mutex.Lock()
+	defer r.lag.mutex.Unlock()
+
+	if r.lag.routedID == 0 {
+		return 0
+	}
+	readID := r.lag.firstID - 1
+	if read := r.lag.sent - len(r.messagesC) - 1; read >= 0 {
+		readID = r.lag.sentIDs[read%len(r.lag.sentIDs)]
+	}
+	if readID >= r.lag.routedID {
+		return 0
+	}
+	return r.lag.routedID - readID
+}
+
+// SetLagThreshold sets the lag above which a route is considered slow.
+func (router *router) SetLagThreshold(threshold uint64, disconnect bool) {
+	router.Lock()
+	defer router.Unlock()
+
+	router.lagThreshold = threshold
+	router.disconnectSlow = disconnect
+}
+
+func (router *router) getLagThreshold() (uint64, bool) {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.lagThreshold, router.disconnectSlow
+}
+
+// checkLag updates the lag metric with the largest lag of the routes of each user,
+// and warns about or disconnects the routes with a lag above the threshold.
+func (router *router) checkLag() {
+	threshold, disconnect := router.getLagThreshold()
+
+	lags := make(map[string]uint64)
+	var slowRoutes []*Route
+	for _, routes := range router.routes {
+		for _, route := range routes {
+			lag := route.Lag()
+			userID := route.Get("user_id")
+			if current, ok := lags[userID]; !ok || lag > current {
+				lags[userID] = lag
+			}
+
+			if threshold == 0 || lag <= threshold {
+				route.lag.slow = false
+				continue
+			}
+			if !route.lag.slow {
+				route.lag.slow = true
+				route.logger.WithFields(log.Fields{
+					"user_id":   userID,
+					"lag":       lag,
+					"threshold": threshold,
+				}).Warn("Slow consumer is lagging behind the topic")
+			}
+			if disconnect {
+				slowRoutes = append(slowRoutes, route)
+			}
+		}
+	}
+
+	for _, route := range slowRoutes {
+		route.logger.WithField("lag", route.Lag()).Warn("Disconnecting slow consumer")
+		mTotalDisconnectedSlowConsumers.Add(1)
+		route.Close()
+		router.unsubscribe(route)
+	}
+
+	for userID, lag := range lags {
+		metrics.PromSubscriberLag.WithLabelValues(userID).Set(float64(lag))
+	}
+	for userID := range router.lagUserIDs {
+		if _, ok := lags[userID]; !ok {
+			metrics.PromSubscriberLag.DeleteLabelValues(userID)
+		}
+	}
+	router.lagUserIDs = lags
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoute_Lag(t *testing.T) {
+	a := assert.New(t)
+
+	// given a route without messages
+	r := NewRoute(RouteConfig{
+		RouteParams: RouteParams{"user_id": "user01"},
+		Path:        "/foo",
+		ChannelSize: 3,
+	})
+	a.Equal(uint64(0), r.Lag())
+
+	// when three messages are delivered, but not read
+	for id := uint64(11); id <= 13; id++ {
+		a.NoError(r.Deliver(&protocol.Message{ID: id, Path: "/foo"}, false))
+	}
+
+	// then the route lags behind by all of them
+	a.Equal(uint64(3), r.Lag())
+
+	// and the lag decreases, when they are read
+	<-r.MessagesChannel()
+	a.Equal(uint64(2), r.Lag())
+	<-r.MessagesChannel()
+	<-r.MessagesChannel()
+	a.Equal(uint64(0), r.Lag())
+
+	// and a message not matching the filters of the route is not counted
+	a.NoError(r.Deliver(&protocol.Message{ID: 14, Path: "/foo", Filters: map[string]string{"user_id": "other"}}, false))
+	a.Equal(uint64(0), r.Lag())
+
+	// and the lag is the distance of the ids, as the topic can have messages of subtopics in between
+	a.NoError(r.Deliver(&protocol.Message{ID: 20, Path: "/foo"}, false))
+	a.Equal(uint64(7), r.Lag())
+}
+
+func TestRouter_CheckLagDisconnectsSlowConsumers(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router with a slow and a fast route
+	kvs := kvstore.NewMemoryKVStore()
+	router := New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil).(*router)
+	slow := NewRoute(RouteConfig{RouteParams: RouteParams{"user_id": "slow"}, Path: "/foo", ChannelSize: 10})
+	fast := NewRoute(RouteConfig{RouteParams: RouteParams{"user_id": "fast"}, Path: "/foo", ChannelSize: 10})
+	router.subscribe(slow)
+	router.subscribe(fast)
+	for id := uint64(1); id <= 5; id++ {
+		router.handleMessage(&protocol.Message{ID: id, Path: "/foo"})
+		<-fast.MessagesChannel()
+	}
+
+	// when checking the lag without a threshold, then no route is closed
+	router.checkLag()
+	a.Len(router.routes["/foo"], 2)
+	a.Equal(map[string]uint64{"slow": 5, "fast": 0}, router.lagUserIDs)
+
+	// when checking the lag above the threshold, without disconnecting
+	router.SetLagThreshold(3, false)
+	router.checkLag()
+
+	// then the slow route is only marked
+	a.Len(router.routes["/foo"], 2)
+	a.True(slow.lag.slow)
+	a.False(fast.lag.slow)
+
+	// when checking with disconnecting
+	router.SetLagThreshold(3, true)
+	router.checkLag()
+
+	// then the slow route is closed and removed
+	a.Equal([]*Route{fast}, router.routes["/foo"])
+	a.True(slow.isInvalid())
+	a.False(fast.isInvalid())
+	a.Equal(map[string]uint64{"slow": 5, "fast": 0}, router.lagUserIDs)
+
+	// and the metric of its user is removed with the next check
+	router.checkLag()
+	a.Equal(map[string]uint64{"fast": 0}, router.lagUserIDs)
+}
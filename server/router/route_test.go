@@ -144,6 +144,51 @@ func TestRouteDeliver_WithTimeout(t *testing.T) {
 	a.False(r.consuming)
 }
 
+func TestRouteDeliver_Blocking(t *testing.T) {
+	a := assert.New(t)
+
+	// given a blocking route with a full channel
+	r := testRoute()
+	r.Blocking = true
+	for i := 0; i < chanSize; i++ {
+		a.NoError(r.Deliver(dummyMessageWithID, false))
+	}
+
+	// when delivering one more message, then it waits for the channel instead of closing the route
+	done := make(chan error)
+	go func() {
+		done <- r.Deliver(dummyMessageWithID, false)
+	}()
+	select {
+	case <-done:
+		a.Fail("Deliver did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+	a.False(r.isInvalid())
+
+	// and returns, when a message is read
+	<-r.MessagesChannel()
+	select {
+	case err := <-done:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.Fail("Deliver still blocked")
+	}
+
+	// and a blocked Deliver returns, when the route is closed
+	go func() {
+		done <- r.Deliver(dummyMessageWithID, false)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.Fail("Deliver still blocked after closing")
+	}
+	a.Equal(ErrInvalidRoute, r.Deliver(dummyMessageWithID, false))
+}
+
 func TestRoute_CloseTwice(t *testing.T) {
 	a := assert.New(t)
 
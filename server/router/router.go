@@ -5,6 +5,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/distribution/health"
@@ -17,6 +18,7 @@ import (
 	"github.com/smancke/guble/server/auth"
 	"github.com/smancke/guble/server/cluster"
 	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/store"
 )
 
@@ -25,7 +27,14 @@ const (
 	handleChannelCapacity        = 500
 	subscribeChannelCapacity     = 10
 	unsubscribeChannelCapacity   = 10
+	resetChannelCapacity         = 10
 	prefix                       = "/admin/router"
+
+	// lagCheckInterval is the interval for updating the lag of the subscribers
+	lagCheckInterval = time.Second
+
+	// wildcardSuffix marks a route path, which matches all children of its parent path
+	wildcardSuffix = "/*"
 )
 
 // Router interface provides a mechanism for PubSub messaging
@@ -47,7 +56,10 @@ type Router interface {
 // Helper struct to pass `Route` to subscription channel and provide a notification channel.
 type subRequest struct {
 	route *Route
-	doneC chan bool
+	doneC chan error
+
+	// batch removes the routes of many paths instead of the route, see UnsubscribePaths
+	batch *batchUnsubscription
 }
 
 type router struct {
@@ -55,14 +67,36 @@ type router struct {
 	handleC      chan *protocol.Message
 	subscribeC   chan subRequest
 	unsubscribeC chan subRequest
-	stopC        chan bool      // Channel that signals stop of the router
-	stopping     bool           // Flag: the router is in stopping process and no incoming messages are accepted
-	wg           sync.WaitGroup // Add any operation that we need to wait upon here
+	resetC       chan string        // the truncated partitions, whose routes are notified
+	resumeC      chan protocol.Path // the resumed topics, whose held messages are delivered
+	stopC        chan bool          // Channel that signals stop of the router
+	stopping     bool               // Flag: the router is in stopping process and no incoming messages are accepted
+	wg           sync.WaitGroup     // Add any operation that we need to wait upon here
 
 	accessManager auth.AccessManager
 	messageStore  store.MessageStore
 	kvStore       kvstore.KVStore
 	cluster       *cluster.Cluster
+	deduplication *deduplication
+	partitioning  *partitioning
+	scheduling    *scheduling
+	aliasing      *aliasing
+	groups        *consumerGroups
+	taps          *taps
+	pausing       *pausing
+	quotas        *quotas
+	middlewares   []namedMiddleware
+
+	lagThreshold   uint64
+	disconnectSlow bool
+	lagUserIDs     map[string]uint64 // the user ids with a lag metric
+
+	maxSubscribers  int
+	deliveryWorkers int
+	pool            *deliveryPool // the delivery workers, used by the goroutine of the router only
+	replayThrottle  *replayThrottle
+	topicLimit      *topicLimit
+	tracing         bool
 
 	sync.RWMutex
 }
@@ -75,12 +109,21 @@ func New(accessManager auth.AccessManager, messageStore store.MessageStore, kvSt
 		handleC:      make(chan *protocol.Message, handleChannelCapacity),
 		subscribeC:   make(chan subRequest, subscribeChannelCapacity),
 		unsubscribeC: make(chan subRequest, unsubscribeChannelCapacity),
+		resetC:       make(chan string, resetChannelCapacity),
+		resumeC:      make(chan protocol.Path, resumeChannelCapacity),
 		stopC:        make(chan bool, 1),
 
 		accessManager: accessManager,
 		messageStore:  messageStore,
 		kvStore:       kvStore,
 		cluster:       cluster,
+		partitioning:  newPartitioning(kvStore),
+		scheduling:    newScheduling(kvStore),
+		aliasing:      newAliasing(kvStore),
+		groups:        newConsumerGroups(),
+		taps:          newTaps(),
+		pausing:       newPausing(),
+		quotas:        newQuotas(kvStore),
 	}
 }
 
@@ -92,10 +135,22 @@ func (router *router) Start() error {
 	router.wg.Add(1)
 	router.setStopping(false)
 
+	if _, workers := router.getFanOut(); workers > 0 {
+		router.pool = newDeliveryPool(workers)
+	}
+
 	go func() {
+		lagTicker := time.NewTicker(lagCheckInterval)
+		defer lagTicker.Stop()
+
 		for {
 			if router.stopping && router.channelsAreEmpty() {
 				router.closeRoutes()
+				// the closed routes do not block the workers delivering the last messages
+				if router.pool != nil {
+					router.pool.stop()
+					router.pool = nil
+				}
 				router.wg.Done()
 				return
 			}
@@ -108,11 +163,23 @@ func (router *router) Start() error {
 					router.handleMessage(message)
 					runtime.Gosched()
 				case subscriber := <-router.subscribeC:
-					router.subscribe(subscriber.route)
-					subscriber.doneC <- true
+					subscriber.doneC <- router.subscribe(subscriber.route)
 				case unsubscriber := <-router.unsubscribeC:
-					router.unsubscribe(unsubscriber.route)
-					unsubscriber.doneC <- true
+					if unsubscriber.batch != nil {
+						router.unsubscribeBatch(unsubscriber.batch)
+					} else {
+						router.unsubscribe(unsubscriber.route)
+					}
+					unsubscriber.doneC <- nil
+				case route := <-router.pool.invalidRoutes():
+					router.unsubscribe(route)
+				case partition := <-router.resetC:
+					router.resetRoutes(partition)
+				case topic := <-router.resumeC:
+					router.resume(topic)
+				case <-lagTicker.C:
+					router.checkLag()
+					router.evictIdleTopics()
 				case <-router.Done():
 					router.setStopping(true)
 				}
@@ -120,15 +187,27 @@ func (router *router) Start() error {
 		}
 	}()
 
+	// the scheduled messages are released by the started router
+	if err := router.scheduling.load(router.release); err != nil {
+		logger.WithError(err).Error("Loading the scheduled messages failed")
+		return err
+	}
 	return nil
 }
 
-// Stop stops the router by closing the stop channel, and waiting on the WaitGroup
+// Stop stops the router by closing the stop channel, and waiting on the WaitGroup.
+// The scheduled messages are not released anymore, and are delivered after the next start.
 func (router *router) Stop() error {
 	logger.Info("Stopping router")
 
+	router.scheduling.stop()
 	router.stopC <- true
 	router.wg.Wait()
+
+	// the usage of the quotas is persisted, so that it is kept within the window after the restart
+	if router.quotas != nil {
+		router.quotas.flush(time.Now())
+	}
 	return nil
 }
 
@@ -156,30 +235,122 @@ func (router *router) Check() error {
 
 // HandleMessage stores the message in the MessageStore(and gets a new ID for it if the message was created locally)
 // and then passes it to the internal channel, and asynchronously to the cluster (if available).
+// A message with an already seen idempotency key is not stored again, but gets the id of the original message.
+// A message with a deliver-at header in the future is scheduled, and stored and delivered at its time.
+// A message published to an alias path is stored and delivered with the canonical path.
+// A message published to this node gets a trace id, if the tracing is enabled and it has none.
 func (router *router) HandleMessage(message *protocol.Message) error {
+	var nodeID uint8
+	if router.cluster != nil {
+		nodeID = router.cluster.Config.ID
+	}
+
+	// only the messages published to this node are traced, deduplicated and transformed,
+	// the ones received from the cluster already were on the node they were published to
+	local := nodeID == 0 || message.NodeID == 0
+	if local {
+		router.trace(message)
+	}
+
 	logger.WithFields(log.Fields{
-		"userID": message.UserID,
-		"path":   message.Path}).Debug("HandleMessage")
+		"user_id": message.UserID,
+		"path":    message.Path,
+		"traceID": message.TraceID()}).Debug("HandleMessage")
 
 	mTotalMessagesIncoming.Add(1)
+	metrics.PromMessagesReceived.WithLabelValues(metrics.TopicLabel(string(message.Path))).Inc()
 	if err := router.isStopping(); err != nil {
 		logger.WithField("error", err.Error()).Error("Router is stopping")
 		return err
 	}
 
-	if !router.accessManager.IsAllowed(auth.WRITE, message.UserID, message.Path) {
+	message.Path = router.ResolveAlias(message.Path)
+	if !auth.IsAllowed(router.accessManager, auth.WRITE, message.UserID, message.ApplicationID, message.Path) {
 		return &PermissionDeniedError{UserID: message.UserID, AccessType: auth.WRITE, Path: message.Path}
 	}
 
-	var nodeID uint8
-	if router.cluster != nil {
-		nodeID = router.cluster.Config.ID
+	if _, err := message.Priority(); err != nil {
+		return err
+	}
+	deliverAt, err := message.DeliverAt()
+	if err != nil {
+		return err
+	}
+
+	var dedup *deduplication
+	var key string
+	if local {
+		if dedup = router.getDeduplication(); dedup != nil {
+			key = idempotencyKey(message)
+		}
+	}
+	if key == "" {
+		return router.publish(message, deliverAt, nodeID, local)
+	}
+
+	reservation, duplicate := dedup.reserve(message, key)
+	if duplicate {
+		logger.WithFields(log.Fields{
+			"path":       message.Path,
+			"message_id": message.ID,
+			"traceID":    message.TraceID(),
+		}).Debug("Ignoring a duplicate message")
+		mTotalDuplicateMessages.Add(1)
+		return nil
+	}
+	// the key stays reserved while the message is published, so that a concurrent duplicate waits for its id
+	if err := router.publish(message, deliverAt, nodeID, local); err != nil {
+		dedup.release(reservation)
+		return err
+	}
+	dedup.store(reservation, message)
+	return nil
+}
+
+// publish checks the quota of the message and transforms it, if it was published to this node,
+// and then schedules it or stores and delivers it.
+func (router *router) publish(message *protocol.Message, deliverAt time.Time, nodeID uint8, local bool) error {
+	if local && router.quotas != nil {
+		if err := router.quotas.use(nodeID, message.ApplicationID, time.Now()); err != nil {
+			logger.WithFields(log.Fields{
+				"path":          message.Path,
+				"applicationID": message.ApplicationID,
+				"traceID":       message.TraceID(),
+			}).Debug("Message rejected by the quota")
+			return err
+		}
 	}
 
+	if local {
+		if err := router.transform(message); err != nil {
+			logger.WithError(err).WithFields(log.Fields{
+				"path":    message.Path,
+				"traceID": message.TraceID(),
+			}).Error("Message rejected by middleware")
+			return err
+		}
+	}
+
+	// the messages received from the cluster were already scheduled on the node they were published to
+	if local && deliverAt.After(time.Now()) {
+		return router.schedule(message, deliverAt, nodeID)
+	}
+	return router.deliver(message, nodeID)
+}
+
+// deliver stores the message and passes it to the internal channel, and to the cluster
+func (router *router) deliver(message *protocol.Message, nodeID uint8) error {
+	if err := router.useTopic(message.Path); err != nil {
+		return err
+	}
 	mTotalMessagesIncomingBytes.Add(int64(len(message.Bytes())))
 	size, err := router.messageStore.StoreMessage(message, nodeID)
 	if err != nil {
-		logger.WithField("error", err.Error()).Error("Error storing message")
+		logger.WithFields(log.Fields{
+			"error":   err.Error(),
+			"path":    message.Path,
+			"traceID": message.TraceID(),
+		}).Error("Error storing message")
 		mTotalMessageStoreErrors.Add(1)
 		return err
 	}
@@ -189,8 +360,9 @@ func (router *router) HandleMessage(message *protocol.Message) error {
 
 	router.handleC <- message
 
+	// the broadcast sends to the other nodes asynchronously, and is waited for when leaving the cluster
 	if router.cluster != nil && message.NodeID == router.cluster.Config.ID {
-		go router.cluster.BroadcastMessage(message)
+		router.cluster.BroadcastMessage(message)
 	}
 
 	return nil
@@ -206,21 +378,26 @@ func (router *router) Subscribe(r *Route) (*Route, error) {
 		return nil, err
 	}
 
+	// a route of an alias path receives the messages of the canonical path
+	r.Path = router.ResolveAlias(r.Path)
 	userID := r.Get("user_id")
 	routePath := r.Path
 
-	accessAllowed := router.accessManager.IsAllowed(auth.READ, userID, routePath)
+	if !validWildcard(routePath) {
+		return r, ErrInvalidWildcard
+	}
+
+	accessAllowed := auth.IsAllowed(router.accessManager, auth.READ, userID, r.Get("application_id"), routePath)
 	if !accessAllowed {
 		return r, &PermissionDeniedError{UserID: userID, AccessType: auth.READ, Path: routePath}
 	}
 	req := subRequest{
 		route: r,
-		doneC: make(chan bool),
+		doneC: make(chan error),
 	}
 
 	router.subscribeC <- req
-	<-req.doneC
-	return r, nil
+	return r, <-req.doneC
 }
 
 // Subscribe adds a route to the subscribers. If there is already a route with same Application Id and Path, it will be replaced.
@@ -232,31 +409,68 @@ func (router *router) Unsubscribe(r *Route) {
 
 	req := subRequest{
 		route: r,
-		doneC: make(chan bool),
+		doneC: make(chan error),
 	}
 	router.unsubscribeC <- req
 	<-req.doneC
 }
 
+// Subscriber is a route of a topic, as listed by GetSubscribers
+type Subscriber struct {
+	NodeID        uint8             `json:"node_id"`
+	UserID        string            `json:"user_id"`
+	ApplicationID string            `json:"application_id"`
+	Route         RouteParams       `json:"route"`
+	Lag           uint64            `json:"lag,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+
+	// Paused is true, while the delivery of the topic is paused on the node of the subscriber
+	Paused bool `json:"paused,omitempty"`
+}
+
+// GetSubscribers returns the JSON array of the subscribers of the topic, connected to this node
 func (router *router) GetSubscribers(topicPath string) ([]byte, error) {
-	subscribers := make([]RouteParams, 0)
+	var nodeID uint8
+	if router.cluster != nil {
+		nodeID = router.cluster.Config.ID
+	}
+
+	subscribers := make([]Subscriber, 0)
 	routes, present := router.routes[protocol.Path(topicPath)]
 	if present {
+		paused := router.isPaused(protocol.Path(topicPath))
 		for index, currRoute := range routes {
 			logger.WithFields(log.Fields{
 				"index":       index,
 				"routeParams": currRoute.RouteParams,
 			}).Debug("Added route to slice")
-			subscribers = append(subscribers, currRoute.RouteParams)
+			subscribers = append(subscribers, Subscriber{
+				NodeID:        nodeID,
+				UserID:        currRoute.RouteParams["user_id"],
+				ApplicationID: currRoute.RouteParams["application_id"],
+				Route:         currRoute.RouteParams,
+				Lag:           currRoute.Lag(),
+				Metadata:      currRoute.Metadata,
+				Paused:        paused,
+			})
 		}
 	}
 	return json.Marshal(subscribers)
 }
 
-func (router *router) subscribe(r *Route) {
+func (router *router) subscribe(r *Route) error {
 	logger.WithField("route", r).Debug("Internal subscribe")
 	mTotalSubscriptionAttempts.Add(1)
 
+	if router.topicFull(r) {
+		mTotalRejectedSubscriptions.Add(1)
+		return ErrTopicFull
+	}
+	if err := router.useTopic(r.Path); err != nil {
+		return err
+	}
+	router.pool.assign(r)
+
 	routePath := r.Path
 	slice, present := router.routes[routePath]
 	var removed bool
@@ -275,10 +489,13 @@ func (router *router) subscribe(r *Route) {
 	} else {
 		mTotalSubscriptions.Add(1)
 		mCurrentSubscriptions.Add(1)
+		router.subscribedTopic(routePath, 1)
 	}
+	return nil
 }
 
-func (router *router) unsubscribe(r *Route) {
+// unsubscribe removes the route, returning true if it was subscribed
+func (router *router) unsubscribe(r *Route) bool {
 	logger.WithField("route", r).Debug("Internal unsubscribe")
 	mTotalUnsubscriptionAttempts.Add(1)
 
@@ -286,13 +503,14 @@ func (router *router) unsubscribe(r *Route) {
 	slice, present := router.routes[routePath]
 	if !present {
 		mTotalInvalidTopicOnUnsubscriptionAttempts.Add(1)
-		return
+		return false
 	}
 	var removed bool
 	router.routes[routePath], removed = removeIfMatching(slice, r)
 	if removed {
 		mTotalUnsubscriptions.Add(1)
 		mCurrentSubscriptions.Add(-1)
+		router.subscribedTopic(routePath, -1)
 	} else {
 		mTotalInvalidUnsubscriptionAttempts.Add(1)
 	}
@@ -300,6 +518,8 @@ func (router *router) unsubscribe(r *Route) {
 		delete(router.routes, routePath)
 		mCurrentRoutes.Add(-1)
 	}
+	router.removeGroup(r)
+	return removed
 }
 
 func (router *router) panicIfInternalDependenciesAreNil() {
@@ -336,26 +556,53 @@ func (router *router) isStopping() error {
 }
 
 func (router *router) handleMessage(message *protocol.Message) {
+	if router.hold(message) {
+		return
+	}
+
 	flog := logger.WithFields(log.Fields{
 		"topic":    message.Path,
 		"metadata": message.Metadata(),
 		"filters":  message.Filters,
+		"traceID":  message.TraceID(),
 	})
 	flog.Debug("Called routeMessage for data")
 	mTotalMessagesRouted.Add(1)
 
 	matched := false
+	delivered := 0
+	batch := router.pool.batch()
 	for path, pathRoutes := range router.routes {
 		if matchesTopic(message.Path, path) {
 			matched = true
+			// the members of a consumer group share the messages, the other routes receive each of them
+			var groups map[string][]*Route
 			for _, route := range pathRoutes {
-				if err := route.Deliver(message, false); err == ErrInvalidRoute {
-					// Unsubscribe invalid routes
-					router.unsubscribe(route)
+				if group := route.Get(GroupParam); group != "" {
+					if groups == nil {
+						groups = make(map[string][]*Route)
+					}
+					groups[group] = append(groups[group], route)
+					continue
+				}
+				if batch != nil {
+					batch.add(route)
+					delivered++
+					continue
+				}
+				if router.deliverToRoute(message, route) == nil {
+					delivered++
+				}
+			}
+			for group, members := range groups {
+				if router.deliverToGroup(message, path, group, members) {
+					delivered++
 				}
 			}
 		}
 	}
+	batch.dispatch(message)
+	router.tap(message, delivered)
 
 	if !matched {
 		flog.Debug("No route matched.")
@@ -363,6 +610,18 @@ func (router *router) handleMessage(message *protocol.Message) {
 	}
 }
 
+// deliverToRoute delivers the message to the route, unsubscribing it if it is invalid
+func (router *router) deliverToRoute(message *protocol.Message, route *Route) error {
+	err := route.Deliver(message, false)
+	if err == ErrInvalidRoute {
+		// Unsubscribe invalid routes
+		router.unsubscribe(route)
+	} else if err == nil {
+		metrics.PromMessagesDelivered.WithLabelValues(metrics.TopicLabel(string(message.Path))).Inc()
+	}
+	return err
+}
+
 func (router *router) closeRoutes() {
 	logger.Debug("closeRoutes")
 
@@ -385,8 +644,15 @@ func (router *router) handleOverloadedChannel() {
 	}
 }
 
-// matchesTopic checks whether the supplied routePath matches the message topic
+// matchesTopic checks whether the supplied routePath matches the message topic.
+// A routePath ending with the wildcard `/*` matches all children of the parent path, on any depth,
+// but not the parent path itself.
 func matchesTopic(messagePath, routePath protocol.Path) bool {
+	if strings.HasSuffix(string(routePath), wildcardSuffix) {
+		parent := strings.TrimSuffix(string(routePath), "*")
+		return len(messagePath) > len(parent) && strings.HasPrefix(string(messagePath), parent)
+	}
+
 	messagePathLen := len(string(messagePath))
 	routePathLen := len(string(routePath))
 	return strings.HasPrefix(string(messagePath), string(routePath)) &&
@@ -394,6 +660,13 @@ func matchesTopic(messagePath, routePath protocol.Path) bool {
 			(messagePathLen > routePathLen && string(messagePath)[routePathLen] == '/'))
 }
 
+// validWildcard checks that a wildcard is only used as the last segment of the path
+func validWildcard(routePath protocol.Path) bool {
+	i := strings.Index(string(routePath), "*")
+	return i == -1 ||
+		(i == len(routePath)-1 && strings.HasSuffix(string(routePath), wildcardSuffix))
+}
+
 // removeIfMatching removes a route from the supplied list, based on same ApplicationID id and same path (if existing)
 // returns: the (possibly updated) slide, and a boolean value (true if route was removed, false otherwise)
 func removeIfMatching(slice []*Route, route *Route) ([]*Route, bool) {
@@ -415,7 +688,7 @@ func (router *router) Fetch(req *store.FetchRequest) error {
 	if err := router.isStopping(); err != nil {
 		return err
 	}
-	router.messageStore.Fetch(req)
+	router.messageStore.Fetch(router.ThrottleFetch(req))
 	return nil
 }
 
@@ -8,6 +8,7 @@ var (
 	mTotalSubscriptionAttempts                 = metrics.NewInt("router.total_subscription_attempts")
 	mTotalDuplicateSubscriptionsAttempts       = metrics.NewInt("router.total_subscription_attempts_duplicate")
 	mTotalSubscriptions                        = metrics.NewInt("router.total_subscriptions")
+	mTotalRejectedSubscriptions                = metrics.NewInt("router.total_subscriptions_rejected_topic_full")
 	mTotalUnsubscriptionAttempts               = metrics.NewInt("router.total_unsubscription_attempts")
 	mTotalInvalidTopicOnUnsubscriptionAttempts = metrics.NewInt("router.total_unsubscription_attempts_invalid_topic")
 	mTotalInvalidUnsubscriptionAttempts        = metrics.NewInt("router.total_unsubscription_attempts_invalid")
@@ -23,12 +24,21 @@ var (
 	mTotalMessageStoreErrors                   = metrics.NewInt("router.total_errors_message_store")
 	mTotalDeliverMessageErrors                 = metrics.NewInt("router.total_errors_deliver_message")
 	mTotalNotMatchedByFilters                  = metrics.NewInt("router.total_not_matched_by_filters")
+	mTotalDuplicateMessages                    = metrics.NewInt("router.total_messages_duplicate")
+	mTotalDisconnectedSlowConsumers            = metrics.NewInt("router.total_disconnected_slow_consumers")
+	mTotalScheduledMessages                    = metrics.NewInt("router.total_messages_scheduled")
+	mTotalDroppedTappedMessages                = metrics.NewInt("router.total_tapped_messages_dropped")
+	mTotalThrottledReplayMessages              = metrics.NewInt("router.total_replay_messages_throttled")
+	mCurrentTopics                             = metrics.NewInt("router.current_topics")
+	mTotalEvictedTopics                        = metrics.NewInt("router.total_topics_evicted")
+	mTotalRejectedTopics                       = metrics.NewInt("router.total_topics_rejected")
 )
 
 func resetRouterMetrics() {
 	mTotalSubscriptionAttempts.Set(0)
 	mTotalDuplicateSubscriptionsAttempts.Set(0)
 	mTotalSubscriptions.Set(0)
+	mTotalRejectedSubscriptions.Set(0)
 	mTotalUnsubscriptionAttempts.Set(0)
 	mTotalInvalidTopicOnUnsubscriptionAttempts.Set(0)
 	mTotalUnsubscriptions.Set(0)
@@ -44,4 +54,12 @@ func resetRouterMetrics() {
 	mTotalMessagesIncomingBytes.Set(0)
 	mTotalMessagesStoredBytes.Set(0)
 	mTotalNotMatchedByFilters.Set(0)
+	mTotalDuplicateMessages.Set(0)
+	mTotalDisconnectedSlowConsumers.Set(0)
+	mTotalScheduledMessages.Set(0)
+	mTotalDroppedTappedMessages.Set(0)
+	mTotalThrottledReplayMessages.Set(0)
+	mCurrentTopics.Set(0)
+	mTotalEvictedTopics.Set(0)
+	mTotalRejectedTopics.Set(0)
 }
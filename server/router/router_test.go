@@ -1,6 +1,7 @@
 package router
 
 import (
+	"encoding/json"
 	"errors"
 	"testing"
 	"time"
@@ -104,6 +105,12 @@ func TestRouter_SubscribeNotAllowed(t *testing.T) {
 	kvsMock := NewMockKVStore(ctrl)
 
 	am.EXPECT().IsAllowed(auth.READ, "user01", protocol.Path("/blah")).Return(false)
+	noScheduledMessages := make(chan [2]string)
+	close(noScheduledMessages)
+	kvsMock.EXPECT().Iterate(SchedulingSchema, "").Return(noScheduledMessages, nil)
+	noAliases := make(chan [2]string)
+	close(noAliases)
+	kvsMock.EXPECT().Iterate(AliasesSchema, "").Return(noAliases, nil)
 
 	router := New(am, msMock, kvsMock, nil).(*router)
 	router.Start()
@@ -185,6 +192,20 @@ func TestRouter_HandleMessageNotAllowed(t *testing.T) {
 	a.NoError(err)
 }
 
+func TestRouter_HandleMessageWithInvalidPriority(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a router
+	router, r := aRouterRoute(chanSize)
+	router.messageStore = NewMockMessageStore(ctrl)
+
+	// when a message with an unknown priority is published, then it is rejected without storing it
+	err := router.HandleMessage(&protocol.Message{Path: r.Path, HeaderJSON: `{"priority":"urgent"}`, Body: aTestByteMessage})
+	a.Equal(protocol.ErrInvalidPriority, err)
+}
+
 func TestRouter_ReplacingOfRoutesMatchingAppID(t *testing.T) {
 	a := assert.New(t)
 
@@ -290,6 +311,60 @@ func TestRouter_RoutingWithSubTopics(t *testing.T) {
 	a.Equal(0, len(r.MessagesChannel()))
 }
 
+func TestRouter_RoutingWithWildcard(t *testing.T) {
+	a := assert.New(t)
+
+	// Given a Router with a wildcard route
+	router, _, _, _ := aStartedRouter()
+	r, err := router.Subscribe(NewRoute(
+		RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        protocol.Path("/blah/*"),
+			ChannelSize: chanSize,
+		},
+	))
+	a.NoError(err)
+
+	// when i send messages to children on different depths
+	for _, path := range []protocol.Path{"/blah/blub", "/blah/blub/deeper/path"} {
+		router.HandleMessage(&protocol.Message{Path: path, Body: aTestByteMessage})
+
+		// then I receive them with their concrete path
+		select {
+		case m := <-r.MessagesChannel():
+			a.Equal(path, m.Path)
+			a.Equal(aTestByteMessage, m.Body)
+		case <-time.After(time.Millisecond * 5):
+			a.Fail("No message received")
+		}
+	}
+
+	// but, when i send a message to the parent or to a path, which just shares the prefix
+	router.HandleMessage(&protocol.Message{Path: "/blah", Body: aTestByteMessage})
+	router.HandleMessage(&protocol.Message{Path: "/blahblub", Body: aTestByteMessage})
+
+	// then the messages are not delivered
+	time.Sleep(time.Millisecond * 5)
+	a.Equal(0, len(r.MessagesChannel()))
+}
+
+func TestRouter_SubscribeInvalidWildcard(t *testing.T) {
+	a := assert.New(t)
+	router, _, _, _ := aStartedRouter()
+
+	for _, path := range []protocol.Path{"/blah*", "/blah/*/blub", "/*blah"} {
+		_, err := router.Subscribe(NewRoute(
+			RouteConfig{
+				RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+				Path:        path,
+				ChannelSize: chanSize,
+			},
+		))
+		a.Equal(ErrInvalidWildcard, err, string(path))
+	}
+	a.Equal(0, len(router.routes))
+}
+
 func TestMatchesTopic(t *testing.T) {
 	for _, test := range []struct {
 		messagePath protocol.Path
@@ -301,6 +376,12 @@ func TestMatchesTopic(t *testing.T) {
 		{"/foo", "/bar", false},
 		{"/fooxyz", "/foo", false},
 		{"/foo", "/bar/xyz", false},
+		{"/foo/xyz", "/foo/*", true},
+		{"/foo/xyz/abc", "/foo/*", true},
+		{"/foo", "/foo/*", false},
+		{"/foo/", "/foo/*", false},
+		{"/foobar", "/foo/*", false},
+		{"/foobar/xyz", "/foo/*", false},
 	} {
 		if !test.matches == matchesTopic(test.messagePath, test.routePath) {
 			t.Errorf("error: expected %v, but: matchesTopic(%q, %q) = %v",
@@ -309,6 +390,52 @@ func TestMatchesTopic(t *testing.T) {
 	}
 }
 
+func TestRouter_GetSubscribers(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router with a route
+	router, _ := aRouterRoute(chanSize)
+
+	// when getting the subscribers of the topic
+	data, err := router.GetSubscribers("/blah")
+	a.NoError(err)
+
+	// then the route is listed
+	var subscribers []Subscriber
+	a.NoError(json.Unmarshal(data, &subscribers))
+	a.Equal([]Subscriber{{
+		UserID:        "user01",
+		ApplicationID: "appid01",
+		Route:         RouteParams{"application_id": "appid01", "user_id": "user01"},
+	}}, subscribers)
+
+	// and a topic without routes has no subscribers
+	data, err = router.GetSubscribers("/other")
+	a.NoError(err)
+	a.Equal("[]", string(data))
+}
+
+func TestRouter_GetSubscribersWithMetadata(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router with a route of a connection with metadata
+	router, _, _, _ := aStartedRouter()
+	r := NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+		Path:        "/blah",
+		ChannelSize: chanSize,
+		Metadata:    map[string]string{"app_version": "1.2"},
+	})
+	_, err := router.Subscribe(r)
+	a.NoError(err)
+
+	// then the metadata is listed with the subscriber
+	data, err := router.GetSubscribers("/blah")
+	a.NoError(err)
+	a.JSONEq(`[{"node_id":0,"user_id":"user01","application_id":"appid01",
+		"route":{"application_id":"appid01","user_id":"user01"},"metadata":{"app_version":"1.2"}}]`, string(data))
+}
+
 func TestRoute_IsRemovedIfChannelIsFull(t *testing.T) {
 	ctrl, finish := testutil.NewMockCtrl(t)
 	defer finish()
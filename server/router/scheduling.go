@@ -0,0 +1,235 @@
+package router
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+)
+
+// SchedulingSchema is the reserved schema of the KV store, containing the scheduled messages by their partition and id
+// (e.g. `foo/42`), so that they are delivered also after a restart.
+const SchedulingSchema = "scheduling"
+
+// Scheduler is implemented by a router, which holds the messages with a deliver-at header until the scheduled time.
+// A scheduled message gets an id of the partition of its topic when it is published, by which it can be cancelled,
+// and a new id when it is stored and delivered, so that it is ordered after the messages published before.
+type Scheduler interface {
+	// CancelScheduled removes the scheduled message with the id of the partition of the topic,
+	// if the user is allowed to publish to its topic.
+	// It returns ErrScheduledMessageNotFound, if the message is not scheduled on this node (anymore).
+	CancelScheduled(topic protocol.Path, id uint64, userID string) error
+}
+
+// scheduledKey identifies a scheduled message, as the message ids are generated per partition
+type scheduledKey struct {
+	partition string
+	id        uint64
+}
+
+func keyOf(message *protocol.Message) scheduledKey {
+	return scheduledKey{partition: message.Path.Partition(), id: message.ID}
+}
+
+// String returns the key of the message in the SchedulingSchema
+func (k scheduledKey) String() string {
+	return k.partition + "/" + strconv.FormatUint(k.id, 10)
+}
+
+// scheduledMessage is a message held until its time, by a timer releasing it
+type scheduledMessage struct {
+	message *protocol.Message
+	timer   *time.Timer
+}
+
+// scheduling keeps the timers of the scheduled messages, which are persisted in the SchedulingSchema of the KV store
+type scheduling struct {
+	kvStore kvstore.KVStore
+
+	mutex    sync.Mutex
+	messages map[scheduledKey]*scheduledMessage
+}
+
+func newScheduling(kvStore kvstore.KVStore) *scheduling {
+	return &scheduling{
+		kvStore:  kvStore,
+		messages: make(map[scheduledKey]*scheduledMessage),
+	}
+}
+
+// schedule holds the message with an id of the message store, and persists it until it is released at deliverAt.
+func (router *router) schedule(message *protocol.Message, deliverAt time.Time, nodeID uint8) error {
+	id, ts, err := router.messageStore.GenerateNextMsgID(message.Path.Partition(), nodeID)
+	if err != nil {
+		logger.WithError(err).Error("Generation of id for the scheduled message failed")
+		return err
+	}
+	message.ID = id
+	message.Time = ts
+	message.NodeID = nodeID
+
+	if err := router.scheduling.kvStore.Put(SchedulingSchema, keyOf(message).String(), message.Bytes()); err != nil {
+		logger.WithError(err).Error("Error persisting the scheduled message")
+		return err
+	}
+	router.scheduling.add(message, deliverAt, router.release)
+	logger.WithFields(log.Fields{
+		"path":       message.Path,
+		"message_id": id,
+		"deliver_at": deliverAt,
+	}).Debug("Scheduled message")
+	mTotalScheduledMessages.Add(1)
+	return nil
+}
+
+// release stores and delivers a scheduled message at its time, unless it was cancelled in the meantime.
+// If the delivery fails, the message stays in the KV store and is delivered after the next start.
+func (router *router) release(key scheduledKey) {
+	if router.isStopping() != nil {
+		return
+	}
+	message := router.scheduling.remove(key)
+	if message == nil {
+		return
+	}
+	var nodeID uint8
+	if router.cluster != nil {
+		nodeID = router.cluster.Config.ID
+	}
+
+	// the released message gets a new id (and time) from the message store
+	m := *message
+	m.ID, m.Time, m.NodeID = 0, 0, 0
+	if err := router.deliver(&m, nodeID); err != nil {
+		logger.WithError(err).WithField("message_id", key.String()).Error("Error delivering the scheduled message")
+		return
+	}
+	if err := router.scheduling.kvStore.Delete(SchedulingSchema, key.String()); err != nil {
+		logger.WithError(err).WithField("message_id", key.String()).Error("Error deleting the delivered scheduled message")
+	}
+}
+
+// CancelScheduled is an implementation of the Scheduler interface.
+func (router *router) CancelScheduled(topic protocol.Path, id uint64, userID string) error {
+	if err := router.isStopping(); err != nil {
+		return err
+	}
+	key := scheduledKey{partition: router.ResolveAlias(topic).Partition(), id: id}
+	message := router.scheduling.get(key)
+	if message == nil {
+		return ErrScheduledMessageNotFound
+	}
+	if !auth.IsAllowed(router.accessManager, auth.WRITE, userID, "", message.Path) {
+		return &PermissionDeniedError{UserID: userID, AccessType: auth.WRITE, Path: message.Path}
+	}
+	if router.scheduling.remove(key) == nil {
+		return ErrScheduledMessageNotFound
+	}
+	if err := router.scheduling.kvStore.Delete(SchedulingSchema, key.String()); err != nil {
+		logger.WithError(err).WithField("message_id", key.String()).Error("Error deleting the cancelled scheduled message")
+		return err
+	}
+	logger.WithFields(log.Fields{
+		"path":       message.Path,
+		"message_id": id,
+		"user_id":    userID,
+	}).Info("Cancelled scheduled message")
+	return nil
+}
+
+// load schedules the persisted messages; the ones with a time in the past are released immediately.
+// The messages persisted by their id only, before the ids were qualified by the partition, are persisted again by their key.
+func (s *scheduling) load(release func(scheduledKey)) error {
+	entries, err := s.kvStore.Iterate(SchedulingSchema, "")
+	if err != nil {
+		return err
+	}
+	count := 0
+	for entry := range entries {
+		message, err := protocol.ParseMessage([]byte(entry[1]))
+		if err != nil {
+			logger.WithError(err).WithField("message_id", entry[0]).Error("Ignoring the invalid scheduled message")
+			continue
+		}
+		deliverAt, err := message.DeliverAt()
+		if err != nil {
+			logger.WithError(err).WithField("message_id", entry[0]).Error("Ignoring the invalid scheduled message")
+			continue
+		}
+		if key := keyOf(message).String(); entry[0] != key {
+			if err := s.kvStore.Put(SchedulingSchema, key, []byte(entry[1])); err != nil {
+				return err
+			}
+			if err := s.kvStore.Delete(SchedulingSchema, entry[0]); err != nil {
+				return err
+			}
+		}
+		s.add(message, deliverAt, release)
+		count++
+	}
+	if count > 0 {
+		logger.WithField("count", count).Info("Loaded the scheduled messages")
+	}
+	return nil
+}
+
+// add starts the timer releasing the message at deliverAt
+func (s *scheduling) add(message *protocol.Message, deliverAt time.Time, release func(scheduledKey)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := keyOf(message)
+	s.messages[key] = &scheduledMessage{
+		message: message,
+		timer:   time.AfterFunc(deliverAt.Sub(time.Now()), func() { release(key) }),
+	}
+}
+
+// get returns the scheduled message with the key, or nil
+func (s *scheduling) get(key scheduledKey) *protocol.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if scheduled, ok := s.messages[key]; ok {
+		return scheduled.message
+	}
+	return nil
+}
+
+// remove stops the timer of the message and returns it, or nil if it is not scheduled (anymore).
+// The persisted message is not deleted.
+func (s *scheduling) remove(key scheduledKey) *protocol.Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scheduled, ok := s.messages[key]
+	if !ok {
+		return nil
+	}
+	scheduled.timer.Stop()
+	delete(s.messages, key)
+	return scheduled.message
+}
+
+// stop stops the timers of all messages, which stay persisted until the next start
+func (s *scheduling) stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, scheduled := range s.messages {
+		scheduled.timer.Stop()
+		delete(s.messages, key)
+	}
+}
+
+func (s *scheduling) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.messages)
+}
@@ -0,0 +1,213 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func aScheduledMessage(path protocol.Path, deliverAt time.Time) *protocol.Message {
+	return &protocol.Message{
+		Path:       path,
+		HeaderJSON: fmt.Sprintf(`{"Deliver-At":"%s"}`, deliverAt.Format(time.RFC3339Nano)),
+		Body:       aTestByteMessage,
+	}
+}
+
+func assertNoMessage(a *assert.Assertions, c <-chan *protocol.Message, wait time.Duration) {
+	select {
+	case m := <-c:
+		a.Fail("Unexpected message", m.ID)
+	case <-time.After(wait):
+	}
+}
+
+func TestRouter_HandleMessageDeliversAtTheScheduledTime(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router with route
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+
+	// when a message is scheduled
+	m := aScheduledMessage(r.Path, time.Now().Add(100*time.Millisecond))
+	a.NoError(router.HandleMessage(m))
+	scheduledID := m.ID
+	a.NotZero(scheduledID)
+
+	// then it is held until its time
+	assertNoMessage(a, r.MessagesChannel(), 50*time.Millisecond)
+	value, exists, err := router.kvStore.Get(SchedulingSchema, keyOf(m).String())
+	a.NoError(err)
+	a.True(exists)
+	a.Equal(string(m.Bytes()), string(value))
+
+	// and delivered with a new id, when it is released
+	select {
+	case delivered := <-r.MessagesChannel():
+		a.Equal(string(aTestByteMessage), string(delivered.Body))
+		a.True(delivered.ID > scheduledID)
+	case <-time.After(time.Second):
+		a.Fail("The scheduled message was not delivered")
+	}
+	_, exists, err = router.kvStore.Get(SchedulingSchema, keyOf(m).String())
+	a.NoError(err)
+	a.False(exists)
+	a.Equal(0, router.scheduling.len())
+}
+
+func TestRouter_HandleMessageDeliversThePastScheduledTimeImmediately(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+
+	a.NoError(router.HandleMessage(aScheduledMessage(r.Path, time.Now().Add(-time.Hour))))
+	assertChannelContainsMessage(a, r.MessagesChannel(), aTestByteMessage)
+	a.Equal(0, router.scheduling.len())
+}
+
+func TestRouter_HandleMessageRejectsAnInvalidScheduledTime(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+
+	err := router.HandleMessage(&protocol.Message{Path: r.Path, HeaderJSON: `{"Deliver-At":"tomorrow"}`})
+	a.Equal(protocol.ErrInvalidDeliverAt, err)
+}
+
+func TestRouter_CancelScheduled(t *testing.T) {
+	a := assert.New(t)
+
+	// given a scheduled message
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+	m := aScheduledMessage(r.Path, time.Now().Add(50*time.Millisecond))
+	a.NoError(router.HandleMessage(m))
+
+	// when it is cancelled before its time
+	a.NoError(router.CancelScheduled(r.Path, m.ID, "user01"))
+
+	// then it is not delivered, and not persisted anymore
+	assertNoMessage(a, r.MessagesChannel(), 100*time.Millisecond)
+	_, exists, err := router.kvStore.Get(SchedulingSchema, keyOf(m).String())
+	a.NoError(err)
+	a.False(exists)
+
+	// and it can not be cancelled again
+	a.Equal(ErrScheduledMessageNotFound, router.CancelScheduled(r.Path, m.ID, "user01"))
+}
+
+func TestRouter_ScheduledMessagesOfTopicsWithTheSameID(t *testing.T) {
+	a := assert.New(t)
+
+	// given a message scheduled in each of two topics, with the same id of their partitions
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	subscribe := func(path protocol.Path) *Route {
+		r, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        path,
+			ChannelSize: chanSize,
+		}))
+		a.NoError(err)
+		return r
+	}
+	foo, bar := subscribe("/foo"), subscribe("/bar")
+	fooMessage := aScheduledMessage("/foo", time.Now().Add(100*time.Millisecond))
+	barMessage := aScheduledMessage("/bar", time.Now().Add(100*time.Millisecond))
+	a.NoError(router.HandleMessage(fooMessage))
+	a.NoError(router.HandleMessage(barMessage))
+	a.Equal(fooMessage.ID, barMessage.ID)
+	a.Equal(2, router.scheduling.len())
+
+	// when the one of a topic is cancelled
+	a.NoError(router.CancelScheduled("/foo", fooMessage.ID, "user01"))
+
+	// then the other one is still persisted and delivered
+	_, exists, err := router.kvStore.Get(SchedulingSchema, keyOf(barMessage).String())
+	a.NoError(err)
+	a.True(exists)
+	select {
+	case delivered := <-bar.MessagesChannel():
+		a.Equal(string(aTestByteMessage), string(delivered.Body))
+	case <-time.After(time.Second):
+		a.Fail("The scheduled message of the other topic was not delivered")
+	}
+	assertNoMessage(a, foo.MessagesChannel(), 50*time.Millisecond)
+}
+
+func TestRouter_LoadsTheScheduledMessagesPersistedByTheirID(t *testing.T) {
+	a := assert.New(t)
+
+	// given a message persisted by its id only
+	kvs := kvstore.NewMemoryKVStore()
+	m := aScheduledMessage("/blah", time.Now().Add(time.Hour))
+	m.ID = 7
+	a.NoError(kvs.Put(SchedulingSchema, "7", m.Bytes()))
+
+	// when it is loaded, then it is persisted again by its partition and id
+	router := New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil).(*router)
+	a.NoError(router.Start())
+	defer router.Stop()
+	a.Equal(1, router.scheduling.len())
+	_, exists, err := kvs.Get(SchedulingSchema, "7")
+	a.NoError(err)
+	a.False(exists)
+	_, exists, err = kvs.Get(SchedulingSchema, "blah/7")
+	a.NoError(err)
+	a.True(exists)
+}
+
+func TestRouter_CancelScheduledRequiresWritePermission(t *testing.T) {
+	a := assert.New(t)
+
+	router, r := aRouterRoute(chanSize)
+	defer router.Stop()
+	m := aScheduledMessage(r.Path, time.Now().Add(time.Hour))
+	a.NoError(router.HandleMessage(m))
+
+	router.accessManager = auth.NewAllowAllAccessManager(false)
+	_, denied := router.CancelScheduled(r.Path, m.ID, "user01").(*PermissionDeniedError)
+	a.True(denied)
+	a.Equal(1, router.scheduling.len())
+}
+
+func TestRouter_DeliversTheScheduledMessagesAfterARestart(t *testing.T) {
+	a := assert.New(t)
+
+	// given a message scheduled by a router, which is stopped
+	kvs := kvstore.NewMemoryKVStore()
+	ms := dummystore.New(kvs)
+	first := New(auth.NewAllowAllAccessManager(true), ms, kvs, nil).(*router)
+	a.NoError(first.Start())
+	a.NoError(first.HandleMessage(aScheduledMessage("/blah", time.Now().Add(100*time.Millisecond))))
+	a.NoError(first.Stop())
+
+	// when a new router is started on the same stores
+	second := New(auth.NewAllowAllAccessManager(true), ms, kvs, nil).(*router)
+	a.NoError(second.Start())
+	defer second.Stop()
+	r, err := second.Subscribe(NewRoute(RouteConfig{
+		RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+		Path:        protocol.Path("/blah"),
+		ChannelSize: chanSize,
+	}))
+	a.NoError(err)
+
+	// then the message is delivered at its time
+	select {
+	case delivered := <-r.MessagesChannel():
+		a.Equal(string(aTestByteMessage), string(delivered.Body))
+	case <-time.After(time.Second):
+		a.Fail("The scheduled message was not delivered after the restart")
+	}
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"sync"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// Tapper is implemented by a router, whose routed messages can be observed for debugging, without subscribing a route.
+// A tap is neither stored nor listed with the subscribers, and does not affect the delivery to the routes.
+type Tapper interface {
+	// Tap returns the channel receiving the messages routed for the path and its subtopics, matching the filters,
+	// and the func removing the tap. The messages are dropped while the channel is full, so that a slow tap never
+	// delays the routing.
+	Tap(path protocol.Path, filters HeaderFilters, channelSize int) (<-chan *TappedMessage, func())
+}
+
+// TappedMessage is a message passing through the router, with the number of routes it was delivered to.
+// The message is shared with the routes, and must not be modified.
+type TappedMessage struct {
+	Message *protocol.Message
+	Routes  int
+}
+
+type tap struct {
+	path    protocol.Path
+	filters HeaderFilters
+	c       chan *TappedMessage
+}
+
+// taps are the registered taps, added and removed by the requests and read by the goroutine of the router
+type taps struct {
+	taps map[*tap]struct{}
+	sync.RWMutex
+}
+
+func newTaps() *taps {
+	return &taps{taps: make(map[*tap]struct{})}
+}
+
+// Tap is an implementation of the Tapper interface.
+func (router *router) Tap(path protocol.Path, filters HeaderFilters, channelSize int) (<-chan *TappedMessage, func()) {
+	t := &tap{
+		path:    router.ResolveAlias(path),
+		filters: filters,
+		c:       make(chan *TappedMessage, channelSize),
+	}
+	router.taps.Lock()
+	router.taps.taps[t] = struct{}{}
+	router.taps.Unlock()
+
+	return t.c, func() {
+		router.taps.Lock()
+		delete(router.taps.taps, t)
+		router.taps.Unlock()
+	}
+}
+
+// tap passes the routed message to the matching taps, without blocking
+func (router *router) tap(message *protocol.Message, routes int) {
+	router.taps.RLock()
+	defer router.taps.RUnlock()
+
+	for t := range router.taps.taps {
+		if !matchesTopic(message.Path, t.path) || !t.filters.Match(message) {
+			continue
+		}
+		select {
+		case t.c <- &TappedMessage{Message: message, Routes: routes}:
+		default:
+			mTotalDroppedTappedMessages.Add(1)
+		}
+	}
+}
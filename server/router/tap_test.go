@@ -0,0 +1,69 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_Tap(t *testing.T) {
+	a := assert.New(t)
+
+	// given a tap of a topic with a subscribed route
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	route := aGroupRoute(a, router, "app1", "")
+	tapC, remove := router.Tap("/orders", nil, 10)
+
+	// when messages are published
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders/eu", Body: []byte("1")}))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/invoices", Body: []byte("2")}))
+
+	// then the tap receives the message of the topic, with the number of routes it was delivered to
+	select {
+	case tapped := <-tapC:
+		a.Equal("1", string(tapped.Message.Body))
+		a.Equal(1, tapped.Routes)
+	case <-time.After(time.Second):
+		a.Fail("no tapped message")
+	}
+
+	// and the route receives it as well
+	a.Equal([]string{"1"}, receivedBodies(route))
+
+	// and after removing the tap, it does not receive the messages anymore
+	remove()
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders", Body: []byte("3")}))
+	a.Equal([]string{"3"}, receivedBodies(route))
+	a.Len(tapC, 0)
+}
+
+func TestRouter_TapWithFiltersDropsWhenFull(t *testing.T) {
+	a := assert.New(t)
+
+	// given a full tap for the messages with a header field, and a route
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	route := aGroupRoute(a, router, "app1", "")
+	tapC, remove := router.Tap("/orders", HeaderFilters{{Key: "type", Value: "refund"}}, 1)
+	defer remove()
+
+	// when messages are published
+	for _, body := range []string{"1", "2", "3"} {
+		a.NoError(router.HandleMessage(&protocol.Message{
+			Path:       "/orders",
+			HeaderJSON: `{"type":"refund"}`,
+			Body:       []byte(body),
+		}))
+	}
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/orders", Body: []byte("4")}))
+
+	// then the route receives all of them
+	a.Equal([]string{"1", "2", "3", "4"}, receivedBodies(route))
+
+	// and the tap the first matching one, dropping the others
+	a.Len(tapC, 1)
+	a.Equal("1", string((<-tapC).Message.Body))
+}
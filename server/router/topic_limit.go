@@ -0,0 +1,238 @@
+package router
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/metrics"
+	"github.com/smancke/guble/server/store"
+)
+
+// TopicLimiter is implemented by a router, which can limit the number of topics used on the node.
+// A topic is the partition of the paths, i.e. their first segment, which is stored in its own files.
+type TopicLimiter interface {
+	// SetMaxTopics rejects the messages and the subscriptions of a new topic with ErrTooManyTopics,
+	// when maxTopics are used (zero disables the limit).
+	// With a positive idleTimeout, the topics without subscribers and without messages for the timeout are evicted:
+	// their partition is closed by the message store, if it is a store.PartitionCloser, releasing its open files.
+	// A new topic then takes the place of the least recently used idle topic, instead of being rejected.
+	SetMaxTopics(maxTopics int, idleTimeout time.Duration)
+}
+
+// SetMaxTopics sets the maximum number of topics and the timeout of the idle topics.
+// It has to be called before the router is used, as the topics used before are not counted.
+func (router *router) SetMaxTopics(maxTopics int, idleTimeout time.Duration) {
+	router.Lock()
+	defer router.Unlock()
+
+	if maxTopics <= 0 && idleTimeout <= 0 {
+		router.topicLimit = nil
+		return
+	}
+	closer, _ := router.messageStore.(store.PartitionCloser)
+	router.topicLimit = newTopicLimit(maxTopics, idleTimeout, closer)
+}
+
+func (router *router) getTopicLimit() *topicLimit {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.topicLimit
+}
+
+// topicOf returns the topic of a path, or an empty string for a wildcard of all topics, which is not counted
+func topicOf(path protocol.Path) string {
+	topic := path.Partition()
+	if topic == "*" {
+		return ""
+	}
+	return topic
+}
+
+// topicUsage is a topic tracked by the topicLimit
+type topicUsage struct {
+	name        string
+	lastUsed    time.Time
+	subscribers int
+}
+
+// topicLimit tracks the used topics in the order of their last use, for evicting the least recently used ones
+type topicLimit struct {
+	sync.Mutex
+
+	max         int
+	idleTimeout time.Duration
+	closer      store.PartitionCloser
+
+	topics map[string]*list.Element
+	lru    *list.List // the *topicUsage, least recently used first
+}
+
+func newTopicLimit(max int, idleTimeout time.Duration, closer store.PartitionCloser) *topicLimit {
+	return &topicLimit{
+		max:         max,
+		idleTimeout: idleTimeout,
+		closer:      closer,
+		topics:      make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// use marks the topic as used, adding it if it is new.
+// A new topic above the maximum evicts the least recently used idle topic, or is rejected with ErrTooManyTopics.
+func (l *topicLimit) use(topic string, now time.Time) error {
+	evicted, err := l.add(topic, now)
+	if evicted != nil {
+		go l.close([]*topicUsage{evicted})
+	}
+	return err
+}
+
+// add adds the topic or marks it as used, returning the topic evicted for it
+func (l *topicLimit) add(topic string, now time.Time) (*topicUsage, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, exist := l.topics[topic]; exist {
+		e.Value.(*topicUsage).lastUsed = now
+		l.lru.MoveToBack(e)
+		return nil, nil
+	}
+	var evicted *topicUsage
+	if l.max > 0 && len(l.topics) >= l.max {
+		if evicted = l.evictOne(now); evicted == nil {
+			mTotalRejectedTopics.Add(1)
+			return nil, ErrTooManyTopics
+		}
+	}
+	l.topics[topic] = l.lru.PushBack(&topicUsage{name: topic, lastUsed: now})
+	mCurrentTopics.Set(int64(len(l.topics)))
+	metrics.PromTopics.Set(float64(len(l.topics)))
+	return evicted, nil
+}
+
+// subscribed counts a new subscriber of a used topic, or removes one with a negative delta
+func (l *topicLimit) subscribed(topic string, delta int, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, exist := l.topics[topic]; exist {
+		usage := e.Value.(*topicUsage)
+		usage.subscribers += delta
+		usage.lastUsed = now
+		l.lru.MoveToBack(e)
+	}
+}
+
+// idle returns true, if the topic can be evicted
+func (l *topicLimit) idle(usage *topicUsage, now time.Time) bool {
+	return l.idleTimeout > 0 && usage.subscribers <= 0 && now.Sub(usage.lastUsed) >= l.idleTimeout
+}
+
+// evictOne evicts the least recently used idle topic, returning nil if there is none
+func (l *topicLimit) evictOne(now time.Time) *topicUsage {
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		usage := e.Value.(*topicUsage)
+		if now.Sub(usage.lastUsed) < l.idleTimeout {
+			// the following topics were used later
+			return nil
+		}
+		if l.idle(usage, now) {
+			return l.evict(e)
+		}
+	}
+	return nil
+}
+
+// evictIdle evicts all idle topics, returning their number.
+// Their partitions are closed in the background, as closing waits for the running compressions of the store.
+func (l *topicLimit) evictIdle(now time.Time) int {
+	evicted := l.removeIdle(now)
+	if len(evicted) > 0 {
+		go l.close(evicted)
+	}
+	return len(evicted)
+}
+
+// removeIdle removes all idle topics, returning them
+func (l *topicLimit) removeIdle(now time.Time) []*topicUsage {
+	l.Lock()
+	defer l.Unlock()
+
+	var evicted []*topicUsage
+	for e := l.lru.Front(); e != nil; {
+		next := e.Next()
+		usage := e.Value.(*topicUsage)
+		if now.Sub(usage.lastUsed) < l.idleTimeout {
+			break
+		}
+		if l.idle(usage, now) {
+			evicted = append(evicted, l.evict(e))
+		}
+		e = next
+	}
+	return evicted
+}
+
+// evict removes the topic, returning it for closing its partition; the caller has to hold the lock
+func (l *topicLimit) evict(e *list.Element) *topicUsage {
+	usage := l.lru.Remove(e).(*topicUsage)
+	delete(l.topics, usage.name)
+	mCurrentTopics.Set(int64(len(l.topics)))
+	mTotalEvictedTopics.Add(1)
+	metrics.PromTopics.Set(float64(len(l.topics)))
+	metrics.PromEvictedTopics.Inc()
+	return usage
+}
+
+// close closes the partitions of the evicted topics, without holding the lock
+func (l *topicLimit) close(evicted []*topicUsage) {
+	for _, usage := range evicted {
+		if l.closer != nil {
+			if err := l.closer.ClosePartition(usage.name); err != nil {
+				logger.WithError(err).WithField("topic", usage.name).Error("Error closing the partition of an idle topic")
+				continue
+			}
+		}
+		logger.WithFields(log.Fields{
+			"topic":    usage.name,
+			"lastUsed": usage.lastUsed,
+		}).Info("Evicted idle topic")
+	}
+}
+
+// useTopic marks the topic of the path as used, if the topics are limited
+func (router *router) useTopic(path protocol.Path) error {
+	l := router.getTopicLimit()
+	if l == nil {
+		return nil
+	}
+	topic := topicOf(path)
+	if topic == "" {
+		return nil
+	}
+	if err := l.use(topic, time.Now()); err != nil {
+		logger.WithField("topic", topic).Warn("Rejected a new topic above the maximum number of topics")
+		return err
+	}
+	return nil
+}
+
+// subscribedTopic counts the subscribers of the topic of the path, if the topics are limited
+func (router *router) subscribedTopic(path protocol.Path, delta int) {
+	if l := router.getTopicLimit(); l != nil {
+		if topic := topicOf(path); topic != "" {
+			l.subscribed(topic, delta, time.Now())
+		}
+	}
+}
+
+// evictIdleTopics evicts the idle topics, if there is an idle timeout
+func (router *router) evictIdleTopics() {
+	if l := router.getTopicLimit(); l != nil && l.idleTimeout > 0 {
+		l.evictIdle(time.Now())
+	}
+}
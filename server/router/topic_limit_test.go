@@ -0,0 +1,167 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// closingStore records the partitions closed by the topic limit
+type closingStore struct {
+	*dummystore.DummyMessageStore
+	closedC chan string
+}
+
+func (s *closingStore) ClosePartition(partition string) error {
+	s.closedC <- partition
+	return nil
+}
+
+// closed returns the partitions closed in the background, waiting shortly for each expected one
+func (s *closingStore) closed(expected int) []string {
+	var closed []string
+	for i := 0; i < expected; i++ {
+		select {
+		case partition := <-s.closedC:
+			closed = append(closed, partition)
+		case <-time.After(time.Second):
+			return closed
+		}
+	}
+	select {
+	case partition := <-s.closedC:
+		closed = append(closed, partition)
+	case <-time.After(10 * time.Millisecond):
+	}
+	return closed
+}
+
+// aTopicLimitRouter returns a started router with the topic limit
+func aTopicLimitRouter(maxTopics int, idleTimeout time.Duration) (*router, *closingStore) {
+	kvs := kvstore.NewMemoryKVStore()
+	s := &closingStore{DummyMessageStore: dummystore.New(kvs), closedC: make(chan string, 10)}
+	router := New(auth.NewAllowAllAccessManager(true), s, kvs, nil).(*router)
+	router.SetMaxTopics(maxTopics, idleTimeout)
+	router.Start()
+	return router, s
+}
+
+func TestRouter_MaxTopics(t *testing.T) {
+	a := assert.New(t)
+
+	// given a router using the maximum number of topics
+	router, _ := aTopicLimitRouter(2, 0)
+	defer router.Stop()
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo/a", Body: []byte("a")}))
+	_, err := router.Subscribe(aFanOutRoute("/bar", "user01"))
+	a.NoError(err)
+
+	// when a message and a subscription of a new topic are handled, then they are rejected
+	a.Equal(ErrTooManyTopics, router.HandleMessage(&protocol.Message{Path: "/baz", Body: []byte("a")}))
+	_, err = router.Subscribe(aFanOutRoute("/baz", "user01"))
+	a.Equal(ErrTooManyTopics, err)
+	a.NotContains(router.routes, protocol.Path("/baz"))
+
+	// but the paths of the used topics are accepted
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo/b", Body: []byte("b")}))
+	_, err = router.Subscribe(aFanOutRoute("/bar/x", "user02"))
+	a.NoError(err)
+
+	// and a wildcard of all topics is not counted
+	_, err = router.Subscribe(aFanOutRoute("/*", "user03"))
+	a.NoError(err)
+
+	a.Len(router.getTopicLimit().topics, 2)
+}
+
+func TestRouter_MaxTopicsEvictsTheLeastRecentlyUsedIdleTopic(t *testing.T) {
+	a := assert.New(t)
+
+	// given two idle topics, and a subscribed one
+	router, s := aTopicLimitRouter(3, time.Hour)
+	defer router.Stop()
+	l := router.getTopicLimit()
+	now := time.Now()
+	a.NoError(l.use("foo", now.Add(-3*time.Hour)))
+	a.NoError(l.use("qux", now.Add(-2*time.Hour)))
+	_, err := router.Subscribe(aFanOutRoute("/bar", "user01"))
+	a.NoError(err)
+
+	// when new topics are used, then the least recently used idle topics are evicted
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/baz", Body: []byte("a")}))
+	a.Equal([]string{"foo"}, s.closed(1))
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/quux", Body: []byte("a")}))
+	a.Equal([]string{"qux"}, s.closed(1))
+
+	// and a further topic is rejected, as the other topics are not idle
+	a.Equal(ErrTooManyTopics, router.HandleMessage(&protocol.Message{Path: "/corge", Body: []byte("a")}))
+	a.Len(l.topics, 3)
+}
+
+func TestRouter_TopicIdleTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	// given topics used an hour ago, one of them with a subscriber
+	router, s := aTopicLimitRouter(0, time.Minute)
+	defer router.Stop()
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("a")}))
+	_, err := router.Subscribe(aFanOutRoute("/bar", "user01"))
+	a.NoError(err)
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/baz", Body: []byte("a")}))
+
+	l := router.getTopicLimit()
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*topicUsage).lastUsed = time.Now().Add(-time.Hour)
+	}
+	// and one used recently
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/baz", Body: []byte("b")}))
+
+	// when evicting the idle topics, then only the one without subscribers and messages is closed
+	router.evictIdleTopics()
+	a.Equal([]string{"foo"}, s.closed(1))
+
+	// and the evicted topic can be used again
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("b")}))
+	a.Len(l.topics, 3)
+}
+
+// blockingCloser closes the partitions only when released, like a store waiting for a running compression
+type blockingCloser struct {
+	releaseC chan struct{}
+}
+
+func (c *blockingCloser) ClosePartition(partition string) error {
+	<-c.releaseC
+	return nil
+}
+
+func TestTopicLimit_EvictionDoesNotWaitForTheClose(t *testing.T) {
+	a := assert.New(t)
+
+	closer := &blockingCloser{releaseC: make(chan struct{})}
+	defer close(closer.releaseC)
+	l := newTopicLimit(1, time.Minute, closer)
+	now := time.Now()
+	a.NoError(l.use("foo", now.Add(-time.Hour)))
+
+	// when idle topics are evicted while their partitions are still closing, then the topics can still be used
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.NoError(l.use("bar", now))
+		a.NoError(l.use("bar", now))
+		a.NoError(l.use("baz", now.Add(2*time.Minute)))
+		a.Equal(1, l.evictIdle(now.Add(time.Hour)))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		a.Fail("The topic limit waited for the close of the partitions")
+	}
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"github.com/smancke/guble/protocol"
+)
+
+// MessageTracer is implemented by a router, which can generate the trace ids of the published messages.
+// The trace id is kept in the header of the message (see protocol.TraceIDHeader), so it is stored with the message,
+// passed to the other nodes of the cluster and to the connectors, and logged by them with the message.
+type MessageTracer interface {
+	// SetTracing enables the generation of a trace id for each message published to this node without a valid one.
+	// The trace ids set by the clients are logged and propagated also without it.
+	SetTracing(enabled bool)
+}
+
+// SetTracing is an implementation of the MessageTracer interface.
+func (router *router) SetTracing(enabled bool) {
+	router.Lock()
+	defer router.Unlock()
+
+	router.tracing = enabled
+}
+
+func (router *router) getTracing() bool {
+	router.RLock()
+	defer router.RUnlock()
+
+	return router.tracing
+}
+
+// trace sets a new trace id for a message without a valid one, if the tracing is enabled
+func (router *router) trace(message *protocol.Message) {
+	if !router.getTracing() || message.TraceID() != "" {
+		return
+	}
+	if err := message.SetTraceID(protocol.NewTraceID()); err != nil {
+		logger.WithError(err).WithField("path", message.Path).Warn("Could not set the trace id of a message with an invalid header")
+	}
+}
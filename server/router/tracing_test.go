@@ -0,0 +1,49 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/store/dummystore"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_Tracing(t *testing.T) {
+	a := assert.New(t)
+
+	kvs := kvstore.NewMemoryKVStore()
+	router := New(auth.NewAllowAllAccessManager(true), dummystore.New(kvs), kvs, nil).(*router)
+	router.Start()
+	defer router.Stop()
+
+	tapC, untap := router.Tap("/foo", nil, 10)
+	defer untap()
+
+	// without tracing, a message gets no trace id
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("a")}))
+	a.Equal("", nextTappedMessage(a, tapC).TraceID())
+
+	// with tracing, a message gets a new trace id
+	router.SetTracing(true)
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("b")}))
+	traceID := nextTappedMessage(a, tapC).TraceID()
+	a.Len(traceID, 32)
+
+	// and a message with a trace id keeps it
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo", HeaderJSON: `{"Trace-Id":"client-1"}`, Body: []byte("c")}))
+	a.Equal("client-1", nextTappedMessage(a, tapC).TraceID())
+}
+
+func nextTappedMessage(a *assert.Assertions, tapC <-chan *TappedMessage) *protocol.Message {
+	select {
+	case tapped := <-tapC:
+		return tapped.Message
+	case <-time.After(time.Second):
+		a.Fail("no message routed")
+		return &protocol.Message{}
+	}
+}
@@ -0,0 +1,61 @@
+package router
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// Truncater is implemented by a router, which can truncate the partitions of its message store.
+type Truncater interface {
+	// Truncate deletes the stored messages of the partition and resets its message ids,
+	// notifies the routes of its topics, and sends the truncation to the other nodes of the cluster.
+	Truncate(partition string) error
+}
+
+// Truncate is an implementation of the Truncater interface.
+func (router *router) Truncate(partition string) error {
+	if err := router.HandleTruncate(partition); err != nil {
+		return err
+	}
+	if router.cluster != nil {
+		return router.cluster.BroadcastTruncate(partition)
+	}
+	return nil
+}
+
+// HandleTruncate truncates the partition on this node only, e.g. when the truncation was received from the cluster.
+// The routes of the topics in the partition are signaled on their ResetChannel.
+func (router *router) HandleTruncate(partition string) error {
+	if err := router.isStopping(); err != nil {
+		return err
+	}
+	t, ok := router.messageStore.(store.Truncater)
+	if !ok {
+		return ErrTruncateNotSupported
+	}
+	if err := t.Truncate(partition); err != nil {
+		logger.WithError(err).WithField("partition", partition).Error("Error truncating the partition")
+		return err
+	}
+	router.resetC <- partition
+	return nil
+}
+
+// resetRoutes signals the truncation to the routes of the partition, including the wildcard routes of all topics
+func (router *router) resetRoutes(partition string) {
+	count := 0
+	for path, pathRoutes := range router.routes {
+		if path.Partition() != partition && path != wildcardSuffix {
+			continue
+		}
+		for _, route := range pathRoutes {
+			route.reset()
+			count++
+		}
+	}
+	logger.WithFields(log.Fields{
+		"partition": partition,
+		"routes":    count,
+	}).Info("Notified the routes of the truncated partition")
+}
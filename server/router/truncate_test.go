@@ -0,0 +1,63 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_Truncate(t *testing.T) {
+	a := assert.New(t)
+
+	// given the routes of two partitions, and a wildcard route of all topics
+	router, _, ms, _ := aStartedRouter()
+	defer router.Stop()
+	subscribe := func(path protocol.Path) *Route {
+		r, err := router.Subscribe(NewRoute(RouteConfig{
+			RouteParams: RouteParams{"application_id": "appid01", "user_id": "user01"},
+			Path:        path,
+			ChannelSize: chanSize,
+		}))
+		a.NoError(err)
+		return r
+	}
+	foo, fooBar, all, other := subscribe("/foo"), subscribe("/foo/bar"), subscribe("/*"), subscribe("/other")
+
+	a.NoError(router.HandleMessage(&protocol.Message{Path: "/foo/bar", Body: []byte("before")}))
+	maxID, _ := ms.MaxMessageID("foo")
+	a.Equal(uint64(1), maxID)
+
+	// when the partition is truncated
+	a.NoError(router.Truncate("foo"))
+
+	// then its ids are reset, and the routes of its topics are signaled
+	maxID, _ = ms.MaxMessageID("foo")
+	a.Equal(uint64(0), maxID)
+	for _, r := range []*Route{foo, fooBar, all} {
+		select {
+		case <-r.ResetChannel():
+		case <-time.After(time.Second):
+			a.FailNow("The route was not reset", r.Path)
+		}
+	}
+	select {
+	case <-other.ResetChannel():
+		a.Fail("The route of another partition was reset")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRouter_TruncateWithoutSupportingStore(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+	router.messageStore = NewMockMessageStore(ctrl)
+
+	a.Equal(ErrTruncateNotSupported, router.Truncate("foo"))
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+)
+
+// BatchUnsubscriber is implemented by a router, which removes the routes of many paths with a single request,
+// e.g. all subscriptions of a connection when the user logs out.
+type BatchUnsubscriber interface {
+	// UnsubscribePaths removes the routes with the params from the paths, returning the number of removed routes.
+	// Only the routes with exactly these params are removed, so the routes of other subscribers
+	// of the paths (e.g. of the connectors) are kept.
+	UnsubscribePaths(params RouteParams, paths []protocol.Path) int
+}
+
+// batchUnsubscription is a request of UnsubscribePaths, handled by the loop of the router
+type batchUnsubscription struct {
+	params  RouteParams
+	paths   []protocol.Path
+	removed int
+}
+
+// UnsubscribePaths is an implementation of the BatchUnsubscriber interface.
+func (router *router) UnsubscribePaths(params RouteParams, paths []protocol.Path) int {
+	if len(paths) == 0 {
+		return 0
+	}
+	batch := &batchUnsubscription{params: params, paths: paths}
+	req := subRequest{
+		batch: batch,
+		doneC: make(chan error),
+	}
+	router.unsubscribeC <- req
+	<-req.doneC
+
+	logger.WithFields(log.Fields{
+		"params":  params,
+		"paths":   len(paths),
+		"removed": batch.removed,
+	}).Debug("Unsubscribed the routes of the paths")
+	return batch.removed
+}
+
+// unsubscribeBatch removes the routes of the batch; it is called by the loop of the router
+func (router *router) unsubscribeBatch(batch *batchUnsubscription) {
+	for _, path := range batch.paths {
+		if router.unsubscribe(&Route{RouteConfig: RouteConfig{Path: path, RouteParams: batch.params}}) {
+			batch.removed++
+		}
+	}
+}
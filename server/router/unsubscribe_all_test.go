@@ -0,0 +1,43 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter_UnsubscribePathsRemovesOnlyTheRoutesWithTheParams(t *testing.T) {
+	a := assert.New(t)
+
+	router, _, _, _ := aStartedRouter()
+	defer router.Stop()
+
+	subscribe := func(path string, params RouteParams) *Route {
+		route, err := router.Subscribe(NewRoute(RouteConfig{RouteParams: params, Path: protocol.Path(path), ChannelSize: chanSize}))
+		a.NoError(err)
+		return route
+	}
+	connection := RouteParams{"application_id": "appid01", "user_id": "user01"}
+	other := RouteParams{"application_id": "appid02", "user_id": "user01"}
+	device := RouteParams{"device_token": "token01", "user_id": "user01"}
+
+	subscribe("/foo", connection)
+	subscribe("/bar", connection)
+	subscribe("/foo", other)
+	subscribe("/foo", device)
+
+	// when unsubscribing the paths of the connection, including one without route
+	removed := router.UnsubscribePaths(connection, []protocol.Path{"/foo", "/bar", "/baz"})
+
+	// then only its routes are removed, and the routes of the other subscribers are kept
+	a.Equal(2, removed)
+	a.Len(router.routes["/foo"], 2)
+	a.NotContains(router.routes, protocol.Path("/bar"))
+	for _, route := range router.routes["/foo"] {
+		a.False(route.RouteParams.Equal(connection))
+	}
+
+	// and nothing is removed without paths
+	a.Equal(0, router.UnsubscribePaths(connection, nil))
+}
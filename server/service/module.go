@@ -3,6 +3,7 @@ package service
 import (
 	"net/http"
 	"sort"
+	"time"
 )
 
 // Startable interface for modules which provide a start mechanism
@@ -15,6 +16,16 @@ type Stopable interface {
 	Stop() error
 }
 
+// Drainer interface for modules which can finish their pending work before being stopped
+type Drainer interface {
+	Drain(timeout time.Duration) error
+}
+
+// Leaver interface for modules which can leave a cluster gracefully, before being stopped
+type Leaver interface {
+	Leave(timeout time.Duration) error
+}
+
 // Endpoint adds a HTTP handler for the `GetPrefix()` to the webserver
 type Endpoint interface {
 	http.Handler
@@ -17,17 +17,20 @@ import (
 const (
 	defaultHealthFrequency = time.Second * 60
 	defaultHealthThreshold = 1
+	defaultDrainTimeout    = time.Second * 10
 )
 
 // Service is the main struct for controlling a guble server
 type Service struct {
-	webserver       *webserver.WebServer
-	router          router.Router
-	modules         []module
-	healthEndpoint  string
-	healthFrequency time.Duration
-	healthThreshold int
-	metricsEndpoint string
+	webserver          *webserver.WebServer
+	router             router.Router
+	modules            []module
+	healthEndpoint     string
+	healthFrequency    time.Duration
+	healthThreshold    int
+	drainTimeout       time.Duration
+	metricsEndpoint    string
+	prometheusEndpoint string
 }
 
 // New creates a new Service, using the given Router and WebServer.
@@ -39,6 +42,7 @@ func New(router router.Router, webserver *webserver.WebServer) *Service {
 		router:          router,
 		healthFrequency: defaultHealthFrequency,
 		healthThreshold: defaultHealthThreshold,
+		drainTimeout:    defaultDrainTimeout,
 	}
 	cluster := router.Cluster()
 	if cluster != nil {
@@ -80,10 +84,23 @@ func (s *Service) MetricsEndpoint(endpointPrefix string) *Service {
 	return s
 }
 
+// PrometheusEndpoint sets the endpoint used for the metrics in the prometheus format. Parameter for disabling the endpoint is: "". Returns the updated service.
+func (s *Service) PrometheusEndpoint(endpointPrefix string) *Service {
+	s.prometheusEndpoint = endpointPrefix
+	return s
+}
+
+// DrainTimeout sets the maximum duration to wait for each Drainer module, when stopping the service. Returns the updated service.
+func (s *Service) DrainTimeout(timeout time.Duration) *Service {
+	s.drainTimeout = timeout
+	return s
+}
+
 // Start checks the modules for the following interfaces and registers and/or starts:
-//   Startable:
-//   health.Checker:
-//   Endpoint: Register the handler function of the Endpoint in the http service at prefix
+//
+//	Startable:
+//	health.Checker:
+//	Endpoint: Register the handler function of the Endpoint in the http service at prefix
 func (s *Service) Start() error {
 	var multierr *multierror.Error
 	if s.healthEndpoint != "" {
@@ -98,6 +115,16 @@ func (s *Service) Start() error {
 	} else {
 		logger.Info("Metrics endpoint disabled")
 	}
+	if err := metrics.RegisterPrometheus(); err != nil {
+		logger.WithError(err).Error("Error registering the prometheus collectors")
+		multierr = multierror.Append(multierr, err)
+	}
+	if s.prometheusEndpoint != "" {
+		logger.WithField("prometheusEndpoint", s.prometheusEndpoint).Info("Prometheus endpoint")
+		s.webserver.Handle(s.prometheusEndpoint, metrics.PrometheusHandler())
+	} else {
+		logger.Info("Prometheus endpoint disabled")
+	}
 	for order, iface := range s.ModulesSortedByStartOrder() {
 		name := reflect.TypeOf(iface).String()
 		if s, ok := iface.(Startable); ok {
@@ -122,11 +149,18 @@ func (s *Service) Start() error {
 	return multierr.ErrorOrNil()
 }
 
-// Stop stops the registered modules in their given order
+// Stop stops the registered modules in their given order.
+// Modules which are a Drainer are drained before being stopped.
 func (s *Service) Stop() error {
 	var multierr *multierror.Error
 	for order, iface := range s.modulesSortedBy(ascendingStopOrder) {
 		name := reflect.TypeOf(iface).String()
+		if d, ok := iface.(Drainer); ok {
+			logger.WithFields(log.Fields{"name": name, "timeout": s.drainTimeout}).Info("Draining module")
+			if err := d.Drain(s.drainTimeout); err != nil {
+				multierr = multierror.Append(multierr, err)
+			}
+		}
 		if s, ok := iface.(Stopable); ok {
 			logger.WithFields(log.Fields{"name": name, "order": order}).Info("Stopping module")
 			if err := s.Stop(); err != nil {
@@ -139,6 +173,32 @@ func (s *Service) Stop() error {
 	return multierr.ErrorOrNil()
 }
 
+// Leave stops the service gracefully, e.g. when the node is terminated in a cluster:
+// the modules which are a Leaver leave first, so that the other nodes remove this node immediately,
+// then the webserver stops accepting new connections and the service is stopped after draining the modules.
+// Each step waits at most for the given timeout.
+func (s *Service) Leave(timeout time.Duration) error {
+	var multierr *multierror.Error
+	for _, iface := range s.modulesSortedBy(ascendingStopOrder) {
+		if l, ok := iface.(Leaver); ok {
+			name := reflect.TypeOf(iface).String()
+			logger.WithFields(log.Fields{"name": name, "timeout": timeout}).Info("Leaving module")
+			if err := l.Leave(timeout); err != nil {
+				logger.WithError(err).WithField("name", name).Error("Error while leaving module")
+				multierr = multierror.Append(multierr, err)
+			}
+		}
+	}
+	logger.Info("Draining the webserver")
+	if err := s.webserver.Drain(timeout); err != nil {
+		multierr = multierror.Append(multierr, err)
+	}
+	if err := s.DrainTimeout(timeout).Stop(); err != nil {
+		multierr = multierror.Append(multierr, err)
+	}
+	return multierr.ErrorOrNil()
+}
+
 // WebServer returns the service *webserver.WebServer instance
 func (s *Service) WebServer() *webserver.WebServer {
 	return s.webserver
@@ -2,6 +2,7 @@ package service
 
 import (
 	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/store"
 	"github.com/smancke/guble/server/store/dummystore"
 	"github.com/smancke/guble/server/webserver"
@@ -51,6 +52,46 @@ func TestStoppingOfModules(t *testing.T) {
 	assert.NotNil(t, p)
 }
 
+func TestDrainingOfModules(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a service with a module, which has pending work after the drain timeout
+	service, _, _, _ := aMockedServiceWithMockedRouterStandalone()
+	service = service.DrainTimeout(5 * time.Second)
+	drainer := &testDrainer{err: errors.New("2 requests pending")}
+	service.RegisterModules(0, 0, drainer)
+
+	// when stopping the service
+	err := service.Stop()
+
+	// then the module was drained with the configured timeout, before it was stopped
+	a.Equal(5*time.Second, drainer.timeout)
+	a.Equal([]string{"drain", "stop"}, drainer.calls)
+	if a.Error(err) {
+		a.Contains(err.Error(), "2 requests pending")
+	}
+}
+
+func TestLeavingOfModules(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a service with a module, which can leave the cluster
+	service, _, _, _ := aMockedServiceWithMockedRouterStandalone()
+	leaver := &testLeaver{}
+	service.RegisterModules(0, 0, leaver)
+
+	// when the service leaves
+	a.NoError(service.Leave(3 * time.Second))
+
+	// then the module left before it was drained and stopped, with the given timeout
+	a.Equal([]string{"leave", "drain", "stop"}, leaver.calls)
+	a.Equal(3*time.Second, leaver.timeout)
+}
+
 func TestEndpointRegisterAndServing(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -162,6 +203,32 @@ func TestMetricsEnabled(t *testing.T) {
 	a.True(len(body) > 0)
 }
 
+func TestPrometheusEnabled(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	defer testutil.ResetDefaultRegistryHealthCheck()
+	a := assert.New(t)
+
+	// given a service with a prometheus endpoint
+	service, _, _, _ := aMockedServiceWithMockedRouterStandalone()
+	service = service.PrometheusEndpoint("/prometheus_url")
+
+	// when starting the service
+	defer service.Stop()
+	a.NoError(service.Start())
+	time.Sleep(time.Millisecond * 10)
+	metrics.PromWebsocketConnections.Set(3)
+
+	// then the guble collectors are exposed
+	url := fmt.Sprintf("http://%s/prometheus_url", service.WebServer().GetAddr())
+	result, err := http.Get(url)
+	a.NoError(err)
+	a.Equal(http.StatusOK, result.StatusCode)
+	body, err := ioutil.ReadAll(result.Body)
+	a.NoError(err)
+	a.Contains(string(body), "guble_websocket_connections 3")
+}
+
 func aMockedServiceWithMockedRouterStandalone() (*Service, kvstore.KVStore, store.MessageStore, *MockRouter) {
 	kvStore := kvstore.NewMemoryKVStore()
 	messageStore := dummystore.New(kvStore)
@@ -196,3 +263,29 @@ type testStopable struct {
 func (*testStopable) Stop() error {
 	panic(fmt.Errorf("In a panic when I should stop"))
 }
+
+type testDrainer struct {
+	err     error
+	timeout time.Duration
+	calls   []string
+}
+
+func (d *testDrainer) Drain(timeout time.Duration) error {
+	d.timeout = timeout
+	d.calls = append(d.calls, "drain")
+	return d.err
+}
+
+func (d *testDrainer) Stop() error {
+	d.calls = append(d.calls, "stop")
+	return nil
+}
+
+type testLeaver struct {
+	testDrainer
+}
+
+func (l *testLeaver) Leave(timeout time.Duration) error {
+	l.calls = append(l.calls, "leave")
+	return nil
+}
@@ -1,5 +1,5 @@
 // Automatically generated by MockGen. DO NOT EDIT!
-// Source: github.com/smancke/guble/server/sms (interfaces: Sender)
+// Source: github.com/smancke/guble/server/sms (interfaces: Sender,SMSProvider)
 
 package sms
 
@@ -38,3 +38,35 @@ func (_m *MockSender) Send(_param0 *protocol.Message) error {
 func (_mr *_MockSenderRecorder) Send(arg0 interface{}) *gomock.Call {
 	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0)
 }
+
+// Mock of SMSProvider interface
+type MockSMSProvider struct {
+	ctrl     *gomock.Controller
+	recorder *_MockSMSProviderRecorder
+}
+
+// Recorder for MockSMSProvider (not exported)
+type _MockSMSProviderRecorder struct {
+	mock *MockSMSProvider
+}
+
+func NewMockSMSProvider(ctrl *gomock.Controller) *MockSMSProvider {
+	mock := &MockSMSProvider{ctrl: ctrl}
+	mock.recorder = &_MockSMSProviderRecorder{mock}
+	return mock
+}
+
+func (_m *MockSMSProvider) EXPECT() *_MockSMSProviderRecorder {
+	return _m.recorder
+}
+
+func (_m *MockSMSProvider) Send(_param0 string, _param1 string, _param2 string) (ProviderResponse, error) {
+	ret := _m.ctrl.Call(_m, "Send", _param0, _param1, _param2)
+	ret0, _ := ret[0].(ProviderResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+func (_mr *_MockSMSProviderRecorder) Send(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return _mr.mock.ctrl.RecordCall(_mr.mock, "Send", arg0, arg1, arg2)
+}
@@ -3,16 +3,27 @@ package sms
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/smancke/guble/protocol"
 )
 
+func init() {
+	RegisterProvider("nexmo", func(config Config) (SMSProvider, error) {
+		if *config.APIKey == "" || *config.APISecret == "" {
+			return nil, ErrMissingCredentials
+		}
+		sender, err := NewNexmoSender(*config.APIKey, *config.APISecret)
+		if err != nil {
+			return nil, err
+		}
+		return sender, nil
+	})
+}
+
 var (
 	URL                = "https://rest.nexmo.com/sms/json?"
 	MaxIdleConnections = 100
@@ -43,13 +54,6 @@ const (
 	ResponseInvalidMessageClass
 )
 
-var (
-	ErrNoSMSSent                 = errors.New("No sms was sent to Nexmo")
-	ErrIncompleteSMSSent         = errors.New("Nexmo sms was only partial delivered.One or more part returned an error")
-	ErrSMSResponseDecodingFailed = errors.New("Nexmo response decoding failed.")
-	ErrNoRetry                   = errors.New("SMS failed. No retrying.")
-)
-
 var nexmoResponseCodeMap = map[ResponseCode]string{
 	ResponseSuccess:              "Success",
 	ResponseThrottled:            "Throttled",
@@ -130,21 +134,14 @@ func NewNexmoSender(apiKey, apiSecret string) (*NexmoSender, error) {
 	return ns, nil
 }
 
-func (ns *NexmoSender) Send(msg *protocol.Message) error {
-	nexmoSMS := new(NexmoSms)
-	err := json.Unmarshal(msg.Body, nexmoSMS)
-	if err != nil {
-		logger.WithField("error", err.Error()).Error("Could not decode message body to send to nexmo")
-		return err
-	}
-	nexmoSMSResponse, err := ns.sendSms(nexmoSMS)
+// Send is a part of the `SMSProvider` implementation.
+func (ns *NexmoSender) Send(to, from, text string) (ProviderResponse, error) {
+	nexmoSMSResponse, err := ns.sendSms(&NexmoSms{To: to, From: from, Text: text})
 	if err != nil {
 		logger.WithField("error", err.Error()).Error("Could not decode nexmo response message body")
-		return err
+		return nil, err
 	}
-	logger.WithField("response", nexmoSMSResponse).Info("Decoded nexmo response")
-
-	return nexmoSMSResponse.Check()
+	return nexmoSMSResponse, nil
 }
 
 func (ns *NexmoSender) sendSms(sms *NexmoSms) (*NexmoMessageResponse, error) {
@@ -54,7 +54,7 @@ func TestNexmoSender_SendWithError(t *testing.T) {
 		Body:          d,
 	}
 
-	err = sender.Send(&msg)
+	err = NewSender(sender).Send(&msg)
 	a.Error(err)
 	a.Equal(ErrIncompleteSMSSent, err)
 }
@@ -0,0 +1,198 @@
+package sms
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+)
+
+const (
+	// DefaultBatchKey is the header field of the messages containing the recipient, by which the sms are batched
+	DefaultBatchKey = "to"
+
+	// DefaultMaxTextLength is the maximum length of the concatenated text of a batch, if the provider does not limit it:
+	// a multi-part sms of 10 parts, of 153 characters each
+	DefaultMaxTextLength = 1530
+
+	// batchSeparator separates the texts of the messages concatenated in a batch
+	batchSeparator = "\n"
+)
+
+// lengthLimiter is implemented by the senders and providers limiting the length of the text of an sms
+type lengthLimiter interface {
+	MaxTextLength() int
+}
+
+// MaxTextLength returns the maximum text length of the provider, or DefaultMaxTextLength
+func (s *providerSender) MaxTextLength() int {
+	if l, ok := s.provider.(lengthLimiter); ok {
+		return l.MaxTextLength()
+	}
+	return DefaultMaxTextLength
+}
+
+// smsBatch contains the messages to a recipient, received within the batch window, in the order of their ids.
+// A message without the recipient in its header, or with a body which is not an sms, is sent in a batch of its own.
+type smsBatch struct {
+	messages []*protocol.Message
+	sms      []*SMS
+}
+
+// parts returns the messages sent for the batch: the texts of the consecutive sms from the same sender concatenated,
+// as long as they do not exceed the maxLength. A concatenated message has the id of its last message.
+func (b *smsBatch) parts(maxLength int) []*protocol.Message {
+	if b.sms == nil {
+		return b.messages
+	}
+	var (
+		parts []*protocol.Message
+		first int
+		text  string
+	)
+	for i, sms := range b.sms {
+		if i > first {
+			joined := text + batchSeparator + sms.Text
+			if sms.From == b.sms[first].From && sms.To == b.sms[first].To && utf8.RuneCountInString(joined) <= maxLength {
+				text = joined
+				continue
+			}
+			parts = append(parts, b.part(first, i, text))
+		}
+		first, text = i, sms.Text
+	}
+	return append(parts, b.part(first, len(b.sms), text))
+}
+
+// part returns the message concatenating the texts of the messages from first to end (exclusive)
+func (b *smsBatch) part(first, end int, text string) *protocol.Message {
+	if end-first == 1 {
+		return b.messages[first]
+	}
+	last := b.messages[end-1]
+	body, _ := json.Marshal(&SMS{To: b.sms[first].To, From: b.sms[first].From, Text: text})
+	return &protocol.Message{
+		ID:            last.ID,
+		Path:          last.Path,
+		UserID:        last.UserID,
+		ApplicationID: last.ApplicationID,
+		Time:          last.Time,
+		HeaderJSON:    last.HeaderJSON,
+		Body:          body,
+	}
+}
+
+// batchWindow collects the batches of the messages received within a batch window, in the order of their first messages
+type batchWindow struct {
+	key     string
+	batches []*smsBatch
+	byKey   map[string]*smsBatch
+	lastID  uint64
+}
+
+func newBatchWindow(key string) *batchWindow {
+	return &batchWindow{key: key, byKey: make(map[string]*smsBatch)}
+}
+
+func (w *batchWindow) empty() bool {
+	return len(w.batches) == 0
+}
+
+// add appends the message to the batch of its recipient
+func (w *batchWindow) add(msg *protocol.Message) {
+	w.lastID = msg.ID
+	recipient := msg.HeaderValues(w.key)[w.key]
+	sms := new(SMS)
+	if recipient == "" || json.Unmarshal(msg.Body, sms) != nil {
+		w.batches = append(w.batches, &smsBatch{messages: []*protocol.Message{msg}})
+		return
+	}
+	b, ok := w.byKey[recipient]
+	if !ok {
+		b = &smsBatch{}
+		w.byKey[recipient] = b
+		w.batches = append(w.batches, b)
+	}
+	b.messages = append(b.messages, msg)
+	b.sms = append(b.sms, sms)
+}
+
+// batchLoop is the proxyLoop of a gateway with a batch window: the messages to the same recipient received
+// within the window, which starts with the first message after the previous one, are sent together.
+func (g *gateway) batchLoop() (*protocol.Message, error) {
+	defer func() { g.cancelFunc = nil }()
+
+	window := newBatchWindow(g.batchKey())
+	var timeout <-chan time.Time
+	for {
+		select {
+		case msg, opened := <-g.route.MessagesChannel():
+			if !opened {
+				// the messages of the window are fetched again, after the gateway restarted
+				g.logger.WithField("batches", len(window.batches)).Info("Route channel closed, before sending the batches")
+				return nil, connector.ErrRouteChannelClosed
+			}
+			if window.empty() {
+				timeout = time.After(g.batchWindow())
+			}
+			window.add(msg)
+		case <-timeout:
+			timeout = nil
+			if err := g.flush(window); err != nil {
+				return nil, err
+			}
+			window = newBatchWindow(g.batchKey())
+		case <-g.ctx.Done():
+			return nil, nil
+		}
+	}
+}
+
+// flush sends the batches of the window. If one fails, the last sent id is set before its first message,
+// so that the messages not sent are fetched again after the restart (and the batches sent after it, again).
+func (g *gateway) flush(window *batchWindow) error {
+	maxLength := g.maxTextLength()
+	for _, b := range window.batches {
+		parts := b.parts(maxLength)
+		if len(parts) < len(b.messages) {
+			g.logger.WithFields(log.Fields{
+				"messages": len(b.messages),
+				"parts":    len(parts),
+			}).Debug("Sending batched sms")
+		}
+		for _, part := range parts {
+			if err := g.deliver(part); err != nil {
+				if errSet := g.SetLastSentID(b.messages[0].ID - 1); errSet != nil {
+					g.logger.WithField("error", errSet.Error()).Error("Error setting last ID")
+				}
+				return err
+			}
+		}
+	}
+	return g.SetLastSentID(window.lastID)
+}
+
+func (g *gateway) batchWindow() time.Duration {
+	if g.config.BatchWindow == nil {
+		return 0
+	}
+	return *g.config.BatchWindow
+}
+
+func (g *gateway) batchKey() string {
+	if g.config.BatchKey == nil || strings.TrimSpace(*g.config.BatchKey) == "" {
+		return DefaultBatchKey
+	}
+	return *g.config.BatchKey
+}
+
+func (g *gateway) maxTextLength() int {
+	if l, ok := g.sender.(lengthLimiter); ok {
+		return l.MaxTextLength()
+	}
+	return DefaultMaxTextLength
+}
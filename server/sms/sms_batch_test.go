@@ -0,0 +1,180 @@
+package sms
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/store/dummystore"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func smsMessage(id uint64, to, from, text string) *protocol.Message {
+	body, _ := json.Marshal(&SMS{To: to, From: from, Text: text})
+	return &protocol.Message{
+		ID:         id,
+		Path:       "/sms",
+		HeaderJSON: `{"to":"` + to + `"}`,
+		Body:       body,
+	}
+}
+
+func decodeSMS(t *testing.T, msg *protocol.Message) *SMS {
+	sms := new(SMS)
+	assert.NoError(t, json.Unmarshal(msg.Body, sms))
+	return sms
+}
+
+func TestBatchWindow_ConcatenatesTheSmsByRecipient(t *testing.T) {
+	a := assert.New(t)
+
+	window := newBatchWindow(DefaultBatchKey)
+	window.add(smsMessage(1, "+491", "guble", "first"))
+	window.add(smsMessage(2, "+492", "guble", "other"))
+	window.add(smsMessage(3, "+491", "guble", "second"))
+	unbatched := &protocol.Message{ID: 4, Path: "/sms", Body: []byte(`{"to":"+491","text":"no header"}`)}
+	window.add(unbatched)
+	window.add(smsMessage(5, "+491", "other sender", "third"))
+
+	a.Equal(uint64(5), window.lastID)
+	if !a.Len(window.batches, 3) {
+		return
+	}
+
+	// the texts of a recipient are concatenated in order, as long as the sender is the same
+	parts := window.batches[0].parts(DefaultMaxTextLength)
+	if a.Len(parts, 2) {
+		a.Equal(uint64(3), parts[0].ID)
+		a.Equal(&SMS{To: "+491", From: "guble", Text: "first\nsecond"}, decodeSMS(t, parts[0]))
+		a.Equal(uint64(5), parts[1].ID)
+		a.Equal("third", decodeSMS(t, parts[1]).Text)
+	}
+
+	// a single message is sent as it is
+	a.Equal([]*protocol.Message{window.batches[1].messages[0]}, window.batches[1].parts(DefaultMaxTextLength))
+	a.Equal([]*protocol.Message{unbatched}, window.batches[2].parts(DefaultMaxTextLength))
+}
+
+func TestSmsBatch_SplitsAtTheMaxTextLength(t *testing.T) {
+	a := assert.New(t)
+
+	window := newBatchWindow(DefaultBatchKey)
+	for i, text := range []string{"aaaa", "bbbb", "cccc", "dddddddddddd"} {
+		window.add(smsMessage(uint64(i+1), "+491", "guble", text))
+	}
+
+	parts := window.batches[0].parts(10)
+	if a.Len(parts, 3) {
+		a.Equal("aaaa\nbbbb", decodeSMS(t, parts[0]).Text)
+		a.Equal("cccc", decodeSMS(t, parts[1]).Text)
+		// a text exceeding the length on its own is not split
+		a.Equal("dddddddddddd", decodeSMS(t, parts[2]).Text)
+	}
+}
+
+func TestProviderSender_MaxTextLength(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(DefaultMaxTextLength, NewSender(&NexmoSender{}).(lengthLimiter).MaxTextLength())
+	a.Equal(twilioMaxBodyLength, NewSender(&TwilioSender{}).(lengthLimiter).MaxTextLength())
+}
+
+func batchingGateway(t *testing.T, sender Sender) (*gateway, *MockRouter) {
+	kvStore := kvstore.NewMemoryKVStore()
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().KVStore().AnyTimes().Return(kvStore, nil)
+	routerMock.EXPECT().MessageStore().AnyTimes().Return(dummystore.New(kvStore), nil)
+
+	topic := "/sms"
+	worker := 1
+	intervalMetrics := false
+	window := 50 * time.Millisecond
+	key := DefaultBatchKey
+	gw, err := New(routerMock, sender, Config{
+		Workers:         &worker,
+		SMSTopic:        &topic,
+		IntervalMetrics: &intervalMetrics,
+		BatchWindow:     &window,
+		BatchKey:        &key,
+	})
+	assert.NoError(t, err)
+	return gw, routerMock
+}
+
+func Test_SendBatchedSms(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mockSmsSender := NewMockSender(ctrl)
+	gw, routerMock := batchingGateway(t, mockSmsSender)
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) (*router.Route, error) {
+		return r, nil
+	})
+	a.NoError(gw.Start())
+
+	// then the sms to the same recipient are sent in a single request, after the window
+	sent := make(chan *SMS, 2)
+	mockSmsSender.EXPECT().Send(gomock.Any()).Times(2).Do(func(msg *protocol.Message) error {
+		sent <- decodeSMS(t, msg)
+		return nil
+	})
+
+	// when three messages to two recipients are published within the window
+	gw.route.Deliver(smsMessage(1, "+491", "guble", "first"), true)
+	gw.route.Deliver(smsMessage(2, "+491", "guble", "second"), true)
+	gw.route.Deliver(smsMessage(3, "+492", "guble", "other"), true)
+
+	for _, expected := range []*SMS{
+		{To: "+491", From: "guble", Text: "first\nsecond"},
+		{To: "+492", From: "guble", Text: "other"},
+	} {
+		select {
+		case sms := <-sent:
+			a.Equal(expected, sms)
+		case <-time.After(time.Second):
+			a.Fail("no sms sent")
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	a.Equal(uint64(3), gw.LastIDSent)
+
+	a.NoError(gw.Stop())
+}
+
+func Test_FailedBatchIsFetchedAgain(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mockSmsSender := NewMockSender(ctrl)
+	gw, routerMock := batchingGateway(t, mockSmsSender)
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) (*router.Route, error) {
+		return r, nil
+	}).Times(2)
+	routerMock.EXPECT().Done().AnyTimes().Return(make(chan bool))
+	a.NoError(gw.Start())
+
+	// when the batch of the second recipient fails
+	gomock.InOrder(
+		mockSmsSender.EXPECT().Send(gomock.Any()).Return(nil),
+		mockSmsSender.EXPECT().Send(gomock.Any()).Return(ErrNoSMSSent),
+	)
+
+	gw.route.Deliver(smsMessage(3, "+491", "guble", "first"), true)
+	gw.route.Deliver(smsMessage(4, "+492", "guble", "other"), true)
+	gw.route.Deliver(smsMessage(5, "+492", "guble", "another"), true)
+	time.Sleep(100 * time.Millisecond)
+
+	// then the gateway restarts, fetching the messages from the first one of the failed batch
+	a.Equal(uint64(3), gw.LastIDSent)
+	if fr := gw.fetchRequest(); a.NotNil(fr) {
+		a.Equal(uint64(4), fr.StartID)
+	}
+	gw.Cancel()
+}
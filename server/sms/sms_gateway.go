@@ -31,12 +31,18 @@ type Sender interface {
 
 type Config struct {
 	Enabled         *bool
+	Provider        *string
 	APIKey          *string
 	APISecret       *string
 	Workers         *int
 	SMSTopic        *string
 	IntervalMetrics *bool
 
+	// BatchWindow is the time, within which the sms to the same recipient are concatenated (disabled if zero)
+	BatchWindow *time.Duration
+	// BatchKey is the header field containing the recipient of a message, for the batching
+	BatchKey *string
+
 	Name   string
 	Schema string
 }
@@ -128,7 +134,7 @@ func (g *gateway) Run() {
 			"is_incomplete_sms": err == ErrIncompleteSMSSent,
 		}).Error("Error returned by gateway proxy loop")
 
-		if err == ErrIncompleteSMSSent {
+		if err == ErrIncompleteSMSSent && currentMsg != nil {
 			err2 := g.retry(currentMsg)
 			if err2 != nil {
 				g.logger.WithField("error", err2.Error()).Error("Error returned by retry.")
@@ -171,6 +177,9 @@ func isRestartableErr(err error) bool {
 // proxyLoop returns the current processed message alongside the error that
 // occured during sending of the message
 func (g *gateway) proxyLoop() (*protocol.Message, error) {
+	if g.batchWindow() > 0 {
+		return g.batchLoop()
+	}
 	var (
 		opened      bool = true
 		receivedMsg *protocol.Message
@@ -224,14 +233,28 @@ func (g *gateway) retry(msg *protocol.Message) error {
 }
 
 func (g *gateway) send(receivedMsg *protocol.Message) error {
+	if err := g.deliver(receivedMsg); err != nil {
+		return err
+	}
+	g.SetLastSentID(receivedMsg.ID)
+	return nil
+}
+
+// deliver sends the message by the sender, skipping it if the provider rejected it permanently
+func (g *gateway) deliver(receivedMsg *protocol.Message) error {
 	err := g.sender.Send(receivedMsg)
+	if err == ErrNoRetry {
+		// the provider rejected the sms permanently, so it is skipped
+		log.WithField("error", err.Error()).Error("Sending of message failed permanently")
+		mTotalResponseErrors.Add(1)
+		return nil
+	}
 	if err != nil {
 		log.WithField("error", err.Error()).Error("Sending of message failed")
 		mTotalResponseErrors.Add(1)
 		return err
 	}
 	mTotalSentMessages.Add(1)
-	g.SetLastSentID(receivedMsg.ID)
 	return nil
 }
 
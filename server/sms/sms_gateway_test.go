@@ -197,6 +197,59 @@ func Test_Restart(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+func Test_SkipRejectedSms(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mockSmsSender := NewMockSender(ctrl)
+	kvStore := kvstore.NewMemoryKVStore()
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().KVStore().AnyTimes().Return(kvStore, nil)
+	msgStore := dummystore.New(kvStore)
+	routerMock.EXPECT().MessageStore().AnyTimes().Return(msgStore, nil)
+
+	topic := "/sms"
+	worker := 1
+	intervalMetrics := true
+	config := Config{
+		Workers:         &worker,
+		SMSTopic:        &topic,
+		Name:            "test_gateway",
+		Schema:          SMSSchema,
+		IntervalMetrics: &intervalMetrics,
+	}
+
+	// the gateway is not restarted
+	routerMock.EXPECT().Subscribe(gomock.Any()).Times(1).Do(func(r *router.Route) (*router.Route, error) {
+		return r, nil
+	})
+
+	gw, err := New(routerMock, mockSmsSender, config)
+	a.NoError(err)
+
+	err = gw.Start()
+	a.NoError(err)
+
+	rejected := protocol.Message{Path: protocol.Path(topic), ID: uint64(4), Body: []byte(`{"to":"invalid"}`)}
+	sent := protocol.Message{Path: protocol.Path(topic), ID: uint64(5), Body: []byte(`{"to":"toNumber"}`)}
+
+	// when the first sms is rejected permanently
+	mockSmsSender.EXPECT().Send(gomock.Eq(&rejected)).Times(1).Return(ErrNoRetry)
+	mockSmsSender.EXPECT().Send(gomock.Eq(&sent)).Times(1).Return(nil)
+
+	gw.route.Deliver(&rejected, true)
+	gw.route.Deliver(&sent, true)
+	time.Sleep(100 * time.Millisecond)
+
+	// then it is skipped and the next one is sent
+	a.Equal(uint64(5), gw.LastIDSent)
+
+	err = gw.Stop()
+	a.NoError(err)
+}
+
 func TestReadLastID(t *testing.T) {
 	ctrl, finish := testutil.NewMockCtrl(t)
 	defer finish()
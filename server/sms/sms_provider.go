@@ -0,0 +1,109 @@
+package sms
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// DefaultProvider is the name of the SMS provider used, if none is configured
+const DefaultProvider = "nexmo"
+
+var (
+	ErrNoSMSSent                 = errors.New("No sms was sent to the provider")
+	ErrIncompleteSMSSent         = errors.New("Sms was only partial delivered.One or more part returned an error")
+	ErrSMSResponseDecodingFailed = errors.New("Sms provider response decoding failed.")
+	ErrNoRetry                   = errors.New("SMS failed. No retrying.")
+	ErrMissingCredentials        = errors.New("The API key and secret have to be provided for the sms provider.")
+)
+
+// SMSProvider sends a single sms using the API of a specific provider
+type SMSProvider interface {
+	Send(to, from, text string) (ProviderResponse, error)
+}
+
+// ProviderResponse is the decoded response of an SMSProvider.
+// Check returns nil if the sms was delivered, ErrIncompleteSMSSent if it should be retried,
+// ErrNoRetry if it was rejected permanently or another error.
+type ProviderResponse interface {
+	Check() error
+}
+
+// ProviderFactory creates an SMSProvider from the gateway configuration
+type ProviderFactory func(config Config) (SMSProvider, error)
+
+var (
+	providersMutex sync.RWMutex
+	providers      = make(map[string]ProviderFactory)
+)
+
+// RegisterProvider makes an SMSProvider available by name, for the configuration of the gateway.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+
+	providers[name] = factory
+}
+
+// Providers returns the sorted names of all registered providers
+func Providers() []string {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProvider creates the registered SMSProvider with the given name
+func NewProvider(name string, config Config) (SMSProvider, error) {
+	providersMutex.RLock()
+	factory, ok := providers[name]
+	providersMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Unknown sms provider: %q", name)
+	}
+	return factory(config)
+}
+
+// SMS is the json body of a message published to the sms topic
+type SMS struct {
+	To   string `json:"to"`
+	From string `json:"from"`
+	Text string `json:"text"`
+}
+
+type providerSender struct {
+	provider SMSProvider
+}
+
+// NewSender returns a Sender, decoding the sms messages and sending them with the given provider
+func NewSender(provider SMSProvider) Sender {
+	return &providerSender{provider: provider}
+}
+
+func (s *providerSender) Send(msg *protocol.Message) error {
+	sms := new(SMS)
+	err := json.Unmarshal(msg.Body, sms)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Could not decode message body to send as sms")
+		return err
+	}
+
+	response, err := s.provider.Send(sms.To, sms.From, sms.Text)
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("Could not send sms")
+		return err
+	}
+	logger.WithField("response", response).Info("Decoded sms provider response")
+
+	return response.Check()
+}
@@ -0,0 +1,104 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProvider(t *testing.T) {
+	a := assert.New(t)
+	key, secret := "key", "secret"
+	config := Config{APIKey: &key, APISecret: &secret}
+
+	a.Equal([]string{"nexmo", "twilio"}, Providers())
+
+	p, err := NewProvider("nexmo", config)
+	a.NoError(err)
+	a.IsType(&NexmoSender{}, p)
+
+	p, err = NewProvider("twilio", config)
+	a.NoError(err)
+	a.IsType(&TwilioSender{}, p)
+
+	_, err = NewProvider("unknown", config)
+	a.Error(err)
+
+	empty := ""
+	_, err = NewProvider("twilio", Config{APIKey: &empty, APISecret: &empty})
+	a.Equal(ErrMissingCredentials, err)
+}
+
+func TestProviderSender_Send(t *testing.T) {
+	ctrl, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	provider := NewMockSMSProvider(ctrl)
+	sender := NewSender(provider)
+
+	body, err := json.Marshal(&SMS{To: "toNumber", From: "fromNumber", Text: "body"})
+	a.NoError(err)
+	msg := &protocol.Message{Path: protocol.Path(SMSDefaultTopic), Body: body}
+
+	// the response of the provider is checked
+	provider.EXPECT().Send("toNumber", "fromNumber", "body").
+		Return(TwilioMessageResponse{SID: "SM42", Status: "queued"}, nil)
+	a.NoError(sender.Send(msg))
+
+	// a permanent rejection is not retried
+	provider.EXPECT().Send("toNumber", "fromNumber", "body").
+		Return(TwilioMessageResponse{StatusCode: 400, Code: 21211, Message: "Invalid 'To' Phone Number"}, nil)
+	a.Equal(ErrNoRetry, sender.Send(msg))
+
+	// but throttling and server errors are
+	provider.EXPECT().Send("toNumber", "fromNumber", "body").
+		Return(TwilioMessageResponse{StatusCode: 429, Code: 20429, Message: "Too Many Requests"}, nil)
+	a.Equal(ErrIncompleteSMSSent, sender.Send(msg))
+
+	provider.EXPECT().Send("toNumber", "fromNumber", "body").
+		Return(TwilioMessageResponse{StatusCode: 503, Code: 20503, Message: "Service Unavailable"}, nil)
+	a.Equal(ErrIncompleteSMSSent, sender.Send(msg))
+
+	// and errors of the provider are returned
+	provider.EXPECT().Send("toNumber", "fromNumber", "body").Return(nil, ErrNoSMSSent)
+	a.Equal(ErrNoSMSSent, sender.Send(msg))
+
+	// a message body, which is not a sms is not sent
+	a.Error(sender.Send(&protocol.Message{Path: protocol.Path(SMSDefaultTopic), Body: []byte("no json")}))
+}
+
+func TestTwilioSender_Send(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		a.Equal("AC42", user)
+		a.Equal("token", password)
+		a.Equal("/Accounts/AC42/Messages.json", r.URL.Path)
+		a.Equal("+40746278186", r.FormValue("To"))
+		a.Equal("REWE", r.FormValue("From"))
+		a.Equal("Hello", r.FormValue("Body"))
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"sid": "SM42", "to": "+40746278186", "status": "queued", "error_code": null}`)
+	}))
+	defer server.Close()
+
+	defer func(u string) { TwilioURL = u }(TwilioURL)
+	TwilioURL = server.URL + "/Accounts/%s/Messages.json"
+
+	sender, err := NewTwilioSender("AC42", "token")
+	a.NoError(err)
+
+	response, err := sender.Send("+40746278186", "REWE", "Hello")
+	a.NoError(err)
+	a.Equal("SM42", response.(*TwilioMessageResponse).SID)
+	a.NoError(response.Check())
+}
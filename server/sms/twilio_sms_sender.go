@@ -0,0 +1,152 @@
+package sms
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterProvider("twilio", func(config Config) (SMSProvider, error) {
+		if *config.APIKey == "" || *config.APISecret == "" {
+			return nil, ErrMissingCredentials
+		}
+		sender, err := NewTwilioSender(*config.APIKey, *config.APISecret)
+		if err != nil {
+			return nil, err
+		}
+		return sender, nil
+	})
+}
+
+// TwilioURL is the endpoint of the Twilio messages API, formatted with the account SID
+var TwilioURL = "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json"
+
+// twilioCodeTooManyRequests is the Twilio error code for a throttled request
+const twilioCodeTooManyRequests = 20429
+
+// twilioMaxBodyLength is the maximum number of characters of the body of a message, which Twilio sends in segments
+const twilioMaxBodyLength = 1600
+
+// TwilioMessageResponse is the response of the Twilio messages API.
+// On success the message fields are set, on a rejected request the Code and Message.
+type TwilioMessageResponse struct {
+	StatusCode int `json:"-"`
+
+	SID          string `json:"sid"`
+	To           string `json:"to"`
+	Status       string `json:"status"`
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+	MoreInfo string `json:"more_info"`
+}
+
+// Check is a part of the `ProviderResponse` implementation.
+// Throttled requests and server errors are retried, all other rejections are permanent.
+func (tr TwilioMessageResponse) Check() error {
+	fields := log.Fields{
+		"statusCode": tr.StatusCode,
+		"status":     tr.Status,
+		"code":       tr.Code,
+		"message":    tr.Message,
+		"error":      tr.ErrorMessage,
+	}
+	if tr.StatusCode == http.StatusTooManyRequests || tr.Code == twilioCodeTooManyRequests || tr.StatusCode >= 500 {
+		logger.WithFields(fields).Error("Temporary error received from Twilio")
+		return ErrIncompleteSMSSent
+	}
+	if tr.StatusCode >= 400 || tr.Code != 0 || tr.ErrorCode != 0 || tr.Status == "failed" || tr.Status == "undelivered" {
+		logger.WithFields(fields).Error("Sms rejected by Twilio")
+		return ErrNoRetry
+	}
+	if tr.SID == "" {
+		return ErrNoSMSSent
+	}
+	return nil
+}
+
+// TwilioSender is the SMSProvider for the Twilio messages API
+type TwilioSender struct {
+	logger     *log.Entry
+	AccountSID string
+	AuthToken  string
+
+	httpClient *http.Client
+}
+
+// NewTwilioSender creates a TwilioSender authenticating with the account SID and auth token
+func NewTwilioSender(accountSID, authToken string) (*TwilioSender, error) {
+	ts := &TwilioSender{
+		logger:     logger.WithField("name", "twilioSender"),
+		AccountSID: accountSID,
+		AuthToken:  authToken,
+	}
+	ts.createHttpClient()
+	return ts, nil
+}
+
+// Send is a part of the `SMSProvider` implementation.
+func (ts *TwilioSender) Send(to, from, text string) (ProviderResponse, error) {
+	ts.logger.WithFields(log.Fields{"to": to, "from": from}).Info("sendSms")
+
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", from)
+	form.Set("Body", text)
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf(TwilioURL, ts.AccountSID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(ts.AccountSID, ts.AuthToken)
+
+	resp, err := ts.httpClient.Do(req)
+	if err != nil {
+		ts.logger.WithField("error", err.Error()).Error("Error doing the request to twilio endpoint")
+		ts.createHttpClient()
+		mTotalSendErrors.Add(1)
+		return nil, ErrNoSMSSent
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ts.logger.WithField("error", err.Error()).Error("Error reading the twilio body response")
+		mTotalResponseInternalErrors.Add(1)
+		return nil, ErrSMSResponseDecodingFailed
+	}
+
+	messageResponse := &TwilioMessageResponse{StatusCode: resp.StatusCode}
+	if err := json.Unmarshal(respBody, messageResponse); err != nil {
+		ts.logger.WithField("error", err.Error()).Error("Error decoding the response from twilio endpoint")
+		mTotalResponseInternalErrors.Add(1)
+		return nil, ErrSMSResponseDecodingFailed
+	}
+	ts.logger.WithField("messageResponse", messageResponse).Info("Actual twilio response")
+
+	return messageResponse, nil
+}
+
+// MaxTextLength returns the maximum length of the body of a message accepted by Twilio
+func (ts *TwilioSender) MaxTextLength() int {
+	return twilioMaxBodyLength
+}
+
+func (ts *TwilioSender) createHttpClient() {
+	ts.logger.Info("Recreating HTTP client for twilio sender")
+	ts.httpClient = &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: MaxIdleConnections,
+		},
+		Timeout: RequestTimeout,
+	}
+}
@@ -152,6 +152,15 @@ func (dms *DummyMessageStore) maxMessageID(partition string) (uint64, error) {
 	return sequenceValue, nil
 }
 
+// Truncate resets the message id of the partition, so the next message gets the id 1.
+// It is a part of the `store.Truncater` implementation.
+func (dms *DummyMessageStore) Truncate(partition string) error {
+	dms.topicSequencesLock.Lock()
+	defer dms.topicSequencesLock.Unlock()
+	dms.setID(partition, 0)
+	return nil
+}
+
 // the id to a new value
 func (dms *DummyMessageStore) setID(partition string, id uint64) {
 	dms.topicSequences[partition] = id
@@ -29,6 +29,18 @@ func Test_DummyMessageStore_ErrorOnWrongMessageId(t *testing.T) {
 	a.Error(store.Store("partition", 42, []byte{}))
 }
 
+func Test_DummyMessageStore_Truncate(t *testing.T) {
+	a := assert.New(t)
+
+	dms := New(kvstore.NewMemoryKVStore())
+	a.NoError(dms.Store("partition", 1, []byte{}))
+	a.NoError(dms.Store("partition", 2, []byte{}))
+
+	a.NoError(dms.Truncate("partition"))
+	a.Equal(uint64(0), fne(dms.MaxMessageID("partition")))
+	a.NoError(dms.Store("partition", 1, []byte{}))
+}
+
 func Test_DummyMessageStore_InitIdsFromKvStore(t *testing.T) {
 	a := assert.New(t)
 
@@ -0,0 +1,207 @@
+package filestore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var errBatcherStopped = errors.New("The batching of the partition is stopped")
+
+// batchedMessage is a message waiting in a batch, until the batch is flushed
+type batchedMessage struct {
+	message *protocol.Message
+	nodeID  uint8
+	size    int
+	doneC   chan error
+}
+
+// batcher groups the messages stored in a partition, for writing all messages of a batch
+// with a single sync of the files. A batch is flushed when it contains size messages,
+// or when its first message waited for the linger duration.
+type batcher struct {
+	partition *messagePartition
+	size      int
+	linger    time.Duration
+
+	messageC chan *batchedMessage
+	stopC    chan struct{}
+	stopOnce sync.Once
+	// exitC is closed when the loop is done
+	exitC chan struct{}
+}
+
+func newBatcher(p *messagePartition, size int, linger time.Duration) *batcher {
+	return &batcher{
+		partition: p,
+		size:      size,
+		linger:    linger,
+		messageC:  make(chan *batchedMessage, size),
+		stopC:     make(chan struct{}),
+		exitC:     make(chan struct{}),
+	}
+}
+
+func (b *batcher) start() {
+	go b.loop()
+}
+
+// stop flushes the waiting messages and stops the batching.
+func (b *batcher) stop() {
+	b.stopOnce.Do(func() {
+		close(b.stopC)
+	})
+	<-b.exitC
+}
+
+// store appends the message to the current batch and blocks until the batch is flushed.
+// It returns the size of the stored message.
+func (b *batcher) store(message *protocol.Message, nodeID uint8) (int, error) {
+	bm := &batchedMessage{
+		message: message,
+		nodeID:  nodeID,
+		doneC:   make(chan error, 1),
+	}
+	select {
+	case b.messageC <- bm:
+	case <-b.stopC:
+		return 0, errBatcherStopped
+	}
+
+	select {
+	case err := <-bm.doneC:
+		return bm.size, err
+	case <-b.exitC:
+		// the message may have been flushed by the last batch
+		select {
+		case err := <-bm.doneC:
+			return bm.size, err
+		default:
+			return 0, errBatcherStopped
+		}
+	}
+}
+
+func (b *batcher) loop() {
+	defer close(b.exitC)
+
+	batch := make([]*batchedMessage, 0, b.size)
+	for {
+		select {
+		case bm := <-b.messageC:
+			batch = append(batch, bm)
+		case <-b.stopC:
+			b.flush(b.drain(batch))
+			return
+		}
+
+		linger := time.NewTimer(b.linger)
+	collect:
+		for len(batch) < b.size {
+			select {
+			case bm := <-b.messageC:
+				batch = append(batch, bm)
+			case <-linger.C:
+				break collect
+			case <-b.stopC:
+				linger.Stop()
+				b.flush(b.drain(batch))
+				return
+			}
+		}
+		linger.Stop()
+
+		b.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain appends all waiting messages to the batch
+func (b *batcher) drain(batch []*batchedMessage) []*batchedMessage {
+	for {
+		select {
+		case bm := <-b.messageC:
+			batch = append(batch, bm)
+		default:
+			return batch
+		}
+	}
+}
+
+// flush writes the messages of the batch, syncs the files once and signals the waiting publishers.
+// The ids of the locally received messages are generated in the order of the batch.
+func (b *batcher) flush(batch []*batchedMessage) {
+	if len(batch) == 0 {
+		return
+	}
+	p := b.partition
+	p.Lock()
+
+	start := time.Now()
+	errs := make([]error, len(batch))
+	for i, bm := range batch {
+		errs[i] = p.storeBatched(bm)
+	}
+	if err := p.sync(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error syncing a batch of messages")
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	if err := p.evict(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error evicting messages")
+	}
+	observeLatency("write_batch", start)
+	p.Unlock()
+
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"messages":  len(batch),
+	}).Debug("Flushed batch")
+
+	for i, bm := range batch {
+		bm.doneC <- errs[i]
+	}
+}
+
+// storeBatched writes a message of a batch; the caller has to hold the lock
+func (p *messagePartition) storeBatched(bm *batchedMessage) error {
+	message := bm.message
+
+	// as in StoreMessage, the ids are only generated for the messages received by this node
+	if bm.nodeID == 0 || message.NodeID == 0 {
+		id, ts, err := p.nextMsgID(bm.nodeID)
+		if err != nil {
+			return err
+		}
+		message.ID = id
+		message.Time = ts
+		message.NodeID = bm.nodeID
+	}
+
+	data := message.Bytes()
+	if err := p.store(message.ID, data); err != nil {
+		return err
+	}
+	bm.size = len(data)
+	return nil
+}
+
+// sync commits the append files to the disk; the caller has to hold the lock
+func (p *messagePartition) sync() error {
+	if p.appendFile != nil {
+		if err := p.appendFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if p.indexFile != nil {
+		return p.indexFile.Sync()
+	}
+	return nil
+}
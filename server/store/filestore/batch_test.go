@@ -0,0 +1,124 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_BatchesTheWrites(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_batch_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetBatching(10, 20*time.Millisecond)
+
+	// when messages are published concurrently
+	var wg sync.WaitGroup
+	ids := make(chan uint64, 25)
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := &protocol.Message{Path: "/foo/bar", Body: []byte("Hello")}
+			size, err := mStore.StoreMessage(m, 0)
+			a.NoError(err)
+			a.Equal(len(m.Bytes()), size)
+			ids <- m.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	// then each message got its own id and is stored
+	unique := make(map[uint64]bool)
+	for id := range ids {
+		unique[id] = true
+	}
+	a.Len(unique, 25)
+	fetched := fetchIDs(a, mStore, 0, 100)
+	a.Len(fetched, 25)
+	for id := range unique {
+		a.Contains(fetched, id)
+	}
+
+	p, _ := mStore.Partition("foo")
+	a.Equal(uint64(25), p.Count())
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_StopFlushesTheBatch(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_batch_test")
+	defer os.RemoveAll(dir)
+
+	// given a batch waiting to be filled
+	mStore := New(dir)
+	mStore.SetBatching(100, time.Hour)
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	b := p.(*messagePartition).batcher
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mStore.StoreMessage(&protocol.Message{Path: "/foo", Body: []byte("Hello")}, 0)
+			a.NoError(err)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	a.Equal(uint64(0), p.MaxMessageID())
+
+	// when the store is stopped, then the waiting messages are written and acknowledged
+	a.NoError(mStore.Stop())
+	wg.Wait()
+
+	// and a publish after stopping is rejected
+	_, err = b.store(&protocol.Message{Path: "/foo", Body: []byte("Hello")}, 0)
+	a.Equal(errBatcherStopped, err)
+
+	reopened := New(dir)
+	p, err = reopened.Partition("foo")
+	a.NoError(err)
+	a.Equal(uint64(3), p.Count())
+	a.NoError(reopened.Stop())
+}
+
+func Benchmark_StoreMessage_FsyncPerMessage(b *testing.B) {
+	benchmarkBatchedStoreMessage(b, 1)
+}
+
+func Benchmark_StoreMessage_Batched(b *testing.B) {
+	benchmarkBatchedStoreMessage(b, 64)
+}
+
+// benchmarkBatchedStoreMessage measures the throughput of concurrent publishers,
+// with the given number of messages written per fsync
+func benchmarkBatchedStoreMessage(b *testing.B, batchSize int) {
+	a := assert.New(b)
+	dir, _ := ioutil.TempDir("", "guble_batch_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetBatching(batchSize, time.Millisecond)
+
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := mStore.StoreMessage(&protocol.Message{Path: "/foo", Body: []byte("Hello World")}, 0)
+			a.NoError(err)
+		}
+	})
+	b.StopTimer()
+	a.NoError(mStore.Stop())
+}
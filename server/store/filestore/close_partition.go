@@ -0,0 +1,46 @@
+package filestore
+
+// ClosePartition flushes the waiting messages of an open partition, closes its files and removes it
+// from the open partitions, so it is opened again from its files by the next use.
+// Closing a partition which is not open does nothing. The partition is closed without holding the lock
+// of the store, after the running compression and compaction finished; a use of the partition meanwhile
+// waits for the close, before opening it again.
+// It is a part of the `store.PartitionCloser` implementation.
+func (fms *FileMessageStore) ClosePartition(partition string) error {
+	fms.mutex.Lock()
+	p, exist := fms.partitions[partition]
+	if !exist {
+		fms.mutex.Unlock()
+		return nil
+	}
+	delete(fms.partitions, partition)
+	closed := make(chan struct{})
+	fms.closing[partition] = closed
+	fms.mutex.Unlock()
+
+	defer func() {
+		fms.mutex.Lock()
+		delete(fms.closing, partition)
+		fms.mutex.Unlock()
+		close(closed)
+	}()
+	return p.closeFiles()
+}
+
+// closeFiles flushes the waiting messages and closes the files, waiting for the running compression
+// before the compaction, since the compression holds the compaction lock for reading
+func (p *messagePartition) closeFiles() error {
+	if p.batcher != nil {
+		p.batcher.stop()
+	}
+	p.compressionWG.Wait()
+
+	// a running compaction keeps its files open, until it finished
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.closeAppendFiles()
+}
@@ -0,0 +1,86 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_ClosePartition(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_close_partition_test")
+	defer os.RemoveAll(dir)
+
+	// given an open partition with messages
+	mStore := New(dir)
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 3; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageWithDevice(id, now, "")))
+	}
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	a.NotNil(p.(*messagePartition).appendFile)
+
+	// when it is closed, then its files are closed and it is not open anymore
+	a.NoError(mStore.ClosePartition("foo"))
+	a.Nil(p.(*messagePartition).appendFile)
+	a.Nil(p.(*messagePartition).indexFile)
+	a.NotContains(mStore.partitions, "foo")
+
+	// and closing it again does nothing
+	a.NoError(mStore.ClosePartition("foo"))
+
+	// and it is opened again with its messages by the next use
+	a.Equal([]uint64{1, 2, 3}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Store("foo", 4, aMessageWithDevice(4, now, "")))
+	a.Equal([]uint64{1, 2, 3, 4}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_ClosePartitionWaitsForTheRunningCompression(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_close_partition_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	a.NoError(mStore.Store("foo", 1, aMessageWithDevice(1, time.Now().Unix(), "")))
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	mp := p.(*messagePartition)
+
+	// given a compression in flight, which did not take the compaction lock yet
+	mp.compressionWG.Add(1)
+	startCompression := make(chan struct{})
+	go func() {
+		defer mp.compressionWG.Done()
+		<-startCompression
+		mp.compactionMutex.RLock()
+		defer mp.compactionMutex.RUnlock()
+	}()
+
+	// when the partition is closed meanwhile
+	closed := make(chan error)
+	go func() {
+		closed <- mStore.ClosePartition("foo")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(startCompression)
+
+	// then the close waits for the compression, without blocking it
+	select {
+	case err := <-closed:
+		a.NoError(err)
+	case <-time.After(time.Second):
+		a.FailNow("The partition was not closed while a compression was running")
+	}
+	a.Nil(mp.appendFile)
+
+	// and a use of the partition meanwhile opens it again
+	a.Equal([]uint64{1}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Stop())
+}
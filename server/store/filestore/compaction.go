@@ -0,0 +1,400 @@
+package filestore
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultCompactionInterval is the time between two compaction passes of the FileMessageStore
+const defaultCompactionInterval = 10 * time.Minute
+
+// SetTTL sets the time to live for the messages of a topic and its subtopics.
+// A message expires by the TTL of its most specific topic, e.g. a TTL of `/sms/otp` applies to `/sms/otp/42`
+// instead of the TTL of `/sms`. Expired messages are skipped when fetching and removed from disk by the periodic compaction.
+// A ttl of zero disables the expiration of the topic.
+func (fms *FileMessageStore) SetTTL(topic string, ttl time.Duration) {
+	partitionName := partitionOfTopic(topic)
+
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	ttls := fms.ttls[partitionName].with(topicOfTTL(topic), ttl)
+	if len(ttls) > 0 {
+		fms.ttls[partitionName] = ttls
+	} else {
+		delete(fms.ttls, partitionName)
+	}
+	if p, exist := fms.partitions[partitionName]; exist {
+		p.setTTLs(ttls)
+	}
+}
+
+// Start locks the base directory, migrates the store to the StoreVersion (or returns a StoreVersionError
+// for a newer one) and starts the periodic compaction of expired messages.
+// Implements the service.startable interface.
+func (fms *FileMessageStore) Start() error {
+	if err := fms.lock(); err != nil {
+		return err
+	}
+	if err := migrate(fms.basedir); err != nil {
+		fms.mutex.Lock()
+		fms.unlock()
+		fms.mutex.Unlock()
+		return err
+	}
+	fms.openIndexedPartitions()
+
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	if fms.stopC != nil {
+		return nil
+	}
+	fms.stopC = make(chan bool)
+	fms.compactionWG.Add(1)
+	go fms.compactionLoop(fms.stopC)
+	return nil
+}
+
+func (fms *FileMessageStore) compactionLoop(stopC chan bool) {
+	defer fms.compactionWG.Done()
+	ticker := time.NewTicker(fms.compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fms.compact()
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// compact removes the expired, evicted and superseded messages from all partitions with a TTL,
+// evicted messages or a compaction key
+func (fms *FileMessageStore) compact() {
+	fms.mutex.RLock()
+	partitions := make([]*messagePartition, 0, len(fms.partitions))
+	for _, p := range fms.partitions {
+		if len(p.getTTLs()) > 0 || p.hasEvictedMessages() || p.getCompactionKey() != "" {
+			partitions = append(partitions, p)
+		}
+	}
+	fms.mutex.RUnlock()
+
+	for _, p := range partitions {
+		removed, err := p.compact(time.Now())
+		if err != nil {
+			logger.WithError(err).WithField("partition", p.name).Error("Error compacting partition")
+			continue
+		}
+		logger.WithFields(log.Fields{
+			"partition": p.name,
+			"removed":   removed,
+		}).Info("Compacted partition")
+	}
+}
+
+func (p *messagePartition) setTTLs(ttls topicTTLs) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.ttls = ttls
+}
+
+func (p *messagePartition) getTTLs() topicTTLs {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.ttls
+}
+
+// oldestMessageID returns the smallest message id still stored in the partition, or 0 if it is empty
+func (p *messagePartition) oldestMessageID() uint64 {
+	p.fileCache.RLock()
+	defer p.fileCache.RUnlock()
+
+	for _, entry := range p.fileCache.entries {
+		if entry.max > 0 {
+			return entry.min
+		}
+	}
+	if front := p.list.front(); front != nil {
+		return front.id
+	}
+	return 0
+}
+
+// withoutExpired returns an index list containing only the messages not expired by the TTL of their topic.
+// The message files are opened once for the list, as all of its messages are read.
+func (p *messagePartition) withoutExpired(l *indexList, ttls topicTTLs, now time.Time) (*indexList, error) {
+	reader := p.newSegmentReader()
+	defer reader.close()
+
+	result := newIndexList(l.len())
+	err := l.mapWithPredicate(func(index *index, _ int) error {
+		data, err := reader.read(index)
+		if _, corrupted := err.(*CorruptedMessageError); corrupted {
+			// the corrupted messages are handled by the fetch, according to the corruption policy
+			result.insert(index)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !ttls.isExpired(data, now) {
+			result.insert(index)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (p *messagePartition) readMessage(index *index) ([]byte, error) {
+	file, err := p.openSegment(index.fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readRecord(file, index)
+}
+
+// segmentReader reads the messages of the index entries, keeping the message file of the last one open,
+// as the entries of an index list are in the same file
+type segmentReader struct {
+	p      *messagePartition
+	file   *messageFile
+	fileID int
+}
+
+func (p *messagePartition) newSegmentReader() *segmentReader {
+	return &segmentReader{p: p}
+}
+
+func (r *segmentReader) read(index *index) ([]byte, error) {
+	if r.file == nil || r.fileID != index.fileID {
+		r.close()
+		file, err := r.p.openSegment(index.fileID)
+		if err != nil {
+			return nil, err
+		}
+		r.file, r.fileID = file, index.fileID
+	}
+	return readRecord(r.file, index)
+}
+
+func (r *segmentReader) close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+// compact rewrites the files of the partition containing expired, evicted or superseded messages.
+// The surviving messages keep their ids. It returns the number of removed messages.
+// As the files are written in chronological order, the compaction of the evicted messages, and of the messages expired
+// by a TTL of the whole partition, stops at the first file without removed messages, while the key compaction
+// and the TTLs of the subtopics rewrite all files with removed messages.
+// Files emptied by a previous compaction are skipped.
+func (p *messagePartition) compact(now time.Time) (int, error) {
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.ttls) == 0 && p.evictedMessages == 0 && p.compactionKey == "" {
+		return 0, nil
+	}
+	var superseded map[uint64]bool
+	if p.compactionKey != "" {
+		var err error
+		if superseded, err = p.supersededMessages(); err != nil {
+			return 0, err
+		}
+	}
+	ttls := p.ttls
+	_, uniform := ttls.uniform(p.name)
+	removable := func(index *index, data []byte) bool {
+		return index.id < p.firstRetainedID || ttls.isExpired(data, now) || superseded[index.id]
+	}
+
+	totalRemoved := 0
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		l, err := p.loadIndexList(fileID)
+		if err != nil {
+			return totalRemoved, err
+		}
+		if l.len() == 0 {
+			continue
+		}
+		survivors, removed, err := p.compactFile(fileID, l, removable)
+		if err != nil {
+			return totalRemoved, err
+		}
+		if removed == 0 {
+			if superseded != nil || (len(ttls) > 0 && !uniform) {
+				continue
+			}
+			p.compacted(totalRemoved)
+			return totalRemoved, nil
+		}
+		totalRemoved += removed
+
+		entry := &cacheEntry{}
+		if survivors.len() > 0 {
+			entry = &cacheEntry{min: survivors.front().id, max: survivors.back().id}
+		}
+		p.fileCache.Lock()
+		p.fileCache.entries[fileID] = entry
+		p.fileCache.Unlock()
+	}
+
+	// the current file is still open for appending and will be reopened on the next store
+	if p.list.len() > 0 {
+		if err := p.closeAppendFiles(); err != nil {
+			return totalRemoved, err
+		}
+		survivors, removed, err := p.compactFile(p.fileCache.length(), p.list, removable)
+		if err != nil {
+			return totalRemoved, err
+		}
+		totalRemoved += removed
+		p.list = survivors
+		p.entriesCount = uint64(survivors.len())
+	}
+
+	p.compacted(totalRemoved)
+	return totalRemoved, nil
+}
+
+// compacted updates the counters after removing messages.
+// All evicted messages were removed, so the eviction restarts with the compacted files.
+func (p *messagePartition) compacted(removed int) {
+	p.totalNumberOfMessages -= uint64(removed)
+	p.evictedMessages = 0
+	p.eviction = evictionCursor{}
+}
+
+// compactFile rewrites the message and index file with the given id, skipping the removable messages.
+// It returns the list of the surviving messages and the number of removed messages.
+func (p *messagePartition) compactFile(fileID int, l *indexList, removable func(*index, []byte) bool) (*indexList, int, error) {
+	msgFile, err := p.openSegment(fileID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer msgFile.Close()
+
+	var survivors []record
+	for _, index := range l.toSliceArray() {
+		data, err := readRecord(msgFile, index)
+		if _, corrupted := err.(*CorruptedMessageError); corrupted && p.corruptionPolicy != CorruptionFail {
+			// the corrupted messages are not fetched anymore with the skip policy, so they are removed
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !removable(index, data) {
+			survivors = append(survivors, record{index.id, data})
+		}
+	}
+
+	removed := l.len() - len(survivors)
+	if removed == 0 {
+		return l, 0, nil
+	}
+
+	compacted, err := p.rewriteFile(fileID, msgFile.compressed, survivors)
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.compress && fileID < p.fileCache.length() {
+		p.compressInBackground(fileID)
+	}
+
+	logger.WithFields(log.Fields{
+		"filename":  msgFile.name,
+		"removed":   removed,
+		"remaining": len(survivors),
+	}).Debug("Compacted file")
+
+	return compacted, removed, nil
+}
+
+// record is a message read from a message file, with its id
+type record struct {
+	id   uint64
+	data []byte
+}
+
+// rewriteFile replaces the message and index file with the given id by the records, written in the current format.
+// The message file is replaced before the index file, so a rewrite interrupted in between leaves the complete
+// temporary index file, see completeRewrite. It returns the index list of the new files.
+func (p *messagePartition) rewriteFile(fileID int, isCompressed bool, records []record) (*indexList, error) {
+	msgFilename := p.composeMsgFilenameForPosition(uint64(fileID))
+	idxFilename := p.composeIdxFilenameForPosition(uint64(fileID))
+
+	tmpMsgFile, err := os.OpenFile(msgFilename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer tmpMsgFile.Close()
+
+	tmpIdxFile, err := os.OpenFile(idxFilename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer tmpIdxFile.Close()
+
+	if _, err := tmpMsgFile.Write(append(append([]byte{}, magicNumber...), fileFormatVersion...)); err != nil {
+		return nil, err
+	}
+	position := uint64(len(magicNumber) + len(fileFormatVersion))
+
+	rewritten := newIndexList(int(messagesPerFile))
+	for i, r := range records {
+		headerSize, err := writeRecord(tmpMsgFile, fileFormatVersion[0], r.id, r.data)
+		if err != nil {
+			return nil, err
+		}
+
+		messageOffset := position + uint64(headerSize)
+		if err := writeIndexEntry(tmpIdxFile, r.id, messageOffset, uint32(len(r.data)), uint64(i)); err != nil {
+			return nil, err
+		}
+		rewritten.insert(&index{
+			id:     r.id,
+			offset: messageOffset,
+			size:   uint32(len(r.data)),
+			fileID: fileID,
+		})
+		position = messageOffset + uint64(len(r.data))
+	}
+	if err := tmpMsgFile.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmpIdxFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmpMsgFile.Name(), msgFilename); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpIdxFile.Name(), idxFilename); err != nil {
+		return nil, err
+	}
+
+	// the rewritten file replaces the compressed one, and is compressed again after the compaction
+	if isCompressed {
+		p.decompressed.invalidate(fileID)
+		if err := os.Remove(msgFilename + compressedSuffix); err != nil {
+			return nil, err
+		}
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,241 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MessagePartition_ExpiredMessagesAreSkippedAndCompacted(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	// allow three messages per file
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_compaction_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetTTL("/foo", time.Hour)
+
+	// given four expired and three fresh messages, spread over three files
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	now := time.Now().Unix()
+	for i, ts := range []int64{old, old, old, old, now, now, now} {
+		id := uint64(i + 1)
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, ts)))
+	}
+
+	// then the expired messages are not fetched, even before compaction
+	a.Equal([]uint64{5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+
+	// and the count applies to the fresh messages only
+	a.Equal([]uint64{5, 6}, fetchIDs(a, mStore, 2, 2))
+
+	// when compacting
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	removed, err := p.(*messagePartition).compact(time.Now())
+
+	// then the expired messages are removed
+	a.NoError(err)
+	a.Equal(4, removed)
+	a.Equal(uint64(3), p.Count())
+	a.Equal(uint64(7), p.MaxMessageID())
+
+	// and a fetch pointing into the expired region is moved to the oldest surviving message
+	a.Equal([]uint64{5, 6, 7}, fetchIDs(a, mStore, 2, 10))
+
+	// and new messages can still be appended to the compacted file
+	a.NoError(mStore.Store("foo", 8, aMessageAt(8, now)))
+	a.Equal([]uint64{5, 6, 7, 8}, fetchIDs(a, mStore, 0, 10))
+
+	// and the compacted files can be loaded again
+	a.NoError(mStore.Stop())
+	mStore = New(dir)
+	mStore.SetTTL("/foo", time.Hour)
+	a.Equal([]uint64{5, 6, 7, 8}, fetchIDs(a, mStore, 3, 10))
+	p, err = mStore.Partition("foo")
+	a.NoError(err)
+	a.Equal(uint64(4), p.Count())
+
+	// and a later compaction skips the emptied file and removes the remaining messages
+	removed, err = p.(*messagePartition).compact(time.Now().Add(2 * time.Hour))
+	a.NoError(err)
+	a.Equal(4, removed)
+	a.Equal(uint64(0), p.Count())
+	a.Equal([]uint64{}, fetchIDs(a, mStore, 0, 10))
+}
+
+func Test_FileMessageStore_StopWaitsForCompaction(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_compaction_test")
+	defer os.RemoveAll(dir)
+
+	// given a started store compacting continuously
+	mStore := New(dir)
+	mStore.compactionInterval = time.Millisecond
+	mStore.SetTTL("foo", time.Hour)
+	a.NoError(mStore.Store("foo", 1, aMessageAt(1, time.Now().Unix())))
+	a.NoError(mStore.Start())
+	time.Sleep(10 * time.Millisecond)
+
+	// when stopping, then the compaction loop has finished
+	a.NoError(mStore.Stop())
+	done := make(chan bool)
+	go func() {
+		mStore.compactionWG.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Millisecond):
+		a.Fail("compaction still running")
+	}
+}
+
+func Test_MessagePartition_NoExpiryWithoutTTL(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_compaction_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	a.NoError(mStore.Store("foo", 1, aMessageAt(1, old)))
+	a.NoError(mStore.Store("foo", 2, []byte("not a guble message")))
+
+	mStore.compact()
+	a.Equal([]uint64{1, 2}, fetchIDs(a, mStore, 0, 10))
+
+	// when setting a TTL, only the guble message expires
+	mStore.SetTTL("foo", time.Hour)
+	mStore.compact()
+	a.Equal([]uint64{2}, fetchIDs(a, mStore, 0, 10))
+}
+
+func Test_MessagePartition_TTLOfTheTopicOfTheMessage(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_compaction_test")
+	defer os.RemoveAll(dir)
+
+	// given a TTL of a subtopic only, and old messages of the subtopic and of another one of the partition
+	mStore := New(dir)
+	mStore.SetTTL("/foo/short", time.Hour)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	now := time.Now().Unix()
+	for i, m := range []struct {
+		path protocol.Path
+		ts   int64
+	}{{"/foo/long", old}, {"/foo/long", old}, {"/foo/short", old}, {"/foo/short/sub", old}, {"/foo/short", now}} {
+		id := uint64(i + 1)
+		message := &protocol.Message{ID: id, Path: m.path, Time: m.ts, Body: []byte("Hello")}
+		a.NoError(mStore.Store("foo", id, message.Bytes()))
+	}
+
+	// then only the old messages of the subtopic (and its subtopics) are expired
+	a.Equal([]uint64{1, 2, 5}, fetchIDs(a, mStore, 0, 10))
+	offsets, err := mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 1, LastID: 5, Count: 3}, offsets)
+
+	// and they are removed by the compaction, also after a file without expired messages
+	p := partitionOf(a, mStore)
+	removed, err := p.compact(time.Now())
+	a.NoError(err)
+	a.Equal(2, removed)
+	a.Equal([]uint64{1, 2, 5}, fetchIDs(a, mStore, 0, 10))
+
+	// and a TTL of the partition applies to the other topics
+	mStore.SetTTL("/foo", 90*time.Minute)
+	a.Equal([]uint64{5}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Stop())
+}
+
+func Test_topicTTLs(t *testing.T) {
+	a := assert.New(t)
+
+	ttls := topicTTLs{}.with("/sms", time.Hour).with("/sms/otp", time.Minute)
+	a.Equal(time.Hour, ttls.of("/sms"))
+	a.Equal(time.Hour, ttls.of("/sms/news"))
+	a.Equal(time.Minute, ttls.of("/sms/otp/42"))
+	a.Equal(time.Duration(0), ttls.of("/smsx"))
+	_, uniform := ttls.uniform("sms")
+	a.False(uniform)
+
+	ttls = ttls.with("/sms/otp", 0)
+	ttl, uniform := ttls.uniform("sms")
+	a.True(uniform)
+	a.Equal(time.Hour, ttl)
+	a.Equal(topicOfTTL("sms/"), protocol.Path("/sms"))
+}
+
+func Test_messageTime(t *testing.T) {
+	a := assert.New(t)
+
+	ts, ok := messageTime(aMessageAt(42, 1420110000))
+	a.True(ok)
+	a.Equal(int64(1420110000), ts)
+
+	_, ok = messageTime([]byte("aaaaaaaaaa"))
+	a.False(ok)
+}
+
+func aMessageAt(id uint64, ts int64) []byte {
+	m := &protocol.Message{
+		ID:   id,
+		Path: protocol.Path("/foo/bar"),
+		Time: ts,
+		Body: []byte("Hello"),
+	}
+	return m.Bytes()
+}
+
+func fetchIDs(a *assert.Assertions, mStore *FileMessageStore, startID uint64, count int) []uint64 {
+	req := &store.FetchRequest{
+		Partition: "foo",
+		StartID:   startID,
+		Count:     count,
+		MessageC:  make(chan *store.FetchedMessage, 10),
+		ErrorC:    make(chan error, 1),
+		StartC:    make(chan int, 1),
+	}
+	mStore.Fetch(req)
+
+	ids := []uint64{}
+	select {
+	case <-req.StartC:
+	case err := <-req.ErrorC:
+		a.Fail(err.Error())
+		return ids
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+		return ids
+	}
+
+	for {
+		select {
+		case msg, open := <-req.MessageC:
+			if !open {
+				return ids
+			}
+			ids = append(ids, msg.ID)
+		case err := <-req.ErrorC:
+			a.Fail(err.Error())
+			return ids
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return ids
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package filestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// compressedSuffix is appended to the name of a sealed message file, when it is stored gzip compressed.
+// The index files are never compressed, so the offsets in them refer to the uncompressed message file.
+const compressedSuffix = ".gz"
+
+// segment is a message file opened for reading the messages at the offsets of its index
+type segment interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// decompressedSegment is a compressed message file, decompressed in memory
+type decompressedSegment struct {
+	*bytes.Reader
+}
+
+func (decompressedSegment) Close() error {
+	return nil
+}
+
+// messageFile is a message file opened for reading, with the format version of its header
+type messageFile struct {
+	segment
+	name       string
+	version    byte
+	compressed bool
+}
+
+// segmentCache keeps the last decompressed message file,
+// as the fetches and the compaction usually read many messages of the same file
+type segmentCache struct {
+	sync.Mutex
+	fileID int
+	data   []byte
+}
+
+func (c *segmentCache) invalidate(fileID int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.data != nil && c.fileID == fileID {
+		c.data = nil
+	}
+}
+
+// openSegment opens the message file with the given id, which is transparently decompressed if it is compressed
+func (p *messagePartition) openSegment(fileID int) (*messageFile, error) {
+	filename := p.composeMsgFilenameForPosition(uint64(fileID))
+	file, err := os.Open(filename)
+	if err == nil {
+		return newMessageFile(file, filename, false)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err := p.decompressSegment(fileID)
+	if err != nil {
+		return nil, err
+	}
+	return newMessageFile(decompressedSegment{bytes.NewReader(data)}, filename, true)
+}
+
+func newMessageFile(s segment, filename string, compressed bool) (*messageFile, error) {
+	version, err := readFormatVersion(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &messageFile{segment: s, name: filename, version: version, compressed: compressed}, nil
+}
+
+func (p *messagePartition) decompressSegment(fileID int) ([]byte, error) {
+	p.decompressed.Lock()
+	defer p.decompressed.Unlock()
+
+	if p.decompressed.data != nil && p.decompressed.fileID == fileID {
+		return p.decompressed.data, nil
+	}
+
+	defer observeLatency("decompress", time.Now())
+	file, err := os.Open(p.composeMsgFilenameForPosition(uint64(fileID)) + compressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p.decompressed.fileID = fileID
+	p.decompressed.data = data
+	return data, nil
+}
+
+// compressSegment replaces the sealed message file with the given id by its gzip compressed version.
+// The compressed file is complete before the uncompressed one is removed, so the readers always find one of them.
+func (p *messagePartition) compressSegment(fileID int) error {
+	filename := p.composeMsgFilenameForPosition(uint64(fileID))
+	src, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		// already compressed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	defer observeLatency("compress", time.Now())
+	tmpFilename := filename + compressedSuffix + ".tmp"
+	dst, err := os.OpenFile(tmpFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	w := gzip.NewWriter(dst)
+	if _, err := io.Copy(w, src); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, filename+compressedSuffix); err != nil {
+		return err
+	}
+	logger.WithField("filename", filename).Debug("Compressed sealed message file")
+	return os.Remove(filename)
+}
+
+// compressInBackground compresses the sealed message files with the given ids, one after the other.
+// The compaction, which rewrites the files, waits for the compression.
+func (p *messagePartition) compressInBackground(fileIDs ...int) {
+	if len(fileIDs) == 0 {
+		return
+	}
+	p.compressionWG.Add(1)
+	go func() {
+		defer p.compressionWG.Done()
+		p.compactionMutex.RLock()
+		defer p.compactionMutex.RUnlock()
+
+		for _, fileID := range fileIDs {
+			if err := p.compressSegment(fileID); err != nil {
+				logger.WithError(err).WithFields(log.Fields{
+					"partition": p.name,
+					"fileID":    fileID,
+				}).Error("Error compressing sealed message file")
+			}
+		}
+	}()
+}
+
+// setCompression enables the compression of the sealed message files,
+// and compresses the already sealed files which are not compressed yet.
+func (p *messagePartition) setCompression(enabled bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.compress = enabled
+	if !enabled {
+		return
+	}
+	var sealed []int
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		sealed = append(sealed, fileID)
+	}
+	p.compressInBackground(sealed...)
+}
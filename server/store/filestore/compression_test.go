@@ -0,0 +1,189 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_CompressesTheSealedFiles(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	// allow three messages per file
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_compression_test")
+	defer os.RemoveAll(dir)
+
+	// given seven messages spread over three files, with compression
+	mStore := New(dir)
+	mStore.SetCompression(true)
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 7; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+	p := partitionOf(a, mStore)
+	p.compressionWG.Wait()
+
+	// then the two sealed files are compressed, and the file being appended is not
+	assertCompressed(a, p, 0, true)
+	assertCompressed(a, p, 1, true)
+	assertCompressed(a, p, 2, false)
+
+	// and the messages are fetched from the compressed files, forward and backward
+	a.Equal([]uint64{1, 2, 3, 4, 5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+	a.Equal([]uint64{2, 3, 4}, fetchIDs(a, mStore, 2, 3))
+	a.Equal([]uint64{2, 3, 4, 5}, fetchBackwardIDs(a, mStore, 5, 4))
+	assertFetchedData(a, mStore, 4, aMessageAt(4, now))
+
+	// and a file sealed later is compressed as well
+	for id := uint64(8); id <= 10; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+	p.compressionWG.Wait()
+	assertCompressed(a, p, 2, true)
+	assertCompressed(a, p, 3, false)
+
+	// and the compressed files are read after a restart, also without compression
+	a.NoError(mStore.Stop())
+	mStore = New(dir)
+	a.Equal([]uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, fetchIDs(a, mStore, 0, 20))
+	a.Equal(uint64(10), partitionOf(a, mStore).Count())
+	a.Equal(uint64(10), partitionOf(a, mStore).MaxMessageID())
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_CompressesTheExistingSealedFilesWhenOpened(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_compression_test")
+	defer os.RemoveAll(dir)
+
+	// given files written without compression
+	mStore := New(dir)
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 4; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+	assertCompressed(a, partitionOf(a, mStore), 0, false)
+	a.NoError(mStore.Stop())
+
+	// when the store is opened with compression
+	mStore = New(dir)
+	mStore.SetCompression(true)
+	p := partitionOf(a, mStore)
+	p.compressionWG.Wait()
+
+	// then the sealed file is compressed
+	assertCompressed(a, p, 0, true)
+	assertCompressed(a, p, 1, false)
+	a.Equal([]uint64{1, 2, 3, 4}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_CompactsTheCompressedFiles(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_compression_test")
+	defer os.RemoveAll(dir)
+
+	// given compressed files with two expired messages
+	mStore := New(dir)
+	mStore.SetCompression(true)
+	mStore.SetTTL("/foo", time.Hour)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	now := time.Now().Unix()
+	for i, ts := range []int64{old, old, now, now, now, now, now} {
+		id := uint64(i + 1)
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, ts)))
+	}
+	p := partitionOf(a, mStore)
+	p.compressionWG.Wait()
+	assertCompressed(a, p, 0, true)
+
+	// then the expired messages are skipped, when reading the compressed files
+	a.Equal([]uint64{3, 4, 5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+
+	// when compacting
+	removed, err := p.compact(time.Now())
+	a.NoError(err)
+	a.Equal(2, removed)
+
+	// then the compacted file is compressed again, and contains the surviving message
+	p.compressionWG.Wait()
+	assertCompressed(a, p, 0, true)
+	a.Equal([]uint64{3, 4, 5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+	assertFetchedData(a, mStore, 3, aMessageAt(3, now))
+	a.NoError(mStore.Stop())
+}
+
+func partitionOf(a *assert.Assertions, mStore *FileMessageStore) *messagePartition {
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	return p.(*messagePartition)
+}
+
+func assertCompressed(a *assert.Assertions, p *messagePartition, fileID int, compressed bool) {
+	filename := p.composeMsgFilenameForPosition(uint64(fileID))
+	_, err := os.Stat(filename + compressedSuffix)
+	a.Equal(compressed, err == nil, "compressed file of %d", fileID)
+	_, err = os.Stat(filename)
+	a.Equal(!compressed, err == nil, "uncompressed file of %d", fileID)
+}
+
+func fetchBackwardIDs(a *assert.Assertions, mStore *FileMessageStore, startID uint64, count int) []uint64 {
+	req := store.NewFetchRequest("foo", startID, 0, store.DirectionBackwards, count)
+	req.Init()
+	mStore.Fetch(req)
+	ids := []uint64{}
+	for _, m := range collect(a, req) {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func assertFetchedData(a *assert.Assertions, mStore *FileMessageStore, id uint64, data []byte) {
+	req := store.NewFetchRequest("foo", id, id, store.DirectionForward, 1)
+	req.Init()
+	mStore.Fetch(req)
+	if fetched := collect(a, req); a.Len(fetched, 1) {
+		a.Equal(data, fetched[0].Message)
+	}
+}
+
+func collect(a *assert.Assertions, req *store.FetchRequest) []*store.FetchedMessage {
+	var fetched []*store.FetchedMessage
+	select {
+	case <-req.StartC:
+	case err := <-req.ErrorC:
+		a.Fail(err.Error())
+		return nil
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+		return nil
+	}
+	for {
+		select {
+		case m, open := <-req.MessageC:
+			if !open {
+				return fetched
+			}
+			fetched = append(fetched, m)
+		case err := <-req.ErrorC:
+			a.Fail(err.Error())
+			return fetched
+		case <-time.After(time.Second):
+			a.Fail("timeout")
+			return fetched
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// formatVersionWithoutChecksum is the version of the message files written before the checksums.
+	// These files are still read and appended, without verifying their messages.
+	formatVersionWithoutChecksum byte = 1
+
+	// formatVersionWithChecksum adds a CRC32 checksum of the message id and the message to each record
+	formatVersionWithChecksum byte = 2
+
+	checksumSize = 4
+)
+
+// CorruptionPolicy is the handling of the corrupted messages found by the fetches, see SetCorruptionPolicy
+type CorruptionPolicy string
+
+const (
+	// CorruptionSkip skips the corrupted messages, so the fetch returns the other ones
+	CorruptionSkip CorruptionPolicy = "skip"
+
+	// CorruptionFail ends the fetch with a CorruptedMessageError at the first corrupted message
+	CorruptionFail CorruptionPolicy = "fail"
+)
+
+// IsValid returns true for a known policy
+func (p CorruptionPolicy) IsValid() bool {
+	return p == CorruptionSkip || p == CorruptionFail
+}
+
+// CorruptedMessageError is the error of a message, which does not match the checksum stored with it
+type CorruptedMessageError struct {
+	ID       uint64
+	Offset   uint64
+	Filename string
+}
+
+func (e *CorruptedMessageError) Error() string {
+	return fmt.Sprintf("Corrupted message %d at offset %d of %s", e.ID, e.Offset, e.Filename)
+}
+
+// SetCorruptionPolicy sets the handling of the corrupted messages, i.e. with a wrong checksum, found by the fetches.
+// The messages are skipped by default. It applies to the partitions opened after the call.
+func (fms *FileMessageStore) SetCorruptionPolicy(policy CorruptionPolicy) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.corruptionPolicy = policy
+}
+
+// checksum returns the CRC32 of the message id (as little endian bytes) and the message.
+// The id is added byte by byte, as a slice of its bytes would be allocated for each message.
+func checksum(id uint64, data []byte) uint32 {
+	crc := ^uint32(0)
+	for i := uint(0); i < 8; i++ {
+		crc = crc32.IEEETable[byte(crc)^byte(id>>(8*i))] ^ (crc >> 8)
+	}
+	return crc32.Update(^crc, crc32.IEEETable, data)
+}
+
+// recordHeaderSize returns the size of the bytes before each message in a file of the format version:
+// the message size and the message id, 32 bit and 64 bit, followed by the 32 bit checksum since version 2
+func recordHeaderSize(version byte) int {
+	if version >= formatVersionWithChecksum {
+		return 12 + checksumSize
+	}
+	return 12
+}
+
+// writeRecord writes the message with its record header in the format version.
+// It returns the size of the header, which is the distance from the position of the record to the message.
+func writeRecord(w io.Writer, version byte, id uint64, data []byte) (int, error) {
+	headerSize := recordHeaderSize(version)
+	record := make([]byte, headerSize, headerSize+len(data))
+	binary.LittleEndian.PutUint32(record, uint32(len(data)))
+	binary.LittleEndian.PutUint64(record[4:], id)
+	if version >= formatVersionWithChecksum {
+		binary.LittleEndian.PutUint32(record[12:], checksum(id, data))
+	}
+	_, err := w.Write(append(record, data...))
+	return headerSize, err
+}
+
+// readFormatVersion reads the format version from the header of a message file
+func readFormatVersion(r io.ReaderAt) (byte, error) {
+	version := make([]byte, len(fileFormatVersion))
+	if _, err := r.ReadAt(version, int64(len(magicNumber))); err != nil {
+		return 0, err
+	}
+	return version[0], nil
+}
+
+// readRecord reads the message of the index entry from the file into a new buffer, which can be retained.
+func readRecord(file *messageFile, index *index) ([]byte, error) {
+	var buf []byte
+	return readRecordInto(file, index, &buf)
+}
+
+// readRecordInto reads the message of the index entry from the file, verifying its checksum if the file has checksums.
+// The returned message is a slice of the buffer, which is grown if it is too small, so it is only valid
+// until the buffer is reused. A wrong checksum is logged and returned as a CorruptedMessageError.
+func readRecordInto(file *messageFile, index *index, buf *[]byte) ([]byte, error) {
+	size := int(index.size)
+	offset := int64(index.offset)
+	if file.version >= formatVersionWithChecksum {
+		// the checksum is the last field of the record header, just before the message
+		size += checksumSize
+		offset -= checksumSize
+	}
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	record := (*buf)[:size]
+	if _, err := file.ReadAt(record, offset); err != nil {
+		return nil, err
+	}
+	if file.version < formatVersionWithChecksum {
+		return record, nil
+	}
+
+	data := record[checksumSize:]
+	if binary.LittleEndian.Uint32(record) != checksum(index.id, data) {
+		err := &CorruptedMessageError{ID: index.id, Offset: index.offset, Filename: file.name}
+		logger.WithFields(log.Fields{
+			"id":       index.id,
+			"offset":   index.offset,
+			"filename": file.name,
+		}).Error("Corrupted message")
+		return nil, err
+	}
+	return data, nil
+}
+
+// scanRecord reads the record at the position of the message file, returning the message id,
+// the offset of the message and the position of the next record.
+// A partial record returns io.ErrUnexpectedEOF, and a wrong checksum a CorruptedMessageError.
+func scanRecord(file *os.File, version byte, position, fileSize int64) (uint64, int64, int64, error) {
+	header := make([]byte, recordHeaderSize(version))
+	if position+int64(len(header)) > fileSize {
+		return 0, position, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := file.ReadAt(header, position); err != nil {
+		return 0, position, 0, err
+	}
+	size := int64(binary.LittleEndian.Uint32(header))
+	id := binary.LittleEndian.Uint64(header[4:])
+	offset := position + int64(len(header))
+	if offset+size > fileSize {
+		return id, offset, 0, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return id, offset, 0, err
+	}
+	if version >= formatVersionWithChecksum && binary.LittleEndian.Uint32(header[12:]) != checksum(id, data) {
+		return id, offset, 0, &CorruptedMessageError{ID: id, Offset: uint64(offset), Filename: file.Name()}
+	}
+	return id, offset, offset + size, nil
+}
+
+// repairAppendFile scans the message file being appended (i.e. the last one), after its index list is loaded.
+// A crash can leave a partial record at its end, or a record written without its index entry.
+// The file is truncated at the first partial, corrupted or not indexed record, and the index entries
+// of the removed records are dropped, so that the appending can safely continue.
+func (p *messagePartition) repairAppendFile() error {
+	fileID := p.fileCache.length()
+	filename := p.composeMsgFilenameForPosition(uint64(fileID))
+	file, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+
+	indexed := make(map[uint64]*index, p.list.len())
+	for _, e := range p.list.toSliceArray() {
+		indexed[e.offset] = e
+	}
+
+	// a file without a complete header is written again from the start
+	var kept []*index
+	position := int64(0)
+	if headerSize := int64(len(magicNumber) + len(fileFormatVersion)); fileSize >= headerSize {
+		version, err := readFormatVersion(file)
+		if err != nil {
+			return err
+		}
+		for position = headerSize; position < fileSize; {
+			id, offset, next, err := scanRecord(file, version, position, fileSize)
+			if _, corrupted := err.(*CorruptedMessageError); err != nil && err != io.ErrUnexpectedEOF && !corrupted {
+				return err
+			}
+			le := logger.WithFields(log.Fields{
+				"id":       id,
+				"offset":   offset,
+				"filename": filename,
+			})
+			if err != nil {
+				le.WithError(err).Error("Truncating the message file at an invalid record")
+				break
+			}
+			e := indexed[uint64(offset)]
+			if e == nil || e.id != id || int64(e.size) != next-offset {
+				le.Warn("Truncating the message file at a record without index entry")
+				break
+			}
+			kept = append(kept, e)
+			position = next
+		}
+	}
+
+	if position == fileSize && len(kept) == p.list.len() {
+		return nil
+	}
+	if err := file.Truncate(position); err != nil {
+		return err
+	}
+
+	// the index entries are rewritten in the order of the records, as written by store
+	indexFile, err := os.OpenFile(p.composeIdxFilenameForPosition(uint64(fileID)), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+	for i, e := range kept {
+		if err := writeIndexEntry(indexFile, e.id, e.offset, e.size, uint64(i)); err != nil {
+			return err
+		}
+	}
+	if err := indexFile.Truncate(int64(len(kept) * indexEntrySize)); err != nil {
+		return err
+	}
+
+	logger.WithFields(log.Fields{
+		"filename":  filename,
+		"truncated": fileSize - position,
+		"dropped":   p.list.len() - len(kept),
+		"remaining": len(kept),
+	}).Warn("Repaired the message file")
+
+	l := newIndexList(int(messagesPerFile))
+	l.insert(kept...)
+	p.list = l
+	p.entriesCount = uint64(len(kept))
+	return nil
+}
@@ -0,0 +1,243 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_SkipsTheCorruptedMessages(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given five messages, with a corrupted one
+	mStore := New(dir)
+	storeMessages(a, mStore, 1, 5)
+	corruptMessage(a, partitionOf(a, mStore), 3)
+
+	// then the corrupted message is skipped by the fetches
+	a.Equal([]uint64{1, 2, 4, 5}, fetchIDs(a, mStore, 0, 10))
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_FailsAtTheCorruptedMessages(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given five messages, with a corrupted one, and the fail policy
+	mStore := New(dir)
+	mStore.SetCorruptionPolicy(CorruptionFail)
+	storeMessages(a, mStore, 1, 5)
+	p := partitionOf(a, mStore)
+	corruptMessage(a, p, 3)
+
+	// then the fetch ends with an error at the corrupted message
+	req := store.NewFetchRequest("foo", 1, 0, store.DirectionForward, 10)
+	req.Init()
+	mStore.Fetch(req)
+	a.Equal(5, <-req.StartC)
+	a.Equal(uint64(1), (<-req.MessageC).ID)
+	a.Equal(uint64(2), (<-req.MessageC).ID)
+	select {
+	case err := <-req.ErrorC:
+		if corrupted, ok := err.(*CorruptedMessageError); a.True(ok) {
+			a.Equal(uint64(3), corrupted.ID)
+			a.Equal(p.composeMsgFilenameForPosition(0), corrupted.Filename)
+		}
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+	}
+	a.NoError(mStore.Stop())
+}
+
+func Test_MessagePartition_TruncatesThePartialRecordOnStartup(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given three messages, followed by a partial record
+	p, err := newMessagePartition(dir, "foo")
+	a.NoError(err)
+	for id := uint64(1); id <= 3; id++ {
+		a.NoError(p.Store(id, []byte("aaaaaaaaaa")))
+	}
+	a.NoError(p.Close())
+	filename := p.composeMsgFilenameForPosition(0)
+	size := fileSize(a, filename)
+	appendToFile(a, filename, []byte{100, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 1, 2})
+
+	// when the partition is opened again
+	p, err = newMessagePartition(dir, "foo")
+	a.NoError(err)
+
+	// then the partial record is removed, and the next message is appended after the last complete one
+	a.Equal(size, fileSize(a, filename))
+	a.Equal(uint64(3), p.Count())
+	a.NoError(p.Store(4, []byte("bbbbbbbbbb")))
+	a.Equal([]uint64{1, 2, 3, 4}, fetchPartitionIDs(a, p))
+	a.NoError(p.Close())
+}
+
+func Test_MessagePartition_TruncatesTheCorruptedRecordOnStartup(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given four messages, with a corrupted third one
+	p, err := newMessagePartition(dir, "foo")
+	a.NoError(err)
+	for id := uint64(1); id <= 4; id++ {
+		a.NoError(p.Store(id, []byte("aaaaaaaaaa")))
+	}
+	a.NoError(p.Close())
+	corruptMessage(a, p, 3)
+
+	// when the partition is opened again
+	p, err = newMessagePartition(dir, "foo")
+	a.NoError(err)
+
+	// then the log is truncated at the corrupted message, also in the index
+	a.Equal(uint64(2), p.Count())
+	a.Equal(uint64(2), p.MaxMessageID())
+	entries, err := calculateNoEntries(p.composeIdxFilenameForPosition(0))
+	a.NoError(err)
+	a.Equal(uint64(2), entries)
+
+	// and the appending continues after the last valid message
+	a.NoError(p.Store(5, []byte("bbbbbbbbbb")))
+	a.Equal([]uint64{1, 2, 5}, fetchPartitionIDs(a, p))
+	a.NoError(p.Close())
+}
+
+func Test_MessagePartition_TruncatesTheRecordWithoutIndexEntryOnStartup(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given two messages, followed by a complete record written without its index entry
+	p, err := newMessagePartition(dir, "foo")
+	a.NoError(err)
+	a.NoError(p.Store(1, []byte("aaaaaaaaaa")))
+	a.NoError(p.Store(2, []byte("aaaaaaaaaa")))
+	a.NoError(p.Close())
+	filename := p.composeMsgFilenameForPosition(0)
+	size := fileSize(a, filename)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	a.NoError(err)
+	_, err = writeRecord(file, formatVersionWithChecksum, 3, []byte("cccccccccc"))
+	a.NoError(err)
+	a.NoError(file.Close())
+
+	// when the partition is opened again
+	p, err = newMessagePartition(dir, "foo")
+	a.NoError(err)
+
+	// then the record is removed
+	a.Equal(size, fileSize(a, filename))
+	a.Equal(uint64(2), p.Count())
+	a.NoError(p.Close())
+}
+
+func Test_MessagePartition_ReadsAndAppendsTheFilesWithoutChecksums(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_corruption_test")
+	defer os.RemoveAll(dir)
+
+	// given a message file in the format version without checksums
+	p := &messagePartition{basedir: dir, name: "foo"}
+	msgFile, err := os.Create(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+	idxFile, err := os.Create(p.composeIdxFilenameForPosition(0))
+	a.NoError(err)
+	_, err = msgFile.Write(append(append([]byte{}, magicNumber...), formatVersionWithoutChecksum))
+	a.NoError(err)
+	position := uint64(len(magicNumber) + 1)
+	for id := uint64(1); id <= 2; id++ {
+		headerSize, err := writeRecord(msgFile, formatVersionWithoutChecksum, id, []byte("aaaaaaaaaa"))
+		a.NoError(err)
+		a.Equal(12, headerSize)
+		a.NoError(writeIndexEntry(idxFile, id, position+12, 10, id-1))
+		position += 12 + 10
+	}
+	a.NoError(msgFile.Close())
+	a.NoError(idxFile.Close())
+
+	// when it is opened and appended
+	p, err = newMessagePartition(dir, "foo")
+	a.NoError(err)
+	a.Equal(uint64(2), p.Count())
+	a.NoError(p.Store(3, []byte("bbbbbbbbbb")))
+	a.NoError(p.Close())
+
+	// then the file keeps its format version, and all messages are read after a restart
+	msgFile, err = os.Open(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+	version, err := readFormatVersion(msgFile)
+	a.NoError(err)
+	a.Equal(formatVersionWithoutChecksum, version)
+	a.NoError(msgFile.Close())
+
+	p, err = newMessagePartition(dir, "foo")
+	a.NoError(err)
+	a.Equal(uint64(3), p.Count())
+	a.Equal([]uint64{1, 2, 3}, fetchPartitionIDs(a, p))
+	a.NoError(p.Close())
+}
+
+func storeMessages(a *assert.Assertions, mStore *FileMessageStore, from, to uint64) {
+	now := time.Now().Unix()
+	for id := from; id <= to; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+}
+
+// corruptMessage flips the first byte of the stored message with the id
+func corruptMessage(a *assert.Assertions, p *messagePartition, id uint64) {
+	for _, e := range p.list.toSliceArray() {
+		if e.id != id {
+			continue
+		}
+		file, err := os.OpenFile(p.composeMsgFilenameForPosition(uint64(e.fileID)), os.O_RDWR, 0666)
+		a.NoError(err)
+		defer file.Close()
+		b := make([]byte, 1)
+		_, err = file.ReadAt(b, int64(e.offset))
+		a.NoError(err)
+		_, err = file.WriteAt([]byte{^b[0]}, int64(e.offset))
+		a.NoError(err)
+		return
+	}
+	a.Fail("message not found")
+}
+
+func appendToFile(a *assert.Assertions, filename string, data []byte) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	a.NoError(err)
+	defer file.Close()
+	_, err = file.Write(data)
+	a.NoError(err)
+}
+
+func fileSize(a *assert.Assertions, filename string) int64 {
+	stat, err := os.Stat(filename)
+	a.NoError(err)
+	return stat.Size()
+}
+
+func fetchPartitionIDs(a *assert.Assertions, p *messagePartition) []uint64 {
+	req := store.NewFetchRequest("foo", 0, 0, store.DirectionForward, 100)
+	req.Init()
+	p.Fetch(req)
+	ids := []uint64{}
+	for _, m := range collect(a, req) {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
@@ -0,0 +1,393 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+)
+
+// headerIndexVersion is the format version of the header index files.
+// A header index file of another version, or with other keys than the configured ones, is rebuilt.
+const headerIndexVersion = 1
+
+var (
+	// headerIndexMagic starts each header index file
+	headerIndexMagic = []byte{'g', 'b', 'l', 'h', 'd', 'x'}
+
+	errHeaderIndexFormat = errors.New("Not a header index file of the current format version.")
+)
+
+// The header index of a message file is written next to its index file, as `<partition>-<position>.hdx`.
+// It starts with the magic number, the format version and the length-prefixed json list of the indexed keys,
+// followed by a record for each stored message: its id, and the length-prefixed json object of its indexed header fields.
+// So the message index files keep their format, and are read as before without a header index.
+
+// SetIndexedHeaders sets the header keys indexed for the messages of a topic, so that they can be scanned
+// by ScanHeaders without reading the messages. As the messages are stored per partition, the keys apply
+// to the whole partition of the topic. The existing messages are indexed by scanning the partition once,
+// when the keys changed since its header index was written; no keys remove the header index of the partition.
+// The existing partitions with indexed keys are opened by Start, so that the scan is done on startup,
+// instead of by the first request.
+func (fms *FileMessageStore) SetIndexedHeaders(topic string, keys []string) {
+	partitionName := partitionOfTopic(topic)
+	keys = normalizeHeaderKeys(keys)
+
+	fms.mutex.Lock()
+	if len(keys) > 0 {
+		fms.indexedHeaders[partitionName] = keys
+	} else {
+		delete(fms.indexedHeaders, partitionName)
+	}
+	p, exist := fms.partitions[partitionName]
+	fms.mutex.Unlock()
+
+	if !exist {
+		// the keys are applied by opening the partition
+		return
+	}
+	if err := p.setIndexedHeaders(keys); err != nil {
+		logger.WithError(err).WithField("partition", partitionName).Error("Error indexing the message headers")
+	}
+}
+
+// openIndexedPartitions opens the existing partitions with indexed header keys, rebuilding their header indexes if needed
+func (fms *FileMessageStore) openIndexedPartitions() {
+	fms.mutex.RLock()
+	var names []string
+	for name := range fms.indexedHeaders {
+		names = append(names, name)
+	}
+	fms.mutex.RUnlock()
+
+	for _, name := range names {
+		if _, err := os.Stat(path.Join(fms.basedir, name)); err == nil {
+			fms.Partition(name)
+		}
+	}
+}
+
+// IndexedHeaders returns the header keys indexed for the partition.
+// It is a part of the `store.HeaderIndex` implementation.
+func (fms *FileMessageStore) IndexedHeaders(partition string) []string {
+	fms.mutex.RLock()
+	defer fms.mutex.RUnlock()
+
+	return fms.indexedHeaders[partition]
+}
+
+// ScanHeaders calls fn with the indexed header fields of the messages of the request, reading the header index files.
+// A message missing in the header index (e.g. written before a crash, but not its header record) is read instead.
+// It is a part of the `store.HeaderIndex` implementation.
+func (fms *FileMessageStore) ScanHeaders(req *store.FetchRequest, fn store.HeaderFunc) error {
+	p, err := fms.Partition(req.Partition)
+	if err != nil {
+		return err
+	}
+	return p.(*messagePartition).scanHeaders(req, fn)
+}
+
+// normalizeHeaderKeys returns the sorted keys without the empty and the duplicate ones
+func normalizeHeaderKeys(keys []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			normalized = append(normalized, key)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func (p *messagePartition) composeHdxFilenameForPosition(value uint64) string {
+	return filepath.Join(p.basedir, fmt.Sprintf("%s-%020d.hdx", p.name, value))
+}
+
+// setIndexedHeaders sets the indexed keys, and rebuilds the header index files written with other keys or format version
+func (p *messagePartition) setIndexedHeaders(keys []string) error {
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.closeHeaderFile(); err != nil {
+		return err
+	}
+	p.indexedHeaders = keys
+
+	for fileID := 0; fileID <= p.fileCache.length(); fileID++ {
+		filename := p.composeHdxFilenameForPosition(uint64(fileID))
+		if len(keys) == 0 {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if indexedKeys, err := readHeaderIndexKeys(filename); err == nil && reflect.DeepEqual(indexedKeys, keys) {
+			continue
+		}
+		if err := p.rebuildHeaderIndex(fileID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildHeaderIndex writes the header index of the file by reading all of its messages
+func (p *messagePartition) rebuildHeaderIndex(fileID int) error {
+	l := p.list
+	if fileID < p.fileCache.length() {
+		var err error
+		if l, err = p.loadIndexList(fileID); err != nil {
+			return err
+		}
+	}
+	filename := p.composeHdxFilenameForPosition(uint64(fileID))
+	logger.WithFields(log.Fields{
+		"filename": filename,
+		"messages": l.len(),
+	}).Info("Rebuilding the header index")
+
+	tmpFile, err := os.OpenFile(filename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Close()
+
+	w := bufio.NewWriter(tmpFile)
+	if err := writeHeaderIndexStart(w, p.indexedHeaders); err != nil {
+		return err
+	}
+	reader := p.newSegmentReader()
+	defer reader.close()
+	err = l.mapWithPredicate(func(index *index, _ int) error {
+		data, err := reader.read(index)
+		if _, corrupted := err.(*CorruptedMessageError); corrupted {
+			// a corrupted message is not indexed, it is handled by the fetch as before
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return writeHeaderRecord(w, index.id, messageHeaderValues(data, p.indexedHeaders))
+	})
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// indexHeaders appends the header record of the stored message to the header index of the current file,
+// opening it with the first message; the caller has to hold the lock
+func (p *messagePartition) indexHeaders(messageID uint64, data []byte) error {
+	if len(p.indexedHeaders) == 0 {
+		return nil
+	}
+	if p.headerFile == nil {
+		file, err := os.OpenFile(p.composeHdxFilenameForPosition(uint64(p.fileCache.length())), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		if stat, err := file.Stat(); err != nil || stat.Size() == 0 {
+			if err := writeHeaderIndexStart(file, p.indexedHeaders); err != nil {
+				file.Close()
+				return err
+			}
+		}
+		p.headerFile = file
+	}
+	return writeHeaderRecord(p.headerFile, messageID, messageHeaderValues(data, p.indexedHeaders))
+}
+
+// closeHeaderFile closes the header index of the current file; the caller has to hold the lock
+func (p *messagePartition) closeHeaderFile() error {
+	if p.headerFile == nil {
+		return nil
+	}
+	err := p.headerFile.Close()
+	p.headerFile = nil
+	return err
+}
+
+// scanHeaders calls fn with the indexed header fields of the messages of the fetch list of the request
+func (p *messagePartition) scanHeaders(req *store.FetchRequest, fn store.HeaderFunc) error {
+	p.compactionMutex.RLock()
+	defer p.compactionMutex.RUnlock()
+
+	p.RLock()
+	keys := p.indexedHeaders
+	p.RUnlock()
+	if len(keys) == 0 {
+		return fmt.Errorf("The headers of the partition %s are not indexed.", p.name)
+	}
+
+	fetchList, err := p.calculateFetchList(req)
+	if err != nil {
+		return err
+	}
+
+	headerIndexes := make(map[int]map[uint64]map[string]string)
+	return fetchList.mapWithPredicate(func(index *index, _ int) error {
+		headers, loaded := headerIndexes[index.fileID]
+		if !loaded {
+			headers, err = readHeaderIndex(p.composeHdxFilenameForPosition(uint64(index.fileID)), keys)
+			if err != nil && !os.IsNotExist(err) && err != errHeaderIndexFormat {
+				return err
+			}
+			headerIndexes[index.fileID] = headers
+		}
+		if header, ok := headers[index.id]; ok {
+			return fn(index.id, header)
+		}
+
+		data, err := p.readMessage(index)
+		if _, corrupted := err.(*CorruptedMessageError); corrupted && p.corruptionPolicy != CorruptionFail {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(index.id, messageHeaderValues(data, keys))
+	})
+}
+
+// messageHeaderValues returns the values of the keys in the header of a serialized message,
+// which is the second line, after the metadata line
+func messageHeaderValues(data []byte, keys []string) map[string]string {
+	headerJSON := []byte{}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		headerJSON = data[i+1:]
+		if j := bytes.IndexByte(headerJSON, '\n'); j >= 0 {
+			headerJSON = headerJSON[:j]
+		}
+	}
+	return (&protocol.Message{HeaderJSON: string(headerJSON)}).HeaderValues(keys...)
+}
+
+// writeHeaderIndexStart writes the magic number, the format version and the keys of a new header index
+func writeHeaderIndexStart(w io.Writer, keys []string) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	start := append(append([]byte{}, headerIndexMagic...), headerIndexVersion)
+	start = appendLengthPrefixed(start, data)
+	_, err = w.Write(start)
+	return err
+}
+
+// writeHeaderRecord writes the id and the header values of a message with a single write,
+// so that a concurrent scan reads a partial record at the end of the file at most
+func writeHeaderRecord(w io.Writer, id uint64, values map[string]string) error {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 8, 8+4+len(data))
+	binary.LittleEndian.PutUint64(record, id)
+	_, err = w.Write(appendLengthPrefixed(record, data))
+	return err
+}
+
+func appendLengthPrefixed(buf, data []byte) []byte {
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(len(data)))
+	return append(append(buf, length...), data...)
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(length))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readHeaderIndexStart reads the keys of a header index, returning errHeaderIndexFormat for another format version
+func readHeaderIndexStart(r io.Reader) ([]string, error) {
+	start := make([]byte, len(headerIndexMagic)+1)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, errHeaderIndexFormat
+	}
+	if !bytes.Equal(start[:len(headerIndexMagic)], headerIndexMagic) || start[len(headerIndexMagic)] != headerIndexVersion {
+		return nil, errHeaderIndexFormat
+	}
+	data, err := readLengthPrefixed(r)
+	if err != nil {
+		return nil, errHeaderIndexFormat
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, errHeaderIndexFormat
+	}
+	return keys, nil
+}
+
+// readHeaderIndexKeys returns the keys of a header index file
+func readHeaderIndexKeys(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readHeaderIndexStart(bufio.NewReader(file))
+}
+
+// readHeaderIndex reads the header values by message id from a header index file written with the keys.
+// A partial record at the end of the file, which is being appended, is ignored.
+func readHeaderIndex(filename string, keys []string) (map[uint64]map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	indexedKeys, err := readHeaderIndexStart(r)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(indexedKeys, keys) {
+		return nil, errHeaderIndexFormat
+	}
+
+	headers := make(map[uint64]map[string]string)
+	id := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, id); err != nil {
+			return headers, nil
+		}
+		data, err := readLengthPrefixed(r)
+		if err != nil {
+			return headers, nil
+		}
+		var values map[string]string
+		if err := json.Unmarshal(data, &values); err != nil {
+			return headers, nil
+		}
+		headers[binary.LittleEndian.Uint64(id)] = values
+	}
+}
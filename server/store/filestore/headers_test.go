@@ -0,0 +1,124 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func aMessageWithHeader(id uint64, header string) []byte {
+	return (&protocol.Message{ID: id, Path: "/foo", Time: 1420110000, HeaderJSON: header, Body: []byte("body")}).Bytes()
+}
+
+// scanHeaders returns the indexed header fields of the messages of the partition foo, by id
+func scanHeaders(a *assert.Assertions, mStore *FileMessageStore) map[uint64]map[string]string {
+	headers := make(map[uint64]map[string]string)
+	req := store.NewFetchRequest("foo", 0, 0, store.DirectionForward, -1)
+	a.NoError(mStore.ScanHeaders(req, func(id uint64, header map[string]string) error {
+		headers[id] = header
+		return nil
+	}))
+	return headers
+}
+
+func Test_FileMessageStore_IndexedHeaders(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_headers_test")
+	defer os.RemoveAll(dir)
+
+	// given a store indexing the customer header of the topic
+	mStore := New(dir)
+	mStore.SetIndexedHeaders("/foo", []string{"Customer", "", "Customer"})
+	a.Equal([]string{"Customer"}, mStore.IndexedHeaders("foo"))
+	a.Nil(mStore.IndexedHeaders("bar"))
+
+	// when messages are stored over several files
+	for id := uint64(1); id <= 3; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageWithHeader(id, fmt.Sprintf(`{"customer":"c%d","Other":"x"}`, id))))
+	}
+	a.NoError(mStore.Store("foo", 4, aMessageWithHeader(4, "")))
+
+	// then their indexed fields are scanned
+	expected := map[uint64]map[string]string{
+		1: {"Customer": "c1"},
+		2: {"Customer": "c2"},
+		3: {"Customer": "c3"},
+		4: {},
+	}
+	a.Equal(expected, scanHeaders(a, mStore))
+	_, err := os.Stat(dir + "/foo/foo-00000000000000000001.hdx")
+	a.NoError(err)
+
+	// and without the messages, as a message removed from its file is still scanned by the header index
+	a.NoError(os.Truncate(dir+"/foo/foo-00000000000000000000.msg", 0))
+	a.Equal(expected, scanHeaders(a, mStore))
+
+	// and the headers of a partition not indexed cannot be scanned
+	a.Error(mStore.ScanHeaders(store.NewFetchRequest("bar", 0, 0, store.DirectionForward, -1), func(uint64, map[string]string) error {
+		return nil
+	}))
+}
+
+func Test_FileMessageStore_HeaderIndexIsRebuiltWhenTheKeysChange(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(2)
+
+	dir, _ := ioutil.TempDir("", "guble_headers_test")
+	defer os.RemoveAll(dir)
+
+	// given messages stored without a header index
+	mStore := New(dir)
+	for id := uint64(1); id <= 3; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageWithHeader(id, fmt.Sprintf(`{"Customer":"c%d","Region":"r%d"}`, id, id))))
+	}
+	a.NoError(mStore.Stop())
+
+	// when the store is restarted indexing a header, then the existing messages are indexed on startup
+	mStore = New(dir)
+	mStore.SetIndexedHeaders("/foo", []string{"Customer"})
+	a.NoError(mStore.Start())
+	_, err := os.Stat(dir + "/foo/foo-00000000000000000000.hdx")
+	a.NoError(err)
+	a.Equal(map[uint64]map[string]string{
+		1: {"Customer": "c1"},
+		2: {"Customer": "c2"},
+		3: {"Customer": "c3"},
+	}, scanHeaders(a, mStore))
+	a.NoError(mStore.Store("foo", 4, aMessageWithHeader(4, `{"Customer":"c4","Region":"r4"}`)))
+	a.NoError(mStore.Stop())
+
+	// and a header index of another format version is rebuilt as well, with the changed keys
+	hdx := dir + "/foo/foo-00000000000000000000.hdx"
+	data, err := ioutil.ReadFile(hdx)
+	a.NoError(err)
+	data[len(headerIndexMagic)] = headerIndexVersion + 1
+	a.NoError(ioutil.WriteFile(hdx, data, 0666))
+
+	mStore = New(dir)
+	mStore.SetIndexedHeaders("/foo", []string{"Region", "Customer"})
+	a.NoError(mStore.Start())
+	defer mStore.Stop()
+	a.Equal(map[uint64]map[string]string{
+		1: {"Customer": "c1", "Region": "r1"},
+		2: {"Customer": "c2", "Region": "r2"},
+		3: {"Customer": "c3", "Region": "r3"},
+		4: {"Customer": "c4", "Region": "r4"},
+	}, scanHeaders(a, mStore))
+	a.Equal([]uint64{1, 2, 3, 4}, fetchIDs(a, mStore, 0, 10))
+
+	// and the header index is removed without indexed keys
+	mStore.SetIndexedHeaders("/foo", nil)
+	_, err = os.Stat(hdx)
+	a.True(os.IsNotExist(err))
+	a.Equal([]uint64{1, 2, 3, 4}, fetchIDs(a, mStore, 0, 10))
+}
@@ -204,15 +204,25 @@ func (l *indexList) extract(req *store.FetchRequest) *indexList {
 	currentPos := lastPos
 	if found {
 		currentPos = pos
+	} else if closest := l.get(lastPos); closest != nil && req.StartID > 0 {
+		// the closest entry may be on the wrong side of the StartID, which is not part of the result
+		if req.Direction >= 0 && closest.id < req.StartID {
+			currentPos++
+		} else if req.Direction < 0 && closest.id > req.StartID {
+			currentPos--
+		}
 	}
 
 	for potentialEntries.len() < req.Count && currentPos >= 0 && currentPos < l.len() {
 		elem := l.get(currentPos)
-		logger.WithFields(log.Fields{
-			"elem":       *elem,
-			"currentPos": currentPos,
-			"req":        *req,
-		}).Debug("Elem in retrieve")
+		// the fields of the entry are only composed for the debug level, as this runs for each fetched message
+		if log.GetLevel() >= log.DebugLevel {
+			logger.WithFields(log.Fields{
+				"elem":       *elem,
+				"currentPos": currentPos,
+				"req":        *req,
+			}).Debug("Elem in retrieve")
+		}
 
 		if elem == nil {
 			logger.WithFields(log.Fields{
@@ -225,6 +235,11 @@ func (l *indexList) extract(req *store.FetchRequest) *indexList {
 			break
 		}
 
+		// the EndID may not be an existing message id, so a later message does not belong to the result
+		if req.EndID > 0 && req.Direction >= 0 && elem.id > req.EndID {
+			break
+		}
+
 		potentialEntries.insert(elem)
 		currentPos += int(req.Direction)
 
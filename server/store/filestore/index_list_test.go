@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/server/store"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -62,3 +63,34 @@ func Test_SortedListSanity(t *testing.T) {
 	a.Nil(list.back())
 
 }
+
+func Test_ExtractStartsAtTheStartID(t *testing.T) {
+	a := assert.New(t)
+	list := newIndexList(3)
+	for _, id := range []uint64{10, 20, 30} {
+		list.insert(&index{id: id, size: 3})
+	}
+
+	ids := func(l *indexList) (result []uint64) {
+		for _, i := range l.toSliceArray() {
+			result = append(result, i.id)
+		}
+		return
+	}
+
+	// a missing StartID closer to the previous entry is not included
+	a.Equal([]uint64{20, 30}, ids(list.extract(&store.FetchRequest{StartID: 11, Direction: 1, Count: 10})))
+	a.Equal([]uint64{20, 30}, ids(list.extract(&store.FetchRequest{StartID: 19, Direction: 1, Count: 10})))
+	a.Equal([]uint64{20, 30}, ids(list.extract(&store.FetchRequest{StartID: 20, Direction: 1, Count: 10})))
+	a.Equal([]uint64{10, 20, 30}, ids(list.extract(&store.FetchRequest{StartID: 0, Direction: 1, Count: 10})))
+	a.Empty(ids(list.extract(&store.FetchRequest{StartID: 31, Direction: 1, Count: 10})))
+
+	// and backwards
+	a.Equal([]uint64{10, 20}, ids(list.extract(&store.FetchRequest{StartID: 29, Direction: -1, Count: 10})))
+	a.Equal([]uint64{10}, ids(list.extract(&store.FetchRequest{StartID: 11, Direction: -1, Count: 10})))
+
+	// the EndID is inclusive, also if it is not an existing id
+	a.Equal([]uint64{10, 20}, ids(list.extract(&store.FetchRequest{StartID: 10, EndID: 20, Direction: 1, Count: 10})))
+	a.Equal([]uint64{10, 20}, ids(list.extract(&store.FetchRequest{StartID: 10, EndID: 25, Direction: 1, Count: 10})))
+	a.Empty(ids(list.extract(&store.FetchRequest{StartID: 11, EndID: 15, Direction: 1, Count: 10})))
+}
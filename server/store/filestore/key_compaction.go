@@ -0,0 +1,93 @@
+package filestore
+
+// SetCompactionKey enables the key compaction of a topic: the periodic compaction keeps only the latest message
+// for each value of the header field key, and removes the older messages with the same value.
+// So a replay of the topic from its first message returns the current state of each key,
+// followed by the messages stored since the last compaction. The messages without the header field are kept.
+// As the messages are stored per partition, the key applies to the whole partition of the topic.
+// An empty key disables the key compaction.
+func (fms *FileMessageStore) SetCompactionKey(topic string, key string) {
+	partitionName := partitionOfTopic(topic)
+
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	if key != "" {
+		fms.compactionKeys[partitionName] = key
+	} else {
+		delete(fms.compactionKeys, partitionName)
+	}
+	if p, exist := fms.partitions[partitionName]; exist {
+		p.setCompactionKey(key)
+	}
+}
+
+func (p *messagePartition) setCompactionKey(key string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.compactionKey = key
+}
+
+func (p *messagePartition) getCompactionKey() string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.compactionKey
+}
+
+// supersededMessages returns the ids of the messages, which are followed by a message with the same value
+// of the compaction key; the caller has to hold the lock
+func (p *messagePartition) supersededMessages() (map[uint64]bool, error) {
+	latest := make(map[string]uint64)
+	superseded := make(map[uint64]bool)
+
+	visit := func(fileID int, l *indexList) error {
+		if l.len() == 0 {
+			return nil
+		}
+		file, err := p.openSegment(fileID)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		for _, index := range l.toSliceArray() {
+			data, err := readRecord(file, index)
+			if _, corrupted := err.(*CorruptedMessageError); corrupted {
+				// the corrupted messages are handled by the compaction, according to the corruption policy
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			key, ok := messageHeaderValues(data, []string{p.compactionKey})[p.compactionKey]
+			if !ok || key == "" {
+				continue
+			}
+			if last, exist := latest[key]; exist {
+				if last > index.id {
+					superseded[index.id] = true
+					continue
+				}
+				superseded[last] = true
+			}
+			latest[key] = index.id
+		}
+		return nil
+	}
+
+	for fileID := 0; fileID < p.fileCache.length(); fileID++ {
+		l, err := p.loadIndexList(fileID)
+		if err != nil {
+			return nil, err
+		}
+		if err := visit(fileID, l); err != nil {
+			return nil, err
+		}
+	}
+	if err := visit(p.fileCache.length(), p.list); err != nil {
+		return nil, err
+	}
+	return superseded, nil
+}
@@ -0,0 +1,111 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func aMessageWithDevice(id uint64, ts int64, device string) []byte {
+	m := &protocol.Message{
+		ID:   id,
+		Path: protocol.Path("/foo/bar"),
+		Time: ts,
+		Body: []byte(fmt.Sprintf("status %d", id)),
+	}
+	if device != "" {
+		m.HeaderJSON = fmt.Sprintf(`{"Device-Id":%q}`, device)
+	}
+	return m.Bytes()
+}
+
+func Test_MessagePartition_KeyCompaction(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	// allow three messages per file
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_key_compaction_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetCompactionKey("/foo", "device-id")
+
+	// given the states of three devices and a message without device, spread over three files
+	now := time.Now().Unix()
+	for i, device := range []string{"d1", "d2", "d1", "", "d3", "d2", "d1"} {
+		id := uint64(i + 1)
+		a.NoError(mStore.Store("foo", id, aMessageWithDevice(id, now, device)))
+	}
+	a.Equal([]uint64{1, 2, 3, 4, 5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+
+	// when compacting
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	removed, err := p.(*messagePartition).compact(time.Now())
+
+	// then only the latest message of each device, and the message without device remain
+	a.NoError(err)
+	a.Equal(3, removed)
+	a.Equal([]uint64{4, 5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+	a.Equal(uint64(4), p.Count())
+	a.Equal(uint64(7), p.MaxMessageID())
+
+	// and a next compaction, without superseded messages, removes nothing
+	removed, err = p.(*messagePartition).compact(time.Now())
+	a.NoError(err)
+	a.Equal(0, removed)
+
+	// and a new state supersedes the compacted one
+	a.NoError(mStore.Store("foo", 8, aMessageWithDevice(8, now, "d3")))
+	removed, err = p.(*messagePartition).compact(time.Now())
+	a.NoError(err)
+	a.Equal(1, removed)
+	a.Equal([]uint64{4, 6, 7, 8}, fetchIDs(a, mStore, 0, 10))
+
+	// and the compacted files can be loaded again
+	a.NoError(mStore.Stop())
+	mStore = New(dir)
+	a.Equal([]uint64{4, 6, 7, 8}, fetchIDs(a, mStore, 0, 10))
+}
+
+func Test_MessagePartition_KeyCompactionWithTTL(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_key_compaction_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetCompactionKey("/foo", "Device-Id")
+	mStore.SetTTL("/foo", time.Hour)
+
+	// given an expired latest state of a device, and a superseded one of another device
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	now := time.Now().Unix()
+	a.NoError(mStore.Store("foo", 1, aMessageWithDevice(1, old, "d1")))
+	a.NoError(mStore.Store("foo", 2, aMessageWithDevice(2, now, "d2")))
+	a.NoError(mStore.Store("foo", 3, aMessageWithDevice(3, now, "d2")))
+
+	// then the compaction removes both
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	removed, err := p.(*messagePartition).compact(time.Now())
+	a.NoError(err)
+	a.Equal(2, removed)
+	a.Equal([]uint64{3}, fetchIDs(a, mStore, 0, 10))
+
+	// and without compaction key, the messages are kept
+	mStore.SetCompactionKey("/foo", "")
+	mStore.SetTTL("/foo", 0)
+	a.NoError(mStore.Store("foo", 4, aMessageWithDevice(4, now, "d2")))
+	removed, err = p.(*messagePartition).compact(time.Now())
+	a.NoError(err)
+	a.Equal(0, removed)
+	a.Equal([]uint64{3, 4}, fetchIDs(a, mStore, 0, 10))
+}
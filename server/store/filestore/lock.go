@@ -0,0 +1,93 @@
+package filestore
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// lockFileName is the file in the base directory, locked by the started FileMessageStore
+	lockFileName = "guble.lock"
+
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+// ErrLocked is returned by Start, if the base directory is still locked by another process after the lock timeout
+var ErrLocked = errors.New("The storage path is locked by another guble process")
+
+// SetLockTimeout sets the maximum duration Start waits for the lock of the base directory, held by another process.
+// This is the previous process on a graceful restart, which releases the lock when its store is stopped.
+// With the default of zero, Start fails at once if the directory is locked.
+func (fms *FileMessageStore) SetLockTimeout(timeout time.Duration) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.lockTimeout = timeout
+}
+
+// lock acquires the exclusive lock of the base directory, so that two processes never write the same files.
+// The lock is released by the operating system, if the process exits without stopping the store.
+func (fms *FileMessageStore) lock() error {
+	fms.mutex.RLock()
+	locked, timeout := fms.lockFile != nil, fms.lockTimeout
+	fms.mutex.RUnlock()
+	if locked {
+		return nil
+	}
+
+	if err := os.MkdirAll(fms.basedir, 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path.Join(fms.basedir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		logger.WithFields(log.Fields{"basedir": fms.basedir, "timeout": timeout}).Error("The storage path is locked")
+		return ErrLocked
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// the pid of the owner for the operators, the lock itself is not bound to the content
+	file.Truncate(0)
+	file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+
+	fms.mutex.Lock()
+	fms.lockFile = file
+	fms.mutex.Unlock()
+	logger.WithField("basedir", fms.basedir).Info("Locked the storage path")
+	return nil
+}
+
+// unlock releases the lock of the base directory. It has to be called with the mutex held.
+func (fms *FileMessageStore) unlock() error {
+	if fms.lockFile == nil {
+		return nil
+	}
+	file := fms.lockFile
+	fms.lockFile = nil
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN); err != nil {
+		file.Close()
+		return err
+	}
+	logger.WithField("basedir", fms.basedir).Info("Unlocked the storage path")
+	return file.Close()
+}
@@ -0,0 +1,41 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_LocksTheBaseDirectory(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_lock_test")
+	defer os.RemoveAll(dir)
+
+	// given a started store
+	first := New(dir)
+	a.NoError(first.Start())
+
+	// then another store of the same directory can not be started
+	second := New(dir)
+	a.Equal(ErrLocked, second.Start())
+
+	// when waiting for the lock, then it is started after the first store is stopped
+	second.SetLockTimeout(time.Second)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Stop()
+	}()
+	start := time.Now()
+	a.NoError(second.Start())
+	a.True(time.Since(start) >= 50*time.Millisecond)
+
+	// and the lock is released again by stopping it
+	a.NoError(second.Stop())
+	third := New(dir)
+	a.NoError(third.Start())
+	a.NoError(third.Stop())
+}
@@ -10,6 +10,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/store"
 
 	"io"
@@ -19,19 +20,11 @@ import (
 
 var (
 	magicNumber       = []byte{42, 249, 180, 108, 82, 75, 222, 182}
-	fileFormatVersion = []byte{1}
+	fileFormatVersion = []byte{formatVersionWithChecksum}
 	messagesPerFile   = uint64(10000)
 	indexEntrySize    = 20
 )
 
-const (
-	gubleNodeIdBits    = 3
-	sequenceBits       = 12
-	gubleNodeIdShift   = sequenceBits
-	timestampLeftShift = sequenceBits + gubleNodeIdBits
-	gubleEpoch         = 1467714505012
-)
-
 type index struct {
 	id     uint64
 	offset uint64
@@ -46,21 +39,54 @@ type messagePartition struct {
 	indexFile             *os.File
 	appendFilePosition    uint64
 	maxMessageID          uint64
-	sequenceNumber        uint64
+	lastGeneratedID       uint64
 	totalNumberOfMessages uint64
 	entriesCount          uint64
 	list                  *indexList
 	fileCache             *cache
+	ttls                  topicTTLs
+	compactionKey         string
+	idGenerator           store.IDGenerator
+
+	// maxMessages limits the number of messages kept in the partition.
+	// The messages with an id lower than firstRetainedID are evicted and removed by the next compaction.
+	maxMessages     int
+	firstRetainedID uint64
+	evictedMessages uint64
+	eviction        evictionCursor
+
+	// batcher groups the writes of StoreMessage, if the store is batching them
+	batcher *batcher
+
+	// compress enables the compression of the message files when they are sealed
+	compress      bool
+	compressionWG sync.WaitGroup
+	decompressed  segmentCache
+
+	// compactionMutex is held for writing during compaction and for reading by running fetches,
+	// because compaction rewrites the files under the feet of the readers
+	compactionMutex sync.RWMutex
+
+	// appendVersion is the format version of the file being appended, which may be an older one after a restart
+	appendVersion byte
+
+	// corruptionPolicy is the handling of the corrupted messages by the fetches
+	corruptionPolicy CorruptionPolicy
+
+	// indexedHeaders are the header keys written to the header index of the current file, by headerFile
+	indexedHeaders []string
+	headerFile     *os.File
 
 	sync.RWMutex
 }
 
 func newMessagePartition(basedir string, storeName string) (*messagePartition, error) {
 	p := &messagePartition{
-		basedir:   basedir,
-		name:      storeName,
-		list:      newIndexList(int(messagesPerFile)),
-		fileCache: newCache(),
+		basedir:     basedir,
+		name:        storeName,
+		list:        newIndexList(int(messagesPerFile)),
+		fileCache:   newCache(),
+		idGenerator: store.SequenceIDGenerator{},
 	}
 	return p, p.initialize()
 }
@@ -80,7 +106,7 @@ func (p *messagePartition) Count() uint64 {
 	p.RLock()
 	defer p.RUnlock()
 
-	return p.totalNumberOfMessages
+	return p.totalNumberOfMessages - p.evictedMessages
 }
 
 func (p *messagePartition) initialize() error {
@@ -137,7 +163,11 @@ func (p *messagePartition) readIdxFiles() error {
 			return err
 		}
 		//add to total number of messages per partition
-		p.totalNumberOfMessages += messagesPerFile
+		entriesInIndex, err := calculateNoEntries(indexFilenames[i])
+		if err != nil {
+			return err
+		}
+		p.totalNumberOfMessages += entriesInIndex
 
 		// put entry in file cache
 		p.fileCache.add(cEntry)
@@ -160,6 +190,10 @@ func (p *messagePartition) readIdxFiles() error {
 		}).Error("Error loading last .idx file")
 		return err
 	}
+	if err := p.repairAppendFile(); err != nil {
+		logger.WithError(err).Error("Error repairing the last message file")
+		return err
+	}
 	//add the last part
 	p.totalNumberOfMessages += uint64(p.list.len())
 	back := p.list.back()
@@ -172,6 +206,15 @@ func (p *messagePartition) readIdxFiles() error {
 }
 
 func (p *messagePartition) closeAppendFiles() error {
+	// the batched writes are only acknowledged after a sync, also of the files closed on rotation
+	if p.batcher != nil {
+		if err := p.sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.closeHeaderFile(); err != nil {
+		return err
+	}
 	if p.appendFile != nil {
 		if err := p.appendFile.Close(); err != nil {
 			if p.indexFile != nil {
@@ -197,6 +240,12 @@ func readCacheEntryFromIdxFile(filename string) (entry *cacheEntry, err error) {
 		return
 	}
 
+	// all messages of the file may have been removed by compaction
+	if entriesInIndex == 0 {
+		entry = &cacheEntry{}
+		return
+	}
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return
@@ -225,7 +274,8 @@ func (p *messagePartition) createNextAppendFiles() error {
 		return err
 	}
 
-	// write file header on new files
+	// write file header on new files, and append the existing ones in their format version
+	p.appendVersion = fileFormatVersion[0]
 	if stat, _ := appendfile.Stat(); stat.Size() == 0 {
 		p.appendFilePosition = uint64(stat.Size())
 
@@ -238,6 +288,9 @@ func (p *messagePartition) createNextAppendFiles() error {
 		if err != nil {
 			return err
 		}
+	} else if p.appendVersion, err = readFormatVersion(appendfile); err != nil {
+		appendfile.Close()
+		return err
 	}
 
 	indexfile, errIndex := os.OpenFile(p.composeIdxFilenameForPosition(uint64(p.fileCache.length())), os.O_RDWR|os.O_CREATE, 0666)
@@ -262,35 +315,33 @@ func (p *messagePartition) generateNextMsgID(nodeID uint8) (uint64, int64, error
 	p.Lock()
 	defer p.Unlock()
 
-	//Get the local Timestamp
-	currTime := time.Now()
-	// timestamp in Seconds will be return to client
-	timestamp := currTime.Unix()
-
-	//Use the unixNanoTimestamp for generating id
-	nanoTimestamp := currTime.UnixNano()
+	return p.nextMsgID(nodeID)
+}
 
-	if nanoTimestamp < gubleEpoch {
-		err := fmt.Errorf("Clock is moving backwards. Rejecting requests until %d.", timestamp)
+// nextMsgID generates the id of the next message by the IDGenerator; the caller has to hold the lock
+func (p *messagePartition) nextMsgID(nodeID uint8) (uint64, int64, error) {
+	if p.lastGeneratedID < p.maxMessageID {
+		p.lastGeneratedID = p.maxMessageID
+	}
+	id, timestamp, err := p.idGenerator.NextID(p.lastGeneratedID, nodeID)
+	if err != nil {
 		return 0, 0, err
 	}
-
-	id := (uint64(nanoTimestamp-gubleEpoch) << timestampLeftShift) |
-		(uint64(nodeID) << gubleNodeIdShift) | p.sequenceNumber
-
-	p.sequenceNumber++
+	p.lastGeneratedID = id
 
 	logger.WithFields(log.Fields{
-		"id":                  id,
-		"messagePartition":    p.basedir,
-		"localSequenceNumber": p.sequenceNumber,
-		"currentNode":         nodeID,
+		"id":               id,
+		"messagePartition": p.basedir,
+		"currentNode":      nodeID,
 	}).Debug("Generated id")
 
 	return id, timestamp, nil
 }
 
 func (p *messagePartition) Close() error {
+	// the running compression has to finish, before the files are closed
+	p.compressionWG.Wait()
+
 	p.Lock()
 	defer p.Unlock()
 
@@ -307,7 +358,16 @@ func (p *messagePartition) Store(msgID uint64, msg []byte) error {
 	p.Lock()
 	defer p.Unlock()
 
-	return p.store(msgID, msg)
+	defer observeLatency("write", time.Now())
+	if err := p.store(msgID, msg); err != nil {
+		return err
+	}
+
+	// the message is stored, so a failing eviction only delays it until the next write
+	if err := p.evict(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error evicting messages")
+	}
+	return nil
 }
 
 func (p *messagePartition) store(messageID uint64, data []byte) error {
@@ -343,6 +403,9 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 				min: p.list.front().id,
 				max: p.list.back().id,
 			})
+			if p.compress {
+				p.compressInBackground(p.fileCache.length() - 1)
+			}
 
 			//clear the current sorted cache
 			p.list.clear()
@@ -354,26 +417,21 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 		}
 	}
 
-	// write the message size and the message id: 32 bit and 64 bit, so 12 bytes
-	sizeAndID := make([]byte, 12)
-	binary.LittleEndian.PutUint32(sizeAndID, uint32(len(data)))
-	binary.LittleEndian.PutUint64(sizeAndID[4:], messageID)
-
-	if _, err := p.appendFile.Write(sizeAndID); err != nil {
-		return err
-	}
-
-	// write the message
-	if _, err := p.appendFile.Write(data); err != nil {
+	// write the message with its size, id and checksum
+	headerSize, err := writeRecord(p.appendFile, p.appendVersion, messageID, data)
+	if err != nil {
 		return err
 	}
 
 	// write the index entry to the index file
-	messageOffset := p.appendFilePosition + uint64(len(sizeAndID))
-	err := writeIndexEntry(p.indexFile, messageID, messageOffset, uint32(len(data)), p.entriesCount)
+	messageOffset := p.appendFilePosition + uint64(headerSize)
+	err = writeIndexEntry(p.indexFile, messageID, messageOffset, uint32(len(data)), p.entriesCount)
 	if err != nil {
 		return err
 	}
+	if err := p.indexHeaders(messageID, data); err != nil {
+		return err
+	}
 	p.entriesCount++
 	p.totalNumberOfMessages++
 
@@ -394,7 +452,7 @@ func (p *messagePartition) store(messageID uint64, data []byte) error {
 	}
 	p.list.insert(e)
 
-	p.appendFilePosition += uint64(len(sizeAndID) + len(data))
+	p.appendFilePosition += uint64(headerSize + len(data))
 
 	if messageID > p.maxMessageID {
 		p.maxMessageID = messageID
@@ -414,7 +472,16 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 	le.Debug("Fetching")
 
 	go func() {
+		// The files are opened while holding the lock. A compaction afterwards replaces the files,
+		// but the offsets of the fetch list stay valid for the already opened ones.
+		p.compactionMutex.RLock()
 		fetchList, err := p.calculateFetchList(req)
+		var files map[int]*messageFile
+		if err == nil {
+			files, err = p.openFiles(fetchList)
+		}
+		p.compactionMutex.RUnlock()
+		defer closeFiles(files)
 
 		if err != nil {
 			log.WithField("err", err).Error("Error calculating list")
@@ -423,7 +490,7 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 		}
 		req.StartC <- fetchList.len()
 
-		err = p.fetchByFetchlist(fetchList, req)
+		err = p.fetchByFetchlist(fetchList, files, req)
 
 		if err != nil {
 			le.WithField("err", err).Error("Error calculating list")
@@ -434,22 +501,47 @@ func (p *messagePartition) Fetch(req *store.FetchRequest) {
 	}()
 }
 
-// fetchByFetchlist fetches the messages in the supplied fetchlist and sends them to the message-channel
-func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.FetchRequest) error {
+// openFiles opens the message files of all entries in the fetchlist, by file id
+func (p *messagePartition) openFiles(fetchList *indexList) (map[int]*messageFile, error) {
+	files := make(map[int]*messageFile)
+	err := fetchList.mapWithPredicate(func(index *index, _ int) error {
+		if _, opened := files[index.fileID]; opened {
+			return nil
+		}
+		file, err := p.openSegment(index.fileID)
+		if err != nil {
+			return err
+		}
+		files[index.fileID] = file
+		return nil
+	})
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+func closeFiles(files map[int]*messageFile) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// fetchByFetchlist fetches the messages in the supplied fetchlist from the opened files
+// and sends them to the message-channel. The corrupted messages are skipped, or end the fetch with the fail policy.
+func (p *messagePartition) fetchByFetchlist(fetchList *indexList, files map[int]*messageFile, req *store.FetchRequest) error {
 	return fetchList.mapWithPredicate(func(index *index, _ int) error {
 		if req.IsDone() {
 			return store.ErrRequestDone
 		}
 
-		filename := p.composeMsgFilenameForPosition(uint64(index.fileID))
-		file, err := os.Open(filename)
-		if err != nil {
-			return err
+		start := time.Now()
+		msg, err := readRecord(files[index.fileID], index)
+		observeLatency("read", start)
+		if _, corrupted := err.(*CorruptedMessageError); corrupted && p.corruptionPolicy != CorruptionFail {
+			return nil
 		}
-		defer file.Close()
-
-		msg := make([]byte, index.size, index.size)
-		_, err = file.ReadAt(msg, int64(index.offset))
 		if err != nil {
 			logger.WithFields(log.Fields{
 				"err":    err,
@@ -463,12 +555,45 @@ func (p *messagePartition) fetchByFetchlist(fetchList *indexList, req *store.Fet
 	})
 }
 
+// observeLatency records the duration of a message store operation since the start
+func observeLatency(operation string, start time.Time) {
+	metrics.PromMessageStoreLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
 // calculateFetchList returns a list of fetchEntry records for all messages in the fetch request.
 func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexList, error) {
 	if req.Direction == 0 {
 		req.Direction = 1
 	}
 
+	// With a TTL or a max messages limit, the expired and evicted messages are skipped while building the list,
+	// so the Count applies to the surviving messages only. A start position in a region removed by compaction
+	// or evicted is moved to the oldest surviving message, without changing the request of the caller.
+	ttls := p.getTTLs()
+	now := time.Now()
+	firstRetainedID := p.retentionStart()
+	withoutExpired := func(l *indexList) (*indexList, error) {
+		l = withoutEvicted(l, firstRetainedID)
+		if len(ttls) == 0 {
+			return l, nil
+		}
+		return p.withoutExpired(l, ttls, now)
+	}
+	if (len(ttls) > 0 || firstRetainedID > 0) && req.StartID > 0 && req.Direction > 0 {
+		oldestID := p.oldestMessageID()
+		if firstRetainedID > oldestID {
+			oldestID = firstRetainedID
+		}
+		if req.StartID < oldestID {
+			req = &store.FetchRequest{
+				StartID:   oldestID,
+				EndID:     req.EndID,
+				Direction: req.Direction,
+				Count:     req.Count,
+			}
+		}
+	}
+
 	potentialEntries := newIndexList(0)
 
 	// reading from IndexFiles
@@ -484,8 +609,12 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 			prev = true
 
 			l, err := p.loadIndexList(i)
+			if err == nil {
+				l, err = withoutExpired(l)
+			}
 			if err != nil {
 				logger.WithError(err).Info("Error loading idx file in memory")
+				p.fileCache.RUnlock()
 				return nil, err
 			}
 
@@ -497,7 +626,12 @@ func (p *messagePartition) calculateFetchList(req *store.FetchRequest) (*indexLi
 
 	// Read from current cached value (the idx file which size is smaller than MESSAGE_PER_FILE
 	if p.list.contains(req.StartID) || (prev && potentialEntries.len() < req.Count) {
-		potentialEntries.insert(p.list.extract(req).toSliceArray()...)
+		l, err := withoutExpired(p.list)
+		if err != nil {
+			p.fileCache.RUnlock()
+			return nil, err
+		}
+		potentialEntries.insert(l.extract(req).toSliceArray()...)
 	}
 
 	// Currently potentialEntries contains a potentials IDs from any files and
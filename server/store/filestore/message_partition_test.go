@@ -48,6 +48,10 @@ func TestFileMessageStore_GenerateNextMsgIdMultipleNodes(t *testing.T) {
 	mStore2, err := newMessagePartition(dir2, "node1")
 	a.Nil(err)
 
+	// the snowflake ids of the nodes are ordered by time over both partitions
+	mStore.idGenerator = store.NewSnowflakeIDGenerator()
+	mStore2.idGenerator = store.NewSnowflakeIDGenerator()
+
 	var generatedIDs []uint64
 	lastID := uint64(0)
 
@@ -81,27 +85,27 @@ func Test_MessagePartition_loadFiles(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	msgData := []byte("aaaaaaaaaa")             // 10 bytes message
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 	a.Equal(uint64(13), mStore.Count())
 
 	a.NoError(mStore.Close())
@@ -201,29 +205,29 @@ func Test_calculateFetchList(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	// File header: MAGIC_NUMBER + FILE_NUMBER_VERSION = 9 bytes in the file
-	// For each stored message there is a 12 bytes write that contains the msgID and size
+	// For each stored message there is a 16 bytes write that contains the size, the msgID and the checksum
 
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData)) // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 
 	defer a.NoError(mStore.Close())
 
@@ -235,34 +239,34 @@ func Test_calculateFetchList(t *testing.T) {
 		{`direct match`,
 			store.FetchRequest{StartID: 3, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{3, uint64(21), 10, 0}}, // messageId, offset, size, fileId
+				items: []*index{{3, uint64(25), 10, 0}}, // messageId, offset, size, fileId
 			},
 		},
 		{`direct match in second file`,
 			store.FetchRequest{StartID: 8, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{8, uint64(21), 10, 1}}, // messageId, offset, size, fileId,
+				items: []*index{{8, uint64(25), 10, 1}}, // messageId, offset, size, fileId,
 			},
 		},
 		{`direct match in second file, not first position`,
 			store.FetchRequest{StartID: 13, Direction: 0, Count: 1},
 			indexList{
-				items: []*index{{13, uint64(65), 10, 1}}, // messageId, offset, size, fileId,
+				items: []*index{{13, uint64(77), 10, 1}}, // messageId, offset, size, fileId,
 			},
 		},
 		// TODO this is caused by hasStartID() functions.This will be done when implementing the EndID logic
 		// {`next entry matches`,
 		// 	store.FetchRequest{StartID: 1, Direction: 0, Count: 1},
 		// 	SortedIndexList{
-		// 		{3, uint64(21), 10, 0}, // messageId, offset, size, fileId
+		// 		{3, uint64(25), 10, 0}, // messageId, offset, size, fileId
 		// 	},
 		// },
 		{`entry before matches`,
 			store.FetchRequest{StartID: 5, Direction: -1, Count: 2},
 			indexList{
 				items: []*index{
-					{4, uint64(43), 10, 0},  // messageId, offset, size, fileId
-					{5, uint64(109), 10, 0}, // messageId, offset, size, fileId
+					{4, uint64(51), 10, 0},  // messageId, offset, size, fileId
+					{5, uint64(129), 10, 0}, // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -282,9 +286,9 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 9, Direction: 1, Count: 3},
 			indexList{
 				items: []*index{
-					{9, uint64(87), 10, 0},  // messageId, offset, size, fileId
-					{10, uint64(65), 10, 0}, // messageId, offset, size, fileId
-					{13, uint64(65), 10, 1}, // messageId, offset, size, fileId
+					{9, uint64(103), 10, 0}, // messageId, offset, size, fileId
+					{10, uint64(77), 10, 0}, // messageId, offset, size, fileId
+					{13, uint64(77), 10, 1}, // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -292,11 +296,11 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 26, Direction: -1, Count: 4},
 			indexList{
 				items: []*index{
-					// {15, uint64(43), 10, 1},  // messageId, offset, size, fileId
-					{22, uint64(87), 10, 1},  // messageId, offset, size, fileId
-					{23, uint64(109), 10, 1}, // messageId, offset, size, fileId
-					{24, uint64(21), 10, 2},  // messageId, offset, size, fileId
-					{26, uint64(43), 10, 2},  // messageId, offset, size, fileId
+					// {15, uint64(51), 10, 1},  // messageId, offset, size, fileId
+					{22, uint64(103), 10, 1}, // messageId, offset, size, fileId
+					{23, uint64(129), 10, 1}, // messageId, offset, size, fileId
+					{24, uint64(25), 10, 2},  // messageId, offset, size, fileId
+					{26, uint64(51), 10, 2},  // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -304,16 +308,16 @@ func Test_calculateFetchList(t *testing.T) {
 			store.FetchRequest{StartID: 5, Direction: 1, Count: 10},
 			indexList{
 				items: []*index{
-					{5, uint64(109), 10, 0},  // messageId, offset, size, fileId
-					{8, uint64(21), 10, 1},   // messageId, offset, size, fileId
-					{9, uint64(87), 10, 0},   // messageId, offset, size, fileId
-					{10, uint64(65), 10, 0},  // messageId, offset, size, fileId
-					{13, uint64(65), 10, 1},  // messageId, offset, size, fileId
-					{15, uint64(43), 10, 1},  // messageId, offset, size, fileId
-					{22, uint64(87), 10, 1},  // messageId, offset, size, fileId
-					{23, uint64(109), 10, 1}, // messageId, offset, size, fileId
-					{24, uint64(21), 10, 2},  // messageId, offset, size, fileId
-					{26, uint64(43), 10, 2},  // messageId, offset, size, fileId
+					{5, uint64(129), 10, 0},  // messageId, offset, size, fileId
+					{8, uint64(25), 10, 1},   // messageId, offset, size, fileId
+					{9, uint64(103), 10, 0},  // messageId, offset, size, fileId
+					{10, uint64(77), 10, 0},  // messageId, offset, size, fileId
+					{13, uint64(77), 10, 1},  // messageId, offset, size, fileId
+					{15, uint64(51), 10, 1},  // messageId, offset, size, fileId
+					{22, uint64(103), 10, 1}, // messageId, offset, size, fileId
+					{23, uint64(129), 10, 1}, // messageId, offset, size, fileId
+					{24, uint64(25), 10, 2},  // messageId, offset, size, fileId
+					{26, uint64(51), 10, 2},  // messageId, offset, size, fileId
 				},
 			},
 		},
@@ -362,29 +366,29 @@ func Test_Partition_Fetch(t *testing.T) {
 	mStore, _ := newMessagePartition(dir, "myMessages")
 
 	// File header: MAGIC_NUMBER + FILE_NUMBER_VERSION = 9 bytes in the file
-	// For each stored message there is a 12 bytes write that contains the msgID and size
+	// For each stored message there is a 16 bytes write that contains the size, the msgID and the checksum
 
-	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 21, size: 10
-	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 21+10+12=43
+	a.NoError(mStore.Store(uint64(3), msgData)) // stored offset 25, size: 10
+	a.NoError(mStore.Store(uint64(4), msgData)) // stored offset 25+10+16=51
 
-	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 43+22=65
+	a.NoError(mStore.Store(uint64(10), msgData)) // stored offset 51+26=77
 
-	a.NoError(mStore.Store(uint64(9), msgData2)) // stored offset 65+22=87
-	a.NoError(mStore.Store(uint64(5), msgData3)) // stored offset 87+22=109
+	a.NoError(mStore.Store(uint64(9), msgData2)) // stored offset 77+26=103
+	a.NoError(mStore.Store(uint64(5), msgData3)) // stored offset 103+26=129
 
 	// here second file will start
-	a.NoError(mStore.Store(uint64(8), msgData2))  // stored offset 21
-	a.NoError(mStore.Store(uint64(15), msgData))  // stored offset 43
-	a.NoError(mStore.Store(uint64(13), msgData3)) // stored offset 65
+	a.NoError(mStore.Store(uint64(8), msgData2))  // stored offset 25
+	a.NoError(mStore.Store(uint64(15), msgData))  // stored offset 51
+	a.NoError(mStore.Store(uint64(13), msgData3)) // stored offset 77
 
-	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 87
-	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 109
+	a.NoError(mStore.Store(uint64(22), msgData)) // stored offset 103
+	a.NoError(mStore.Store(uint64(23), msgData)) // stored offset 129
 
 	// third file
-	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 21
-	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 43
+	a.NoError(mStore.Store(uint64(24), msgData)) // stored offset 25
+	a.NoError(mStore.Store(uint64(26), msgData)) // stored offset 51
 
-	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 65
+	a.NoError(mStore.Store(uint64(30), msgData)) // stored offset 77
 
 	defer a.NoError(mStore.Close())
 
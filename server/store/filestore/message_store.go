@@ -2,32 +2,85 @@
 package filestore
 
 import (
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/store"
 )
 
+// defaultMinFreePercent is the percentage of free storage space, below which the store is unhealthy by default
+const defaultMinFreePercent = 5
+
 // FileMessageStore is a struct used by the filesystem-based implementation of the MessageStore interface.
 // It holds the base directory, a map of messagePartitions etc.
 type FileMessageStore struct {
 	partitions map[string]*messagePartition
 	basedir    string
 	mutex      sync.RWMutex
+
+	// ttls holds the message TTLs of the topics by partition name
+	ttls map[string]topicTTLs
+
+	// compactionKeys holds the header field of the key compaction by partition name, see SetCompactionKey
+	compactionKeys map[string]string
+
+	// maxMessages holds the max messages limits set by partition name, overriding the defaultMaxMessages
+	maxMessages        map[string]int
+	defaultMaxMessages int
+
+	// batchSize and batchLinger configure the batching of the writes of StoreMessage, see SetBatching
+	batchSize   int
+	batchLinger time.Duration
+
+	// compress enables the compression of the sealed message files, see SetCompression
+	compress bool
+
+	// idGenerator generates the ids of the stored messages, see SetIDGenerator
+	idGenerator store.IDGenerator
+
+	// corruptionPolicy is the handling of the corrupted messages by the fetches, see SetCorruptionPolicy
+	corruptionPolicy CorruptionPolicy
+
+	// indexedHeaders holds the indexed header keys by partition name, see SetIndexedHeaders
+	indexedHeaders map[string][]string
+
+	// minFreeBytes and minFreePercent are the thresholds of the free storage space, see SetMinFreeSpace
+	minFreeBytes   uint64
+	minFreePercent float64
+
+	// lockFile holds the exclusive lock of the base directory between Start and Stop, see SetLockTimeout
+	lockFile    *os.File
+	lockTimeout time.Duration
+
+	// closing holds the partitions being closed by ClosePartition, closing their channel when done
+	closing map[string]chan struct{}
+
+	compactionInterval time.Duration
+	stopC              chan bool
+	compactionWG       sync.WaitGroup
 }
 
 // New returns a new FileMessageStore.
 func New(basedir string) *FileMessageStore {
 	return &FileMessageStore{
-		partitions: make(map[string]*messagePartition),
-		basedir:    basedir,
+		partitions:         make(map[string]*messagePartition),
+		closing:            make(map[string]chan struct{}),
+		basedir:            basedir,
+		ttls:               make(map[string]topicTTLs),
+		compactionKeys:     make(map[string]string),
+		maxMessages:        make(map[string]int),
+		indexedHeaders:     make(map[string][]string),
+		minFreePercent:     defaultMinFreePercent,
+		idGenerator:        store.SequenceIDGenerator{},
+		compactionInterval: defaultCompactionInterval,
 	}
 }
 
@@ -43,13 +96,28 @@ func (fms *FileMessageStore) MaxMessageID(partition string) (uint64, error) {
 // Stop the FileMessageStore.
 // Implements the service.stopable interface.
 func (fms *FileMessageStore) Stop() error {
+	logger.Info("Stopping")
+
 	fms.mutex.Lock()
-	defer fms.mutex.Unlock()
+	stopC := fms.stopC
+	fms.stopC = nil
+	fms.mutex.Unlock()
+
+	// a running compaction has to finish, before the partitions are closed
+	if stopC != nil {
+		close(stopC)
+		fms.compactionWG.Wait()
+	}
 
-	logger.Info("Stopping")
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
 
 	var returnError error
 	for key, partition := range fms.partitions {
+		// the waiting messages are flushed, before closing the files
+		if partition.batcher != nil {
+			partition.batcher.stop()
+		}
 		if err := partition.Close(); err != nil {
 			returnError = err
 			logger.WithFields(log.Fields{
@@ -59,6 +127,9 @@ func (fms *FileMessageStore) Stop() error {
 		}
 		delete(fms.partitions, key)
 	}
+	if err := fms.unlock(); err != nil {
+		returnError = err
+	}
 	return returnError
 }
 
@@ -75,6 +146,22 @@ func (fms *FileMessageStore) GenerateNextMsgID(partitionName string, nodeID uint
 func (fms *FileMessageStore) StoreMessage(message *protocol.Message, nodeID uint8) (int, error) {
 	partitionName := message.Path.Partition()
 
+	p, err := fms.Partition(partitionName)
+	if err != nil {
+		return 0, err
+	}
+	if b := p.(*messagePartition).batcher; b != nil {
+		size, err := b.store(message, nodeID)
+		if err != nil {
+			logger.WithError(err).WithFields(log.Fields{
+				"partition": partitionName,
+				"traceID":   message.TraceID(),
+			}).Error("Error storing a batched message in partition")
+			return 0, err
+		}
+		return size, nil
+	}
+
 	// If nodeID is zero means we are running in standalone more, otherwise
 	// if the message has no nodeID it means it was received by this node
 	if nodeID == 0 || message.NodeID == 0 {
@@ -98,9 +185,10 @@ func (fms *FileMessageStore) StoreMessage(message *protocol.Message, nodeID uint
 	data := message.Bytes()
 
 	if err := fms.Store(partitionName, message.ID, message.Bytes()); err != nil {
-		logger.
-			WithError(err).WithField("partition", partitionName).
-			Error("Error storing locally generated  messagein partition")
+		logger.WithError(err).WithFields(log.Fields{
+			"partition": partitionName,
+			"traceID":   message.TraceID(),
+		}).Error("Error storing locally generated  messagein partition")
 		return 0, err
 	}
 
@@ -110,6 +198,7 @@ func (fms *FileMessageStore) StoreMessage(message *protocol.Message, nodeID uint
 		"partition":     partitionName,
 		"messageUserID": message.UserID,
 		"nodeID":        nodeID,
+		"traceID":       message.TraceID(),
 	}).Debug("Stored message")
 
 	return len(data), nil
@@ -172,6 +261,13 @@ func (fms *FileMessageStore) Partition(partition string) (store.MessagePartition
 	fms.mutex.Lock()
 	defer fms.mutex.Unlock()
 
+	// a partition being closed is opened again, after its files were closed
+	for closed, closing := fms.closing[partition]; closing; closed, closing = fms.closing[partition] {
+		fms.mutex.Unlock()
+		<-closed
+		fms.mutex.Lock()
+	}
+
 	partitionStore, exist := fms.partitions[partition]
 	if !exist {
 		dir := path.Join(fms.basedir, partition)
@@ -192,35 +288,113 @@ func (fms *FileMessageStore) Partition(partition string) (store.MessagePartition
 			logger.WithField("err", err).Error("partitionStore")
 			return nil, err
 		}
+		partitionStore.ttls = fms.ttls[partition]
+		partitionStore.compactionKey = fms.compactionKeys[partition]
+		partitionStore.idGenerator = fms.idGenerator
+		partitionStore.corruptionPolicy = fms.corruptionPolicy
+		partitionStore.setMaxMessages(fms.maxMessagesOf(partition))
+		if fms.batchSize > 0 {
+			partitionStore.batcher = newBatcher(partitionStore, fms.batchSize, fms.batchLinger)
+			partitionStore.batcher.start()
+		}
+		if fms.compress {
+			partitionStore.setCompression(true)
+		}
+		// the header indexes are rebuilt, if their keys or format changed, or removed without indexed keys
+		if err := partitionStore.setIndexedHeaders(fms.indexedHeaders[partition]); err != nil {
+			logger.WithError(err).WithField("partition", partition).Error("Error indexing the message headers")
+		}
 		fms.partitions[partition] = partitionStore
 	}
 	return partitionStore, nil
 }
 
-// Check returns if available storage space is still above a certain threshold.
+// SetBatching enables the batching of the messages stored by StoreMessage: the messages of a partition
+// are buffered until size messages are waiting, or the first of them waited for the linger duration.
+// The batch is then written with a single sync of the files, and StoreMessage returns after the sync.
+// A size of zero disables the batching, which writes each message without syncing.
+// It applies to the partitions opened after the call, so it has to be called before storing messages.
+func (fms *FileMessageStore) SetBatching(size int, linger time.Duration) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.batchSize = size
+	fms.batchLinger = linger
+}
+
+// SetCompression enables the gzip compression of the message files, when they are sealed
+// (i.e. full, and not appended anymore). The file being appended and the index files stay uncompressed.
+// The already sealed files are compressed in the background, when a partition is opened.
+// The compressed files are decompressed transparently by the fetches, also without compression enabled.
+// It applies to the partitions opened after the call.
+func (fms *FileMessageStore) SetCompression(enabled bool) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.compress = enabled
+}
+
+// SetIDGenerator is a part of the `store.IDGeneratorSetter` implementation.
+// The ids of a partition continue after its last stored id, also when the generator changes.
+// It applies to the partitions opened after the call.
+func (fms *FileMessageStore) SetIDGenerator(generator store.IDGenerator) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.idGenerator = generator
+}
+
+// SetMinFreeSpace sets the thresholds of the free space of the filesystem of the base directory,
+// below which the store reports itself unhealthy: a number of bytes and a percentage of the total space.
+// A threshold of zero is disabled. By default the store is unhealthy with less than 5% free space.
+func (fms *FileMessageStore) SetMinFreeSpace(bytes uint64, percent float64) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.minFreeBytes = bytes
+	fms.minFreePercent = percent
+}
+
+// Check returns an error, if the available storage space is below one of the thresholds set by SetMinFreeSpace.
+// The error contains the free and the total bytes of the filesystem, as shown by the health endpoint.
 func (fms *FileMessageStore) Check() error {
 	var stat syscall.Statfs_t
-
-	syscall.Statfs(fms.basedir, &stat)
+	if err := syscall.Statfs(fms.basedir, &stat); err != nil {
+		logger.WithError(err).WithField("basedir", fms.basedir).Error("Error reading the storage space")
+		return err
+	}
 
 	// available space in bytes = available blocks * size per block
 	freeSpace := stat.Bavail * uint64(stat.Bsize)
 	// total space in bytes = total system blocks * size per block
 	totalSpace := stat.Blocks * uint64(stat.Bsize)
 
-	usedSpacePercentage := 1 - (float64(freeSpace) / float64(totalSpace))
+	freePercentage := 100.0
+	if totalSpace > 0 {
+		freePercentage = 100 * float64(freeSpace) / float64(totalSpace)
+	}
 
-	if usedSpacePercentage > 0.95 {
-		errorMessage := "Storage is almost full"
+	fms.mutex.RLock()
+	minFreeBytes, minFreePercent := fms.minFreeBytes, fms.minFreePercent
+	fms.mutex.RUnlock()
+
+	if freeSpace < minFreeBytes || freePercentage < minFreePercent {
 		logger.WithFields(log.Fields{
-			"percentage": usedSpacePercentage,
-		}).Warn(errorMessage)
-		return errors.New(errorMessage)
+			"free":       freeSpace,
+			"total":      totalSpace,
+			"percentage": freePercentage,
+		}).Warn("Storage is almost full")
+		return fmt.Errorf("Storage is almost full: %d of %d bytes free (%.1f%%)", freeSpace, totalSpace, freePercentage)
 	}
 
 	return nil
 }
 
+// partitionOfTopic returns the partition name of a topic path, e.g. `foo` for `/foo/bar`
+func partitionOfTopic(topic string) string {
+	return protocol.Path(topic).Partition()
+}
+
 // extractPartitionName returns the partition name from a filepath
 // The files would have this format /basepath/partition-number.extenstion
 // if filepath is not in the right format empty string is returned
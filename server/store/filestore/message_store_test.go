@@ -3,6 +3,9 @@ package filestore
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
+	"path"
 	"testing"
 	"time"
 
@@ -178,6 +181,31 @@ func Test_Check(t *testing.T) {
 	a.Nil(err)
 }
 
+func TestFileMessageStore_CheckMinFreeSpace(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_message_store_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	// given no thresholds, then the store is healthy
+	mStore.SetMinFreeSpace(0, 0)
+	a.NoError(mStore.Check())
+
+	// when requiring more free bytes than the filesystem has, then the error contains the free and total bytes
+	mStore.SetMinFreeSpace(math.MaxUint64, 0)
+	err := mStore.Check()
+	if a.Error(err) {
+		a.Regexp(`^Storage is almost full: \d+ of \d+ bytes free \(\d+\.\d%\)$`, err.Error())
+	}
+
+	// and requiring more than all of the space as free is unhealthy as well
+	mStore.SetMinFreeSpace(0, 101)
+	a.Error(mStore.Check())
+
+	// and a missing base directory is unhealthy
+	a.Error(New(path.Join(dir, "missing")).Check())
+}
+
 // func Test_Partitions(t *testing.T) {
 // 	// Store multiple partitions then recreate the store and see if they are picked up
 // 	a := assert.New(t)
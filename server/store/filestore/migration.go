@@ -0,0 +1,240 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StoreVersion is the version of the files in the base directory, written by this version of the FileMessageStore.
+// It is stored in the version file of the base directory: a store of an older version is migrated by Start,
+// and a store of a newer version is refused.
+const StoreVersion = 1
+
+// versionFileName is the file in the base directory, containing the version of the store
+const versionFileName = "store.version"
+
+// StoreVersionError is returned by Start and Migrate, if the store was written by a newer version of guble
+type StoreVersionError struct {
+	Version int
+}
+
+func (e *StoreVersionError) Error() string {
+	return fmt.Sprintf("The store version %d is newer than the version %d supported by this guble", e.Version, StoreVersion)
+}
+
+// migration upgrades the store from the previous version to its version.
+// As an interrupted migration is run again, it has to complete the files migrated partially.
+type migration struct {
+	version     int
+	description string
+	migrate     func(basedir string) error
+}
+
+// migrations are the migrations of the store, in the order of their versions
+var migrations = []migration{
+	{version: 1, description: "Rewriting the message files without checksums", migrate: addChecksums},
+}
+
+// Migrate locks the base directory and migrates the store to the StoreVersion, without starting the store.
+// Start migrates the store as well, so this is only needed for upgrading it before starting a new version of guble.
+func (fms *FileMessageStore) Migrate() error {
+	fms.mutex.RLock()
+	locked := fms.lockFile != nil
+	fms.mutex.RUnlock()
+
+	if err := fms.lock(); err != nil {
+		return err
+	}
+	if !locked {
+		defer func() {
+			fms.mutex.Lock()
+			defer fms.mutex.Unlock()
+			fms.unlock()
+		}()
+	}
+	return migrate(fms.basedir)
+}
+
+// migrate runs the migrations after the version of the store in the basedir, writing the version after each of them,
+// so that an interrupted migration is resumed by the next run.
+func migrate(basedir string) error {
+	version, err := readStoreVersion(basedir)
+	if err != nil {
+		return err
+	}
+	if version > StoreVersion {
+		logger.WithFields(log.Fields{"basedir": basedir, "version": version}).Error("The store was written by a newer version of guble")
+		return &StoreVersionError{Version: version}
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		l := logger.WithFields(log.Fields{
+			"basedir":   basedir,
+			"from":      version,
+			"to":        m.version,
+			"migration": m.description,
+		})
+		l.Info("Migrating the store")
+		start := time.Now()
+		if err := m.migrate(basedir); err != nil {
+			l.WithError(err).Error("Migrating the store failed, it is resumed by the next start")
+			return err
+		}
+		if err := writeStoreVersion(basedir, m.version); err != nil {
+			return err
+		}
+		l.WithField("duration", time.Since(start)).Info("Migrated the store")
+		version = m.version
+	}
+	return writeStoreVersion(basedir, version)
+}
+
+// readStoreVersion returns the version of the store in the basedir: the content of its version file,
+// else 0 for a store written before the versions, or the StoreVersion for a new store without partitions
+func readStoreVersion(basedir string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(basedir, versionFileName))
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("Invalid store version file: %v", err)
+		}
+		return version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	entries, err := ioutil.ReadDir(basedir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			return 0, nil
+		}
+	}
+	return StoreVersion, nil
+}
+
+// writeStoreVersion replaces the version file of the basedir
+func writeStoreVersion(basedir string, version int) error {
+	filename := path.Join(basedir, versionFileName)
+	if err := ioutil.WriteFile(filename+".tmp", []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// addChecksums is the migration to version 1: it rewrites the message files written before the checksums
+// in the current format version, with their index files.
+func addChecksums(basedir string) error {
+	entries, err := ioutil.ReadDir(basedir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := path.Join(basedir, entry.Name())
+		if err := completeRewrites(dir); err != nil {
+			return err
+		}
+		p, err := newMessagePartition(dir, entry.Name())
+		if err != nil {
+			return err
+		}
+		// the current file is the one after the sealed files
+		for fileID := 0; fileID <= p.fileCache.length(); fileID++ {
+			if err := p.upgradeFile(fileID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// upgradeFile rewrites the message file with the given id in the current format version, if it has an older one
+func (p *messagePartition) upgradeFile(fileID int) error {
+	if _, err := os.Stat(p.composeIdxFilenameForPosition(uint64(fileID))); os.IsNotExist(err) {
+		return nil
+	}
+	file, err := p.openSegment(fileID)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if file.version >= fileFormatVersion[0] {
+		return nil
+	}
+
+	l, err := p.loadIndexList(fileID)
+	if err != nil {
+		return err
+	}
+	records := make([]record, 0, l.len())
+	for _, index := range l.toSliceArray() {
+		data, err := readRecord(file, index)
+		if err != nil {
+			return err
+		}
+		records = append(records, record{index.id, data})
+	}
+	if _, err := p.rewriteFile(fileID, file.compressed, records); err != nil {
+		return err
+	}
+	logger.WithFields(log.Fields{
+		"filename": file.name,
+		"version":  file.version,
+		"messages": len(records),
+	}).Info("Upgraded the message file")
+	return nil
+}
+
+// completeRewrites replaces the index files in the directory of a partition by their temporary files, if a rewrite
+// was interrupted after replacing the message file. If the message file was not replaced yet, the old files are still valid.
+// It has to be called before the partition is opened, which would truncate the message file to the old index file.
+func completeRewrites(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".idx.tmp") {
+			continue
+		}
+		idxFilename := path.Join(dir, strings.TrimSuffix(entry.Name(), ".tmp"))
+		msgFilename := strings.TrimSuffix(idxFilename, ".idx") + ".msg"
+
+		if _, err := os.Stat(msgFilename + ".tmp"); err == nil {
+			os.Remove(msgFilename + ".tmp")
+			if err := os.Remove(idxFilename + ".tmp"); err != nil {
+				return err
+			}
+			continue
+		}
+		logger.WithField("filename", idxFilename).Info("Completing the interrupted rewrite of the index file")
+		if err := os.Rename(idxFilename+".tmp", idxFilename); err != nil {
+			return err
+		}
+		// the compressed file is removed after the rewritten one replaced it
+		if _, err := os.Stat(msgFilename + compressedSuffix); err == nil {
+			if err := os.Remove(msgFilename + compressedSuffix); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeLegacyPartition writes a partition in the format without checksums and without a store version
+func writeLegacyPartition(a *assert.Assertions, basedir string, ids ...uint64) *messagePartition {
+	a.NoError(os.MkdirAll(path.Join(basedir, "foo"), 0700))
+	p := &messagePartition{basedir: path.Join(basedir, "foo"), name: "foo"}
+	msgFile, err := os.Create(p.composeMsgFilenameForPosition(0))
+	a.NoError(err)
+	idxFile, err := os.Create(p.composeIdxFilenameForPosition(0))
+	a.NoError(err)
+	_, err = msgFile.Write(append(append([]byte{}, magicNumber...), formatVersionWithoutChecksum))
+	a.NoError(err)
+	position := uint64(len(magicNumber) + 1)
+	for i, id := range ids {
+		headerSize, err := writeRecord(msgFile, formatVersionWithoutChecksum, id, []byte("aaaaaaaaaa"))
+		a.NoError(err)
+		a.NoError(writeIndexEntry(idxFile, id, position+uint64(headerSize), 10, uint64(i)))
+		position += uint64(headerSize) + 10
+	}
+	a.NoError(msgFile.Close())
+	a.NoError(idxFile.Close())
+	return p
+}
+
+func fileFormatVersionOf(a *assert.Assertions, filename string) byte {
+	file, err := os.Open(filename)
+	a.NoError(err)
+	defer file.Close()
+	version, err := readFormatVersion(file)
+	a.NoError(err)
+	return version
+}
+
+func storeVersionOf(a *assert.Assertions, basedir string) string {
+	data, err := ioutil.ReadFile(path.Join(basedir, versionFileName))
+	a.NoError(err)
+	return string(data)
+}
+
+func Test_Migrate_UpgradesTheMessageFilesWithoutChecksums(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	// given a store written before the store versions
+	legacy := writeLegacyPartition(a, dir, 1, 2, 3)
+	version, err := readStoreVersion(dir)
+	a.NoError(err)
+	a.Equal(0, version)
+
+	// when it is migrated
+	a.NoError(New(dir).Migrate())
+
+	// then the files have the checksums, and the messages are read from the rewritten files
+	a.Equal("1\n", storeVersionOf(a, dir))
+	a.Equal(formatVersionWithChecksum, fileFormatVersionOf(a, legacy.composeMsgFilenameForPosition(0)))
+	p, err := newMessagePartition(legacy.basedir, "foo")
+	a.NoError(err)
+	a.Equal([]uint64{1, 2, 3}, fetchPartitionIDs(a, p))
+	a.NoError(p.Close())
+
+	// and the lock was released
+	fms := New(dir)
+	a.NoError(fms.Start())
+	a.NoError(fms.Stop())
+}
+
+func Test_Migrate_CompletesAnInterruptedRewrite(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	// given a migration interrupted after replacing the message file, but not yet its index file
+	legacy := writeLegacyPartition(a, dir, 1, 2)
+	idxFilename := legacy.composeIdxFilenameForPosition(0)
+	oldIndex, err := ioutil.ReadFile(idxFilename)
+	a.NoError(err)
+	a.NoError(migrate(dir))
+	a.NoError(os.Rename(idxFilename, idxFilename+".tmp"))
+	a.NoError(ioutil.WriteFile(idxFilename, oldIndex, 0666))
+	a.NoError(writeStoreVersion(dir, 0))
+
+	// when the store is started
+	fms := New(dir)
+	a.NoError(fms.Start())
+	defer fms.Stop()
+
+	// then the migration is resumed, completing the rewritten files
+	a.Equal("1\n", storeVersionOf(a, dir))
+	_, err = os.Stat(idxFilename + ".tmp")
+	a.True(os.IsNotExist(err))
+	p, err := fms.Partition("foo")
+	a.NoError(err)
+	a.Equal([]uint64{1, 2}, fetchPartitionIDs(a, p.(*messagePartition)))
+}
+
+func Test_Start_WritesTheVersionOfANewStore(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	fms := New(dir)
+	a.NoError(fms.Start())
+	a.NoError(fms.Stop())
+	a.Equal("1\n", storeVersionOf(a, dir))
+}
+
+func Test_Start_RefusesAStoreOfANewerVersion(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_migration_test")
+	defer os.RemoveAll(dir)
+
+	a.NoError(writeStoreVersion(dir, StoreVersion+1))
+
+	// the store is refused each time, without keeping the lock
+	for i := 0; i < 2; i++ {
+		err := New(dir).Start()
+		if a.IsType(&StoreVersionError{}, err) {
+			a.Equal(StoreVersion+1, err.(*StoreVersionError).Version)
+		}
+	}
+	a.Equal("2\n", storeVersionOf(a, dir))
+}
@@ -0,0 +1,108 @@
+package filestore
+
+import (
+	"sort"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+)
+
+// Offsets returns the ids of the oldest and the last message of the partition and the number of messages,
+// without the messages evicted or expired but not yet removed by the compaction.
+// It is a part of the `store.OffsetsReader` implementation.
+func (fms *FileMessageStore) Offsets(partition string) (store.Offsets, error) {
+	p, err := fms.Partition(partition)
+	if err != nil {
+		return store.Offsets{}, err
+	}
+	return p.(*messagePartition).offsets(time.Now())
+}
+
+// offsets reads the index lists of the partition, from the oldest file up to the first one with a retained message.
+// As the messages are stored in chronological order, the messages expired by a TTL of the whole partition are found
+// by a binary search, reading only the publishing time of a few messages. With TTLs of subtopics, the messages
+// of all files are read.
+func (p *messagePartition) offsets(now time.Time) (store.Offsets, error) {
+	p.compactionMutex.RLock()
+	defer p.compactionMutex.RUnlock()
+
+	offsets := store.Offsets{
+		LastID: p.MaxMessageID(),
+		Count:  p.Count(),
+	}
+	ttls := p.getTTLs()
+	_, uniform := ttls.uniform(p.name)
+	firstRetainedID := p.retentionStart()
+
+	found := false
+	for fileID := 0; fileID <= p.fileCache.length(); fileID++ {
+		l := p.list
+		if fileID < p.fileCache.length() {
+			var err error
+			if l, err = p.loadIndexList(fileID); err != nil {
+				return store.Offsets{}, err
+			}
+		}
+		l = withoutEvicted(l, firstRetainedID)
+
+		expired, first := 0, 0
+		if len(ttls) > 0 {
+			var err error
+			if expired, first, err = p.countExpired(l, ttls, now); err != nil {
+				return store.Offsets{}, err
+			}
+			if uint64(expired) < offsets.Count {
+				offsets.Count -= uint64(expired)
+			} else {
+				offsets.Count = 0
+			}
+		}
+		if !found && first < l.len() {
+			offsets.FirstID = l.get(first).id
+			found = true
+		}
+		// the messages expired by the TTLs of the subtopics are counted in all files
+		if found && (len(ttls) == 0 || uniform) {
+			return offsets, nil
+		}
+	}
+	if !found {
+		offsets.Count = 0
+	}
+	return offsets, nil
+}
+
+// countExpired returns the number of expired messages of the list, and the position of its first message not expired
+func (p *messagePartition) countExpired(l *indexList, ttls topicTTLs, now time.Time) (int, int, error) {
+	reader := p.newSegmentReader()
+	defer reader.close()
+
+	var err error
+	if _, uniform := ttls.uniform(p.name); uniform {
+		n := sort.Search(l.len(), func(i int) bool {
+			if err != nil {
+				return true
+			}
+			var data []byte
+			if data, err = reader.read(l.get(i)); err != nil {
+				return true
+			}
+			return !ttls.isExpired(data, now)
+		})
+		return n, n, err
+	}
+
+	expired, first := 0, l.len()
+	for i := 0; i < l.len(); i++ {
+		data, err := reader.read(l.get(i))
+		if err != nil {
+			return 0, 0, err
+		}
+		if ttls.isExpired(data, now) {
+			expired++
+		} else if first == l.len() {
+			first = i
+		}
+	}
+	return expired, first, nil
+}
@@ -0,0 +1,81 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_Offsets(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_offsets_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	// an empty partition has zero offsets
+	offsets, err := mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{}, offsets)
+
+	// given seven messages spread over three files
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 7; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+	offsets, err = mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 1, LastID: 7, Count: 7}, offsets)
+
+	// when the oldest messages are evicted, then the offsets start after them
+	mStore.SetMaxMessages("/foo", 3)
+	offsets, err = mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 5, LastID: 7, Count: 3}, offsets)
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_OffsetsWithoutExpiredMessages(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_offsets_test")
+	defer os.RemoveAll(dir)
+
+	// given four expired messages, the last one in the second file, and three recent messages
+	mStore := New(dir)
+	mStore.SetTTL("/foo", time.Hour)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	now := time.Now().Unix()
+	for i, ts := range []int64{old, old, old, old, now, now, now} {
+		id := uint64(i + 1)
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, ts)))
+	}
+
+	// then the offsets start at the first recent message, before the compaction
+	offsets, err := mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 5, LastID: 7, Count: 3}, offsets)
+
+	// and after it
+	p := partitionOf(a, mStore)
+	_, err = p.compact(time.Now())
+	a.NoError(err)
+	offsets, err = mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 5, LastID: 7, Count: 3}, offsets)
+
+	// and when all messages are expired, there is no first message
+	offsets, err = p.offsets(time.Now().Add(2 * time.Hour))
+	a.NoError(err)
+	a.Equal(store.Offsets{LastID: 7}, offsets)
+	a.NoError(mStore.Stop())
+}
@@ -0,0 +1,65 @@
+package filestore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/smancke/guble/server/metrics"
+	"github.com/smancke/guble/server/store"
+)
+
+// recordBufferSize is the initial capacity of the pooled buffers of the replays
+const recordBufferSize = 4 * 1024
+
+// recordBuffers are the buffers reused by the replays for reading the messages
+var recordBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, recordBufferSize)
+		return &buf
+	},
+}
+
+// Replay calls fn with the messages of the request, read into a pooled buffer instead of a new one per message.
+// The message passed to fn is only valid until fn returns.
+// It is a part of the `store.Replayer` implementation.
+func (fms *FileMessageStore) Replay(req *store.FetchRequest, fn store.ReplayFunc) error {
+	p, err := fms.Partition(req.Partition)
+	if err != nil {
+		return err
+	}
+	return p.(*messagePartition).replay(req, fn)
+}
+
+// replay reads the messages of the fetch list of the request one after the other into the same buffer,
+// skipping the corrupted messages like Fetch.
+func (p *messagePartition) replay(req *store.FetchRequest, fn store.ReplayFunc) error {
+	p.compactionMutex.RLock()
+	fetchList, err := p.calculateFetchList(req)
+	var files map[int]*messageFile
+	if err == nil {
+		files, err = p.openFiles(fetchList)
+	}
+	p.compactionMutex.RUnlock()
+	defer closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	buf := recordBuffers.Get().(*[]byte)
+	defer recordBuffers.Put(buf)
+
+	// the observer is looked up once, instead of for each message
+	readLatency := metrics.PromMessageStoreLatency.WithLabelValues("read")
+	return fetchList.mapWithPredicate(func(index *index, _ int) error {
+		start := time.Now()
+		msg, err := readRecordInto(files[index.fileID], index, buf)
+		readLatency.Observe(time.Since(start).Seconds())
+		if _, corrupted := err.(*CorruptedMessageError); corrupted && p.corruptionPolicy != CorruptionFail {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(index.id, msg)
+	})
+}
@@ -0,0 +1,134 @@
+package filestore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_Replay(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_replay_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	// given seven messages of different sizes spread over three files
+	for id := uint64(1); id <= 7; id++ {
+		a.NoError(mStore.Store("foo", id, []byte(fmt.Sprintf("message %0*d", id*100, id))))
+	}
+
+	// when the messages from id 2 are replayed, copying each message
+	var ids []uint64
+	var messages []string
+	err := mStore.Replay(store.NewFetchRequest("foo", 2, 0, store.DirectionForward, -1), func(id uint64, message []byte) error {
+		ids = append(ids, id)
+		messages = append(messages, string(message))
+		return nil
+	})
+
+	// then they are replayed in order
+	a.NoError(err)
+	a.Equal([]uint64{2, 3, 4, 5, 6, 7}, ids)
+	for i, id := range ids {
+		a.Equal(fmt.Sprintf("message %0*d", id*100, id), messages[i])
+	}
+
+	// and an error of the function stops the replay
+	stop := errors.New("stop")
+	count := 0
+	err = mStore.Replay(store.NewFetchRequest("foo", 1, 0, store.DirectionForward, -1), func(id uint64, message []byte) error {
+		count++
+		return stop
+	})
+	a.Equal(stop, err)
+	a.Equal(1, count)
+	a.NoError(mStore.Stop())
+}
+
+func Test_FileMessageStore_ReplayReusesTheBuffer(t *testing.T) {
+	a := assert.New(t)
+	dir, _ := ioutil.TempDir("", "guble_replay_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+	a.NoError(mStore.Store("foo", 1, []byte("first")))
+	a.NoError(mStore.Store("foo", 2, []byte("other")))
+
+	// a retained message is overwritten by the next one
+	var retained [][]byte
+	a.NoError(mStore.Replay(store.NewFetchRequest("foo", 1, 0, store.DirectionForward, -1), func(id uint64, message []byte) error {
+		retained = append(retained, message)
+		return nil
+	}))
+	a.Len(retained, 2)
+	a.Equal("other", string(retained[0]))
+	a.NoError(mStore.Stop())
+}
+
+func Benchmark_Fetch_1Kb_Messages(b *testing.B) {
+	benchmarkReading(b, func(mStore *FileMessageStore, req *store.FetchRequest) int {
+		req.Init()
+		mStore.Fetch(req)
+		<-req.StartC
+		count := 0
+		for range req.MessageC {
+			count++
+		}
+		return count
+	})
+}
+
+func Benchmark_Replay_1Kb_Messages(b *testing.B) {
+	benchmarkReading(b, func(mStore *FileMessageStore, req *store.FetchRequest) int {
+		count := 0
+		mStore.Replay(req, func(id uint64, message []byte) error {
+			count++
+			return nil
+		})
+		return count
+	})
+}
+
+// benchmarkReading measures the reading of all messages of a partition by the function, reporting the allocations
+func benchmarkReading(b *testing.B, read func(*FileMessageStore, *store.FetchRequest) int) {
+	a := assert.New(b)
+	dir, _ := ioutil.TempDir("", "guble_replay_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	const messages = 1000
+	message := make([]byte, 1024)
+	for i := range message {
+		message[i] = 'a'
+	}
+	for id := uint64(1); id <= messages; id++ {
+		a.NoError(mStore.Store("foo", id, message))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := read(mStore, store.NewFetchRequest("foo", 1, 0, store.DirectionForward, -1))
+		a.Equal(messages, count)
+	}
+	b.StopTimer()
+	a.NoError(mStore.Stop())
+}
+
+func Test_checksumOfTheIDBytes(t *testing.T) {
+	id := uint64(0x0102030405060708)
+	idBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(idBytes, id)
+	data := []byte("Hello World")
+	assert.Equal(t, crc32.Update(crc32.ChecksumIEEE(idBytes), crc32.IEEETable, data), checksum(id, data))
+}
@@ -0,0 +1,149 @@
+package filestore
+
+// SetMaxMessages limits the number of messages kept for a topic, overriding the default limit.
+// As the messages are stored per partition, the limit applies to the whole partition of the topic.
+// When storing a message exceeds the limit, the oldest message is evicted: it is not fetched anymore,
+// and removed from disk by the periodic compaction. A limit of zero keeps all the messages of the topic.
+func (fms *FileMessageStore) SetMaxMessages(topic string, n int) {
+	partitionName := partitionOfTopic(topic)
+
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.maxMessages[partitionName] = n
+	if p, exist := fms.partitions[partitionName]; exist {
+		p.setMaxMessages(n)
+	}
+}
+
+// SetDefaultMaxMessages sets the maximum number of messages kept for the topics
+// without a limit set by SetMaxMessages. A limit of zero disables the default limit.
+func (fms *FileMessageStore) SetDefaultMaxMessages(n int) {
+	fms.mutex.Lock()
+	defer fms.mutex.Unlock()
+
+	fms.defaultMaxMessages = n
+	for name, p := range fms.partitions {
+		if _, overridden := fms.maxMessages[name]; !overridden {
+			p.setMaxMessages(n)
+		}
+	}
+}
+
+// maxMessagesOf returns the limit of a partition; the caller has to hold the mutex
+func (fms *FileMessageStore) maxMessagesOf(partitionName string) int {
+	if n, overridden := fms.maxMessages[partitionName]; overridden {
+		return n
+	}
+	return fms.defaultMaxMessages
+}
+
+// evictionCursor points to the next message of the partition which may be evicted
+type evictionCursor struct {
+	fileID int
+	pos    int
+
+	// list is the loaded index list of a file already written, nil for the current file
+	list *indexList
+}
+
+func (p *messagePartition) setMaxMessages(n int) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.maxMessages = n
+	if err := p.evict(); err != nil {
+		logger.WithError(err).WithField("partition", p.name).Error("Error evicting messages")
+	}
+}
+
+// retentionStart returns the id of the oldest message not evicted, or 0 if no message was evicted
+func (p *messagePartition) retentionStart() uint64 {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.firstRetainedID
+}
+
+// hasEvictedMessages returns true if evicted messages are waiting for the compaction
+func (p *messagePartition) hasEvictedMessages() bool {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.evictedMessages > 0
+}
+
+// evict marks the oldest messages as evicted, while the partition holds more than maxMessages.
+// The caller has to hold the lock of the partition.
+func (p *messagePartition) evict() error {
+	evicted := false
+	for p.maxMessages > 0 && p.totalNumberOfMessages-p.evictedMessages > uint64(p.maxMessages) {
+		oldest, err := p.oldestRetained()
+		if err != nil {
+			return err
+		}
+		if oldest == nil {
+			break
+		}
+		p.evictedMessages++
+		p.firstRetainedID = oldest.id + 1
+		evicted = true
+	}
+	if !evicted {
+		return nil
+	}
+
+	// the retention starts at the id of the next message, so fetches can start from it
+	oldest, err := p.oldestRetained()
+	if err != nil {
+		return err
+	}
+	if oldest != nil {
+		p.firstRetainedID = oldest.id
+	}
+	return nil
+}
+
+// oldestRetained moves the eviction cursor to the oldest message which is not evicted, and returns it.
+// It returns nil if there is no such message. The caller has to hold the lock of the partition.
+func (p *messagePartition) oldestRetained() (*index, error) {
+	c := &p.eviction
+	for {
+		l := p.list
+		if c.fileID < p.fileCache.length() {
+			if c.list == nil {
+				var err error
+				if c.list, err = p.loadIndexList(c.fileID); err != nil {
+					return nil, err
+				}
+			}
+			l = c.list
+		}
+
+		for ; c.pos < l.len(); c.pos++ {
+			if entry := l.get(c.pos); entry.id >= p.firstRetainedID {
+				return entry, nil
+			}
+		}
+
+		if c.fileID >= p.fileCache.length() {
+			return nil, nil
+		}
+		p.eviction = evictionCursor{fileID: c.fileID + 1}
+	}
+}
+
+// withoutEvicted returns an index list without the messages evicted before the given id
+func withoutEvicted(l *indexList, firstRetainedID uint64) *indexList {
+	if firstRetainedID == 0 {
+		return l
+	}
+	result := newIndexList(l.len())
+	l.mapWithPredicate(func(index *index, _ int) error {
+		if index.id >= firstRetainedID {
+			result.insert(index)
+		}
+		return nil
+	})
+	return result
+}
@@ -0,0 +1,83 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_MessagePartition_OldestMessagesAreEvictedAndCompacted(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	// allow three messages per file
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetMaxMessages("/foo", 3)
+
+	// given seven messages, spread over three files
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 7; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+
+	// then only the three most recent messages are fetched, even before compaction
+	p, err := mStore.Partition("foo")
+	a.NoError(err)
+	a.Equal(uint64(3), p.Count())
+	a.Equal([]uint64{5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+
+	// and a fetch pointing to an evicted message is moved to the oldest message
+	a.Equal([]uint64{5, 6}, fetchIDs(a, mStore, 2, 2))
+
+	// when compacting, then the evicted messages are removed
+	removed, err := p.(*messagePartition).compact(time.Now())
+	a.NoError(err)
+	a.Equal(4, removed)
+	a.Equal(uint64(3), p.Count())
+	a.Equal([]uint64{5, 6, 7}, fetchIDs(a, mStore, 0, 10))
+
+	// and the eviction continues after the compaction
+	a.NoError(mStore.Store("foo", 8, aMessageAt(8, now)))
+	a.Equal(uint64(3), p.Count())
+	a.Equal([]uint64{6, 7, 8}, fetchIDs(a, mStore, 0, 10))
+
+	// and the limit is enforced again after loading the files
+	a.NoError(mStore.Stop())
+	mStore = New(dir)
+	mStore.SetDefaultMaxMessages(2)
+	a.Equal([]uint64{7, 8}, fetchIDs(a, mStore, 0, 10))
+}
+
+func Test_FileMessageStore_MaxMessagesOverridesTheDefault(t *testing.T) {
+	a := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "guble_retention_test")
+	defer os.RemoveAll(dir)
+
+	mStore := New(dir)
+	mStore.SetDefaultMaxMessages(1)
+	mStore.SetMaxMessages("/foo", 0)
+
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 3; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+		a.NoError(mStore.Store("bar", id, aMessageAt(id, now)))
+	}
+
+	// then the topic without limit keeps all messages, while the default applies to the other ones
+	a.Equal([]uint64{1, 2, 3}, fetchIDs(a, mStore, 0, 10))
+	bar, err := mStore.Partition("bar")
+	a.NoError(err)
+	a.Equal(uint64(1), bar.Count())
+
+	// when setting a limit on an existing partition, then the oldest messages are evicted immediately
+	mStore.SetMaxMessages("/foo", 2)
+	a.Equal([]uint64{2, 3}, fetchIDs(a, mStore, 0, 10))
+}
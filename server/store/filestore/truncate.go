@@ -0,0 +1,72 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Truncate deletes all message and index files of the partition, and resets its message ids.
+// The messages stored afterwards start a new sequence, as in a new partition.
+// It is a part of the `store.Truncater` implementation.
+func (fms *FileMessageStore) Truncate(partition string) error {
+	p, err := fms.Partition(partition)
+	if err != nil {
+		return err
+	}
+	return p.(*messagePartition).truncate()
+}
+
+// truncate removes the files of the partition, waiting for the running compression and compaction
+func (p *messagePartition) truncate() error {
+	p.compressionWG.Wait()
+
+	p.compactionMutex.Lock()
+	defer p.compactionMutex.Unlock()
+
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.closeAppendFiles(); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(p.basedir)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, fileInfo := range files {
+		if !strings.HasPrefix(fileInfo.Name(), p.name+"-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(p.basedir, fileInfo.Name())); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	p.appendFilePosition = 0
+	p.maxMessageID = 0
+	p.lastGeneratedID = 0
+	p.totalNumberOfMessages = 0
+	p.entriesCount = 0
+	p.list = newIndexList(int(messagesPerFile))
+	p.fileCache = newCache()
+	p.firstRetainedID = 0
+	p.evictedMessages = 0
+	p.eviction = evictionCursor{}
+
+	p.decompressed.Lock()
+	p.decompressed.data = nil
+	p.decompressed.Unlock()
+
+	logger.WithFields(log.Fields{
+		"partition": p.name,
+		"files":     removed,
+	}).Info("Truncated partition")
+	return nil
+}
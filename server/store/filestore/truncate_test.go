@@ -0,0 +1,63 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileMessageStore_Truncate(t *testing.T) {
+	a := assert.New(t)
+	defer func(n uint64) { messagesPerFile = n }(messagesPerFile)
+	messagesPerFile = uint64(3)
+
+	dir, _ := ioutil.TempDir("", "guble_truncate_test")
+	defer os.RemoveAll(dir)
+	mStore := New(dir)
+
+	// given seven messages spread over three files, and another partition
+	now := time.Now().Unix()
+	for id := uint64(1); id <= 7; id++ {
+		a.NoError(mStore.Store("foo", id, aMessageAt(id, now)))
+	}
+	a.NoError(mStore.Store("bar", 1, aMessageAt(1, now)))
+
+	// when the partition is truncated
+	a.NoError(mStore.Truncate("foo"))
+
+	// then its files are deleted and its ids are reset
+	files, _ := filepath.Glob(filepath.Join(dir, "foo", "*"))
+	a.Empty(files)
+	maxID, err := mStore.MaxMessageID("foo")
+	a.NoError(err)
+	a.Equal(uint64(0), maxID)
+	offsets, err := mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{}, offsets)
+
+	// and the other partition is kept
+	maxID, err = mStore.MaxMessageID("bar")
+	a.NoError(err)
+	a.Equal(uint64(1), maxID)
+
+	// and the next messages start a new sequence
+	a.NoError(mStore.Store("foo", 1, aMessageAt(1, now)))
+	a.NoError(mStore.Store("foo", 2, aMessageAt(2, now)))
+	offsets, err = mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 1, LastID: 2, Count: 2}, offsets)
+	a.NoError(mStore.Stop())
+
+	// and only the new messages are loaded again
+	mStore = New(dir)
+	offsets, err = mStore.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 1, LastID: 2, Count: 2}, offsets)
+	a.NoError(mStore.Stop())
+}
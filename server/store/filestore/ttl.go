@@ -0,0 +1,91 @@
+package filestore
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// topicTTLs are the message TTLs of the topics of a partition, by the path of the topic.
+// It is replaced instead of being changed, so that it can be used without holding the lock of the partition.
+type topicTTLs map[protocol.Path]time.Duration
+
+// with returns a copy of the TTLs with the TTL of the topic, or without it if the ttl is zero
+func (t topicTTLs) with(topic protocol.Path, ttl time.Duration) topicTTLs {
+	result := make(topicTTLs, len(t)+1)
+	for path, d := range t {
+		result[path] = d
+	}
+	if ttl > 0 {
+		result[topic] = ttl
+	} else {
+		delete(result, topic)
+	}
+	return result
+}
+
+// of returns the TTL of the most specific topic of the path, or zero if the messages of the path do not expire
+func (t topicTTLs) of(path protocol.Path) time.Duration {
+	for {
+		if ttl, ok := t[path]; ok {
+			return ttl
+		}
+		i := strings.LastIndex(string(path), "/")
+		if i <= 0 {
+			return 0
+		}
+		path = path[:i]
+	}
+}
+
+// uniform returns the TTL, if it applies to all messages of the partition, i.e. it is only set for the partition itself.
+// The messages of a uniform TTL expire in the order they were stored.
+func (t topicTTLs) uniform(partition string) (time.Duration, bool) {
+	ttl, ok := t[protocol.Path("/"+partition)]
+	return ttl, ok && len(t) == 1
+}
+
+// isExpired returns true if the message was published before the TTL of its topic.
+// Data which is not a guble message never expires.
+func (t topicTTLs) isExpired(data []byte, now time.Time) bool {
+	path, publishingTime, ok := messageMetadata(data)
+	if !ok {
+		return false
+	}
+	ttl := t.of(path)
+	return ttl > 0 && time.Unix(publishingTime, 0).Before(now.Add(-ttl))
+}
+
+// topicOfTTL returns the path of a topic, as the TTLs are set also for topics without a leading slash
+func topicOfTTL(topic string) protocol.Path {
+	if !strings.HasPrefix(topic, "/") {
+		topic = "/" + topic
+	}
+	return protocol.Path(strings.TrimSuffix(topic, "/"))
+}
+
+// messageTime parses the publishing time out of the metadata line of a serialized message
+func messageTime(data []byte) (int64, bool) {
+	_, publishingTime, ok := messageMetadata(data)
+	return publishingTime, ok
+}
+
+// messageMetadata parses the path and the publishing time out of the metadata line of a serialized message
+func messageMetadata(data []byte) (protocol.Path, int64, bool) {
+	metadata := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		metadata = data[:i]
+	}
+	fields := bytes.Split(metadata, []byte(","))
+	if (len(fields) != 7 && len(fields) != 8) || len(fields[0]) == 0 || fields[0][0] != '/' {
+		return "", 0, false
+	}
+	publishingTime, err := strconv.ParseInt(string(fields[5]), 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return protocol.Path(fields[0]), publishingTime, true
+}
@@ -0,0 +1,81 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	snowflakeSequenceBits = 12
+	snowflakeNodeIDBits   = 8
+	snowflakeNodeIDShift  = snowflakeSequenceBits
+	snowflakeTimeShift    = snowflakeSequenceBits + snowflakeNodeIDBits
+	snowflakeSequenceMask = 1<<snowflakeSequenceBits - 1
+
+	// snowflakeEpoch is the start of the timestamps of the snowflake ids, in milliseconds since the unix epoch
+	snowflakeEpoch = 1467714505012
+)
+
+// IDGenerator generates the ids of the messages published to a partition, when a MessageStore stores them.
+type IDGenerator interface {
+	// NextID returns the id of the next message of a partition and its publishing time as unix timestamp.
+	// The lastID is the last id generated or stored in the partition, and the returned id has to be greater.
+	NextID(lastID uint64, nodeID uint8) (uint64, int64, error)
+}
+
+// IDGeneratorSetter is implemented by a MessageStore, which generates the message ids by a pluggable IDGenerator.
+type IDGeneratorSetter interface {
+	SetIDGenerator(IDGenerator)
+}
+
+// SequenceIDGenerator generates a sequence per partition: 1, 2, 3, ...
+// The ids of a partition are strictly sequential, so the difference of two ids is the number of messages between them.
+// The node id is not part of the ids, so the messages of different nodes can have the same ids.
+type SequenceIDGenerator struct{}
+
+// NextID is a part of the `IDGenerator` implementation.
+func (SequenceIDGenerator) NextID(lastID uint64, nodeID uint8) (uint64, int64, error) {
+	return lastID + 1, time.Now().Unix(), nil
+}
+
+// SnowflakeIDGenerator generates ids, which are unique over all nodes of a cluster:
+// the milliseconds since the snowflakeEpoch, followed by the 8 bits of the node id and a sequence of 12 bits
+// for the messages of the same millisecond.
+// The ids are increasing within a partition, and give a rough time order over all partitions and nodes
+// (within the skew of the clocks of the nodes), but they are not sequential.
+// If the clock moves backwards, the ids continue after the last id of the partition.
+type SnowflakeIDGenerator struct {
+	now func() time.Time
+}
+
+// NewSnowflakeIDGenerator returns a new SnowflakeIDGenerator.
+func NewSnowflakeIDGenerator() *SnowflakeIDGenerator {
+	return &SnowflakeIDGenerator{now: time.Now}
+}
+
+// NextID is a part of the `IDGenerator` implementation.
+func (g *SnowflakeIDGenerator) NextID(lastID uint64, nodeID uint8) (uint64, int64, error) {
+	now := g.now()
+	millis := now.UnixNano()/int64(time.Millisecond) - snowflakeEpoch
+	if millis < 0 {
+		return 0, 0, fmt.Errorf("store: the clock is before the epoch of the snowflake ids: %v", now)
+	}
+
+	node := uint64(nodeID) << snowflakeNodeIDShift
+	id := uint64(millis)<<snowflakeTimeShift | node
+	if id <= lastID {
+		// within the millisecond of the last id, or the clock moved backwards:
+		// continue the sequence of the last id, or take the next free millisecond of the node
+		lastTimestamp := lastID >> snowflakeTimeShift
+		lastNode := lastID &^ (lastTimestamp << snowflakeTimeShift) &^ snowflakeSequenceMask
+		switch {
+		case lastNode == node && lastID&snowflakeSequenceMask < snowflakeSequenceMask:
+			id = lastID + 1
+		case lastNode < node:
+			id = lastTimestamp<<snowflakeTimeShift | node
+		default:
+			id = (lastTimestamp+1)<<snowflakeTimeShift | node
+		}
+	}
+	return id, now.Unix(), nil
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceIDGenerator_NextID(t *testing.T) {
+	a := assert.New(t)
+
+	id, ts, err := SequenceIDGenerator{}.NextID(41, 3)
+	a.NoError(err)
+	a.Equal(uint64(42), id)
+	a.InDelta(time.Now().Unix(), ts, 1)
+}
+
+func TestSnowflakeIDGenerator_NextID(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Unix(1500000000, 0)
+	g := NewSnowflakeIDGenerator()
+	g.now = func() time.Time { return now }
+	millis := uint64(1500000000000 - snowflakeEpoch)
+
+	// the id contains the milliseconds and the node id
+	id, ts, err := g.NextID(0, 3)
+	a.NoError(err)
+	a.Equal(millis<<20|3<<12, id)
+	a.Equal(int64(1500000000), ts)
+
+	// within the same millisecond, the sequence of the last id continues
+	id2, _, err := g.NextID(id, 3)
+	a.NoError(err)
+	a.Equal(id+1, id2)
+
+	// and another node in the same millisecond starts its own sequence
+	otherNode, _, err := g.NextID(id2, 5)
+	a.NoError(err)
+	a.Equal(millis<<20|5<<12, otherNode)
+
+	// and a node lower than the one of the last id takes the next millisecond
+	lowerNode, _, err := g.NextID(otherNode, 1)
+	a.NoError(err)
+	a.Equal((millis+1)<<20|1<<12, lowerNode)
+
+	// and a full sequence continues in the next millisecond
+	full, _, err := g.NextID(millis<<20|3<<12|snowflakeSequenceMask, 3)
+	a.NoError(err)
+	a.Equal((millis+1)<<20|3<<12, full)
+
+	// and the ids keep increasing, when the clock moves backwards
+	now = now.Add(-time.Second)
+	back, _, err := g.NextID(id2, 3)
+	a.NoError(err)
+	a.Equal(id2+1, back)
+
+	// and a later millisecond starts a new sequence
+	now = now.Add(2 * time.Second)
+	later, _, err := g.NextID(id2, 3)
+	a.NoError(err)
+	a.Equal((millis+1000)<<20|3<<12, later)
+
+	// and a sequential last id is followed by a snowflake id
+	switched, _, err := g.NextID(1000, 3)
+	a.NoError(err)
+	a.Equal(later, switched)
+
+	// a clock before the epoch is an error
+	now = time.Unix(0, 0)
+	_, _, err = g.NextID(0, 3)
+	a.Error(err)
+}
@@ -0,0 +1,318 @@
+package memorystore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+)
+
+// DefaultMaxMessages is the default number of messages kept per partition
+const DefaultMaxMessages = 10000
+
+// MemoryMessageStore is an implementation of the MessageStore interface, keeping the messages only in memory,
+// for the deployments without persistence. Each partition keeps its last messages in a ring buffer,
+// evicting the oldest message when the buffer is full. The fetches, the replay and the offsets
+// work within the retained messages. The messages and their ids are lost on a restart.
+// The message ids are a sequence per partition by default, so the store is not meant for a cluster.
+type MemoryMessageStore struct {
+	maxMessages int
+	idGenerator store.IDGenerator
+
+	mutex      sync.Mutex
+	partitions map[string]*messagePartition
+}
+
+// New returns a new MemoryMessageStore, keeping at most maxMessages per partition
+// (a non-positive maxMessages keeps the DefaultMaxMessages).
+func New(maxMessages int) *MemoryMessageStore {
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxMessages
+	}
+	return &MemoryMessageStore{
+		maxMessages: maxMessages,
+		idGenerator: store.SequenceIDGenerator{},
+		partitions:  make(map[string]*messagePartition),
+	}
+}
+
+// Store is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) Store(partition string, msgID uint64, msg []byte) error {
+	return mms.partition(partition).Store(msgID, msg)
+}
+
+// StoreMessage is a part of the `store.MessageStore` implementation.
+// The id of a message published to this node is generated and stored atomically,
+// so that the messages of concurrent publishers are kept in the order of their ids.
+func (mms *MemoryMessageStore) StoreMessage(message *protocol.Message, nodeID uint8) (int, error) {
+	p := mms.partition(message.Path.Partition())
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if nodeID == 0 || message.NodeID == 0 {
+		id, ts, err := p.nextMsgID(nodeID)
+		if err != nil {
+			return 0, err
+		}
+		message.ID, message.Time = id, ts
+		message.NodeID = nodeID
+	}
+	data := message.Bytes()
+	if err := p.store(message.ID, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Fetch is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) Fetch(req *store.FetchRequest) {
+	mms.partition(req.Partition).Fetch(req)
+}
+
+// MaxMessageID is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) MaxMessageID(partition string) (uint64, error) {
+	return mms.partition(partition).MaxMessageID(), nil
+}
+
+// DoInTx is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) DoInTx(partition string, fnToExecute func(uint64) error) error {
+	return mms.partition(partition).DoInTx(fnToExecute)
+}
+
+// GenerateNextMsgID is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) GenerateNextMsgID(partition string, nodeID uint8) (uint64, int64, error) {
+	p := mms.partition(partition)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.nextMsgID(nodeID)
+}
+
+// SetIDGenerator is a part of the `store.IDGeneratorSetter` implementation.
+// It applies to the partitions created after the call, so it has to be called before storing messages.
+func (mms *MemoryMessageStore) SetIDGenerator(generator store.IDGenerator) {
+	mms.mutex.Lock()
+	defer mms.mutex.Unlock()
+
+	mms.idGenerator = generator
+}
+
+// Partition is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) Partition(partition string) (store.MessagePartition, error) {
+	return mms.partition(partition), nil
+}
+
+// Partitions is a part of the `store.MessageStore` implementation.
+func (mms *MemoryMessageStore) Partitions() ([]store.MessagePartition, error) {
+	mms.mutex.Lock()
+	defer mms.mutex.Unlock()
+
+	partitions := make([]store.MessagePartition, 0, len(mms.partitions))
+	for _, p := range mms.partitions {
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+// Offsets is a part of the `store.OffsetsReader` implementation.
+func (mms *MemoryMessageStore) Offsets(partition string) (store.Offsets, error) {
+	return mms.partition(partition).offsets(), nil
+}
+
+// Truncate is a part of the `store.Truncater` implementation.
+func (mms *MemoryMessageStore) Truncate(partition string) error {
+	mms.partition(partition).truncate()
+	return nil
+}
+
+// partition returns the partition, creating it if it does not exist
+func (mms *MemoryMessageStore) partition(name string) *messagePartition {
+	mms.mutex.Lock()
+	defer mms.mutex.Unlock()
+
+	p, ok := mms.partitions[name]
+	if !ok {
+		p = newMessagePartition(name, mms.maxMessages, mms.idGenerator)
+		mms.partitions[name] = p
+	}
+	return p
+}
+
+// messagePartition keeps the last messages of a partition in a ring buffer, ordered by id
+type messagePartition struct {
+	name        string
+	idGenerator store.IDGenerator
+
+	mutex sync.RWMutex
+
+	// messages is the ring buffer of the retained messages, with the oldest one at position head
+	messages []*store.FetchedMessage
+	head     int
+	size     int
+
+	// maxMessageID is the id of the last stored message, lastGeneratedID the last id generated for a message
+	maxMessageID    uint64
+	lastGeneratedID uint64
+}
+
+func newMessagePartition(name string, maxMessages int, idGenerator store.IDGenerator) *messagePartition {
+	return &messagePartition{
+		name:        name,
+		idGenerator: idGenerator,
+		messages:    make([]*store.FetchedMessage, maxMessages),
+	}
+}
+
+// Name is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) Name() string {
+	return p.name
+}
+
+// MaxMessageID is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) MaxMessageID() uint64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.maxMessageID
+}
+
+// Count returns the number of the retained messages.
+// It is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) Count() uint64 {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return uint64(p.size)
+}
+
+// Store is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) Store(msgID uint64, msg []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.store(msgID, msg)
+}
+
+// DoInTx is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) DoInTx(fnToExecute func(uint64) error) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return fnToExecute(p.maxMessageID)
+}
+
+// Fetch sends the requested messages within the retained ones, in the order of their ids.
+// It is a part of the `store.MessagePartition` implementation.
+func (p *messagePartition) Fetch(req *store.FetchRequest) {
+	messages := p.fetchList(req)
+	go func() {
+		req.StartC <- len(messages)
+		for _, m := range messages {
+			if req.IsDone() {
+				return
+			}
+			req.PushFetchMessage(m)
+		}
+		req.Done()
+	}()
+}
+
+// store appends the message to the ring buffer, evicting the oldest one if the buffer is full.
+// The caller has to hold the lock.
+func (p *messagePartition) store(msgID uint64, msg []byte) error {
+	if msgID <= p.maxMessageID {
+		return fmt.Errorf("MemoryMessageStore: Invalid message id %d for partition %v. The last id is %d",
+			msgID, p.name, p.maxMessageID)
+	}
+	m := &store.FetchedMessage{ID: msgID, Message: msg}
+	if p.size < len(p.messages) {
+		p.messages[(p.head+p.size)%len(p.messages)] = m
+		p.size++
+	} else {
+		p.messages[p.head] = m
+		p.head = (p.head + 1) % len(p.messages)
+	}
+	p.maxMessageID = msgID
+	return nil
+}
+
+// nextMsgID returns the next id of the partition by its IDGenerator, and the current time of the message.
+// The caller has to hold the lock.
+func (p *messagePartition) nextMsgID(nodeID uint8) (uint64, int64, error) {
+	if p.lastGeneratedID < p.maxMessageID {
+		p.lastGeneratedID = p.maxMessageID
+	}
+	id, ts, err := p.idGenerator.NextID(p.lastGeneratedID, nodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	p.lastGeneratedID = id
+	return id, ts, nil
+}
+
+// get returns the retained message at the position i, from the oldest one
+func (p *messagePartition) get(i int) *store.FetchedMessage {
+	return p.messages[(p.head+i)%len(p.messages)]
+}
+
+// fetchList returns the messages of the request, like the FileMessageStore:
+// starting at the StartID, or the closest retained message in the direction of the request,
+// up to the Count and the EndID, in the order of their ids.
+func (p *messagePartition) fetchList(req *store.FetchRequest) []*store.FetchedMessage {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	// the position of the first message with an id not lower than the StartID
+	pos := sort.Search(p.size, func(i int) bool { return p.get(i).ID >= req.StartID })
+
+	var messages []*store.FetchedMessage
+	if req.Direction >= 0 {
+		for i := pos; i < p.size && len(messages) < req.Count; i++ {
+			m := p.get(i)
+			if req.EndID > 0 && m.ID > req.EndID {
+				break
+			}
+			messages = append(messages, m)
+		}
+		return messages
+	}
+
+	// backwards from the last message with an id not higher than the StartID, or from the last one
+	if req.StartID == 0 {
+		pos = p.size - 1
+	} else if pos == p.size || p.get(pos).ID > req.StartID {
+		pos--
+	}
+	for i := pos; i >= 0 && len(messages) < req.Count; i-- {
+		m := p.get(i)
+		if req.EndID > 0 && m.ID < req.EndID {
+			break
+		}
+		messages = append([]*store.FetchedMessage{m}, messages...)
+	}
+	return messages
+}
+
+// offsets returns the ids of the oldest and the last retained message and their number
+func (p *messagePartition) offsets() store.Offsets {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	offsets := store.Offsets{LastID: p.maxMessageID, Count: uint64(p.size)}
+	if p.size > 0 {
+		offsets.FirstID = p.get(0).ID
+	}
+	return offsets
+}
+
+// truncate removes all messages and resets the message ids
+func (p *messagePartition) truncate() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.messages = make([]*store.FetchedMessage, len(p.messages))
+	p.head, p.size = 0, 0
+	p.maxMessageID, p.lastGeneratedID = 0, 0
+}
@@ -0,0 +1,157 @@
+package memorystore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeMessages(a *assert.Assertions, mms *MemoryMessageStore, n int) {
+	for i := 1; i <= n; i++ {
+		_, err := mms.StoreMessage(&protocol.Message{Path: "/foo/bar", Body: []byte(fmt.Sprintf("message %d", i))}, 0)
+		a.NoError(err)
+	}
+}
+
+func fetchIDs(a *assert.Assertions, mms *MemoryMessageStore, start, end uint64, direction store.FetchDirection, count int) []uint64 {
+	req := store.NewFetchRequest("foo", start, end, direction, count)
+	req.Init()
+	mms.Fetch(req)
+
+	ids := []uint64{}
+	select {
+	case n := <-req.StartC:
+		for m := range req.MessageC {
+			ids = append(ids, m.ID)
+		}
+		a.Equal(n, len(ids))
+	case <-time.After(time.Second):
+		a.Fail("timeout")
+	}
+	return ids
+}
+
+func Test_MemoryMessageStore_StoresAndFetches(t *testing.T) {
+	a := assert.New(t)
+	mms := New(10)
+	storeMessages(a, mms, 5)
+
+	a.Equal(uint64(5), fne(mms.MaxMessageID("foo")))
+	a.Equal([]uint64{1, 2, 3, 4, 5}, fetchIDs(a, mms, 0, 0, store.DirectionForward, -1))
+	a.Equal([]uint64{2, 3}, fetchIDs(a, mms, 2, 0, store.DirectionForward, 2))
+	a.Equal([]uint64{2, 3, 4}, fetchIDs(a, mms, 2, 4, store.DirectionForward, -1))
+	a.Equal([]uint64{3, 4, 5}, fetchIDs(a, mms, 5, 0, store.DirectionBackwards, 3))
+	a.Equal([]uint64{4, 5}, fetchIDs(a, mms, 0, 0, store.DirectionBackwards, 2))
+	a.Equal([]uint64{}, fetchIDs(a, mms, 6, 0, store.DirectionForward, -1))
+
+	// and the stored message is fetched as its serialization
+	req := store.NewFetchRequest("foo", 3, 0, store.DirectionOneMessage, 1)
+	req.Init()
+	mms.Fetch(req)
+	a.Equal(1, <-req.StartC)
+	m, err := protocol.ParseMessage((<-req.MessageC).Message)
+	a.NoError(err)
+	a.Equal(uint64(3), m.ID)
+	a.Equal("message 3", string(m.Body))
+}
+
+func Test_MemoryMessageStore_EvictsTheOldestMessages(t *testing.T) {
+	a := assert.New(t)
+	mms := New(3)
+	storeMessages(a, mms, 5)
+
+	// only the last messages are retained, and a start before them begins at the oldest one
+	a.Equal([]uint64{3, 4, 5}, fetchIDs(a, mms, 1, 0, store.DirectionForward, -1))
+	a.Equal([]uint64{3, 4, 5}, fetchIDs(a, mms, 5, 0, store.DirectionBackwards, -1))
+	offsets, err := mms.Offsets("foo")
+	a.NoError(err)
+	a.Equal(store.Offsets{FirstID: 3, LastID: 5, Count: 3}, offsets)
+
+	// and the ids continue after the evicted ones
+	storeMessages(a, mms, 1)
+	a.Equal([]uint64{4, 5, 6}, fetchIDs(a, mms, 0, 0, store.DirectionForward, -1))
+	a.Equal(uint64(3), mms.partition("foo").Count())
+}
+
+func Test_MemoryMessageStore_RejectsAnOutdatedID(t *testing.T) {
+	a := assert.New(t)
+	mms := New(3)
+
+	a.NoError(mms.Store("foo", 1, []byte("a")))
+	a.NoError(mms.Store("foo", 42, []byte("b")))
+	a.Error(mms.Store("foo", 42, []byte("c")))
+	id, _, err := mms.GenerateNextMsgID("foo", 0)
+	a.NoError(err)
+	a.Equal(uint64(43), id)
+}
+
+func Test_MemoryMessageStore_SnowflakeIDs(t *testing.T) {
+	a := assert.New(t)
+	mms := New(10)
+	mms.SetIDGenerator(store.NewSnowflakeIDGenerator())
+
+	// the ids of a node are increasing, and contain its node id
+	var lastID uint64
+	for i := 0; i < 100; i++ {
+		m := &protocol.Message{Path: "/foo/bar", Body: []byte("message")}
+		_, err := mms.StoreMessage(m, 5)
+		a.NoError(err)
+		a.True(m.ID > lastID)
+		a.Equal(uint64(5), m.ID>>12&0xff)
+		a.Equal(uint8(5), m.NodeID)
+		lastID = m.ID
+	}
+	a.Equal(lastID, fne(mms.MaxMessageID("foo")))
+}
+
+func Test_MemoryMessageStore_Truncate(t *testing.T) {
+	a := assert.New(t)
+	mms := New(3)
+	storeMessages(a, mms, 2)
+
+	a.NoError(mms.Truncate("foo"))
+	a.Equal(uint64(0), fne(mms.MaxMessageID("foo")))
+	a.Equal([]uint64{}, fetchIDs(a, mms, 0, 0, store.DirectionForward, -1))
+	storeMessages(a, mms, 1)
+	a.Equal([]uint64{1}, fetchIDs(a, mms, 0, 0, store.DirectionForward, -1))
+}
+
+func Test_MemoryMessageStore_ConcurrentStoresAndFetches(t *testing.T) {
+	a := assert.New(t)
+	mms := New(50)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			storeMessages(a, mms, 100)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				ids := fetchIDs(a, mms, 0, 0, store.DirectionForward, -1)
+				for k := 1; k < len(ids); k++ {
+					a.Equal(ids[k-1]+1, ids[k])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.Equal(uint64(400), fne(mms.MaxMessageID("foo")))
+	a.Len(fetchIDs(a, mms, 0, 0, store.DirectionForward, -1), 50)
+}
+
+func fne(args ...interface{}) interface{} {
+	if args[1] != nil {
+		panic(args[1])
+	}
+	return args[0]
+}
@@ -29,7 +29,7 @@ type MessageStore interface {
 	// The error result if the fnToExecute or an error while locking will be returned by DoInTx.
 	DoInTx(partition string, fnToExecute func(uint64) error) error
 
-	// GenerateNextMsgId generates a new message ID based on a timestamp in a strictly monotonically order
+	// GenerateNextMsgId generates a new message ID of the partition by its IDGenerator, in a strictly monotonically order
 	GenerateNextMsgID(partition string, nodeID uint8) (uint64, int64, error)
 
 	Partition(string) (MessagePartition, error)
@@ -38,6 +38,66 @@ type MessageStore interface {
 	Partitions() ([]MessagePartition, error)
 }
 
+// Offsets describe the messages of a partition which can be fetched
+type Offsets struct {
+	// FirstID is the id of the oldest message not removed by the retention, or 0 if there is none
+	FirstID uint64
+
+	// LastID is the id of the last message stored in the partition
+	LastID uint64
+
+	// Count is the number of messages from FirstID to LastID
+	Count uint64
+}
+
+// OffsetsReader is implemented by a MessageStore, which can read the offsets of a partition from its index.
+type OffsetsReader interface {
+	Offsets(partition string) (Offsets, error)
+}
+
+// Truncater is implemented by a MessageStore, which can delete all messages of a partition.
+type Truncater interface {
+	// Truncate deletes the messages and the index of the partition, and resets its message ids,
+	// so the next message stored starts a new sequence.
+	Truncate(partition string) error
+}
+
+// PartitionCloser is implemented by a MessageStore, which can close an open partition and release its resources,
+// e.g. its open files. The messages are kept, and the partition is opened again when it is used.
+type PartitionCloser interface {
+	ClosePartition(partition string) error
+}
+
+// ReplayFunc is called by a Replayer with each message of a replay, in the order of the fetch request.
+// The message is only valid until the function returns: it is a slice of a buffer of the store,
+// which is reused for the next message. A function retaining the message, or a part of it, has to copy it.
+// Returning an error stops the replay.
+type ReplayFunc func(id uint64, message []byte) error
+
+// Replayer is implemented by a MessageStore, which can replay the messages of a fetch request
+// synchronously, without allocating a buffer for each message, e.g. for large catch-ups.
+type Replayer interface {
+	// Replay calls fn with each message of the partition selected by the ids, the direction and the count
+	// of the request (its channels are not used). It returns the first error of the store or of fn.
+	Replay(req *FetchRequest, fn ReplayFunc) error
+}
+
+// HeaderFunc is called by a HeaderIndex with the id and the indexed header fields of each message of a scan,
+// by the indexed keys. The fields not set in the header of the message are missing.
+// Returning an error stops the scan.
+type HeaderFunc func(id uint64, header map[string]string) error
+
+// HeaderIndex is implemented by a MessageStore, which can keep selected header fields of the messages in its index,
+// so that the messages can be filtered by them without reading the messages.
+type HeaderIndex interface {
+	// IndexedHeaders returns the header keys indexed for the partition, or none if its headers are not indexed.
+	IndexedHeaders(partition string) []string
+
+	// ScanHeaders calls fn with the indexed header fields of each message of the partition selected by the request,
+	// as by Replay. It returns the first error of the store or of fn.
+	ScanHeaders(req *FetchRequest, fn HeaderFunc) error
+}
+
 type MessagePartition interface {
 
 	// Name returns the name of the partition
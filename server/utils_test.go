@@ -127,7 +127,7 @@ func (tcn *testClusterNode) client(userID string, bufferSize int, autoReconnect
 	wsURL := "ws://" + serverAddr + "/stream/user/" + userID
 	httpURL := "http://" + serverAddr
 
-	return client.Open(wsURL, httpURL, bufferSize, autoReconnect)
+	return client.Open(wsURL, httpURL, bufferSize, autoReconnect, false, client.DefaultBackoff, nil, nil, "")
 }
 
 func (tcn *testClusterNode) Subscribe(topic, id string) {
@@ -0,0 +1,7 @@
+package webhook
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+var logger = log.WithField("module", "webhook")
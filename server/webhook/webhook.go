@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/router"
+)
+
+const (
+	// schema is the default database schema for the webhook subscriptions
+	schema = "webhook_subscription"
+
+	// targetKey is the route param holding the target URL, encoded as unpadded base64url
+	targetKey = "target"
+)
+
+var (
+	// ErrInvalidTarget is returned when the target URL of a subscription cannot be decoded
+	ErrInvalidTarget = errors.New("Invalid webhook target URL")
+)
+
+// Config is used for configuring the webhook connector.
+type Config struct {
+	Enabled *bool
+	Prefix  *string
+	Workers *int
+	Secret  *string
+	Retries *int
+	Timeout *time.Duration
+	Events  *connector.Events
+}
+
+// webhook is the connector POSTing the messages of the subscriptions to their target URLs
+type webhook struct {
+	Config
+	connector.Connector
+}
+
+// New creates a new webhook connector and returns it as an connector.ResponsiveConnector
+func New(router router.Router, sender connector.Sender, config Config) (connector.ResponsiveConnector, error) {
+	baseConn, err := connector.NewConnector(router, sender, connector.Config{
+		Name:       "webhook",
+		Schema:     schema,
+		Prefix:     *config.Prefix,
+		URLPattern: fmt.Sprintf("/{%s}/{%s:.*}", targetKey, connector.TopicParam),
+		Workers:    *config.Workers,
+		Events:     config.Events,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Base connector error")
+		return nil, err
+	}
+
+	w := &webhook{config, baseConn}
+	w.SetResponseHandler(w)
+	return w, nil
+}
+
+// HandleResponse advances the subscription after a successful delivery,
+// and removes it if the target rejected the message permanently (4xx) or is invalid.
+func (w *webhook) HandleResponse(request connector.Request, responseIface interface{}, metadata *connector.Metadata, err error) error {
+	subscriber := request.Subscriber()
+	if err == ErrInvalidTarget {
+		logger.WithField("target", subscriber.Route().Get(targetKey)).Error("Removing webhook subscription with invalid target")
+		w.Manager().Remove(subscriber)
+		return err
+	}
+	if err != nil {
+		logger.WithError(err).Error("Error sending message to webhook")
+		return err
+	}
+
+	response, ok := responseIface.(*Response)
+	if !ok {
+		return fmt.Errorf("Invalid webhook response")
+	}
+	message := request.Message()
+
+	switch {
+	case response.Ok():
+		logger.WithFields(log.Fields{
+			"message_id": message.ID,
+			"status":     response.StatusCode,
+		}).Debug("Delivered message to webhook")
+		subscriber.SetLastID(message.ID)
+		if err := w.Manager().Update(subscriber); err != nil {
+			logger.WithError(err).Error("Manager could not update subscription")
+			return err
+		}
+		return nil
+	case response.Permanent():
+		logger.WithFields(log.Fields{
+			"message_id": message.ID,
+			"status":     response.StatusCode,
+		}).Warn("Webhook rejected message, removing subscription")
+		if err := w.Manager().Remove(subscriber); err != nil {
+			logger.WithError(err).Error("Could not remove webhook subscription")
+		}
+		return fmt.Errorf("Webhook rejected message with status %d", response.StatusCode)
+	default:
+		logger.WithFields(log.Fields{
+			"message_id": message.ID,
+			"status":     response.StatusCode,
+		}).Error("Unexpected webhook response")
+		return fmt.Errorf("Unexpected webhook response status %d", response.StatusCode)
+	}
+}
+
+// EncodeTarget returns the target URL encoded for the subscription path
+func EncodeTarget(target string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(target))
+}
+
+// decodeTarget returns the target URL of a subscription, which has to be an absolute http(s) URL
+func decodeTarget(encoded string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidTarget
+	}
+	target, err := url.Parse(string(decoded))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return "", ErrInvalidTarget
+	}
+	return target.String(), nil
+}
@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jpillora/backoff"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+)
+
+const (
+	// SignatureHeader is the HTTP header holding the HMAC-SHA256 of the request body, signed with the shared secret
+	SignatureHeader = "X-Guble-Signature"
+
+	// signaturePrefix is prepended to the hex-encoded signature
+	signaturePrefix = "sha256="
+
+	// ContentTypeHeader is the HTTP header forwarding the content-type of the message body, as the request itself is JSON
+	ContentTypeHeader = "X-Guble-Content-Type"
+
+	// SchemaHeader is the HTTP header forwarding the schema of the message body
+	SchemaHeader = "X-Guble-Schema"
+
+	// SchemaVersionHeader is the HTTP header forwarding the schema version of the message body
+	SchemaVersionHeader = "X-Guble-Schema-Version"
+)
+
+// Response is the response of a webhook target
+type Response struct {
+	StatusCode int
+}
+
+// Ok returns true if the target accepted the message
+func (r *Response) Ok() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// Permanent returns true if the target rejected the message, so that retrying is pointless
+func (r *Response) Permanent() bool {
+	return r.StatusCode >= 400 && r.StatusCode < 500
+}
+
+func (r *Response) retryable() bool {
+	return r.StatusCode >= 500
+}
+
+// payload is the JSON body POSTed to the webhook target
+type payload struct {
+	ID            uint64          `json:"id"`
+	Path          protocol.Path   `json:"path"`
+	UserID        string          `json:"user_id"`
+	ApplicationID string          `json:"application_id"`
+	Time          int64           `json:"time"`
+	Header        json.RawMessage `json:"header,omitempty"`
+	ContentType   string          `json:"content_type,omitempty"`
+	Schema        string          `json:"schema,omitempty"`
+	SchemaVersion string          `json:"schema_version,omitempty"`
+	Body          string          `json:"body"`
+}
+
+func newPayload(m *protocol.Message) (*payload, error) {
+	// decompress a copy, since the message is shared with the other routes
+	msg := *m
+	if err := msg.DecompressBody(); err != nil {
+		return nil, err
+	}
+	p := &payload{
+		ID:            msg.ID,
+		Path:          msg.Path,
+		UserID:        msg.UserID,
+		ApplicationID: msg.ApplicationID,
+		Time:          msg.Time,
+		Schema:        msg.Schema(),
+		SchemaVersion: msg.SchemaVersion(),
+		Body:          string(msg.Body),
+	}
+	// an invalid content-type was rejected when publishing, and is not forwarded
+	p.ContentType, _ = msg.ContentType()
+	if msg.HeaderJSON != "" {
+		p.Header = json.RawMessage(msg.HeaderJSON)
+	}
+	return p, nil
+}
+
+type sender struct {
+	client  *http.Client
+	secret  []byte
+	retries int
+	backoff backoff.Backoff
+
+	// onRetry is called before each retry, see SetRetryHandler
+	onRetry func(connector.Request, error)
+}
+
+// NewSender returns a sender POSTing to the targets of the subscriptions,
+// signing the requests if a secret is configured and retrying on 5xx responses and network errors.
+func NewSender(config Config) connector.Sender {
+	s := &sender{
+		client: &http.Client{Timeout: *config.Timeout},
+		backoff: backoff.Backoff{
+			Min:    100 * time.Millisecond,
+			Max:    10 * time.Second,
+			Factor: 2,
+			Jitter: true,
+		},
+	}
+	if config.Secret != nil && *config.Secret != "" {
+		s.secret = []byte(*config.Secret)
+	}
+	if config.Retries != nil {
+		s.retries = *config.Retries
+	}
+	return s
+}
+
+// SetRetryHandler is an implementation of connector.RetryingSender
+func (s *sender) SetRetryHandler(handler func(connector.Request, error)) {
+	s.onRetry = handler
+}
+
+func (s *sender) Send(request connector.Request) (interface{}, error) {
+	return s.SendContext(context.Background(), request)
+}
+
+// SendContext is an implementation of connector.CancelableSender: the request and its retries are canceled with the context.
+func (s *sender) SendContext(ctx context.Context, request connector.Request) (interface{}, error) {
+	target, err := decodeTarget(request.Subscriber().Route().Get(targetKey))
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPayload(request.Message())
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	// the backoff is per request, as the workers send concurrently
+	b := s.backoff
+	for try := 0; ; try++ {
+		response, err := s.post(ctx, target, body, p)
+		if err == nil && !response.retryable() {
+			return response, nil
+		}
+		if try >= s.retries {
+			return response, err
+		}
+		d := b.Duration()
+		logger.WithFields(log.Fields{
+			"target": target,
+			"try":    try + 1,
+			"error":  err,
+		}).Warn("Retrying webhook in ", d)
+		if s.onRetry != nil {
+			s.onRetry(request, retryError(response, err))
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return response, ctx.Err()
+		}
+	}
+}
+
+// retryError returns the error of a retried request, which is the status of a response without error
+func retryError(response *Response, err error) error {
+	if err == nil && response != nil {
+		return fmt.Errorf("Webhook target responded with status %d", response.StatusCode)
+	}
+	return err
+}
+
+func (s *sender) post(ctx context.Context, target string, body []byte, p *payload) (*Response, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, ErrInvalidTarget
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for header, value := range map[string]string{
+		ContentTypeHeader:   p.ContentType,
+		SchemaHeader:        p.Schema,
+		SchemaVersionHeader: p.SchemaVersion,
+	} {
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	if s.secret != nil {
+		req.Header.Set(SignatureHeader, signaturePrefix+Sign(s.secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// drain the body, so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	return &Response{StatusCode: resp.StatusCode}, nil
+}
+
+// Sign returns the hex-encoded HMAC-SHA256 of the body, as sent in the SignatureHeader
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
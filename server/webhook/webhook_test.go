@@ -0,0 +1,353 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/connector"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig(retries int) Config {
+	enabled := true
+	prefix := "/webhook/"
+	workers := 1
+	secret := "s3cret"
+	timeout := time.Second
+	return Config{
+		Enabled: &enabled,
+		Prefix:  &prefix,
+		Workers: &workers,
+		Secret:  &secret,
+		Retries: &retries,
+		Timeout: &timeout,
+	}
+}
+
+func testSender(retries int) *sender {
+	s := NewSender(testConfig(retries)).(*sender)
+	s.backoff.Min = time.Millisecond
+	s.backoff.Max = time.Millisecond
+	return s
+}
+
+func aRequest(target string, m *protocol.Message) connector.Request {
+	s := connector.NewSubscriber("/topic", router.RouteParams{targetKey: EncodeTarget(target)}, 0)
+	return connector.NewRequest(s, m)
+}
+
+func TestSender_PostsSignedMessage(t *testing.T) {
+	a := assert.New(t)
+
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Equal(http.MethodPost, r.Method)
+		a.Equal("application/json", r.Header.Get("Content-Type"))
+		signature = r.Header.Get(SignatureHeader)
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	response, err := testSender(0).Send(aRequest(server.URL+"/hook", &protocol.Message{
+		ID:         42,
+		Path:       "/topic",
+		UserID:     "user01",
+		Time:       1451236804,
+		HeaderJSON: `{"key":"value"}`,
+		Body:       []byte("Hello"),
+	}))
+	a.NoError(err)
+	a.True(response.(*Response).Ok())
+
+	a.Equal("sha256="+Sign([]byte("s3cret"), body), signature)
+	a.JSONEq(`{"id":42,"path":"/topic","user_id":"user01","application_id":"","time":1451236804,"header":{"key":"value"},"body":"Hello"}`, string(body))
+}
+
+func TestSender_ForwardsTheContentType(t *testing.T) {
+	a := assert.New(t)
+
+	var header http.Header
+	var p payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		a.NoError(json.NewDecoder(r.Body).Decode(&p))
+	}))
+	defer server.Close()
+
+	// when sending a message with a content-type and a schema
+	_, err := testSender(0).Send(aRequest(server.URL, &protocol.Message{
+		ID:         1,
+		Path:       "/topic",
+		HeaderJSON: `{"Content-Type":"application/x-protobuf","Schema":"orders.Order","Schema-Version":"3"}`,
+		Body:       []byte("Hello"),
+	}))
+	a.NoError(err)
+
+	// then they are passed in the headers of the request and in the payload
+	a.Equal("application/json", header.Get("Content-Type"))
+	a.Equal("application/x-protobuf", header.Get(ContentTypeHeader))
+	a.Equal("orders.Order", header.Get(SchemaHeader))
+	a.Equal("3", header.Get(SchemaVersionHeader))
+	a.Equal("application/x-protobuf", p.ContentType)
+	a.Equal("orders.Order", p.Schema)
+	a.Equal("3", p.SchemaVersion)
+}
+
+func TestSender_SendsCompressedBodyDecompressed(t *testing.T) {
+	a := assert.New(t)
+
+	var p payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.NoError(json.NewDecoder(r.Body).Decode(&p))
+	}))
+	defer server.Close()
+
+	m := &protocol.Message{ID: 1, Path: "/topic", Body: []byte("Hello")}
+	a.NoError(m.CompressBody())
+
+	_, err := testSender(0).Send(aRequest(server.URL, m))
+	a.NoError(err)
+	a.Equal("Hello", p.Body)
+	a.True(m.Compressed)
+}
+
+func TestSender_RetriesOnServerErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	response, err := testSender(3).Send(aRequest(server.URL, &protocol.Message{ID: 1}))
+	a.NoError(err)
+	a.True(response.(*Response).Ok())
+	a.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	// when the retries are exhausted, the last response is returned
+	atomic.StoreInt32(&calls, 0)
+	response, err = testSender(1).Send(aRequest(server.URL, &protocol.Message{ID: 1}))
+	a.NoError(err)
+	a.Equal(http.StatusServiceUnavailable, response.(*Response).StatusCode)
+	a.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestSender_ReportsTheRetries(t *testing.T) {
+	a := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	// given a sender with a retry handler
+	s := testSender(3)
+	var retries []error
+	s.SetRetryHandler(func(r connector.Request, err error) {
+		a.Equal(uint64(1), r.Message().ID)
+		retries = append(retries, err)
+	})
+
+	// when the message is sent after two retries, then both retries are reported with the status
+	_, err := s.Send(aRequest(server.URL, &protocol.Message{ID: 1}))
+	a.NoError(err)
+	if a.Len(retries, 2) {
+		a.EqualError(retries[0], "Webhook target responded with status 503")
+	}
+}
+
+func TestSender_DoesNotRetryOnClientErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	response, err := testSender(3).Send(aRequest(server.URL, &protocol.Message{ID: 1}))
+	a.NoError(err)
+	a.True(response.(*Response).Permanent())
+	a.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestSender_SendIsCanceledWithTheContext(t *testing.T) {
+	a := assert.New(t)
+
+	// given a target which does not respond
+	releaseC := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-releaseC
+	}))
+	defer server.Close()
+	defer close(releaseC)
+
+	// when the context of the send is canceled, then the send returns without waiting for the response
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := testSender(3).SendContext(ctx, aRequest(server.URL, &protocol.Message{ID: 1}))
+	a.Error(err)
+	a.True(time.Since(start) < 500*time.Millisecond)
+}
+
+func TestSender_InvalidTarget(t *testing.T) {
+	a := assert.New(t)
+
+	for _, target := range []string{"", "/relative", "ftp://example.com", "http://"} {
+		_, err := testSender(3).Send(aRequest(target, &protocol.Message{ID: 1}))
+		a.Equal(ErrInvalidTarget, err, target)
+	}
+
+	s := connector.NewSubscriber("/topic", router.RouteParams{targetKey: "not base64!"}, 0)
+	_, err := testSender(3).Send(connector.NewRequest(s, &protocol.Message{ID: 1}))
+	a.Equal(ErrInvalidTarget, err)
+}
+
+func TestNew_WithoutKVStore(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().KVStore().Return(nil, errors.New("No KVS was set-up in Router"))
+
+	c, err := New(mRouter, NewSender(testConfig(0)), testConfig(0))
+	a.Error(err)
+	a.Nil(c)
+}
+
+func TestWebhook_HandleResponse(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	kvs := kvstore.NewMemoryKVStore()
+	mRouter.EXPECT().KVStore().Return(kvs, nil)
+	w, err := New(mRouter, NewSender(testConfig(0)), testConfig(0))
+	a.NoError(err)
+
+	s := connector.NewSubscriber("/topic", router.RouteParams{targetKey: EncodeTarget("http://localhost/hook")}, 0)
+	a.NoError(w.Manager().Add(s))
+	request := connector.NewRequest(s, &protocol.Message{ID: 42})
+
+	// a delivered message advances the subscription
+	a.NoError(w.HandleResponse(request, &Response{StatusCode: http.StatusOK}, nil, nil))
+	data, exists, err := kvs.Get(schema, s.Key())
+	a.NoError(err)
+	a.True(exists)
+	var sd connector.SubscriberData
+	a.NoError(json.Unmarshal(data, &sd))
+	a.Equal(uint64(42), sd.LastID)
+
+	// a server error keeps it
+	a.Error(w.HandleResponse(request, &Response{StatusCode: http.StatusBadGateway}, nil, nil))
+	a.NotNil(w.Manager().Find(s.Key()))
+
+	// a client error removes it
+	a.Error(w.HandleResponse(request, &Response{StatusCode: http.StatusNotFound}, nil, nil))
+	a.Nil(w.Manager().Find(s.Key()))
+	_, exists, err = kvs.Get(schema, s.Key())
+	a.NoError(err)
+	a.False(exists)
+}
+
+func TestWebhook_RemovesSubscriptionWithInvalidTarget(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().KVStore().Return(kvstore.NewMemoryKVStore(), nil)
+	w, err := New(mRouter, NewSender(testConfig(0)), testConfig(0))
+	a.NoError(err)
+
+	s := connector.NewSubscriber("/topic", router.RouteParams{targetKey: "invalid"}, 0)
+	a.NoError(w.Manager().Add(s))
+
+	err = w.HandleResponse(connector.NewRequest(s, &protocol.Message{ID: 1}), nil, nil, ErrInvalidTarget)
+	a.Equal(ErrInvalidTarget, err)
+	a.Nil(w.Manager().Find(s.Key()))
+}
+
+func TestWebhook_SubscribeAndDeliver(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	received := make(chan payload, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p payload
+		a.NoError(json.NewDecoder(r.Body).Decode(&p))
+		received <- p
+	}))
+	defer server.Close()
+
+	mRouter := NewMockRouter(testutil.MockCtrl)
+	mRouter.EXPECT().KVStore().Return(kvstore.NewMemoryKVStore(), nil)
+	w, err := New(mRouter, NewSender(testConfig(0)), testConfig(0))
+	a.NoError(err)
+	a.NoError(w.Start())
+
+	routeC := make(chan *router.Route, 1)
+	mRouter.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		routeC <- r
+	}).Return(nil, nil)
+
+	// when subscribing with the encoded target url
+	u := fmt.Sprintf("http://localhost/webhook/%s/topic", EncodeTarget(server.URL))
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	a.NoError(err)
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, req)
+	a.Equal(`{"subscribed":"/topic"}`, rec.Body.String())
+
+	// then a message delivered to the route is POSTed to the target
+	var route *router.Route
+	select {
+	case route = <-routeC:
+	case <-time.After(time.Second):
+		a.FailNow("route not subscribed")
+	}
+	a.Equal(server.URL, mustDecode(a, route.Get(targetKey)))
+	a.NoError(route.Deliver(&protocol.Message{ID: 7, Path: "/topic", Body: []byte("Hello")}, false))
+
+	select {
+	case p := <-received:
+		a.Equal(uint64(7), p.ID)
+		a.Equal("Hello", p.Body)
+	case <-time.After(time.Second):
+		a.Fail("message not POSTed")
+	}
+
+	mRouter.EXPECT().Unsubscribe(gomock.Any()).AnyTimes()
+	a.NoError(w.Stop())
+}
+
+func mustDecode(a *assert.Assertions, encoded string) string {
+	target, err := decodeTarget(encoded)
+	a.NoError(err)
+	return target
+}
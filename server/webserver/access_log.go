@@ -0,0 +1,134 @@
+package webserver
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AccessLog is the configuration of the access log of the WebServer, logging each request with its status,
+// the size of the response and the latency.
+type AccessLog struct {
+	// Exclude are the path prefixes of the requests, which are not logged, e.g. the health and metrics endpoints
+	Exclude []string
+
+	// Logger logs the requests at the info level
+	Logger *log.Logger
+}
+
+// NewAccessLog returns the AccessLog excluding the comma separated path prefixes.
+// It logs with the output and the format of the standard logger, independent of its level,
+// so it has to be created after the logging is configured.
+func NewAccessLog(exclude string) *AccessLog {
+	std := log.StandardLogger()
+	return &AccessLog{
+		Exclude: splitList(exclude),
+		Logger: &log.Logger{
+			Out:       std.Out,
+			Formatter: std.Formatter,
+			Hooks:     std.Hooks,
+			Level:     log.InfoLevel,
+		},
+	}
+}
+
+// excludes returns true if the path is one of the excluded prefixes, or below one of them
+func (l *AccessLog) excludes(path string) bool {
+	for _, prefix := range l.Exclude {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the handler logging the requests, after they were handled.
+// The latency is the duration of the whole request, e.g. of a streamed response or an upgraded websocket connection,
+// while the time to the first byte is the duration until the status of the response was written.
+func (l *AccessLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.excludes(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		aw := &accessLogWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(aw, r)
+		if aw.status == 0 {
+			aw.started(http.StatusOK)
+		}
+
+		remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteIP = r.RemoteAddr
+		}
+		l.Logger.WithFields(log.Fields{
+			"module":     "access",
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     aw.status,
+			"size":       aw.size,
+			"remote_ip":  remoteIP,
+			"latency_ms": milliseconds(time.Since(aw.start)),
+			"ttfb_ms":    milliseconds(aw.firstByte),
+		}).Info("Request")
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// accessLogWriter records the status, the size and the time to the first byte of a response.
+// It keeps the response flushable and hijackable, for the streamed responses and the websocket upgrade.
+type accessLogWriter struct {
+	http.ResponseWriter
+	start     time.Time
+	status    int
+	size      int
+	firstByte time.Duration
+}
+
+func (w *accessLogWriter) started(status int) {
+	w.status = status
+	w.firstByte = time.Since(w.start)
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.started(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.started(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack takes over the connection, which is logged with the status of the websocket upgrade
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("The response does not support hijacking the connection")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.started(http.StatusSwitchingProtocols)
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,162 @@
+package webserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a buffer, which can be read while the requests are logged
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
+
+// testAccessLog returns an AccessLog logging as json into the buffer
+func testAccessLog(exclude string) (*AccessLog, *syncBuffer) {
+	buf := &syncBuffer{}
+	l := NewAccessLog(exclude)
+	l.Logger.Out = buf
+	l.Logger.Formatter = &log.JSONFormatter{}
+	return l, buf
+}
+
+// accessLogEntries parses the json entries of the buffer
+func accessLogEntries(a *assert.Assertions, buf *syncBuffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := make(map[string]interface{})
+		a.NoError(json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog_LogsTheRequests(t *testing.T) {
+	a := assert.New(t)
+	l, buf := testAccessLog("/admin/healthcheck, /metrics")
+	handler := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("handled"))
+	}))
+
+	for _, path := range []string{"/api/message/foo", "/api/missing", "/admin/healthcheck", "/metrics/node"} {
+		req := httptest.NewRequest(http.MethodPost, "http://guble.example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.1:54321"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// the excluded paths are not logged
+	entries := accessLogEntries(a, buf)
+	if a.Len(entries, 2) {
+		a.Equal("info", entries[0]["level"])
+		a.Equal("access", entries[0]["module"])
+		a.Equal("POST", entries[0]["method"])
+		a.Equal("/api/message/foo", entries[0]["path"])
+		a.Equal(200.0, entries[0]["status"])
+		a.Equal(7.0, entries[0]["size"])
+		a.Equal("10.0.0.1", entries[0]["remote_ip"])
+		a.Contains(entries[0], "latency_ms")
+		a.Contains(entries[0], "ttfb_ms")
+
+		a.Equal("/api/missing", entries[1]["path"])
+		a.Equal(404.0, entries[1]["status"])
+	}
+}
+
+func TestAccessLog_LogsTheTimeToTheFirstByteOfAStream(t *testing.T) {
+	a := assert.New(t)
+	l, buf := testAccessLog("")
+	handler := l.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("second"))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://guble.example.com/api/tap/foo", nil))
+	a.True(w.Flushed)
+	a.Equal("firstsecond", w.Body.String())
+
+	entries := accessLogEntries(a, buf)
+	if a.Len(entries, 1) {
+		a.Equal(11.0, entries[0]["size"])
+		a.True(entries[0]["ttfb_ms"].(float64) < 50)
+		a.True(entries[0]["latency_ms"].(float64) >= 50)
+	}
+}
+
+func TestAccessLog_KeepsTheWebsocketUpgrade(t *testing.T) {
+	a := assert.New(t)
+	l, buf := testAccessLog("")
+
+	ws := New("localhost:0")
+	ws.AccessLog = l
+	closedC := make(chan bool)
+	ws.Handle("/stream/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(closedC)
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if !a.NoError(err) {
+			return
+		}
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		a.NoError(err)
+		a.NoError(conn.WriteMessage(websocket.TextMessage, data))
+	}))
+	a.NoError(ws.Start())
+	defer ws.Stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+ws.GetAddr()+"/stream/user/user01", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	a.NoError(conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, data, err := conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("hello", string(data))
+
+	// the connection is logged after it was closed
+	select {
+	case <-closedC:
+	case <-time.After(time.Second):
+		a.Fail("the websocket handler did not return")
+	}
+	for i := 0; i < 100 && buf.String() == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries := accessLogEntries(a, buf)
+	if a.Len(entries, 1) {
+		a.Equal("/stream/user/user01", entries[0]["path"])
+		a.Equal(101.0, entries[0]["status"])
+	}
+}
@@ -0,0 +1,130 @@
+package webserver
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultCORSMethods are the methods allowed for the cross-origin requests by default
+var DefaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodHead}
+
+// CORS is the configuration of the Cross-Origin Resource Sharing, for the browsers calling the WebServer from web apps.
+// The requests from a disallowed origin are rejected with 403; the requests without origin
+// (i.e. not from a browser) and from the same origin as the WebServer are always allowed.
+type CORS struct {
+	// AllowOrigins are the allowed origins, e.g. `https://app.example.com`, or `*` for all origins
+	AllowOrigins []string
+
+	// AllowMethods are the methods allowed for the cross-origin requests
+	AllowMethods []string
+
+	// AllowCredentials allows the browsers to send the cookies and the authorization header with the cross-origin requests
+	AllowCredentials bool
+}
+
+// NewCORS returns the CORS of the comma separated origins and methods; no methods allow the DefaultCORSMethods.
+func NewCORS(origins, methods string, allowCredentials bool) *CORS {
+	c := &CORS{
+		AllowOrigins:     splitList(origins),
+		AllowMethods:     splitList(strings.ToUpper(methods)),
+		AllowCredentials: allowCredentials,
+	}
+	if len(c.AllowMethods) == 0 {
+		c.AllowMethods = DefaultCORSMethods
+	}
+	return c
+}
+
+// AllowsOrigin returns true if the origin of the request is allowed, or the request has no origin.
+// It is also used as the origin check of the websocket upgrade.
+func (c *CORS) AllowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || isSameOrigin(origin, r) {
+		return true
+	}
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns the handler setting the `Access-Control-*` headers, and replying to the preflight requests
+func (c *CORS) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		if !c.AllowsOrigin(r) {
+			logger.WithField("origin", origin).Info("Rejected the request from a disallowed origin")
+			http.Error(w, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		// a wildcard can not be combined with credentials, so the origin is echoed instead
+		if c.allowsAllOrigins() && !c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || requestMethod == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !c.allowsMethod(requestMethod) {
+			logger.WithField("method", requestMethod).Info("Rejected the preflight request of a disallowed method")
+			http.Error(w, "Method not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowMethods, ", "))
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (c *CORS) allowsAllOrigins() bool {
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowsMethod(method string) bool {
+	for _, allowed := range c.AllowMethods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameOrigin returns true if the host of the origin is the host of the request
+func isSameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// splitList returns the trimmed, non-empty values of a comma separated list
+func splitList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,83 @@
+package webserver
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func corsRequest(c *CORS, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	handler := c.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("handled"))
+	}))
+	req := httptest.NewRequest(method, "http://guble.example.com/api/message/foo", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS_AllowsTheConfiguredOrigins(t *testing.T) {
+	a := assert.New(t)
+	c := NewCORS("https://app.example.com, https://admin.example.com", "", false)
+
+	// an allowed origin gets the CORS headers
+	w := corsRequest(c, http.MethodPost, "https://app.example.com", nil)
+	a.Equal(http.StatusOK, w.Code)
+	a.Equal("handled", w.Body.String())
+	a.Equal("https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	a.Equal("", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// a disallowed origin is rejected
+	w = corsRequest(c, http.MethodPost, "https://evil.example.com", nil)
+	a.Equal(http.StatusForbidden, w.Code)
+	a.Equal("", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// and the requests without origin, or from the same origin, are handled without CORS headers
+	w = corsRequest(c, http.MethodPost, "", nil)
+	a.Equal("handled", w.Body.String())
+	a.Equal("", w.Header().Get("Access-Control-Allow-Origin"))
+	a.True(c.AllowsOrigin(httptest.NewRequest(http.MethodGet, "http://guble.example.com/stream/", nil)))
+	same := httptest.NewRequest(http.MethodGet, "http://guble.example.com/stream/", nil)
+	same.Header.Set("Origin", "https://guble.example.com")
+	a.True(c.AllowsOrigin(same))
+}
+
+func TestCORS_Wildcard(t *testing.T) {
+	a := assert.New(t)
+
+	w := corsRequest(NewCORS("*", "", false), http.MethodGet, "https://any.example.com", nil)
+	a.Equal("*", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// with credentials, the origin is echoed
+	w = corsRequest(NewCORS("*", "", true), http.MethodGet, "https://any.example.com", nil)
+	a.Equal("https://any.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	a.Equal("true", w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	a := assert.New(t)
+	c := NewCORS("https://app.example.com", "get,post", false)
+
+	// an allowed method is answered without calling the handler
+	w := corsRequest(c, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "X-Guble-Priority",
+	})
+	a.Equal(http.StatusNoContent, w.Code)
+	a.Equal("", w.Body.String())
+	a.Equal("GET, POST", w.Header().Get("Access-Control-Allow-Methods"))
+	a.Equal("X-Guble-Priority", w.Header().Get("Access-Control-Allow-Headers"))
+
+	// and another method is rejected
+	w = corsRequest(c, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method": "DELETE",
+	})
+	a.Equal(http.StatusForbidden, w.Code)
+}
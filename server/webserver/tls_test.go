@@ -0,0 +1,208 @@
+package webserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeTLSAndReloadTheCertificate(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "guble_tls_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	writeCertificate(a, certFile, keyFile, 1)
+
+	// given a webserver serving TLS
+	server := New("localhost:0")
+	server.TLSCertFile, server.TLSKeyFile = certFile, keyFile
+	server.TLSMinVersion = tls.VersionTLS12
+	server.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	a.NoError(server.Start())
+	defer server.Stop()
+	url := "https://" + server.GetAddr()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get(url)
+	if !a.NoError(err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	a.Equal("hello", string(body))
+	a.Equal(int64(1), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// when the certificate is replaced and reloaded
+	writeCertificate(a, certFile, keyFile, 2)
+	a.NoError(server.ReloadCertificate())
+
+	// then the existing connection is kept
+	resp, err = client.Get(url)
+	a.NoError(err)
+	resp.Body.Close()
+	a.Equal(int64(1), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// and new connections use the new certificate
+	newClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err = newClient.Get(url)
+	a.NoError(err)
+	resp.Body.Close()
+	a.Equal(int64(2), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	// and an invalid certificate is not loaded
+	a.NoError(ioutil.WriteFile(certFile, []byte("invalid"), 0600))
+	a.Error(server.ReloadCertificate())
+
+	// and a client with an older TLS version than the minimum is rejected
+	oldClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS11,
+	}}}
+	_, err = oldClient.Get(url)
+	a.Error(err)
+}
+
+func TestRequireTheClientCertificate(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "guble_tls_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := dir+"/cert.pem", dir+"/key.pem", dir+"/ca.pem"
+	writeCertificate(a, certFile, keyFile, 1)
+
+	// given a CA of the clients
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(10),
+		Subject:               pkix.Name{CommonName: "guble test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	a.NoError(err)
+	a.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0600))
+	ca, err := x509.ParseCertificate(caDer)
+	a.NoError(err)
+
+	// and a webserver requiring the client certificates of the CA
+	server := New("localhost:0")
+	server.TLSCertFile, server.TLSKeyFile, server.TLSClientCAFile = certFile, keyFile, caFile
+	server.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.VerifiedChains[0][0].Subject.CommonName))
+	})
+	a.NoError(server.Start())
+	defer server.Stop()
+	url := "https://" + server.GetAddr()
+
+	// when a client presents a certificate issued by the CA
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	clientDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(11),
+		Subject:      pkix.Name{CommonName: "publisher"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	a.NoError(err)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{clientDer}, PrivateKey: clientKey}},
+	}}}
+
+	// then its request is served with the verified certificate
+	resp, err := client.Get(url)
+	if a.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		a.Equal("publisher", string(body))
+	}
+
+	// and a client without a certificate, or with one of another issuer, is rejected by the handshake
+	withoutCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	_, err = withoutCert.Get(url)
+	a.Error(err)
+
+	selfSigned, err := tls.LoadX509KeyPair(certFile, keyFile)
+	a.NoError(err)
+	otherIssuer := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{selfSigned},
+	}}}
+	_, err = otherIssuer.Get(url)
+	a.Error(err)
+
+	// and a CA file without certificates is an error
+	a.NoError(ioutil.WriteFile(caFile, []byte("invalid"), 0600))
+	invalidCA := New("localhost:0")
+	invalidCA.TLSCertFile, invalidCA.TLSKeyFile, invalidCA.TLSClientCAFile = certFile, keyFile, caFile
+	a.Error(invalidCA.Start())
+}
+
+func TestStartWithAnInvalidCertificate(t *testing.T) {
+	server := New("localhost:0")
+	server.TLSCertFile, server.TLSKeyFile = "/non-existing-cert.pem", "/non-existing-key.pem"
+	assert.Error(t, server.Start())
+	assert.Error(t, New("localhost:0").ReloadCertificate())
+}
+
+func TestParseTLSVersionAndCipherSuites(t *testing.T) {
+	a := assert.New(t)
+
+	v, err := ParseTLSVersion("1.2")
+	a.NoError(err)
+	a.Equal(uint16(tls.VersionTLS12), v)
+	_, err = ParseTLSVersion("2.0")
+	a.Error(err)
+
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"})
+	a.NoError(err)
+	a.Equal([]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, suites)
+
+	suites, err = ParseCipherSuites(nil)
+	a.NoError(err)
+	a.Nil(suites)
+
+	_, err = ParseCipherSuites([]string{"TLS_UNKNOWN"})
+	a.Error(err)
+}
+
+func writeCertificate(a *assert.Assertions, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	a.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	a.NoError(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	a.NoError(err)
+
+	a.NoError(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	a.NoError(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
@@ -1,10 +1,34 @@
 package webserver
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// DefaultReadTimeout is the default maximum duration for reading a request, including its body
+	DefaultReadTimeout = 30 * time.Second
+
+	// DefaultWriteTimeout is the default maximum duration for writing a response
+	DefaultWriteTimeout = 30 * time.Second
+
+	// DefaultIdleTimeout is the default maximum duration a keep-alive connection waits for the next request
+	DefaultIdleTimeout = 120 * time.Second
+
+	// keepAliveDrainLimit is the maximum number of unread request body bytes, which are discarded after a request,
+	// so that the client can reuse the connection
+	keepAliveDrainLimit = 1 << 20
 )
 
 // WebServer is a struct representing a HTTP Server (using a net.Listener and a ServeMux multiplexer).
@@ -13,29 +37,110 @@ type WebServer struct {
 	ln     net.Listener
 	mux    *http.ServeMux
 	addr   string
+
+	// ReadTimeout, WriteTimeout and IdleTimeout configure the http.Server. Zero means no timeout.
+	// The read and write deadlines are not applied to the upgraded websocket connections.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// HTTP2 enables HTTP/2 over cleartext (h2c), for the clients requesting it.
+	// Other clients, and the websocket upgrade, continue to use HTTP/1.1.
+	HTTP2 bool
+
+	// TLSCertFile and TLSKeyFile enable serving HTTPS and WSS with the certificate and the PEM encoded key.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSMinVersion and TLSCipherSuites configure the TLS connections. Zero values use the defaults of crypto/tls.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// TLSClientCAFile requires a client certificate on each TLS handshake, verified by the PEM encoded CA certificates
+	// of the file. Connections without a valid client certificate are rejected by the handshake.
+	TLSClientCAFile string
+
+	// CORS enables the Cross-Origin Resource Sharing for the allowed origins. Nil disables it.
+	CORS *CORS
+
+	// AccessLog enables logging the requests, including the ones rejected by the CORS. Nil disables it.
+	AccessLog *AccessLog
+
+	// Listener is used by Start instead of listening on the address, e.g. the listener inherited from the parent
+	// process on a graceful restart. It has to be a TCP listener.
+	Listener net.Listener
+
+	cert *certificate
+
+	// drained is true after the server was shut down by Drain
+	drained bool
 }
 
 // New returns a new WebServer.
 func New(addr string) *WebServer {
 	return &WebServer{
-		mux:  http.NewServeMux(),
-		addr: addr,
+		mux:          http.NewServeMux(),
+		addr:         addr,
+		ReadTimeout:  DefaultReadTimeout,
+		WriteTimeout: DefaultWriteTimeout,
+		IdleTimeout:  DefaultIdleTimeout,
 	}
 }
 
 // Start the WebServer (implementing service.startable interface).
 func (ws *WebServer) Start() (err error) {
 	logger.WithField("address", ws.addr).Info("Http server is starting up on address")
+	ws.drained = false
 
-	ws.server = &http.Server{Addr: ws.addr, Handler: ws.mux}
-	ws.ln, err = net.Listen("tcp", ws.addr)
-	if err != nil {
+	var handler http.Handler = keepAliveHandler{ws.mux}
+	if ws.CORS != nil {
+		handler = ws.CORS.handler(handler)
+	}
+	if ws.AccessLog != nil {
+		handler = ws.AccessLog.handler(handler)
+	}
+	if ws.HTTP2 {
+		handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: ws.IdleTimeout})
+	}
+	ws.server = &http.Server{
+		Addr:         ws.addr,
+		Handler:      handler,
+		ReadTimeout:  ws.ReadTimeout,
+		WriteTimeout: ws.WriteTimeout,
+		IdleTimeout:  ws.IdleTimeout,
+	}
+	if ws.TLSEnabled() {
+		if ws.cert, err = newCertificate(ws.TLSCertFile, ws.TLSKeyFile); err != nil {
+			return
+		}
+		ws.server.TLSConfig = &tls.Config{
+			MinVersion:     ws.TLSMinVersion,
+			CipherSuites:   ws.TLSCipherSuites,
+			GetCertificate: ws.cert.get,
+		}
+		if ws.TLSClientCAFile != "" {
+			if ws.server.TLSConfig.ClientCAs, err = loadCertPool(ws.TLSClientCAFile); err != nil {
+				return
+			}
+			ws.server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if ws.Listener != nil {
+		ws.ln = ws.Listener
+	} else if ws.ln, err = net.Listen("tcp", ws.addr); err != nil {
 		return
 	}
 
+	// the server and the listener are not read from the WebServer, which can be started again after it was stopped
+	server, ln, tlsEnabled := ws.server, tcpKeepAliveListener{TCPListener: ws.ln.(*net.TCPListener)}, ws.TLSEnabled()
 	go func() {
-		err = ws.server.Serve(tcpKeepAliveListener{TCPListener: ws.ln.(*net.TCPListener)})
-		if err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
+		var err error
+		if tlsEnabled {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 			logger.WithError(err).Error("ListenAndServe")
 		}
 		logger.WithField("address", ws.addr).Info("Http server stopped")
@@ -43,9 +148,46 @@ func (ws *WebServer) Start() (err error) {
 	return
 }
 
+// ListenerFile returns a duplicate of the listening socket of the started WebServer, e.g. to be passed to a new process
+// on a graceful restart. Closing the file does not close the listener, and the other way around.
+func (ws *WebServer) ListenerFile() (*os.File, error) {
+	ln, ok := ws.ln.(*net.TCPListener)
+	if !ok {
+		return nil, errors.New("The WebServer is not listening on a TCP socket")
+	}
+	return ln.File()
+}
+
+// TLSEnabled returns true if the WebServer is configured to serve HTTPS.
+func (ws *WebServer) TLSEnabled() bool {
+	return ws.TLSCertFile != "" && ws.TLSKeyFile != ""
+}
+
+// ReloadCertificate reads the TLS certificate and key files again, e.g. after a certificate rotation.
+// The new certificate is used for the new connections, while the existing ones are kept.
+// If the files are invalid, an error is returned and the current certificate is still used.
+func (ws *WebServer) ReloadCertificate() error {
+	if ws.cert == nil {
+		return errors.New("The WebServer is not serving TLS")
+	}
+	return ws.cert.load()
+}
+
+// Drain stops accepting new connections and waits at most for the timeout, until the active requests are handled
+// (implementing service.drainer interface). The upgraded websocket connections are not waited for.
+func (ws *WebServer) Drain(timeout time.Duration) error {
+	if ws.server == nil || ws.drained {
+		return nil
+	}
+	ws.drained = true
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ws.server.Shutdown(ctx)
+}
+
 // Stop the WebServer (implementing service.stopable interface).
 func (ws *WebServer) Stop() (err error) {
-	if ws.ln != nil {
+	if ws.ln != nil && !ws.drained {
 		err = ws.ln.Close()
 	}
 
@@ -69,6 +211,19 @@ func (ws *WebServer) GetAddr() string {
 	return ws.ln.Addr().String()
 }
 
+// keepAliveHandler discards the request body not read by the handler (up to keepAliveDrainLimit),
+// so that the connection can be reused for the next request, for example by the batch publishers.
+type keepAliveHandler struct {
+	http.Handler
+}
+
+func (h keepAliveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Handler.ServeHTTP(w, r)
+	if r.Body != nil {
+		io.CopyN(ioutil.Discard, r.Body, keepAliveDrainLimit)
+	}
+}
+
 // copied from golang: net/http/server.go
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
@@ -2,9 +2,15 @@ package webserver
 
 import (
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,3 +48,150 @@ func TestStartAndStopWebServer(t *testing.T) {
 	_, err = c2.Post("http://"+addr, "text/plain", bytes.NewBufferString("hello"))
 	assert.Error(t, err)
 }
+
+func TestDrainWaitsForTheActiveRequests(t *testing.T) {
+	a := assert.New(t)
+
+	// given: a started webserver handling a slow request
+	server := New("localhost:0")
+	startedC := make(chan struct{})
+	var completed int32
+	server.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(startedC)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+		atomic.StoreInt32(&completed, 1)
+	})
+	a.NoError(server.Start())
+	addr := server.GetAddr()
+
+	responseC := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		a.NoError(err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		responseC <- string(body)
+	}()
+	<-startedC
+
+	// when: the server is drained
+	a.NoError(server.Drain(time.Second))
+
+	// then: the active request was completed, and new connections are refused
+	a.Equal(int32(1), atomic.LoadInt32(&completed))
+	a.Equal("done", <-responseC)
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	_, err := c.Get("http://" + addr)
+	a.Error(err)
+	a.NoError(server.Stop())
+}
+
+func TestHTTP2WithPriorKnowledge(t *testing.T) {
+	a := assert.New(t)
+
+	// given a started webserver with HTTP/2 enabled
+	server := New("localhost:0")
+	server.HTTP2 = true
+	server.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", r.ProtoMajor)
+	}))
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// when a client requests with HTTP/2 over cleartext
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + server.GetAddr())
+
+	// then HTTP/2 is used
+	if a.NoError(err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		a.Equal("2", string(body))
+	}
+
+	// and HTTP/1.1 clients are still served
+	resp, err = http.Get("http://" + server.GetAddr())
+	if a.NoError(err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		a.Equal("1", string(body))
+	}
+}
+
+func TestConnectionIsReusedWhenTheBodyIsNotRead(t *testing.T) {
+	a := assert.New(t)
+
+	// given a started webserver, with a handler not reading the request body
+	server := New("localhost:0")
+	server.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rejected", http.StatusRequestEntityTooLarge)
+	}))
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// when posting two large messages
+	var remoteAddrs []string
+	client := &http.Client{}
+	for i := 0; i < 2; i++ {
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				remoteAddrs = append(remoteAddrs, info.Conn.LocalAddr().String())
+			},
+		}
+		req, _ := http.NewRequest(http.MethodPost, "http://"+server.GetAddr(), bytes.NewReader(make([]byte, 512*1024)))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := client.Do(req)
+		if a.NoError(err) {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			a.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+	}
+
+	// then both requests used the same connection
+	if a.Equal(2, len(remoteAddrs)) {
+		a.Equal(remoteAddrs[0], remoteAddrs[1])
+	}
+}
+
+func TestListenerIsHandedOverToAnotherWebServer(t *testing.T) {
+	a := assert.New(t)
+
+	// given: a started webserver
+	first := New("localhost:0")
+	first.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "first")
+	})
+	a.NoError(first.Start())
+	addr := first.GetAddr()
+
+	// when: a second webserver starts on a duplicate of its listening socket, and the first one is drained
+	file, err := first.ListenerFile()
+	a.NoError(err)
+	ln, err := net.FileListener(file)
+	a.NoError(err)
+	file.Close()
+	second := New("")
+	second.Listener = ln
+	second.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "second")
+	})
+	a.NoError(first.Drain(time.Second))
+	a.NoError(second.Start())
+	defer second.Stop()
+
+	// then: the new connections to the same address are served by the second webserver
+	a.Equal(addr, second.GetAddr())
+	c := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := c.Get("http://" + addr)
+	if a.NoError(err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		a.Equal("second", string(body))
+	}
+}
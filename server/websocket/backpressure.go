@@ -0,0 +1,84 @@
+package websocket
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/smancke/guble/server/router"
+)
+
+// backpressurePollInterval is the interval, in which a paused connection checks whether the ingest queue drained
+const backpressurePollInterval = 20 * time.Millisecond
+
+// backpressure tracks the ingest queue of all connections of the handler: the publishes waiting for the router
+// (e.g. for a slow message store) and the messages queued by the router for the delivery.
+// While the queue is above the high-water mark, the connections are not read, until it drained below the low-water mark.
+type backpressure struct {
+	high, low int
+
+	// queue is the ingest queue of the router, nil if the router does not report it
+	queue router.IngestQueue
+
+	// publishing is the number of the publishes being handled by the router
+	publishing int64
+
+	pollInterval time.Duration
+}
+
+// SetBackpressure pauses reading from the connections, while the ingest queue exceeds the highWaterMark,
+// until it drained below the lowWaterMark. A paused client is notified with `#slow-down` and `#resume`.
+// A highWaterMark of zero disables it, and a lowWaterMark of zero is the half of the highWaterMark.
+// It has to be called before serving the first connection.
+func (handler *WSHandler) SetBackpressure(highWaterMark, lowWaterMark int) error {
+	if highWaterMark <= 0 {
+		handler.backpressure = nil
+		return nil
+	}
+	if lowWaterMark <= 0 {
+		lowWaterMark = highWaterMark / 2
+	}
+	if lowWaterMark >= highWaterMark {
+		return fmt.Errorf("the low-water mark %d has to be lower than the high-water mark %d", lowWaterMark, highWaterMark)
+	}
+	b := &backpressure{high: highWaterMark, low: lowWaterMark, pollInterval: backpressurePollInterval}
+	b.queue, _ = handler.router.(router.IngestQueue)
+	handler.backpressure = b
+	return nil
+}
+
+// pending returns the length of the ingest queue
+func (b *backpressure) pending() int {
+	n := int(atomic.LoadInt64(&b.publishing))
+	if b.queue != nil {
+		n += b.queue.QueuedMessages()
+	}
+	return n
+}
+
+// publish calls the handle function, counting it as a pending publish meanwhile
+func (b *backpressure) publish(handle func() error) error {
+	if b == nil {
+		return handle()
+	}
+	atomic.AddInt64(&b.publishing, 1)
+	defer atomic.AddInt64(&b.publishing, -1)
+	return handle()
+}
+
+// wait returns false at once, if the ingest queue is below the high-water mark. Otherwise, it calls paused
+// and waits until the queue drained below the low-water mark or done returns true, and returns true.
+func (b *backpressure) wait(paused func(pending int), done func() bool) bool {
+	if b == nil {
+		return false
+	}
+	pending := b.pending()
+	if pending < b.high {
+		return false
+	}
+	paused(pending)
+	for b.pending() > b.low && !done() {
+		time.Sleep(b.pollInterval)
+	}
+	return true
+}
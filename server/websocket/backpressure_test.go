@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIngestQueue is an ingest queue of the given length
+type fakeIngestQueue struct {
+	length int64
+}
+
+func (q *fakeIngestQueue) QueuedMessages() int {
+	return int(atomic.LoadInt64(&q.length))
+}
+
+func (q *fakeIngestQueue) set(length int) {
+	atomic.StoreInt64(&q.length, int64(length))
+}
+
+func TestBackpressure_WaitsFromTheHighToTheLowWaterMark(t *testing.T) {
+	a := assert.New(t)
+
+	queue := &fakeIngestQueue{}
+	b := &backpressure{high: 10, low: 5, queue: queue, pollInterval: time.Millisecond}
+	paused := 0
+	pause := func(int) { paused++ }
+	never := func() bool { return false }
+
+	// below the high-water mark, the connection is not paused
+	queue.set(9)
+	a.False(b.wait(pause, never))
+
+	// and the pending publishes are counted
+	b.publish(func() error {
+		a.Equal(10, b.pending())
+		return nil
+	})
+	a.Equal(9, b.pending())
+
+	// above it, the connection waits until the queue drained below the low-water mark
+	queue.set(10)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		queue.set(6)
+		time.Sleep(10 * time.Millisecond)
+		queue.set(5)
+	}()
+	start := time.Now()
+	a.True(b.wait(pause, never))
+	a.True(time.Since(start) >= 20*time.Millisecond)
+	a.Equal(1, paused)
+
+	// or until it is closed
+	queue.set(20)
+	a.True(b.wait(pause, func() bool { return true }))
+
+	// and a disabled backpressure does not wait
+	var disabled *backpressure
+	a.False(disabled.wait(pause, never))
+}
+
+func TestWSHandler_SetBackpressure(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	handler := testWSHandler(NewMockRouter(testutil.MockCtrl), auth.NewAllowAllAccessManager(true))
+	a.NoError(handler.SetBackpressure(100, 0))
+	a.Equal(50, handler.backpressure.low)
+
+	a.Error(handler.SetBackpressure(100, 100))
+
+	a.NoError(handler.SetBackpressure(0, 0))
+	a.Nil(handler.backpressure)
+}
+
+func Test_PublisherIsPausedWhileTheIngestQueueIsFull(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	wsconn, routerMock, _ := createDefaultMocks([]string{"> /path\n\nfirst"})
+	handler := testWSHandler(routerMock, auth.NewAllowAllAccessManager(true))
+	queue := &fakeIngestQueue{}
+	queue.set(3)
+	handler.backpressure = &backpressure{high: 2, low: 1, queue: queue, pollInterval: time.Millisecond}
+
+	// then the client is asked to slow down, and the message is read after the queue drained
+	done := make(chan bool, 1)
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "first"})
+	gomock.InOrder(
+		wsconn.EXPECT().Send([]byte("#"+protocol.SUCCESS_SLOW_DOWN+" 3")).Do(func([]byte) error {
+			queue.set(1)
+			return nil
+		}),
+		wsconn.EXPECT().Send([]byte("#"+protocol.SUCCESS_RESUME)),
+		wsconn.EXPECT().Send([]byte("#send")).Do(func([]byte) error {
+			done <- true
+			return nil
+		}),
+	)
+
+	websocket := NewWebSocket(handler, wsconn, "testuser")
+	go websocket.Start()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
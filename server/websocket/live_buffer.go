@@ -0,0 +1,76 @@
+package websocket
+
+import (
+	"sort"
+
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/router"
+)
+
+// liveBuffer collects the messages delivered to a route, while the receiver replays the stored messages.
+// The route is read continuously, so the router does not close it for being slow.
+// When the buffer is full, the buffered messages are discarded and the buffer is incomplete,
+// as the discarded messages have to be fetched from the store.
+type liveBuffer struct {
+	route    *router.Route
+	size     int
+	messages []*protocol.Message
+
+	overflowed bool
+	closed     bool
+
+	stopC chan struct{}
+	doneC chan struct{}
+}
+
+func newLiveBuffer(route *router.Route, size int) *liveBuffer {
+	b := &liveBuffer{
+		route: route,
+		size:  size,
+		stopC: make(chan struct{}),
+		doneC: make(chan struct{}),
+	}
+	go b.collect()
+	return b
+}
+
+func (b *liveBuffer) collect() {
+	defer close(b.doneC)
+	for {
+		select {
+		case m, open := <-b.route.MessagesChannel():
+			if !open {
+				b.closed = true
+				return
+			}
+			if b.overflowed {
+				continue
+			}
+			if len(b.messages) >= b.size {
+				b.overflowed = true
+				b.messages = nil
+				continue
+			}
+			b.messages = append(b.messages, m)
+		case <-b.stopC:
+			return
+		}
+	}
+}
+
+// stop stops the buffering and returns the buffered messages sorted by id,
+// and true if all messages delivered to the route meanwhile are buffered.
+func (b *liveBuffer) stop() ([]*protocol.Message, bool) {
+	close(b.stopC)
+	<-b.doneC
+
+	sort.Sort(byID(b.messages))
+	return b.messages, !b.overflowed && !b.closed
+}
+
+// byID sorts the messages by ascending id
+type byID []*protocol.Message
+
+func (m byID) Len() int           { return len(m) }
+func (m byID) Less(i, j int) bool { return m[i].ID < m[j].ID }
+func (m byID) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
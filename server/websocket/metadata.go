@@ -0,0 +1,39 @@
+package websocket
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/smancke/guble/protocol"
+)
+
+// connectionMetadata returns the metadata of the connection, passed by the client in the handshake request
+// as headers with the protocol.MetadataHeaderPrefix or query parameters with the protocol.MetadataQueryPrefix.
+// The keys are lower case, and a query parameter replaces a header of the same key.
+// It returns protocol.ErrInvalidMetadata, if the metadata exceeds the limits.
+func connectionMetadata(r *http.Request) (map[string]string, error) {
+	var metadata map[string]string
+	set := func(key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[strings.ToLower(key)] = values[0]
+	}
+	for name, values := range r.Header {
+		if len(name) > len(protocol.MetadataHeaderPrefix) && strings.EqualFold(name[:len(protocol.MetadataHeaderPrefix)], protocol.MetadataHeaderPrefix) {
+			set(name[len(protocol.MetadataHeaderPrefix):], values)
+		}
+	}
+	for name, values := range r.URL.Query() {
+		if len(name) > len(protocol.MetadataQueryPrefix) && strings.HasPrefix(name, protocol.MetadataQueryPrefix) {
+			set(name[len(protocol.MetadataQueryPrefix):], values)
+		}
+	}
+	if err := protocol.ValidateMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/webserver"
+	"github.com/smancke/guble/testutil"
+
+	"github.com/golang/mock/gomock"
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_connectionMetadata(t *testing.T) {
+	a := assert.New(t)
+
+	// given a handshake with metadata in the headers and the query
+	r, _ := http.NewRequest(http.MethodGet, "http://localhost/stream/?meta_app_version=1.3&meta_Device=phone&other=1", nil)
+	r.Header.Set("X-Guble-Meta-App-Version", "1.2")
+	r.Header.Set("X-Guble-Meta-Os", "android")
+	r.Header.Set("X-Other", "value")
+
+	// then the metadata is collected with lower case keys, the query replacing the headers
+	metadata, err := connectionMetadata(r)
+	a.NoError(err)
+	a.Equal(map[string]string{"app_version": "1.3", "app-version": "1.2", "device": "phone", "os": "android"}, metadata)
+
+	// and a handshake without metadata has none
+	r, _ = http.NewRequest(http.MethodGet, "http://localhost/stream/", nil)
+	metadata, err = connectionMetadata(r)
+	a.NoError(err)
+	a.Nil(metadata)
+
+	// but metadata exceeding the limits is rejected
+	r, _ = http.NewRequest(http.MethodGet, "http://localhost/stream/?meta_app="+strings.Repeat("v", protocol.MaxMetadataValueLength+1), nil)
+	_, err = connectionMetadata(r)
+	a.Equal(protocol.ErrInvalidMetadata, err)
+}
+
+func Test_SubscriptionsHaveTheConnectionMetadata(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	wsconn, routerMock, _ := createDefaultMocks([]string{"+ /foo"})
+	routeC := make(chan *router.Route, 1)
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		routeC <- r
+	}).Return(nil, nil)
+	wsconn.EXPECT().Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /foo"))
+
+	// given a connection with metadata
+	ws := NewWebSocket(testWSHandler(routerMock, auth.NewAllowAllAccessManager(true)), wsconn, "testuser")
+	ws.metadata = map[string]string{"app_version": "1.2"}
+	go ws.Start()
+
+	// then the route of its subscription has the metadata
+	select {
+	case r := <-routeC:
+		a.Equal(map[string]string{"app_version": "1.2"}, r.Metadata)
+	case <-time.After(time.Second):
+		a.Fail("not subscribed")
+	}
+	time.Sleep(time.Millisecond * 2)
+}
+
+func Test_HandshakeWithInvalidMetadata(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// when connecting with an invalid metadata key, then the handshake is rejected
+	_, resp, _ := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/user01?meta_a%20b=1", nil)
+	if a.NotNil(resp) {
+		a.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// and with an invalid application id as well
+	_, resp, _ = gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/user01?applicationId=a%20b", nil)
+	if a.NotNil(resp) {
+		a.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiter for the publishes, keyed by user.
+// The bucket of a user is shared by all connections of the user on this node,
+// and removed when the last of them is closed.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens      float64
+	last        time.Time
+	connections int
+}
+
+// newRateLimiter returns a limiter allowing rate publishes per second, with bursts of up to burst publishes.
+// A burst smaller than one allows bursts of one second.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if burst < 1 {
+		b = rate
+		if b < 1 {
+			b = 1
+		}
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   b,
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// register adds a connection of the user
+func (l *rateLimiter) register(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.bucket(key).connections++
+}
+
+// unregister removes a connection of the user, and the bucket with the last connection
+func (l *rateLimiter) unregister(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return
+	}
+	b.connections--
+	if b.connections <= 0 {
+		delete(l.buckets, key)
+	}
+}
+
+// allow takes a token from the bucket of the user and returns false, if the bucket is empty
+func (l *rateLimiter) allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b := l.bucket(key)
+	now := l.now()
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// bucket returns the bucket of the user, creating a full one if not existing; the caller has to hold the mutex
+func (l *rateLimiter) bucket(key string) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: l.now()}
+		l.buckets[key] = b
+	}
+	return b
+}
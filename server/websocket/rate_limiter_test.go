@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_AllowsBurstAndRefills(t *testing.T) {
+	a := assert.New(t)
+
+	now := time.Now()
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+	l.register("user:foo")
+
+	// the burst is allowed at once
+	for i := 0; i < 3; i++ {
+		a.True(l.allow("user:foo"))
+	}
+	a.False(l.allow("user:foo"))
+
+	// and the bucket is refilled with the rate
+	now = now.Add(500 * time.Millisecond)
+	a.True(l.allow("user:foo"))
+	a.False(l.allow("user:foo"))
+
+	// but not above the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		a.True(l.allow("user:foo"))
+	}
+	a.False(l.allow("user:foo"))
+}
+
+func TestRateLimiter_IsSharedByTheConnectionsOfAUser(t *testing.T) {
+	a := assert.New(t)
+
+	l := newRateLimiter(1, 1)
+	l.now = func() time.Time { return time.Unix(1420110000, 0) }
+
+	// given two connections of the same user and one of another user
+	l.register("user:foo")
+	l.register("user:foo")
+	l.register("user:bar")
+
+	// then the bucket is shared by the connections of the user only
+	a.True(l.allow("user:foo"))
+	a.False(l.allow("user:foo"))
+	a.True(l.allow("user:bar"))
+
+	// and removed after the last connection of the user is closed
+	l.unregister("user:foo")
+	a.Contains(l.buckets, "user:foo")
+	l.unregister("user:foo")
+	a.NotContains(l.buckets, "user:foo")
+	a.Contains(l.buckets, "user:bar")
+}
+
+func TestNewRateLimiter_DefaultBurst(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(float64(5), newRateLimiter(5, 0).burst)
+	a.Equal(float64(1), newRateLimiter(0.5, 0).burst)
+	a.Equal(float64(10), newRateLimiter(5, 10).burst)
+}
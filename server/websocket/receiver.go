@@ -2,19 +2,45 @@ package websocket
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/server/store"
 
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 )
 
-var errUnreadMsgsAvailable = errors.New("unread messages available")
+var (
+	errAckWithoutUserID = errors.New("at-least-once delivery requires a user id")
+
+	// liveBufferSize is the maximum number of live messages buffered for a route during the replay
+	liveBufferSize = 1000
+)
+
+const (
+	// ackSchema is the kvstore schema for the last acknowledged message IDs of the at-least-once subscriptions
+	ackSchema = "ws_ack"
+
+	// maxUnackedMessages is the number of sent message IDs remembered for the acks.
+	// An ack is cumulative, so the oldest IDs are still acknowledged by an ack for a later message.
+	maxUnackedMessages = 1000
+
+	// filterArgPrefix is the prefix of the header filter arguments of a receive command, e.g. `filter:region=eu`
+	filterArgPrefix = "filter:"
+)
+
+// receiveOptions are the options of a receive command, passed as header json
+type receiveOptions struct {
+	Ack bool `json:"ack"`
+}
 
 // Receiver is a helper class, for managing a combined pull push on a topic.
 // It is used for implementation of the + (receive) command in the guble protocol.
@@ -28,12 +54,33 @@ type Receiver struct {
 	doFetch             bool
 	doSubscription      bool
 	startID             int64
+	endID               uint64
 	maxCount            int
 	lastSentID          uint64
 	shouldStop          bool
 	route               *router.Route
 	enableNotifications bool
 	userID              string
+	filters             router.HeaderFilters
+	metadata            map[string]string
+
+	// the start and filter arguments of the command, and the id of the last message passed to the websocket,
+	// for restoring the subscription of a session
+	startArg        string
+	filterArgs      []string
+	lastDeliveredID uint64
+
+	// detached is set for a receiver canceled together with all receivers of the connection, see detach
+	detached int32
+
+	// restored is true for a receiver restored by the session, until the client subscribes to its path again
+	restored bool
+
+	// the at-least-once delivery, with the sent but not yet acknowledged message IDs
+	ack        bool
+	kvStore    kvstore.KVStore
+	unackedIDs []uint64
+	ackMutex   sync.Mutex
 }
 
 // NewReceiverFromCmd parses the info in the command
@@ -62,18 +109,39 @@ func NewReceiverFromCmd(
 		return nil, fmt.Errorf("command requires at least a path argument, but non given")
 	}
 
-	args := strings.SplitN(cmd.Arg, " ", 3)
+	args, err := rec.parseFilters(strings.Split(cmd.Arg, " "))
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 3 {
+		args = append(args[:2], strings.Join(args[2:], " "))
+	}
 	rec.path = protocol.Path(args[0])
-
 	if len(args) > 1 {
+		rec.startArg = args[1]
+	}
+
+	rec.doSubscription = true
+	if len(args) > 1 && args[1] == protocol.PositionLatest {
+		if len(args) > 2 {
+			return nil, fmt.Errorf("%v can not be combined with a maxCount, but was %q", protocol.PositionLatest, args[2])
+		}
+	} else if len(args) > 1 {
 		rec.doFetch = true
-		rec.startID, err = strconv.ParseInt(args[1], 10, 64)
-		if err != nil {
-			return nil, fmt.Errorf("startid has to be empty or int, but was %q: %v", args[1], err)
+		if args[1] == protocol.PositionEarliest {
+			rec.startID = 0
+		} else if i := strings.Index(args[1], ".."); i >= 0 {
+			if err := rec.parseRange(args[1][:i], args[1][i+2:]); err != nil {
+				return nil, err
+			}
+		} else {
+			rec.startID, err = strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("startid has to be empty or int, but was %q: %v", args[1], err)
+			}
 		}
 	}
 
-	rec.doSubscription = true
 	if len(args) > 2 {
 		rec.doSubscription = false
 		rec.maxCount, err = strconv.Atoi(args[2])
@@ -82,9 +150,138 @@ func NewReceiverFromCmd(
 		}
 	}
 
+	if len(cmd.HeaderJSON) > 0 {
+		options := &receiveOptions{}
+		if err := json.Unmarshal([]byte(cmd.HeaderJSON), options); err != nil {
+			return nil, fmt.Errorf("header has to be empty or json, but was %q: %v", cmd.HeaderJSON, err)
+		}
+		if options.Ack {
+			if err := rec.enableAck(len(args) > 1); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	return rec, nil
 }
 
+// parseFilters removes the `filter:expression` arguments of a receive command and parses them as header filters
+func (rec *Receiver) parseFilters(args []string) ([]string, error) {
+	remaining := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, filterArgPrefix) {
+			remaining = append(remaining, arg)
+			continue
+		}
+		filter, err := router.ParseHeaderFilter(strings.TrimPrefix(arg, filterArgPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", arg, err)
+		}
+		rec.filters = append(rec.filters, filter)
+		rec.filterArgs = append(rec.filterArgs, arg)
+	}
+	return remaining, nil
+}
+
+// parseRange parses the range `startID..endID` of a receive command, replaying the messages
+// with ids from startID up to endID (both inclusive) without subscribing afterwards
+func (rec *Receiver) parseRange(start, end string) error {
+	startID, err := strconv.ParseUint(start, 10, 64)
+	if err != nil {
+		return fmt.Errorf("the start of a range has to be a positive int, but was %q: %v", start, err)
+	}
+	endID, err := strconv.ParseUint(end, 10, 64)
+	if err != nil || endID == 0 || endID < startID {
+		return fmt.Errorf("the end of a range has to be an int, not smaller than the start, but was %q", end)
+	}
+	rec.startID = int64(startID)
+	rec.endID = endID
+	rec.doSubscription = false
+	return nil
+}
+
+// enableAck turns on the at-least-once delivery.
+// Without an explicit start id, the receiver fetches all messages after the last acknowledged one.
+func (rec *Receiver) enableAck(explicitStart bool) error {
+	if rec.userID == "" {
+		return errAckWithoutUserID
+	}
+	kvStore, err := rec.router.KVStore()
+	if err != nil {
+		return err
+	}
+	rec.ack = true
+	rec.kvStore = kvStore
+
+	if explicitStart {
+		return nil
+	}
+	value, exist, err := kvStore.Get(ackSchema, rec.ackKey())
+	if err != nil || !exist {
+		return err
+	}
+	lastAckedID, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return err
+	}
+	rec.doFetch = true
+	rec.startID = int64(lastAckedID) + 1
+	rec.lastSentID = lastAckedID
+	return nil
+}
+
+// resumedBy returns true, if the receiver of a new receive command continues this one:
+// it has the same filters and delivery, and no start position.
+func (rec *Receiver) resumedBy(other *Receiver) bool {
+	if other.startArg != "" || other.ack != rec.ack || len(other.filterArgs) != len(rec.filterArgs) {
+		return false
+	}
+	for i, arg := range other.filterArgs {
+		if arg != rec.filterArgs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ackKey identifies the subscription of the user to the path, over all connections
+func (rec *Receiver) ackKey() string {
+	return rec.userID + " " + string(rec.path)
+}
+
+// Ack acknowledges the message with the ID and all messages sent before it.
+// It returns false, if the receiver is not in at-least-once mode or has not sent the message.
+func (rec *Receiver) Ack(id uint64) (bool, error) {
+	if !rec.ack {
+		return false, nil
+	}
+	rec.ackMutex.Lock()
+	defer rec.ackMutex.Unlock()
+
+	for i, unackedID := range rec.unackedIDs {
+		if unackedID == id {
+			rec.unackedIDs = rec.unackedIDs[i+1:]
+			return true, rec.kvStore.Put(ackSchema, rec.ackKey(), []byte(strconv.FormatUint(id, 10)))
+		}
+	}
+	return false, nil
+}
+
+// send passes a message to the websocket and remembers its ID for the acknowledgement
+func (rec *Receiver) send(id uint64, message []byte) {
+	rec.lastSentID = id
+	atomic.StoreUint64(&rec.lastDeliveredID, id)
+	if rec.ack {
+		rec.ackMutex.Lock()
+		if len(rec.unackedIDs) >= maxUnackedMessages {
+			rec.unackedIDs = rec.unackedIDs[1:]
+		}
+		rec.unackedIDs = append(rec.unackedIDs, id)
+		rec.ackMutex.Unlock()
+	}
+	rec.sendC <- message
+}
+
 // Start starts the receiver loop
 func (rec *Receiver) Start() error {
 	rec.shouldStop = false
@@ -99,27 +296,13 @@ func (rec *Receiver) Start() error {
 func (rec *Receiver) subscriptionLoop() {
 	for !rec.shouldStop {
 		if rec.doFetch {
-
-			if err := rec.fetch(); err != nil {
+			if err := rec.catchUp(); err != nil {
 				logger.WithError(err).WithField("rec", rec).Error("Error while fetching subscription")
 				rec.sendError(protocol.ERROR_INTERNAL_SERVER, err.Error())
 				return
 			}
-
-			if err := rec.messageStore.DoInTx(rec.path.Partition(), rec.subscribeIfNoUnreadMessagesAvailable); err != nil {
-				if err == errUnreadMsgsAvailable {
-					logger.WithFields(log.Fields{
-						"lastSentId": rec.lastSentID,
-						"receiver":   rec,
-					}).Error("errUnreadMsgsAvailable")
-					rec.startID = int64(rec.lastSentID) + 1
-					continue // fetch again
-				} else {
-					logger.WithError(err).WithField("recStartId", rec.startID).
-						Error("Error while subscribeIfNoUnreadMessagesAvailable")
-					rec.sendError(protocol.ERROR_INTERNAL_SERVER, err.Error())
-					return
-				}
+			if rec.shouldStop {
+				return
 			}
 		} else {
 			rec.subscribe()
@@ -136,29 +319,86 @@ func (rec *Receiver) subscriptionLoop() {
 	}
 }
 
-func (rec *Receiver) subscribeIfNoUnreadMessagesAvailable(maxMessageID uint64) error {
-	if maxMessageID > rec.lastSentID {
-		return errUnreadMsgsAvailable
+// catchUp subscribes to the route and replays the stored messages, while the live messages of the route are buffered.
+// After the replay reached the live tail, the buffered messages not yet replayed are sent in the order of their ids,
+// so the messages are delivered in order. If the buffer overflows or the route is closed during the replay,
+// the replay is extended to the messages stored meanwhile, instead of dropping them.
+func (rec *Receiver) catchUp() error {
+	if !rec.subscribeRoute() {
+		return nil
+	}
+	for {
+		live := newLiveBuffer(rec.route, liveBufferSize)
+		err := rec.fetch()
+		buffered, complete := live.stop()
+		if err != nil || rec.shouldStop {
+			if !rec.isDetached() {
+				rec.router.Unsubscribe(rec.route)
+			}
+			rec.route = nil
+			return err
+		}
+		if complete {
+			rec.sendOK(protocol.SUCCESS_SUBSCRIBED_TO, "%v", rec.path)
+			for _, m := range buffered {
+				if m.ID > rec.lastSentID {
+					rec.send(m.ID, m.Bytes())
+				}
+			}
+			return nil
+		}
+
+		logger.WithFields(log.Fields{
+			"lastSentId": rec.lastSentID,
+			"receiver":   rec,
+		}).Info("Extending the replay, because the live messages could not be buffered")
+		if live.closed && !rec.subscribeRoute() {
+			return nil
+		}
+		if next := int64(rec.lastSentID) + 1; next > rec.startID {
+			rec.startID = next
+		}
 	}
-	rec.subscribe()
-	return nil
 }
 
 func (rec *Receiver) subscribe() {
+	if rec.subscribeRoute() {
+		rec.sendOK(protocol.SUCCESS_SUBSCRIBED_TO, string(rec.path))
+	}
+}
+
+// subscribeRoute subscribes a new route of the receiver, returning false after sending the error if it failed
+func (rec *Receiver) subscribeRoute() bool {
 	rec.route = router.NewRoute(
 		router.RouteConfig{
-			RouteParams: router.RouteParams{"application_id": rec.applicationID, "user_id": rec.userID},
-			Path:        rec.path,
-			ChannelSize: 10,
+			RouteParams:   router.RouteParams{"application_id": rec.applicationID, "user_id": rec.userID},
+			Path:          rec.path,
+			ChannelSize:   10,
+			HeaderFilters: rec.filters,
+			Metadata:      rec.metadata,
 		},
 	)
 
 	_, err := rec.router.Subscribe(rec.route)
-	if err != nil {
-		rec.sendError(protocol.ERROR_SUBSCRIBED_TO, string(rec.path), err.Error())
-	} else {
-		rec.sendOK(protocol.SUCCESS_SUBSCRIBED_TO, string(rec.path))
+	if err == nil && rec.isDetached() {
+		// the route was subscribed after the routes of the connection were removed
+		rec.router.Unsubscribe(rec.route)
+		return false
+	}
+	if _, ok := err.(*router.PermissionDeniedError); ok {
+		rec.sendError(protocol.ERROR_ACCESS_DENIED, "%v", rec.path)
+		return false
+	} else if err == router.ErrTopicFull {
+		rec.sendError(protocol.ERROR_TOPIC_FULL, "%v", rec.path)
+		return false
+	} else if err == router.ErrTooManyTopics {
+		rec.sendError(protocol.ERROR_TOO_MANY_TOPICS, "%v", rec.path)
+		return false
+	} else if err != nil {
+		rec.sendError(protocol.ERROR_SUBSCRIBED_TO, "%v %v", rec.path, err.Error())
+		return false
 	}
+	return true
 }
 
 func (rec *Receiver) receiveFromSubscription() {
@@ -179,18 +419,25 @@ func (rec *Receiver) receiveFromSubscription() {
 			}).Debug("Delivering message")
 
 			if m.ID > rec.lastSentID {
-				rec.lastSentID = m.ID
-				rec.sendC <- m.Bytes()
+				rec.send(m.ID, m.Bytes())
 			} else {
 				logger.WithFields(log.Fields{
-					"msgId": m.ID,
+					"message_id": m.ID,
 				}).Debug("Message already sent to client. Dropping message.")
 			}
+		case <-rec.route.ResetChannel():
+			// the topic was truncated, so the ids of its next messages start a new sequence
+			logger.WithField("path", rec.path).Info("Topic reset")
+			rec.lastSentID = 0
+			atomic.StoreUint64(&rec.lastDeliveredID, 0)
+			rec.sendOK(protocol.SUCCESS_TOPIC_RESET, "%v", rec.path)
 		case <-rec.cancelC:
 			rec.shouldStop = true
-			rec.router.Unsubscribe(rec.route)
+			if !rec.isDetached() {
+				rec.router.Unsubscribe(rec.route)
+				rec.sendOK(protocol.SUCCESS_CANCELED, string(rec.path))
+			}
 			rec.route = nil
-			rec.sendOK(protocol.SUCCESS_CANCELED, string(rec.path))
 			return
 		}
 	}
@@ -201,12 +448,24 @@ func (rec *Receiver) fetchOnlyLoop() {
 	if err != nil {
 		logger.WithError(err).WithField("rec", rec).Error("Error while fetching")
 		rec.sendError(protocol.ERROR_INTERNAL_SERVER, err.Error())
+		return
+	}
+	if rec.endID > 0 && !rec.shouldStop {
+		rec.sendOK(protocol.SUCCESS_DONE, "%v", rec.path)
 	}
 }
 
+// partition returns the partition of the path, which is the one of its canonical path for an alias
+func (rec *Receiver) partition() string {
+	if aliaser, ok := rec.router.(router.Aliaser); ok {
+		return aliaser.ResolveAlias(rec.path).Partition()
+	}
+	return rec.path.Partition()
+}
+
 func (rec *Receiver) fetch() error {
 	fetch := &store.FetchRequest{
-		Partition: rec.path.Partition(),
+		Partition: rec.partition(),
 		MessageC:  make(chan *store.FetchedMessage, 10), //TODO MAKE more tests when the receiver will be refactored after the route params is integrated.Initial capacity was 3
 		ErrorC:    make(chan error),
 		StartC:    make(chan int),
@@ -219,9 +478,25 @@ func (rec *Receiver) fetch() error {
 		if rec.maxCount == 0 {
 			fetch.Count = math.MaxInt32
 		}
+		if rec.endID > 0 {
+			// a range ending after the last message stops at the current tail
+			maxID, err := rec.messageStore.MaxMessageID(rec.partition())
+			if err != nil {
+				return err
+			}
+			if maxID == 0 || maxID < fetch.StartID {
+				rec.sendOK(protocol.SUCCESS_FETCH_START, "%v %v", rec.path, 0)
+				rec.sendOK(protocol.SUCCESS_FETCH_END, "%v", rec.path)
+				return nil
+			}
+			fetch.EndID = rec.endID
+			if maxID < rec.endID {
+				fetch.EndID = maxID
+			}
+		}
 	} else {
 		fetch.Direction = -1
-		maxID, err := rec.messageStore.MaxMessageID(rec.path.Partition())
+		maxID, err := rec.messageStore.MaxMessageID(rec.partition())
 		if err != nil {
 			return err
 		}
@@ -232,7 +507,12 @@ func (rec *Receiver) fetch() error {
 		}
 	}
 
-	rec.messageStore.Fetch(fetch)
+	// the catch-up is throttled, if the replay from the message store is limited
+	if throttler, ok := rec.router.(router.ReplayThrottler); ok {
+		rec.messageStore.Fetch(throttler.ThrottleFetch(fetch))
+	} else {
+		rec.messageStore.Fetch(fetch)
+	}
 
 	for {
 		select {
@@ -243,31 +523,61 @@ func (rec *Receiver) fetch() error {
 				rec.sendOK(protocol.SUCCESS_FETCH_END, string(rec.path))
 				return nil
 			}
+			if !rec.matchesFilters(msgAndID.Message) {
+				// skipped messages count as sent, for not fetching them again before subscribing
+				rec.lastSentID = msgAndID.ID
+				continue
+			}
 			logger.WithFields(log.Fields{
-				"msgId":      msgAndID.ID,
+				"message_id": msgAndID.ID,
 				"msg":        string(msgAndID.Message),
 				"lastSendId": rec.lastSentID,
 			}).Info("Reply sent")
 
-			rec.lastSentID = msgAndID.ID
-			rec.sendC <- msgAndID.Message
+			rec.send(msgAndID.ID, msgAndID.Message)
 		case err := <-fetch.ErrorC:
 			return err
 		case <-rec.cancelC:
 			rec.shouldStop = true
-			rec.sendOK(protocol.SUCCESS_CANCELED, string(rec.path))
+			if !rec.isDetached() {
+				rec.sendOK(protocol.SUCCESS_CANCELED, string(rec.path))
+			}
 			// TODO implement cancellation in message store
 			return nil
 		}
 	}
 }
 
+// matchesFilters returns true if the fetched message matches the header filters of the receiver
+func (rec *Receiver) matchesFilters(data []byte) bool {
+	if len(rec.filters) == 0 {
+		return true
+	}
+	m, err := protocol.ParseMessage(data)
+	if err != nil {
+		logger.WithError(err).WithField("path", rec.path).Error("Error parsing a fetched message for filtering")
+		return false
+	}
+	return rec.filters.Match(m)
+}
+
 // Stop stops/cancels the receiver
 func (rec *Receiver) Stop() error {
 	rec.cancelC <- true
 	return nil
 }
 
+// detach stops the receiver without removing its route and without the canceled notification,
+// as the routes of all receivers of the connection are removed at once, see WebSocket.handleCancelAllCmd
+func (rec *Receiver) detach() {
+	atomic.StoreInt32(&rec.detached, 1)
+	rec.Stop()
+}
+
+func (rec *Receiver) isDetached() bool {
+	return atomic.LoadInt32(&rec.detached) == 1
+}
+
 func (rec *Receiver) sendError(name string, argPattern string, params ...interface{}) {
 	notificationMessage := &protocol.NotificationMessage{
 		Name:    name,
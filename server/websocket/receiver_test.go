@@ -2,15 +2,23 @@ package websocket
 
 import (
 	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/service"
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/store/dummystore"
+	"github.com/smancke/guble/server/store/filestore"
 	"github.com/smancke/guble/testutil"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
 	"testing"
 	"time"
 )
@@ -21,7 +29,9 @@ func Test_Receiver_error_handling_on_create(t *testing.T) {
 
 	a := assert.New(t)
 
-	badArgs := []string{"", "20", "foo 20 20", "/foo 20 20 20", "/foo a", "/foo 20 b"}
+	badArgs := []string{"", "20", "foo 20 20", "/foo 20 20 20", "/foo a", "/foo 20 b",
+		"/foo 20..10", "/foo -1..5", "/foo 1..b", "/foo 0..0", "/foo filter:", "/foo filter:=eu",
+		"/foo @latest 20", "/foo @now"}
 	for _, arg := range badArgs {
 		rec, _, _, _, err := aMockedReceiver(arg)
 		a.Nil(rec, "Testing with: "+arg)
@@ -29,7 +39,7 @@ func Test_Receiver_error_handling_on_create(t *testing.T) {
 	}
 }
 
-func Test_Receiver_Fetch_Subscribe_Fetch_Subscribe(t *testing.T) {
+func Test_Receiver_Subscribe_Fetch_Subscribe_Fetch(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
 
@@ -38,8 +48,15 @@ func Test_Receiver_Fetch_Subscribe_Fetch_Subscribe(t *testing.T) {
 	rec, msgChannel, routerMock, messageStore, err := aMockedReceiver("/foo 0")
 	a.NoError(err)
 
-	// fetch first, starting at 0
-	fetchFirst1 := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+	// subscribe first, for buffering the live messages during the replay
+	var route *router.Route
+	subscribe := routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		a.Equal(r.Path, protocol.Path("/foo"))
+		route = r
+	})
+
+	// fetch, starting at 0, while the router delivers an already fetched and a new message
+	fetchFirst := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
 		go func() {
 			a.Equal("foo", r.Partition)
 			a.Equal(store.DirectionForward, r.Direction)
@@ -47,109 +64,214 @@ func Test_Receiver_Fetch_Subscribe_Fetch_Subscribe(t *testing.T) {
 			a.Equal(int(math.MaxInt32), r.Count)
 
 			r.StartC <- 2
+			route.Deliver(&protocol.Message{ID: uint64(3), Body: []byte("router-3"), Time: 1405544146}, true)
+			route.Deliver(&protocol.Message{ID: uint64(2), Body: []byte("router-2"), Time: 1405544146}, true)
+			time.Sleep(10 * time.Millisecond)
 
-			r.MessageC <- &store.FetchedMessage{ID: uint64(1), Message: []byte("fetch_first1-a")}
-			r.MessageC <- &store.FetchedMessage{ID: uint64(2), Message: []byte("fetch_first1-b")}
+			r.MessageC <- &store.FetchedMessage{ID: uint64(1), Message: []byte("fetch_first-a")}
+			r.MessageC <- &store.FetchedMessage{ID: uint64(2), Message: []byte("fetch_first-b")}
 			close(r.MessageC)
 		}()
 	})
+	fetchFirst.After(subscribe)
+
+	subscriptionLoopDone := make(chan bool)
+	go func() {
+		rec.subscriptionLoop()
+		subscriptionLoopDone <- true
+	}()
 
-	// there is a gap between fetched and max id
-	messageID1 := messageStore.EXPECT().DoInTx(gomock.Any(), gomock.Any()).
-		Do(func(partition string, callback func(maxMessageId uint64) error) {
-			callback(uint64(3))
-		}).Return(errUnreadMsgsAvailable)
-	messageID1.After(fetchFirst1)
+	// then the buffered live message is sent after the replay, without the duplicate
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_FETCH_START+" /foo 2",
+		"fetch_first-a",
+		"fetch_first-b",
+		"#"+protocol.SUCCESS_FETCH_END+" /foo",
+		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo",
+		",3,,,,1405544146,0\n\nrouter-3",
+	)
 
-	// fetch again, starting at 3, because, there is still a gap
-	fetchFirst2 := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+	// when the router closes the route, then the receiver subscribes and fetches again, starting at 4
+	subscribe2 := routerMock.EXPECT().Subscribe(gomock.Any())
+	fetchAfter := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
 		go func() {
-			a.Equal("foo", r.Partition)
-			a.Equal(store.DirectionForward, r.Direction)
-			a.Equal(uint64(3), r.StartID)
+			a.Equal(uint64(4), r.StartID)
 			a.Equal(int(math.MaxInt32), r.Count)
 
 			r.StartC <- 1
-			r.MessageC <- &store.FetchedMessage{ID: uint64(3), Message: []byte("fetch_first2-a")}
+			r.MessageC <- &store.FetchedMessage{ID: uint64(4), Message: []byte("fetch_after-a")}
 			close(r.MessageC)
 		}()
 	})
-	fetchFirst2.After(messageID1)
+	fetchAfter.After(subscribe2)
+	route.Close()
 
-	// the gap is closed
-	messageID2 := messageStore.EXPECT().DoInTx(gomock.Any(), gomock.Any()).
-		Do(func(partition string, callback func(maxMessageId uint64) error) {
-			callback(uint64(3))
-		})
-	messageID2.After(fetchFirst2)
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_FETCH_START+" /foo 1",
+		"fetch_after-a",
+		"#"+protocol.SUCCESS_FETCH_END+" /foo",
+		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo",
+	)
 
-	// subscribe
+	time.Sleep(time.Millisecond)
+	routerMock.EXPECT().Unsubscribe(gomock.Any())
+	rec.Stop()
+
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_CANCELED+" /foo",
+	)
+
+	testutil.ExpectDone(a, subscriptionLoopDone)
+}
+
+func Test_Receiver_ReplayIsExtendedWhenTheLiveBufferOverflows(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	defer func(size int) { liveBufferSize = size }(liveBufferSize)
+	liveBufferSize = 2
+
+	rec, msgChannel, routerMock, messageStore, err := aMockedReceiver("/foo 0")
+	a.NoError(err)
+
+	var route *router.Route
 	subscribe := routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
-		a.Equal(r.Path, protocol.Path("/foo"))
-		r.Deliver(&protocol.Message{ID: uint64(4), Body: []byte("router-a"), Time: 1405544146}, true)
-		r.Deliver(&protocol.Message{ID: uint64(5), Body: []byte("router-b"), Time: 1405544146}, true)
-		r.Close() // emulate router close
+		route = r
 	})
-	subscribe.After(messageID2)
 
-	// router closed, so we fetch again, starting at 6 (after meesages from subscribe)
-	fetchAfter := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+	// more live messages are delivered during the replay than buffered
+	fetchFirst := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
 		go func() {
-			a.Equal(uint64(6), r.StartID)
-			a.Equal(int(math.MaxInt32), r.Count)
-
 			r.StartC <- 1
-			r.MessageC <- &store.FetchedMessage{ID: uint64(6), Message: []byte("fetch_after-a")}
+			for id := 2; id <= 5; id++ {
+				route.Deliver(&protocol.Message{ID: uint64(id), Body: []byte("router")}, true)
+			}
+			time.Sleep(10 * time.Millisecond)
+			r.MessageC <- &store.FetchedMessage{ID: uint64(1), Message: []byte("fetch-1")}
 			close(r.MessageC)
 		}()
 	})
-	fetchAfter.After(subscribe)
-
-	// no gap
-	messageID3 := messageStore.EXPECT().DoInTx(gomock.Any(), gomock.Any()).
-		Do(func(partition string, callback func(maxMessageId uint64) error) {
-			callback(uint64(6))
-		})
+	fetchFirst.After(subscribe)
 
-	messageID3.After(fetchAfter)
-
-	// subscribe and don't send messages,
-	// so the client has to wait until we stop
-	subscribe2 := routerMock.EXPECT().Subscribe(gomock.Any())
-	subscribe2.After(messageID3)
+	// then the replay continues after the last sent message, instead of dropping the live messages
+	fetchSecond := messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+		go func() {
+			a.Equal(uint64(2), r.StartID)
+			r.StartC <- 4
+			for id := 2; id <= 5; id++ {
+				r.MessageC <- &store.FetchedMessage{ID: uint64(id), Message: []byte(fmt.Sprintf("fetch-%d", id))}
+			}
+			close(r.MessageC)
+		}()
+	})
+	fetchSecond.After(fetchFirst)
 
-	subscriptionLoopDone := make(chan bool)
-	go func() {
-		rec.subscriptionLoop()
-		subscriptionLoopDone <- true
-	}()
+	go rec.subscriptionLoop()
 
 	expectMessages(a, msgChannel,
-		"#"+protocol.SUCCESS_FETCH_START+" /foo 2",
-		"fetch_first1-a",
-		"fetch_first1-b",
-		"#"+protocol.SUCCESS_FETCH_END+" /foo",
 		"#"+protocol.SUCCESS_FETCH_START+" /foo 1",
-		"fetch_first2-a",
+		"fetch-1",
 		"#"+protocol.SUCCESS_FETCH_END+" /foo",
-		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo",
-		",4,,,,1405544146,0\n\nrouter-a",
-		",5,,,,1405544146,0\n\nrouter-b",
-		"#"+protocol.SUCCESS_FETCH_START+" /foo 1",
-		"fetch_after-a",
+		"#"+protocol.SUCCESS_FETCH_START+" /foo 4",
+		"fetch-2",
+		"fetch-3",
+		"fetch-4",
+		"fetch-5",
 		"#"+protocol.SUCCESS_FETCH_END+" /foo",
 		"#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo",
 	)
 
-	time.Sleep(time.Millisecond)
 	routerMock.EXPECT().Unsubscribe(gomock.Any())
 	rec.Stop()
+	expectMessages(a, msgChannel, "#"+protocol.SUCCESS_CANCELED+" /foo")
+}
 
-	expectMessages(a, msgChannel,
-		"#"+protocol.SUCCESS_CANCELED+" /foo",
-	)
+func Test_Receiver_MessagesPublishedDuringTheReplayAreDeliveredInOrder(t *testing.T) {
+	a := assert.New(t)
 
-	testutil.ExpectDone(a, subscriptionLoopDone)
+	// given a router with stored messages
+	dir, err := ioutil.TempDir("", "guble_receiver_test")
+	a.NoError(err)
+	defer os.RemoveAll(dir)
+	r := router.New(auth.NewAllowAllAccessManager(true), filestore.New(dir), kvstore.NewMemoryKVStore(), nil)
+	a.NoError(r.(service.Startable).Start())
+	defer r.(service.Stopable).Stop()
+
+	const stored, published = 300, 300
+	for i := 0; i < stored; i++ {
+		a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("stored")}))
+	}
+
+	// when a client catches up, while further messages are published
+	sendC := make(chan []byte, 10)
+	rec, err := NewReceiverFromCmd("appId", &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo 0"}, sendC, r, "userId")
+	a.NoError(err)
+	a.NoError(rec.Start())
+	defer rec.Stop()
+	go func() {
+		for i := 0; i < published; i++ {
+			r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("published")})
+		}
+	}()
+
+	// then all messages are received once, with increasing ids
+	var lastID uint64
+	timeout := time.After(10 * time.Second)
+	for received := 0; received < stored+published; {
+		select {
+		case data := <-sendC:
+			decoded, err := protocol.Decode(data)
+			a.NoError(err)
+			if m, ok := decoded.(*protocol.Message); ok {
+				a.True(m.ID > lastID, "message %v received after %v", m.ID, lastID)
+				lastID = m.ID
+				received++
+			}
+		case <-timeout:
+			a.FailNow("timeout", "after message %v", lastID)
+		}
+	}
+}
+
+func Test_Receiver_TopicReset(t *testing.T) {
+	a := assert.New(t)
+
+	// given a subscribed receiver, which received a message
+	r := router.New(auth.NewAllowAllAccessManager(true), dummystore.New(kvstore.NewMemoryKVStore()), kvstore.NewMemoryKVStore(), nil)
+	a.NoError(r.(service.Startable).Start())
+	defer r.(service.Stopable).Stop()
+
+	sendC := make(chan []byte, 10)
+	rec, err := NewReceiverFromCmd("appId", &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo"}, sendC, r, "userId")
+	a.NoError(err)
+	a.NoError(rec.Start())
+	defer rec.Stop()
+	expectMessages(a, sendC, "#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo")
+
+	expectBody := func(id uint64, body string) {
+		select {
+		case data := <-sendC:
+			decoded, err := protocol.Decode(data)
+			a.NoError(err)
+			if m, ok := decoded.(*protocol.Message); a.True(ok, string(data)) {
+				a.Equal(id, m.ID)
+				a.Equal(body, string(m.Body))
+			}
+		case <-time.After(time.Second):
+			a.FailNow("timeout: " + body)
+		}
+	}
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("before")}))
+	expectBody(1, "before")
+
+	// when the topic is truncated
+	a.NoError(r.(router.Truncater).Truncate("foo"))
+
+	// then the client is notified, and receives the next messages with the new ids
+	expectMessages(a, sendC, "#"+protocol.SUCCESS_TOPIC_RESET+" /foo")
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("after")}))
+	expectBody(1, "after")
 }
 
 func Test_Receiver_Fetch_Returns_Correct_Messages(t *testing.T) {
@@ -221,6 +343,11 @@ func Test_Receiver_Fetch_Produces_Correct_Fetch_Requests(t *testing.T) {
 			maxID:  42,
 			expect: store.FetchRequest{Partition: "foo", Direction: -1, StartID: uint64(42), Count: 10},
 		},
+		{desc: "forward fetch from the earliest message",
+			arg:    "/foo @earliest 20",
+			maxID:  -1,
+			expect: store.FetchRequest{Partition: "foo", Direction: 1, StartID: uint64(0), Count: 20},
+		},
 	}
 
 	for _, test := range testcases {
@@ -249,6 +376,108 @@ func Test_Receiver_Fetch_Produces_Correct_Fetch_Requests(t *testing.T) {
 	}
 }
 
+func Test_Receiver_FetchRange(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	testcases := []struct {
+		desc          string
+		arg           string
+		maxID         uint64
+		expectedEndID uint64
+	}{
+		{desc: "range within the stored messages", arg: "/foo 100..200", maxID: 300, expectedEndID: 200},
+		{desc: "range exceeding the max id is clamped to the tail", arg: "/foo 100..200", maxID: 150, expectedEndID: 150},
+	}
+
+	for _, test := range testcases {
+		rec, msgChannel, _, messageStore, err := aMockedReceiver(test.arg)
+		a.NoError(err, test.desc)
+		a.False(rec.doSubscription, test.desc)
+
+		messageStore.EXPECT().MaxMessageID("foo").Return(test.maxID, nil)
+		messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+			a.Equal(store.DirectionForward, r.Direction, test.desc)
+			a.Equal(uint64(100), r.StartID, test.desc)
+			a.Equal(test.expectedEndID, r.EndID, test.desc)
+			go func() {
+				r.StartC <- 1
+				r.MessageC <- &store.FetchedMessage{ID: uint64(100), Message: []byte("a")}
+				close(r.MessageC)
+			}()
+		})
+
+		// when replaying the range, then the messages are followed by the done notification
+		go rec.fetchOnlyLoop()
+		expectMessages(a, msgChannel,
+			"#"+protocol.SUCCESS_FETCH_START+" /foo 1",
+			"a",
+			"#"+protocol.SUCCESS_FETCH_END+" /foo",
+			"#"+protocol.SUCCESS_DONE+" /foo")
+	}
+}
+
+func Test_Receiver_FetchRangeAfterTheTail(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	rec, msgChannel, _, messageStore, err := aMockedReceiver("/foo 100..200")
+	a.NoError(err)
+
+	// given the range starts after the last stored message, then nothing is fetched
+	messageStore.EXPECT().MaxMessageID("foo").Return(uint64(50), nil)
+
+	go rec.fetchOnlyLoop()
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_FETCH_START+" /foo 0",
+		"#"+protocol.SUCCESS_FETCH_END+" /foo",
+		"#"+protocol.SUCCESS_DONE+" /foo")
+}
+
+func Test_Receiver_Filters(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a subscription with filters
+	rec, _, routerMock, _, err := aMockedReceiver("/foo filter:region=eu filter:premium")
+	a.NoError(err)
+	a.True(rec.doSubscription)
+	a.False(rec.doFetch)
+	expectedFilters := router.HeaderFilters{{Key: "region", Value: "eu"}, {Key: "premium", Present: true}}
+	a.Equal(expectedFilters, rec.filters)
+
+	// then the route of the subscription has the filters
+	routerMock.EXPECT().Subscribe(gomock.Any()).Do(func(r *router.Route) {
+		a.Equal(expectedFilters, r.HeaderFilters)
+	})
+	go rec.subscribe()
+	<-rec.sendC
+
+	// and a fetch with filters only sends the matching messages
+	rec, msgChannel, _, messageStore, err := aMockedReceiver("/foo 0 10 filter:region=eu")
+	a.NoError(err)
+	a.False(rec.doSubscription)
+	a.Equal(10, rec.maxCount)
+
+	matching := &protocol.Message{ID: 2, Path: "/foo", HeaderJSON: `{"region":"eu"}`, Body: []byte("eu")}
+	messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
+		go func() {
+			r.StartC <- 2
+			r.MessageC <- &store.FetchedMessage{ID: 1, Message: (&protocol.Message{ID: 1, Path: "/foo", HeaderJSON: `{"region":"us"}`}).Bytes()}
+			r.MessageC <- &store.FetchedMessage{ID: 2, Message: matching.Bytes()}
+			close(r.MessageC)
+		}()
+	})
+	go rec.fetchOnlyLoop()
+	expectMessages(a, msgChannel,
+		"#"+protocol.SUCCESS_FETCH_START+" /foo 2",
+		string(matching.Bytes()),
+		"#"+protocol.SUCCESS_FETCH_END+" /foo")
+}
+
 func Test_Receiver_Fetch_Sends_error_on_failure(t *testing.T) {
 	a := assert.New(t)
 
@@ -258,9 +487,14 @@ func Test_Receiver_Fetch_Sends_error_on_failure(t *testing.T) {
 	} {
 		ctrl := gomock.NewController(t)
 
-		rec, msgChannel, _, messageStore, err := aMockedReceiver(arg)
+		rec, msgChannel, routerMock, messageStore, err := aMockedReceiver(arg)
 		a.NoError(err)
 
+		// the subscription buffering the live messages is removed after the error
+		if rec.doSubscription {
+			routerMock.EXPECT().Subscribe(gomock.Any())
+			routerMock.EXPECT().Unsubscribe(gomock.Any())
+		}
 		messageStore.EXPECT().Fetch(gomock.Any()).Do(func(r *store.FetchRequest) {
 			go func() {
 				r.ErrorC <- errors.New("expected test error")
@@ -290,6 +524,140 @@ func Test_Receiver_Fetch_Sends_error_on_failure_in_MaxMessageId(t *testing.T) {
 	expectMessages(a, msgChannel, "!error-server-internal expected test error")
 }
 
+func Test_Receiver_Ack(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	// given an at-least-once receiver without a stored ack
+	kvs := kvstore.NewMemoryKVStore()
+	rec, msgChannel, _, _, err := aMockedAckReceiver("/foo", kvs)
+	a.NoError(err)
+	a.True(rec.ack)
+	a.False(rec.doFetch)
+
+	// which has sent two messages
+	go func() {
+		rec.send(4, []byte("message-4"))
+		rec.send(5, []byte("message-5"))
+	}()
+	expectMessages(a, msgChannel, "message-4", "message-5")
+
+	// then an unknown message can not be acknowledged
+	acked, err := rec.Ack(3)
+	a.NoError(err)
+	a.False(acked)
+
+	// and an ack is cumulative and stored
+	acked, err = rec.Ack(5)
+	a.NoError(err)
+	a.True(acked)
+	value, exist, err := kvs.Get(ackSchema, "userId /foo")
+	a.NoError(err)
+	a.True(exist)
+	a.Equal("5", string(value))
+
+	acked, err = rec.Ack(4)
+	a.NoError(err)
+	a.False(acked)
+}
+
+func Test_Receiver_Ack_FetchesAfterTheLastAcknowledgedMessage(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	kvs := kvstore.NewMemoryKVStore()
+	a.NoError(kvs.Put(ackSchema, "userId /foo", []byte("5")))
+
+	// when subscribing in at-least-once mode, then the receiver fetches after the last ack
+	rec, _, _, _, err := aMockedAckReceiver("/foo", kvs)
+	a.NoError(err)
+	a.True(rec.doFetch)
+	a.True(rec.doSubscription)
+	a.Equal(int64(6), rec.startID)
+	a.Equal(uint64(5), rec.lastSentID)
+
+	// and an explicit start id is honored
+	rec, _, _, _, err = aMockedAckReceiver("/foo 2", kvs)
+	a.NoError(err)
+	a.Equal(int64(2), rec.startID)
+
+	// and subscriptions without the ack header are not affected
+	rec, _, _, _, err = aMockedReceiver("/foo")
+	a.NoError(err)
+	a.False(rec.doFetch)
+	acked, err := rec.Ack(5)
+	a.NoError(err)
+	a.False(acked)
+}
+
+func Test_Receiver_Positions(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	// @latest only subscribes, as without a start id
+	rec, _, _, _, err := aMockedReceiver("/foo @latest filter:region=eu")
+	a.NoError(err)
+	a.False(rec.doFetch)
+	a.True(rec.doSubscription)
+	a.Len(rec.filters, 1)
+
+	// @earliest replays from the oldest message, then subscribes
+	rec, _, _, _, err = aMockedReceiver("/foo @earliest")
+	a.NoError(err)
+	a.True(rec.doFetch)
+	a.True(rec.doSubscription)
+	a.Equal(int64(0), rec.startID)
+
+	// and for an at-least-once subscription, @latest skips the replay after the last ack
+	kvs := kvstore.NewMemoryKVStore()
+	a.NoError(kvs.Put(ackSchema, "userId /foo", []byte("5")))
+	rec, _, _, _, err = aMockedAckReceiver("/foo @latest", kvs)
+	a.NoError(err)
+	a.False(rec.doFetch)
+	a.True(rec.ack)
+}
+
+func Test_Receiver_Ack_ErrorHandlingOnCreate(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().MessageStore().Return(NewMockMessageStore(testutil.MockCtrl), nil).AnyTimes()
+
+	// an invalid header
+	cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo", HeaderJSON: "{ack"}
+	_, err := NewReceiverFromCmd("any-appId", cmd, make(chan []byte), routerMock, "userId")
+	a.Error(err)
+
+	// an anonymous user
+	cmd = &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo", HeaderJSON: protocol.AckHeader}
+	_, err = NewReceiverFromCmd("any-appId", cmd, make(chan []byte), routerMock, "")
+	a.Equal(errAckWithoutUserID, err)
+}
+
+func aMockedAckReceiver(arg string, kvs kvstore.KVStore) (*Receiver, chan []byte, *MockRouter, *MockMessageStore, error) {
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	messageStore := NewMockMessageStore(testutil.MockCtrl)
+	routerMock.EXPECT().MessageStore().Return(messageStore, nil).AnyTimes()
+	routerMock.EXPECT().KVStore().Return(kvs, nil)
+	sendChannel := make(chan []byte)
+	cmd := &protocol.Cmd{
+		Name:       protocol.CmdReceive,
+		Arg:        arg,
+		HeaderJSON: protocol.AckHeader,
+	}
+	rec, err := NewReceiverFromCmd("any-appId", cmd, sendChannel, routerMock, "userId")
+	return rec, sendChannel, routerMock, messageStore, err
+}
+
 //rec, sendChannel, router, messageStore, err := aMockedReceiver("+")
 func aMockedReceiver(arg string) (*Receiver, chan []byte, *MockRouter, *MockMessageStore, error) {
 	routerMock := NewMockRouter(testutil.MockCtrl)
@@ -0,0 +1,310 @@
+package websocket
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/kvstore"
+
+	log "github.com/Sirupsen/logrus"
+
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sessionSchema is the kvstore schema of the websocket sessions, by user id and session id
+	sessionSchema = "ws_session"
+
+	// sessionSaveInterval is the interval, in which the positions of the subscriptions of a connected session are saved
+	sessionSaveInterval = 10 * time.Second
+
+	// maxSessionExpiryInterval is the maximum interval, in which the expired sessions are removed
+	maxSessionExpiryInterval = time.Minute
+)
+
+// sessionSubscription is a subscription of a session, with the id of the last message delivered for it
+type sessionSubscription struct {
+	Path    protocol.Path `json:"path"`
+	Start   string        `json:"start,omitempty"`
+	Filters []string      `json:"filters,omitempty"`
+	Ack     bool          `json:"ack,omitempty"`
+	LastID  uint64        `json:"last_id,omitempty"`
+}
+
+// cmd returns the receive command restoring the subscription after its last delivered message.
+// Without a delivered message, the subscription starts again as it was requested.
+// A subscription with ack continues after its last acknowledged message.
+func (s sessionSubscription) cmd() *protocol.Cmd {
+	args := []string{string(s.Path)}
+	cmd := &protocol.Cmd{Name: protocol.CmdReceive}
+	if s.Ack {
+		cmd.HeaderJSON = protocol.AckHeader
+	} else if s.LastID > 0 {
+		args = append(args, strconv.FormatUint(s.LastID+1, 10))
+	} else if s.Start != "" {
+		args = append(args, s.Start)
+	}
+	cmd.Arg = strings.Join(append(args, s.Filters...), " ")
+	return cmd
+}
+
+// sessionData is the stored state of a session
+type sessionData struct {
+	Subscriptions []sessionSubscription `json:"subscriptions"`
+	LastSeen      time.Time             `json:"last_seen"`
+}
+
+// sessionStore stores the sessions in the kvstore, removing them after being idle for the expiry
+type sessionStore struct {
+	kvStore kvstore.KVStore
+	expiry  time.Duration
+	now     func() time.Time
+}
+
+func newSessionStore(kvStore kvstore.KVStore, expiry time.Duration) *sessionStore {
+	return &sessionStore{
+		kvStore: kvStore,
+		expiry:  expiry,
+		now:     time.Now,
+	}
+}
+
+// sessionKey identifies the session of a user, so that a session id can not be used by another user
+func sessionKey(userID, sessionID string) string {
+	return userID + " " + sessionID
+}
+
+// load returns the session, or nil if it does not exist or is expired
+func (s *sessionStore) load(key string) (*sessionData, error) {
+	value, exist, err := s.kvStore.Get(sessionSchema, key)
+	if err != nil || !exist {
+		return nil, err
+	}
+	data := &sessionData{}
+	if err := json.Unmarshal(value, data); err != nil {
+		return nil, err
+	}
+	if s.expired(data) {
+		return nil, s.kvStore.Delete(sessionSchema, key)
+	}
+	return data, nil
+}
+
+// save stores the subscriptions of the session, seen now
+func (s *sessionStore) save(key string, subscriptions []sessionSubscription) error {
+	value, err := json.Marshal(&sessionData{
+		Subscriptions: subscriptions,
+		LastSeen:      s.now(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.kvStore.Put(sessionSchema, key, value)
+}
+
+func (s *sessionStore) expired(data *sessionData) bool {
+	return s.now().Sub(data.LastSeen) > s.expiry
+}
+
+// removeExpired deletes the expired sessions, which are not connected, returning their number
+func (s *sessionStore) removeExpired(connected map[string]bool) (int, error) {
+	entries, err := s.kvStore.Iterate(sessionSchema, "")
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for entry := range entries {
+		data := &sessionData{}
+		if err := json.Unmarshal([]byte(entry[1]), data); err != nil || (s.expired(data) && !connected[entry[0]]) {
+			expired = append(expired, entry[0])
+		}
+	}
+	for _, key := range expired {
+		if err := s.kvStore.Delete(sessionSchema, key); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// SetSessionExpiry enables the sessions of the clients, which connect with a protocol.SessionIDParam:
+// the subscriptions of a session are stored with their positions, and restored when the client connects again
+// with the same session id. A session is removed after being idle (without a connection) for the given expiry.
+// Zero disables the sessions. It has to be called before Start.
+func (handler *WSHandler) SetSessionExpiry(expiry time.Duration) error {
+	if expiry <= 0 {
+		handler.sessions = nil
+		return nil
+	}
+	kvStore, err := handler.router.KVStore()
+	if err != nil {
+		return err
+	}
+	handler.sessions = newSessionStore(kvStore, expiry)
+	return nil
+}
+
+// Start starts removing the expired sessions, if the sessions are enabled.
+func (handler *WSHandler) Start() error {
+	if handler.sessions == nil {
+		return nil
+	}
+	interval := handler.sessions.expiry
+	if interval > maxSessionExpiryInterval {
+		interval = maxSessionExpiryInterval
+	}
+	handler.stopC = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := handler.sessions.removeExpired(handler.connectedSessions())
+				if err != nil {
+					logger.WithError(err).Error("Error removing the expired websocket sessions")
+				} else if n > 0 {
+					logger.WithField("sessions", n).Info("Removed the expired websocket sessions")
+				}
+			case <-handler.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop saves the sessions of the connected clients, so that they are restored after a restart.
+func (handler *WSHandler) Stop() error {
+	if handler.sessions == nil {
+		return nil
+	}
+	if handler.stopC != nil {
+		close(handler.stopC)
+	}
+
+	handler.socketsMutex.Lock()
+	sockets := make([]*WebSocket, 0, len(handler.sockets))
+	for ws := range handler.sockets {
+		sockets = append(sockets, ws)
+	}
+	handler.socketsMutex.Unlock()
+
+	for _, ws := range sockets {
+		ws.saveSession()
+	}
+	return nil
+}
+
+// connectedSessions returns the keys of the sessions of the connected clients
+func (handler *WSHandler) connectedSessions() map[string]bool {
+	handler.socketsMutex.Lock()
+	defer handler.socketsMutex.Unlock()
+
+	connected := make(map[string]bool)
+	for ws := range handler.sockets {
+		if ws.sessionID != "" {
+			connected[ws.sessionKey()] = true
+		}
+	}
+	return connected
+}
+
+func (ws *WebSocket) sessionKey() string {
+	return sessionKey(ws.userID, ws.sessionID)
+}
+
+// restoreSession restores the subscriptions of the session of the client, notifying the client of the outcome:
+// with the number of the restored subscriptions, that the session was started (if it was unknown or expired),
+// or the error, if it could not be restored. Then the client has to subscribe again by itself.
+func (ws *WebSocket) restoreSession() {
+	if ws.sessions == nil {
+		ws.sendError(protocol.ERROR_SESSION_RESTORE, "%v the sessions are disabled", ws.sessionID)
+		return
+	}
+	data, err := ws.sessions.load(ws.sessionKey())
+	if err != nil {
+		logger.WithError(err).WithField("sessionID", ws.sessionID).Error("Error loading the websocket session")
+		ws.sendError(protocol.ERROR_SESSION_RESTORE, "%v %v", ws.sessionID, err)
+		return
+	}
+	if data == nil {
+		ws.sendOK(protocol.SUCCESS_SESSION_STARTED, "%v", ws.sessionID)
+		return
+	}
+	logger.WithFields(log.Fields{
+		"sessionID":     ws.sessionID,
+		"subscriptions": len(data.Subscriptions),
+	}).Info("Restoring the websocket session")
+	ws.sendOK(protocol.SUCCESS_SESSION_RESTORED, "%v %d", ws.sessionID, len(data.Subscriptions))
+	for _, s := range data.Subscriptions {
+		ws.receive(s.cmd(), true)
+	}
+}
+
+// keepSession saves the session in the sessionSaveInterval, returning the function to stop it
+func (ws *WebSocket) keepSession() func() {
+	stopC := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(sessionSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ws.saveSession()
+			case <-stopC:
+				return
+			}
+		}
+	}()
+	return func() { close(stopC) }
+}
+
+// saveSession stores the ongoing subscriptions of the client with their positions, if it has a session
+func (ws *WebSocket) saveSession() {
+	if ws.sessionID == "" || ws.sessions == nil {
+		return
+	}
+	subscriptions, ok := ws.sessionSubscriptions()
+	if !ok {
+		return
+	}
+	if err := ws.sessions.save(ws.sessionKey(), subscriptions); err != nil {
+		logger.WithError(err).WithField("sessionID", ws.sessionID).Error("Error saving the websocket session")
+	}
+}
+
+// sessionSubscriptions returns the subscriptions of the receivers, without the fetches and ranges, ordered by path.
+// It returns false, if the receivers were stopped already.
+func (ws *WebSocket) sessionSubscriptions() ([]sessionSubscription, bool) {
+	ws.receiversMutex.Lock()
+	defer ws.receiversMutex.Unlock()
+
+	if ws.closed {
+		return nil, false
+	}
+	subscriptions := make([]sessionSubscription, 0, len(ws.receivers))
+	for _, rec := range ws.receivers {
+		if !rec.doSubscription {
+			continue
+		}
+		subscriptions = append(subscriptions, sessionSubscription{
+			Path:    rec.path,
+			Start:   rec.startArg,
+			Filters: rec.filterArgs,
+			Ack:     rec.ack,
+			LastID:  atomic.LoadUint64(&rec.lastDeliveredID),
+		})
+	}
+	sort.Sort(byPath(subscriptions))
+	return subscriptions, true
+}
+
+type byPath []sessionSubscription
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,185 @@
+package websocket
+
+import (
+	"github.com/smancke/guble/protocol"
+	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
+	"github.com/smancke/guble/server/router"
+	"github.com/smancke/guble/server/service"
+	"github.com/smancke/guble/server/store/memorystore"
+	"github.com/smancke/guble/server/webserver"
+
+	gorillaws "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_sessionSubscription_cmd(t *testing.T) {
+	a := assert.New(t)
+
+	for _, tc := range []struct {
+		subscription sessionSubscription
+		arg          string
+		header       string
+	}{
+		{sessionSubscription{Path: "/foo"}, "/foo", ""},
+		{sessionSubscription{Path: "/foo", Start: "-5"}, "/foo -5", ""},
+		{sessionSubscription{Path: "/foo", Start: "-5", LastID: 41}, "/foo 42", ""},
+		{sessionSubscription{Path: "/foo", Filters: []string{"filter:region=eu"}, LastID: 41}, "/foo 42 filter:region=eu", ""},
+		{sessionSubscription{Path: "/foo", Start: "3", Ack: true, LastID: 41}, "/foo", protocol.AckHeader},
+	} {
+		cmd := tc.subscription.cmd()
+		a.Equal(protocol.CmdReceive, cmd.Name)
+		a.Equal(tc.arg, cmd.Arg)
+		a.Equal(tc.header, cmd.HeaderJSON)
+	}
+}
+
+func Test_sessionStore_removeExpired(t *testing.T) {
+	a := assert.New(t)
+
+	// given two sessions seen an hour ago, and one seen now
+	now := time.Unix(1420110000, 0)
+	sessions := newSessionStore(kvstore.NewMemoryKVStore(), 30*time.Minute)
+	sessions.now = func() time.Time { return now.Add(-time.Hour) }
+	a.NoError(sessions.save(sessionKey("user01", "idle"), nil))
+	a.NoError(sessions.save(sessionKey("user01", "connected"), nil))
+	sessions.now = func() time.Time { return now }
+	a.NoError(sessions.save(sessionKey("user01", "recent"), []sessionSubscription{{Path: "/foo", LastID: 3}}))
+
+	// when the expired sessions are removed, then the connected one is kept
+	n, err := sessions.removeExpired(map[string]bool{sessionKey("user01", "connected"): true})
+	a.NoError(err)
+	a.Equal(1, n)
+
+	data, err := sessions.load(sessionKey("user01", "idle"))
+	a.NoError(err)
+	a.Nil(data)
+	data, err = sessions.load(sessionKey("user01", "recent"))
+	a.NoError(err)
+	if a.NotNil(data) {
+		a.Equal([]sessionSubscription{{Path: "/foo", LastID: 3}}, data.Subscriptions)
+	}
+
+	// and an expired session is not loaded, even if it was connected
+	data, err = sessions.load(sessionKey("user01", "connected"))
+	a.NoError(err)
+	a.Nil(data)
+}
+
+// sessionServer starts a webserver with a websocket handler, which keeps the sessions in the kvstore
+func sessionServer(t *testing.T, r router.Router) (*WSHandler, *webserver.WebServer) {
+	handler, err := NewWSHandler(r, "/stream/")
+	assert.NoError(t, err)
+	assert.NoError(t, handler.SetSessionExpiry(time.Hour))
+	assert.NoError(t, handler.Start())
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	assert.NoError(t, server.Start())
+	return handler, server
+}
+
+func dialSession(t *testing.T, server *webserver.WebServer, user, sessionID string) *gorillaws.Conn {
+	url := "ws://" + server.GetAddr() + "/stream/user/" + user + "?" + protocol.SessionIDParam + "=" + sessionID
+	conn, _, err := gorillaws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFrame(t, conn, "#"+protocol.SUCCESS_CONNECTED)
+	return conn
+}
+
+// expectFrame reads the next frame, which has to start with the prefix
+func expectFrame(t *testing.T, conn *gorillaws.Conn, prefix string) string {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(string(data), prefix), "expected %q, but was %q", prefix, string(data))
+	return string(data)
+}
+
+func Test_WebSocket_RestoresTheSession(t *testing.T) {
+	a := assert.New(t)
+
+	kvs := kvstore.NewMemoryKVStore()
+	r := router.New(auth.NewAllowAllAccessManager(true), memorystore.New(1000), kvs, nil)
+	a.NoError(r.(service.Startable).Start())
+	defer r.(service.Stopable).Stop()
+
+	// given a client of a new session, which subscribed and received a message
+	handler, server := sessionServer(t, r)
+	conn := dialSession(t, server, "user01", "device01")
+	expectFrame(t, conn, "#"+protocol.SUCCESS_SESSION_STARTED+" device01")
+	a.NoError(conn.WriteMessage(gorillaws.BinaryMessage, []byte("+ /foo")))
+	expectFrame(t, conn, "#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo")
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("first")}))
+	expectFrame(t, conn, "/foo,1,")
+
+	// when the server is stopped and the message is published meanwhile
+	a.NoError(handler.Stop())
+	conn.Close()
+	server.Stop()
+	for handler.Clients() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("second")}))
+
+	// and the client connects to the restarted server with the same session
+	handler, server = sessionServer(t, r)
+	defer server.Stop()
+	defer handler.Stop()
+	conn = dialSession(t, server, "user01", "device01")
+	defer conn.Close()
+
+	// then the subscription is restored, continuing after the received message
+	expectFrame(t, conn, "#"+protocol.SUCCESS_SESSION_RESTORED+" device01 1")
+	expectFrame(t, conn, "#"+protocol.SUCCESS_FETCH_START+" /foo 1")
+	expectFrame(t, conn, "/foo,2,")
+	expectFrame(t, conn, "#"+protocol.SUCCESS_FETCH_END+" /foo")
+	expectFrame(t, conn, "#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo")
+
+	// and subscribing to the restored path again keeps the restored subscription
+	a.NoError(conn.WriteMessage(gorillaws.BinaryMessage, []byte("+ /foo")))
+	expectFrame(t, conn, "#"+protocol.SUCCESS_SUBSCRIBED_TO+" /foo")
+	a.NoError(r.HandleMessage(&protocol.Message{Path: "/foo", Body: []byte("third")}))
+	expectFrame(t, conn, "/foo,3,")
+
+	// and the session is not restored for another user
+	other := dialSession(t, server, "user02", "device01")
+	defer other.Close()
+	expectFrame(t, other, "#"+protocol.SUCCESS_SESSION_STARTED+" device01")
+}
+
+func Test_WebSocket_SessionsDisabled(t *testing.T) {
+	a := assert.New(t)
+
+	kvs := kvstore.NewMemoryKVStore()
+	r := router.New(auth.NewAllowAllAccessManager(true), memorystore.New(1000), kvs, nil)
+	a.NoError(r.(service.Startable).Start())
+	defer r.(service.Stopable).Stop()
+
+	handler, err := NewWSHandler(r, "/stream/")
+	a.NoError(err)
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// a client connecting with a session is told, that it was not restored
+	conn := dialSession(t, server, "user01", "device01")
+	defer conn.Close()
+	expectFrame(t, conn, "!"+protocol.ERROR_SESSION_RESTORE+" device01 the sessions are disabled")
+
+	// and an invalid session id is rejected
+	_, resp, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/user01?"+protocol.SessionIDParam+"=a%20b", nil)
+	a.Error(err)
+	if a.NotNil(resp) {
+		a.Equal(400, resp.StatusCode)
+	}
+}
@@ -3,6 +3,7 @@ package websocket
 import (
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/metrics"
 	"github.com/smancke/guble/server/router"
 
 	log "github.com/Sirupsen/logrus"
@@ -10,11 +11,18 @@ import (
 	"github.com/rs/xid"
 
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// maxCommandHeaderSize is the size in bytes allowed for the command line and the header of a frame,
+// in addition to the MaxMessageSize of its body
+const maxCommandHeaderSize = 64 * 1024
+
 var webSocketUpgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
@@ -24,6 +32,40 @@ type WSHandler struct {
 	router        router.Router
 	prefix        string
 	accessManager auth.AccessManager
+
+	// CompressThreshold is the body size in bytes, above which the message bodies are gzip compressed
+	// for clients requesting it in the handshake. Zero disables the compression.
+	CompressThreshold int
+
+	// MaxMessageSize is the maximum body size in bytes of a published message. Zero disables the limit.
+	MaxMessageSize int
+
+	// PingInterval is the interval of the pings sent to the clients. Zero disables the pings.
+	PingInterval time.Duration
+
+	// PongTimeout is the time a client has to answer a ping, before it is disconnected.
+	PongTimeout time.Duration
+
+	// Authenticator authenticates the handshakes, before the connection is upgraded. Nil accepts all connections.
+	Authenticator auth.Authenticator
+
+	// CheckOrigin returns true, if the origin of the handshake is allowed. Nil accepts all origins.
+	CheckOrigin func(r *http.Request) bool
+
+	// limiter limits the publishes per user, nil if disabled
+	limiter *rateLimiter
+
+	// backpressure pauses reading from the connections while the ingest queue is full, nil if disabled
+	backpressure *backpressure
+
+	// sessions stores the sessions of the clients, nil if disabled; stopC stops the removal of the expired ones
+	sessions *sessionStore
+	stopC    chan struct{}
+
+	// the connected websockets, and if the handler was drained by ReconnectClients
+	socketsMutex sync.Mutex
+	sockets      map[*WebSocket]struct{}
+	draining     bool
 }
 
 // NewWSHandler returns a new WSHandler.
@@ -39,6 +81,78 @@ func NewWSHandler(router router.Router, prefix string) (*WSHandler, error) {
 	}, nil
 }
 
+// SetRateLimit limits the publishes of each user to perSecond messages, with bursts of up to burst messages.
+// The limit is shared by all connections of a user. A rate of zero disables the limit.
+// It has to be called before serving the first connection.
+func (handler *WSHandler) SetRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		handler.limiter = nil
+		return
+	}
+	handler.limiter = newRateLimiter(perSecond, burst)
+}
+
+// ReconnectClients sends the reconnect notification to all connected clients, asking them to close the connection
+// and to reconnect (e.g. to another node) after a random delay of up to maxDelay. The notification is queued after
+// the messages already queued for a client, so they are sent before the client closes the connection.
+// From then on, the new connections are rejected. It returns the number of notified clients.
+func (handler *WSHandler) ReconnectClients(maxDelay time.Duration) int {
+	handler.socketsMutex.Lock()
+	handler.draining = true
+	sockets := make([]*WebSocket, 0, len(handler.sockets))
+	for ws := range handler.sockets {
+		sockets = append(sockets, ws)
+	}
+	handler.socketsMutex.Unlock()
+
+	for _, ws := range sockets {
+		// queued asynchronously, so that a client with a full send channel does not delay the others
+		go ws.sendOK(protocol.SUCCESS_RECONNECT, "%d", int64(maxDelay/time.Millisecond))
+	}
+	logger.WithFields(log.Fields{
+		"clients":  len(sockets),
+		"maxDelay": maxDelay,
+	}).Info("Asked the clients to reconnect")
+	return len(sockets)
+}
+
+// Clients returns the number of connected clients
+func (handler *WSHandler) Clients() int {
+	handler.socketsMutex.Lock()
+	defer handler.socketsMutex.Unlock()
+
+	return len(handler.sockets)
+}
+
+// register adds a connected websocket, returning false if the handler is draining
+func (handler *WSHandler) register(ws *WebSocket) bool {
+	handler.socketsMutex.Lock()
+	defer handler.socketsMutex.Unlock()
+
+	if handler.draining {
+		return false
+	}
+	if handler.sockets == nil {
+		handler.sockets = make(map[*WebSocket]struct{})
+	}
+	handler.sockets[ws] = struct{}{}
+	return true
+}
+
+func (handler *WSHandler) unregister(ws *WebSocket) {
+	handler.socketsMutex.Lock()
+	defer handler.socketsMutex.Unlock()
+
+	delete(handler.sockets, ws)
+}
+
+func (handler *WSHandler) isDraining() bool {
+	handler.socketsMutex.Lock()
+	defer handler.socketsMutex.Unlock()
+
+	return handler.draining
+}
+
 // GetPrefix returns the prefix.
 // It is a part of the service.endpoint implementation.
 func (handler *WSHandler) GetPrefix() string {
@@ -48,14 +162,125 @@ func (handler *WSHandler) GetPrefix() string {
 // ServeHTTP is an http.Handler.
 // It is a part of the service.endpoint implementation.
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, err := webSocketUpgrader.Upgrade(w, r, nil)
+	if handler.isDraining() {
+		http.Error(w, "The server is draining the connections.", http.StatusServiceUnavailable)
+		return
+	}
+	// the path is used without the query, which may contain the access token
+	// an application authenticated by the credentials (e.g. a client certificate) is the publisher of the connection
+	userID, publisherID, err := auth.AuthenticateApplication(handler.Authenticator, r, extractUserID(r.URL.Path), r.URL.Query().Get(protocol.ApplicationIDParam))
+	if err != nil {
+		logger.WithError(err).WithField("path", r.URL.Path).Info("Rejected the websocket handshake")
+		http.Error(w, err.Error(), auth.AuthenticationStatus(err))
+		return
+	}
+	// a client requesting only unknown versions is rejected, instead of misreading its frames
+	requested := websocket.Subprotocols(r)
+	codec, err := protocol.NegotiateSubprotocol(requested)
+	if err != nil {
+		logger.WithField("subprotocols", requested).Info("Rejected the websocket handshake")
+		w.Header().Set(protocol.SubprotocolsHeader, strings.Join(protocol.Subprotocols(), ", "))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata, err := connectionMetadata(r)
+	if err != nil {
+		logger.WithError(err).WithField("path", r.URL.Path).Info("Rejected the websocket handshake")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if publisherID != "" {
+		if err := protocol.ValidateApplicationID(publisherID); err != nil {
+			logger.WithError(err).WithField("path", r.URL.Path).Info("Rejected the websocket handshake")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sessionID := r.URL.Query().Get(protocol.SessionIDParam)
+	if sessionID != "" {
+		if err := protocol.ValidateSessionID(sessionID); err != nil {
+			logger.WithError(err).WithField("path", r.URL.Path).Info("Rejected the websocket handshake")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	compress := handler.CompressThreshold > 0 && r.Header.Get(protocol.CompressionHeader) == protocol.CompressionGzip
+
+	responseHeader := http.Header{}
+	if compress {
+		responseHeader.Set(protocol.CompressionHeader, protocol.CompressionGzip)
+	}
+	if len(requested) > 0 {
+		responseHeader.Set("Sec-WebSocket-Protocol", codec.Subprotocol())
+	}
+	upgrader := webSocketUpgrader
+	if handler.CheckOrigin != nil {
+		upgrader.CheckOrigin = handler.CheckOrigin
+	}
+	c, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		logger.WithError(err).Error("Error on upgrading to websocket")
 		return
 	}
 	defer c.Close()
 
-	NewWebSocket(handler, &wsconn{c}, extractUserID(r.RequestURI)).Start()
+	// the read and write timeouts of the http server are meant for requests, not for the lifetime of a websocket,
+	// and older go versions keep the deadlines on the hijacked connection
+	c.SetReadDeadline(time.Time{})
+	c.SetWriteDeadline(time.Time{})
+	// a frame exceeding the limit is not read into memory: the connection is closed instead.
+	// The bodies exceeding the MaxMessageSize within the limit are rejected by the send command.
+	if handler.MaxMessageSize > 0 {
+		c.SetReadLimit(int64(handler.MaxMessageSize + maxCommandHeaderSize))
+	}
+	if handler.PingInterval > 0 {
+		defer handler.ping(c)()
+	}
+
+	metrics.PromWebsocketConnections.Inc()
+	defer metrics.PromWebsocketConnections.Dec()
+
+	ws := NewWebSocket(handler, &wsconn{c}, userID)
+	ws.codec = codec
+	ws.metadata = metadata
+	ws.publisherID = publisherID
+	ws.sessionID = sessionID
+	if compress {
+		ws.compressThreshold = handler.CompressThreshold
+	}
+	if !handler.register(ws) {
+		return
+	}
+	defer handler.unregister(ws)
+	ws.Start()
+}
+
+// ping sends pings to the client in the PingInterval, returning the function to stop them.
+// Each pong extends the read deadline of the connection, so that reading fails if the client misses a pong.
+func (handler *WSHandler) ping(c *websocket.Conn) func() {
+	timeout := handler.PingInterval + handler.PongTimeout
+	c.SetReadDeadline(time.Now().Add(timeout))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(timeout))
+	})
+
+	stopC := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(handler.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(handler.PongTimeout)); err != nil {
+					logger.WithError(err).Debug("Could not send ping")
+					return
+				}
+			case <-stopC:
+				return
+			}
+		}
+	}()
+	return func() { close(stopC) }
 }
 
 // WSConnection is a wrapper interface for the needed functions of the websocket.Conn
@@ -78,6 +303,7 @@ func (conn *wsconn) Close() {
 }
 
 // Send bytes through the connection and possibly return an error.
+// All messages are sent as binary frames, so that the binary bodies pass through as raw bytes.
 func (conn *wsconn) Send(bytes []byte) error {
 	return conn.WriteMessage(websocket.BinaryMessage, bytes)
 }
@@ -95,11 +321,34 @@ type WebSocket struct {
 	applicationID string
 	userID        string
 	sendChannel   chan []byte
-	receivers     map[protocol.Path]*Receiver
+
+	// the receivers of the subscriptions by path, guarded by receiversMutex for saving the session,
+	// which is not saved anymore after the receivers were stopped on closing
+	receivers      map[protocol.Path]*Receiver
+	receiversMutex sync.Mutex
+	closed         bool
+
+	// compressThreshold is the body size above which messages are sent compressed, zero if not requested
+	compressThreshold int
+
+	// codec encodes and decodes the frames of the negotiated subprotocol
+	codec protocol.FrameCodec
+
+	// metadata of the connection passed by the client, which is set on the routes of its subscriptions
+	metadata map[string]string
+
+	// publisherID is the application id named by the client on the handshake, which is set on its published messages
+	// instead of the random applicationID of the connection, e.g. for the message quota of the application
+	publisherID string
+
+	// sessionID is the session named by the client on the handshake, whose subscriptions are restored and saved
+	sessionID string
 }
 
 // NewWebSocket returns a new WebSocket.
+// It uses the frames of protocol.SubprotocolV1, ServeHTTP sets the codec of the negotiated subprotocol.
 func NewWebSocket(handler *WSHandler, wsConn WSConnection, userID string) *WebSocket {
+	codec, _ := protocol.Codec(protocol.SubprotocolV1)
 	return &WebSocket{
 		WSHandler:     handler,
 		WSConnection:  wsConn,
@@ -107,14 +356,30 @@ func NewWebSocket(handler *WSHandler, wsConn WSConnection, userID string) *WebSo
 		userID:        userID,
 		sendChannel:   make(chan []byte, 10),
 		receivers:     make(map[protocol.Path]*Receiver),
+		codec:         codec,
 	}
 }
 
 // Start the WebSocket (the send and receive loops).
 // It is implementing the service.startable interface.
 func (ws *WebSocket) Start() error {
+	if ws.limiter != nil {
+		ws.limiter.register(ws.rateLimitKey())
+		defer ws.limiter.unregister(ws.rateLimitKey())
+	}
+	logger.WithFields(log.Fields{
+		"user_id":       ws.userID,
+		"applicationID": ws.applicationID,
+		"metadata":      ws.metadata,
+	}).Debug("Connected")
 	ws.sendConnectionMessage()
 	go ws.sendLoop()
+	if ws.sessionID != "" {
+		ws.restoreSession()
+	}
+	if ws.sessionID != "" && ws.sessions != nil {
+		defer ws.keepSession()()
+	}
 	ws.receiveLoop()
 	return nil
 }
@@ -124,10 +389,12 @@ func (ws *WebSocket) sendLoop() {
 		if !ws.checkAccess(raw) {
 			continue
 		}
+		raw = ws.codec.EncodeFrame(ws.compress(raw))
 		if err := ws.Send(raw); err != nil {
 			logger.WithFields(log.Fields{
-				"userId":        ws.userID,
+				"user_id":       ws.userID,
 				"applicationID": ws.applicationID,
+				"metadata":      ws.metadata,
 				"totalSize":     len(raw),
 				"actualContent": string(raw),
 			}).Error("Could not send")
@@ -142,16 +409,33 @@ func (ws *WebSocket) checkAccess(raw []byte) bool {
 		path := getPathFromRawMessage(raw)
 
 		logger.WithFields(log.Fields{
-			"userID": ws.userID,
-			"path":   path,
+			"user_id": ws.userID,
+			"path":    path,
 		}).Debug("Received msg")
 
-		return len(path) == 0 || ws.accessManager.IsAllowed(auth.READ, ws.userID, path)
+		return len(path) == 0 || auth.IsAllowed(ws.accessManager, auth.READ, ws.userID, ws.applicationID, path)
 
 	}
 	return true
 }
 
+// compress returns the message with a gzip compressed body, if the body is larger than the compression threshold.
+// Notifications and small messages are returned unchanged.
+func (ws *WebSocket) compress(raw []byte) []byte {
+	if ws.compressThreshold <= 0 || len(raw) <= ws.compressThreshold || raw[0] != byte('/') {
+		return raw
+	}
+	msg, err := protocol.ParseMessage(raw)
+	if err != nil || len(msg.Body) <= ws.compressThreshold {
+		return raw
+	}
+	if err := msg.CompressBody(); err != nil {
+		logger.WithError(err).WithField("applicationID", ws.applicationID).Error("Error compressing message")
+		return raw
+	}
+	return msg.Bytes()
+}
+
 func getPathFromRawMessage(raw []byte) protocol.Path {
 	i := strings.Index(string(raw), ",")
 	return protocol.Path(raw[:i])
@@ -160,8 +444,24 @@ func getPathFromRawMessage(raw []byte) protocol.Path {
 func (ws *WebSocket) receiveLoop() {
 	var message []byte
 	for {
+		ws.throttle()
 		err := ws.Receive(&message)
 		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				logger.WithFields(log.Fields{
+					"user_id":       ws.userID,
+					"applicationID": ws.applicationID,
+					"metadata":      ws.metadata,
+				}).Info("Disconnecting the client, which missed a pong")
+				metrics.PromWebsocketPongTimeouts.Inc()
+			}
+			if err == websocket.ErrReadLimit {
+				logger.WithFields(log.Fields{
+					"user_id":        ws.userID,
+					"applicationID":  ws.applicationID,
+					"maxMessageSize": ws.MaxMessageSize,
+				}).Info("Disconnecting the client, which sent a frame exceeding the max message size")
+			}
 
 			logger.WithFields(log.Fields{
 				"applicationID": ws.applicationID,
@@ -172,7 +472,7 @@ func (ws *WebSocket) receiveLoop() {
 		}
 
 		//protocol.Debug("websocket_connector, raw message received: %v", string(message))
-		cmd, err := protocol.ParseCmd(message)
+		cmd, err := ws.codec.DecodeCmd(message)
 		if err != nil {
 			ws.sendError(protocol.ERROR_BAD_REQUEST, "error parsing command. %v", err.Error())
 			continue
@@ -184,6 +484,8 @@ func (ws *WebSocket) receiveLoop() {
 			ws.handleReceiveCmd(cmd)
 		case protocol.CmdCancel:
 			ws.handleCancelCmd(cmd)
+		case protocol.CmdAck:
+			ws.handleAckCmd(cmd)
 		default:
 			ws.sendError(protocol.ERROR_BAD_REQUEST, "unknown command %v", cmd.Name)
 		}
@@ -199,7 +501,20 @@ func (ws *WebSocket) sendConnectionMessage() {
 	ws.sendChannel <- n.Bytes()
 }
 
+// handleReceiveCmd subscribes to the path of the command, or to each path of a comma-separated list,
+// e.g. `+ /foo,/bar 5`. The paths are subscribed independently, with the same arguments,
+// so each of them is confirmed or rejected by its own notification.
 func (ws *WebSocket) handleReceiveCmd(cmd *protocol.Cmd) {
+	for _, pathCmd := range splitReceiveCmd(cmd) {
+		ws.receive(pathCmd, false)
+	}
+	ws.saveSession()
+}
+
+// receive starts the receiver of the command. The receivers restored by the session are kept,
+// when the client subscribes to the same path again (after the reconnect) without a start position,
+// and replaced by a subscription with other arguments.
+func (ws *WebSocket) receive(cmd *protocol.Cmd, restored bool) {
 	rec, err := NewReceiverFromCmd(
 		ws.applicationID,
 		cmd,
@@ -209,23 +524,144 @@ func (ws *WebSocket) handleReceiveCmd(cmd *protocol.Cmd) {
 	)
 	if err != nil {
 		logger.WithError(err).Error("Client error in handleReceiveCmd")
+		// the error starts with the path, so that the client can assign it to its subscribe command
+		if path := strings.SplitN(cmd.Arg, " ", 2)[0]; strings.HasPrefix(path, "/") {
+			ws.sendError(protocol.ERROR_BAD_REQUEST, "%v %v", path, err.Error())
+			return
+		}
 		ws.sendError(protocol.ERROR_BAD_REQUEST, err.Error())
 		return
 	}
+	rec.metadata = ws.metadata
+	rec.restored = restored
+
+	ws.receiversMutex.Lock()
+	previous, exists := ws.receivers[rec.path]
+	if exists && previous.restored {
+		if previous.resumedBy(rec) {
+			previous.restored = false
+			ws.receiversMutex.Unlock()
+			ws.sendOK(protocol.SUCCESS_SUBSCRIBED_TO, "%v", rec.path)
+			return
+		}
+		previous.Stop()
+	}
 	ws.receivers[rec.path] = rec
+	ws.receiversMutex.Unlock()
 	rec.Start()
 }
 
+// splitReceiveCmd returns a receive command for each path in the path argument of the command
+func splitReceiveCmd(cmd *protocol.Cmd) []*protocol.Cmd {
+	paths, args := cmd.Arg, ""
+	if i := strings.Index(cmd.Arg, " "); i >= 0 {
+		paths, args = cmd.Arg[:i], cmd.Arg[i:]
+	}
+	if !strings.Contains(paths, protocol.PathListSeparator) {
+		return []*protocol.Cmd{cmd}
+	}
+
+	cmds := make([]*protocol.Cmd, 0)
+	seen := make(map[string]bool)
+	for _, path := range strings.Split(paths, protocol.PathListSeparator) {
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		cmds = append(cmds, &protocol.Cmd{
+			Name:       cmd.Name,
+			Arg:        path + args,
+			HeaderJSON: cmd.HeaderJSON,
+		})
+	}
+	return cmds
+}
+
 func (ws *WebSocket) handleCancelCmd(cmd *protocol.Cmd) {
 	if len(cmd.Arg) == 0 {
 		ws.sendError(protocol.ERROR_BAD_REQUEST, "- command requires a path argument, but none given")
 		return
 	}
+	if cmd.Arg == protocol.CancelAllArg {
+		ws.handleCancelAllCmd()
+		return
+	}
 	path := protocol.Path(cmd.Arg)
 	rec, exist := ws.receivers[path]
-	if exist {
-		rec.Stop()
-		delete(ws.receivers, path)
+	if !exist {
+		ws.sendError(protocol.ERROR_SUBSCRIPTION_NOT_FOUND, "%v", path)
+		return
+	}
+	rec.Stop()
+	ws.receiversMutex.Lock()
+	delete(ws.receivers, path)
+	ws.receiversMutex.Unlock()
+	ws.saveSession()
+}
+
+// handleCancelAllCmd cancels all subscriptions of the connection, removing their routes with a single request
+// to the router, and confirms it by a single notification. The subscriptions of the connectors are not affected,
+// as only the routes with the params of the connection are removed.
+func (ws *WebSocket) handleCancelAllCmd() {
+	ws.receiversMutex.Lock()
+	receivers := ws.receivers
+	ws.receivers = make(map[protocol.Path]*Receiver)
+	ws.receiversMutex.Unlock()
+
+	paths := make([]protocol.Path, 0, len(receivers))
+	for path, rec := range receivers {
+		rec.detach()
+		paths = append(paths, path)
+	}
+	params := router.RouteParams{"application_id": ws.applicationID, "user_id": ws.userID}
+	removed := 0
+	if batcher, ok := ws.router.(router.BatchUnsubscriber); ok {
+		removed = batcher.UnsubscribePaths(params, paths)
+	} else {
+		for _, path := range paths {
+			ws.router.Unsubscribe(router.NewRoute(router.RouteConfig{Path: path, RouteParams: params}))
+		}
+		removed = len(paths)
+	}
+	logger.WithFields(log.Fields{
+		"user_id":       ws.userID,
+		"applicationID": ws.applicationID,
+		"subscriptions": len(paths),
+		"routes":        removed,
+	}).Info("Canceled all subscriptions")
+
+	ws.sendOK(protocol.SUCCESS_CANCELED_ALL, "%d", len(paths))
+	ws.saveSession()
+}
+
+// handleAckCmd acknowledges a message for the at-least-once subscription to the path, which has sent it,
+// e.g. `a /foo 42`. A path is needed, as the message ids are generated per partition.
+func (ws *WebSocket) handleAckCmd(cmd *protocol.Cmd) {
+	args := strings.Fields(cmd.Arg)
+	if len(args) != 2 {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "ack command requires a path and a message id, but was %q", cmd.Arg)
+		return
+	}
+	path := protocol.Path(args[0])
+	id, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "ack command requires a message id, but was %q", args[1])
+		return
+	}
+
+	rec, exist := ws.receivers[path]
+	if !exist {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "no subscription to %v", path)
+		return
+	}
+	acked, err := rec.Ack(id)
+	if err != nil {
+		logger.WithError(err).WithField("applicationID", ws.applicationID).Error("Error storing the ack")
+		ws.sendError(protocol.ERROR_INTERNAL_SERVER, "%v", err)
+		return
+	}
+	if !acked {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "no unacknowledged message with id %v of %v", id, path)
 	}
 }
 
@@ -239,30 +675,132 @@ func (ws *WebSocket) handleSendCmd(cmd *protocol.Cmd) {
 		return
 	}
 
+	if ws.MaxMessageSize > 0 && len(cmd.Body) > ws.MaxMessageSize {
+		ws.sendError(protocol.ERROR_MAX_MESSAGE_SIZE_EXCEEDED, "message body of %d bytes exceeds the maximum of %d bytes", len(cmd.Body), ws.MaxMessageSize)
+		return
+	}
+
+	if ws.limiter != nil && !ws.limiter.allow(ws.rateLimitKey()) {
+		ws.sendError(protocol.ERROR_RATE_LIMITED, "%v", cmd.Arg)
+		return
+	}
+
 	args := strings.SplitN(cmd.Arg, " ", 2)
+	applicationID := ws.applicationID
+	if ws.publisherID != "" {
+		applicationID = ws.publisherID
+	}
 	msg := &protocol.Message{
 		Path:          protocol.Path(args[0]),
-		ApplicationID: ws.applicationID,
+		ApplicationID: applicationID,
 		UserID:        ws.userID,
 		HeaderJSON:    cmd.HeaderJSON,
 		Body:          cmd.Body,
+		Binary:        cmd.IsBinary(),
+	}
+	if _, err := msg.Priority(); err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err)
+		return
+	}
+	if _, err := msg.DeliverAt(); err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err)
+		return
+	}
+	if _, err := msg.Expires(); err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err)
+		return
+	}
+	if _, err := msg.ContentType(); err != nil {
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err)
+		return
 	}
 
-	ws.router.HandleMessage(msg)
+	err := ws.backpressure.publish(func() error { return ws.router.HandleMessage(msg) })
+	if err == router.ErrTooManyTopics {
+		ws.sendError(protocol.ERROR_TOO_MANY_TOPICS, "%v", msg.Path)
+		return
+	}
+	switch err := err.(type) {
+	case *router.PermissionDeniedError:
+		ws.sendError(protocol.ERROR_ACCESS_DENIED, "%v", msg.Path)
+		return
+	case *router.MiddlewareError:
+		ws.sendError(protocol.ERROR_BAD_REQUEST, "%v", err)
+		return
+	case *router.QuotaExceededError:
+		// the client can retry in the next window of the quota, after the given seconds
+		ws.sendError(protocol.ERROR_QUOTA_EXCEEDED, "%v %d", msg.Path, err.RetryAfterSeconds())
+		return
+	}
 
 	ws.sendOK(protocol.SUCCESS_SEND, "")
 }
 
+// throttle pauses reading from the connection while the ingest queue is above the high-water mark,
+// so that the client is slowed down by the TCP flow control. The client is notified when it is paused and resumed.
+func (ws *WebSocket) throttle() {
+	paused := func(pending int) {
+		logger.WithFields(log.Fields{
+			"user_id":       ws.userID,
+			"applicationID": ws.applicationID,
+			"pending":       pending,
+		}).Debug("Pausing the connection, while the ingest queue is full")
+		metrics.PromWebsocketThrottled.Inc()
+		ws.sendOK(protocol.SUCCESS_SLOW_DOWN, "%d", pending)
+	}
+	if !ws.backpressure.wait(paused, ws.isClosed) {
+		return
+	}
+	metrics.PromWebsocketThrottled.Dec()
+	if ws.isClosed() {
+		return
+	}
+	ws.sendOK(protocol.SUCCESS_RESUME, "")
+
+	// the pongs of the client were not read meanwhile, so the read deadline is extended
+	if c, ok := ws.WSConnection.(readDeadliner); ok && ws.PingInterval > 0 {
+		c.SetReadDeadline(time.Now().Add(ws.PingInterval + ws.PongTimeout))
+	}
+}
+
+// readDeadliner is implemented by the connections, which fail reading after a deadline
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+func (ws *WebSocket) isClosed() bool {
+	ws.receiversMutex.Lock()
+	defer ws.receiversMutex.Unlock()
+
+	return ws.closed
+}
+
+// rateLimitKey identifies the user for the rate limit.
+// The connections without a user id are limited separately.
+func (ws *WebSocket) rateLimitKey() string {
+	if ws.userID == "" {
+		return "application:" + ws.applicationID
+	}
+	return "user:" + ws.userID
+}
+
 func (ws *WebSocket) cleanAndClose() {
 
 	logger.WithFields(log.Fields{
 		"applicationID": ws.applicationID,
+		"metadata":      ws.metadata,
 	}).Debug("Closing applicationId")
 
+	// the session keeps the subscriptions of the connection, for restoring them on the next connect
+	ws.saveSession()
+
+	ws.receiversMutex.Lock()
+	ws.closed = true
 	for path, rec := range ws.receivers {
 		rec.Stop()
 		delete(ws.receivers, path)
 	}
+	ws.receiversMutex.Unlock()
 
 	ws.Close()
 }
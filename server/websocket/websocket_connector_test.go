@@ -3,14 +3,18 @@ package websocket
 import (
 	"github.com/smancke/guble/protocol"
 	"github.com/smancke/guble/server/auth"
+	"github.com/smancke/guble/server/kvstore"
 	"github.com/smancke/guble/server/router"
 	"github.com/smancke/guble/server/store"
+	"github.com/smancke/guble/server/webserver"
 	"github.com/smancke/guble/testutil"
 
 	"github.com/golang/mock/gomock"
+	gorillaws "github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
@@ -61,6 +65,182 @@ func Test_WebSocket_SubscribeAndUnsubscribe(t *testing.T) {
 	a.Equal(protocol.Path("/bar"), websocket.receivers[protocol.Path("/bar")].path)
 }
 
+func Test_WebSocket_UnsubscribeAll(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	a := assert.New(t)
+
+	// the cancel command is read after both subscriptions were confirmed
+	commandsC := make(chan []byte, 3)
+	commandsC <- []byte("+ /foo")
+	commandsC <- []byte("+ /bar")
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	messageStore := NewMockMessageStore(testutil.MockCtrl)
+	routerMock.EXPECT().MessageStore().Return(messageStore, nil).AnyTimes()
+	wsconn := NewMockWSConnection(testutil.MockCtrl)
+	wsconn.EXPECT().Receive(gomock.Any()).Do(func(message *[]byte) error {
+		*message = <-commandsC
+		return nil
+	}).Times(4)
+	wsconn.EXPECT().Send(connectedNotificationMatcher{})
+
+	var subscribed sync.WaitGroup
+	subscribed.Add(2)
+	subscribedDone := func(bytes []byte) error {
+		subscribed.Done()
+		return nil
+	}
+	routerMock.EXPECT().Subscribe(routeMatcher{"/foo"}).Return(nil, nil)
+	wsconn.EXPECT().
+		Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /foo")).
+		Do(subscribedDone)
+	routerMock.EXPECT().Subscribe(routeMatcher{"/bar"}).Return(nil, nil)
+	wsconn.EXPECT().
+		Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /bar")).
+		Do(subscribedDone)
+
+	// then a router without batch unsubscriptions is asked for each route,
+	// and the cancellation is confirmed by a single notification
+	done := make(chan bool, 1)
+	routerMock.EXPECT().Unsubscribe(routeMatcher{"/foo"})
+	routerMock.EXPECT().Unsubscribe(routeMatcher{"/bar"})
+	wsconn.EXPECT().
+		Send([]byte("#" + protocol.SUCCESS_CANCELED_ALL + " 2")).
+		Do(func(bytes []byte) error {
+			done <- true
+			return nil
+		})
+
+	websocket := runNewWebSocket(wsconn, routerMock, messageStore, nil)
+	subscribed.Wait()
+	commandsC <- []byte("- *")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("No canceled-all notification sent")
+	}
+	websocket.receiversMutex.Lock()
+	defer websocket.receiversMutex.Unlock()
+	a.Equal(0, len(websocket.receivers))
+}
+
+func Test_WebSocket_SubscribeWithoutAccess(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	wsconn, routerMock, messageStore := createDefaultMocks([]string{"+ /private"})
+
+	done := make(chan bool, 1)
+	routerMock.EXPECT().Subscribe(routeMatcher{"/private"}).
+		Return(nil, &router.PermissionDeniedError{Path: "/private", AccessType: auth.READ})
+	wsconn.EXPECT().
+		Send([]byte("!" + protocol.ERROR_ACCESS_DENIED + " /private")).
+		Do(func(bytes []byte) error {
+			done <- true
+			return nil
+		})
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("No access denied error sent")
+	}
+}
+
+func Test_WebSocket_SubscribeToAFullTopic(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	wsconn, routerMock, messageStore := createDefaultMocks([]string{"+ /crowded"})
+
+	done := make(chan bool, 1)
+	routerMock.EXPECT().Subscribe(routeMatcher{"/crowded"}).Return(nil, router.ErrTopicFull)
+	wsconn.EXPECT().
+		Send([]byte("!" + protocol.ERROR_TOPIC_FULL + " /crowded")).
+		Do(func(bytes []byte) error {
+			done <- true
+			return nil
+		})
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("No topic full error sent")
+	}
+}
+
+func Test_WebSocket_SubscribeToMultiplePaths(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a single command for three paths, where the access to one of them is denied
+	wsconn, routerMock, messageStore := createDefaultMocks([]string{"+ /foo,/private,/bar,/foo"})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	doneGroup := func(bytes []byte) error {
+		wg.Done()
+		return nil
+	}
+
+	routerMock.EXPECT().Subscribe(routeMatcher{"/foo"}).Return(nil, nil)
+	routerMock.EXPECT().Subscribe(routeMatcher{"/private"}).
+		Return(nil, &router.PermissionDeniedError{Path: "/private", AccessType: auth.READ})
+	routerMock.EXPECT().Subscribe(routeMatcher{"/bar"}).Return(nil, nil)
+
+	// then each path is answered by its own notification
+	wsconn.EXPECT().Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /foo")).Do(doneGroup)
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_ACCESS_DENIED + " /private")).Do(doneGroup)
+	wsconn.EXPECT().Send([]byte("#" + protocol.SUCCESS_SUBSCRIBED_TO + " /bar")).Do(doneGroup)
+
+	websocket := runNewWebSocket(wsconn, routerMock, messageStore, nil)
+	wg.Wait()
+
+	a.Equal(3, len(websocket.receivers))
+}
+
+func Test_splitReceiveCmd(t *testing.T) {
+	a := assert.New(t)
+
+	cmd := &protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo 5", HeaderJSON: protocol.AckHeader}
+	a.Equal([]*protocol.Cmd{cmd}, splitReceiveCmd(cmd))
+
+	cmds := splitReceiveCmd(&protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo,,/bar 5 filter:a=b", HeaderJSON: protocol.AckHeader})
+	a.Equal([]*protocol.Cmd{
+		{Name: protocol.CmdReceive, Arg: "/foo 5 filter:a=b", HeaderJSON: protocol.AckHeader},
+		{Name: protocol.CmdReceive, Arg: "/bar 5 filter:a=b", HeaderJSON: protocol.AckHeader},
+	}, cmds)
+}
+
+func Test_WebSocket_UnsubscribeUnknownPath(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	wsconn, routerMock, messageStore := createDefaultMocks([]string{"- /foo"})
+
+	done := make(chan bool, 1)
+	wsconn.EXPECT().
+		Send([]byte("!" + protocol.ERROR_SUBSCRIPTION_NOT_FOUND + " /foo")).
+		Do(func(bytes []byte) error {
+			done <- true
+			return nil
+		})
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+
+	select {
+	case <-done:
+	case <-time.After(time.Millisecond * 100):
+		t.Error("timeout while waiting for the error notification")
+	}
+}
+
 func Test_SendMessage(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -74,6 +254,159 @@ func Test_SendMessage(t *testing.T) {
 	runNewWebSocket(wsconn, routerMock, messageStore, nil)
 }
 
+func Test_SendBinaryMessage(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	commands := []string{"> /path binary\n\n\xff\x00\n\xfe"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "\xff\x00\n\xfe"}).Do(func(msg *protocol.Message) {
+		a.True(msg.Binary)
+	})
+	wsconn.EXPECT().Send([]byte("#send"))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageWithoutAccess(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /private\n\nHello"}
+	wsconn, routerMock, messageStore := createDefaultMocks(commands)
+
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/private", message: "Hello"}).
+		Return(&router.PermissionDeniedError{Path: "/private", AccessType: auth.WRITE})
+	wsconn.EXPECT().Send([]byte("!error-access-denied /private"))
+
+	runNewWebSocket(wsconn, routerMock, messageStore, nil)
+}
+
+func Test_SendMessageExceedingTheMaxMessageSize(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n\nHello, this is a test", "> /path\n\nHello"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	// then only the small message is passed to the router
+	done := make(chan bool, 1)
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_MAX_MESSAGE_SIZE_EXCEEDED + " message body of 21 bytes exceeds the maximum of 10 bytes"))
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello"})
+	wsconn.EXPECT().Send([]byte("#send")).Do(func(bytes []byte) error {
+		done <- true
+		return nil
+	})
+
+	// when sending a message larger than the limit and a small one
+	handler := testWSHandler(routerMock, auth.NewAllowAllAccessManager(true))
+	handler.MaxMessageSize = 10
+	websocket := NewWebSocket(handler, wsconn, "testuser")
+	go websocket.Start()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func Test_FrameExceedingTheReadLimitDisconnects(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a webserver with a websocket handler limiting the message size
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+	handler.MaxMessageSize = 10
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	conn, _, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	_, _, err = conn.ReadMessage()
+	a.NoError(err)
+
+	// when sending a frame larger than the max message size and the header
+	body := strings.Repeat("x", handler.MaxMessageSize+maxCommandHeaderSize)
+	a.NoError(conn.WriteMessage(gorillaws.BinaryMessage, []byte("> /foo\n\n"+body)))
+
+	// then the connection is closed, without the frame being read
+	_, _, err = conn.ReadMessage()
+	a.True(gorillaws.IsCloseError(err, gorillaws.CloseMessageTooBig), "%v", err)
+}
+
+func Test_SendMessageExceedingTheRateLimit(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+
+	commands := []string{"> /path\n\nfirst", "> /path\n\nsecond"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	// then only the first message is passed to the router, and the second is dropped with an error
+	done := make(chan bool, 1)
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "first"})
+	gomock.InOrder(
+		wsconn.EXPECT().Send([]byte("#send")),
+		wsconn.EXPECT().Send([]byte("!"+protocol.ERROR_RATE_LIMITED+" /path")).Do(func(bytes []byte) error {
+			done <- true
+			return nil
+		}),
+	)
+
+	// when sending two messages with a limit of one message per minute
+	handler := testWSHandler(routerMock, auth.NewAllowAllAccessManager(true))
+	handler.SetRateLimit(1.0/60, 1)
+	websocket := NewWebSocket(handler, wsconn, "testuser")
+	go websocket.Start()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
+func Test_SendMessageExceedingTheQuota(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	commands := []string{"> /path\n\nHello"}
+	wsconn, routerMock, _ := createDefaultMocks(commands)
+
+	// then the message is published with the application id named on the handshake, and rejected by its quota
+	done := make(chan bool, 1)
+	routerMock.EXPECT().HandleMessage(messageMatcher{path: "/path", message: "Hello"}).Do(func(msg *protocol.Message) {
+		a.Equal("shop", msg.ApplicationID)
+	}).Return(&router.QuotaExceededError{ApplicationID: "shop", Limit: 10, RetryAfter: 90500 * time.Millisecond})
+	wsconn.EXPECT().Send([]byte("!" + protocol.ERROR_QUOTA_EXCEEDED + " /path 91")).Do(func(bytes []byte) error {
+		done <- true
+		return nil
+	})
+
+	websocket := NewWebSocket(testWSHandler(routerMock, auth.NewAllowAllAccessManager(true)), wsconn, "testuser")
+	websocket.publisherID = "shop"
+	go websocket.Start()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fail()
+	}
+}
+
 func Test_AnIncomingMessageIsDelivered(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
@@ -121,11 +454,53 @@ func Test_AnIncomingMessageIsNotAllowed(t *testing.T) {
 	time.Sleep(time.Millisecond * 2)
 }
 
+func Test_LargeMessagesAreCompressed(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	wsconn, routerMock, _ := createDefaultMocks([]string{})
+
+	// given a websocket of a client, which requested the compression
+	handler := NewWebSocket(
+		testWSHandler(routerMock, auth.NewAllowAllAccessManager(true)),
+		wsconn,
+		"testuser",
+	)
+	handler.compressThreshold = 100
+	go func() {
+		handler.Start()
+	}()
+	time.Sleep(time.Millisecond * 2)
+
+	largeMessage := &protocol.Message{
+		ID:   uint64(43),
+		Path: "/foo",
+		Body: []byte(strings.Repeat("Test", 100)),
+	}
+
+	// then the small message is sent unchanged and the large one compressed
+	wsconn.EXPECT().Send(aTestMessage.Bytes())
+	wsconn.EXPECT().Send(gomock.Any()).Do(func(data []byte) error {
+		msg, err := protocol.ParseMessage(data)
+		a.NoError(err)
+		a.True(msg.Compressed)
+		a.NoError(msg.DecompressBody())
+		a.Equal(largeMessage.Body, msg.Body)
+		return nil
+	})
+
+	// when sending both
+	handler.sendChannel <- aTestMessage.Bytes()
+	handler.sendChannel <- largeMessage.Bytes()
+	time.Sleep(time.Millisecond * 2)
+}
+
 func Test_BadCommands(t *testing.T) {
 	_, finish := testutil.NewMockCtrl(t)
 	defer finish()
 
-	badRequests := []string{"XXXX", "", ">", ">/foo", "+", "-", "send /foo"}
+	badRequests := []string{"XXXX", "", ">", ">/foo", "+", "-", "send /foo", "a", "a foo", "a 42", "a /foo x", "a /foo 42"}
 	wsconn, routerMock, messageStore := createDefaultMocks(badRequests)
 
 	counter := 0
@@ -153,6 +528,311 @@ func Test_BadCommands(t *testing.T) {
 	assert.Equal(t, len(badRequests), counter, "expected number of bad requests does not match")
 }
 
+func Test_WebSocketOutlivesTheHTTPTimeouts(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a webserver with HTTP/2 and short timeouts, serving the websocket handler
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+
+	server := webserver.New("localhost:0")
+	server.ReadTimeout = 20 * time.Millisecond
+	server.WriteTimeout = 20 * time.Millisecond
+	server.HTTP2 = true
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// when connecting and sending a command after the timeouts
+	conn, _, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	_, data, err := conn.ReadMessage()
+	a.NoError(err)
+	a.True(strings.HasPrefix(string(data), "#"+protocol.SUCCESS_CONNECTED))
+
+	time.Sleep(50 * time.Millisecond)
+	a.NoError(conn.WriteMessage(gorillaws.BinaryMessage, []byte("XXXX")))
+
+	// then the connection is still served
+	_, data, err = conn.ReadMessage()
+	a.NoError(err)
+	a.True(strings.HasPrefix(string(data), "!"+protocol.ERROR_BAD_REQUEST))
+}
+
+func Test_ClientMissingThePongIsDisconnected(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a webserver with a websocket handler sending pings
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	routerMock.EXPECT().MessageStore().Return(NewMockMessageStore(testutil.MockCtrl), nil).AnyTimes()
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+	handler.PingInterval = 20 * time.Millisecond
+	handler.PongTimeout = 20 * time.Millisecond
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	// and a subscribed client, which does not answer the pings
+	unsubscribed := make(chan bool, 1)
+	routerMock.EXPECT().Subscribe(routeMatcher{"/foo"}).Return(nil, nil)
+	routerMock.EXPECT().Unsubscribe(routeMatcher{"/foo"}).Do(func(*router.Route) { unsubscribed <- true })
+
+	conn, _, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetPingHandler(func(string) error { return nil })
+	a.NoError(conn.WriteMessage(gorillaws.BinaryMessage, []byte("+ /foo")))
+
+	// and a client answering the pings
+	answering, _, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer answering.Close()
+	answeringClosed := make(chan bool, 1)
+	go func() {
+		for {
+			if _, _, err := answering.ReadMessage(); err != nil {
+				answeringClosed <- true
+				return
+			}
+		}
+	}()
+
+	// then the client missing the pong is disconnected and its routes are removed
+	closed := make(chan bool)
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		a.Fail("The connection was not closed")
+	}
+	select {
+	case <-unsubscribed:
+	case <-time.After(time.Second):
+		a.Fail("The route was not removed")
+	}
+
+	// and the other client is still connected
+	select {
+	case <-answeringClosed:
+		a.Fail("The client answering the pings was disconnected")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_ReconnectClients(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a webserver with a websocket handler and a connected client
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	conn, _, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	if !a.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	_, data, err := conn.ReadMessage()
+	a.NoError(err)
+	a.True(strings.HasPrefix(string(data), "#"+protocol.SUCCESS_CONNECTED))
+
+	a.Equal(1, handler.Clients())
+
+	// when asking the clients to reconnect
+	a.Equal(1, handler.ReconnectClients(5*time.Second))
+
+	// then the client is notified with the maximum delay in milliseconds
+	_, data, err = conn.ReadMessage()
+	a.NoError(err)
+	a.Equal("#"+protocol.SUCCESS_RECONNECT+" 5000", string(data))
+
+	// and new connections are rejected
+	_, resp, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/testuser", nil)
+	a.Error(err)
+	if a.NotNil(resp) {
+		a.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+// tokenAuthenticator authenticates the bearer token `token-<user>` as the user
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) AuthenticateConnection(r *http.Request) (string, map[string]interface{}, error) {
+	token := auth.BearerToken(r)
+	if !strings.HasPrefix(token, "token-") {
+		return "", nil, auth.ErrInvalidToken
+	}
+	return strings.TrimPrefix(token, "token-"), nil, nil
+}
+
+func Test_AuthenticatedHandshake(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a websocket handler with an authenticator
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+	handler.Authenticator = tokenAuthenticator{}
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	dial := func(path, token string) (*gorillaws.Conn, int) {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		conn, resp, err := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+path, header)
+		if err != nil {
+			if a.NotNil(resp) {
+				return nil, resp.StatusCode
+			}
+			return nil, 0
+		}
+		return conn, resp.StatusCode
+	}
+
+	// when connecting without a valid token, then the handshake is rejected before upgrading
+	_, code := dial("/stream/user/user01", "")
+	a.Equal(http.StatusUnauthorized, code)
+	_, code = dial("/stream/user/user01", "invalid")
+	a.Equal(http.StatusUnauthorized, code)
+
+	// and a token of another user is forbidden
+	_, code = dial("/stream/user/user01", "token-user02")
+	a.Equal(http.StatusForbidden, code)
+
+	// and a valid token connects as the authenticated user, also when passed in the query
+	conn, code := dial("/stream/?access_token=token-user01", "")
+	if a.Equal(http.StatusSwitchingProtocols, code) {
+		defer conn.Close()
+		_, data, err := conn.ReadMessage()
+		a.NoError(err)
+		a.Contains(string(data), `"UserId": "user01"`)
+	}
+}
+
+func Test_SubprotocolNegotiation(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	dial := func(subprotocols ...string) (*gorillaws.Conn, *http.Response) {
+		dialer := *gorillaws.DefaultDialer
+		dialer.Subprotocols = subprotocols
+		conn, resp, _ := dialer.Dial("ws://"+server.GetAddr()+"/stream/user/user01", nil)
+		return conn, resp
+	}
+
+	// when requesting a supported version among unknown ones, then it is selected
+	conn, resp := dial("guble.v9", protocol.SubprotocolV1)
+	if a.Equal(http.StatusSwitchingProtocols, resp.StatusCode) {
+		a.Equal(protocol.SubprotocolV1, conn.Subprotocol())
+		_, data, err := conn.ReadMessage()
+		a.NoError(err)
+		a.Contains(string(data), protocol.SUCCESS_CONNECTED)
+		conn.Close()
+	}
+
+	// and a client without a subprotocol is connected with the version 1, without a negotiated subprotocol
+	conn, resp = dial()
+	if a.Equal(http.StatusSwitchingProtocols, resp.StatusCode) {
+		a.Equal("", conn.Subprotocol())
+		conn.Close()
+	}
+
+	// but a client with only unknown versions is rejected, with the versions of the server
+	_, resp = dial("guble.v9")
+	if a.NotNil(resp) {
+		a.Equal(http.StatusBadRequest, resp.StatusCode)
+		a.Equal(protocol.SubprotocolV1, resp.Header.Get(protocol.SubprotocolsHeader))
+	}
+}
+
+func Test_HandshakeChecksTheOrigin(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given a websocket handler checking the origins of CORS
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().AccessManager().Return(auth.NewAllowAllAccessManager(true), nil)
+	handler, err := NewWSHandler(routerMock, "/stream/")
+	a.NoError(err)
+	handler.CheckOrigin = webserver.NewCORS("https://app.example.com", "", false).AllowsOrigin
+
+	server := webserver.New("localhost:0")
+	server.Handle(handler.GetPrefix(), handler)
+	a.NoError(server.Start())
+	defer server.Stop()
+
+	dial := func(origin string) (*gorillaws.Conn, *http.Response) {
+		header := http.Header{}
+		header.Set("Origin", origin)
+		conn, resp, _ := gorillaws.DefaultDialer.Dial("ws://"+server.GetAddr()+"/stream/user/user01", header)
+		return conn, resp
+	}
+
+	// when connecting from an allowed origin, then the connection is upgraded
+	conn, resp := dial("https://app.example.com")
+	if a.Equal(http.StatusSwitchingProtocols, resp.StatusCode) {
+		conn.Close()
+	}
+
+	// and another origin is rejected
+	_, resp = dial("https://evil.example.com")
+	if a.NotNil(resp) {
+		a.Equal(http.StatusForbidden, resp.StatusCode)
+	}
+}
+
 func TestExtractUserId(t *testing.T) {
 	assert.Equal(t, "marvin", extractUserID("/foo/user/marvin"))
 	assert.Equal(t, "marvin", extractUserID("/user/marvin"))
@@ -260,3 +940,51 @@ func (notify connectedNotificationMatcher) Matches(x interface{}) bool {
 func (notify connectedNotificationMatcher) String() string {
 	return fmt.Sprintf("is connected message")
 }
+
+func Test_AckCmdAcknowledgesTheMessageOfItsPathOnly(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	// given at-least-once subscriptions to two topics, which have both sent a message with the same id
+	kvs := kvstore.NewMemoryKVStore()
+	ws := NewWebSocket(testWSHandler(NewMockRouter(testutil.MockCtrl), auth.NewAllowAllAccessManager(true)), nil, "userId")
+	for _, path := range []protocol.Path{"/foo", "/bar"} {
+		rec, msgChannel, _, _, err := aMockedAckReceiver(string(path), kvs)
+		a.NoError(err)
+		go rec.send(5, []byte("message-5"))
+		expectMessages(a, msgChannel, "message-5")
+		ws.receivers[path] = rec
+	}
+
+	// when the message of one topic is acknowledged
+	ws.handleAckCmd(&protocol.Cmd{Name: protocol.CmdAck, Arg: "/foo 5"})
+
+	// then only its subscription is acknowledged
+	a.Empty(ws.sendChannel)
+	value, exist, err := kvs.Get(ackSchema, "userId /foo")
+	a.NoError(err)
+	a.True(exist)
+	a.Equal("5", string(value))
+	_, exist, err = kvs.Get(ackSchema, "userId /bar")
+	a.NoError(err)
+	a.False(exist)
+	a.Equal([]uint64{5}, ws.receivers["/bar"].unackedIDs)
+
+	// and an ack of a path without subscription is rejected
+	ws.handleAckCmd(&protocol.Cmd{Name: protocol.CmdAck, Arg: "/baz 5"})
+	a.Contains(string(<-ws.sendChannel), "!error-bad-request no subscription to /baz")
+}
+
+func Test_BadReceiveCmdStartsWithThePath(t *testing.T) {
+	_, finish := testutil.NewMockCtrl(t)
+	defer finish()
+	a := assert.New(t)
+
+	routerMock := NewMockRouter(testutil.MockCtrl)
+	routerMock.EXPECT().MessageStore().Return(NewMockMessageStore(testutil.MockCtrl), nil).AnyTimes()
+	ws := NewWebSocket(testWSHandler(routerMock, auth.NewAllowAllAccessManager(true)), nil, "testuser")
+
+	ws.receive(&protocol.Cmd{Name: protocol.CmdReceive, Arg: "/foo x"}, false)
+	a.Contains(string(<-ws.sendChannel), "!error-bad-request /foo startid has to be empty or int")
+}